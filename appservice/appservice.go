@@ -16,6 +16,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -65,6 +66,11 @@ func Create() *AppService {
 	as.Router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/app/v1/ping", as.PostPing).Methods(http.MethodPost)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/protocol/{protocol}", as.GetThirdPartyProtocol).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location/{protocol}", as.GetThirdPartyLocation).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location", as.GetThirdPartyLocationByAlias).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user/{protocol}", as.GetThirdPartyUser).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user", as.GetThirdPartyUserByID).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/mau/live", as.GetLive).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/mau/ready", as.GetReady).Methods(http.MethodGet)
 
@@ -128,6 +134,19 @@ func (qh *QueryHandlerStub) QueryUser(userID id.UserID) bool {
 	return false
 }
 
+// ThirdPartyHandler handles third-party protocol lookups from the homeserver.
+// See https://spec.matrix.org/v1.12/application-service-api/#third-party-networks
+//
+// Returning a nil protocol or an empty list will make the appservice respond with M_NOT_FOUND.
+// If an [Error] is returned, it will be sent to the homeserver as-is.
+type ThirdPartyHandler interface {
+	GetProtocol(ctx context.Context, protocol string) (*mautrix.ThirdPartyProtocol, error)
+	GetLocation(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error)
+	GetUser(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error)
+	GetLocationByAlias(ctx context.Context, alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error)
+	GetUserByID(ctx context.Context, userID id.UserID) ([]*mautrix.ThirdPartyUser, error)
+}
+
 type WebsocketHandler func(WebsocketCommand) (ok bool, data interface{})
 
 type StateStore interface {
@@ -159,6 +178,15 @@ type AppService struct {
 	OTKCounts      chan *mautrix.OTKCount
 	QueryHandler   QueryHandler
 	StateStore     StateStore
+	// ThirdPartyHandler is optional. If it's not set, all third-party lookups will return M_NOT_FOUND.
+	ThirdPartyHandler ThirdPartyHandler
+	// Inbox is optional. If set, events are persisted before transactions are acknowledged. See [TransactionInbox].
+	Inbox TransactionInbox
+
+	inboxEvents             map[*event.Event]*inboxEntry
+	inboxReplayed           chan struct{}
+	inboxLock               sync.Mutex
+	receivesForwardedEvents atomic.Bool
 
 	Router       *mux.Router
 	UserAgent    string
@@ -169,6 +197,8 @@ type AppService struct {
 	SpecVersions *mautrix.RespVersions
 
 	DefaultHTTPRetries int
+	// RateLimiter is shared by all clients created by this appservice, except external clients using a different homeserver.
+	RateLimiter *mautrix.RateLimiter
 
 	Live  bool
 	Ready bool
@@ -180,12 +210,11 @@ type AppService struct {
 
 	ws                    *websocket.Conn
 	wsWriteLock           sync.Mutex
+	wsMux                 *WebsocketMultiplexer
 	StopWebsocket         func(error)
 	websocketHandlers     map[string]WebsocketHandler
 	websocketHandlersLock sync.RWMutex
-	websocketRequests     map[int]chan<- *WebsocketCommand
-	websocketRequestsLock sync.RWMutex
-	websocketRequestID    int32
+	websocketRequests     websocketRequestTracker
 	// ProcessID is an identifier sent to the websocket proxy for debugging connections
 	ProcessID string
 
@@ -214,7 +243,6 @@ func (as *AppService) PrepareWebsocket() {
 	if as.websocketHandlers == nil {
 		as.websocketHandlers = make(map[string]WebsocketHandler, 32)
 		as.websocketHandlers[WebsocketCommandHTTPProxy] = as.WebsocketHTTPProxy
-		as.websocketRequests = make(map[int]chan<- *WebsocketCommand)
 	}
 }
 
@@ -355,7 +383,7 @@ func (as *AppService) SetHomeserverURL(homeserverURL string) error {
 // This does not do any validation, and it does not cache the client.
 // Usually you should prefer [AppService.Client] or [AppService.Intent] over this method.
 func (as *AppService) NewMautrixClient(userID id.UserID) *mautrix.Client {
-	return &mautrix.Client{
+	client := &mautrix.Client{
 		HomeserverURL:       as.hsURLForClient,
 		UserID:              userID,
 		SetAppServiceUserID: true,
@@ -367,6 +395,10 @@ func (as *AppService) NewMautrixClient(userID id.UserID) *mautrix.Client {
 		DefaultHTTPRetries:  as.DefaultHTTPRetries,
 		SpecVersions:        as.SpecVersions,
 	}
+	if as.RateLimiter != nil {
+		client.RateLimiter = as.RateLimiter
+	}
+	return client
 }
 
 // NewExternalMautrixClient creates a new [mautrix.Client] instance for an external user,
@@ -380,6 +412,7 @@ func (as *AppService) NewExternalMautrixClient(userID id.UserID, token string, h
 	client.SetAppServiceUserID = false
 	if homeserverURL != "" {
 		client.Client = &http.Client{Timeout: 180 * time.Second}
+		client.RateLimiter = nil
 		var err error
 		client.HomeserverURL, err = mautrix.ParseAndNormalizeBaseURL(homeserverURL)
 		if err != nil {
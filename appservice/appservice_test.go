@@ -2,6 +2,7 @@ package appservice
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -10,6 +11,10 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestClient_UnixSocket(t *testing.T) {
@@ -40,3 +45,65 @@ func TestClient_UnixSocket(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "@joe:example.org", string(resp.UserID))
 }
+
+type testThirdPartyHandler struct{}
+
+func (tph *testThirdPartyHandler) GetProtocol(ctx context.Context, protocol string) (*mautrix.ThirdPartyProtocol, error) {
+	if protocol != "test" {
+		return nil, nil
+	}
+	return &mautrix.ThirdPartyProtocol{UserFields: []string{"username"}}, nil
+}
+
+func (tph *testThirdPartyHandler) GetLocation(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error) {
+	return nil, Error{HTTPStatus: http.StatusTeapot, ErrorCode: ErrUnknown, Message: "no locations here"}
+}
+
+func (tph *testThirdPartyHandler) GetUser(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error) {
+	return []*mautrix.ThirdPartyUser{{
+		UserID:   id.UserID("@test_" + fields["username"] + ":example.com"),
+		Protocol: protocol,
+		Fields:   map[string]any{"username": fields["username"]},
+	}}, nil
+}
+
+func (tph *testThirdPartyHandler) GetLocationByAlias(ctx context.Context, alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error) {
+	return nil, nil
+}
+
+func (tph *testThirdPartyHandler) GetUserByID(ctx context.Context, userID id.UserID) ([]*mautrix.ThirdPartyUser, error) {
+	return nil, nil
+}
+
+func TestAppService_ThirdParty(t *testing.T) {
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer hs_token")
+		w := httptest.NewRecorder()
+		as.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request("/_matrix/app/v1/thirdparty/protocol/test").Code)
+
+	as.ThirdPartyHandler = &testThirdPartyHandler{}
+	w := request("/_matrix/app/v1/thirdparty/protocol/test")
+	require.Equal(t, http.StatusOK, w.Code)
+	var protocol mautrix.ThirdPartyProtocol
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &protocol))
+	assert.Equal(t, []string{"username"}, protocol.UserFields)
+	assert.Equal(t, http.StatusNotFound, request("/_matrix/app/v1/thirdparty/protocol/other").Code)
+
+	w = request("/_matrix/app/v1/thirdparty/user/test?username=alice")
+	require.Equal(t, http.StatusOK, w.Code)
+	var users []*mautrix.ThirdPartyUser
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+	require.Len(t, users, 1)
+	assert.Equal(t, id.UserID("@test_alice:example.com"), users[0].UserID)
+
+	assert.Equal(t, http.StatusTeapot, request("/_matrix/app/v1/thirdparty/location/test").Code)
+	assert.Equal(t, http.StatusNotFound, request("/_matrix/app/v1/thirdparty/user?userid=@foo:example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, request("/_matrix/app/v1/thirdparty/location").Code)
+}
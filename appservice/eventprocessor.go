@@ -9,7 +9,9 @@ package appservice
 import (
 	"context"
 	"encoding/json"
+	"hash/fnv"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -24,6 +26,11 @@ const (
 	AsyncHandlers ExecMode = iota
 	AsyncLoop
 	Sync
+	// PerRoom handles events of each room in order, but different rooms in parallel.
+	// Rooms are sharded to a fixed pool of workers (see [EventProcessor.PerRoomWorkers]),
+	// so a slow handler will also delay other rooms in the same shard.
+	// Events without a room ID are sharded by sender instead.
+	PerRoom
 )
 
 type EventHandler = func(ctx context.Context, evt *event.Event)
@@ -33,9 +40,20 @@ type DeviceListHandler = func(ctx context.Context, lists *mautrix.DeviceLists, s
 type EventProcessor struct {
 	ExecMode ExecMode
 
+	// ExecSyncWarnTime and ExecSyncTimeout apply to the Sync and PerRoom modes.
+	// In the PerRoom mode, the worker keeps waiting for the handler after ExecSyncTimeout to keep events in order,
+	// so the timeout only logs an error.
 	ExecSyncWarnTime time.Duration
 	ExecSyncTimeout  time.Duration
 
+	// PerRoomWorkers is the number of workers used in the PerRoom mode.
+	PerRoomWorkers int
+	// PerRoomQueueSize is the number of events each PerRoom worker can buffer before Dispatch starts blocking.
+	PerRoomQueueSize int
+
+	workerQueues []chan *queuedEvent
+	workerInit   sync.Once
+
 	as       *AppService
 	stop     chan struct{}
 	handlers map[event.Type][]EventHandler
@@ -54,6 +72,9 @@ func NewEventProcessor(as *AppService) *EventProcessor {
 		ExecSyncWarnTime: 30 * time.Second,
 		ExecSyncTimeout:  15 * time.Minute,
 
+		PerRoomWorkers:   16,
+		PerRoomQueueSize: 128,
+
 		otkHandlers:        make([]OTKHandler, 0),
 		deviceListHandlers: make([]DeviceListHandler, 0),
 	}
@@ -126,53 +147,145 @@ func (ep *EventProcessor) DispatchDeviceList(ctx context.Context, dl *mautrix.De
 }
 
 func (ep *EventProcessor) Dispatch(ctx context.Context, evt *event.Event) {
+	ctx, markHandled := ep.as.startInboxEvent(ctx, evt)
 	handlers, ok := ep.handlers[evt.Type]
 	if !ok {
+		markHandled()
 		return
 	}
 	switch ep.ExecMode {
 	case AsyncHandlers:
+		if !ep.as.inboxEnabled() {
+			for _, handler := range handlers {
+				go ep.callHandler(ctx, handler, evt)
+			}
+			return
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(handlers))
 		for _, handler := range handlers {
-			go ep.callHandler(ctx, handler, evt)
+			go func() {
+				defer wg.Done()
+				ep.callHandler(ctx, handler, evt)
+			}()
 		}
+		go func() {
+			wg.Wait()
+			markHandled()
+		}()
 	case AsyncLoop:
 		go func() {
 			for _, handler := range handlers {
 				ep.callHandler(ctx, handler, evt)
 			}
+			markHandled()
 		}()
 	case Sync:
-		if ep.ExecSyncWarnTime == 0 && ep.ExecSyncTimeout == 0 {
-			for _, handler := range handlers {
-				ep.callHandler(ctx, handler, evt)
-			}
-			return
+		ep.callHandlersAndWait(ctx, handlers, evt, markHandled, false)
+	case PerRoom:
+		ep.dispatchToWorker(ctx, handlers, evt, markHandled)
+	}
+}
+
+// callHandlersAndWait calls all handlers of an event in order, logging a warning if they take longer than
+// ExecSyncWarnTime and giving up waiting after ExecSyncTimeout. If keepOrder is true, it logs an error
+// after ExecSyncTimeout, but doesn't return until the handlers are done.
+func (ep *EventProcessor) callHandlersAndWait(ctx context.Context, handlers []EventHandler, evt *event.Event, markHandled func(), keepOrder bool) {
+	if ep.ExecSyncWarnTime == 0 && ep.ExecSyncTimeout == 0 {
+		for _, handler := range handlers {
+			ep.callHandler(ctx, handler, evt)
 		}
-		doneChan := make(chan struct{})
-		go func() {
-			for _, handler := range handlers {
-				ep.callHandler(ctx, handler, evt)
-			}
-			close(doneChan)
-		}()
+		markHandled()
+		return
+	}
+	doneChan := make(chan struct{})
+	go func() {
+		for _, handler := range handlers {
+			ep.callHandler(ctx, handler, evt)
+		}
+		markHandled()
+		close(doneChan)
+	}()
+	select {
+	case <-doneChan:
+		return
+	case <-time.After(ep.ExecSyncWarnTime):
+		log := ep.as.Log.With().
+			Str("event_id", evt.ID.String()).
+			Str("event_type", evt.Type.String()).
+			Str("room_id", evt.RoomID.String()).
+			Logger()
+		log.Warn().Msg("Handling event in appservice transaction channel is taking long")
 		select {
 		case <-doneChan:
 			return
-		case <-time.After(ep.ExecSyncWarnTime):
-			log := ep.as.Log.With().
-				Str("event_id", evt.ID.String()).
-				Str("event_type", evt.Type.String()).
-				Logger()
-			log.Warn().Msg("Handling event in appservice transaction channel is taking long")
-			select {
-			case <-doneChan:
-				return
-			case <-time.After(ep.ExecSyncTimeout):
+		case <-time.After(ep.ExecSyncTimeout):
+			if !keepOrder {
 				log.Error().Msg("Giving up waiting for event handler")
+				return
 			}
+			log.Error().Msg("Event handler is taking too long, other events in the same room are waiting for it")
+			<-doneChan
 		}
 	}
 }
+
+type queuedEvent struct {
+	ctx         context.Context
+	evt         *event.Event
+	handlers    []EventHandler
+	markHandled func()
+}
+
+func (ep *EventProcessor) initWorkers() {
+	workers := ep.PerRoomWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	ep.workerQueues = make([]chan *queuedEvent, workers)
+	for i := range ep.workerQueues {
+		ep.workerQueues[i] = make(chan *queuedEvent, ep.PerRoomQueueSize)
+		go ep.runWorker(ep.workerQueues[i])
+	}
+}
+
+func (ep *EventProcessor) runWorker(queue <-chan *queuedEvent) {
+	for {
+		select {
+		case item := <-queue:
+			// Events in the same room must not be handled in parallel, so the worker always waits for the handlers
+			ep.callHandlersAndWait(item.ctx, item.handlers, item.evt, item.markHandled, true)
+		case <-ep.stop:
+			return
+		}
+	}
+}
+
+func (ep *EventProcessor) dispatchToWorker(ctx context.Context, handlers []EventHandler, evt *event.Event, markHandled func()) {
+	ep.workerInit.Do(ep.initWorkers)
+	key := string(evt.RoomID)
+	if key == "" {
+		key = string(evt.Sender)
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	queue := ep.workerQueues[hash.Sum32()%uint32(len(ep.workerQueues))]
+	item := &queuedEvent{ctx: ctx, evt: evt, handlers: handlers, markHandled: markHandled}
+	select {
+	case queue <- item:
+		return
+	default:
+	}
+	ep.as.Log.Warn().
+		Str("event_id", evt.ID.String()).
+		Str("room_id", evt.RoomID.String()).
+		Msg("Per-room event queue is full, waiting for space")
+	select {
+	case queue <- item:
+	case <-ep.stop:
+	}
+}
+
 func (ep *EventProcessor) startEvents(ctx context.Context) {
 	for {
 		select {
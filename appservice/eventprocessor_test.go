@@ -0,0 +1,119 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func shardOf(roomID id.RoomID, workers int) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(roomID))
+	return hash.Sum32() % uint32(workers)
+}
+
+func TestEventProcessor_PerRoom(t *testing.T) {
+	ep := NewEventProcessor(Create())
+	ep.ExecMode = PerRoom
+	ep.PerRoomWorkers = 4
+	ep.PerRoomQueueSize = 4
+	defer ep.Stop()
+
+	slowRoom := id.RoomID("!slow:example.com")
+	fastRoom := slowRoom
+	for i := 0; shardOf(fastRoom, ep.PerRoomWorkers) == shardOf(slowRoom, ep.PerRoomWorkers); i++ {
+		fastRoom = id.RoomID(fmt.Sprintf("!fast%d:example.com", i))
+	}
+
+	unblock := make(chan struct{})
+	fastDone := make(chan struct{})
+	var lock sync.Mutex
+	var order []string
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		if evt.RoomID == slowRoom && evt.ID == "$slow0" {
+			<-unblock
+		}
+		lock.Lock()
+		order = append(order, evt.ID.String())
+		lock.Unlock()
+		if evt.RoomID == fastRoom {
+			close(fastDone)
+		}
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		ep.Dispatch(ctx, &event.Event{ID: id.EventID(fmt.Sprintf("$slow%d", i)), RoomID: slowRoom, Type: event.EventMessage})
+	}
+	ep.Dispatch(ctx, &event.Event{ID: "$fast", RoomID: fastRoom, Type: event.EventMessage})
+
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event in other room was blocked by slow room")
+	}
+	close(unblock)
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(order) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"$fast", "$slow0", "$slow1", "$slow2"}, order)
+}
+
+func TestEventProcessor_PerRoomTimeoutKeepsOrder(t *testing.T) {
+	ep := NewEventProcessor(Create())
+	ep.ExecMode = PerRoom
+	ep.ExecSyncWarnTime = 10 * time.Millisecond
+	ep.ExecSyncTimeout = 10 * time.Millisecond
+	defer ep.Stop()
+
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	var running int
+	var order []string
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		lock.Lock()
+		running++
+		assert.Equal(t, 1, running, "events in the same room must not be handled in parallel")
+		lock.Unlock()
+		if evt.ID == "$first" {
+			<-unblock
+		}
+		lock.Lock()
+		running--
+		order = append(order, evt.ID.String())
+		lock.Unlock()
+	})
+
+	ctx := context.Background()
+	ep.Dispatch(ctx, &event.Event{ID: "$first", RoomID: "!room:example.com", Type: event.EventMessage})
+	ep.Dispatch(ctx, &event.Event{ID: "$second", RoomID: "!room:example.com", Type: event.EventMessage})
+	// Wait for well past the timeout before letting the first handler finish
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	assert.Empty(t, order)
+	lock.Unlock()
+	close(unblock)
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(order) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"$first", "$second"}, order)
+}
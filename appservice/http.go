@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -141,28 +142,55 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 			HTTPStatus: http.StatusBadRequest,
 			Message:    "Failed to parse body JSON",
 		}.Write(w)
+	} else if err = as.handleTransaction(ctx, txnID, &txn); err != nil {
+		log.Err(err).Msg("Failed to handle transaction")
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Failed to handle transaction",
+		}.Write(w)
 	} else {
-		as.handleTransaction(ctx, txnID, &txn)
 		WriteBlankOK(w)
 	}
 }
 
-func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction) {
+func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction) error {
 	log := zerolog.Ctx(ctx)
 	log.Debug().Object("content", txn).Msg("Starting handling of transaction")
+	evts := make([]*event.Event, 0, len(txn.Events))
 	if as.Registration.EphemeralEvents {
 		if txn.EphemeralEvents != nil {
-			as.handleEvents(ctx, txn.EphemeralEvents, event.EphemeralEventType)
+			evts = append(evts, prepareEvents(txn.EphemeralEvents, event.EphemeralEventType)...)
 		} else if txn.MSC2409EphemeralEvents != nil {
-			as.handleEvents(ctx, txn.MSC2409EphemeralEvents, event.EphemeralEventType)
+			evts = append(evts, prepareEvents(txn.MSC2409EphemeralEvents, event.EphemeralEventType)...)
 		}
 		if txn.ToDeviceEvents != nil {
-			as.handleEvents(ctx, txn.ToDeviceEvents, event.ToDeviceEventType)
+			evts = append(evts, prepareEvents(txn.ToDeviceEvents, event.ToDeviceEventType)...)
 		} else if txn.MSC2409ToDeviceEvents != nil {
-			as.handleEvents(ctx, txn.MSC2409ToDeviceEvents, event.ToDeviceEventType)
+			evts = append(evts, prepareEvents(txn.MSC2409ToDeviceEvents, event.ToDeviceEventType)...)
+		}
+	}
+	pdus := prepareEvents(txn.Events, event.UnknownEventType)
+	evts = append(evts, pdus...)
+	if as.Inbox != nil && id != "" {
+		err := as.waitForInboxReplay(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for inbox replay: %w", err)
+		}
+		isNew, err := as.Inbox.Put(ctx, id, pdus)
+		if err != nil {
+			return fmt.Errorf("failed to store transaction in inbox: %w", err)
+		} else if !isNew {
+			log.Debug().Msg("Ignoring duplicate transaction (already in inbox)")
+			as.txnIDC.MarkProcessed(id)
+			return nil
 		}
+		as.trackInboxEvents(id, pdus)
+	}
+	for _, evt := range evts {
+		as.parseEventContent(ctx, evt)
+		as.dispatchEvent(ctx, evt)
 	}
-	as.handleEvents(ctx, txn.Events, event.UnknownEventType)
 	if txn.DeviceLists != nil {
 		as.handleDeviceLists(ctx, txn.DeviceLists)
 	} else if txn.MSC3202DeviceLists != nil {
@@ -175,6 +203,7 @@ func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Tra
 	}
 	as.txnIDC.MarkProcessed(id)
 	log.Debug().Msg("Finished dispatching events from transaction")
+	return nil
 }
 
 func (as *AppService) handleOTKCounts(ctx context.Context, otks OTKCountMap) {
@@ -201,54 +230,66 @@ func (as *AppService) handleDeviceLists(ctx context.Context, dl *mautrix.DeviceL
 	}
 }
 
-func (as *AppService) handleEvents(ctx context.Context, evts []*event.Event, defaultTypeClass event.TypeClass) {
-	log := zerolog.Ctx(ctx)
+func prepareEvents(evts []*event.Event, defaultTypeClass event.TypeClass) []*event.Event {
 	for _, evt := range evts {
 		evt.Mautrix.ReceivedAt = time.Now()
 		if defaultTypeClass != event.UnknownEventType {
-			if defaultTypeClass == event.EphemeralEventType {
-				evt.Mautrix.EventSource = event.SourceEphemeral
-			} else if defaultTypeClass == event.ToDeviceEventType {
-				evt.Mautrix.EventSource = event.SourceToDevice
-			}
 			evt.Type.Class = defaultTypeClass
 		} else if evt.StateKey != nil {
-			evt.Mautrix.EventSource = event.SourceTimeline & event.SourceJoin
 			evt.Type.Class = event.StateEventType
 		} else {
-			evt.Mautrix.EventSource = event.SourceTimeline
 			evt.Type.Class = event.MessageEventType
 		}
-		err := evt.Content.ParseRaw(evt.Type)
-		if errors.Is(err, event.ErrUnsupportedContentType) {
-			log.Debug().Str("event_id", evt.ID.String()).Msg("Not parsing content of unsupported event")
-		} else if err != nil {
-			log.Warn().Err(err).
-				Str("event_id", evt.ID.String()).
-				Str("event_type", evt.Type.Type).
-				Str("event_type_class", evt.Type.Class.Name()).
-				Msg("Failed to parse content of event")
-		}
+		setEventSource(evt)
+	}
+	return evts
+}
 
-		if evt.Type.IsState() {
-			mautrix.UpdateStateStore(ctx, as.StateStore, evt)
-		}
-		var ch chan *event.Event
-		if evt.Type.Class == event.ToDeviceEventType {
-			ch = as.ToDeviceEvents
-		} else {
-			ch = as.Events
-		}
-		select {
-		case ch <- evt:
-		default:
-			log.Warn().
-				Str("event_id", evt.ID.String()).
-				Str("event_type", evt.Type.Type).
-				Str("event_type_class", evt.Type.Class.Name()).
-				Msg("Event channel is full")
-			ch <- evt
-		}
+func setEventSource(evt *event.Event) {
+	switch evt.Type.Class {
+	case event.EphemeralEventType:
+		evt.Mautrix.EventSource = event.SourceEphemeral
+	case event.ToDeviceEventType:
+		evt.Mautrix.EventSource = event.SourceToDevice
+	case event.StateEventType:
+		evt.Mautrix.EventSource = event.SourceTimeline & event.SourceJoin
+	default:
+		evt.Mautrix.EventSource = event.SourceTimeline
+	}
+}
+
+func (as *AppService) parseEventContent(ctx context.Context, evt *event.Event) {
+	err := evt.Content.ParseRaw(evt.Type)
+	if errors.Is(err, event.ErrUnsupportedContentType) {
+		zerolog.Ctx(ctx).Debug().Str("event_id", evt.ID.String()).Msg("Not parsing content of unsupported event")
+	} else if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("event_id", evt.ID.String()).
+			Str("event_type", evt.Type.Type).
+			Str("event_type_class", evt.Type.Class.Name()).
+			Msg("Failed to parse content of event")
+	}
+}
+
+func (as *AppService) dispatchEvent(ctx context.Context, evt *event.Event) {
+	if evt.Type.IsState() {
+		mautrix.UpdateStateStore(ctx, as.StateStore, evt)
+	}
+	var ch chan *event.Event
+	if evt.Type.Class == event.ToDeviceEventType {
+		ch = as.ToDeviceEvents
+	} else {
+		ch = as.Events
+	}
+	select {
+	case ch <- evt:
+	default:
+		zerolog.Ctx(ctx).Warn().
+			Str("event_id", evt.ID.String()).
+			Str("event_type", evt.Type.Type).
+			Str("event_type_class", evt.Type.Class.Name()).
+			Msg("Event channel is full")
+		ch <- evt
 	}
 }
 
@@ -290,6 +331,128 @@ func (as *AppService) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (as *AppService) writeThirdPartyResponse(w http.ResponseWriter, r *http.Request, resp any, found bool, err error) {
+	var asErr Error
+	if errors.As(err, &asErr) {
+		asErr.Write(w)
+	} else if err != nil {
+		as.Log.Err(err).Str("path", r.URL.Path).Msg("Failed to handle third-party lookup")
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Failed to handle third-party lookup",
+		}.Write(w)
+	} else if !found {
+		Error{
+			ErrorCode:  ErrNotFound,
+			HTTPStatus: http.StatusNotFound,
+			Message:    "No results found",
+		}.Write(w)
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func thirdPartyFields(r *http.Request) map[string]string {
+	query := r.URL.Query()
+	fields := make(map[string]string, len(query))
+	for key := range query {
+		if key != "access_token" {
+			fields[key] = query.Get(key)
+		}
+	}
+	return fields
+}
+
+// GetThirdPartyProtocol handles a /thirdparty/protocol GET call from the homeserver.
+func (as *AppService) GetThirdPartyProtocol(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	var resp *mautrix.ThirdPartyProtocol
+	var err error
+	if as.ThirdPartyHandler != nil {
+		resp, err = as.ThirdPartyHandler.GetProtocol(as.thirdPartyContext(r), mux.Vars(r)["protocol"])
+	}
+	as.writeThirdPartyResponse(w, r, resp, resp != nil, err)
+}
+
+// GetThirdPartyLocation handles a /thirdparty/location/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocation(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	var resp []*mautrix.ThirdPartyLocation
+	var err error
+	if as.ThirdPartyHandler != nil {
+		resp, err = as.ThirdPartyHandler.GetLocation(as.thirdPartyContext(r), mux.Vars(r)["protocol"], thirdPartyFields(r))
+	}
+	as.writeThirdPartyResponse(w, r, resp, len(resp) > 0, err)
+}
+
+// GetThirdPartyUser handles a /thirdparty/user/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyUser(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	var resp []*mautrix.ThirdPartyUser
+	var err error
+	if as.ThirdPartyHandler != nil {
+		resp, err = as.ThirdPartyHandler.GetUser(as.thirdPartyContext(r), mux.Vars(r)["protocol"], thirdPartyFields(r))
+	}
+	as.writeThirdPartyResponse(w, r, resp, len(resp) > 0, err)
+}
+
+// GetThirdPartyLocationByAlias handles a /thirdparty/location GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocationByAlias(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	alias := r.URL.Query().Get("alias")
+	if alias == "" {
+		Error{
+			ErrorCode:  ErrMissingParam,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Missing alias query parameter",
+		}.Write(w)
+		return
+	}
+	var resp []*mautrix.ThirdPartyLocation
+	var err error
+	if as.ThirdPartyHandler != nil {
+		resp, err = as.ThirdPartyHandler.GetLocationByAlias(as.thirdPartyContext(r), id.RoomAlias(alias))
+	}
+	as.writeThirdPartyResponse(w, r, resp, len(resp) > 0, err)
+}
+
+// GetThirdPartyUserByID handles a /thirdparty/user GET call from the homeserver.
+func (as *AppService) GetThirdPartyUserByID(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	userID := r.URL.Query().Get("userid")
+	if userID == "" {
+		Error{
+			ErrorCode:  ErrMissingParam,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Missing userid query parameter",
+		}.Write(w)
+		return
+	}
+	var resp []*mautrix.ThirdPartyUser
+	var err error
+	if as.ThirdPartyHandler != nil {
+		resp, err = as.ThirdPartyHandler.GetUserByID(as.thirdPartyContext(r), id.UserID(userID))
+	}
+	as.writeThirdPartyResponse(w, r, resp, len(resp) > 0, err)
+}
+
+func (as *AppService) thirdPartyContext(r *http.Request) context.Context {
+	return as.Log.With().Str("third_party_lookup", r.URL.Path).Logger().WithContext(r.Context())
+}
+
 func (as *AppService) PostPing(w http.ResponseWriter, r *http.Request) {
 	if !as.CheckServerToken(w, r) {
 		return
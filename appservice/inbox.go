@@ -0,0 +1,264 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// TransactionInbox is a persistent store for events received from the homeserver.
+//
+// When [AppService.Inbox] is set, the room events (PDUs) in each transaction are stored in the inbox before
+// the transaction is acknowledged, and each event is removed from the inbox after all handlers
+// have finished processing it (see [AppService.MarkEventHandled] and [DeferEventHandled]). Events that were still
+// in the inbox when the process stopped are redelivered by [AppService.ReplayInbox],
+// which means handlers get at-least-once delivery and must be able to handle duplicates.
+//
+// Ephemeral events (typing notifications, receipts and presence), to-device events, device list updates
+// and one-time key counts are not stored: they're dispatched normally, but not redelivered.
+type TransactionInbox interface {
+	// Put stores all events of a transaction. If the transaction ID has already been stored,
+	// it must not store anything and return false.
+	Put(ctx context.Context, txnID string, evts []*event.Event) (isNew bool, err error)
+	// MarkDone removes a single event from the inbox.
+	MarkDone(ctx context.Context, txnID string, index int) error
+	// GetPending returns all events that haven't been marked as done, in the order they were received.
+	// The type class of the returned events must be the same as when they were stored.
+	GetPending(ctx context.Context) ([]*InboxEvent, error)
+}
+
+// InboxEvent is an event stored in a [TransactionInbox].
+type InboxEvent struct {
+	TxnID string
+	Index int
+	Event *event.Event
+}
+
+type inboxEntry struct {
+	txnID string
+	index int
+	// holds is the number of MarkEventHandled calls that are still needed before the event is done.
+	holds int
+	// forwardedFrom is the original event if this event was passed on from the inbox of another appservice.
+	forwardedFrom *inboxEventRef
+}
+
+// inboxEnabled checks if events dispatched by this appservice may be in an inbox,
+// either its own or the one of an appservice that forwarded them here.
+func (as *AppService) inboxEnabled() bool {
+	return as.Inbox != nil || as.receivesForwardedEvents.Load()
+}
+
+func (as *AppService) trackInboxEvents(txnID string, evts []*event.Event) {
+	as.inboxLock.Lock()
+	defer as.inboxLock.Unlock()
+	if as.inboxEvents == nil {
+		as.inboxEvents = make(map[*event.Event]*inboxEntry)
+	}
+	for i, evt := range evts {
+		as.inboxEvents[evt] = &inboxEntry{txnID: txnID, index: i, holds: 1}
+	}
+}
+
+// MarkEventHandled removes the given event from the inbox, if it came from one.
+//
+// [EventProcessor] calls this automatically after all handlers of an event have returned.
+// Applications that read [AppService.Events] directly must call this themselves.
+// If a handler called [DeferEventHandled], the event is only removed after the function it returned is called too.
+func (as *AppService) MarkEventHandled(ctx context.Context, evt *event.Event) {
+	if !as.inboxEnabled() {
+		return
+	}
+	as.inboxLock.Lock()
+	entry, ok := as.inboxEvents[evt]
+	if ok {
+		entry.holds--
+		if entry.holds > 0 {
+			ok = false
+		} else {
+			delete(as.inboxEvents, evt)
+		}
+	}
+	as.inboxLock.Unlock()
+	if !ok {
+		return
+	} else if entry.forwardedFrom != nil {
+		entry.forwardedFrom.as.MarkEventHandled(ctx, entry.forwardedFrom.evt)
+		return
+	}
+	err := as.Inbox.MarkDone(ctx, entry.txnID, entry.index)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).
+			Str("transaction_id", entry.txnID).
+			Int("event_index", entry.index).
+			Stringer("event_id", evt.ID).
+			Msg("Failed to mark event as handled in inbox")
+	}
+}
+
+// ForwardInboxEvent passes an event from this appservice on to another one. This is meant for programs that
+// receive transactions on one appservice and dispatch the events to the event processors of several others.
+//
+// If the event is in the inbox, it's kept there until the forwarded event has been marked as handled
+// in the target appservice, in addition to the usual [AppService.MarkEventHandled] call on this appservice.
+// The forwarded event may be the original event or a copy of it.
+func (as *AppService) ForwardInboxEvent(evt *event.Event, target *AppService, forwarded *event.Event) {
+	if as.Inbox == nil {
+		return
+	}
+	as.inboxLock.Lock()
+	entry, ok := as.inboxEvents[evt]
+	if ok {
+		entry.holds++
+	}
+	as.inboxLock.Unlock()
+	if !ok {
+		return
+	}
+	target.inboxLock.Lock()
+	if target.inboxEvents == nil {
+		target.inboxEvents = make(map[*event.Event]*inboxEntry)
+	}
+	target.inboxEvents[forwarded] = &inboxEntry{holds: 1, forwardedFrom: &inboxEventRef{as: as, evt: evt}}
+	target.inboxLock.Unlock()
+	target.receivesForwardedEvents.Store(true)
+}
+
+type inboxContextKey struct{}
+
+type inboxEventRef struct {
+	as  *AppService
+	evt *event.Event
+}
+
+// startInboxEvent returns a context that allows handlers of the given event to call [DeferEventHandled],
+// and a function that must be called after the handlers have returned.
+//
+// If the event isn't in the inbox itself, but is being dispatched while handling another inbox event
+// (e.g. after decrypting an encrypted event), the original event is kept in the inbox until it's done.
+func (as *AppService) startInboxEvent(ctx context.Context, evt *event.Event) (context.Context, func()) {
+	if !as.inboxEnabled() {
+		return ctx, func() {}
+	}
+	as.inboxLock.Lock()
+	_, ok := as.inboxEvents[evt]
+	as.inboxLock.Unlock()
+	if !ok {
+		return ctx, DeferEventHandled(ctx)
+	}
+	ctx = context.WithValue(ctx, inboxContextKey{}, &inboxEventRef{as: as, evt: evt})
+	return ctx, func() {
+		as.MarkEventHandled(ctx, evt)
+	}
+}
+
+// DeferEventHandled prevents the event being handled in the given context from being removed from the inbox
+// when its handlers return. This is meant for handlers that pass the event to a background queue:
+// the returned function must be called once the event has actually been handled.
+//
+// The context must be the one passed to the event handler by [EventProcessor].
+// If the event didn't come from an inbox, the returned function does nothing.
+func DeferEventHandled(ctx context.Context) func() {
+	ref, ok := ctx.Value(inboxContextKey{}).(*inboxEventRef)
+	if !ok {
+		return func() {}
+	}
+	ref.as.inboxLock.Lock()
+	entry, ok := ref.as.inboxEvents[ref.evt]
+	if ok {
+		entry.holds++
+	}
+	ref.as.inboxLock.Unlock()
+	if !ok {
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ref.as.MarkEventHandled(ctx, ref.evt)
+		})
+	}
+}
+
+// HoldTransactionsForReplay makes incoming transactions wait until [AppService.ReplayInbox] has finished,
+// so that new events aren't stored or dispatched before the ones left over from the previous run.
+//
+// This must be called before starting the HTTP listener or websocket. The listener can then be started early,
+// e.g. to respond to homeserver pings, while the inbox is replayed once event handlers are ready.
+func (as *AppService) HoldTransactionsForReplay() {
+	as.inboxLock.Lock()
+	defer as.inboxLock.Unlock()
+	if as.inboxReplayed == nil {
+		as.inboxReplayed = make(chan struct{})
+	}
+}
+
+func (as *AppService) waitForInboxReplay(ctx context.Context) error {
+	as.inboxLock.Lock()
+	replayed := as.inboxReplayed
+	as.inboxLock.Unlock()
+	if replayed == nil {
+		return nil
+	}
+	select {
+	case <-replayed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (as *AppService) finishInboxReplay() {
+	as.inboxLock.Lock()
+	defer as.inboxLock.Unlock()
+	if as.inboxReplayed != nil {
+		select {
+		case <-as.inboxReplayed:
+		default:
+			close(as.inboxReplayed)
+		}
+	}
+}
+
+// ReplayInbox redelivers all events that were left unhandled in the inbox, e.g. due to a crash.
+//
+// This should be called once on startup after event handlers are registered and the event processor is started.
+// Transactions held by [AppService.HoldTransactionsForReplay] are released after the replayed events are dispatched.
+func (as *AppService) ReplayInbox(ctx context.Context) error {
+	if as.Inbox == nil {
+		return nil
+	}
+	defer as.finishInboxReplay()
+	pending, err := as.Inbox.GetPending(ctx)
+	if err != nil {
+		return err
+	} else if len(pending) == 0 {
+		return nil
+	}
+	zerolog.Ctx(ctx).Info().Int("event_count", len(pending)).Msg("Replaying unhandled events from transaction inbox")
+	as.inboxLock.Lock()
+	if as.inboxEvents == nil {
+		as.inboxEvents = make(map[*event.Event]*inboxEntry)
+	}
+	for _, item := range pending {
+		as.inboxEvents[item.Event] = &inboxEntry{txnID: item.TxnID, index: item.Index, holds: 1}
+	}
+	as.inboxLock.Unlock()
+	for _, item := range pending {
+		evt := item.Event
+		evt.Mautrix.ReceivedAt = time.Now()
+		as.parseEventContent(ctx, evt)
+		as.dispatchEvent(ctx, evt)
+	}
+	return nil
+}
@@ -129,6 +129,10 @@ type Error struct {
 	Message    string    `json:"error"`
 }
 
+func (err Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.ErrorCode, err.Message)
+}
+
 func (err Error) Write(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(err.HTTPStatus)
@@ -144,6 +148,8 @@ const (
 	ErrBadJSON      ErrorCode = "M_BAD_JSON"
 	ErrNotJSON      ErrorCode = "M_NOT_JSON"
 	ErrUnknown      ErrorCode = "M_UNKNOWN"
+	ErrNotFound     ErrorCode = "M_NOT_FOUND"
+	ErrMissingParam ErrorCode = "M_MISSING_PARAM"
 )
 
 // Custom ErrorCodes
@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sqlinbox implements a persistent [appservice.TransactionInbox] using a dbutil database.
+package sqlinbox
+
+import (
+	"context"
+	"embed"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable dbutil.UpgradeTable
+
+func init() {
+	UpgradeTable.RegisterFS(rawUpgrades)
+}
+
+const VersionTableName = "mx_txn_inbox_version"
+
+// DefaultRetention is the default value for [SQLInbox.Retention].
+const DefaultRetention = 24 * time.Hour
+
+// SQLInbox is a [appservice.TransactionInbox] that stores transactions in an SQL database.
+type SQLInbox struct {
+	*dbutil.Database
+
+	// Retention is how long fully handled transaction IDs are remembered for deduplicating retried transactions.
+	Retention time.Duration
+
+	lastPrune time.Time
+	pruneLock sync.Mutex
+}
+
+var _ appservice.TransactionInbox = (*SQLInbox)(nil)
+
+// NewSQLInbox creates a new inbox using the given database. The tables are created when [SQLInbox.Upgrade] is called.
+func NewSQLInbox(db *dbutil.Database, log dbutil.DatabaseLogger) *SQLInbox {
+	return &SQLInbox{
+		Database:  db.Child(VersionTableName, UpgradeTable, log),
+		Retention: DefaultRetention,
+	}
+}
+
+const (
+	insertTransactionQuery = `
+		INSERT INTO mx_txn_inbox_transaction (txn_id, received_at) VALUES ($1, $2)
+		ON CONFLICT (txn_id) DO NOTHING
+	`
+	insertEventQuery = `
+		INSERT INTO mx_txn_inbox_event (txn_id, idx, type_class, event) VALUES ($1, $2, $3, $4)
+	`
+	deleteEventQuery = `
+		DELETE FROM mx_txn_inbox_event WHERE txn_id=$1 AND idx=$2
+	`
+	getPendingEventsQuery = `
+		SELECT mx_txn_inbox_event.txn_id, idx, type_class, event
+		FROM mx_txn_inbox_event
+		INNER JOIN mx_txn_inbox_transaction ON mx_txn_inbox_event.txn_id = mx_txn_inbox_transaction.txn_id
+		ORDER BY mx_txn_inbox_transaction.received_at, mx_txn_inbox_event.txn_id, idx
+	`
+	pruneTransactionsQuery = `
+		DELETE FROM mx_txn_inbox_transaction
+		WHERE received_at < $1 AND NOT EXISTS(
+			SELECT 1 FROM mx_txn_inbox_event WHERE mx_txn_inbox_event.txn_id = mx_txn_inbox_transaction.txn_id
+		)
+	`
+)
+
+func (inbox *SQLInbox) Put(ctx context.Context, txnID string, evts []*event.Event) (isNew bool, err error) {
+	inbox.pruneIfNeeded(ctx)
+	err = inbox.DoTxn(ctx, nil, func(ctx context.Context) error {
+		res, err := inbox.Exec(ctx, insertTransactionQuery, txnID, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if affected == 0 {
+			return nil
+		}
+		isNew = true
+		for i, evt := range evts {
+			_, err = inbox.Exec(ctx, insertEventQuery, txnID, i, int(evt.Type.Class), dbutil.JSON{Data: evt})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (inbox *SQLInbox) MarkDone(ctx context.Context, txnID string, index int) error {
+	_, err := inbox.Exec(ctx, deleteEventQuery, txnID, index)
+	return err
+}
+
+func (inbox *SQLInbox) GetPending(ctx context.Context) ([]*appservice.InboxEvent, error) {
+	rows, err := inbox.Query(ctx, getPendingEventsQuery)
+	return dbutil.NewRowIterWithError(rows, scanInboxEvent, err).AsList()
+}
+
+func scanInboxEvent(row dbutil.Scannable) (*appservice.InboxEvent, error) {
+	var item appservice.InboxEvent
+	var typeClass int
+	item.Event = &event.Event{}
+	err := row.Scan(&item.TxnID, &item.Index, &typeClass, dbutil.JSON{Data: item.Event})
+	if err != nil {
+		return nil, err
+	}
+	item.Event.Type.Class = event.TypeClass(typeClass)
+	return &item, nil
+}
+
+func (inbox *SQLInbox) pruneIfNeeded(ctx context.Context) {
+	inbox.pruneLock.Lock()
+	if time.Since(inbox.lastPrune) < inbox.Retention/4 {
+		inbox.pruneLock.Unlock()
+		return
+	}
+	inbox.lastPrune = time.Now()
+	inbox.pruneLock.Unlock()
+	_, err := inbox.Exec(ctx, pruneTransactionsQuery, time.Now().Add(-inbox.Retention).UnixMilli())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to prune old transactions from inbox")
+	}
+}
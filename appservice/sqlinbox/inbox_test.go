@@ -0,0 +1,305 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlinbox_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	_ "go.mau.fi/util/dbutil/litestream"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/sqlinbox"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var dbCounter atomic.Int64
+
+func newInbox(t *testing.T) *sqlinbox.SQLInbox {
+	db, err := dbutil.NewFromConfig("", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          fmt.Sprintf("file:sqlinbox%d?mode=memory&cache=shared&_txlock=immediate", dbCounter.Add(1)),
+			MaxOpenConns: 1,
+			MaxIdleConns: 1,
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	inbox := sqlinbox.NewSQLInbox(db, dbutil.NoopLogger)
+	require.NoError(t, inbox.Upgrade(context.Background()))
+	return inbox
+}
+
+func newAppService(inbox appservice.TransactionInbox) *appservice.AppService {
+	as := appservice.Create()
+	as.Log = zerolog.Nop()
+	as.Registration = &appservice.Registration{ServerToken: "hs_token"}
+	as.Inbox = inbox
+	return as
+}
+
+const testTransaction = `{"events": [
+	{"type": "m.room.message", "event_id": "$a", "room_id": "!room", "sender": "@user:example.com", "content": {"msgtype": "m.text", "body": "one"}},
+	{"type": "m.room.message", "event_id": "$b", "room_id": "!room", "sender": "@user:example.com", "content": {"msgtype": "m.text", "body": "two"}}
+]}`
+
+func putTransaction(as *appservice.AppService, txnID string) int {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(testTransaction))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSQLInbox_Put(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+	evt := &event.Event{ID: "$a", Type: event.EventMessage, Content: event.Content{VeryRaw: []byte(`{"body":"hi"}`)}}
+	evt.Type.Class = event.MessageEventType
+	isNew, err := inbox.Put(ctx, "txn1", []*event.Event{evt})
+	require.NoError(t, err)
+	assert.True(t, isNew)
+	isNew, err = inbox.Put(ctx, "txn1", []*event.Event{evt})
+	require.NoError(t, err)
+	assert.False(t, isNew)
+
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "txn1", pending[0].TxnID)
+	assert.Equal(t, evt.ID, pending[0].Event.ID)
+	assert.Equal(t, event.MessageEventType, pending[0].Event.Type.Class)
+
+	require.NoError(t, inbox.MarkDone(ctx, "txn1", 0))
+	pending, err = inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	// The transaction ID is still remembered after all events are done
+	isNew, err = inbox.Put(ctx, "txn1", []*event.Event{evt})
+	require.NoError(t, err)
+	assert.False(t, isNew)
+}
+
+func TestSQLInbox_Replay(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+
+	// Simulate a crash: the transaction is acknowledged, but nothing consumes the events
+	crashedAS := newAppService(inbox)
+	require.Equal(t, http.StatusOK, putTransaction(crashedAS, "txn1"))
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+
+	as := newAppService(inbox)
+	ep := appservice.NewEventProcessor(as)
+	ep.ExecMode = appservice.Sync
+	received := make(chan string, 10)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		received <- evt.Content.AsMessage().Body
+	})
+	ep.Start(ctx)
+	defer ep.Stop()
+	require.NoError(t, as.ReplayInbox(ctx))
+	// Retrying the same transaction must not deliver the events twice
+	require.Equal(t, http.StatusOK, putTransaction(as, "txn1"))
+
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case body := <-received:
+			assert.Equal(t, expected, body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for replayed event")
+		}
+	}
+	require.Eventually(t, func() bool {
+		pending, err = inbox.GetPending(ctx)
+		return err == nil && len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case body := <-received:
+		t.Fatalf("Unexpected duplicate event %q", body)
+	default:
+	}
+}
+
+func TestSQLInbox_DeferEventHandled(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+	as := newAppService(inbox)
+	ep := appservice.NewEventProcessor(as)
+	ep.ExecMode = appservice.Sync
+	dones := make(chan func(), 10)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		dones <- appservice.DeferEventHandled(ctx)
+	})
+	ep.Start(ctx)
+	defer ep.Stop()
+	require.Equal(t, http.StatusOK, putTransaction(as, "txn1"))
+
+	var deferred []func()
+	for len(deferred) < 2 {
+		select {
+		case done := <-dones:
+			deferred = append(deferred, done)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+	// Handlers have returned, but the events must stay in the inbox until the deferred work is done
+	time.Sleep(50 * time.Millisecond)
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	deferred[0]()
+	deferred[0]()
+	pending, err = inbox.GetPending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 1, pending[0].Index)
+	deferred[1]()
+	pending, err = inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestSQLInbox_HoldTransactionsForReplay(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+	crashedAS := newAppService(inbox)
+	require.Equal(t, http.StatusOK, putTransaction(crashedAS, "txn1"))
+
+	as := newAppService(inbox)
+	as.HoldTransactionsForReplay()
+	statusCode := make(chan int, 1)
+	go func() {
+		statusCode <- putTransaction(as, "txn2")
+	}()
+	select {
+	case <-statusCode:
+		t.Fatal("Transaction was handled before inbox replay")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2, "held transaction must not be stored before replay")
+
+	ep := appservice.NewEventProcessor(as)
+	ep.ExecMode = appservice.Sync
+	received := make(chan string, 10)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		received <- evt.Content.AsMessage().Body
+	})
+	ep.Start(ctx)
+	defer ep.Stop()
+	require.NoError(t, as.ReplayInbox(ctx))
+	select {
+	case code := <-statusCode:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for held transaction")
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for events")
+		}
+	}
+	select {
+	case body := <-received:
+		t.Fatalf("Unexpected duplicate event %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSQLInbox_OnlyStoresRoomEvents(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+	as := newAppService(inbox)
+	as.Registration.EphemeralEvents = true
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(`{
+		"events": [{"type": "m.room.message", "event_id": "$a", "room_id": "!room", "sender": "@user:example.com", "content": {"msgtype": "m.text", "body": "one"}}],
+		"ephemeral": [{"type": "m.typing", "room_id": "!room", "content": {"user_ids": ["@user:example.com"]}}]
+	}`))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, id.EventID("$a"), pending[0].Event.ID)
+	assert.Equal(t, 0, pending[0].Index)
+}
+
+func TestSQLInbox_ForwardInboxEvent(t *testing.T) {
+	ctx := context.Background()
+	inbox := newInbox(t)
+	as := newAppService(inbox)
+	targets := []*appservice.AppService{newAppService(nil), newAppService(nil)}
+	dones := make(chan func(), 10)
+	for _, target := range targets {
+		ep := appservice.NewEventProcessor(target)
+		ep.ExecMode = appservice.Sync
+		ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+			dones <- appservice.DeferEventHandled(ctx)
+		})
+		ep.Start(ctx)
+		defer ep.Stop()
+	}
+	go func() {
+		for evt := range as.Events {
+			for _, target := range targets {
+				evtCopy := *evt
+				as.ForwardInboxEvent(evt, target, &evtCopy)
+				target.Events <- &evtCopy
+			}
+			as.MarkEventHandled(ctx, evt)
+		}
+	}()
+	require.Equal(t, http.StatusOK, putTransaction(as, "txn1"))
+
+	var deferred []func()
+	for len(deferred) < 4 {
+		select {
+		case done := <-dones:
+			deferred = append(deferred, done)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for forwarded events")
+		}
+	}
+	pending, err := inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+	for _, done := range deferred[:3] {
+		done()
+	}
+	pending, err = inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1, "event must stay in the inbox until all targets have handled it")
+	deferred[3]()
+	pending, err = inbox.GetPending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
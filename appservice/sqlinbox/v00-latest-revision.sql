@@ -0,0 +1,19 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_txn_inbox_transaction (
+	txn_id      TEXT   PRIMARY KEY,
+	received_at BIGINT NOT NULL
+);
+
+CREATE INDEX mx_txn_inbox_transaction_received_at_idx ON mx_txn_inbox_transaction (received_at);
+
+CREATE TABLE mx_txn_inbox_event (
+	txn_id      TEXT    NOT NULL,
+	idx         INTEGER NOT NULL,
+	type_class  INTEGER NOT NULL,
+	event       jsonb   NOT NULL,
+
+	PRIMARY KEY (txn_id, idx),
+	CONSTRAINT mx_txn_inbox_event_txn_fkey FOREIGN KEY (txn_id)
+		REFERENCES mx_txn_inbox_transaction (txn_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,229 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+var (
+	ErrRegistrationMissingID     = errors.New("registration is missing id")
+	ErrRegistrationMissingToken  = errors.New("registration is missing token")
+	ErrRegistrationSameTokens    = errors.New("as_token and hs_token must be different")
+	ErrRegistrationInvalidURL    = errors.New("registration has invalid url")
+	ErrRegistrationMissingSender = errors.New("registration is missing sender_localpart")
+	ErrRegistrationInvalidRegex  = errors.New("registration has invalid namespace regex")
+	ErrSenderNotInNamespace      = errors.New("sender_localpart is not in an exclusive user namespace")
+)
+
+// Validate checks that the registration is well-formed. If serverName is set, it also checks that
+// the sender user ID is inside an exclusive user namespace.
+//
+// All problems are returned joined together with [errors.Join].
+func (reg *Registration) Validate(serverName string) error {
+	var errs []error
+	if reg.ID == "" {
+		errs = append(errs, ErrRegistrationMissingID)
+	}
+	if reg.AppToken == "" {
+		errs = append(errs, fmt.Errorf("%w: as_token", ErrRegistrationMissingToken))
+	}
+	if reg.ServerToken == "" {
+		errs = append(errs, fmt.Errorf("%w: hs_token", ErrRegistrationMissingToken))
+	}
+	if reg.AppToken != "" && reg.AppToken == reg.ServerToken {
+		errs = append(errs, ErrRegistrationSameTokens)
+	}
+	// The URL may be null for appservices that don't want to receive transactions
+	if reg.URL != "" && reg.URL != "null" {
+		parsed, err := url.Parse(reg.URL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %w", ErrRegistrationInvalidURL, err))
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("%w: scheme must be http or https", ErrRegistrationInvalidURL))
+		}
+	}
+	if reg.SenderLocalpart == "" {
+		errs = append(errs, ErrRegistrationMissingSender)
+	}
+	for _, kind := range reg.Namespaces.kinds() {
+		if _, err := kind.list.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("%w in %s: %w", ErrRegistrationInvalidRegex, kind.name, err))
+		}
+	}
+	if serverName != "" && reg.SenderLocalpart != "" {
+		sender := fmt.Sprintf("@%s:%s", reg.SenderLocalpart, serverName)
+		if !reg.Namespaces.UserIDs.MatchesExclusive(sender) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrSenderNotInNamespace, sender))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type namespaceKind struct {
+	name string
+	list NamespaceList
+}
+
+func (ns *Namespaces) kinds() []namespaceKind {
+	return []namespaceKind{
+		{"users", ns.UserIDs},
+		{"aliases", ns.RoomAliases},
+		{"rooms", ns.RoomIDs},
+	}
+}
+
+// Compile compiles all the regexes in the namespace list.
+func (nsl NamespaceList) Compile() ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(nsl))
+	for i, ns := range nsl {
+		var err error
+		compiled[i], err = regexp.Compile(ns.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", ns.Regex, err)
+		}
+	}
+	return compiled, nil
+}
+
+// MatchesExclusive returns true if the given string matches any exclusive namespace in the list.
+// Invalid regexes are ignored.
+func (nsl NamespaceList) MatchesExclusive(str string) bool {
+	for _, ns := range nsl {
+		re, err := regexp.Compile(ns.Regex)
+		if ns.Exclusive && err == nil && re.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespaceConflict describes an overlap between namespaces of two different registrations.
+type NamespaceConflict struct {
+	// Kind is the namespace type: users, aliases or rooms.
+	Kind    string
+	Ours    Namespace
+	Theirs  Namespace
+	Example string
+}
+
+func (nc NamespaceConflict) String() string {
+	return fmt.Sprintf("%s namespace %q overlaps with %q (both match %q)", nc.Kind, nc.Ours.Regex, nc.Theirs.Regex, nc.Example)
+}
+
+// FindConflicts finds namespaces in this registration that overlap with namespaces in the other registration
+// when at least one of the namespaces is exclusive.
+//
+// Checking whether two arbitrary regexes overlap isn't feasible, so this generates an example string
+// for each regex and checks if it's matched by the other regex. This catches typical ghost namespaces
+// like `^@prefix_.*:example\.com$`, but may miss more complicated overlaps.
+func (reg *Registration) FindConflicts(other *Registration) []NamespaceConflict {
+	var conflicts []NamespaceConflict
+	otherKinds := other.Namespaces.kinds()
+	for i, kind := range reg.Namespaces.kinds() {
+		for _, ours := range kind.list {
+			for _, theirs := range otherKinds[i].list {
+				if !ours.Exclusive && !theirs.Exclusive {
+					continue
+				}
+				if example, ok := findOverlap(ours.Regex, theirs.Regex); ok {
+					conflicts = append(conflicts, NamespaceConflict{
+						Kind:    kind.name,
+						Ours:    ours,
+						Theirs:  theirs,
+						Example: example,
+					})
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+func findOverlap(a, b string) (string, bool) {
+	reA, errA := regexp.Compile(a)
+	reB, errB := regexp.Compile(b)
+	if errA != nil || errB != nil {
+		return "", false
+	}
+	for _, example := range exampleMatches(a) {
+		if reA.MatchString(example) && reB.MatchString(example) {
+			return example, true
+		}
+	}
+	for _, example := range exampleMatches(b) {
+		if reA.MatchString(example) && reB.MatchString(example) {
+			return example, true
+		}
+	}
+	return "", false
+}
+
+// exampleMatches generates a few strings that the given regex should match.
+func exampleMatches(regex string) []string {
+	parsed, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	parsed = parsed.Simplify()
+	// Generate one example with the shortest repetitions and one where each repetition contains a character,
+	// as the latter is more likely to hit a more specific namespace in the other registration.
+	return []string{generateExample(parsed, false), generateExample(parsed, true)}
+}
+
+func generateExample(re *syntax.Regexp, fillRepeats bool) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return ""
+		}
+		// Prefer a lowercase letter or digit if the class allows one, as those are valid in all identifiers
+		for _, candidate := range "a0" {
+			for i := 0; i+1 < len(re.Rune); i += 2 {
+				if re.Rune[i] <= candidate && candidate <= re.Rune[i+1] {
+					return string(candidate)
+				}
+			}
+		}
+		return string(re.Rune[0])
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return "a"
+	case syntax.OpCapture:
+		return generateExample(re.Sub[0], fillRepeats)
+	case syntax.OpStar, syntax.OpQuest:
+		if fillRepeats {
+			return generateExample(re.Sub[0], fillRepeats)
+		}
+		return ""
+	case syntax.OpPlus:
+		return generateExample(re.Sub[0], fillRepeats)
+	case syntax.OpRepeat:
+		count := re.Min
+		if fillRepeats && count == 0 && re.Max != 0 {
+			count = 1
+		}
+		return strings.Repeat(generateExample(re.Sub[0], fillRepeats), count)
+	case syntax.OpConcat:
+		var buf strings.Builder
+		for _, sub := range re.Sub {
+			buf.WriteString(generateExample(sub, fillRepeats))
+		}
+		return buf.String()
+	case syntax.OpAlternate:
+		return generateExample(re.Sub[0], fillRepeats)
+	default:
+		// Anchors, word boundaries and empty matches don't produce any characters
+		return ""
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestRegistration(userRegexes ...string) *Registration {
+	reg := &Registration{
+		ID:              "test",
+		URL:             "http://localhost:29319",
+		AppToken:        "as_token",
+		ServerToken:     "hs_token",
+		SenderLocalpart: "testbot",
+	}
+	for _, regex := range userRegexes {
+		reg.Namespaces.UserIDs = append(reg.Namespaces.UserIDs, Namespace{Regex: regex, Exclusive: true})
+	}
+	return reg
+}
+
+func TestRegistration_Validate(t *testing.T) {
+	reg := makeTestRegistration(`^@testbot:example\.com$`, `^@test_.*:example\.com$`)
+	require.NoError(t, reg.Validate("example.com"))
+	assert.ErrorIs(t, reg.Validate("example.org"), ErrSenderNotInNamespace)
+
+	reg.ServerToken = reg.AppToken
+	reg.Namespaces.RoomAliases = NamespaceList{{Regex: `^#test_(.*:example\.com$`, Exclusive: true}}
+	reg.URL = "localhost:1234"
+	err := reg.Validate("example.com")
+	assert.ErrorIs(t, err, ErrRegistrationSameTokens)
+	assert.ErrorIs(t, err, ErrRegistrationInvalidRegex)
+	assert.ErrorIs(t, err, ErrRegistrationInvalidURL)
+	assert.NotErrorIs(t, err, ErrSenderNotInNamespace)
+
+	assert.ErrorIs(t, (&Registration{}).Validate(""), ErrRegistrationMissingToken)
+}
+
+func TestRegistration_FindConflicts(t *testing.T) {
+	reg := makeTestRegistration(`^@testbot:example\.com$`, `^@test_.*:example\.com$`)
+	tests := []struct {
+		name     string
+		regex    string
+		conflict bool
+	}{
+		{"more specific", `^@test_[0-9]+:example\.com$`, true},
+		{"wildcard", `^@.*:example\.com$`, true},
+		{"same bot", `^@testbot:example\.com$`, true},
+		{"other prefix", `^@other_.*:example\.com$`, false},
+		{"other server", `^@test_.*:example\.org$`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conflicts := reg.FindConflicts(makeTestRegistration(test.regex))
+			assert.Equal(t, test.conflict, len(conflicts) > 0, conflicts)
+		})
+	}
+
+	other := makeTestRegistration()
+	other.Namespaces.UserIDs = NamespaceList{{Regex: `^@test_.*:example\.com$`, Exclusive: false}}
+	assert.Len(t, reg.FindConflicts(other), 1, "non-exclusive namespace overlapping with exclusive one should conflict")
+	reg.Namespaces.UserIDs[1].Exclusive = false
+	assert.Empty(t, reg.FindConflicts(other), "two non-exclusive namespaces shouldn't conflict")
+}
@@ -29,6 +29,8 @@ type WebsocketRequest struct {
 	ReqID   int         `json:"id,omitempty"`
 	Command string      `json:"command"`
 	Data    interface{} `json:"data"`
+	// AppserviceID is set when the request is sent through a [WebsocketMultiplexer].
+	AppserviceID string `json:"appservice_id,omitempty"`
 
 	Deadline time.Duration `json:"-"`
 }
@@ -37,6 +39,8 @@ type WebsocketCommand struct {
 	ReqID   int             `json:"id,omitempty"`
 	Command string          `json:"command"`
 	Data    json.RawMessage `json:"data"`
+	// AppserviceID is the registration ID of the target appservice on multiplexed connections.
+	AppserviceID string `json:"appservice_id,omitempty"`
 
 	Ctx context.Context `json:"-"`
 }
@@ -117,6 +121,7 @@ var (
 
 	ErrWebsocketNotConnected = errors.New("websocket not connected")
 	ErrWebsocketClosed       = errors.New("websocket closed before response received")
+	ErrWebsocketMultiplexed  = errors.New("appservice websocket is managed by a multiplexer")
 )
 
 func (mwcc MeowWebsocketCloseCode) String() string {
@@ -167,18 +172,28 @@ func parseCloseError(err error) error {
 }
 
 func (as *AppService) HasWebsocket() bool {
+	if as.wsMux != nil {
+		return as.wsMux.IsConnected()
+	}
 	return as.ws != nil
 }
 
 func (as *AppService) SendWebsocket(cmd *WebsocketRequest) error {
-	ws := as.ws
 	if cmd == nil {
 		return nil
-	} else if ws == nil {
+	} else if as.wsMux != nil {
+		cmd.AppserviceID = as.Registration.ID
+		return as.wsMux.send(cmd)
+	}
+	return writeWebsocket(&as.wsWriteLock, as.ws, cmd)
+}
+
+func writeWebsocket(lock *sync.Mutex, ws *websocket.Conn, cmd *WebsocketRequest) error {
+	if ws == nil {
 		return ErrWebsocketNotConnected
 	}
-	as.wsWriteLock.Lock()
-	defer as.wsWriteLock.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
 	if cmd.Deadline == 0 {
 		cmd.Deadline = 3 * time.Minute
 	}
@@ -186,29 +201,74 @@ func (as *AppService) SendWebsocket(cmd *WebsocketRequest) error {
 	return ws.WriteJSON(cmd)
 }
 
-func (as *AppService) clearWebsocketResponseWaiters() {
-	as.websocketRequestsLock.Lock()
-	for _, waiter := range as.websocketRequests {
-		waiter <- &WebsocketCommand{Command: "__websocket_closed"}
-	}
-	as.websocketRequests = make(map[int]chan<- *WebsocketCommand)
-	as.websocketRequestsLock.Unlock()
+type websocketResponseWaiter struct {
+	appserviceID string
+	ch           chan<- *WebsocketCommand
+}
+
+// websocketRequestTracker matches responses received through a websocket to the requests waiting for them.
+// Appservices on a [WebsocketMultiplexer] share the tracker of the multiplexer, so request IDs are unique
+// across the whole connection.
+type websocketRequestTracker struct {
+	nextID  atomic.Int32
+	waiters map[int]websocketResponseWaiter
+	lock    sync.RWMutex
 }
 
-func (as *AppService) addWebsocketResponseWaiter(reqID int, waiter chan<- *WebsocketCommand) {
-	as.websocketRequestsLock.Lock()
-	as.websocketRequests[reqID] = waiter
-	as.websocketRequestsLock.Unlock()
+func (wrt *websocketRequestTracker) add(appserviceID string, waiter chan<- *WebsocketCommand) int {
+	reqID := int(wrt.nextID.Add(1))
+	wrt.lock.Lock()
+	if wrt.waiters == nil {
+		wrt.waiters = make(map[int]websocketResponseWaiter)
+	}
+	wrt.waiters[reqID] = websocketResponseWaiter{appserviceID: appserviceID, ch: waiter}
+	wrt.lock.Unlock()
+	return reqID
 }
 
-func (as *AppService) removeWebsocketResponseWaiter(reqID int, waiter chan<- *WebsocketCommand) {
-	as.websocketRequestsLock.Lock()
-	existingWaiter, ok := as.websocketRequests[reqID]
-	if ok && existingWaiter == waiter {
-		delete(as.websocketRequests, reqID)
+func (wrt *websocketRequestTracker) remove(reqID int, waiter chan<- *WebsocketCommand) {
+	wrt.lock.Lock()
+	existingWaiter, ok := wrt.waiters[reqID]
+	if ok && existingWaiter.ch == waiter {
+		delete(wrt.waiters, reqID)
 	}
 	close(waiter)
-	as.websocketRequestsLock.Unlock()
+	wrt.lock.Unlock()
+}
+
+func (wrt *websocketRequestTracker) clear() {
+	wrt.lock.Lock()
+	for _, waiter := range wrt.waiters {
+		waiter.ch <- &WebsocketCommand{Command: "__websocket_closed"}
+	}
+	wrt.waiters = make(map[int]websocketResponseWaiter)
+	wrt.lock.Unlock()
+}
+
+func (wrt *websocketRequestTracker) deliver(log *zerolog.Logger, cmd *WebsocketCommand) {
+	wrt.lock.RLock()
+	defer wrt.lock.RUnlock()
+	waiter, ok := wrt.waiters[cmd.ReqID]
+	if !ok {
+		log.Warn().Msg("Dropping response to unknown request ID")
+	} else if cmd.AppserviceID != "" && waiter.appserviceID != "" && cmd.AppserviceID != waiter.appserviceID {
+		log.Warn().
+			Str("request_appservice_id", waiter.appserviceID).
+			Msg("Dropping response for a request that was sent by another appservice")
+	} else {
+		select {
+		case waiter.ch <- cmd:
+		default:
+			log.Warn().Msg("Failed to handle response: channel didn't accept response")
+		}
+	}
+}
+
+func (as *AppService) websocketRequestTracker() *websocketRequestTracker {
+	if as.wsMux != nil {
+		return &as.wsMux.requests
+	}
+	return &as.websocketRequests
 }
 
 type ErrorResponse struct {
@@ -221,10 +281,14 @@ func (er *ErrorResponse) Error() string {
 }
 
 func (as *AppService) RequestWebsocket(ctx context.Context, cmd *WebsocketRequest, response interface{}) error {
-	cmd.ReqID = int(atomic.AddInt32(&as.websocketRequestID, 1))
+	var appserviceID string
+	if as.wsMux != nil {
+		appserviceID = as.Registration.ID
+	}
+	tracker := as.websocketRequestTracker()
 	respChan := make(chan *WebsocketCommand, 1)
-	as.addWebsocketResponseWaiter(cmd.ReqID, respChan)
-	defer as.removeWebsocketResponseWaiter(cmd.ReqID, respChan)
+	cmd.ReqID = tracker.add(appserviceID, respChan)
+	defer tracker.remove(cmd.ReqID, respChan)
 	err := as.SendWebsocket(cmd)
 	if err != nil {
 		return err
@@ -269,7 +333,11 @@ type WebsocketTransactionHandler func(ctx context.Context, msg WebsocketMessage)
 
 func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg WebsocketMessage) (bool, any) {
 	if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
-		as.handleTransaction(ctx, msg.TxnID, &msg.Transaction)
+		err := as.handleTransaction(ctx, msg.TxnID, &msg.Transaction)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to handle transaction")
+			return false, err
+		}
 	} else {
 		zerolog.Ctx(ctx).Debug().
 			Object("content", &msg.Transaction).
@@ -280,7 +348,6 @@ func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg
 
 func (as *AppService) consumeWebsocket(stopFunc func(error), ws *websocket.Conn) {
 	defer stopFunc(ErrWebsocketUnknownError)
-	ctx := context.Background()
 	for {
 		var msg WebsocketMessage
 		err := ws.ReadJSON(&msg)
@@ -289,72 +356,65 @@ func (as *AppService) consumeWebsocket(stopFunc func(error), ws *websocket.Conn)
 			stopFunc(parseCloseError(err))
 			return
 		}
-		with := as.Log.With().
-			Int("req_id", msg.ReqID).
-			Str("ws_command", msg.Command)
-		if msg.TxnID != "" {
-			with = with.Str("transaction_id", msg.TxnID)
-		}
-		log := with.Logger()
-		ctx = log.WithContext(ctx)
-		if msg.Command == "" || msg.Command == "transaction" {
-			ok, resp := as.WebsocketTransactionHandler(ctx, msg)
-			go func() {
-				err := as.SendWebsocket(msg.MakeResponse(ok, resp))
-				if err != nil {
-					log.Warn().Err(err).Msg("Failed to send response to websocket transaction")
-				} else {
-					log.Debug().Msg("Sent response to transaction")
-				}
-			}()
-		} else if msg.Command == "connect" {
-			log.Debug().Msg("Websocket connect confirmation received")
-		} else if msg.Command == "response" || msg.Command == "error" {
-			as.websocketRequestsLock.RLock()
-			respChan, ok := as.websocketRequests[msg.ReqID]
-			if ok {
-				select {
-				case respChan <- &msg.WebsocketCommand:
-				default:
-					log.Warn().Msg("Failed to handle response: channel didn't accept response")
-				}
+		as.handleWebsocketMessage(msg)
+	}
+}
+
+func (as *AppService) handleWebsocketMessage(msg WebsocketMessage) {
+	with := as.Log.With().
+		Int("req_id", msg.ReqID).
+		Str("ws_command", msg.Command)
+	if msg.TxnID != "" {
+		with = with.Str("transaction_id", msg.TxnID)
+	}
+	log := with.Logger()
+	ctx := log.WithContext(context.Background())
+	if msg.Command == "" || msg.Command == "transaction" {
+		ok, resp := as.WebsocketTransactionHandler(ctx, msg)
+		go func() {
+			err := as.SendWebsocket(msg.MakeResponse(ok, resp))
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to send response to websocket transaction")
 			} else {
-				log.Warn().Msg("Dropping response to unknown request ID")
+				log.Debug().Msg("Sent response to transaction")
 			}
-			as.websocketRequestsLock.RUnlock()
-		} else {
-			log.Debug().Msg("Received websocket command")
-			as.websocketHandlersLock.RLock()
-			handler, ok := as.websocketHandlers[msg.Command]
-			as.websocketHandlersLock.RUnlock()
-			if !ok {
-				handler = as.unknownCommandHandler
-			}
-			go func() {
-				okResp, data := handler(msg.WebsocketCommand)
-				err := as.SendWebsocket(msg.MakeResponse(okResp, data))
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to send response to websocket command")
-				} else if okResp {
-					log.Debug().Msg("Sent success response to websocket command")
-				} else {
-					log.Debug().Msg("Sent error response to websocket command")
-				}
-			}()
+		}()
+	} else if msg.Command == "connect" {
+		log.Debug().Msg("Websocket connect confirmation received")
+	} else if msg.Command == "response" || msg.Command == "error" {
+		as.websocketRequestTracker().deliver(&log, &msg.WebsocketCommand)
+	} else {
+		log.Debug().Msg("Received websocket command")
+		as.websocketHandlersLock.RLock()
+		handler, ok := as.websocketHandlers[msg.Command]
+		as.websocketHandlersLock.RUnlock()
+		if !ok {
+			handler = as.unknownCommandHandler
 		}
+		go func() {
+			okResp, data := handler(msg.WebsocketCommand)
+			err := as.SendWebsocket(msg.MakeResponse(okResp, data))
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to send response to websocket command")
+			} else if okResp {
+				log.Debug().Msg("Sent success response to websocket command")
+			} else {
+				log.Debug().Msg("Sent error response to websocket command")
+			}
+		}()
 	}
 }
 
-func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
+func makeWebsocketURL(baseURL string, fallback *url.URL) (string, error) {
 	var parsed *url.URL
 	if baseURL != "" {
 		var err error
 		parsed, err = url.Parse(baseURL)
 		if err != nil {
-			return fmt.Errorf("failed to parse URL: %w", err)
+			return "", fmt.Errorf("failed to parse URL: %w", err)
 		}
 	} else {
-		copiedURL := *as.hsURLForClient
+		copiedURL := *fallback
 		parsed = &copiedURL
 	}
 	parsed.Path = filepath.Join(parsed.Path, "_matrix/client/unstable/fi.mau.as_sync")
@@ -363,42 +423,79 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	} else if parsed.Scheme == "https" {
 		parsed.Scheme = "wss"
 	}
-	ws, resp, err := websocket.DefaultDialer.Dial(parsed.String(), http.Header{
-		"Authorization": []string{fmt.Sprintf("Bearer %s", as.Registration.AppToken)},
-		"User-Agent":    []string{as.BotClient().UserAgent},
+	return parsed.String(), nil
+}
 
-		"X-Mautrix-Process-ID":        []string{as.ProcessID},
-		"X-Mautrix-Websocket-Version": []string{"3"},
-	})
+func dialWebsocket(addr string, header http.Header) (*websocket.Conn, error) {
+	ws, resp, err := websocket.DefaultDialer.Dial(addr, header)
 	if resp != nil && resp.StatusCode >= 400 {
 		var errResp Error
 		err = json.NewDecoder(resp.Body).Decode(&errResp)
 		if err != nil {
-			return fmt.Errorf("websocket request returned HTTP %d with non-JSON body", resp.StatusCode)
+			return nil, fmt.Errorf("websocket request returned HTTP %d with non-JSON body", resp.StatusCode)
 		} else {
-			return fmt.Errorf("websocket request returned %s (HTTP %d): %s", errResp.ErrorCode, resp.StatusCode, errResp.Message)
+			return nil, fmt.Errorf("websocket request returned %s (HTTP %d): %s", errResp.ErrorCode, resp.StatusCode, errResp.Message)
 		}
 	} else if err != nil {
-		return fmt.Errorf("failed to open websocket: %w", err)
+		return nil, fmt.Errorf("failed to open websocket: %w", err)
 	}
-	if as.StopWebsocket != nil {
-		as.StopWebsocket(ErrWebsocketOverridden)
+	return ws, nil
+}
+
+func closeWebsocket(log *zerolog.Logger, lock *sync.Mutex, ws *websocket.Conn) {
+	lock.Lock()
+	defer lock.Unlock()
+	_ = ws.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	err := ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Warn().Err(err).Msg("Error writing close message to websocket")
 	}
-	closeChan := make(chan error)
+	err = ws.Close()
+	if err != nil {
+		log.Warn().Err(err).Msg("Error closing websocket")
+	}
+}
+
+func makeWebsocketStopFunc(log *zerolog.Logger, closeChan chan error) func(error) {
 	closeChanOnce := sync.Once{}
-	stopFunc := func(err error) {
+	return func(err error) {
 		closeChanOnce.Do(func() {
 			select {
 			case closeChan <- err:
 			default:
-				as.Log.Warn().
+				log.Warn().
 					AnErr("close_error", err).
 					Msg("Nothing is reading on close channel")
 				closeChan <- err
-				as.Log.Warn().Msg("Websocket close completed after being stuck")
+				log.Warn().Msg("Websocket close completed after being stuck")
 			}
 		})
 	}
+}
+
+func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
+	if as.wsMux != nil {
+		return ErrWebsocketMultiplexed
+	}
+	addr, err := makeWebsocketURL(baseURL, as.hsURLForClient)
+	if err != nil {
+		return err
+	}
+	ws, err := dialWebsocket(addr, http.Header{
+		"Authorization": []string{fmt.Sprintf("Bearer %s", as.Registration.AppToken)},
+		"User-Agent":    []string{as.BotClient().UserAgent},
+
+		"X-Mautrix-Process-ID":        []string{as.ProcessID},
+		"X-Mautrix-Websocket-Version": []string{"3"},
+	})
+	if err != nil {
+		return err
+	}
+	if as.StopWebsocket != nil {
+		as.StopWebsocket(ErrWebsocketOverridden)
+	}
+	closeChan := make(chan error)
+	stopFunc := makeWebsocketStopFunc(&as.Log, closeChan)
 	as.ws = ws
 	as.StopWebsocket = stopFunc
 	as.PrepareWebsocket()
@@ -422,18 +519,48 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	}
 
 	if as.ws == ws {
-		as.clearWebsocketResponseWaiters()
+		as.websocketRequests.clear()
 		as.ws = nil
 	}
 
-	_ = ws.SetWriteDeadline(time.Now().Add(3 * time.Second))
-	err = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
-	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
-		as.Log.Warn().Err(err).Msg("Error writing close message to websocket")
+	closeWebsocket(&as.Log, &as.wsWriteLock, ws)
+	return closeErr
+}
+
+type WebsocketPingData struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// PingWebsocket sends a ping command through the websocket and returns the timestamp that the server included in its response.
+func (as *AppService) PingWebsocket(ctx context.Context) (serverTs time.Time, err error) {
+	var resp WebsocketPingData
+	err = as.RequestWebsocket(ctx, &WebsocketRequest{
+		Command: "ping",
+		Data:    &WebsocketPingData{Timestamp: time.Now().UnixMilli()},
+	}, &resp)
+	if err == nil {
+		serverTs = time.UnixMilli(resp.Timestamp)
 	}
-	err = ws.Close()
-	if err != nil {
-		as.Log.Warn().Err(err).Msg("Error closing websocket")
+	return
+}
+
+// RunWebsocketPinger calls the given ping function at the given interval
+// until the stop channel is closed or the ping function returns false.
+func RunWebsocketPinger(log *zerolog.Logger, interval time.Duration, stop <-chan struct{}, ping func() bool) {
+	clock := time.NewTicker(interval)
+	defer func() {
+		log.Info().Msg("Stopping websocket pinger")
+		clock.Stop()
+	}()
+	log.Info().Dur("interval_duration", interval).Msg("Starting websocket pinger")
+	for {
+		select {
+		case <-clock.C:
+			if !ping() {
+				return
+			}
+		case <-stop:
+			return
+		}
 	}
-	return closeErr
 }
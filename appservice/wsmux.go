@@ -0,0 +1,460 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+const WebsocketCommandMultiplexRegister = "multiplex_register"
+
+// WebsocketMultiplexRegister is the data of the multiplex_register command,
+// which is sent for each appservice after a multiplexed connection is opened.
+type WebsocketMultiplexRegister struct {
+	AppserviceID string `json:"appservice_id"`
+	AppToken     string `json:"as_token"`
+	// LastTxnID is the ID of the last transaction that was acknowledged for this appservice,
+	// which allows the server to resume sending transactions after a reconnection.
+	LastTxnID string `json:"last_txn_id,omitempty"`
+}
+
+var ErrNoMultiplexedAppservices = errors.New("no appservices added to multiplexer")
+
+// WebsocketTxnIDStore persists the ID of the last acknowledged transaction of each multiplexed appservice,
+// so that the server can resume sending transactions where it left off after the process restarts.
+type WebsocketTxnIDStore interface {
+	GetLastTxnID(ctx context.Context, appserviceID string) (string, error)
+	SetLastTxnID(ctx context.Context, appserviceID, txnID string) error
+}
+
+// WebsocketMultiplexer runs multiple appservices over a single fi.mau.as_sync websocket connection.
+//
+// Messages from the server are routed to appservices based on the appservice_id field,
+// which is the ID in the registration file. Messages without an appservice_id are routed
+// to the first appservice that was added. All requests sent by the appservices will have
+// the field set automatically. Request IDs are allocated by the multiplexer, so responses
+// are matched to the right request even if the server doesn't echo the appservice_id.
+//
+// The connection is shared, so calling StopWebsocket on any of the appservices will close it for all of them.
+// Appservices added to a multiplexer must not call StartWebsocket themselves.
+type WebsocketMultiplexer struct {
+	Log zerolog.Logger
+	// URL is the base URL of the websocket server. If empty, the homeserver URL of the first appservice is used.
+	URL string
+	// ProcessID is an identifier sent to the websocket proxy for debugging connections
+	ProcessID string
+	// OnConnect is called in a goroutine after a connection is opened and all appservices have been registered.
+	OnConnect func()
+	// TxnIDStore is used to persist the last acknowledged transaction IDs. If nil, they're only kept in memory.
+	TxnIDStore WebsocketTxnIDStore
+
+	ReconnectBackoff      time.Duration
+	MaxReconnectBackoff   time.Duration
+	ReconnectBackoffReset time.Duration
+
+	appservices     map[string]*AppService
+	appserviceOrder []*AppService
+	lastTxnIDs      map[string]string
+	connectHandlers []func()
+	lock            sync.RWMutex
+	requests        websocketRequestTracker
+
+	ws           *websocket.Conn
+	wsWriteLock  sync.Mutex
+	stopFunc     func(error)
+	connLock     sync.RWMutex
+	stopping     atomic.Bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+	shortCircuit chan struct{}
+}
+
+// NewWebsocketMultiplexer creates a new WebsocketMultiplexer that connects to the given base URL.
+func NewWebsocketMultiplexer(baseURL string, log zerolog.Logger) *WebsocketMultiplexer {
+	return &WebsocketMultiplexer{
+		Log:       log,
+		URL:       baseURL,
+		ProcessID: getDefaultProcessID(),
+
+		ReconnectBackoff:      2 * time.Second,
+		MaxReconnectBackoff:   2 * time.Minute,
+		ReconnectBackoffReset: 5 * time.Minute,
+
+		appservices:  make(map[string]*AppService),
+		lastTxnIDs:   make(map[string]string),
+		stop:         make(chan struct{}),
+		shortCircuit: make(chan struct{}),
+	}
+}
+
+// Add adds an appservice to the multiplexer. The appservice must have a registration with a unique ID.
+//
+// Appservices should be added before calling Run. Appservices added while connected
+// will only be registered with the server after the next reconnection.
+func (mux *WebsocketMultiplexer) Add(as *AppService) error {
+	if as.Registration == nil || as.Registration.ID == "" {
+		return fmt.Errorf("appservice doesn't have a registration ID")
+	}
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if _, exists := mux.appservices[as.Registration.ID]; exists {
+		return fmt.Errorf("appservice %q is already added to the multiplexer", as.Registration.ID)
+	}
+	as.PrepareWebsocket()
+	as.wsMux = mux
+	as.StopWebsocket = mux.closeConnection
+	mux.appservices[as.Registration.ID] = as
+	mux.appserviceOrder = append(mux.appserviceOrder, as)
+	return nil
+}
+
+// Get returns the appservice with the given registration ID, or nil if it hasn't been added.
+func (mux *WebsocketMultiplexer) Get(appserviceID string) *AppService {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	return mux.appservices[appserviceID]
+}
+
+func (mux *WebsocketMultiplexer) primary() *AppService {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	if len(mux.appserviceOrder) == 0 {
+		return nil
+	}
+	return mux.appserviceOrder[0]
+}
+
+func (mux *WebsocketMultiplexer) getAll() []*AppService {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	return append([]*AppService(nil), mux.appserviceOrder...)
+}
+
+// AddConnectHandler adds a function that is called in a goroutine every time a connection is opened
+// and all appservices have been registered, in addition to OnConnect.
+func (mux *WebsocketMultiplexer) AddConnectHandler(handler func()) {
+	mux.lock.Lock()
+	mux.connectHandlers = append(mux.connectHandlers, handler)
+	mux.lock.Unlock()
+}
+
+// LastTxnID returns the ID of the last transaction that was acknowledged for the given appservice
+// since the multiplexer was created.
+func (mux *WebsocketMultiplexer) LastTxnID(appserviceID string) string {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	return mux.lastTxnIDs[appserviceID]
+}
+
+func (mux *WebsocketMultiplexer) loadLastTxnID(ctx context.Context, appserviceID string) string {
+	txnID := mux.LastTxnID(appserviceID)
+	if txnID != "" || mux.TxnIDStore == nil {
+		return txnID
+	}
+	txnID, err := mux.TxnIDStore.GetLastTxnID(ctx, appserviceID)
+	if err != nil {
+		mux.Log.Err(err).Str("appservice_id", appserviceID).Msg("Failed to load last transaction ID")
+		return ""
+	}
+	return txnID
+}
+
+func (mux *WebsocketMultiplexer) storeLastTxnID(appserviceID, txnID string) {
+	mux.lock.Lock()
+	mux.lastTxnIDs[appserviceID] = txnID
+	mux.lock.Unlock()
+	if mux.TxnIDStore == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := mux.TxnIDStore.SetLastTxnID(ctx, appserviceID, txnID)
+	if err != nil {
+		mux.Log.Err(err).
+			Str("appservice_id", appserviceID).
+			Str("transaction_id", txnID).
+			Msg("Failed to store last transaction ID")
+	}
+}
+
+// IsConnected returns true if the multiplexer currently has an open websocket connection.
+func (mux *WebsocketMultiplexer) IsConnected() bool {
+	mux.connLock.RLock()
+	defer mux.connLock.RUnlock()
+	return mux.ws != nil
+}
+
+func (mux *WebsocketMultiplexer) send(cmd *WebsocketRequest) error {
+	mux.connLock.RLock()
+	ws := mux.ws
+	mux.connLock.RUnlock()
+	err := writeWebsocket(&mux.wsWriteLock, ws, cmd)
+	if err != nil {
+		return err
+	}
+	if txnResp, ok := cmd.Data.(*WebsocketTransactionResponse); ok && cmd.Command == "response" && txnResp.TxnID != "" {
+		mux.storeLastTxnID(cmd.AppserviceID, txnResp.TxnID)
+	}
+	return nil
+}
+
+func (mux *WebsocketMultiplexer) consume(stopFunc func(error), ws *websocket.Conn) {
+	defer stopFunc(ErrWebsocketUnknownError)
+	primary := mux.primary()
+	for {
+		var msg WebsocketMessage
+		err := ws.ReadJSON(&msg)
+		if err != nil {
+			mux.Log.Debug().Err(err).Msg("Error reading from websocket")
+			stopFunc(parseCloseError(err))
+			return
+		}
+		if msg.Command == "response" || msg.Command == "error" {
+			log := mux.Log.With().
+				Str("appservice_id", msg.AppserviceID).
+				Int("req_id", msg.ReqID).
+				Str("ws_command", msg.Command).
+				Logger()
+			mux.requests.deliver(&log, &msg.WebsocketCommand)
+			continue
+		}
+		target := primary
+		if msg.AppserviceID != "" {
+			target = mux.Get(msg.AppserviceID)
+		}
+		if target != nil {
+			target.handleWebsocketMessage(msg)
+			continue
+		}
+		mux.Log.Warn().
+			Str("appservice_id", msg.AppserviceID).
+			Int("req_id", msg.ReqID).
+			Str("ws_command", msg.Command).
+			Str("transaction_id", msg.TxnID).
+			Msg("Received websocket message for unknown appservice")
+		if resp := msg.MakeResponse(false, fmt.Errorf("unknown appservice ID")); resp != nil {
+			resp.AppserviceID = msg.AppserviceID
+			go func() {
+				err := mux.send(resp)
+				if err != nil {
+					mux.Log.Warn().Err(err).Msg("Failed to send error response for unknown appservice")
+				}
+			}()
+		}
+	}
+}
+
+func (mux *WebsocketMultiplexer) register(ctx context.Context) error {
+	for _, as := range mux.getAll() {
+		err := as.RequestWebsocket(ctx, &WebsocketRequest{
+			Command: WebsocketCommandMultiplexRegister,
+			Data: &WebsocketMultiplexRegister{
+				AppserviceID: as.Registration.ID,
+				AppToken:     as.Registration.AppToken,
+				LastTxnID:    mux.loadLastTxnID(ctx, as.Registration.ID),
+			},
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to register %s: %w", as.Registration.ID, err)
+		}
+	}
+	return nil
+}
+
+// Connect opens a single websocket connection, registers all appservices
+// and blocks until the connection is closed.
+//
+// Most callers should use Run instead, which reconnects automatically.
+func (mux *WebsocketMultiplexer) Connect() error {
+	primary := mux.primary()
+	if primary == nil {
+		return ErrNoMultiplexedAppservices
+	}
+	addr, err := makeWebsocketURL(mux.URL, primary.hsURLForClient)
+	if err != nil {
+		return err
+	}
+	ws, err := dialWebsocket(addr, http.Header{
+		"Authorization": []string{fmt.Sprintf("Bearer %s", primary.Registration.AppToken)},
+		"User-Agent":    []string{primary.BotClient().UserAgent},
+
+		"X-Mautrix-Process-ID":        []string{mux.ProcessID},
+		"X-Mautrix-Websocket-Version": []string{"3"},
+		"X-Mautrix-Multiplex":         []string{"true"},
+	})
+	if err != nil {
+		return err
+	}
+	closeChan := make(chan error)
+	stopFunc := makeWebsocketStopFunc(&mux.Log, closeChan)
+	mux.connLock.Lock()
+	prevStopFunc := mux.stopFunc
+	mux.ws = ws
+	mux.stopFunc = stopFunc
+	mux.connLock.Unlock()
+	if prevStopFunc != nil {
+		prevStopFunc(ErrWebsocketOverridden)
+	}
+	mux.Log.Debug().Msg("Multiplexed appservice transaction websocket opened")
+
+	go mux.consume(stopFunc, ws)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err := mux.register(ctx)
+		if err != nil {
+			mux.Log.Err(err).Msg("Failed to register appservices on multiplexed websocket")
+			stopFunc(err)
+			return
+		}
+		mux.Log.Debug().Msg("Registered all appservices on multiplexed websocket")
+		if mux.OnConnect != nil {
+			go mux.OnConnect()
+		}
+		mux.lock.RLock()
+		handlers := mux.connectHandlers
+		mux.lock.RUnlock()
+		for _, handler := range handlers {
+			go handler()
+		}
+	}()
+
+	closeErr := <-closeChan
+
+	mux.connLock.Lock()
+	if mux.ws == ws {
+		mux.ws = nil
+		mux.stopFunc = nil
+		mux.requests.clear()
+	}
+	mux.connLock.Unlock()
+
+	closeWebsocket(&mux.Log, &mux.wsWriteLock, ws)
+	return closeErr
+}
+
+// Run connects to the websocket server and reconnects with exponential backoff until Stop is called
+// or the connection is replaced by another client. When reconnecting, the ID of the last acknowledged
+// transaction of each appservice is sent to the server so that it can resume where it left off.
+//
+// The return value is nil if the multiplexer was stopped manually, and the close error otherwise.
+func (mux *WebsocketMultiplexer) Run() error {
+	reconnectBackoff := mux.ReconnectBackoff
+	lastDisconnect := time.Now()
+	for {
+		err := mux.Connect()
+		if errors.Is(err, ErrWebsocketManualStop) {
+			return nil
+		} else if errors.Is(err, ErrNoMultiplexedAppservices) {
+			return err
+		} else if closeCommand := (&CloseCommand{}); errors.As(err, &closeCommand) && closeCommand.Status == MeowConnectionReplaced {
+			mux.Log.Warn().Msg("Multiplexed websocket closed by another client")
+			return err
+		} else if err != nil {
+			mux.Log.Err(err).Msg("Error in multiplexed appservice websocket")
+		}
+		if mux.stopping.Load() {
+			return nil
+		}
+		now := time.Now()
+		if lastDisconnect.Add(mux.ReconnectBackoffReset).Before(now) {
+			reconnectBackoff = mux.ReconnectBackoff
+		} else {
+			reconnectBackoff *= 2
+			if reconnectBackoff > mux.MaxReconnectBackoff {
+				reconnectBackoff = mux.MaxReconnectBackoff
+			}
+		}
+		lastDisconnect = now
+		mux.Log.Info().
+			Int("backoff_seconds", int(reconnectBackoff.Seconds())).
+			Msg("Websocket disconnected, reconnecting...")
+		select {
+		case <-mux.shortCircuit:
+			mux.Log.Debug().Msg("Reconnect backoff was short-circuited")
+		case <-mux.stop:
+			return nil
+		case <-time.After(reconnectBackoff):
+		}
+	}
+}
+
+// Reconnect skips the current reconnect backoff sleep if Run is waiting to reconnect.
+func (mux *WebsocketMultiplexer) Reconnect() bool {
+	select {
+	case mux.shortCircuit <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ping pings the server using the first appservice. If the ping fails, the connection is closed,
+// which will make Run reconnect.
+func (mux *WebsocketMultiplexer) Ping(ctx context.Context) (serverTs time.Time, err error) {
+	primary := mux.primary()
+	if primary == nil {
+		return time.Time{}, ErrNoMultiplexedAppservices
+	} else if !mux.IsConnected() {
+		return time.Time{}, ErrWebsocketNotConnected
+	}
+	start := time.Now()
+	serverTs, err = primary.PingWebsocket(ctx)
+	end := time.Now()
+	if err != nil {
+		mux.Log.Warn().Err(err).Dur("duration", end.Sub(start)).Msg("Websocket ping returned error")
+		mux.closeConnection(fmt.Errorf("websocket ping returned error in %s: %w", end.Sub(start), err))
+	} else {
+		mux.Log.Debug().
+			Dur("duration", end.Sub(start)).
+			Dur("req_duration", serverTs.Sub(start)).
+			Dur("resp_duration", end.Sub(serverTs)).
+			Msg("Websocket ping returned success")
+	}
+	return
+}
+
+// RunPinger pings the server at the given interval until Stop is called.
+func (mux *WebsocketMultiplexer) RunPinger(interval time.Duration) {
+	RunWebsocketPinger(&mux.Log, interval, mux.stop, func() bool {
+		if mux.IsConnected() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, _ = mux.Ping(ctx)
+			cancel()
+		}
+		return !mux.stopping.Load()
+	})
+}
+
+// Stop closes the websocket connection and stops Run and RunPinger.
+func (mux *WebsocketMultiplexer) Stop() {
+	mux.stopping.Store(true)
+	mux.stopOnce.Do(func() {
+		close(mux.stop)
+	})
+	mux.closeConnection(ErrWebsocketManualStop)
+}
+
+// closeConnection closes the current connection with the given error, if there is one.
+// It's used as the StopWebsocket function of all added appservices.
+func (mux *WebsocketMultiplexer) closeConnection(err error) {
+	mux.connLock.RLock()
+	stopFunc := mux.stopFunc
+	mux.connLock.RUnlock()
+	if stopFunc != nil {
+		stopFunc(err)
+	}
+}
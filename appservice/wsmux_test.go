@@ -0,0 +1,295 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type testMuxServerConn struct {
+	t      *testing.T
+	ws     *websocket.Conn
+	header http.Header
+}
+
+func (conn *testMuxServerConn) read() WebsocketCommand {
+	_ = conn.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var cmd WebsocketCommand
+	require.NoError(conn.t, conn.ws.ReadJSON(&cmd))
+	return cmd
+}
+
+func (conn *testMuxServerConn) write(data any) {
+	require.NoError(conn.t, conn.ws.WriteJSON(data))
+}
+
+func (conn *testMuxServerConn) acceptRegistrations(count int) map[string]WebsocketMultiplexRegister {
+	regs := make(map[string]WebsocketMultiplexRegister, count)
+	for i := 0; i < count; i++ {
+		cmd := conn.read()
+		require.Equal(conn.t, WebsocketCommandMultiplexRegister, cmd.Command)
+		var reg WebsocketMultiplexRegister
+		require.NoError(conn.t, json.Unmarshal(cmd.Data, &reg))
+		assert.Equal(conn.t, cmd.AppserviceID, reg.AppserviceID)
+		regs[reg.AppserviceID] = reg
+		conn.write(map[string]any{
+			"id":            cmd.ReqID,
+			"command":       "response",
+			"appservice_id": cmd.AppserviceID,
+			"data":          map[string]any{},
+		})
+	}
+	return regs
+}
+
+func newTestMuxServer(t *testing.T) (*httptest.Server, <-chan *testMuxServerConn) {
+	conns := make(chan *testMuxServerConn, 4)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/unstable/fi.mau.as_sync", r.URL.Path)
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		conns <- &testMuxServerConn{t: t, ws: ws, header: r.Header}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, conns
+}
+
+func newTestMuxAppservice(t *testing.T, regID string) *AppService {
+	as := Create()
+	as.Registration = &Registration{ID: regID, AppToken: regID + "_as_token"}
+	as.HomeserverDomain = "example.com"
+	require.NoError(t, as.SetHomeserverURL("http://localhost"))
+	return as
+}
+
+func waitForConn(t *testing.T, conns <-chan *testMuxServerConn) *testMuxServerConn {
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for websocket connection")
+		return nil
+	}
+}
+
+func TestWebsocketMultiplexer(t *testing.T) {
+	srv, conns := newTestMuxServer(t)
+	bridgeA := newTestMuxAppservice(t, "bridge_a")
+	bridgeB := newTestMuxAppservice(t, "bridge_b")
+
+	mux := NewWebsocketMultiplexer(srv.URL, zerolog.Nop())
+	mux.ReconnectBackoff = 10 * time.Millisecond
+	require.NoError(t, mux.Add(bridgeA))
+	require.NoError(t, mux.Add(bridgeB))
+	require.Error(t, mux.Add(newTestMuxAppservice(t, "bridge_a")))
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- mux.Run()
+	}()
+
+	conn := waitForConn(t, conns)
+	assert.Equal(t, "Bearer bridge_a_as_token", conn.header.Get("Authorization"))
+	assert.Equal(t, "true", conn.header.Get("X-Mautrix-Multiplex"))
+	regs := conn.acceptRegistrations(2)
+	assert.Equal(t, "bridge_b_as_token", regs["bridge_b"].AppToken)
+	assert.Empty(t, regs["bridge_b"].LastTxnID)
+	assert.True(t, bridgeA.HasWebsocket())
+	assert.True(t, bridgeB.HasWebsocket())
+
+	conn.write(map[string]any{
+		"id":            5,
+		"command":       "transaction",
+		"appservice_id": "bridge_b",
+		"txn_id":        "txn1",
+		"events": []map[string]any{{
+			"type":     "m.room.message",
+			"room_id":  "!room:example.com",
+			"sender":   "@user:example.com",
+			"event_id": "$event1",
+			"content":  map[string]any{"msgtype": "m.text", "body": "hello"},
+		}},
+	})
+	resp := conn.read()
+	assert.Equal(t, 5, resp.ReqID)
+	assert.Equal(t, "response", resp.Command)
+	assert.Equal(t, "bridge_b", resp.AppserviceID)
+	assert.JSONEq(t, `{"txn_id":"txn1"}`, string(resp.Data))
+
+	select {
+	case evt := <-bridgeB.Events:
+		assert.Equal(t, event.EventMessage, evt.Type)
+		assert.Equal(t, "hello", evt.Content.AsMessage().Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	assert.Empty(t, bridgeA.Events)
+	assert.Eventually(t, func() bool {
+		return mux.LastTxnID("bridge_b") == "txn1"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn.write(map[string]any{"id": 6, "command": "transaction", "appservice_id": "bridge_c", "txn_id": "txn2"})
+	resp = conn.read()
+	assert.Equal(t, 6, resp.ReqID)
+	assert.Equal(t, "error", resp.Command)
+	assert.Equal(t, "bridge_c", resp.AppserviceID)
+
+	require.NoError(t, conn.ws.Close())
+	conn = waitForConn(t, conns)
+	regs = conn.acceptRegistrations(2)
+	assert.Equal(t, "txn1", regs["bridge_b"].LastTxnID)
+	assert.Empty(t, regs["bridge_a"].LastTxnID)
+
+	mux.Stop()
+	select {
+	case err := <-runDone:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for multiplexer to stop")
+	}
+	assert.False(t, bridgeA.HasWebsocket())
+}
+
+func startTestMux(t *testing.T, mux *WebsocketMultiplexer) {
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- mux.Run()
+	}()
+	t.Cleanup(func() {
+		mux.Stop()
+		select {
+		case <-runDone:
+		case <-time.After(5 * time.Second):
+			t.Error("Timed out waiting for multiplexer to stop")
+		}
+	})
+}
+
+func TestWebsocketMultiplexerRequestIDs(t *testing.T) {
+	srv, conns := newTestMuxServer(t)
+	bridgeA := newTestMuxAppservice(t, "bridge_a")
+	bridgeB := newTestMuxAppservice(t, "bridge_b")
+	mux := NewWebsocketMultiplexer(srv.URL, zerolog.Nop())
+	require.NoError(t, mux.Add(bridgeA))
+	require.NoError(t, mux.Add(bridgeB))
+	require.ErrorIs(t, bridgeA.StartWebsocket("", nil), ErrWebsocketMultiplexed)
+	startTestMux(t, mux)
+	conn := waitForConn(t, conns)
+	conn.acceptRegistrations(2)
+
+	results := make(map[string]chan time.Time, 2)
+	for _, as := range []*AppService{bridgeA, bridgeB} {
+		result := make(chan time.Time, 1)
+		results[as.Registration.ID] = result
+		go func(as *AppService) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ts, err := as.PingWebsocket(ctx)
+			assert.NoError(t, err)
+			result <- ts
+		}(as)
+	}
+	reqs := map[string]WebsocketCommand{}
+	for i := 0; i < 2; i++ {
+		cmd := conn.read()
+		require.Equal(t, "ping", cmd.Command)
+		reqs[cmd.AppserviceID] = cmd
+	}
+	require.Len(t, reqs, 2)
+	assert.NotEqual(t, reqs["bridge_a"].ReqID, reqs["bridge_b"].ReqID, "request IDs must be unique across the connection")
+
+	// A response tagged with the wrong appservice must not complete the request
+	conn.write(map[string]any{
+		"id":            reqs["bridge_a"].ReqID,
+		"command":       "response",
+		"appservice_id": "bridge_b",
+		"data":          map[string]any{"timestamp": 1},
+	})
+	// Responses without an appservice ID are matched by the request ID alone
+	conn.write(map[string]any{
+		"id":      reqs["bridge_b"].ReqID,
+		"command": "response",
+		"data":    map[string]any{"timestamp": 2},
+	})
+	conn.write(map[string]any{
+		"id":      reqs["bridge_a"].ReqID,
+		"command": "response",
+		"data":    map[string]any{"timestamp": 3},
+	})
+	for asID, expected := range map[string]int64{"bridge_a": 3, "bridge_b": 2} {
+		select {
+		case ts := <-results[asID]:
+			assert.Equal(t, expected, ts.UnixMilli(), asID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for ping response of %s", asID)
+		}
+	}
+}
+
+type testTxnIDStore struct {
+	lock   sync.Mutex
+	txnIDs map[string]string
+}
+
+func (store *testTxnIDStore) GetLastTxnID(_ context.Context, appserviceID string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.txnIDs[appserviceID], nil
+}
+
+func (store *testTxnIDStore) SetLastTxnID(_ context.Context, appserviceID, txnID string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.txnIDs[appserviceID] = txnID
+	return nil
+}
+
+func TestWebsocketMultiplexerTxnIDStore(t *testing.T) {
+	srv, conns := newTestMuxServer(t)
+	store := &testTxnIDStore{txnIDs: map[string]string{"bridge_a": "txn41"}}
+	bridgeA := newTestMuxAppservice(t, "bridge_a")
+	mux := NewWebsocketMultiplexer(srv.URL, zerolog.Nop())
+	mux.TxnIDStore = store
+	require.NoError(t, mux.Add(bridgeA))
+	connected := make(chan struct{}, 1)
+	mux.AddConnectHandler(func() {
+		connected <- struct{}{}
+	})
+	startTestMux(t, mux)
+	conn := waitForConn(t, conns)
+	regs := conn.acceptRegistrations(1)
+	assert.Equal(t, "txn41", regs["bridge_a"].LastTxnID, "last transaction ID should be loaded from the store")
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for connect handler")
+	}
+
+	conn.write(map[string]any{"id": 1, "command": "transaction", "appservice_id": "bridge_a", "txn_id": "txn42"})
+	resp := conn.read()
+	assert.Equal(t, "response", resp.Command)
+	assert.Eventually(t, func() bool {
+		txnID, _ := store.GetLastTxnID(context.Background(), "bridge_a")
+		return txnID == "txn42"
+	}, 5*time.Second, 10*time.Millisecond)
+}
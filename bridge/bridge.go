@@ -210,6 +210,10 @@ type Bridge struct {
 
 	DoublePuppet *doublePuppetUtil
 
+	// WebsocketMultiplexer, if set, is used to receive events instead of a separate websocket connection.
+	// The appservice is added to it during init, and the caller is responsible for running and stopping it.
+	WebsocketMultiplexer *appservice.WebsocketMultiplexer
+
 	AS               *appservice.AppService
 	EventProcessor   *appservice.EventProcessor
 	CommandProcessor CommandProcessor
@@ -637,6 +641,14 @@ func (br *Bridge) init() {
 	br.AS.DoublePuppetValue = br.Name
 	br.AS.GetProfile = br.getProfile
 	br.Bot = br.AS.BotIntent()
+	if br.WebsocketMultiplexer != nil {
+		err = br.WebsocketMultiplexer.Add(br.AS)
+		if err != nil {
+			br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).
+				Msg("Failed to add appservice to websocket multiplexer")
+			os.Exit(15)
+		}
+	}
 
 	br.ZLog.Debug().Msg("Initializing Matrix event processor")
 	br.EventProcessor = appservice.NewEventProcessor(br.AS)
@@ -734,7 +746,7 @@ func (br *Bridge) start() {
 		br.LogDBUpgradeErrorAndExit("matrix_state", err)
 	}
 
-	if br.Config.Homeserver.Websocket || len(br.Config.Homeserver.WSProxy) > 0 {
+	if br.WebsocketMultiplexer != nil || br.Config.Homeserver.Websocket || len(br.Config.Homeserver.WSProxy) > 0 {
 		br.Websocket = true
 		br.ZLog.Debug().Msg("Starting application service websocket")
 		var wg sync.WaitGroup
@@ -778,7 +790,7 @@ func (br *Bridge) start() {
 	if br.Config.Bridge.GetResendBridgeInfo() {
 		go br.ResendBridgeInfo()
 	}
-	if br.Websocket && br.Config.Homeserver.WSPingInterval > 0 {
+	if br.Websocket && br.WebsocketMultiplexer == nil && br.Config.Homeserver.WSPingInterval > 0 {
 		br.wsStopPinger = make(chan struct{}, 1)
 		go br.websocketServerPinger()
 	}
@@ -817,7 +829,7 @@ func (br *Bridge) stop() {
 		br.Crypto.Stop()
 	}
 	waitForWS := false
-	if br.AS.StopWebsocket != nil {
+	if br.AS.StopWebsocket != nil && br.WebsocketMultiplexer == nil {
 		br.ZLog.Debug().Msg("Stopping application service websocket")
 		br.AS.StopWebsocket(appservice.ErrWebsocketManualStop)
 		waitForWS = true
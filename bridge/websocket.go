@@ -43,6 +43,11 @@ func (br *Bridge) startWebsocket(wg *sync.WaitGroup) {
 		default:
 		}
 	}
+	if br.WebsocketMultiplexer != nil {
+		log.Debug().Msg("Waiting for events from websocket multiplexer")
+		br.WebsocketMultiplexer.AddConnectHandler(onConnect)
+		return
+	}
 	reconnectBackoff := defaultReconnectBackoff
 	lastDisconnect := time.Now().UnixNano()
 	br.wsStopped = make(chan struct{})
@@ -92,21 +97,24 @@ func (br *Bridge) startWebsocket(wg *sync.WaitGroup) {
 	}
 }
 
-type wsPingData struct {
-	Timestamp int64 `json:"timestamp"`
-}
-
 func (br *Bridge) PingServer() (start, serverTs, end time.Time) {
 	if !br.Websocket {
 		panic(fmt.Errorf("PingServer called without websocket enabled"))
 	}
 	if !br.AS.HasWebsocket() {
 		br.ZLog.Debug().Msg("Received server ping request, but no websocket connected. Trying to short-circuit backoff sleep")
-		select {
-		case br.wsShortCircuitReconnectBackoff <- struct{}{}:
-		default:
-			br.ZLog.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
-			return
+		if br.WebsocketMultiplexer != nil {
+			if !br.WebsocketMultiplexer.Reconnect() {
+				br.ZLog.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
+				return
+			}
+		} else {
+			select {
+			case br.wsShortCircuitReconnectBackoff <- struct{}{}:
+			default:
+				br.ZLog.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
+				return
+			}
 		}
 		select {
 		case <-br.wsStarted:
@@ -118,20 +126,15 @@ func (br *Bridge) PingServer() (start, serverTs, end time.Time) {
 		}
 	}
 	start = time.Now()
-	var resp wsPingData
 	br.ZLog.Debug().Msg("Pinging appservice websocket")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err := br.AS.RequestWebsocket(ctx, &appservice.WebsocketRequest{
-		Command: "ping",
-		Data:    &wsPingData{Timestamp: start.UnixMilli()},
-	}, &resp)
+	serverTs, err := br.AS.PingWebsocket(ctx)
 	end = time.Now()
 	if err != nil {
 		br.ZLog.Warn().Err(err).Dur("duration", end.Sub(start)).Msg("Websocket ping returned error")
 		br.AS.StopWebsocket(fmt.Errorf("websocket ping returned error in %s: %w", end.Sub(start), err))
 	} else {
-		serverTs = time.Unix(0, resp.Timestamp*int64(time.Millisecond))
 		br.ZLog.Debug().
 			Dur("duration", end.Sub(start)).
 			Dur("req_duration", serverTs.Sub(start)).
@@ -143,21 +146,8 @@ func (br *Bridge) PingServer() (start, serverTs, end time.Time) {
 
 func (br *Bridge) websocketServerPinger() {
 	interval := time.Duration(br.Config.Homeserver.WSPingInterval) * time.Second
-	clock := time.NewTicker(interval)
-	defer func() {
-		br.ZLog.Info().Msg("Stopping websocket pinger")
-		clock.Stop()
-	}()
-	br.ZLog.Info().Dur("interval_duration", interval).Msg("Starting websocket pinger")
-	for {
-		select {
-		case <-clock.C:
-			br.PingServer()
-		case <-br.wsStopPinger:
-			return
-		}
-		if br.Stopping {
-			return
-		}
-	}
+	appservice.RunWebsocketPinger(br.ZLog, interval, br.wsStopPinger, func() bool {
+		br.PingServer()
+		return !br.Stopping
+	})
 }
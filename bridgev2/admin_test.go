@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestUserLoginReconnect(t *testing.T) {
+	h, login, _, _ := bridgetest.NewChat(t, nil)
+	client := login.Client.(*bridgetest.NetworkAPI)
+	connects, disconnects := client.ConnectionCounts()
+
+	stopReading := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stopReading:
+				return
+			default:
+				// Portals read the client without locking, so Reconnect must never clear or replace it
+				assert.True(t, login.Client.IsLoggedIn())
+			}
+		}
+	}()
+	require.NoError(t, login.Reconnect(h.Ctx))
+	close(stopReading)
+	readers.Wait()
+
+	assert.Same(t, client, login.Client)
+	newConnects, newDisconnects := client.ConnectionCounts()
+	assert.Equal(t, connects+1, newConnects)
+	assert.Equal(t, disconnects+1, newDisconnects)
+
+	login.Delete(h.Ctx, status.BridgeState{StateEvent: status.StateLoggedOut}, bridgev2.DeleteOpts{})
+	assert.Error(t, login.Reconnect(h.Ctx))
+}
+
+func TestGetEventQueueStats(t *testing.T) {
+	h, login, portalKey, roomID := bridgetest.NewChat(t, nil)
+	stats := h.Bridge.GetEventQueueStats()
+	assert.Equal(t, 1, stats.CachedPortals)
+	assert.Zero(t, stats.QueuedEvents)
+	assert.Zero(t, stats.NonEmptyQueues)
+
+	client := login.Client.(*bridgetest.NetworkAPI)
+	unblock := make(chan struct{})
+	client.BlockSend = unblock
+	for i := 0; i < 3; i++ {
+		h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent(id.EventID(fmt.Sprintf("$queued%d:bridge.test", i)), login.UserMXID, roomID, "hi"))
+	}
+	// The first event is being handled, so the other two should be waiting in the queue
+	require.Eventually(t, func() bool {
+		return h.Bridge.GetEventQueueStats().QueuedEvents == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	stats = h.Bridge.GetEventQueueStats()
+	assert.Equal(t, 1, stats.NonEmptyQueues)
+	assert.Equal(t, 2, stats.LongestQueue)
+	assert.Equal(t, portalKey, stats.LongestQueuePortal)
+
+	close(unblock)
+	h.WaitRoom(roomID)
+	assert.Len(t, client.SentMessages(), 3)
+	assert.Zero(t, h.Bridge.GetEventQueueStats().QueuedEvents)
+}
+
+func TestUserGetAllWithManagementRoom(t *testing.T) {
+	h, _, _, _ := bridgetest.NewChat(t, nil)
+	withRoom := h.User("@managed:bridge.test")
+	withRoom.ManagementRoom = "!management:bridge.test"
+	require.NoError(t, withRoom.Save(h.Ctx))
+	h.User("@unmanaged:bridge.test")
+
+	users, err := h.Bridge.DB.User.GetAllWithManagementRoom(h.Ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, withRoom.MXID, users[0].MXID)
+	assert.Equal(t, withRoom.ManagementRoom, users[0].ManagementRoom)
+
+	other := database.New("other", database.MetaTypes{}, h.DB)
+	users, err = other.User.GetAllWithManagementRoom(h.Ctx)
+	require.NoError(t, err)
+	assert.Empty(t, users, "users of other bridges must not be returned")
+}
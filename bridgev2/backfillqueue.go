@@ -14,7 +14,9 @@ import (
 
 	"github.com/rs/zerolog"
 
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
 	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
 )
 
 const BackfillMinBackoffAfterRoomCreate = 1 * time.Minute
@@ -28,21 +30,47 @@ func (br *Bridge) WakeupBackfillQueue() {
 	}
 }
 
+func (br *Bridge) backfillQueueEnabled() bool {
+	cfg := br.GetConfig()
+	return cfg.Backfill.Enabled && cfg.Backfill.Queue.Enabled
+}
+
+// RunBackfillQueue runs the backfill queue until the bridge is stopped.
+// It returns immediately if the queue is disabled in the config or is already running.
+//
+// If the queue is disabled by reloading the config, the loop keeps running, but doesn't handle any tasks.
 func (br *Bridge) RunBackfillQueue() {
-	if !br.Config.Backfill.Queue.Enabled || !br.Config.Backfill.Enabled {
+	if !br.backfillQueueEnabled() {
+		return
+	} else if !br.backfillQueueRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer br.backfillQueueRunning.Store(false)
+	select {
+	case <-br.stopBackfillQueue:
 		return
+	default:
 	}
 	log := br.Log.With().Str("component", "backfill queue").Logger()
 	if !br.Matrix.GetCapabilities().BatchSending {
-		log.Warn().Msg("Backfill queue is enabled in config, but Matrix server doesn't support batch sending")
-		return
+		if br.GetConfig().Backfill.Queue.LegacyMode == bridgeconfig.BackfillLegacyModeDisabled {
+			log.Warn().Msg("Backfill queue is enabled in config, but Matrix server doesn't support batch sending")
+			return
+		}
+		log.Info().
+			Str("legacy_mode", string(br.GetConfig().Backfill.Queue.LegacyMode)).
+			Msg("Matrix server doesn't support batch sending, using legacy backfill mode")
 	}
 	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+	defer cancel()
 	go func() {
-		<-br.stopBackfillQueue
-		cancel()
+		select {
+		case <-br.stopBackfillQueue:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
-	batchDelay := time.Duration(br.Config.Backfill.Queue.BatchDelay) * time.Second
+	batchDelay := time.Duration(br.GetConfig().Backfill.Queue.BatchDelay) * time.Second
 	log.Info().Stringer("batch_delay", batchDelay).Msg("Backfill queue starting")
 	noTasksFoundCount := 0
 	for {
@@ -72,8 +100,14 @@ func (br *Bridge) RunBackfillQueue() {
 			return
 		case <-timer.C:
 		}
+		if !br.backfillQueueEnabled() {
+			continue
+		}
 		backfillTask, err := br.DB.BackfillTask.GetNext(ctx)
-		if err != nil {
+		if err != nil && ctx.Err() != nil {
+			log.Info().Msg("Stopping backfill queue")
+			return
+		} else if err != nil {
 			log.Err(err).Msg("Failed to get next backfill queue entry")
 			time.Sleep(BackfillQueueErrorBackoff)
 			continue
@@ -109,7 +143,8 @@ func (br *Bridge) doBackfillTask(ctx context.Context, task *database.BackfillTas
 		time.Sleep(BackfillQueueErrorBackoff)
 		return
 	}
-	completed, err := br.actuallyDoBackfillTask(ctx, task)
+	extraBatchesBefore := task.ExtraBatches
+	completed, maxBatchesReached, err := br.actuallyDoBackfillTask(ctx, task)
 	if err != nil {
 		log.Err(err).Msg("Failed to do backfill task")
 		time.Sleep(BackfillQueueErrorBackoff)
@@ -118,6 +153,7 @@ func (br *Bridge) doBackfillTask(ctx context.Context, task *database.BackfillTas
 		log.Info().
 			Int("batch_count", task.BatchCount).
 			Bool("is_done", task.IsDone).
+			Bool("max_batches_reached", maxBatchesReached).
 			Msg("Backfill task completed successfully")
 	} else {
 		log.Info().
@@ -125,13 +161,90 @@ func (br *Bridge) doBackfillTask(ctx context.Context, task *database.BackfillTas
 			Bool("is_done", task.IsDone).
 			Msg("Backfill task canceled")
 	}
-	err = br.DB.BackfillTask.Update(ctx, task)
+	updated, err := br.DB.BackfillTask.UpdateProgress(ctx, task, extraBatchesBefore-task.ExtraBatches, maxBatchesReached)
 	if err != nil {
 		log.Err(err).Msg("Failed to update backfill task")
 		time.Sleep(BackfillQueueErrorBackoff)
+	} else if !updated {
+		log.Info().Msg("Backfill task was restarted or removed while the batch was running, discarded progress")
 	}
 }
 
+// BackfillTaskInfo contains a backfill task along with statistics about the messages bridged in the portal.
+type BackfillTaskInfo = database.BackfillTaskInfo
+
+// GetBackfillTaskInfo returns the backfill task of the given portal along with message statistics.
+func (br *Bridge) GetBackfillTaskInfo(ctx context.Context, task *database.BackfillTask) (*BackfillTaskInfo, error) {
+	info := &BackfillTaskInfo{BackfillTask: task}
+	var err error
+	info.MessageCount, err = br.DB.Message.CountMessagesInPortal(ctx, task.PortalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count messages in portal: %w", err)
+	}
+	firstMessage, err := br.DB.Message.GetFirstPortalMessage(ctx, task.PortalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get first portal message: %w", err)
+	} else if firstMessage != nil {
+		info.OldestMessageTS = firstMessage.Timestamp
+	}
+	return info, nil
+}
+
+// GetAllBackfillTaskInfo returns all backfill tasks along with message statistics.
+// Pending tasks are sorted first.
+func (br *Bridge) GetAllBackfillTaskInfo(ctx context.Context) ([]*BackfillTaskInfo, error) {
+	infos, err := br.DB.BackfillTask.GetAllWithStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backfill tasks: %w", err)
+	}
+	return infos, nil
+}
+
+type BackfillControlAction string
+
+const (
+	BackfillActionPause      BackfillControlAction = "pause"
+	BackfillActionResume     BackfillControlAction = "resume"
+	BackfillActionRestart    BackfillControlAction = "restart"
+	BackfillActionPrioritize BackfillControlAction = "prioritize"
+	BackfillActionMore       BackfillControlAction = "more"
+)
+
+// ControlBackfill changes the state of the backfill task of the given portal.
+// The batches parameter is only used for [BackfillActionMore].
+func (br *Bridge) ControlBackfill(ctx context.Context, portalKey networkid.PortalKey, action BackfillControlAction, batches int) error {
+	task, err := br.DB.BackfillTask.GetByPortal(ctx, portalKey)
+	if err != nil {
+		return fmt.Errorf("failed to get backfill task: %w", err)
+	} else if task == nil {
+		return ErrBackfillTaskNotFound
+	}
+	switch action {
+	case BackfillActionPause:
+		err = br.DB.BackfillTask.SetPaused(ctx, portalKey, true)
+	case BackfillActionResume:
+		err = br.DB.BackfillTask.SetPaused(ctx, portalKey, false)
+	case BackfillActionRestart:
+		err = br.DB.BackfillTask.Restart(ctx, portalKey)
+	case BackfillActionPrioritize:
+		err = br.DB.BackfillTask.Prioritize(ctx, portalKey)
+	case BackfillActionMore:
+		if batches <= 0 {
+			return fmt.Errorf("batch count must be positive")
+		}
+		err = br.DB.BackfillTask.AddExtraBatches(ctx, portalKey, batches)
+	default:
+		return fmt.Errorf("unknown backfill action %q", action)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s backfill task: %w", action, err)
+	}
+	if action != BackfillActionPause {
+		br.WakeupBackfillQueue()
+	}
+	return nil
+}
+
 func (portal *Portal) deleteBackfillQueueTaskIfRoomDoesNotExist(ctx context.Context) bool {
 	// Acquire the room create lock to ensure that task deletion doesn't race with room creation
 	portal.roomCreateLock.Lock()
@@ -147,11 +260,11 @@ func (portal *Portal) deleteBackfillQueueTaskIfRoomDoesNotExist(ctx context.Cont
 	return false
 }
 
-func (br *Bridge) actuallyDoBackfillTask(ctx context.Context, task *database.BackfillTask) (bool, error) {
+func (br *Bridge) actuallyDoBackfillTask(ctx context.Context, task *database.BackfillTask) (completed, maxBatchesReached bool, err error) {
 	log := zerolog.Ctx(ctx)
 	portal, err := br.GetExistingPortalByKey(ctx, task.PortalKey)
 	if err != nil {
-		return false, fmt.Errorf("failed to get portal for backfill task: %w", err)
+		return false, false, fmt.Errorf("failed to get portal for backfill task: %w", err)
 	} else if portal == nil {
 		log.Warn().Msg("Portal not found for backfill task")
 		err = br.DB.BackfillTask.Delete(ctx, task.PortalKey)
@@ -159,14 +272,14 @@ func (br *Bridge) actuallyDoBackfillTask(ctx context.Context, task *database.Bac
 			log.Err(err).Msg("Failed to delete backfill task after portal wasn't found")
 			time.Sleep(BackfillQueueErrorBackoff)
 		}
-		return false, nil
+		return false, false, nil
 	} else if portal.MXID == "" {
 		portal.deleteBackfillQueueTaskIfRoomDoesNotExist(ctx)
-		return false, nil
+		return false, false, nil
 	}
 	login, err := br.GetExistingUserLoginByID(ctx, task.UserLoginID)
 	if err != nil {
-		return false, fmt.Errorf("failed to get user login for backfill task: %w", err)
+		return false, false, fmt.Errorf("failed to get user login for backfill task: %w", err)
 	} else if login == nil || !login.Client.IsLoggedIn() {
 		if login == nil {
 			log.Warn().Msg("User login not found for backfill task")
@@ -175,14 +288,14 @@ func (br *Bridge) actuallyDoBackfillTask(ctx context.Context, task *database.Bac
 		}
 		logins, err := br.GetUserLoginsInPortal(ctx, portal.PortalKey)
 		if err != nil {
-			return false, fmt.Errorf("failed to get user portals for backfill task: %w", err)
+			return false, false, fmt.Errorf("failed to get user portals for backfill task: %w", err)
 		} else if len(logins) == 0 {
 			log.Debug().Msg("No user logins found for backfill task")
 			task.NextDispatchMinTS = database.BackfillNextDispatchNever
 			if login == nil {
 				task.UserLoginID = ""
 			}
-			return false, nil
+			return false, false, nil
 		}
 		if login == nil {
 			task.UserLoginID = ""
@@ -202,45 +315,50 @@ func (br *Bridge) actuallyDoBackfillTask(ctx context.Context, task *database.Bac
 		if !foundLogin {
 			log.Debug().Msg("No logged in user logins found for backfill task")
 			task.NextDispatchMinTS = database.BackfillNextDispatchNever
-			return false, nil
+			return false, false, nil
 		}
 	}
 	if task.BatchCount < 0 {
 		var msgCount int
 		msgCount, err = br.DB.Message.CountMessagesInPortal(ctx, task.PortalKey)
 		if err != nil {
-			return false, fmt.Errorf("failed to count messages in portal: %w", err)
+			return false, false, fmt.Errorf("failed to count messages in portal: %w", err)
 		}
-		task.BatchCount = msgCount / br.Config.Backfill.Queue.BatchSize
+		task.BatchCount = msgCount / br.GetConfig().Backfill.Queue.BatchSize
 		log.Debug().
 			Int("message_count", msgCount).
 			Int("batch_count", task.BatchCount).
 			Msg("Calculated existing batch count")
 	}
-	maxBatches := br.Config.Backfill.Queue.MaxBatches
+	maxBatches := br.GetConfig().Backfill.Queue.MaxBatches
 	api, ok := login.Client.(BackfillingNetworkAPI)
 	if !ok {
-		return false, fmt.Errorf("network API does not support backfilling")
+		return false, false, fmt.Errorf("network API does not support backfilling")
 	}
 	limiterAPI, ok := api.(BackfillingNetworkAPIWithLimits)
 	if ok {
 		maxBatches = limiterAPI.GetBackfillMaxBatchCount(ctx, portal, task)
 	}
-	if maxBatches < 0 || maxBatches > task.BatchCount {
+	withinLimit := maxBatches < 0 || maxBatches > task.BatchCount
+	if withinLimit || task.ExtraBatches > 0 {
 		err = portal.DoBackwardsBackfill(ctx, login, task)
 		if err != nil {
-			return false, fmt.Errorf("failed to backfill: %w", err)
+			return false, false, fmt.Errorf("failed to backfill: %w", err)
 		}
 		task.BatchCount++
+		// Extra batches are only used up by batches beyond the configured maximum
+		if !withinLimit {
+			task.ExtraBatches--
+		}
 	} else {
 		log.Debug().
 			Int("max_batches", maxBatches).
 			Int("batch_count", task.BatchCount).
 			Msg("Not actually backfilling: max batches reached")
 	}
-	task.IsDone = task.IsDone || (maxBatches > 0 && task.BatchCount >= maxBatches)
-	batchDelay := time.Duration(br.Config.Backfill.Queue.BatchDelay) * time.Second
+	maxBatchesReached = maxBatches > 0 && task.BatchCount >= maxBatches
+	batchDelay := time.Duration(br.GetConfig().Backfill.Queue.BatchDelay) * time.Second
 	task.CompletedAt = time.Now()
 	task.NextDispatchMinTS = task.CompletedAt.Add(batchDelay)
-	return true, nil
+	return true, maxBatchesReached, nil
 }
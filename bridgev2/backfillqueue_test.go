@@ -0,0 +1,177 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestActuallyDoBackfillTask_ExtraBatches(t *testing.T) {
+	tests := []struct {
+		name             string
+		batchCount       int
+		extraBatches     int
+		wantBatchCount   int
+		wantExtraBatches int
+		wantMaxReached   bool
+	}{
+		{"WithinLimit", 0, 1, 1, 1, false},
+		{"LastBatchWithinLimit", 1, 1, 2, 1, true},
+		{"BeyondLimit", 2, 1, 3, 0, true},
+		{"BeyondLimitWithoutExtra", 2, 0, 2, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := bridgetest.DefaultConfig()
+			cfg.Backfill.Queue.LegacyMode = bridgeconfig.BackfillLegacyModeInline
+			cfg.Backfill.Queue.BatchSize = 2
+			cfg.Backfill.Queue.MaxBatches = 2
+			h, login, portalKey, _ := bridgetest.NewChat(t, cfg)
+			login.Client.(*bridgetest.NetworkAPI).FetchMessagesFunc = fetchTwoBatches
+
+			task := &database.BackfillTask{
+				PortalKey:    portalKey,
+				UserLoginID:  login.ID,
+				BatchCount:   test.batchCount,
+				ExtraBatches: test.extraBatches,
+			}
+			completed, maxReached, err := h.Bridge.ActuallyDoBackfillTask(h.Ctx, task)
+			require.NoError(t, err)
+			assert.True(t, completed)
+			assert.Equal(t, test.wantMaxReached, maxReached)
+			assert.Equal(t, test.wantExtraBatches, task.ExtraBatches)
+			assert.Equal(t, test.wantBatchCount, task.BatchCount)
+		})
+	}
+}
+
+func TestReloadConfigStartsBackfillQueue(t *testing.T) {
+	cfg := bridgetest.DefaultConfig()
+	cfg.Backfill.Queue.LegacyMode = bridgeconfig.BackfillLegacyModeInline
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, cfg)
+	br := h.Bridge
+	br.RunBackfillQueue()
+	assert.False(t, br.IsBackfillQueueRunning(), "queue shouldn't run while disabled")
+
+	newConfig := *br.GetConfig()
+	newConfig.Backfill.Enabled = true
+	newConfig.Backfill.Queue.Enabled = true
+	br.ReloadConfig(&newConfig)
+	assert.Eventually(t, br.IsBackfillQueueRunning, 5*time.Second, 10*time.Millisecond)
+
+	h.Stop()
+	assert.Eventually(t, func() bool {
+		return !br.IsBackfillQueueRunning()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackfillTaskProgressKeepsControls(t *testing.T) {
+	h, login, portalKey, _ := bridgetest.NewChat(t, nil)
+	require.NoError(t, h.Bridge.DB.BackfillTask.Upsert(h.Ctx, &database.BackfillTask{
+		PortalKey:         portalKey,
+		UserLoginID:       login.ID,
+		BatchCount:        1,
+		ExtraBatches:      1,
+		NextDispatchMinTS: time.Now(),
+	}))
+	task, err := h.Bridge.DB.BackfillTask.GetByPortal(h.Ctx, portalKey)
+	require.NoError(t, err)
+	require.NoError(t, h.Bridge.DB.BackfillTask.MarkDispatched(h.Ctx, task))
+
+	// Simulate commands being run while the batch is being backfilled
+	require.NoError(t, h.Bridge.ControlBackfill(h.Ctx, portalKey, bridgev2.BackfillActionPause, 0))
+	require.NoError(t, h.Bridge.ControlBackfill(h.Ctx, portalKey, bridgev2.BackfillActionMore, 2))
+
+	task.BatchCount++
+	task.ExtraBatches--
+	task.Cursor = "next"
+	updated, err := h.Bridge.DB.BackfillTask.UpdateProgress(h.Ctx, task, 1, true)
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	task, err = h.Bridge.DB.BackfillTask.GetByPortal(h.Ctx, portalKey)
+	require.NoError(t, err)
+	assert.True(t, task.Paused)
+	assert.Equal(t, 2, task.ExtraBatches)
+	assert.False(t, task.IsDone)
+	assert.Equal(t, 2, task.BatchCount)
+	assert.Equal(t, networkid.PaginationCursor("next"), task.Cursor)
+
+	updated, err = h.Bridge.DB.BackfillTask.UpdateProgress(h.Ctx, task, 2, true)
+	require.NoError(t, err)
+	assert.True(t, updated)
+	task, err = h.Bridge.DB.BackfillTask.GetByPortal(h.Ctx, portalKey)
+	require.NoError(t, err)
+	assert.Equal(t, 0, task.ExtraBatches)
+	assert.True(t, task.IsDone)
+}
+
+func TestBackfillTaskProgressAfterRestart(t *testing.T) {
+	h, login, portalKey, _ := bridgetest.NewChat(t, nil)
+	require.NoError(t, h.Bridge.DB.BackfillTask.Upsert(h.Ctx, &database.BackfillTask{
+		PortalKey:         portalKey,
+		UserLoginID:       login.ID,
+		BatchCount:        3,
+		Cursor:            "old",
+		NextDispatchMinTS: time.Now(),
+	}))
+	task, err := h.Bridge.DB.BackfillTask.GetByPortal(h.Ctx, portalKey)
+	require.NoError(t, err)
+	require.NoError(t, h.Bridge.DB.BackfillTask.MarkDispatched(h.Ctx, task))
+
+	// The restart happens while the batch is being backfilled, so the batch's progress must be discarded
+	require.NoError(t, h.Bridge.ControlBackfill(h.Ctx, portalKey, bridgev2.BackfillActionRestart, 0))
+
+	task.BatchCount++
+	task.Cursor = "next"
+	task.IsDone = true
+	updated, err := h.Bridge.DB.BackfillTask.UpdateProgress(h.Ctx, task, 0, false)
+	require.NoError(t, err)
+	assert.False(t, updated)
+
+	task, err = h.Bridge.DB.BackfillTask.GetByPortal(h.Ctx, portalKey)
+	require.NoError(t, err)
+	assert.Equal(t, -1, task.BatchCount)
+	assert.Empty(t, task.Cursor)
+	assert.False(t, task.IsDone)
+}
+
+func TestGetAllBackfillTaskInfo(t *testing.T) {
+	h, login, portalKey, _ := bridgetest.NewChat(t, nil)
+	require.NoError(t, h.Bridge.DB.BackfillTask.EnsureExists(h.Ctx, portalKey, login.ID))
+	emptyKey := networkid.PortalKey{ID: "empty", Receiver: portalKey.Receiver}
+	_, err := h.Bridge.GetPortalByKey(h.Ctx, emptyKey)
+	require.NoError(t, err)
+	require.NoError(t, h.Bridge.DB.BackfillTask.EnsureExists(h.Ctx, emptyKey, login.ID))
+	firstMessage, err := h.Bridge.DB.Message.GetFirstPortalMessage(h.Ctx, portalKey)
+	require.NoError(t, err)
+	require.NotNil(t, firstMessage)
+
+	infos, err := h.Bridge.GetAllBackfillTaskInfo(h.Ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	byPortal := make(map[networkid.PortalKey]*bridgev2.BackfillTaskInfo)
+	for _, info := range infos {
+		byPortal[info.PortalKey] = info
+	}
+	require.Contains(t, byPortal, portalKey)
+	assert.Equal(t, 1, byPortal[portalKey].MessageCount)
+	assert.True(t, firstMessage.Timestamp.Equal(byPortal[portalKey].OldestMessageTS))
+	require.Contains(t, byPortal, emptyKey)
+	assert.Equal(t, 0, byPortal[emptyKey].MessageCount)
+	assert.True(t, byPortal[emptyKey].OldestMessageTS.IsZero())
+}
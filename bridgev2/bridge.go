@@ -10,6 +10,8 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
@@ -34,9 +36,24 @@ type Bridge struct {
 	Bot      MatrixAPI
 	Network  NetworkConnector
 	Commands CommandProcessor
-	Config   *bridgeconfig.BridgeConfig
+	// Config is the bridge config.
+	//
+	// Deprecated: use [Bridge.GetConfig] instead. This field is the config the bridge was created with,
+	// and it isn't updated by [Bridge.ReloadConfig].
+	Config *bridgeconfig.BridgeConfig
 
 	DisappearLoop *DisappearLoop
+	// ScheduledMessages holds Matrix messages that should be sent later.
+	ScheduledMessages *ScheduledMessageLoop
+	// Metrics is nil unless metrics are enabled in the config.
+	Metrics *Metrics
+	// SharedDB should be set if the database is shared with other bridges in the same process.
+	// If true, Stop will not close the database.
+	SharedDB bool
+	// Version is a human-readable version of the bridge software, shown in admin commands.
+	Version string
+	// StartTime is the time when Start or StartConnectors was called.
+	StartTime time.Time
 
 	usersByMXID    map[id.UserID]*User
 	userLoginsByID map[networkid.UserLoginID]*UserLogin
@@ -45,8 +62,12 @@ type Bridge struct {
 	ghostsByID     map[networkid.UserID]*Ghost
 	cacheLock      sync.Mutex
 
-	wakeupBackfillQueue chan struct{}
-	stopBackfillQueue   chan struct{}
+	wakeupBackfillQueue  chan struct{}
+	stopBackfillQueue    chan struct{}
+	backfillQueueRunning atomic.Bool
+	loginsStarted        atomic.Bool
+
+	config atomic.Pointer[bridgeconfig.BridgeConfig]
 }
 
 func NewBridge(
@@ -65,7 +86,6 @@ func NewBridge(
 
 		Matrix:  matrix,
 		Network: network,
-		Config:  cfg,
 
 		usersByMXID:    make(map[id.UserID]*User),
 		userLoginsByID: make(map[networkid.UserLoginID]*UserLogin),
@@ -76,14 +96,17 @@ func NewBridge(
 		wakeupBackfillQueue: make(chan struct{}),
 		stopBackfillQueue:   make(chan struct{}),
 	}
-	if br.Config == nil {
-		br.Config = &bridgeconfig.BridgeConfig{CommandPrefix: "!bridge"}
+	if cfg == nil {
+		cfg = &bridgeconfig.BridgeConfig{CommandPrefix: "!bridge"}
 	}
+	br.config.Store(cfg)
+	br.Config = cfg
 	br.Commands = newCommandProcessor(br)
 	br.Matrix.Init(br)
 	br.Bot = br.Matrix.BotIntent()
 	br.Network.Init(br)
 	br.DisappearLoop = &DisappearLoop{br: br}
+	br.ScheduledMessages = &ScheduledMessageLoop{br: br}
 	return br
 }
 
@@ -114,6 +137,7 @@ func (br *Bridge) Start() error {
 
 func (br *Bridge) StartConnectors() error {
 	br.Log.Info().Msg("Starting bridge")
+	br.StartTime = time.Now()
 	ctx := br.Log.WithContext(context.Background())
 
 	err := br.DB.Upgrade(ctx)
@@ -134,7 +158,8 @@ func (br *Bridge) StartConnectors() error {
 	if br.Network.GetCapabilities().DisappearingMessages {
 		go br.DisappearLoop.Start()
 	}
-	if didSplitPortals || br.Config.ResendBridgeInfo {
+	br.ScheduledMessages.Start()
+	if didSplitPortals || br.GetConfig().ResendBridgeInfo {
 		br.ResendBridgeInfo(ctx)
 	}
 	return nil
@@ -153,10 +178,43 @@ func (br *Bridge) ResendBridgeInfo(ctx context.Context) {
 	log.Info().Msg("Resent bridge info to all portals")
 }
 
+// GetConfig returns the current bridge config.
+//
+// The returned config must not be modified, as it may be read concurrently by other goroutines.
+// It may be replaced at any time by [Bridge.ReloadConfig], so code that needs several fields
+// to be consistent with each other should call this once and keep using the same pointer.
+func (br *Bridge) GetConfig() *bridgeconfig.BridgeConfig {
+	return br.config.Load()
+}
+
+// ReloadConfig replaces the bridge config with the given one at runtime.
+//
+// The config is published atomically, so [Bridge.GetConfig] returns either the old or the new config,
+// and the old config is never modified. User permissions are read from the current config,
+// so they change immediately. The backfill queue is woken up to pick up new limits,
+// and started if it was enabled by the reload.
+// The caller is responsible for only changing fields that are safe to reload (see [bridgeconfig.ReloadableSections]).
+//
+// The deprecated [Bridge.Config] and [User.Permissions] fields keep their old values, as they're read without locking.
+// If the network connector doesn't implement [ConfigReloadingNetwork], a warning is logged, as it may still be using them.
+func (br *Bridge) ReloadConfig(cfg *bridgeconfig.BridgeConfig) {
+	br.config.Store(cfg)
+	if br.loginsStarted.Load() {
+		go br.RunBackfillQueue()
+	}
+	br.WakeupBackfillQueue()
+	if reloadingNet, ok := br.Network.(ConfigReloadingNetwork); ok {
+		reloadingNet.OnConfigReloaded(cfg)
+	} else {
+		br.Log.Warn().Msg("Network connector doesn't declare support for config reloads, " +
+			"so it may not see the new config if it reads the deprecated Bridge.Config or User.Permissions fields")
+	}
+}
+
 func (br *Bridge) MigrateToSplitPortals(ctx context.Context) bool {
 	log := zerolog.Ctx(ctx).With().Str("action", "migrate to split portals").Logger()
 	ctx = log.WithContext(ctx)
-	if !br.Config.SplitPortals || br.DB.KV.Get(ctx, database.KeySplitPortalsEnabled) == "true" {
+	if !br.GetConfig().SplitPortals || br.DB.KV.Get(ctx, database.KeySplitPortalsEnabled) == "true" {
 		return false
 	}
 	affected, err := br.DB.Portal.MigrateToSplitPortals(ctx)
@@ -195,6 +253,7 @@ func (br *Bridge) StartLogins() error {
 		br.Log.Info().Msg("No user logins found")
 		br.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateUnconfigured})
 	}
+	br.loginsStarted.Store(true)
 	go br.RunBackfillQueue()
 
 	br.Log.Info().Msg("Bridge started")
@@ -204,6 +263,7 @@ func (br *Bridge) StartLogins() error {
 func (br *Bridge) Stop() {
 	br.Log.Info().Msg("Shutting down bridge")
 	close(br.stopBackfillQueue)
+	br.ScheduledMessages.Stop()
 	br.Matrix.Stop()
 	br.cacheLock.Lock()
 	var wg sync.WaitGroup
@@ -216,9 +276,40 @@ func (br *Bridge) Stop() {
 	if stopNet, ok := br.Network.(StoppableNetwork); ok {
 		stopNet.Stop()
 	}
-	err := br.DB.Close()
-	if err != nil {
-		br.Log.Warn().Err(err).Msg("Failed to close database")
+	if !br.SharedDB {
+		err := br.DB.Close()
+		if err != nil {
+			br.Log.Warn().Err(err).Msg("Failed to close database")
+		}
 	}
 	br.Log.Info().Msg("Shutdown complete")
 }
+
+// EventQueueStats contains statistics about the event queues of portals that are currently loaded in memory.
+type EventQueueStats struct {
+	CachedPortals      int
+	NonEmptyQueues     int
+	QueuedEvents       int
+	LongestQueue       int
+	LongestQueuePortal networkid.PortalKey
+}
+
+// GetEventQueueStats returns the current statistics of portal event queues.
+func (br *Bridge) GetEventQueueStats() (stats EventQueueStats) {
+	br.cacheLock.Lock()
+	defer br.cacheLock.Unlock()
+	stats.CachedPortals = len(br.portalsByKey)
+	for key, portal := range br.portalsByKey {
+		depth := len(portal.events)
+		if depth == 0 {
+			continue
+		}
+		stats.NonEmptyQueues++
+		stats.QueuedEvents += depth
+		if depth > stats.LongestQueue {
+			stats.LongestQueue = depth
+			stats.LongestQueuePortal = key
+		}
+	}
+	return
+}
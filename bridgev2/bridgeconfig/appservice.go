@@ -7,6 +7,7 @@
 package bridgeconfig
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"go.mau.fi/util/random"
 	"gopkg.in/yaml.v3"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/id"
 )
@@ -32,8 +34,10 @@ type AppserviceConfig struct {
 	ASToken string `yaml:"as_token"`
 	HSToken string `yaml:"hs_token"`
 
-	EphemeralEvents   bool `yaml:"ephemeral_events"`
-	AsyncTransactions bool `yaml:"async_transactions"`
+	EphemeralEvents      bool `yaml:"ephemeral_events"`
+	AsyncTransactions    bool `yaml:"async_transactions"`
+	DurableTransactions  bool `yaml:"durable_transactions"`
+	ThirdPartyUserLookup bool `yaml:"third_party_user_lookup"`
 
 	UsernameTemplate string             `yaml:"username_template"`
 	usernameTemplate *template.Template `yaml:"-"`
@@ -93,13 +97,51 @@ func (config *Config) GenerateRegistration() *appservice.Registration {
 	config.Encryption.applyUnstableFlags(registration)
 
 	registration.SenderLocalpart = random.String(32)
+	config.RegisterNamespaces(registration)
+
+	return registration
+}
+
+// RegisterNamespaces adds the bridge bot and ghost user namespaces of this config to the given registration.
+func (config *Config) RegisterNamespaces(registration *appservice.Registration) {
 	botRegex := regexp.MustCompile(fmt.Sprintf("^@%s:%s$",
 		regexp.QuoteMeta(config.AppService.Bot.Username),
 		regexp.QuoteMeta(config.Homeserver.Domain)))
 	registration.Namespaces.UserIDs.Register(botRegex, true)
 	registration.Namespaces.UserIDs.Register(config.MakeUserIDRegex(".*"), true)
+}
 
-	return registration
+// ValidateRegistration checks that the given registration is valid and matches this config.
+// This includes checking that the bot and ghost user IDs generated with the username template
+// are inside exclusive user namespaces of the registration.
+func (config *Config) ValidateRegistration(registration *appservice.Registration) error {
+	// Bridge registrations use a random sender_localpart that isn't used for anything,
+	// so only the bot user is required to be in a namespace.
+	errs := []error{registration.Validate("")}
+	if registration.ID != config.AppService.ID {
+		errs = append(errs, fmt.Errorf("registration id %q doesn't match appservice.id %q", registration.ID, config.AppService.ID))
+	}
+	if registration.AppToken != config.AppService.ASToken {
+		errs = append(errs, errors.New("registration as_token doesn't match appservice.as_token"))
+	}
+	if registration.ServerToken != config.AppService.HSToken {
+		errs = append(errs, errors.New("registration hs_token doesn't match appservice.hs_token"))
+	}
+	if registration.URL != config.AppService.Address {
+		errs = append(errs, fmt.Errorf("registration url %q doesn't match appservice.address %q", registration.URL, config.AppService.Address))
+	}
+	botMXID := id.NewUserID(config.AppService.Bot.Username, config.Homeserver.Domain)
+	if !registration.Namespaces.UserIDs.MatchesExclusive(string(botMXID)) {
+		errs = append(errs, fmt.Errorf("bot user %s is not in an exclusive user namespace", botMXID))
+	}
+	for _, sample := range []string{"1234567890", "abcdef", "user.name_123"} {
+		ghostMXID := id.NewUserID(config.AppService.FormatUsername(sample), config.Homeserver.Domain)
+		if !registration.Namespaces.UserIDs.MatchesExclusive(string(ghostMXID)) {
+			errs = append(errs, fmt.Errorf("ghost user %s generated with the username template is not in an exclusive user namespace", ghostMXID))
+			break
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (config *Config) MakeAppService() *appservice.AppService {
@@ -110,6 +152,9 @@ func (config *Config) MakeAppService() *appservice.AppService {
 	as.Host.Port = config.AppService.Port
 	as.Registration = config.AppService.GetRegistration()
 	config.Encryption.applyUnstableFlags(as.Registration)
+	if rl := config.Homeserver.RateLimit; rl.RequestsPerSecond > 0 {
+		as.RateLimiter = mautrix.NewRateLimiter(rl.RequestsPerSecond, rl.Burst)
+	}
 	return as
 }
 
@@ -6,6 +6,12 @@
 
 package bridgeconfig
 
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
 type BackfillConfig struct {
 	Enabled              bool `yaml:"enabled"`
 	MaxInitialMessages   int  `yaml:"max_initial_messages"`
@@ -27,6 +33,40 @@ type BackfillQueueConfig struct {
 	MaxBatches int  `yaml:"max_batches"`
 
 	MaxBatchesOverride map[string]int `yaml:"max_batches_override"`
+
+	LegacyMode BackfillLegacyMode `yaml:"legacy_mode"`
+}
+
+// BackfillLegacyMode specifies how the backfill queue sends old messages
+// when the homeserver doesn't support batch sending.
+type BackfillLegacyMode string
+
+const (
+	// BackfillLegacyModeDisabled disables the backfill queue on homeservers without batch sending.
+	BackfillLegacyModeDisabled BackfillLegacyMode = ""
+	// BackfillLegacyModeThread sends old messages into a separate history thread.
+	BackfillLegacyModeThread BackfillLegacyMode = "thread"
+	// BackfillLegacyModeInline sends old messages at the end of the room, with notices marking each batch.
+	BackfillLegacyModeInline BackfillLegacyMode = "inline"
+)
+
+func (mode *BackfillLegacyMode) UnmarshalYAML(node *yaml.Node) error {
+	if node.Tag == "!!null" {
+		*mode = BackfillLegacyModeDisabled
+		return nil
+	}
+	var str string
+	err := node.Decode(&str)
+	if err != nil {
+		return err
+	}
+	switch BackfillLegacyMode(str) {
+	case BackfillLegacyModeDisabled, BackfillLegacyModeThread, BackfillLegacyModeInline:
+		*mode = BackfillLegacyMode(str)
+		return nil
+	default:
+		return fmt.Errorf("invalid backfill legacy mode %q", str)
+	}
 }
 
 func (bqc *BackfillQueueConfig) GetOverride(name string) int {
@@ -0,0 +1,42 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgeconfig_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+)
+
+func TestBackfillLegacyMode_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected bridgeconfig.BackfillLegacyMode
+	}{
+		{"Thread", "legacy_mode: thread", bridgeconfig.BackfillLegacyModeThread},
+		{"Inline", "legacy_mode: inline", bridgeconfig.BackfillLegacyModeInline},
+		{"Empty", `legacy_mode: ""`, bridgeconfig.BackfillLegacyModeDisabled},
+		{"Null", "legacy_mode: null", bridgeconfig.BackfillLegacyModeDisabled},
+		{"Missing", "batch_size: 10", bridgeconfig.BackfillLegacyModeDisabled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cfg bridgeconfig.BackfillQueueConfig
+			require.NoError(t, yaml.Unmarshal([]byte(test.input), &cfg))
+			assert.Equal(t, test.expected, cfg.LegacyMode)
+		})
+	}
+
+	var cfg bridgeconfig.BackfillQueueConfig
+	err := yaml.Unmarshal([]byte("legacy_mode: threads"), &cfg)
+	assert.ErrorContains(t, err, `invalid backfill legacy mode "threads"`)
+}
@@ -24,6 +24,7 @@ type Config struct {
 	Matrix       MatrixConfig       `yaml:"matrix"`
 	Analytics    AnalyticsConfig    `yaml:"analytics"`
 	Provisioning ProvisioningConfig `yaml:"provisioning"`
+	Metrics      MetricsConfig      `yaml:"metrics"`
 	PublicMedia  PublicMediaConfig  `yaml:"public_media"`
 	DirectMedia  DirectMediaConfig  `yaml:"direct_media"`
 	Backfill     BackfillConfig     `yaml:"backfill"`
@@ -96,6 +97,12 @@ type ProvisioningConfig struct {
 	DebugEndpoints bool   `yaml:"debug_endpoints"`
 }
 
+type MetricsConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	ServeOnAppservice bool   `yaml:"serve_on_appservice"`
+	Listen            string `yaml:"listen"`
+}
+
 type DirectMediaConfig struct {
 	Enabled                bool   `yaml:"enabled"`
 	MediaIDPrefix          string `yaml:"media_id_prefix"`
@@ -17,6 +17,8 @@ type EncryptionConfig struct {
 	Appservice bool `yaml:"appservice"`
 	MSC4190    bool `yaml:"msc4190"`
 
+	GhostDevices bool `yaml:"ghost_devices"`
+
 	PlaintextMentions bool `yaml:"plaintext_mentions"`
 
 	PickleKey string `yaml:"pickle_key"`
@@ -0,0 +1,86 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgeconfig
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReloadableSections contains the config paths that can be changed at runtime without restarting the bridge.
+var ReloadableSections = []string{
+	"bridge.relay",
+	"bridge.permissions",
+	"backfill",
+}
+
+// ReloadResult describes the differences found when reloading the config.
+type ReloadResult struct {
+	// Reloaded contains the paths of changed sections that were applied.
+	Reloaded []string
+	// RequiresRestart contains the paths of changed sections that were not applied,
+	// because they can only be changed by restarting the bridge.
+	RequiresRestart []string
+}
+
+// HasChanges returns true if any config section changed.
+func (rr *ReloadResult) HasChanges() bool {
+	return len(rr.Reloaded) > 0 || len(rr.RequiresRestart) > 0
+}
+
+func yamlEqual(a, b reflect.Value) bool {
+	aData, aErr := yaml.Marshal(a.Interface())
+	bData, bErr := yaml.Marshal(b.Interface())
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+	return bytes.Equal(aData, bData)
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
+
+// diffReloadable copies reloadable fields from newVal to target and records all changes in result.
+// The values are compared by their YAML representation, as some fields contain unexported compiled data.
+func diffReloadable(target, newVal reflect.Value, prefix string, result *ReloadResult, recurse map[string]bool) {
+	for i := 0; i < target.NumField(); i++ {
+		name := yamlName(target.Type().Field(i))
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		if recurse[path] {
+			diffReloadable(target.Field(i), newVal.Field(i), path+".", result, recurse)
+		} else if yamlEqual(target.Field(i), newVal.Field(i)) {
+			continue
+		} else if slices.Contains(ReloadableSections, path) {
+			target.Field(i).Set(newVal.Field(i))
+			result.Reloaded = append(result.Reloaded, path)
+		} else {
+			result.RequiresRestart = append(result.RequiresRestart, path)
+		}
+	}
+}
+
+// MergeReloadable returns a copy of the config where all sections listed in [ReloadableSections]
+// are taken from newConfig. Changes in other sections are not applied, only reported in the result.
+func (c *Config) MergeReloadable(newConfig *Config) (*Config, *ReloadResult) {
+	merged := *c
+	var result ReloadResult
+	// bridge.backfill is a copy of the top-level backfill section, so it's not compared separately.
+	newCopy := *newConfig
+	newCopy.Bridge.Backfill = merged.Bridge.Backfill
+	diffReloadable(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(&newCopy).Elem(), "", &result, map[string]bool{"bridge": true})
+	merged.Bridge.Backfill = merged.Backfill
+	return &merged, &result
+}
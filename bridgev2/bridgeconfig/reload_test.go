@@ -0,0 +1,91 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgeconfig_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+)
+
+const reloadTestConfig = `
+homeserver:
+    address: http://localhost:8008
+    domain: example.com
+bridge:
+    command_prefix: "!test"
+    permissions:
+        "*": relay
+        "@admin:example.com": admin
+    relay:
+        enabled: false
+backfill:
+    enabled: true
+    max_initial_messages: 50
+management_room_texts:
+    welcome: Hello
+`
+
+func parseReloadTestConfig(t *testing.T, data string) *bridgeconfig.Config {
+	t.Helper()
+	var cfg bridgeconfig.Config
+	require.NoError(t, yaml.Unmarshal([]byte(data), &cfg))
+	cfg.Bridge.Backfill = cfg.Backfill
+	return &cfg
+}
+
+func TestConfig_MergeReloadable_NoChanges(t *testing.T) {
+	cfg := parseReloadTestConfig(t, reloadTestConfig)
+	merged, result := cfg.MergeReloadable(parseReloadTestConfig(t, reloadTestConfig))
+	assert.False(t, result.HasChanges())
+	assert.Equal(t, cfg.Bridge.Permissions, merged.Bridge.Permissions)
+}
+
+func TestConfig_MergeReloadable(t *testing.T) {
+	cfg := parseReloadTestConfig(t, reloadTestConfig)
+	newCfg := parseReloadTestConfig(t, `
+homeserver:
+    address: http://localhost:8009
+    domain: example.com
+bridge:
+    command_prefix: "!other"
+    permissions:
+        "*": relay
+        "example.com": user
+        "@admin:example.com": admin
+    relay:
+        enabled: true
+backfill:
+    enabled: true
+    max_initial_messages: 100
+management_room_texts:
+    welcome: Hi
+`)
+	merged, result := cfg.MergeReloadable(newCfg)
+	assert.ElementsMatch(t, []string{"bridge.relay", "bridge.permissions", "backfill"}, result.Reloaded)
+	assert.ElementsMatch(t, []string{"homeserver", "bridge.command_prefix", "management_room_texts"}, result.RequiresRestart)
+
+	// Reloadable sections are taken from the new config
+	assert.True(t, merged.Bridge.Relay.Enabled)
+	assert.True(t, merged.Bridge.Permissions.Get("@user:example.com").Login)
+	assert.Equal(t, 100, merged.Backfill.MaxInitialMessages)
+	assert.Equal(t, 100, merged.Bridge.Backfill.MaxInitialMessages)
+	// Other sections are kept
+	assert.Equal(t, "Hello", merged.ManagementRoomTexts.Welcome)
+	assert.Equal(t, "http://localhost:8008", merged.Homeserver.Address)
+	assert.Equal(t, "!test", merged.Bridge.CommandPrefix)
+	// The original config isn't modified
+	assert.False(t, cfg.Bridge.Relay.Enabled)
+	assert.False(t, cfg.Bridge.Permissions.Get("@user:example.com").Login)
+	assert.Equal(t, 50, cfg.Backfill.MaxInitialMessages)
+	assert.Equal(t, 50, cfg.Bridge.Backfill.MaxInitialMessages)
+	assert.Equal(t, "Hello", cfg.ManagementRoomTexts.Welcome)
+}
@@ -71,6 +71,8 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Str|up.Null, "homeserver", "websocket_proxy")
 	helper.Copy(up.Bool, "homeserver", "websocket")
 	helper.Copy(up.Int, "homeserver", "ping_interval_seconds")
+	helper.Copy(up.Float|up.Int, "homeserver", "rate_limit", "requests_per_second")
+	helper.Copy(up.Int, "homeserver", "rate_limit", "burst")
 
 	helper.Copy(up.Str|up.Null, "appservice", "address")
 	helper.Copy(up.Str|up.Null, "appservice", "public_address")
@@ -82,6 +84,8 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Str, "appservice", "bot", "avatar")
 	helper.Copy(up.Bool, "appservice", "ephemeral_events")
 	helper.Copy(up.Bool, "appservice", "async_transactions")
+	helper.Copy(up.Bool, "appservice", "durable_transactions")
+	helper.Copy(up.Bool, "appservice", "third_party_user_lookup")
 	helper.Copy(up.Str, "appservice", "as_token")
 	helper.Copy(up.Str, "appservice", "hs_token")
 	helper.Copy(up.Str, "appservice", "username_template")
@@ -106,6 +110,10 @@ func doUpgrade(helper up.Helper) {
 	}
 	helper.Copy(up.Bool, "provisioning", "debug_endpoints")
 
+	helper.Copy(up.Bool, "metrics", "enabled")
+	helper.Copy(up.Bool, "metrics", "serve_on_appservice")
+	helper.Copy(up.Str|up.Null, "metrics", "listen")
+
 	helper.Copy(up.Bool, "direct_media", "enabled")
 	helper.Copy(up.Str|up.Null, "direct_media", "media_id_prefix")
 	helper.Copy(up.Str, "direct_media", "server_name")
@@ -137,6 +145,7 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Int, "backfill", "queue", "batch_delay")
 	helper.Copy(up.Int, "backfill", "queue", "max_batches")
 	helper.Copy(up.Map, "backfill", "queue", "max_batches_override")
+	helper.Copy(up.Str|up.Null, "backfill", "queue", "legacy_mode")
 
 	helper.Copy(up.Map, "double_puppet", "servers")
 	helper.Copy(up.Bool, "double_puppet", "allow_discovery")
@@ -151,6 +160,7 @@ func doUpgrade(helper up.Helper) {
 	} else {
 		helper.Copy(up.Bool, "encryption", "msc4190")
 	}
+	helper.Copy(up.Bool, "encryption", "ghost_devices")
 	helper.Copy(up.Bool, "encryption", "allow_key_sharing")
 	if secret, ok := helper.Get(up.Str, "encryption", "pickle_key"); !ok || secret == "generate" {
 		helper.Set(up.Str, random.String(64), "encryption", "pickle_key")
@@ -195,6 +205,7 @@ var SpacedBlocks = [][]string{
 	{"matrix"},
 	{"analytics"},
 	{"provisioning"},
+	{"metrics"},
 	{"public_media"},
 	{"direct_media"},
 	{"backfill"},
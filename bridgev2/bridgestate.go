@@ -110,6 +110,7 @@ func (bsq *BridgeStateQueue) Send(state status.BridgeState) {
 
 	state = state.Fill(bsq.user)
 	bsq.prevUnsent = &state
+	bsq.bridge.Metrics.TrackLoginState(state)
 
 	if len(bsq.ch) >= 8 {
 		bsq.bridge.Log.Warn().Msg("Bridge state queue is nearly full, discarding an item")
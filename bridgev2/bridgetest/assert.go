@@ -0,0 +1,86 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgetest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ExpectedMessage describes a message that is expected in a room timeline. Empty fields are not checked.
+type ExpectedMessage struct {
+	Sender  id.UserID
+	Type    event.Type
+	MsgType event.MessageType
+	Body    string
+	// Edit is the ID of the event that the message is expected to edit.
+	Edit id.EventID
+}
+
+func (em ExpectedMessage) matches(evt *event.Event) bool {
+	if em.Sender != "" && evt.Sender != em.Sender {
+		return false
+	} else if em.Type.Type != "" && evt.Type.Type != em.Type.Type {
+		return false
+	}
+	msg, isMessage := evt.Content.Parsed.(*event.MessageEventContent)
+	if em.MsgType != "" && (!isMessage || msg.MsgType != em.MsgType) {
+		return false
+	} else if em.Body != "" && (!isMessage || msg.Body != em.Body) {
+		return false
+	} else if em.Edit != "" && (!isMessage || msg.RelatesTo.GetReplaceID() != em.Edit) {
+		return false
+	}
+	return true
+}
+
+// AssertMessages asserts that the non-state timeline of the given room matches the expected messages exactly.
+func (h *Harness) AssertMessages(roomID id.RoomID, expected ...ExpectedMessage) bool {
+	h.T.Helper()
+	messages := h.Matrix.Messages(roomID)
+	if !assert.Len(h.T, messages, len(expected), "unexpected number of messages in %s", roomID) {
+		return false
+	}
+	ok := true
+	for i, evt := range messages {
+		ok = assert.Truef(h.T, expected[i].matches(evt), "message #%d (%s) doesn't match: expected %+v, got %s with %+v", i, evt.ID, expected[i], evt.Type.Type, evt.Content.Parsed) && ok
+	}
+	return ok
+}
+
+// AssertBodies asserts that the bodies of all message events in the given room match the given list.
+func (h *Harness) AssertBodies(roomID id.RoomID, bodies ...string) bool {
+	h.T.Helper()
+	var actual []string
+	for _, evt := range h.Matrix.Messages(roomID) {
+		if msg, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+			actual = append(actual, msg.Body)
+		}
+	}
+	return assert.Equal(h.T, bodies, actual, "unexpected message bodies in %s", roomID)
+}
+
+// RequireLastMessage returns the last non-state event in the given room and fails the test if there are none.
+func (h *Harness) RequireLastMessage(roomID id.RoomID) *event.Event {
+	h.T.Helper()
+	messages := h.Matrix.Messages(roomID)
+	require.NotEmpty(h.T, messages, "no messages in %s", roomID)
+	return messages[len(messages)-1]
+}
+
+// AssertMessageStatus asserts that the latest message status sent for the given event has the given status.
+func (h *Harness) AssertMessageStatus(eventID id.EventID, expected event.MessageStatus) bool {
+	h.T.Helper()
+	status := h.Matrix.MessageStatus(eventID)
+	if !assert.NotNil(h.T, status, "no message status for %s", eventID) {
+		return false
+	}
+	return assert.Equal(h.T, expected, status.Status, "unexpected message status for %s", eventID)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgetest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHarness(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	userID := id.UserID("@user:bridge.test")
+	login := h.Login(h.User(userID), "username", map[string]string{"username": "me"})
+	require.Equal(t, networkid.UserLoginID("me"), login.ID)
+
+	portalKey := networkid.PortalKey{ID: "chat", Receiver: login.ID}
+	h.QueueRemoteEvent(login, &simplevent.Message[string]{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventMessage,
+			PortalKey:    portalKey,
+			Sender:       bridgev2.EventSender{Sender: "alice"},
+			CreatePortal: true,
+			Timestamp:    time.Now(),
+		},
+		ID:   "msg1",
+		Data: "hello",
+		ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data string) (*bridgev2.ConvertedMessage, error) {
+			return &bridgev2.ConvertedMessage{
+				Parts: []*bridgev2.ConvertedMessagePart{{
+					Type:    event.EventMessage,
+					Content: &event.MessageEventContent{MsgType: event.MsgText, Body: data},
+				}},
+			}, nil
+		},
+	})
+
+	roomID := h.PortalRoom(portalKey)
+	require.NotEmpty(t, roomID)
+	name := h.Matrix.GetState(roomID, event.StateRoomName, "")
+	require.NotNil(t, name)
+	assert.Equal(t, "Test chat", name.Content.AsRoomName().Name)
+	h.AssertMessages(roomID, bridgetest.ExpectedMessage{
+		Sender: h.Matrix.FormatGhostMXID("alice"),
+		Body:   "hello",
+	})
+
+	evt := h.SendMatrixText(roomID, userID, "hi alice")
+	h.AssertBodies(roomID, "hello", "hi alice")
+	h.AssertMessageStatus(evt.ID, event.MessageStatusSuccess)
+	msg, err := h.Bridge.DB.Message.GetPartByMXID(h.Ctx, evt.ID)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, networkid.MessageID("sent-"+evt.ID), msg.ID)
+}
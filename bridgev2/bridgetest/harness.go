@@ -0,0 +1,246 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bridgetest contains helpers for unit testing bridgev2 network connectors without a homeserver.
+//
+// A [Harness] runs a real [bridgev2.Bridge] with the given network connector, an in-memory SQLite database
+// and a mock [MatrixConnector] that records all events, state and media sent to Matrix.
+// Tests can inject remote and Matrix events, wait for the portal queues to drain and inspect the resulting rooms.
+package bridgetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	_ "go.mau.fi/util/dbutil/litestream"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultTimeout is the maximum time the harness waits for portal queues to drain.
+var DefaultTimeout = 10 * time.Second
+
+var dbCounter atomic.Int64
+
+// NewDatabase creates a new in-memory SQLite database. The database is closed when the test finishes.
+func NewDatabase(t testing.TB) *dbutil.Database {
+	t.Helper()
+	db, err := dbutil.NewFromConfig("", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          fmt.Sprintf("file:bridgetest%d?mode=memory&cache=shared&_txlock=immediate", dbCounter.Add(1)),
+			MaxOpenConns: 1,
+			MaxIdleConns: 1,
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+// DefaultConfig returns a bridge config that gives admin permissions to everyone.
+func DefaultConfig() *bridgeconfig.BridgeConfig {
+	return &bridgeconfig.BridgeConfig{
+		CommandPrefix: "!test",
+		Permissions: bridgeconfig.PermissionConfig{
+			"*": &bridgeconfig.PermissionLevelAdmin,
+		},
+	}
+}
+
+// Harness runs a bridge with a mock Matrix connector for testing network connectors.
+type Harness struct {
+	T       testing.TB
+	Ctx     context.Context
+	DB      *dbutil.Database
+	Matrix  *MatrixConnector
+	Network bridgev2.NetworkConnector
+	Bridge  *bridgev2.Bridge
+
+	stopOnce sync.Once
+}
+
+// New creates and starts a bridge with the given network connector.
+//
+// If cfg is nil, [DefaultConfig] is used. The bridge is stopped when the test finishes.
+func New(t testing.TB, network bridgev2.NetworkConnector, cfg *bridgeconfig.BridgeConfig) *Harness {
+	t.Helper()
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	log := zerolog.New(zerolog.NewTestWriter(t)).With().Timestamp().Logger()
+	h := &Harness{
+		T:       t,
+		Ctx:     log.WithContext(context.Background()),
+		DB:      NewDatabase(t),
+		Matrix:  NewMatrixConnector(),
+		Network: network,
+	}
+	h.Bridge = bridgev2.NewBridge("", h.DB, log, cfg, h.Matrix, network, commands.NewProcessor)
+	h.Bridge.SharedDB = true
+	require.NoError(t, h.Bridge.Start())
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// Stop stops the bridge. It's called automatically when the test finishes, but can be called earlier
+// to test shutdown behavior.
+func (h *Harness) Stop() {
+	h.stopOnce.Do(h.Bridge.Stop)
+}
+
+// User returns the bridge user with the given Matrix ID, creating it if necessary.
+func (h *Harness) User(userID id.UserID) *bridgev2.User {
+	h.T.Helper()
+	user, err := h.Bridge.GetUserByMXID(h.Ctx, userID)
+	require.NoError(h.T, err)
+	require.NotNil(h.T, user)
+	return user
+}
+
+// Login runs the given login flow for the user and returns the created login.
+//
+// User input and cookie steps are submitted with the given input map, display and wait steps are waited for.
+func (h *Harness) Login(user *bridgev2.User, flowID string, input map[string]string) *bridgev2.UserLogin {
+	h.T.Helper()
+	process, err := h.Network.CreateLogin(h.Ctx, user, flowID)
+	require.NoError(h.T, err)
+	step, err := process.Start(h.Ctx)
+	for i := 0; i < 20; i++ {
+		require.NoError(h.T, err)
+		require.NotNil(h.T, step)
+		switch step.Type {
+		case bridgev2.LoginStepTypeUserInput:
+			step, err = process.(bridgev2.LoginProcessUserInput).SubmitUserInput(h.Ctx, input)
+		case bridgev2.LoginStepTypeCookies:
+			step, err = process.(bridgev2.LoginProcessCookies).SubmitCookies(h.Ctx, input)
+		case bridgev2.LoginStepTypeDisplayAndWait:
+			step, err = process.(bridgev2.LoginProcessDisplayAndWait).Wait(h.Ctx)
+		case bridgev2.LoginStepTypeComplete:
+			require.NotNil(h.T, step.CompleteParams)
+			require.NotNil(h.T, step.CompleteParams.UserLogin)
+			return step.CompleteParams.UserLogin
+		default:
+			h.T.Fatalf("unknown login step type %q", step.Type)
+		}
+	}
+	h.T.Fatalf("login flow %q didn't complete", flowID)
+	return nil
+}
+
+func (h *Harness) waitCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(h.Ctx, DefaultTimeout)
+}
+
+// WaitPortal waits until all events queued in the portal with the given key have been handled.
+// It does nothing if the portal doesn't exist.
+func (h *Harness) WaitPortal(key networkid.PortalKey) {
+	h.T.Helper()
+	portal, err := h.Bridge.GetExistingPortalByKey(h.Ctx, key)
+	require.NoError(h.T, err)
+	if portal == nil {
+		return
+	}
+	ctx, cancel := h.waitCtx()
+	defer cancel()
+	require.NoError(h.T, portal.WaitQueue(ctx), "portal queue didn't drain")
+}
+
+// WaitRoom waits until all events queued in the portal of the given Matrix room have been handled.
+// It does nothing if the room isn't a portal.
+func (h *Harness) WaitRoom(roomID id.RoomID) {
+	h.T.Helper()
+	portal, err := h.Bridge.GetPortalByMXID(h.Ctx, roomID)
+	require.NoError(h.T, err)
+	if portal == nil {
+		return
+	}
+	ctx, cancel := h.waitCtx()
+	defer cancel()
+	require.NoError(h.T, portal.WaitQueue(ctx), "portal queue didn't drain")
+}
+
+// QueueRemoteEvent queues the given remote event and waits until the portal has handled it.
+func (h *Harness) QueueRemoteEvent(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent) {
+	h.T.Helper()
+	login.QueueRemoteEvent(evt)
+	h.WaitPortal(evt.GetPortalKey())
+}
+
+// PortalRoom returns the Matrix room ID of the portal with the given key, or an empty string if it has no room.
+func (h *Harness) PortalRoom(key networkid.PortalKey) id.RoomID {
+	h.T.Helper()
+	portal, err := h.Bridge.GetExistingPortalByKey(h.Ctx, key)
+	require.NoError(h.T, err)
+	if portal == nil {
+		return ""
+	}
+	return portal.MXID
+}
+
+// SendMatrixEvent adds an event from the given user to the room timeline, passes it to the bridge
+// and waits until the portal has handled it.
+func (h *Harness) SendMatrixEvent(roomID id.RoomID, sender id.UserID, evtType event.Type, content any) *event.Event {
+	h.T.Helper()
+	h.Matrix.lock.Lock()
+	evtID := id.EventID(h.Matrix.nextID("$matrix") + ":" + h.Matrix.Domain)
+	h.Matrix.lock.Unlock()
+	evt := &event.Event{
+		ID:      evtID,
+		Sender:  sender,
+		Type:    evtType,
+		RoomID:  roomID,
+		Content: event.Content{Parsed: content},
+	}
+	if evtType.Class == event.StateEventType {
+		stateKey := ""
+		if evtType == event.StateMember {
+			stateKey = sender.String()
+		}
+		evt.StateKey = &stateKey
+	} else if evtType.Class == event.UnknownEventType {
+		evt.Type.Class = event.MessageEventType
+	}
+	require.NoError(h.T, h.Matrix.addEvent(evt))
+	h.Bridge.QueueMatrixEvent(h.Ctx, evt)
+	h.WaitRoom(roomID)
+	return evt
+}
+
+// MatrixTextEvent returns a plain text message event from the given user. Unlike [Harness.SendMatrixText],
+// it doesn't add the event to the room or pass it to the bridge.
+func MatrixTextEvent(evtID id.EventID, sender id.UserID, roomID id.RoomID, text string) *event.Event {
+	return &event.Event{
+		ID:      evtID,
+		Sender:  sender,
+		Type:    event.EventMessage,
+		RoomID:  roomID,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: text}},
+	}
+}
+
+// SendMatrixText sends a plain text message from the given user to the room. See [Harness.SendMatrixEvent].
+func (h *Harness) SendMatrixText(roomID id.RoomID, sender id.UserID, text string) *event.Event {
+	h.T.Helper()
+	return h.SendMatrixEvent(roomID, sender, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    text,
+	})
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Profile contains the profile info set through a mock [MatrixAPI].
+type Profile struct {
+	DisplayName string
+	AvatarURL   id.ContentURIString
+	ExtraMeta   any
+}
+
+// MatrixAPI is an in-memory [bridgev2.MatrixAPI] for a single user. All actions are recorded in the parent [MatrixConnector].
+type MatrixAPI struct {
+	UserID id.UserID
+
+	mc          *MatrixConnector
+	profile     Profile
+	accountData map[event.Type]any
+}
+
+var (
+	_ bridgev2.MatrixAPI            = (*MatrixAPI)(nil)
+	_ bridgev2.MarkAsDMMatrixAPI    = (*MatrixAPI)(nil)
+	_ bridgev2.AccountDataMatrixAPI = (*MatrixAPI)(nil)
+)
+
+// ErrMediaNotFound is returned by the download methods if the requested media doesn't exist.
+var ErrMediaNotFound = errors.New("media not found")
+
+func (ma *MatrixAPI) GetMXID() id.UserID {
+	return ma.UserID
+}
+
+// Profile returns the current profile of the user.
+func (ma *MatrixAPI) Profile() Profile {
+	ma.mc.lock.Lock()
+	defer ma.mc.lock.Unlock()
+	return ma.profile
+}
+
+func (ma *MatrixAPI) SendMessage(ctx context.Context, roomID id.RoomID, eventType event.Type, content *event.Content, extra *bridgev2.MatrixSendExtra) (*mautrix.RespSendEvent, error) {
+	evt := &event.Event{
+		Sender:  ma.UserID,
+		Type:    eventType,
+		RoomID:  roomID,
+		Content: *content,
+	}
+	if extra != nil && !extra.Timestamp.IsZero() {
+		evt.Timestamp = extra.Timestamp.UnixMilli()
+	}
+	if extra != nil && extra.MessageMeta != nil && extra.MessageMeta.MXID != "" {
+		evt.ID = extra.MessageMeta.MXID
+	} else {
+		ma.mc.lock.Lock()
+		evt.ID = id.EventID(ma.mc.nextID("$event") + ":" + ma.mc.Domain)
+		ma.mc.lock.Unlock()
+	}
+	if ma.mc.FailSend != nil {
+		if err := ma.mc.FailSend(evt); err != nil {
+			return nil, err
+		}
+	}
+	err := ma.mc.addEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+}
+
+func (ma *MatrixAPI) SendState(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, content *event.Content, ts time.Time) (*mautrix.RespSendEvent, error) {
+	evt := ma.mc.newStateEvent(roomID, ma.UserID, eventType, stateKey, nil)
+	evt.Content = *content
+	if !ts.IsZero() {
+		evt.Timestamp = ts.UnixMilli()
+	}
+	err := ma.mc.addEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+}
+
+func (ma *MatrixAPI) withRoom(roomID id.RoomID, fn func(room *Room)) error {
+	ma.mc.lock.Lock()
+	defer ma.mc.lock.Unlock()
+	room, ok := ma.mc.rooms[roomID]
+	if !ok {
+		return fmt.Errorf("%w: room %s doesn't exist", mautrix.MNotFound, roomID)
+	}
+	fn(room)
+	return nil
+}
+
+func (ma *MatrixAPI) MarkRead(ctx context.Context, roomID id.RoomID, eventID id.EventID, ts time.Time) error {
+	return ma.withRoom(roomID, func(room *Room) {
+		room.Read[ma.UserID] = eventID
+	})
+}
+
+func (ma *MatrixAPI) MarkUnread(ctx context.Context, roomID id.RoomID, unread bool) error {
+	return ma.withRoom(roomID, func(room *Room) {
+		if unread {
+			delete(room.Read, ma.UserID)
+		}
+	})
+}
+
+func (ma *MatrixAPI) MarkTyping(ctx context.Context, roomID id.RoomID, typingType bridgev2.TypingType, timeout time.Duration) error {
+	return ma.withRoom(roomID, func(room *Room) {})
+}
+
+func (ma *MatrixAPI) DownloadMedia(ctx context.Context, uri id.ContentURIString, file *event.EncryptedFileInfo) ([]byte, error) {
+	if file != nil {
+		uri = file.URL
+	}
+	media := ma.mc.GetMedia(uri)
+	if media == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMediaNotFound, uri)
+	}
+	return bytes.Clone(media.Data), nil
+}
+
+func (ma *MatrixAPI) DownloadMediaToFile(ctx context.Context, uri id.ContentURIString, file *event.EncryptedFileInfo, writable bool, callback func(*os.File) error) error {
+	data, err := ma.DownloadMedia(ctx, uri, file)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp("", "bridgetest-download-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	_, err = tempFile.Write(data)
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return callback(tempFile)
+}
+
+func (ma *MatrixAPI) storeMedia(data []byte, fileName, mimeType string) id.ContentURIString {
+	ma.mc.lock.Lock()
+	defer ma.mc.lock.Unlock()
+	uri := id.ContentURI{Homeserver: ma.mc.Domain, FileID: ma.mc.nextID("media")}.CUString()
+	ma.mc.media[uri] = &Media{
+		URI:      uri,
+		Data:     data,
+		FileName: fileName,
+		MimeType: mimeType,
+	}
+	return uri
+}
+
+func (ma *MatrixAPI) UploadMedia(ctx context.Context, roomID id.RoomID, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	return ma.storeMedia(bytes.Clone(data), fileName, mimeType), nil, nil
+}
+
+func (ma *MatrixAPI) UploadMediaStream(ctx context.Context, roomID id.RoomID, size int64, requireFile bool, cb bridgev2.FileStreamCallback) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	if !requireFile {
+		var buf bytes.Buffer
+		res, err := cb(&buf)
+		if err != nil {
+			return "", nil, err
+		}
+		return ma.storeMedia(buf.Bytes(), res.FileName, res.MimeType), nil, nil
+	}
+	tempFile, err := os.CreateTemp("", "bridgetest-upload-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	res, err := cb(tempFile)
+	if err != nil {
+		return "", nil, err
+	}
+	path := tempFile.Name()
+	if res.ReplacementFile != "" {
+		path = res.ReplacementFile
+		defer os.Remove(res.ReplacementFile)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return ma.storeMedia(data, res.FileName, res.MimeType), nil, nil
+}
+
+func (ma *MatrixAPI) SetDisplayName(ctx context.Context, name string) error {
+	ma.mc.lock.Lock()
+	ma.profile.DisplayName = name
+	ma.mc.lock.Unlock()
+	return nil
+}
+
+func (ma *MatrixAPI) SetAvatarURL(ctx context.Context, avatarURL id.ContentURIString) error {
+	ma.mc.lock.Lock()
+	ma.profile.AvatarURL = avatarURL
+	ma.mc.lock.Unlock()
+	return nil
+}
+
+func (ma *MatrixAPI) SetExtraProfileMeta(ctx context.Context, data any) error {
+	ma.mc.lock.Lock()
+	ma.profile.ExtraMeta = data
+	ma.mc.lock.Unlock()
+	return nil
+}
+
+func (ma *MatrixAPI) CreateRoom(ctx context.Context, req *mautrix.ReqCreateRoom) (id.RoomID, error) {
+	return ma.mc.createRoom(ma.UserID, req).ID, nil
+}
+
+func (ma *MatrixAPI) DeleteRoom(ctx context.Context, roomID id.RoomID, puppetsOnly bool) error {
+	return ma.withRoom(roomID, func(room *Room) {
+		room.Deleted = true
+	})
+}
+
+func (ma *MatrixAPI) setMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) error {
+	member, err := ma.mc.GetMemberInfo(context.Background(), roomID, userID)
+	if err != nil {
+		return err
+	} else if member != nil && member.Membership == membership {
+		return nil
+	}
+	evt := ma.mc.newStateEvent(roomID, ma.UserID, event.StateMember, userID.String(), &event.MemberEventContent{
+		Membership: membership,
+	})
+	return ma.mc.addEvent(evt)
+}
+
+func (ma *MatrixAPI) EnsureJoined(ctx context.Context, roomID id.RoomID) error {
+	return ma.setMembership(roomID, ma.UserID, event.MembershipJoin)
+}
+
+func (ma *MatrixAPI) EnsureInvited(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	member, err := ma.mc.GetMemberInfo(ctx, roomID, userID)
+	if err != nil {
+		return err
+	} else if member != nil && member.Membership == event.MembershipJoin {
+		return nil
+	}
+	return ma.setMembership(roomID, userID, event.MembershipInvite)
+}
+
+func (ma *MatrixAPI) TagRoom(ctx context.Context, roomID id.RoomID, tag event.RoomTag, isTagged bool) error {
+	return ma.withRoom(roomID, func(room *Room) {
+		if room.Tags[ma.UserID] == nil {
+			room.Tags[ma.UserID] = make(map[event.RoomTag]bool)
+		}
+		room.Tags[ma.UserID][tag] = isTagged
+	})
+}
+
+func (ma *MatrixAPI) MuteRoom(ctx context.Context, roomID id.RoomID, until time.Time) error {
+	return ma.withRoom(roomID, func(room *Room) {
+		room.Muted[ma.UserID] = until
+	})
+}
+
+func (ma *MatrixAPI) MarkAsDM(ctx context.Context, roomID id.RoomID, otherUser id.UserID) error {
+	return ma.withRoom(roomID, func(room *Room) {})
+}
+
+func (ma *MatrixAPI) GetAccountData(ctx context.Context, eventType event.Type, output any) error {
+	ma.mc.lock.Lock()
+	data, ok := ma.accountData[eventType]
+	ma.mc.lock.Unlock()
+	if !ok {
+		return mautrix.MNotFound
+	}
+	return copyViaJSON(data, output)
+}
+
+func (ma *MatrixAPI) SetAccountData(ctx context.Context, eventType event.Type, data any) error {
+	ma.mc.lock.Lock()
+	defer ma.mc.lock.Unlock()
+	if ma.accountData == nil {
+		ma.accountData = make(map[event.Type]any)
+	}
+	ma.accountData[eventType] = data
+	return nil
+}
+
+func copyViaJSON(from, to any) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
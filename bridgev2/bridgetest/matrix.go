@@ -0,0 +1,449 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultDomain is the server name used by [MatrixConnector] if the Domain field is empty.
+const DefaultDomain = "bridge.test"
+
+// Room is the in-memory state of a room created or joined through the mock Matrix connector.
+type Room struct {
+	ID            id.RoomID
+	CreateRequest *mautrix.ReqCreateRoom
+	Deleted       bool
+
+	// Timeline contains all events sent to the room in order, including state events.
+	Timeline []*event.Event
+	// State contains the latest state events by type and state key.
+	State   map[event.Type]map[string]*event.Event
+	Members map[id.UserID]*event.MemberEventContent
+
+	Tags  map[id.UserID]map[event.RoomTag]bool
+	Muted map[id.UserID]time.Time
+	Read  map[id.UserID]id.EventID
+}
+
+// Media is a file uploaded through the mock Matrix connector.
+type Media struct {
+	URI      id.ContentURIString
+	Data     []byte
+	FileName string
+	MimeType string
+}
+
+// MessageStatusRecord is a single message status sent by the bridge.
+type MessageStatusRecord struct {
+	Status *bridgev2.MessageStatus
+	Event  *bridgev2.MessageStatusEventInfo
+}
+
+// MatrixConnector is an in-memory [bridgev2.MatrixConnector] that records everything the bridge sends to Matrix.
+//
+// Bot and ghost user IDs are generated from the network ID of the bridge: the bot is `@<network>bot:<domain>`
+// and ghosts are `@<network>_<encoded user ID>:<domain>`.
+type MatrixConnector struct {
+	Domain       string
+	Bridge       *bridgev2.Bridge
+	Capabilities *bridgev2.MatrixCapabilities
+	// FailSend is called before a message is sent through any intent. If it returns an error,
+	// sending fails with that error, which can be used to test how the bridge handles failures.
+	FailSend func(evt *event.Event) error
+
+	lock            sync.Mutex
+	rooms           map[id.RoomID]*Room
+	media           map[id.ContentURIString]*Media
+	intents         map[id.UserID]*MatrixAPI
+	bridgeStates    []*status.BridgeState
+	messageStatuses []*MessageStatusRecord
+	counter         int
+	ghostPrefix     string
+	bot             *MatrixAPI
+}
+
+var _ bridgev2.MatrixConnector = (*MatrixConnector)(nil)
+
+// NewMatrixConnector creates a new mock Matrix connector.
+func NewMatrixConnector() *MatrixConnector {
+	return &MatrixConnector{
+		Domain:       DefaultDomain,
+		Capabilities: &bridgev2.MatrixCapabilities{},
+		rooms:        make(map[id.RoomID]*Room),
+		media:        make(map[id.ContentURIString]*Media),
+		intents:      make(map[id.UserID]*MatrixAPI),
+	}
+}
+
+func (mc *MatrixConnector) Init(bridge *bridgev2.Bridge) {
+	mc.Bridge = bridge
+	if mc.Domain == "" {
+		mc.Domain = DefaultDomain
+	}
+	networkID := strings.ToLower(bridge.Network.GetName().NetworkID)
+	if networkID == "" {
+		networkID = "test"
+	}
+	mc.ghostPrefix = networkID + "_"
+	mc.bot = mc.intent(id.NewUserID(networkID+"bot", mc.Domain))
+}
+
+func (mc *MatrixConnector) Start(ctx context.Context) error {
+	return nil
+}
+
+func (mc *MatrixConnector) Stop() {}
+
+func (mc *MatrixConnector) GetCapabilities() *bridgev2.MatrixCapabilities {
+	return mc.Capabilities
+}
+
+func (mc *MatrixConnector) nextID(prefix string) string {
+	mc.counter++
+	return fmt.Sprintf("%s%d", prefix, mc.counter)
+}
+
+func (mc *MatrixConnector) intent(userID id.UserID) *MatrixAPI {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	intent, ok := mc.intents[userID]
+	if !ok {
+		intent = &MatrixAPI{UserID: userID, mc: mc}
+		mc.intents[userID] = intent
+	}
+	return intent
+}
+
+// Intent returns the mock MatrixAPI for the given user ID.
+func (mc *MatrixConnector) Intent(userID id.UserID) *MatrixAPI {
+	return mc.intent(userID)
+}
+
+func (mc *MatrixConnector) ParseGhostMXID(userID id.UserID) (networkid.UserID, bool) {
+	localpart, server, err := userID.Parse()
+	if err != nil || server != mc.Domain || !strings.HasPrefix(localpart, mc.ghostPrefix) {
+		return "", false
+	}
+	decoded, err := id.DecodeUserLocalpart(strings.TrimPrefix(localpart, mc.ghostPrefix))
+	if err != nil {
+		return "", false
+	}
+	return networkid.UserID(decoded), true
+}
+
+// FormatGhostMXID returns the Matrix user ID of the ghost for the given remote user ID.
+func (mc *MatrixConnector) FormatGhostMXID(userID networkid.UserID) id.UserID {
+	return id.NewUserID(mc.ghostPrefix+id.EncodeUserLocalpart(string(userID)), mc.Domain)
+}
+
+func (mc *MatrixConnector) GhostIntent(userID networkid.UserID) bridgev2.MatrixAPI {
+	return mc.intent(mc.FormatGhostMXID(userID))
+}
+
+func (mc *MatrixConnector) NewUserIntent(ctx context.Context, userID id.UserID, accessToken string) (bridgev2.MatrixAPI, string, error) {
+	return mc.intent(userID), accessToken, nil
+}
+
+func (mc *MatrixConnector) BotIntent() bridgev2.MatrixAPI {
+	return mc.bot
+}
+
+func (mc *MatrixConnector) SendBridgeStatus(ctx context.Context, state *status.BridgeState) error {
+	mc.lock.Lock()
+	mc.bridgeStates = append(mc.bridgeStates, state)
+	mc.lock.Unlock()
+	return nil
+}
+
+func (mc *MatrixConnector) SendMessageStatus(ctx context.Context, status *bridgev2.MessageStatus, evt *bridgev2.MessageStatusEventInfo) {
+	mc.lock.Lock()
+	mc.messageStatuses = append(mc.messageStatuses, &MessageStatusRecord{Status: status, Event: evt})
+	mc.lock.Unlock()
+}
+
+func (mc *MatrixConnector) GenerateContentURI(ctx context.Context, mediaID networkid.MediaID) (id.ContentURIString, error) {
+	return id.ContentURI{Homeserver: mc.Domain, FileID: base64.RawURLEncoding.EncodeToString(mediaID)}.CUString(), nil
+}
+
+func (mc *MatrixConnector) GetPowerLevels(ctx context.Context, roomID id.RoomID) (*event.PowerLevelsEventContent, error) {
+	evt := mc.GetState(roomID, event.StatePowerLevels, "")
+	if evt == nil {
+		return &event.PowerLevelsEventContent{}, nil
+	}
+	return evt.Content.AsPowerLevels(), nil
+}
+
+func (mc *MatrixConnector) GetMembers(ctx context.Context, roomID id.RoomID) (map[id.UserID]*event.MemberEventContent, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		return nil, mautrix.MNotFound
+	}
+	members := make(map[id.UserID]*event.MemberEventContent, len(room.Members))
+	for userID, member := range room.Members {
+		members[userID] = member
+	}
+	return members, nil
+}
+
+func (mc *MatrixConnector) GetMemberInfo(ctx context.Context, roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		return nil, mautrix.MNotFound
+	}
+	return room.Members[userID], nil
+}
+
+func (mc *MatrixConnector) BatchSend(ctx context.Context, roomID id.RoomID, req *mautrix.ReqBeeperBatchSend, extras []*bridgev2.MatrixSendExtra) (*mautrix.RespBeeperBatchSend, error) {
+	resp := &mautrix.RespBeeperBatchSend{EventIDs: make([]id.EventID, len(req.Events))}
+	for i, evt := range req.Events {
+		evt.RoomID = roomID
+		if evt.ID == "" {
+			mc.lock.Lock()
+			evt.ID = id.EventID(mc.nextID("$batch") + ":" + mc.Domain)
+			mc.lock.Unlock()
+		}
+		err := mc.addEvent(evt)
+		if err != nil {
+			return nil, err
+		}
+		resp.EventIDs[i] = evt.ID
+	}
+	return resp, nil
+}
+
+func (mc *MatrixConnector) GenerateDeterministicEventID(roomID id.RoomID, _ networkid.PortalKey, messageID networkid.MessageID, partID networkid.PartID) id.EventID {
+	hash := sha256.Sum256([]byte(string(roomID) + "\x00" + string(messageID) + "\x00" + string(partID)))
+	return id.EventID(fmt.Sprintf("$%s:%s", base64.RawURLEncoding.EncodeToString(hash[:]), mc.Domain))
+}
+
+func (mc *MatrixConnector) GenerateReactionEventID(roomID id.RoomID, targetMessage *database.Message, sender networkid.UserID, emojiID networkid.EmojiID) id.EventID {
+	hash := sha256.Sum256([]byte(string(roomID) + "\x00" + string(targetMessage.ID) + "\x00" + string(sender) + "\x00" + string(emojiID)))
+	return id.EventID(fmt.Sprintf("$%s:%s", base64.RawURLEncoding.EncodeToString(hash[:]), mc.Domain))
+}
+
+func (mc *MatrixConnector) ServerName() string {
+	return mc.Domain
+}
+
+// addEvent stores the given event in the timeline of its room and updates room state if necessary.
+func (mc *MatrixConnector) addEvent(evt *event.Event) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	room, ok := mc.rooms[evt.RoomID]
+	if !ok {
+		return fmt.Errorf("%w: room %s doesn't exist", mautrix.MNotFound, evt.RoomID)
+	} else if room.Deleted {
+		return fmt.Errorf("%w: room %s has been deleted", mautrix.MForbidden, evt.RoomID)
+	}
+	if evt.Timestamp == 0 {
+		evt.Timestamp = time.Now().UnixMilli()
+	}
+	if evt.Content.Parsed == nil && evt.Content.VeryRaw != nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	room.Timeline = append(room.Timeline, evt)
+	if evt.StateKey != nil {
+		evt.Type.Class = event.StateEventType
+		room.setState(evt)
+	} else if evt.Type.Class == event.UnknownEventType {
+		evt.Type.Class = event.MessageEventType
+	}
+	return nil
+}
+
+func (room *Room) setState(evt *event.Event) {
+	if room.State[evt.Type] == nil {
+		room.State[evt.Type] = make(map[string]*event.Event)
+	}
+	room.State[evt.Type][*evt.StateKey] = evt
+	if evt.Type == event.StateMember {
+		if member, ok := evt.Content.Parsed.(*event.MemberEventContent); ok {
+			room.Members[id.UserID(*evt.StateKey)] = member
+		}
+	}
+}
+
+func (mc *MatrixConnector) createRoom(creator id.UserID, req *mautrix.ReqCreateRoom) *Room {
+	mc.lock.Lock()
+	roomID := id.RoomID(mc.nextID("!room") + ":" + mc.Domain)
+	room := &Room{
+		ID:            roomID,
+		CreateRequest: req,
+		State:         make(map[event.Type]map[string]*event.Event),
+		Members:       make(map[id.UserID]*event.MemberEventContent),
+		Tags:          make(map[id.UserID]map[event.RoomTag]bool),
+		Muted:         make(map[id.UserID]time.Time),
+		Read:          make(map[id.UserID]id.EventID),
+	}
+	mc.rooms[roomID] = room
+	mc.lock.Unlock()
+
+	_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StateCreate, "", &event.CreateEventContent{}))
+	_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StateMember, creator.String(), &event.MemberEventContent{Membership: event.MembershipJoin}))
+	if req.PowerLevelOverride != nil {
+		_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StatePowerLevels, "", req.PowerLevelOverride))
+	}
+	for _, evt := range req.InitialState {
+		stateEvt := *evt
+		stateEvt.ID = ""
+		stateEvt.RoomID = roomID
+		stateEvt.Sender = creator
+		if stateEvt.StateKey == nil {
+			stateEvt.StateKey = new(string)
+		}
+		mc.lock.Lock()
+		stateEvt.ID = id.EventID(mc.nextID("$state") + ":" + mc.Domain)
+		mc.lock.Unlock()
+		_ = mc.addEvent(&stateEvt)
+	}
+	if req.Name != "" {
+		_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StateRoomName, "", &event.RoomNameEventContent{Name: req.Name}))
+	}
+	if req.Topic != "" {
+		_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StateTopic, "", &event.TopicEventContent{Topic: req.Topic}))
+	}
+	for _, invitee := range req.Invite {
+		membership := event.MembershipInvite
+		if req.BeeperAutoJoinInvites {
+			membership = event.MembershipJoin
+		}
+		_ = mc.addEvent(mc.newStateEvent(roomID, creator, event.StateMember, invitee.String(), &event.MemberEventContent{
+			Membership: membership,
+			IsDirect:   req.IsDirect,
+		}))
+	}
+	return room
+}
+
+func (mc *MatrixConnector) newStateEvent(roomID id.RoomID, sender id.UserID, evtType event.Type, stateKey string, content any) *event.Event {
+	mc.lock.Lock()
+	evtID := id.EventID(mc.nextID("$state") + ":" + mc.Domain)
+	mc.lock.Unlock()
+	return &event.Event{
+		ID:       evtID,
+		RoomID:   roomID,
+		Sender:   sender,
+		Type:     evtType,
+		StateKey: &stateKey,
+		Content:  event.Content{Parsed: content},
+	}
+}
+
+// Room returns the room with the given ID, or nil if it doesn't exist.
+//
+// The returned struct must not be modified or read concurrently with the bridge.
+// Use the other getters to safely read data while the bridge is running.
+func (mc *MatrixConnector) Room(roomID id.RoomID) *Room {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.rooms[roomID]
+}
+
+// Rooms returns the IDs of all rooms that exist.
+func (mc *MatrixConnector) Rooms() []id.RoomID {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	roomIDs := make([]id.RoomID, 0, len(mc.rooms))
+	for roomID := range mc.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	slices.Sort(roomIDs)
+	return roomIDs
+}
+
+// Timeline returns a copy of the full timeline of the given room, including state events.
+func (mc *MatrixConnector) Timeline(roomID id.RoomID) []*event.Event {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(room.Timeline)
+}
+
+// Messages returns all non-state events in the timeline of the given room.
+func (mc *MatrixConnector) Messages(roomID id.RoomID) []*event.Event {
+	timeline := mc.Timeline(roomID)
+	return slices.DeleteFunc(timeline, func(evt *event.Event) bool {
+		return evt.StateKey != nil
+	})
+}
+
+// GetEvent returns the event with the given ID from the given room, or nil if it doesn't exist.
+func (mc *MatrixConnector) GetEvent(roomID id.RoomID, eventID id.EventID) *event.Event {
+	for _, evt := range mc.Timeline(roomID) {
+		if evt.ID == eventID {
+			return evt
+		}
+	}
+	return nil
+}
+
+// GetState returns the current state event with the given type and key, or nil if it's not set.
+func (mc *MatrixConnector) GetState(roomID id.RoomID, evtType event.Type, stateKey string) *event.Event {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return room.State[evtType][stateKey]
+}
+
+// GetMedia returns the uploaded media with the given URI, or nil if it doesn't exist.
+func (mc *MatrixConnector) GetMedia(uri id.ContentURIString) *Media {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.media[uri]
+}
+
+// BridgeStates returns all bridge states sent by the bridge.
+func (mc *MatrixConnector) BridgeStates() []*status.BridgeState {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return slices.Clone(mc.bridgeStates)
+}
+
+// MessageStatuses returns all message statuses sent by the bridge.
+func (mc *MatrixConnector) MessageStatuses() []*MessageStatusRecord {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return slices.Clone(mc.messageStatuses)
+}
+
+// MessageStatus returns the latest message status sent for the given event ID, or nil if there isn't one.
+func (mc *MatrixConnector) MessageStatus(eventID id.EventID) *bridgev2.MessageStatus {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	for i := len(mc.messageStatuses) - 1; i >= 0; i-- {
+		if mc.messageStatuses[i].Event.SourceEventID == eventID {
+			return mc.messageStatuses[i].Status
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgetest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	up "go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/ptr"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// NetworkConnector is a minimal [bridgev2.NetworkConnector] for testing bridgev2 itself.
+//
+// It has a single login flow called "username", which creates a login whose ID is the entered username.
+// The clients of logins are [NetworkAPI]s.
+type NetworkConnector struct {
+	Bridge *bridgev2.Bridge
+
+	configReloads atomic.Int32
+}
+
+var (
+	_ bridgev2.NetworkConnector       = (*NetworkConnector)(nil)
+	_ bridgev2.ConfigReloadingNetwork = (*NetworkConnector)(nil)
+)
+
+func (nc *NetworkConnector) Init(br *bridgev2.Bridge)           { nc.Bridge = br }
+func (nc *NetworkConnector) Start(ctx context.Context) error    { return nil }
+func (nc *NetworkConnector) GetDBMetaTypes() database.MetaTypes { return database.MetaTypes{} }
+func (nc *NetworkConnector) GetConfig() (string, any, up.Upgrader) {
+	return "", nil, up.NoopUpgrader
+}
+
+func (nc *NetworkConnector) OnConfigReloaded(cfg *bridgeconfig.BridgeConfig) {
+	nc.configReloads.Add(1)
+}
+
+// ConfigReloads returns the number of times the bridge config has been reloaded.
+func (nc *NetworkConnector) ConfigReloads() int {
+	return int(nc.configReloads.Load())
+}
+
+func (nc *NetworkConnector) GetName() bridgev2.BridgeName {
+	return bridgev2.BridgeName{
+		DisplayName:      "Test",
+		NetworkURL:       "https://example.com",
+		NetworkID:        "test",
+		BeeperBridgeType: "maunium.net/go/mautrix/bridgev2/bridgetest",
+		DefaultPort:      29999,
+	}
+}
+
+func (nc *NetworkConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
+	return &bridgev2.NetworkGeneralCapabilities{}
+}
+
+func (nc *NetworkConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLogin) error {
+	login.Client = &NetworkAPI{Login: login}
+	return nil
+}
+
+func (nc *NetworkConnector) GetLoginFlows() []bridgev2.LoginFlow {
+	return []bridgev2.LoginFlow{{Name: "Username", ID: "username"}}
+}
+
+func (nc *NetworkConnector) CreateLogin(ctx context.Context, user *bridgev2.User, flowID string) (bridgev2.LoginProcess, error) {
+	return &usernameLogin{user: user}, nil
+}
+
+type usernameLogin struct {
+	user *bridgev2.User
+}
+
+func (ul *usernameLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
+	return &bridgev2.LoginStep{
+		Type:   bridgev2.LoginStepTypeUserInput,
+		StepID: "test.username",
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{{Type: bridgev2.LoginInputFieldTypeUsername, ID: "username"}},
+		},
+	}, nil
+}
+
+func (ul *usernameLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	login, err := ul.user.NewLogin(ctx, &database.UserLogin{
+		ID:         networkid.UserLoginID(input["username"]),
+		RemoteName: input["username"],
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &bridgev2.LoginStep{
+		Type:           bridgev2.LoginStepTypeComplete,
+		StepID:         "test.complete",
+		CompleteParams: &bridgev2.LoginCompleteParams{UserLoginID: login.ID, UserLogin: login},
+	}, nil
+}
+
+func (ul *usernameLogin) Cancel() {}
+
+var _ bridgev2.LoginProcessUserInput = (*usernameLogin)(nil)
+
+// NetworkAPI is the client of logins created by [NetworkConnector].
+//
+// Every chat has the name "Test chat" and contains the user and the remote user alice.
+// Matrix messages and calls are accepted and recorded, and backfilling uses the FetchMessagesFunc field.
+type NetworkAPI struct {
+	Login *bridgev2.UserLogin
+
+	// FetchMessagesFunc is called by FetchMessages. If it's not set, there are no messages to backfill.
+	FetchMessagesFunc func(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error)
+	// If BlockSend is set, HandleMatrixMessage waits until the channel is closed.
+	BlockSend chan struct{}
+
+	lock        sync.Mutex
+	sent        []id.EventID
+	calls       []*bridgev2.MatrixCall
+	connects    int
+	disconnects int
+}
+
+var (
+	_ bridgev2.NetworkAPI             = (*NetworkAPI)(nil)
+	_ bridgev2.CallHandlingNetworkAPI = (*NetworkAPI)(nil)
+	_ bridgev2.BackfillingNetworkAPI  = (*NetworkAPI)(nil)
+)
+
+func (na *NetworkAPI) IsLoggedIn() bool                 { return true }
+func (na *NetworkAPI) LogoutRemote(ctx context.Context) {}
+
+func (na *NetworkAPI) Connect(ctx context.Context) {
+	na.lock.Lock()
+	na.connects++
+	na.lock.Unlock()
+}
+
+func (na *NetworkAPI) Disconnect() {
+	na.lock.Lock()
+	na.disconnects++
+	na.lock.Unlock()
+}
+
+func (na *NetworkAPI) IsThisUser(ctx context.Context, userID networkid.UserID) bool {
+	return string(userID) == string(na.Login.ID)
+}
+
+func (na *NetworkAPI) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*bridgev2.ChatInfo, error) {
+	return &bridgev2.ChatInfo{
+		Name: ptr.Ptr("Test chat"),
+		Members: &bridgev2.ChatMemberList{
+			IsFull: true,
+			Members: []bridgev2.ChatMember{
+				{EventSender: bridgev2.EventSender{IsFromMe: true}},
+				{EventSender: bridgev2.EventSender{Sender: "alice"}},
+			},
+		},
+	}, nil
+}
+
+func (na *NetworkAPI) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
+	return &bridgev2.UserInfo{Name: ptr.Ptr(string(ghost.ID))}, nil
+}
+
+func (na *NetworkAPI) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *bridgev2.NetworkRoomCapabilities {
+	return &bridgev2.NetworkRoomCapabilities{}
+}
+
+func (na *NetworkAPI) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
+	if na.BlockSend != nil {
+		<-na.BlockSend
+	}
+	na.lock.Lock()
+	na.sent = append(na.sent, msg.Event.ID)
+	na.lock.Unlock()
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:       networkid.MessageID("sent-" + msg.Event.ID),
+			SenderID: networkid.UserID(na.Login.ID),
+		},
+	}, nil
+}
+
+func (na *NetworkAPI) HandleMatrixCall(ctx context.Context, msg *bridgev2.MatrixCall) error {
+	na.lock.Lock()
+	na.calls = append(na.calls, msg)
+	na.lock.Unlock()
+	return nil
+}
+
+func (na *NetworkAPI) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+	if na.FetchMessagesFunc == nil {
+		return &bridgev2.FetchMessagesResponse{}, nil
+	}
+	return na.FetchMessagesFunc(ctx, params)
+}
+
+// SentMessages returns the IDs of all Matrix messages passed to HandleMatrixMessage.
+func (na *NetworkAPI) SentMessages() []id.EventID {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	return slices.Clone(na.sent)
+}
+
+// Calls returns all Matrix call events passed to HandleMatrixCall.
+func (na *NetworkAPI) Calls() []*bridgev2.MatrixCall {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	return slices.Clone(na.calls)
+}
+
+// ConnectionCounts returns how many times Connect and Disconnect have been called.
+func (na *NetworkAPI) ConnectionCounts() (connects, disconnects int) {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	return na.connects, na.disconnects
+}
+
+// TextMessage returns a remote text message event that creates the portal if it doesn't exist.
+func TextMessage(msgID networkid.MessageID, sender networkid.UserID, portalKey networkid.PortalKey, text string) *simplevent.Message[string] {
+	return &simplevent.Message[string]{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventMessage,
+			PortalKey:    portalKey,
+			Sender:       bridgev2.EventSender{Sender: sender},
+			CreatePortal: true,
+			Timestamp:    time.Now(),
+		},
+		ID:   msgID,
+		Data: text,
+		ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data string) (*bridgev2.ConvertedMessage, error) {
+			return &bridgev2.ConvertedMessage{
+				Parts: []*bridgev2.ConvertedMessagePart{{
+					Type:    event.EventMessage,
+					Content: &event.MessageEventContent{MsgType: event.MsgText, Body: data},
+				}},
+			}, nil
+		},
+	}
+}
+
+// NewChat starts a bridge with a [NetworkConnector], logs in as @user:bridge.test with the username "me"
+// and creates a portal containing one message from alice.
+//
+// If cfg is nil, [DefaultConfig] is used.
+func NewChat(t testing.TB, cfg *bridgeconfig.BridgeConfig) (*Harness, *bridgev2.UserLogin, networkid.PortalKey, id.RoomID) {
+	t.Helper()
+	h := New(t, &NetworkConnector{}, cfg)
+	login := h.Login(h.User("@user:bridge.test"), "username", map[string]string{"username": "me"})
+	portalKey := networkid.PortalKey{ID: "chat", Receiver: login.ID}
+	h.QueueRemoteEvent(login, TextMessage("msg1", "alice", portalKey, "hello"))
+	roomID := h.PortalRoom(portalKey)
+	require.NotEmpty(t, roomID)
+	return h, login, portalKey, roomID
+}
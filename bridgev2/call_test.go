@@ -0,0 +1,126 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+type testCallEvent struct {
+	simplevent.EventMeta
+	Info *bridgev2.CallInfo
+}
+
+var _ bridgev2.RemoteCall = (*testCallEvent)(nil)
+
+func (evt *testCallEvent) GetCall() *bridgev2.CallInfo {
+	return evt.Info
+}
+
+func newTestCallEvent(portalKey networkid.PortalKey, info *bridgev2.CallInfo) *testCallEvent {
+	return &testCallEvent{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventCall,
+			PortalKey: portalKey,
+			Sender:    bridgev2.EventSender{Sender: "alice"},
+			Timestamp: time.Now(),
+		},
+		Info: info,
+	}
+}
+
+func TestHandleMatrixCall(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	invite := h.SendMatrixEvent(roomID, login.UserMXID, event.CallInvite, &event.CallInviteEventContent{
+		BaseCallEventContent: event.BaseCallEventContent{CallID: "call1", PartyID: "party1", Version: "1"},
+		Lifetime:             60000,
+	})
+	hangup := h.SendMatrixEvent(roomID, login.UserMXID, event.CallHangup, &event.CallHangupEventContent{
+		BaseCallEventContent: event.BaseCallEventContent{CallID: "call1", PartyID: "party1", Version: "1"},
+	})
+
+	calls := login.Client.(*bridgetest.NetworkAPI).Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, invite.ID, calls[0].Event.ID)
+	assert.Equal(t, "call1", calls[0].Content.GetCallBase().CallID)
+	assert.IsType(t, &event.CallInviteEventContent{}, calls[0].Content)
+	assert.IsType(t, &event.CallHangupEventContent{}, calls[1].Content)
+	h.AssertMessageStatus(invite.ID, event.MessageStatusSuccess)
+	// Only invites get success statuses
+	assert.Nil(t, h.Matrix.MessageStatus(hangup.ID))
+}
+
+func TestHandleRemoteCall(t *testing.T) {
+	h, login, portalKey, roomID := bridgetest.NewChat(t, nil)
+	h.QueueRemoteEvent(login, newTestCallEvent(portalKey, &bridgev2.CallInfo{
+		ID:       "call1",
+		Type:     bridgev2.CallTypeVideo,
+		State:    bridgev2.CallStateEnded,
+		Duration: 90 * time.Second,
+	}))
+	notice := h.RequireLastMessage(roomID)
+	assert.Equal(t, h.Matrix.FormatGhostMXID("alice"), notice.Sender)
+	assert.Equal(t, event.MsgNotice, notice.Content.AsMessage().MsgType)
+	assert.Equal(t, "Video call ended (duration: 1:30)", notice.Content.AsMessage().Body)
+	assert.Nil(t, h.Matrix.GetState(roomID, event.StateUnstableGroupCall, "call1"))
+
+	// Events without call info are ignored
+	h.QueueRemoteEvent(login, newTestCallEvent(portalKey, nil))
+	assert.Equal(t, notice.ID, h.RequireLastMessage(roomID).ID)
+}
+
+func TestHandleRemoteGroupCall(t *testing.T) {
+	h, login, portalKey, roomID := bridgetest.NewChat(t, nil)
+	h.QueueRemoteEvent(login, newTestCallEvent(portalKey, &bridgev2.CallInfo{
+		ID:      "group1",
+		Type:    bridgev2.CallTypeVideo,
+		State:   bridgev2.CallStateStarted,
+		IsGroup: true,
+		Name:    "Meeting",
+	}))
+	state := h.Matrix.GetState(roomID, event.StateUnstableGroupCall, "group1")
+	require.NotNil(t, state)
+	content := parseGroupCall(t, state)
+	assert.Equal(t, event.GroupCallTypeVideo, content.Type)
+	assert.Equal(t, event.GroupCallIntentRoom, content.Intent)
+	assert.Equal(t, "Meeting", content.Name)
+	assert.Empty(t, content.Terminated)
+	// Starting a group call only creates the state event
+	assert.NotEqual(t, event.MsgNotice, h.RequireLastMessage(roomID).Content.AsMessage().MsgType)
+
+	h.QueueRemoteEvent(login, newTestCallEvent(portalKey, &bridgev2.CallInfo{
+		ID:      "group1",
+		Type:    bridgev2.CallTypeVideo,
+		State:   bridgev2.CallStateEnded,
+		IsGroup: true,
+	}))
+	state = h.Matrix.GetState(roomID, event.StateUnstableGroupCall, "group1")
+	require.NotNil(t, state)
+	assert.Equal(t, "call_ended", parseGroupCall(t, state).Terminated)
+	notice := h.RequireLastMessage(roomID)
+	assert.Equal(t, "Group video call ended", notice.Content.AsMessage().Body)
+}
+
+func parseGroupCall(t *testing.T, evt *event.Event) *event.GroupCallEventContent {
+	t.Helper()
+	if evt.Content.Parsed == nil {
+		require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	}
+	content, ok := evt.Content.Parsed.(*event.GroupCallEventContent)
+	require.True(t, ok, "unexpected content type %T", evt.Content.Parsed)
+	return content
+}
@@ -0,0 +1,410 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+var CommandListUsers = &FullHandler{
+	Func: fnListUsers,
+	Name: "list-users",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "List all users who are logged into the bridge and the states of their logins",
+	},
+	RequiresAdmin: true,
+}
+
+func fnListUsers(ce *Event) {
+	userIDs, err := ce.Bridge.DB.UserLogin.GetAllUserIDsWithLogins(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get users with logins")
+		ce.Reply("Failed to get users with logins")
+		return
+	} else if len(userIDs) == 0 {
+		ce.Reply("No users are logged into the bridge")
+		return
+	}
+	var output strings.Builder
+	for _, userID := range userIDs {
+		user, err := ce.Bridge.GetExistingUserByMXID(ce.Ctx, userID)
+		if err != nil {
+			ce.Log.Err(err).Stringer("user_id", userID).Msg("Failed to get user")
+			_, _ = fmt.Fprintf(&output, "* `%s` - failed to load user\n", userID)
+			continue
+		} else if user == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(&output, "* `%s`\n", userID)
+		for _, login := range user.GetUserLogins() {
+			_, _ = fmt.Fprintf(&output, "  * `%s` (%s) - `%s`\n", login.ID, login.RemoteName, login.BridgeState.GetPrev().StateEvent)
+		}
+	}
+	ce.Reply(output.String())
+}
+
+func getLoginFromArgs(ce *Event, usage string) *bridgev2.UserLogin {
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `$cmdprefix %s`", usage)
+		return nil
+	}
+	login, err := ce.Bridge.GetExistingUserLoginByID(ce.Ctx, networkid.UserLoginID(ce.Args[0]))
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get login")
+		ce.Reply("Failed to get login")
+		return nil
+	} else if login == nil {
+		ce.Reply("Login `%s` not found", ce.Args[0])
+		return nil
+	}
+	return login
+}
+
+var CommandForceLogout = &FullHandler{
+	Func: fnForceLogout,
+	Name: "force-logout",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Log out any user's login. The `--local` flag skips logging out on the remote network.",
+		Args:        "[--local] <_login ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnForceLogout(ce *Event) {
+	localOnly := len(ce.Args) > 0 && strings.ToLower(ce.Args[0]) == "--local"
+	if localOnly {
+		ce.Args = ce.Args[1:]
+	}
+	login := getLoginFromArgs(ce, "force-logout [--local] <login ID>")
+	if login == nil {
+		return
+	}
+	login.Delete(ce.Ctx, status.BridgeState{StateEvent: status.StateLoggedOut, Reason: "ADMIN_LOGOUT"}, bridgev2.DeleteOpts{
+		LogoutRemote: !localOnly,
+	})
+	ce.Reply("Logged out `%s` of `%s`", login.ID, login.UserMXID)
+}
+
+var CommandReconnect = &FullHandler{
+	Func: fnReconnect,
+	Name: "reconnect",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Disconnect and reconnect a login to the remote network",
+		Args:        "<_login ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnReconnect(ce *Event) {
+	login := getLoginFromArgs(ce, "reconnect <login ID>")
+	if login == nil {
+		return
+	}
+	err := login.Reconnect(ce.Ctx)
+	if err != nil {
+		ce.Reply("Failed to reconnect `%s`: %v", login.ID, err)
+		return
+	}
+	ce.Reply("Reconnected `%s`", login.ID)
+}
+
+func findConnectedLogin(candidates []*bridgev2.UserLogin) *bridgev2.UserLogin {
+	for _, login := range candidates {
+		if client := login.GetClient(); client != nil && client.IsLoggedIn() {
+			return login
+		}
+	}
+	return nil
+}
+
+// findPortalLogin finds a connected login in the current portal. If the portal has a receiver,
+// only the receiver is used, as other logins may not be able to see the chat.
+func findPortalLogin(ce *Event) *bridgev2.UserLogin {
+	logins, err := ce.Bridge.GetUserLoginsInPortal(ce.Ctx, ce.Portal.PortalKey)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get logins in portal")
+		return nil
+	}
+	if ce.Portal.Receiver != "" {
+		logins = slices.DeleteFunc(logins, func(login *bridgev2.UserLogin) bool {
+			return login.ID != ce.Portal.Receiver
+		})
+	}
+	return findConnectedLogin(logins)
+}
+
+// findLoginForGhostResync finds a connected login that can be used to fetch user info from the remote network.
+// Logins in the current portal are preferred, followed by the logins of the user running the command.
+func findLoginForGhostResync(ce *Event) *bridgev2.UserLogin {
+	if ce.Portal != nil {
+		if login := findPortalLogin(ce); login != nil {
+			return login
+		}
+	}
+	if login := findConnectedLogin(ce.User.GetUserLogins()); login != nil {
+		return login
+	}
+	return findConnectedLogin(ce.Bridge.GetAllCachedUserLogins())
+}
+
+var CommandResyncPortal = &FullHandler{
+	Func: fnResyncPortal,
+	Name: "resync-portal",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Fetch the chat info of the current portal from the remote network and update the room",
+	},
+	RequiresAdmin:  true,
+	RequiresPortal: true,
+}
+
+func fnResyncPortal(ce *Event) {
+	login := findPortalLogin(ce)
+	if login == nil {
+		ce.Reply("No connected login in this portal found to fetch chat info with")
+		return
+	}
+	client := login.GetClient()
+	if client == nil {
+		ce.Reply("`%s` was disconnected before the chat info could be fetched", login.ID)
+		return
+	}
+	info, err := client.GetChatInfo(ce.Ctx, ce.Portal)
+	if err != nil {
+		ce.Reply("Failed to get chat info using `%s`: %v", login.ID, err)
+		return
+	} else if info == nil {
+		ce.Reply("The network connector didn't return any chat info")
+		return
+	}
+	// The update is queued like any other chat resync, so that it doesn't race with events
+	// being handled in the portal event loop.
+	login.QueueRemoteEventWithContext(ce.Ctx, &simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventChatResync,
+			PortalKey: ce.Portal.PortalKey,
+		},
+		ChatInfo: info,
+	})
+	err = ce.Portal.WaitQueue(ce.Ctx)
+	if err != nil {
+		ce.Reply("Chat info resync using `%s` was queued, but didn't finish: %v", login.ID, err)
+		return
+	}
+	ce.Reply("Chat info resynced using `%s`", login.ID)
+}
+
+var CommandResyncGhost = &FullHandler{
+	Func: fnResyncGhost,
+	Name: "resync-ghost",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Fetch the info of a remote user from the remote network and update the ghost",
+		Args:        "<_ghost MXID or remote user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnResyncGhost(ce *Event) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `$cmdprefix resync-ghost <ghost MXID or remote user ID>`")
+		return
+	}
+	var ghost *bridgev2.Ghost
+	var err error
+	if strings.HasPrefix(ce.Args[0], "@") {
+		if !ce.Bridge.IsGhostMXID(id.UserID(ce.Args[0])) {
+			ce.Reply("`%s` is not a ghost user", ce.Args[0])
+			return
+		}
+		ghost, err = ce.Bridge.GetGhostByMXID(ce.Ctx, id.UserID(ce.Args[0]))
+	} else {
+		ghost, err = ce.Bridge.GetExistingGhostByID(ce.Ctx, networkid.UserID(ce.Args[0]))
+	}
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get ghost")
+		ce.Reply("Failed to get ghost")
+		return
+	} else if ghost == nil {
+		ce.Reply("Ghost `%s` not found", ce.Args[0])
+		return
+	}
+	login := findLoginForGhostResync(ce)
+	if login == nil {
+		ce.Reply("No connected login found to fetch user info with")
+		return
+	}
+	client := login.GetClient()
+	if client == nil {
+		ce.Reply("`%s` was disconnected before the user info could be fetched", login.ID)
+		return
+	}
+	info, err := client.GetUserInfo(ce.Ctx, ghost)
+	if err != nil {
+		ce.Reply("Failed to get user info using `%s`: %v", login.ID, err)
+		return
+	} else if info == nil {
+		ce.Reply("The network connector didn't return any user info")
+		return
+	}
+	ghost.UpdateInfo(ce.Ctx, info)
+	ce.Reply("User info of `%s` resynced using `%s`", ghost.Intent.GetMXID(), login.ID)
+}
+
+var CommandReIDPortal = &FullHandler{
+	Func: fnReIDPortal,
+	Name: "reid-portal",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Change the remote ID of the current portal. If a portal with the new ID already exists, it will be merged into this one.",
+		Args:        "<_new portal ID_> [_new receiver_]",
+	},
+	RequiresAdmin:  true,
+	RequiresPortal: true,
+}
+
+func fnReIDPortal(ce *Event) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `$cmdprefix reid-portal <new portal ID> [new receiver]`")
+		return
+	}
+	target := networkid.PortalKey{ID: networkid.PortalID(ce.Args[0]), Receiver: ce.Portal.Receiver}
+	if len(ce.Args) > 1 {
+		target.Receiver = networkid.UserLoginID(ce.Args[1])
+	}
+	result, portal, err := ce.Bridge.ReIDPortal(ce.Ctx, ce.Portal.PortalKey, target)
+	if err != nil {
+		ce.Reply("Failed to re-ID portal: %v", err)
+		return
+	}
+	switch result {
+	case bridgev2.ReIDResultNoOp:
+		ce.Reply("Nothing to do")
+	case bridgev2.ReIDResultSourceDeleted:
+		ce.Reply("The portal was deleted, as the target portal already has a room")
+	case bridgev2.ReIDResultSourceReIDd:
+		ce.Reply("Portal re-ID'd to `%s`", portal.PortalKey)
+	case bridgev2.ReIDResultTargetDeletedAndSourceReIDd:
+		ce.Reply("Deleted the existing target portal and re-ID'd this portal to `%s`", portal.PortalKey)
+	case bridgev2.ReIDResultSourceTombstonedIntoTarget:
+		ce.Reply("This room was tombstoned into the existing room of `%s`", portal.PortalKey)
+	default:
+		ce.Reply("Portal re-ID finished with unknown result %d", result)
+	}
+}
+
+var CommandBridgeStatus = &FullHandler{
+	Func:    fnBridgeStatus,
+	Name:    "bridge-status",
+	Aliases: []string{"uptime"},
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Show the bridge version, uptime and event queue statistics",
+	},
+	RequiresAdmin: true,
+}
+
+func fnBridgeStatus(ce *Event) {
+	var output strings.Builder
+	version := ce.Bridge.Version
+	if version == "" {
+		version = "unknown"
+	}
+	_, _ = fmt.Fprintf(&output, "**Version:** %s (mautrix-go %s, %s)\n", version, mautrix.VersionWithCommit, runtime.Version())
+	if ce.Bridge.StartTime.IsZero() {
+		output.WriteString("**Uptime:** not started\n")
+	} else {
+		_, _ = fmt.Fprintf(
+			&output, "**Uptime:** %s (started at %s)\n",
+			time.Since(ce.Bridge.StartTime).Round(time.Second), ce.Bridge.StartTime.Format(time.RFC1123),
+		)
+	}
+	stateCounts := make(map[status.BridgeStateEvent]int)
+	logins := ce.Bridge.GetAllCachedUserLogins()
+	for _, login := range logins {
+		if bs := login.BridgeState; bs != nil {
+			stateCounts[bs.GetPrev().StateEvent]++
+		}
+	}
+	_, _ = fmt.Fprintf(&output, "**Logins:** %d", len(logins))
+	if len(stateCounts) > 0 {
+		parts := make([]string, 0, len(stateCounts))
+		for state, count := range stateCounts {
+			parts = append(parts, fmt.Sprintf("`%s`: %d", state, count))
+		}
+		slices.Sort(parts)
+		_, _ = fmt.Fprintf(&output, " (%s)", strings.Join(parts, ", "))
+	}
+	output.WriteByte('\n')
+	stats := ce.Bridge.GetEventQueueStats()
+	_, _ = fmt.Fprintf(
+		&output, "**Event queues:** %d events queued in %d of %d cached portals\n",
+		stats.QueuedEvents, stats.NonEmptyQueues, stats.CachedPortals,
+	)
+	if stats.LongestQueue > 0 {
+		_, _ = fmt.Fprintf(&output, "**Longest queue:** %d events in `%s`\n", stats.LongestQueue, stats.LongestQueuePortal)
+	}
+	ce.Reply(output.String())
+}
+
+var CommandBroadcast = &FullHandler{
+	Func: fnBroadcast,
+	Name: "broadcast",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Send a notice to the management rooms of all users",
+		Args:        "<_message_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnBroadcast(ce *Event) {
+	if len(ce.RawArgs) == 0 {
+		ce.Reply("Usage: `$cmdprefix broadcast <message>`")
+		return
+	}
+	users, err := ce.Bridge.DB.User.GetAllWithManagementRoom(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get users with management rooms")
+		ce.Reply("Failed to get users with management rooms")
+		return
+	}
+	content := format.RenderMarkdown(ce.RawArgs, true, false)
+	content.MsgType = event.MsgNotice
+	var failed int
+	for _, user := range users {
+		_, err = ce.Bot.SendMessage(ce.Ctx, user.ManagementRoom, event.EventMessage, &event.Content{Parsed: &content}, nil)
+		if err != nil {
+			ce.Log.Err(err).
+				Stringer("user_id", user.MXID).
+				Stringer("room_id", user.ManagementRoom).
+				Msg("Failed to send broadcast to management room")
+			failed++
+		}
+	}
+	if failed > 0 {
+		ce.Reply("Broadcast sent to %d management rooms, failed to send to %d", len(users)-failed, failed)
+	} else {
+		ce.Reply("Broadcast sent to %d management rooms", len(users))
+	}
+}
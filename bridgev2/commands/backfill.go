@@ -0,0 +1,141 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+var CommandBackfillQueue = &FullHandler{
+	Func: fnBackfillQueue,
+	Name: "backfill-queue",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "List all backfill tasks and their progress",
+		Args:        "[--all]",
+	},
+	RequiresAdmin: true,
+}
+
+func formatBackfillTaskInfo(ce *Event, info *bridgev2.BackfillTaskInfo) string {
+	portalName := fmt.Sprintf("`%s`", info.PortalKey.String())
+	portal, err := ce.Bridge.GetExistingPortalByKey(ce.Ctx, info.PortalKey)
+	if err != nil {
+		ce.Log.Err(err).Object("portal_key", info.PortalKey).Msg("Failed to get portal for backfill task")
+	} else if portal != nil && portal.MXID != "" {
+		portalName = fmt.Sprintf("[%s](%s)", portalName, portal.MXID.URI().MatrixToURL())
+	}
+	var state string
+	switch {
+	case info.IsDone:
+		state = "done"
+	case info.Paused:
+		state = "paused"
+	case !info.DispatchedAt.IsZero() && info.CompletedAt.IsZero():
+		state = "in progress"
+	default:
+		state = "pending"
+	}
+	oldest := "none"
+	if !info.OldestMessageTS.IsZero() {
+		oldest = info.OldestMessageTS.UTC().Format(time.DateTime)
+	}
+	extra := ""
+	if info.ExtraBatches > 0 {
+		extra = fmt.Sprintf(", %d extra batches requested", info.ExtraBatches)
+	}
+	return fmt.Sprintf(
+		"* %s: %s, %d batches, %d messages, oldest message from %s%s",
+		portalName, state, max(info.BatchCount, 0), info.MessageCount, oldest, extra,
+	)
+}
+
+func fnBackfillQueue(ce *Event) {
+	infos, err := ce.Bridge.GetAllBackfillTaskInfo(ce.Ctx)
+	if err != nil {
+		ce.Reply("Failed to get backfill tasks: %v", err)
+		return
+	}
+	showAll := len(ce.Args) > 0 && ce.Args[0] == "--all"
+	lines := make([]string, 0, len(infos))
+	doneCount := 0
+	for _, info := range infos {
+		if info.IsDone {
+			doneCount++
+			if !showAll {
+				continue
+			}
+		}
+		lines = append(lines, formatBackfillTaskInfo(ce, info))
+	}
+	if len(lines) == 0 {
+		ce.Reply("No pending backfill tasks (%d completed)", doneCount)
+		return
+	}
+	ce.Reply("%d backfill tasks (%d completed):\n\n%s", len(infos), doneCount, strings.Join(lines, "\n"))
+}
+
+var CommandBackfill = &FullHandler{
+	Func: fnBackfill,
+	Name: "backfill",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "View or control the backfill progress of the current portal",
+		Args:        "[status | pause | resume | restart | prioritize | more [_batches_]]",
+	},
+	RequiresAdmin:  true,
+	RequiresPortal: true,
+}
+
+func fnBackfill(ce *Event) {
+	action := "status"
+	if len(ce.Args) > 0 {
+		action = strings.ToLower(ce.Args[0])
+	}
+	if action == "status" {
+		task, err := ce.Bridge.DB.BackfillTask.GetByPortal(ce.Ctx, ce.Portal.PortalKey)
+		if err != nil {
+			ce.Reply("Failed to get backfill task: %v", err)
+			return
+		} else if task == nil {
+			ce.Reply("This portal doesn't have a backfill task")
+			return
+		}
+		info, err := ce.Bridge.GetBackfillTaskInfo(ce.Ctx, task)
+		if err != nil {
+			ce.Reply("Failed to get backfill task info: %v", err)
+			return
+		}
+		ce.Reply(formatBackfillTaskInfo(ce, info))
+		return
+	}
+	batches := 1
+	if action == string(bridgev2.BackfillActionMore) && len(ce.Args) > 1 {
+		var err error
+		batches, err = strconv.Atoi(ce.Args[1])
+		if err != nil || batches <= 0 {
+			ce.Reply("Batch count must be a positive integer")
+			return
+		}
+	}
+	err := ce.Bridge.ControlBackfill(ce.Ctx, ce.Portal.PortalKey, bridgev2.BackfillControlAction(action), batches)
+	if errors.Is(err, bridgev2.ErrBackfillTaskNotFound) {
+		ce.Reply("This portal doesn't have a backfill task")
+	} else if err != nil {
+		ce.Reply("Failed to %s backfill: %v", action, err)
+	} else if action == string(bridgev2.BackfillActionMore) {
+		ce.Reply("Requested %d more backfill batches", batches)
+	} else {
+		ce.Reply("Backfill %s successful", action)
+	}
+}
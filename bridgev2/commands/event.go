@@ -44,7 +44,7 @@ type Event struct {
 
 // Reply sends a reply to command as notice, with optional string formatting and automatic $cmdprefix replacement.
 func (ce *Event) Reply(msg string, args ...any) {
-	msg = strings.ReplaceAll(msg, "$cmdprefix ", ce.Bridge.Config.CommandPrefix+" ")
+	msg = strings.ReplaceAll(msg, "$cmdprefix ", ce.Bridge.GetConfig().CommandPrefix+" ")
 	if len(args) > 0 {
 		msg = fmt.Sprintf(msg, args...)
 	}
@@ -80,11 +80,11 @@ func (fh *FullHandler) userHasRoomPermission(ce *Event) bool {
 }
 
 func (fh *FullHandler) Run(ce *Event) {
-	if fh.RequiresAdmin && !ce.User.Permissions.Admin {
+	if fh.RequiresAdmin && !ce.User.GetPermissions().Admin {
 		ce.Reply("That command is limited to bridge administrators.")
-	} else if fh.RequiresLoginPermission && !ce.User.Permissions.Login {
+	} else if fh.RequiresLoginPermission && !ce.User.GetPermissions().Login {
 		ce.Reply("You do not have permissions to log into this bridge.")
-	} else if fh.RequiresEventLevel.Type != "" && !ce.User.Permissions.Admin && !fh.userHasRoomPermission(ce) {
+	} else if fh.RequiresEventLevel.Type != "" && !ce.User.GetPermissions().Admin && !fh.userHasRoomPermission(ce) {
 		ce.Reply("That command requires room admin rights.")
 	} else if fh.RequiresPortal && ce.Portal == nil {
 		ce.Reply("That command can only be ran in portal rooms.")
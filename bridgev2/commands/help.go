@@ -8,8 +8,9 @@ package commands
 
 import (
 	"fmt"
-	"sort"
 	"strings"
+
+	basecmd "maunium.net/go/mautrix/commands"
 )
 
 type HelpfulHandler interface {
@@ -18,68 +19,22 @@ type HelpfulHandler interface {
 	ShowInHelp(*Event) bool
 }
 
-type HelpSection struct {
-	Name  string
-	Order int
-}
+type HelpSection = basecmd.HelpSection
 
 var (
 	// Deprecated: this should be used as a placeholder that needs to be fixed
-	HelpSectionUnclassified = HelpSection{"Unclassified", -1}
+	HelpSectionUnclassified = HelpSection{Name: "Unclassified", Order: -1}
 
-	HelpSectionGeneral = HelpSection{"General", 0}
-	HelpSectionAuth    = HelpSection{"Authentication", 10}
-	HelpSectionChats   = HelpSection{"Starting and managing chats", 20}
-	HelpSectionAdmin   = HelpSection{"Administration", 50}
+	HelpSectionGeneral = basecmd.HelpSectionGeneral
+	HelpSectionAuth    = HelpSection{Name: "Authentication", Order: 10}
+	HelpSectionChats   = HelpSection{Name: "Starting and managing chats", Order: 20}
+	HelpSectionAdmin   = basecmd.HelpSectionAdmin
 )
 
-type HelpMeta struct {
-	Command     string
-	Section     HelpSection
-	Description string
-	Args        string
-}
-
-func (hm *HelpMeta) String() string {
-	if len(hm.Args) == 0 {
-		return fmt.Sprintf("**%s** - %s", hm.Command, hm.Description)
-	}
-	return fmt.Sprintf("**%s** %s - %s", hm.Command, hm.Args, hm.Description)
-}
-
-type helpSectionList []HelpSection
-
-func (h helpSectionList) Len() int {
-	return len(h)
-}
-
-func (h helpSectionList) Less(i, j int) bool {
-	return h[i].Order < h[j].Order
-}
-
-func (h helpSectionList) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
-}
-
-type helpMetaList []HelpMeta
-
-func (h helpMetaList) Len() int {
-	return len(h)
-}
-
-func (h helpMetaList) Less(i, j int) bool {
-	return h[i].Command < h[j].Command
-}
-
-func (h helpMetaList) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
-}
-
-var _ sort.Interface = (helpSectionList)(nil)
-var _ sort.Interface = (helpMetaList)(nil)
+type HelpMeta = basecmd.HelpMeta
 
 func FormatHelp(ce *Event) string {
-	sections := make(map[HelpSection]helpMetaList)
+	var helps []HelpMeta
 	for _, handler := range ce.Processor.handlers {
 		helpfulHandler, ok := handler.(HelpfulHandler)
 		if !ok || !helpfulHandler.ShowInHelp(ce) {
@@ -89,14 +44,8 @@ func FormatHelp(ce *Event) string {
 		if help.Description == "" {
 			continue
 		}
-		sections[help.Section] = append(sections[help.Section], help)
-	}
-
-	sortedSections := make(helpSectionList, 0, len(sections))
-	for section := range sections {
-		sortedSections = append(sortedSections, section)
+		helps = append(helps, help)
 	}
-	sort.Sort(sortedSections)
 
 	var output strings.Builder
 	output.Grow(10240)
@@ -109,23 +58,12 @@ func FormatHelp(ce *Event) string {
 	} else {
 		prefixMsg = "This is not your management room: prefixing commands with `%s` is required."
 	}
-	_, _ = fmt.Fprintf(&output, prefixMsg, ce.Bridge.Config.CommandPrefix)
+	_, _ = fmt.Fprintf(&output, prefixMsg, ce.Bridge.GetConfig().CommandPrefix)
 	output.WriteByte('\n')
 	output.WriteString("Parameters in [square brackets] are optional, while parameters in <angle brackets> are required.")
 	output.WriteByte('\n')
 	output.WriteByte('\n')
-
-	for _, section := range sortedSections {
-		output.WriteString("#### ")
-		output.WriteString(section.Name)
-		output.WriteByte('\n')
-		sort.Sort(sections[section])
-		for _, command := range sections[section] {
-			output.WriteString(command.String())
-			output.WriteByte('\n')
-		}
-		output.WriteByte('\n')
-	}
+	basecmd.WriteHelpSections(&output, helps)
 	return output.String()
 }
 
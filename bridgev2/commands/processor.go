@@ -43,10 +43,13 @@ func NewProcessor(bridge *bridgev2.Bridge) bridgev2.CommandProcessor {
 	proc.AddHandlers(
 		CommandHelp, CommandCancel,
 		CommandRegisterPush, CommandDeletePortal, CommandDeleteAllPortals,
+		CommandBackfillQueue, CommandBackfill,
 		CommandLogin, CommandRelogin, CommandListLogins, CommandLogout, CommandSetPreferredLogin,
 		CommandSetRelay, CommandUnsetRelay,
 		CommandResolveIdentifier, CommandStartChat, CommandSearch,
 		CommandSudo, CommandDoIn,
+		CommandListUsers, CommandForceLogout, CommandReconnect, CommandResyncPortal, CommandResyncGhost,
+		CommandReIDPortal, CommandBridgeStatus, CommandBroadcast,
 	)
 	return proc
 }
@@ -108,7 +111,7 @@ func (proc *Processor) Handle(ctx context.Context, roomID id.RoomID, eventID id.
 		args = []string{"unknown-command"}
 	}
 	command := strings.ToLower(args[0])
-	rawArgs := strings.TrimLeft(strings.TrimPrefix(message, command), " ")
+	rawArgs := strings.TrimLeft(strings.TrimPrefix(message, args[0]), " ")
 	portal, err := proc.bridge.GetPortalByMXID(ctx, roomID)
 	if err != nil {
 		log.Err(err).Msg("Failed to get portal")
@@ -28,14 +28,14 @@ var CommandSetRelay = &FullHandler{
 }
 
 func fnSetRelay(ce *Event) {
-	if !ce.Bridge.Config.Relay.Enabled {
+	if !ce.Bridge.GetConfig().Relay.Enabled {
 		ce.Reply("This bridge does not allow relay mode")
 		return
 	} else if !canManageRelay(ce) {
 		ce.Reply("You don't have permission to manage the relay in this room")
 		return
 	}
-	onlySetDefaultRelays := !ce.User.Permissions.Admin && ce.Bridge.Config.Relay.AdminOnly
+	onlySetDefaultRelays := !ce.User.GetPermissions().Admin && ce.Bridge.GetConfig().Relay.AdminOnly
 	var relay *bridgev2.UserLogin
 	if len(ce.Args) == 0 {
 		relay = ce.User.GetDefaultLogin()
@@ -44,7 +44,7 @@ func fnSetRelay(ce *Event) {
 			relay = nil
 		}
 		if relay == nil {
-			if len(ce.Bridge.Config.Relay.DefaultRelays) == 0 {
+			if len(ce.Bridge.GetConfig().Relay.DefaultRelays) == 0 {
 				ce.Reply("You're not logged in and there are no default relay users configured")
 				return
 			}
@@ -55,7 +55,7 @@ func fnSetRelay(ce *Event) {
 				return
 			}
 		Outer:
-			for _, loginID := range ce.Bridge.Config.Relay.DefaultRelays {
+			for _, loginID := range ce.Bridge.GetConfig().Relay.DefaultRelays {
 				for _, login := range logins {
 					if login.ID == loginID {
 						relay = login
@@ -77,9 +77,9 @@ func fnSetRelay(ce *Event) {
 		if relay == nil {
 			ce.Reply("User login with ID `%s` not found", ce.Args[0])
 			return
-		} else if slices.Contains(ce.Bridge.Config.Relay.DefaultRelays, relay.ID) {
+		} else if slices.Contains(ce.Bridge.GetConfig().Relay.DefaultRelays, relay.ID) {
 			// All good
-		} else if relay.UserMXID != ce.User.MXID && !ce.User.Permissions.Admin {
+		} else if relay.UserMXID != ce.User.MXID && !ce.User.GetPermissions().Admin {
 			ce.Reply("Only bridge admins can set another user's login as the relay")
 			return
 		} else if onlySetDefaultRelays {
@@ -130,8 +130,8 @@ func fnUnsetRelay(ce *Event) {
 }
 
 func canManageRelay(ce *Event) bool {
-	return ce.User.Permissions.ManageRelay &&
-		(ce.User.Permissions.Admin ||
+	return ce.User.GetPermissions().ManageRelay &&
+		(ce.User.GetPermissions().Admin ||
 			(ce.Portal.Relay != nil && ce.Portal.Relay.UserMXID == ce.User.MXID) ||
 			hasRelayRoomPermissions(ce))
 }
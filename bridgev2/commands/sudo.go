@@ -80,7 +80,7 @@ func fnDoIn(ce *Event) {
 		return
 	}
 	targetRoomID := id.RoomID(ce.Args[0])
-	if !ce.User.Permissions.Admin {
+	if !ce.User.GetPermissions().Admin {
 		memberInfo, err := ce.Bridge.Matrix.GetMemberInfo(ce.Ctx, targetRoomID, ce.User.MXID)
 		if err != nil {
 			ce.Log.Err(err).Msg("Failed to check if user is in doin target room")
@@ -0,0 +1,402 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
+	nethtml "golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CustomEmoji is a custom emoji or sticker on the remote network.
+//
+// The ID must be unique across the whole bridge and should change if the image changes,
+// as the bridge caches the Matrix content URI of each emoji ID in the database.
+//
+// For the Matrix -> remote direction, network connectors can look up custom emojis
+// by content URI using [database.CustomEmojiQuery.GetByMXC].
+type CustomEmoji struct {
+	ID        networkid.EmojiID
+	Shortcode string
+
+	// If direct media is enabled and the media ID is set, the bridge will use a direct media URI
+	// for the emoji instead of reuploading it.
+	MediaID networkid.MediaID
+	// For pre-uploaded emojis, the MXC URI can be provided directly.
+	MXC id.ContentURIString
+	// Get is used to download the emoji if it needs to be reuploaded.
+	Get func(ctx context.Context) ([]byte, error)
+
+	Info  *event.FileInfo
+	Usage []event.ImagePackUsage
+}
+
+// GetShortcode returns the shortcode of the emoji surrounded by colons.
+func (ce *CustomEmoji) GetShortcode() string {
+	return fmt.Sprintf(":%s:", strings.Trim(ce.Shortcode, ":"))
+}
+
+// CustomEmojiHTML returns a HTML img tag that renders the given custom emoji inline.
+func CustomEmojiHTML(mxc id.ContentURIString, shortcode string) string {
+	escapedShortcode := html.EscapeString(shortcode)
+	return fmt.Sprintf(
+		`<img data-mx-emoticon src="%s" alt="%s" title="%s" height="32"/>`,
+		html.EscapeString(string(mxc)), escapedShortcode, escapedShortcode,
+	)
+}
+
+// GetCustomEmojiMXC returns the Matrix content URI for the given custom emoji,
+// reusing a previously bridged copy if one exists in the database.
+func (br *Bridge) GetCustomEmojiMXC(ctx context.Context, emoji *CustomEmoji, intent MatrixAPI) (id.ContentURIString, error) {
+	existing, err := br.DB.CustomEmoji.GetByID(ctx, emoji.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get custom emoji from database: %w", err)
+	} else if existing != nil && existing.MXC != "" {
+		return existing.MXC, nil
+	}
+	mxc := emoji.MXC
+	if mxc == "" && len(emoji.MediaID) > 0 {
+		mxc, err = br.Matrix.GenerateContentURI(ctx, emoji.MediaID)
+		if err != nil && !errors.Is(err, ErrDirectMediaNotEnabled) {
+			return "", fmt.Errorf("failed to generate direct media URI for custom emoji: %w", err)
+		}
+	}
+	if mxc == "" {
+		if emoji.Get == nil {
+			return "", fmt.Errorf("no Get function provided for custom emoji")
+		}
+		data, err := emoji.Get(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to download custom emoji: %w", err)
+		}
+		mime := http.DetectContentType(data)
+		if emoji.Info != nil && emoji.Info.MimeType != "" {
+			mime = emoji.Info.MimeType
+		}
+		fileName := strings.Trim(emoji.Shortcode, ":") + exmime.ExtensionFromMimetype(mime)
+		mxc, _, err = intent.UploadMedia(ctx, "", data, fileName, mime)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload custom emoji: %w", err)
+		}
+	}
+	err = br.DB.CustomEmoji.Upsert(ctx, &database.CustomEmoji{
+		ID:        emoji.ID,
+		Shortcode: emoji.Shortcode,
+		MXC:       mxc,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("emoji_id", string(emoji.ID)).Msg("Failed to save custom emoji to database")
+	}
+	return mxc, nil
+}
+
+// RenderCustomEmojis replaces the shortcodes of the given custom emojis in the message with inline images.
+//
+// The plaintext body keeps the shortcodes as-is, while the formatted body is created from the plaintext body
+// if the message didn't already have one. Emojis that fail to bridge are left as plain shortcodes.
+func (br *Bridge) RenderCustomEmojis(ctx context.Context, intent MatrixAPI, content *event.MessageEventContent, emojis []*CustomEmoji) {
+	if len(emojis) == 0 {
+		return
+	}
+	content.EnsureHasHTML()
+	for _, emoji := range emojis {
+		shortcode := emoji.GetShortcode()
+		escapedShortcode := html.EscapeString(shortcode)
+		if !strings.Contains(content.FormattedBody, escapedShortcode) {
+			continue
+		}
+		mxc, err := br.GetCustomEmojiMXC(ctx, emoji, intent)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("emoji_id", string(emoji.ID)).Msg("Failed to get custom emoji for message")
+			continue
+		}
+		content.FormattedBody = replaceInHTMLText(content.FormattedBody, escapedShortcode, CustomEmojiHTML(mxc, shortcode))
+	}
+}
+
+// replaceInHTMLText replaces old with new in the text nodes of the given HTML.
+// Tags, attributes and the contents of code blocks are left as-is.
+func replaceInHTMLText(body, old, new string) string {
+	var out strings.Builder
+	tokenizer := nethtml.NewTokenizer(strings.NewReader(body))
+	codeDepth := 0
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == nethtml.ErrorToken {
+			break
+		}
+		raw := tokenizer.Raw()
+		switch tokenType {
+		case nethtml.StartTagToken, nethtml.EndTagToken:
+			tagName, _ := tokenizer.TagName()
+			if tag := string(tagName); tag == "code" || tag == "pre" {
+				if tokenType == nethtml.StartTagToken {
+					codeDepth++
+				} else if codeDepth > 0 {
+					codeDepth--
+				}
+			}
+		case nethtml.TextToken:
+			if codeDepth == 0 {
+				out.WriteString(strings.ReplaceAll(string(raw), old, new))
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+	return out.String()
+}
+
+// MatrixCustomEmoji is a custom emoji used in a Matrix message.
+type MatrixCustomEmoji struct {
+	MXC       id.ContentURIString
+	Shortcode string
+	// The database entry of the emoji if it was originally bridged from the remote network.
+	// Emojis that are only available on Matrix don't have a database entry.
+	Bridged *database.CustomEmoji
+}
+
+// GetMatrixCustomEmojis finds all inline custom emojis (images with the data-mx-emoticon attribute)
+// in the formatted body of the given Matrix message. Each content URI is only included once.
+func (br *Bridge) GetMatrixCustomEmojis(ctx context.Context, content *event.MessageEventContent) ([]*MatrixCustomEmoji, error) {
+	if content.Format != event.FormatHTML || !strings.Contains(content.FormattedBody, "data-mx-emoticon") {
+		return nil, nil
+	}
+	doc, err := nethtml.Parse(strings.NewReader(content.FormattedBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse formatted body: %w", err)
+	}
+	var emojis []*MatrixCustomEmoji
+	seen := make(map[id.ContentURIString]struct{})
+	for _, node := range findHTMLImages(doc, nil) {
+		var isEmoji bool
+		var emoji MatrixCustomEmoji
+		for _, attr := range node.Attr {
+			switch attr.Key {
+			case "data-mx-emoticon":
+				isEmoji = true
+			case "src":
+				emoji.MXC = id.ContentURIString(attr.Val)
+			case "alt":
+				emoji.Shortcode = attr.Val
+			case "title":
+				if emoji.Shortcode == "" {
+					emoji.Shortcode = attr.Val
+				}
+			}
+		}
+		if _, alreadySeen := seen[emoji.MXC]; !isEmoji || alreadySeen || !strings.HasPrefix(string(emoji.MXC), "mxc://") {
+			continue
+		}
+		seen[emoji.MXC] = struct{}{}
+		emoji.Bridged, err = br.DB.CustomEmoji.GetByMXC(ctx, emoji.MXC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get custom emoji from database: %w", err)
+		}
+		emojis = append(emojis, &emoji)
+	}
+	return emojis, nil
+}
+
+func findHTMLImages(node *nethtml.Node, output []*nethtml.Node) []*nethtml.Node {
+	if node.Type == nethtml.ElementNode && node.Data == "img" {
+		output = append(output, node)
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		output = findHTMLImages(child, output)
+	}
+	return output
+}
+
+// ImagePack is a custom emoji or sticker pack on the remote network.
+type ImagePack struct {
+	ID          networkid.ImagePackID
+	Name        string
+	Avatar      *CustomEmoji
+	Usage       []event.ImagePackUsage
+	Attribution string
+	Emojis      []*CustomEmoji
+
+	// If true, the pack is removed from the room instead of being updated.
+	Remove bool
+}
+
+// ConvertImagePack converts the given remote image pack into an MSC2545 image pack event content,
+// uploading any emojis that haven't been bridged yet.
+func (br *Bridge) ConvertImagePack(ctx context.Context, pack *ImagePack, intent MatrixAPI) (*event.ImagePackEventContent, error) {
+	content := &event.ImagePackEventContent{
+		Images: make(map[string]*event.ImagePackImage, len(pack.Emojis)),
+		Pack: event.ImagePackMeta{
+			DisplayName: pack.Name,
+			Usage:       pack.Usage,
+			Attribution: pack.Attribution,
+		},
+	}
+	if pack.Avatar != nil {
+		var err error
+		content.Pack.AvatarURL, err = br.GetCustomEmojiMXC(ctx, pack.Avatar, intent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pack avatar: %w", err)
+		}
+	}
+	for _, emoji := range pack.Emojis {
+		mxc, err := br.GetCustomEmojiMXC(ctx, emoji, intent)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("pack_id", string(pack.ID)).
+				Str("emoji_id", string(emoji.ID)).
+				Msg("Failed to bridge custom emoji in image pack")
+			continue
+		}
+		content.Images[strings.Trim(emoji.Shortcode, ":")] = &event.ImagePackImage{
+			URL:   mxc,
+			Body:  emoji.GetShortcode(),
+			Info:  emoji.Info,
+			Usage: emoji.Usage,
+		}
+	}
+	return content, nil
+}
+
+func (portal *Portal) updateImagePacks(ctx context.Context, packs []*ImagePack, sender MatrixAPI, ts time.Time) {
+	if portal.MXID == "" {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	for _, pack := range packs {
+		existing, err := portal.Bridge.DB.ImagePack.GetByID(ctx, portal.PortalKey, pack.ID)
+		if err != nil {
+			log.Err(err).Str("pack_id", string(pack.ID)).Msg("Failed to get image pack from database")
+			continue
+		}
+		if pack.Remove {
+			if existing == nil {
+				continue
+			}
+			if portal.sendRoomMeta(ctx, sender, ts, event.StateUnstableImagePack, string(pack.ID), &event.ImagePackEventContent{}) {
+				err = portal.Bridge.DB.ImagePack.Delete(ctx, portal.PortalKey, pack.ID)
+				if err != nil {
+					log.Err(err).Str("pack_id", string(pack.ID)).Msg("Failed to delete image pack from database")
+				}
+			}
+			continue
+		}
+		content, err := portal.Bridge.ConvertImagePack(ctx, pack, portal.Bridge.Bot)
+		if err != nil {
+			log.Err(err).Str("pack_id", string(pack.ID)).Msg("Failed to convert image pack")
+			continue
+		}
+		contentJSON, err := json.Marshal(content)
+		if err != nil {
+			log.Err(err).Str("pack_id", string(pack.ID)).Msg("Failed to marshal image pack")
+			continue
+		}
+		hash := sha256.Sum256(contentJSON)
+		if existing != nil && existing.ContentHash == hash {
+			continue
+		}
+		if portal.sendRoomMeta(ctx, sender, ts, event.StateUnstableImagePack, string(pack.ID), content) {
+			err = portal.Bridge.DB.ImagePack.Upsert(ctx, &database.ImagePack{
+				Portal:      portal.PortalKey,
+				ID:          pack.ID,
+				ContentHash: hash,
+			})
+			if err != nil {
+				log.Err(err).Str("pack_id", string(pack.ID)).Msg("Failed to save image pack to database")
+			}
+		}
+	}
+}
+
+// UpdateImagePacks merges the given remote image packs into the user's personal
+// im.ponies.user_emotes pack using their double puppet.
+//
+// Images previously bridged by this bridge are replaced, while any images added
+// by the user themselves are left untouched.
+func (ul *UserLogin) UpdateImagePacks(ctx context.Context, packs []*ImagePack) error {
+	dp := ul.User.DoublePuppet(ctx)
+	if dp == nil {
+		return nil
+	}
+	accountDataAPI, ok := dp.(AccountDataMatrixAPI)
+	if !ok {
+		return nil
+	}
+	var content event.ImagePackEventContent
+	err := accountDataAPI.GetAccountData(ctx, event.AccountDataUnstableImagePack, &content)
+	if err != nil {
+		return fmt.Errorf("failed to get current user image pack: %w", err)
+	}
+	if content.Images == nil {
+		content.Images = make(map[string]*event.ImagePackImage)
+	}
+	for shortcode, img := range content.Images {
+		existing, err := ul.Bridge.DB.CustomEmoji.GetByMXC(ctx, img.URL)
+		if err != nil {
+			return fmt.Errorf("failed to check if image is bridged: %w", err)
+		} else if existing != nil {
+			delete(content.Images, shortcode)
+		}
+	}
+	for _, pack := range packs {
+		if pack.Remove {
+			continue
+		}
+		converted, err := ul.Bridge.ConvertImagePack(ctx, pack, ul.Bridge.Bot)
+		if err != nil {
+			return fmt.Errorf("failed to convert image pack %s: %w", pack.ID, err)
+		}
+		for shortcode, img := range converted.Images {
+			if len(img.Usage) == 0 {
+				img.Usage = converted.Pack.Usage
+			}
+			content.Images[shortcode] = img
+		}
+	}
+	err = accountDataAPI.SetAccountData(ctx, event.AccountDataUnstableImagePack, &content)
+	if err != nil {
+		return fmt.Errorf("failed to set user image pack: %w", err)
+	}
+	return nil
+}
+
+func (portal *Portal) convertCustomEmojiReaction(
+	ctx context.Context, intent MatrixAPI, emoji string, customEmoji *CustomEmoji, extra map[string]any,
+) (string, map[string]any) {
+	if customEmoji == nil {
+		return emoji, extra
+	}
+	mxc, err := portal.Bridge.GetCustomEmojiMXC(ctx, customEmoji, intent)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("emoji_id", string(customEmoji.ID)).Msg("Failed to get custom emoji for reaction")
+		if emoji == "" {
+			emoji = customEmoji.GetShortcode()
+		}
+		return emoji, extra
+	}
+	newExtra := make(map[string]any, len(extra)+1)
+	for key, value := range extra {
+		newExtra[key] = value
+	}
+	newExtra["com.beeper.reaction.shortcode"] = customEmoji.GetShortcode()
+	return string(mxc), newExtra
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestEmoji(downloads *int) *bridgev2.CustomEmoji {
+	return &bridgev2.CustomEmoji{
+		ID:        "emoji1",
+		Shortcode: "party",
+		Get: func(ctx context.Context) ([]byte, error) {
+			*downloads++
+			return []byte("\x89PNG\r\n\x1a\nfake"), nil
+		},
+	}
+}
+
+func TestGetCustomEmojiMXC(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	br := h.Bridge
+
+	mxc, err := br.GetCustomEmojiMXC(h.Ctx, &bridgev2.CustomEmoji{ID: "preuploaded", Shortcode: "pre", MXC: "mxc://example.com/pre"}, br.Bot)
+	require.NoError(t, err)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/pre"), mxc)
+
+	var downloads int
+	mxc, err = br.GetCustomEmojiMXC(h.Ctx, newTestEmoji(&downloads), br.Bot)
+	require.NoError(t, err)
+	media := h.Matrix.GetMedia(mxc)
+	require.NotNil(t, media)
+	assert.Equal(t, "party.png", media.FileName)
+	assert.Equal(t, "image/png", media.MimeType)
+
+	dbEmoji, err := br.DB.CustomEmoji.GetByID(h.Ctx, "emoji1")
+	require.NoError(t, err)
+	require.NotNil(t, dbEmoji)
+	assert.Equal(t, mxc, dbEmoji.MXC)
+
+	// The cached content URI is reused
+	mxc, err = br.GetCustomEmojiMXC(h.Ctx, newTestEmoji(&downloads), br.Bot)
+	require.NoError(t, err)
+	assert.Equal(t, dbEmoji.MXC, mxc)
+	assert.Equal(t, 1, downloads)
+
+	_, err = br.GetCustomEmojiMXC(h.Ctx, &bridgev2.CustomEmoji{ID: "noget", Shortcode: "noget"}, br.Bot)
+	assert.Error(t, err)
+}
+
+func TestRenderCustomEmojis(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	br := h.Bridge
+	var downloads int
+	emoji := newTestEmoji(&downloads)
+	unused := &bridgev2.CustomEmoji{ID: "emoji2", Shortcode: "unused", MXC: "mxc://bridge.test/unused"}
+
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "let's <go> :party: :party:"}
+	br.RenderCustomEmojis(h.Ctx, br.Bot, content, []*bridgev2.CustomEmoji{emoji, unused})
+	assert.Equal(t, "let's <go> :party: :party:", content.Body)
+	assert.Equal(t, event.FormatHTML, content.Format)
+	require.Equal(t, 1, downloads)
+
+	dbEmoji, err := br.DB.CustomEmoji.GetByID(h.Ctx, "emoji1")
+	require.NoError(t, err)
+	require.NotNil(t, dbEmoji)
+	img := bridgev2.CustomEmojiHTML(dbEmoji.MXC, ":party:")
+	assert.Equal(t, "let&#39;s &lt;go&gt; "+img+" "+img, content.FormattedBody)
+	assert.NotContains(t, content.FormattedBody, "unused")
+
+	// The emoji is only uploaded once
+	content = &event.MessageEventContent{MsgType: event.MsgText, Body: ":party:"}
+	br.RenderCustomEmojis(h.Ctx, br.Bot, content, []*bridgev2.CustomEmoji{emoji})
+	assert.Equal(t, img, content.FormattedBody)
+	assert.Equal(t, 1, downloads)
+
+	// Shortcodes are only replaced in text, not in attributes or code
+	content = &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          ":party:",
+		Format:        event.FormatHTML,
+		FormattedBody: `<a href="https://example.com/:party:" title=":party:">:party:</a> <code>:party:</code> <pre><code>:party:</code></pre> :party:`,
+	}
+	br.RenderCustomEmojis(h.Ctx, br.Bot, content, []*bridgev2.CustomEmoji{emoji})
+	assert.Equal(t, `<a href="https://example.com/:party:" title=":party:">`+img+`</a> <code>:party:</code> <pre><code>:party:</code></pre> `+img, content.FormattedBody)
+
+	// Emojis that fail to bridge are left as shortcodes
+	failing := &bridgev2.CustomEmoji{ID: "emoji3", Shortcode: "broken", Get: func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("download failed")
+	}}
+	content = &event.MessageEventContent{MsgType: event.MsgText, Body: ":broken:"}
+	br.RenderCustomEmojis(h.Ctx, br.Bot, content, []*bridgev2.CustomEmoji{failing})
+	assert.Equal(t, ":broken:", content.FormattedBody)
+}
+
+func TestGetMatrixCustomEmojis(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	br := h.Bridge
+	var downloads int
+	mxc, err := br.GetCustomEmojiMXC(h.Ctx, newTestEmoji(&downloads), br.Bot)
+	require.NoError(t, err)
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    ":party: :matrix: :party:",
+		Format:  event.FormatHTML,
+		FormattedBody: bridgev2.CustomEmojiHTML(mxc, ":party:") + " " +
+			bridgev2.CustomEmojiHTML("mxc://example.com/matrix", ":matrix:") + " " +
+			bridgev2.CustomEmojiHTML(mxc, ":party:") +
+			` <img src="mxc://example.com/notemoji" alt="not an emoji">`,
+	}
+	emojis, err := br.GetMatrixCustomEmojis(h.Ctx, content)
+	require.NoError(t, err)
+	require.Len(t, emojis, 2)
+	assert.Equal(t, mxc, emojis[0].MXC)
+	assert.Equal(t, ":party:", emojis[0].Shortcode)
+	require.NotNil(t, emojis[0].Bridged)
+	assert.EqualValues(t, "emoji1", emojis[0].Bridged.ID)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/matrix"), emojis[1].MXC)
+	assert.Nil(t, emojis[1].Bridged)
+
+	emojis, err = br.GetMatrixCustomEmojis(h.Ctx, &event.MessageEventContent{Body: ":party:"})
+	require.NoError(t, err)
+	assert.Empty(t, emojis)
+}
+
+func TestConvertCustomEmojiReaction(t *testing.T) {
+	h, _, portalKey, _ := bridgetest.NewChat(t, nil)
+	portal, err := h.Bridge.GetExistingPortalByKey(h.Ctx, portalKey)
+	require.NoError(t, err)
+	intent := h.Bridge.Bot
+	var downloads int
+
+	emoji, extra := portal.ConvertCustomEmojiReaction(h.Ctx, intent, "👍", nil, map[string]any{"fi.mau.foo": "bar"})
+	assert.Equal(t, "👍", emoji)
+	assert.Equal(t, map[string]any{"fi.mau.foo": "bar"}, extra)
+
+	origExtra := map[string]any{"fi.mau.foo": "bar"}
+	emoji, extra = portal.ConvertCustomEmojiReaction(h.Ctx, intent, "", newTestEmoji(&downloads), origExtra)
+	require.NotNil(t, h.Matrix.GetMedia(id.ContentURIString(emoji)))
+	assert.Equal(t, map[string]any{"fi.mau.foo": "bar", "com.beeper.reaction.shortcode": ":party:"}, extra)
+	assert.Len(t, origExtra, 1, "original extra map must not be modified")
+
+	failing := &bridgev2.CustomEmoji{ID: "emoji2", Shortcode: "broken"}
+	emoji, extra = portal.ConvertCustomEmojiReaction(h.Ctx, intent, "", failing, nil)
+	assert.Equal(t, ":broken:", emoji)
+	assert.Nil(t, extra)
+}
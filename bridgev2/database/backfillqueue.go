@@ -14,6 +14,7 @@ import (
 	"go.mau.fi/util/dbutil"
 
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 )
 
 type BackfillTaskQuery struct {
@@ -33,6 +34,12 @@ type BackfillTask struct {
 	DispatchedAt      time.Time
 	CompletedAt       time.Time
 	NextDispatchMinTS time.Time
+	// The root event of the thread that old messages are sent into when batch sending isn't available.
+	HistoryThreadRoot id.EventID
+	// If true, the backfill queue will skip this task until it's resumed.
+	Paused bool
+	// Number of batches to backfill even if the configured maximum has been reached.
+	ExtraBatches int
 }
 
 var BackfillNextDispatchNever = time.Unix(0, (1<<63)-1)
@@ -56,8 +63,9 @@ const (
 	upsertBackfillQueueQuery = `
 		INSERT INTO backfill_task (
 			bridge_id, portal_id, portal_receiver, user_login_id, batch_count, is_done, cursor,
-			oldest_message_id, dispatched_at, completed_at, next_dispatch_min_ts
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			oldest_message_id, dispatched_at, completed_at, next_dispatch_min_ts, history_thread_root,
+			paused, extra_batches
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		ON CONFLICT (bridge_id, portal_id, portal_receiver) DO UPDATE
 			SET user_login_id=excluded.user_login_id,
 				batch_count=excluded.batch_count,
@@ -66,7 +74,10 @@ const (
 				oldest_message_id=excluded.oldest_message_id,
 				dispatched_at=excluded.dispatched_at,
 				completed_at=excluded.completed_at,
-				next_dispatch_min_ts=excluded.next_dispatch_min_ts
+				next_dispatch_min_ts=excluded.next_dispatch_min_ts,
+				history_thread_root=excluded.history_thread_root,
+				paused=excluded.paused,
+				extra_batches=excluded.extra_batches
 	`
 	markBackfillDispatchedQuery = `
 		UPDATE backfill_task SET dispatched_at=$4, completed_at=NULL, next_dispatch_min_ts=$5
@@ -75,17 +86,77 @@ const (
 	updateBackfillQueueQuery = `
 		UPDATE backfill_task
 		SET user_login_id=$4, batch_count=$5, is_done=$6, cursor=$7, oldest_message_id=$8,
-			dispatched_at=$9, completed_at=$10, next_dispatch_min_ts=$11
+			dispatched_at=$9, completed_at=$10, next_dispatch_min_ts=$11, history_thread_root=$12,
+			paused=$13, extra_batches=$14
 		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
 	`
-	getNextBackfillQuery = `
+	// paused and extra_batches may be changed by commands while the task is running,
+	// so this only consumes the used extra batches instead of overwriting the column.
+	// Restarting clears dispatched_at, so the dispatched_at check makes restarts win over progress.
+	updateBackfillProgressQuery = `
+		UPDATE backfill_task
+		SET user_login_id=$4, batch_count=$5, is_done=($6 OR ($14 AND extra_batches <= $13)), cursor=$7,
+			oldest_message_id=$8, dispatched_at=$9, completed_at=$10, next_dispatch_min_ts=$11,
+			history_thread_root=$12,
+			extra_batches=CASE WHEN extra_batches > $13 THEN extra_batches - $13 ELSE 0 END
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3 AND dispatched_at = $9
+	`
+	getBackfillTaskBaseQuery = `
 		SELECT
 			bridge_id, portal_id, portal_receiver, user_login_id, batch_count, is_done,
-			cursor, oldest_message_id, dispatched_at, completed_at, next_dispatch_min_ts
+			cursor, oldest_message_id, dispatched_at, completed_at, next_dispatch_min_ts, history_thread_root,
+			paused, extra_batches
 		FROM backfill_task
-		WHERE bridge_id = $1 AND next_dispatch_min_ts < $2 AND is_done = false AND user_login_id <> ''
+	`
+	getNextBackfillQuery = getBackfillTaskBaseQuery + `
+		WHERE bridge_id = $1 AND next_dispatch_min_ts < $2 AND is_done = false AND paused = false AND user_login_id <> ''
 		ORDER BY next_dispatch_min_ts LIMIT 1
 	`
+	getAllBackfillTasksQuery = getBackfillTaskBaseQuery + `
+		WHERE bridge_id = $1
+		ORDER BY is_done, next_dispatch_min_ts
+	`
+	getAllBackfillTasksWithStatsQuery = `
+		SELECT
+			bt.bridge_id, bt.portal_id, bt.portal_receiver, bt.user_login_id, bt.batch_count, bt.is_done,
+			bt.cursor, bt.oldest_message_id, bt.dispatched_at, bt.completed_at, bt.next_dispatch_min_ts,
+			bt.history_thread_root, bt.paused, bt.extra_batches,
+			COALESCE(stats.message_count, 0), stats.oldest_message_ts
+		FROM backfill_task bt
+		LEFT JOIN (
+			SELECT room_id, room_receiver, COUNT(*) AS message_count, MIN(timestamp) AS oldest_message_ts
+			FROM message
+			WHERE bridge_id = $1
+			GROUP BY room_id, room_receiver
+		) stats ON stats.room_id = bt.portal_id AND stats.room_receiver = bt.portal_receiver
+		WHERE bt.bridge_id = $1
+		ORDER BY bt.is_done, bt.next_dispatch_min_ts
+	`
+	getBackfillTaskByPortalQuery = getBackfillTaskBaseQuery + `
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
+	setBackfillPausedQuery = `
+		UPDATE backfill_task SET paused=$4
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
+	prioritizeBackfillQuery = `
+		UPDATE backfill_task SET next_dispatch_min_ts=$4
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
+	restartBackfillQuery = `
+		UPDATE backfill_task
+		SET batch_count=-1, is_done=false, cursor=NULL, oldest_message_id=NULL, dispatched_at=NULL,
+			completed_at=NULL, next_dispatch_min_ts=$4, extra_batches=0
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
+	addBackfillExtraBatchesQuery = `
+		UPDATE backfill_task SET extra_batches=extra_batches+$4, is_done=false, next_dispatch_min_ts=$5
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
+	setBackfillHistoryThreadRootQuery = `
+		UPDATE backfill_task SET history_thread_root=$4
+		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
+	`
 	deleteBackfillQueueQuery = `
 		DELETE FROM backfill_task
 		WHERE bridge_id = $1 AND portal_id = $2 AND portal_receiver = $3
@@ -120,25 +191,122 @@ func (btq *BackfillTaskQuery) Update(ctx context.Context, bq *BackfillTask) erro
 	return btq.Exec(ctx, updateBackfillQueueQuery, bq.sqlVariables()...)
 }
 
+// UpdateProgress saves the progress of a finished backfill batch. Unlike [BackfillTaskQuery.Update],
+// it doesn't overwrite the paused flag, and it subtracts usedExtraBatches from the stored extra batch
+// count rather than replacing it, so changes made while the batch was running aren't lost.
+//
+// The task is marked as done if bq.IsDone is set, or if maxBatchesReached is set and there are
+// no extra batches left.
+//
+// The update is only applied if the task is still marked as dispatched at bq.DispatchedAt
+// (see [BackfillTaskQuery.MarkDispatched]). If the task was restarted while the batch was running,
+// the progress is discarded and false is returned.
+func (btq *BackfillTaskQuery) UpdateProgress(ctx context.Context, bq *BackfillTask, usedExtraBatches int, maxBatchesReached bool) (bool, error) {
+	ensureBridgeIDMatches(&bq.BridgeID, btq.BridgeID)
+	res, err := btq.GetDB().Exec(
+		ctx, updateBackfillProgressQuery,
+		bq.BridgeID, bq.PortalKey.ID, bq.PortalKey.Receiver, bq.UserLoginID, bq.BatchCount, bq.IsDone,
+		dbutil.StrPtr(bq.Cursor), dbutil.StrPtr(bq.OldestMessageID),
+		dbutil.ConvertedPtr(bq.DispatchedAt, time.Time.UnixNano),
+		dbutil.ConvertedPtr(bq.CompletedAt, time.Time.UnixNano),
+		bq.NextDispatchMinTS.UnixNano(), dbutil.StrPtr(bq.HistoryThreadRoot),
+		usedExtraBatches, maxBatchesReached,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
 func (btq *BackfillTaskQuery) GetNext(ctx context.Context) (*BackfillTask, error) {
 	return btq.QueryOne(ctx, getNextBackfillQuery, btq.BridgeID, time.Now().UnixNano())
 }
 
+func (btq *BackfillTaskQuery) GetAll(ctx context.Context) ([]*BackfillTask, error) {
+	return btq.QueryMany(ctx, getAllBackfillTasksQuery, btq.BridgeID)
+}
+
+// GetAllWithStats returns all backfill tasks along with statistics about the messages bridged in each portal.
+func (btq *BackfillTaskQuery) GetAllWithStats(ctx context.Context) ([]*BackfillTaskInfo, error) {
+	rows, err := btq.GetDB().Query(ctx, getAllBackfillTasksWithStatsQuery, btq.BridgeID)
+	return dbutil.NewRowIterWithError(rows, scanBackfillTaskInfo, err).AsList()
+}
+
+func (btq *BackfillTaskQuery) GetByPortal(ctx context.Context, portalKey networkid.PortalKey) (*BackfillTask, error) {
+	return btq.QueryOne(ctx, getBackfillTaskByPortalQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver)
+}
+
+func (btq *BackfillTaskQuery) SetPaused(ctx context.Context, portalKey networkid.PortalKey, paused bool) error {
+	return btq.Exec(ctx, setBackfillPausedQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver, paused)
+}
+
+// Prioritize makes the given task the next one to be dispatched by the backfill queue.
+func (btq *BackfillTaskQuery) Prioritize(ctx context.Context, portalKey networkid.PortalKey) error {
+	return btq.Exec(ctx, prioritizeBackfillQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver, 0)
+}
+
+// Restart resets the progress of the given task, so that backfilling starts over from the oldest bridged message.
+func (btq *BackfillTaskQuery) Restart(ctx context.Context, portalKey networkid.PortalKey) error {
+	return btq.Exec(ctx, restartBackfillQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver, time.Now().UnixNano())
+}
+
+// AddExtraBatches allows the given task to backfill more batches than the configured maximum
+// and schedules it to be dispatched immediately.
+func (btq *BackfillTaskQuery) AddExtraBatches(ctx context.Context, portalKey networkid.PortalKey, count int) error {
+	return btq.Exec(ctx, addBackfillExtraBatchesQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver, count, time.Now().UnixNano())
+}
+
+// SetHistoryThreadRoot saves the history thread root of the task without touching any other fields,
+// so that it's kept even if the batch that created the root fails.
+func (btq *BackfillTaskQuery) SetHistoryThreadRoot(ctx context.Context, bq *BackfillTask) error {
+	ensureBridgeIDMatches(&bq.BridgeID, btq.BridgeID)
+	return btq.Exec(ctx, setBackfillHistoryThreadRootQuery, bq.BridgeID, bq.PortalKey.ID, bq.PortalKey.Receiver, dbutil.StrPtr(bq.HistoryThreadRoot))
+}
+
 func (btq *BackfillTaskQuery) Delete(ctx context.Context, portalKey networkid.PortalKey) error {
 	return btq.Exec(ctx, deleteBackfillQueueQuery, btq.BridgeID, portalKey.ID, portalKey.Receiver)
 }
 
+// BackfillTaskInfo contains a backfill task along with statistics about the messages bridged in the portal.
+type BackfillTaskInfo struct {
+	*BackfillTask
+	MessageCount    int
+	OldestMessageTS time.Time
+}
+
+func scanBackfillTaskInfo(row dbutil.Scannable) (*BackfillTaskInfo, error) {
+	info := &BackfillTaskInfo{}
+	var oldestMessageTS sql.NullInt64
+	var err error
+	info.BackfillTask, err = (&BackfillTask{}).scan(row, &info.MessageCount, &oldestMessageTS)
+	if err != nil {
+		return nil, err
+	}
+	if oldestMessageTS.Valid {
+		info.OldestMessageTS = time.Unix(0, oldestMessageTS.Int64)
+	}
+	return info, nil
+}
+
 func (bt *BackfillTask) Scan(row dbutil.Scannable) (*BackfillTask, error) {
-	var cursor, oldestMessageID sql.NullString
+	return bt.scan(row)
+}
+
+func (bt *BackfillTask) scan(row dbutil.Scannable, extra ...any) (*BackfillTask, error) {
+	var cursor, oldestMessageID, historyThreadRoot sql.NullString
 	var dispatchedAt, completedAt, nextDispatchMinTS sql.NullInt64
-	err := row.Scan(
+	err := row.Scan(append([]any{
 		&bt.BridgeID, &bt.PortalKey.ID, &bt.PortalKey.Receiver, &bt.UserLoginID, &bt.BatchCount, &bt.IsDone,
-		&cursor, &oldestMessageID, &dispatchedAt, &completedAt, &nextDispatchMinTS)
+		&cursor, &oldestMessageID, &dispatchedAt, &completedAt, &nextDispatchMinTS, &historyThreadRoot,
+		&bt.Paused, &bt.ExtraBatches,
+	}, extra...)...)
 	if err != nil {
 		return nil, err
 	}
 	bt.Cursor = networkid.PaginationCursor(cursor.String)
 	bt.OldestMessageID = networkid.MessageID(oldestMessageID.String)
+	bt.HistoryThreadRoot = id.EventID(historyThreadRoot.String)
 	if dispatchedAt.Valid {
 		bt.DispatchedAt = time.Unix(0, dispatchedAt.Int64)
 	}
@@ -157,6 +325,7 @@ func (bt *BackfillTask) sqlVariables() []any {
 		dbutil.StrPtr(bt.Cursor), dbutil.StrPtr(bt.OldestMessageID),
 		dbutil.ConvertedPtr(bt.DispatchedAt, time.Time.UnixNano),
 		dbutil.ConvertedPtr(bt.CompletedAt, time.Time.UnixNano),
-		bt.NextDispatchMinTS.UnixNano(),
+		bt.NextDispatchMinTS.UnixNano(), dbutil.StrPtr(bt.HistoryThreadRoot),
+		bt.Paused, bt.ExtraBatches,
 	}
 }
@@ -0,0 +1,129 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"encoding/hex"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+type CustomEmojiQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*CustomEmoji]
+}
+
+type CustomEmoji struct {
+	BridgeID  networkid.BridgeID
+	ID        networkid.EmojiID
+	Shortcode string
+	MXC       id.ContentURIString
+}
+
+const (
+	getCustomEmojiBaseQuery = `
+		SELECT bridge_id, id, shortcode, mxc FROM custom_emoji
+	`
+	getCustomEmojiByIDQuery  = getCustomEmojiBaseQuery + `WHERE bridge_id=$1 AND id=$2`
+	getCustomEmojiByMXCQuery = getCustomEmojiBaseQuery + `WHERE bridge_id=$1 AND mxc=$2 LIMIT 1`
+	upsertCustomEmojiQuery   = `
+		INSERT INTO custom_emoji (bridge_id, id, shortcode, mxc)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (bridge_id, id) DO UPDATE SET shortcode=excluded.shortcode, mxc=excluded.mxc
+	`
+)
+
+func (ceq *CustomEmojiQuery) GetByID(ctx context.Context, emojiID networkid.EmojiID) (*CustomEmoji, error) {
+	return ceq.QueryOne(ctx, getCustomEmojiByIDQuery, ceq.BridgeID, emojiID)
+}
+
+func (ceq *CustomEmojiQuery) GetByMXC(ctx context.Context, mxc id.ContentURIString) (*CustomEmoji, error) {
+	return ceq.QueryOne(ctx, getCustomEmojiByMXCQuery, ceq.BridgeID, mxc)
+}
+
+func (ceq *CustomEmojiQuery) Upsert(ctx context.Context, emoji *CustomEmoji) error {
+	ensureBridgeIDMatches(&emoji.BridgeID, ceq.BridgeID)
+	return ceq.Exec(ctx, upsertCustomEmojiQuery, emoji.sqlVariables()...)
+}
+
+func (ce *CustomEmoji) Scan(row dbutil.Scannable) (*CustomEmoji, error) {
+	err := row.Scan(&ce.BridgeID, &ce.ID, &ce.Shortcode, &ce.MXC)
+	if err != nil {
+		return nil, err
+	}
+	return ce, nil
+}
+
+func (ce *CustomEmoji) sqlVariables() []any {
+	return []any{ce.BridgeID, ce.ID, ce.Shortcode, ce.MXC}
+}
+
+type ImagePackQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*ImagePack]
+}
+
+type ImagePack struct {
+	BridgeID    networkid.BridgeID
+	Portal      networkid.PortalKey
+	ID          networkid.ImagePackID
+	ContentHash [32]byte
+}
+
+const (
+	getImagePackBaseQuery = `
+		SELECT bridge_id, portal_id, portal_receiver, id, content_hash FROM image_pack
+	`
+	getImagePackByIDQuery      = getImagePackBaseQuery + `WHERE bridge_id=$1 AND portal_id=$2 AND portal_receiver=$3 AND id=$4`
+	getImagePacksInPortalQuery = getImagePackBaseQuery + `WHERE bridge_id=$1 AND portal_id=$2 AND portal_receiver=$3`
+	upsertImagePackQuery       = `
+		INSERT INTO image_pack (bridge_id, portal_id, portal_receiver, id, content_hash)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (bridge_id, portal_id, portal_receiver, id) DO UPDATE SET content_hash=excluded.content_hash
+	`
+	deleteImagePackQuery = `
+		DELETE FROM image_pack WHERE bridge_id=$1 AND portal_id=$2 AND portal_receiver=$3 AND id=$4
+	`
+)
+
+func (ipq *ImagePackQuery) GetByID(ctx context.Context, portal networkid.PortalKey, packID networkid.ImagePackID) (*ImagePack, error) {
+	return ipq.QueryOne(ctx, getImagePackByIDQuery, ipq.BridgeID, portal.ID, portal.Receiver, packID)
+}
+
+func (ipq *ImagePackQuery) GetAllInPortal(ctx context.Context, portal networkid.PortalKey) ([]*ImagePack, error) {
+	return ipq.QueryMany(ctx, getImagePacksInPortalQuery, ipq.BridgeID, portal.ID, portal.Receiver)
+}
+
+func (ipq *ImagePackQuery) Upsert(ctx context.Context, pack *ImagePack) error {
+	ensureBridgeIDMatches(&pack.BridgeID, ipq.BridgeID)
+	return ipq.Exec(ctx, upsertImagePackQuery, pack.sqlVariables()...)
+}
+
+func (ipq *ImagePackQuery) Delete(ctx context.Context, portal networkid.PortalKey, packID networkid.ImagePackID) error {
+	return ipq.Exec(ctx, deleteImagePackQuery, ipq.BridgeID, portal.ID, portal.Receiver, packID)
+}
+
+func (ip *ImagePack) Scan(row dbutil.Scannable) (*ImagePack, error) {
+	var contentHash string
+	err := row.Scan(&ip.BridgeID, &ip.Portal.ID, &ip.Portal.Receiver, &ip.ID, &contentHash)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := hex.DecodeString(contentHash)
+	if len(data) == 32 {
+		ip.ContentHash = *(*[32]byte)(data)
+	}
+	return ip, nil
+}
+
+func (ip *ImagePack) sqlVariables() []any {
+	return []any{ip.BridgeID, ip.Portal.ID, ip.Portal.Receiver, ip.ID, hex.EncodeToString(ip.ContentHash[:])}
+}
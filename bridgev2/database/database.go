@@ -28,12 +28,17 @@ type Database struct {
 	Ghost               *GhostQuery
 	Message             *MessageQuery
 	DisappearingMessage *DisappearingMessageQuery
+	ScheduledMessage    *ScheduledMessageQuery
 	Reaction            *ReactionQuery
 	User                *UserQuery
 	UserLogin           *UserLoginQuery
 	UserPortal          *UserPortalQuery
 	BackfillTask        *BackfillTaskQuery
 	KV                  *KVQuery
+	CustomEmoji         *CustomEmojiQuery
+	ImagePack           *ImagePackQuery
+	PollOption          *PollOptionQuery
+	PollVote            *PollVoteQuery
 }
 
 type MetaMerger interface {
@@ -105,6 +110,12 @@ func New(bridgeID networkid.BridgeID, mt MetaTypes, db *dbutil.Database) *Databa
 				return &DisappearingMessage{}
 			}),
 		},
+		ScheduledMessage: &ScheduledMessageQuery{
+			BridgeID: bridgeID,
+			QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*ScheduledMessage]) *ScheduledMessage {
+				return &ScheduledMessage{}
+			}),
+		},
 		Reaction: &ReactionQuery{
 			BridgeID: bridgeID,
 			MetaType: mt.Reaction,
@@ -141,6 +152,30 @@ func New(bridgeID networkid.BridgeID, mt MetaTypes, db *dbutil.Database) *Databa
 			BridgeID: bridgeID,
 			Database: db,
 		},
+		CustomEmoji: &CustomEmojiQuery{
+			BridgeID: bridgeID,
+			QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*CustomEmoji]) *CustomEmoji {
+				return &CustomEmoji{}
+			}),
+		},
+		ImagePack: &ImagePackQuery{
+			BridgeID: bridgeID,
+			QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*ImagePack]) *ImagePack {
+				return &ImagePack{}
+			}),
+		},
+		PollOption: &PollOptionQuery{
+			BridgeID: bridgeID,
+			QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*PollOption]) *PollOption {
+				return &PollOption{}
+			}),
+		},
+		PollVote: &PollVoteQuery{
+			BridgeID: bridgeID,
+			QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*PollVote]) *PollVote {
+				return &PollVote{}
+			}),
+		},
 	}
 }
 
@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+type PollOptionQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*PollOption]
+}
+
+// PollOption maps a Matrix poll answer ID (m.id) to the option ID on the remote network.
+type PollOption struct {
+	BridgeID      networkid.BridgeID
+	Room          networkid.PortalKey
+	MessageID     networkid.MessageID
+	MessagePartID networkid.PartID
+	AnswerID      string
+	OptionID      networkid.PollOptionID
+}
+
+const (
+	getAllPollOptionsQuery = `
+		SELECT bridge_id, room_id, room_receiver, message_id, message_part_id, answer_id, option_id FROM poll_option
+		WHERE bridge_id=$1 AND room_receiver=$2 AND message_id=$3 AND message_part_id=$4
+	`
+	upsertPollOptionQuery = `
+		INSERT INTO poll_option (bridge_id, room_id, room_receiver, message_id, message_part_id, answer_id, option_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (bridge_id, room_receiver, message_id, message_part_id, answer_id) DO UPDATE SET option_id=excluded.option_id
+	`
+)
+
+func (poq *PollOptionQuery) GetAll(ctx context.Context, msg *Message) ([]*PollOption, error) {
+	return poq.QueryMany(ctx, getAllPollOptionsQuery, poq.BridgeID, msg.Room.Receiver, msg.ID, msg.PartID)
+}
+
+func (poq *PollOptionQuery) Put(ctx context.Context, msg *Message, options map[string]networkid.PollOptionID) error {
+	return poq.GetDB().DoTxn(ctx, nil, func(ctx context.Context) error {
+		for answerID, optionID := range options {
+			opt := &PollOption{
+				BridgeID:      poq.BridgeID,
+				Room:          msg.Room,
+				MessageID:     msg.ID,
+				MessagePartID: msg.PartID,
+				AnswerID:      answerID,
+				OptionID:      optionID,
+			}
+			err := poq.Exec(ctx, upsertPollOptionQuery, opt.sqlVariables()...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (po *PollOption) Scan(row dbutil.Scannable) (*PollOption, error) {
+	err := row.Scan(&po.BridgeID, &po.Room.ID, &po.Room.Receiver, &po.MessageID, &po.MessagePartID, &po.AnswerID, &po.OptionID)
+	if err != nil {
+		return nil, err
+	}
+	return po, nil
+}
+
+func (po *PollOption) sqlVariables() []any {
+	return []any{po.BridgeID, po.Room.ID, po.Room.Receiver, po.MessageID, po.MessagePartID, po.AnswerID, po.OptionID}
+}
+
+type PollVoteQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*PollVote]
+}
+
+// PollVote is the latest known vote of a single user in a poll.
+type PollVote struct {
+	BridgeID      networkid.BridgeID
+	Room          networkid.PortalKey
+	MessageID     networkid.MessageID
+	MessagePartID networkid.PartID
+	SenderID      networkid.UserID
+	OptionIDs     []networkid.PollOptionID
+	Timestamp     time.Time
+}
+
+const (
+	getPollVoteBaseQuery = `
+		SELECT bridge_id, room_id, room_receiver, message_id, message_part_id, sender_id, option_ids, timestamp FROM poll_vote
+	`
+	getAllPollVotesQuery = getPollVoteBaseQuery + `WHERE bridge_id=$1 AND room_receiver=$2 AND message_id=$3 AND message_part_id=$4`
+	upsertPollVoteQuery  = `
+		INSERT INTO poll_vote (bridge_id, room_id, room_receiver, message_id, message_part_id, sender_id, option_ids, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (bridge_id, room_receiver, message_id, message_part_id, sender_id)
+		DO UPDATE SET option_ids=excluded.option_ids, timestamp=excluded.timestamp
+	`
+)
+
+func (pvq *PollVoteQuery) GetAll(ctx context.Context, msg *Message) ([]*PollVote, error) {
+	return pvq.QueryMany(ctx, getAllPollVotesQuery, pvq.BridgeID, msg.Room.Receiver, msg.ID, msg.PartID)
+}
+
+func (pvq *PollVoteQuery) Upsert(ctx context.Context, vote *PollVote) error {
+	ensureBridgeIDMatches(&vote.BridgeID, pvq.BridgeID)
+	return pvq.Exec(ctx, upsertPollVoteQuery, vote.sqlVariables()...)
+}
+
+func (pv *PollVote) Scan(row dbutil.Scannable) (*PollVote, error) {
+	var timestamp int64
+	err := row.Scan(
+		&pv.BridgeID, &pv.Room.ID, &pv.Room.Receiver, &pv.MessageID, &pv.MessagePartID, &pv.SenderID,
+		dbutil.JSON{Data: &pv.OptionIDs}, &timestamp,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pv.Timestamp = time.Unix(0, timestamp)
+	return pv, nil
+}
+
+func (pv *PollVote) sqlVariables() []any {
+	if pv.OptionIDs == nil {
+		pv.OptionIDs = []networkid.PollOptionID{}
+	}
+	return []any{
+		pv.BridgeID, pv.Room.ID, pv.Room.Receiver, pv.MessageID, pv.MessagePartID, pv.SenderID,
+		dbutil.JSON{Data: pv.OptionIDs}, pv.Timestamp.UnixNano(),
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"go.mau.fi/util/dbutil"
 
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -54,7 +55,12 @@ type Portal struct {
 	InSpace      bool
 	RoomType     RoomType
 	Disappear    DisappearingSetting
-	Metadata     any
+
+	JoinRule          event.JoinRule
+	HistoryVisibility event.HistoryVisibility
+	GuestAccess       event.GuestAccess
+
+	Metadata any
 }
 
 const (
@@ -63,6 +69,7 @@ const (
 		       name, topic, avatar_id, avatar_hash, avatar_mxc,
 		       name_set, topic_set, avatar_set, name_is_custom, in_space,
 		       room_type, disappear_type, disappear_timer,
+		       join_rule, history_visibility, guest_access,
 		       metadata
 		FROM portal
 	`
@@ -83,10 +90,10 @@ const (
 			name, topic, avatar_id, avatar_hash, avatar_mxc,
 			name_set, avatar_set, topic_set, name_is_custom, in_space,
 			room_type, disappear_type, disappear_timer,
-			metadata, relay_bridge_id
+			metadata, join_rule, history_visibility, guest_access, relay_bridge_id
 		) VALUES (
 			$1, $2, $3, $4, $5, $6, cast($7 AS TEXT), $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
-			CASE WHEN cast($7 AS TEXT) IS NULL THEN NULL ELSE $1 END
+			$23, $24, $25, CASE WHEN cast($7 AS TEXT) IS NULL THEN NULL ELSE $1 END
 		)
 	`
 	updatePortalQuery = `
@@ -95,7 +102,8 @@ const (
 		    relay_login_id=cast($7 AS TEXT), relay_bridge_id=CASE WHEN cast($7 AS TEXT) IS NULL THEN NULL ELSE bridge_id END,
 		    other_user_id=$8, name=$9, topic=$10, avatar_id=$11, avatar_hash=$12, avatar_mxc=$13,
 		    name_set=$14, avatar_set=$15, topic_set=$16, name_is_custom=$17, in_space=$18,
-		    room_type=$19, disappear_type=$20, disappear_timer=$21, metadata=$22
+		    room_type=$19, disappear_type=$20, disappear_timer=$21, metadata=$22,
+		    join_rule=$23, history_visibility=$24, guest_access=$25
 		WHERE bridge_id=$1 AND id=$2 AND receiver=$3
 	`
 	deletePortalQuery = `
@@ -189,6 +197,7 @@ func (p *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
 		&p.Name, &p.Topic, &p.AvatarID, &avatarHash, &p.AvatarMXC,
 		&p.NameSet, &p.TopicSet, &p.AvatarSet, &p.NameIsCustom, &p.InSpace,
 		&p.RoomType, &disappearType, &disappearTimer,
+		&p.JoinRule, &p.HistoryVisibility, &p.GuestAccess,
 		dbutil.JSON{Data: p.Metadata},
 	)
 	if err != nil {
@@ -237,5 +246,6 @@ func (p *Portal) sqlVariables() []any {
 		p.NameSet, p.TopicSet, p.AvatarSet, p.NameIsCustom, p.InSpace,
 		p.RoomType, dbutil.StrPtr(p.Disappear.Type), dbutil.NumPtr(p.Disappear.Timer),
 		dbutil.JSON{Data: p.Metadata},
+		p.JoinRule, p.HistoryVisibility, p.GuestAccess,
 	}
 }
@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type ScheduledMessageQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*ScheduledMessage]
+}
+
+// ScheduledMessage is a Matrix message that the bridge holds until its scheduled send time,
+// because the remote network doesn't support scheduling messages natively.
+type ScheduledMessage struct {
+	BridgeID networkid.BridgeID
+	RoomID   id.RoomID
+	EventID  id.EventID
+	Sender   id.UserID
+	SendAt   time.Time
+	Event    *event.Event
+}
+
+const (
+	insertScheduledMessageQuery = `
+		INSERT INTO scheduled_message (bridge_id, mx_room, mxid, sender, send_at, event)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (bridge_id, mxid) DO UPDATE SET send_at=excluded.send_at, event=excluded.event
+	`
+	getUpcomingScheduledMessagesQuery = `
+		SELECT bridge_id, mx_room, mxid, sender, send_at, event
+		FROM scheduled_message WHERE bridge_id=$1 AND send_at < $2
+		ORDER BY send_at
+	`
+	getScheduledMessageQuery = `
+		SELECT bridge_id, mx_room, mxid, sender, send_at, event
+		FROM scheduled_message WHERE bridge_id=$1 AND mxid=$2
+	`
+	getScheduledMessagesByRoomQuery = `
+		SELECT bridge_id, mx_room, mxid, sender, send_at, event
+		FROM scheduled_message WHERE bridge_id=$1 AND mx_room=$2
+		ORDER BY send_at
+	`
+	moveScheduledMessagesToRoomQuery = `
+		UPDATE scheduled_message SET mx_room=$3 WHERE bridge_id=$1 AND mx_room=$2
+	`
+	claimScheduledMessageQuery = `
+		DELETE FROM scheduled_message WHERE bridge_id=$1 AND mxid=$2
+		RETURNING bridge_id, mx_room, mxid, sender, send_at, event
+	`
+)
+
+func (smq *ScheduledMessageQuery) Put(ctx context.Context, sm *ScheduledMessage) error {
+	ensureBridgeIDMatches(&sm.BridgeID, smq.BridgeID)
+	return smq.Exec(ctx, insertScheduledMessageQuery, sm.sqlVariables()...)
+}
+
+// GetUpcoming returns all scheduled messages that should be sent within the given duration, including overdue ones.
+func (smq *ScheduledMessageQuery) GetUpcoming(ctx context.Context, duration time.Duration) ([]*ScheduledMessage, error) {
+	return smq.QueryMany(ctx, getUpcomingScheduledMessagesQuery, smq.BridgeID, time.Now().Add(duration).UnixNano())
+}
+
+func (smq *ScheduledMessageQuery) Get(ctx context.Context, eventID id.EventID) (*ScheduledMessage, error) {
+	return smq.QueryOne(ctx, getScheduledMessageQuery, smq.BridgeID, eventID)
+}
+
+func (smq *ScheduledMessageQuery) GetByRoom(ctx context.Context, roomID id.RoomID) ([]*ScheduledMessage, error) {
+	return smq.QueryMany(ctx, getScheduledMessagesByRoomQuery, smq.BridgeID, roomID)
+}
+
+// MoveToRoom moves all scheduled messages in the old room to the new room, e.g. after the room was upgraded.
+func (smq *ScheduledMessageQuery) MoveToRoom(ctx context.Context, oldRoomID, newRoomID id.RoomID) error {
+	return smq.Exec(ctx, moveScheduledMessagesToRoomQuery, smq.BridgeID, oldRoomID, newRoomID)
+}
+
+// Claim deletes the scheduled message with the given event ID and returns it.
+// It returns nil if the message doesn't exist, e.g. because it was already sent or cancelled,
+// which means only one caller can ever claim a given message.
+func (smq *ScheduledMessageQuery) Claim(ctx context.Context, eventID id.EventID) (*ScheduledMessage, error) {
+	return smq.QueryOne(ctx, claimScheduledMessageQuery, smq.BridgeID, eventID)
+}
+
+func (sm *ScheduledMessage) Scan(row dbutil.Scannable) (*ScheduledMessage, error) {
+	var sendAt int64
+	sm.Event = &event.Event{}
+	err := row.Scan(&sm.BridgeID, &sm.RoomID, &sm.EventID, &sm.Sender, &sendAt, dbutil.JSON{Data: sm.Event})
+	if err != nil {
+		return nil, err
+	}
+	sm.SendAt = time.Unix(0, sendAt)
+	return sm, nil
+}
+
+func (sm *ScheduledMessage) sqlVariables() []any {
+	return []any{sm.BridgeID, sm.RoomID, sm.EventID, sm.Sender, sm.SendAt.UnixNano(), dbutil.JSON{Data: sm.Event}}
+}
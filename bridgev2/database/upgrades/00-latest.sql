@@ -1,4 +1,4 @@
--- v0 -> v18 (compatible with v9+): Latest revision
+-- v0 -> v24 (compatible with v9+): Latest revision
 CREATE TABLE "user" (
 	bridge_id       TEXT NOT NULL,
 	mxid            TEXT NOT NULL,
@@ -25,33 +25,36 @@ CREATE TABLE user_login (
 );
 
 CREATE TABLE portal (
-	bridge_id       TEXT    NOT NULL,
-	id              TEXT    NOT NULL,
-	receiver        TEXT    NOT NULL,
-	mxid            TEXT,
-
-	parent_id       TEXT,
-	parent_receiver TEXT    NOT NULL DEFAULT '',
-
-	relay_bridge_id TEXT,
-	relay_login_id  TEXT,
-
-	other_user_id   TEXT,
-
-	name            TEXT    NOT NULL,
-	topic           TEXT    NOT NULL,
-	avatar_id       TEXT    NOT NULL,
-	avatar_hash     TEXT    NOT NULL,
-	avatar_mxc      TEXT    NOT NULL,
-	name_set        BOOLEAN NOT NULL,
-	avatar_set      BOOLEAN NOT NULL,
-	topic_set       BOOLEAN NOT NULL,
-	name_is_custom  BOOLEAN NOT NULL DEFAULT false,
-	in_space        BOOLEAN NOT NULL,
-	room_type       TEXT    NOT NULL,
-	disappear_type  TEXT,
-	disappear_timer BIGINT,
-	metadata        jsonb   NOT NULL,
+	bridge_id          TEXT    NOT NULL,
+	id                 TEXT    NOT NULL,
+	receiver           TEXT    NOT NULL,
+	mxid               TEXT,
+
+	parent_id          TEXT,
+	parent_receiver    TEXT    NOT NULL DEFAULT '',
+
+	relay_bridge_id    TEXT,
+	relay_login_id     TEXT,
+
+	other_user_id      TEXT,
+
+	name               TEXT    NOT NULL,
+	topic              TEXT    NOT NULL,
+	avatar_id          TEXT    NOT NULL,
+	avatar_hash        TEXT    NOT NULL,
+	avatar_mxc         TEXT    NOT NULL,
+	name_set           BOOLEAN NOT NULL,
+	avatar_set         BOOLEAN NOT NULL,
+	topic_set          BOOLEAN NOT NULL,
+	name_is_custom     BOOLEAN NOT NULL DEFAULT false,
+	in_space           BOOLEAN NOT NULL,
+	room_type          TEXT    NOT NULL,
+	disappear_type     TEXT,
+	disappear_timer    BIGINT,
+	join_rule          TEXT    NOT NULL DEFAULT '',
+	history_visibility TEXT    NOT NULL DEFAULT '',
+	guest_access       TEXT    NOT NULL DEFAULT '',
+	metadata           jsonb   NOT NULL,
 
 	PRIMARY KEY (bridge_id, id, receiver),
 	CONSTRAINT portal_parent_fkey FOREIGN KEY (bridge_id, parent_id, parent_receiver)
@@ -129,6 +132,18 @@ CREATE TABLE disappearing_message (
 	PRIMARY KEY (bridge_id, mxid)
 );
 
+CREATE TABLE scheduled_message (
+	bridge_id TEXT   NOT NULL,
+	mx_room   TEXT   NOT NULL,
+	mxid      TEXT   NOT NULL,
+	sender    TEXT   NOT NULL,
+	send_at   BIGINT NOT NULL,
+	event     jsonb  NOT NULL,
+
+	PRIMARY KEY (bridge_id, mxid)
+);
+CREATE INDEX scheduled_message_send_at_idx ON scheduled_message (bridge_id, send_at);
+
 CREATE TABLE reaction (
 	bridge_id       TEXT   NOT NULL,
 	message_id      TEXT   NOT NULL,
@@ -192,6 +207,9 @@ CREATE TABLE backfill_task (
 	dispatched_at        BIGINT,
 	completed_at         BIGINT,
 	next_dispatch_min_ts BIGINT  NOT NULL,
+	history_thread_root  TEXT,
+	paused               BOOLEAN NOT NULL DEFAULT false,
+	extra_batches        INTEGER NOT NULL DEFAULT 0,
 
 	PRIMARY KEY (bridge_id, portal_id, portal_receiver),
 	CONSTRAINT backfill_queue_portal_fkey FOREIGN KEY (bridge_id, portal_id, portal_receiver)
@@ -206,3 +224,66 @@ CREATE TABLE kv_store (
 
 	PRIMARY KEY (bridge_id, key)
 );
+
+CREATE TABLE custom_emoji (
+	bridge_id TEXT NOT NULL,
+	id        TEXT NOT NULL,
+	shortcode TEXT NOT NULL,
+	mxc       TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, id)
+);
+CREATE INDEX custom_emoji_mxc_idx ON custom_emoji (bridge_id, mxc);
+
+CREATE TABLE image_pack (
+	bridge_id       TEXT NOT NULL,
+	portal_id       TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL,
+	id              TEXT NOT NULL,
+	content_hash    TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, portal_id, portal_receiver, id),
+	CONSTRAINT image_pack_portal_fkey FOREIGN KEY (bridge_id, portal_id, portal_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE poll_option (
+	bridge_id       TEXT NOT NULL,
+	room_id         TEXT NOT NULL,
+	room_receiver   TEXT NOT NULL,
+	message_id      TEXT NOT NULL,
+	message_part_id TEXT NOT NULL,
+	answer_id       TEXT NOT NULL,
+	option_id       TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, room_receiver, message_id, message_part_id, answer_id),
+	CONSTRAINT poll_option_room_fkey FOREIGN KEY (bridge_id, room_id, room_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_option_message_fkey FOREIGN KEY (bridge_id, room_receiver, message_id, message_part_id)
+		REFERENCES message (bridge_id, room_receiver, id, part_id)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE poll_vote (
+	bridge_id       TEXT   NOT NULL,
+	room_id         TEXT   NOT NULL,
+	room_receiver   TEXT   NOT NULL,
+	message_id      TEXT   NOT NULL,
+	message_part_id TEXT   NOT NULL,
+	sender_id       TEXT   NOT NULL,
+	option_ids      jsonb  NOT NULL,
+	timestamp       BIGINT NOT NULL,
+
+	PRIMARY KEY (bridge_id, room_receiver, message_id, message_part_id, sender_id),
+	CONSTRAINT poll_vote_room_fkey FOREIGN KEY (bridge_id, room_id, room_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_vote_message_fkey FOREIGN KEY (bridge_id, room_receiver, message_id, message_part_id)
+		REFERENCES message (bridge_id, room_receiver, id, part_id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_vote_sender_fkey FOREIGN KEY (bridge_id, sender_id)
+		REFERENCES ghost (bridge_id, id)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
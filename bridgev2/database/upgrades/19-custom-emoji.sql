@@ -0,0 +1,23 @@
+-- v19 (compatible with v9+): Add custom emoji and image pack tables
+CREATE TABLE custom_emoji (
+	bridge_id TEXT NOT NULL,
+	id        TEXT NOT NULL,
+	shortcode TEXT NOT NULL,
+	mxc       TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, id)
+);
+CREATE INDEX custom_emoji_mxc_idx ON custom_emoji (bridge_id, mxc);
+
+CREATE TABLE image_pack (
+	bridge_id       TEXT NOT NULL,
+	portal_id       TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL,
+	id              TEXT NOT NULL,
+	content_hash    TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, portal_id, portal_receiver, id),
+	CONSTRAINT image_pack_portal_fkey FOREIGN KEY (bridge_id, portal_id, portal_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,40 @@
+-- v20 (compatible with v9+): Add poll option and vote tables
+CREATE TABLE poll_option (
+	bridge_id       TEXT NOT NULL,
+	room_id         TEXT NOT NULL,
+	room_receiver   TEXT NOT NULL,
+	message_id      TEXT NOT NULL,
+	message_part_id TEXT NOT NULL,
+	answer_id       TEXT NOT NULL,
+	option_id       TEXT NOT NULL,
+
+	PRIMARY KEY (bridge_id, room_receiver, message_id, message_part_id, answer_id),
+	CONSTRAINT poll_option_room_fkey FOREIGN KEY (bridge_id, room_id, room_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_option_message_fkey FOREIGN KEY (bridge_id, room_receiver, message_id, message_part_id)
+		REFERENCES message (bridge_id, room_receiver, id, part_id)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE poll_vote (
+	bridge_id       TEXT   NOT NULL,
+	room_id         TEXT   NOT NULL,
+	room_receiver   TEXT   NOT NULL,
+	message_id      TEXT   NOT NULL,
+	message_part_id TEXT   NOT NULL,
+	sender_id       TEXT   NOT NULL,
+	option_ids      jsonb  NOT NULL,
+	timestamp       BIGINT NOT NULL,
+
+	PRIMARY KEY (bridge_id, room_receiver, message_id, message_part_id, sender_id),
+	CONSTRAINT poll_vote_room_fkey FOREIGN KEY (bridge_id, room_id, room_receiver)
+		REFERENCES portal (bridge_id, id, receiver)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_vote_message_fkey FOREIGN KEY (bridge_id, room_receiver, message_id, message_part_id)
+		REFERENCES message (bridge_id, room_receiver, id, part_id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT poll_vote_sender_fkey FOREIGN KEY (bridge_id, sender_id)
+		REFERENCES ghost (bridge_id, id)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,4 @@
+-- v21 (compatible with v9+): Store room settings of portals
+ALTER TABLE portal ADD COLUMN join_rule TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN history_visibility TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN guest_access TEXT NOT NULL DEFAULT '';
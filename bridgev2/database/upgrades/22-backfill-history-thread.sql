@@ -0,0 +1,2 @@
+-- v22 (compatible with v9+): Store history thread root for legacy backfill
+ALTER TABLE backfill_task ADD COLUMN history_thread_root TEXT;
@@ -0,0 +1,3 @@
+-- v23 (compatible with v9+): Add manual controls for backfill tasks
+ALTER TABLE backfill_task ADD COLUMN paused BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE backfill_task ADD COLUMN extra_batches INTEGER NOT NULL DEFAULT 0;
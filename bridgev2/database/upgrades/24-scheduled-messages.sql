@@ -0,0 +1,12 @@
+-- v24 (compatible with v9+): Add table for scheduled messages
+CREATE TABLE scheduled_message (
+	bridge_id TEXT   NOT NULL,
+	mx_room   TEXT   NOT NULL,
+	mxid      TEXT   NOT NULL,
+	sender    TEXT   NOT NULL,
+	send_at   BIGINT NOT NULL,
+	event     jsonb  NOT NULL,
+
+	PRIMARY KEY (bridge_id, mxid)
+);
+CREATE INDEX scheduled_message_send_at_idx ON scheduled_message (bridge_id, send_at);
@@ -33,8 +33,9 @@ const (
 	getUserBaseQuery = `
 		SELECT bridge_id, mxid, management_room, access_token FROM "user"
 	`
-	getUserByMXIDQuery = getUserBaseQuery + `WHERE bridge_id=$1 AND mxid=$2`
-	insertUserQuery    = `
+	getUserByMXIDQuery                 = getUserBaseQuery + `WHERE bridge_id=$1 AND mxid=$2`
+	getAllUsersWithManagementRoomQuery = getUserBaseQuery + `WHERE bridge_id=$1 AND management_room IS NOT NULL`
+	insertUserQuery                    = `
 		INSERT INTO "user" (bridge_id, mxid, management_room, access_token)
 		VALUES ($1, $2, $3, $4)
 	`
@@ -48,6 +49,10 @@ func (uq *UserQuery) GetByMXID(ctx context.Context, userID id.UserID) (*User, er
 	return uq.QueryOne(ctx, getUserByMXIDQuery, uq.BridgeID, userID)
 }
 
+func (uq *UserQuery) GetAllWithManagementRoom(ctx context.Context) ([]*User, error) {
+	return uq.QueryMany(ctx, getAllUsersWithManagementRoomQuery, uq.BridgeID)
+}
+
 func (uq *UserQuery) Insert(ctx context.Context, user *User) error {
 	ensureBridgeIDMatches(&user.BridgeID, uq.BridgeID)
 	return uq.Exec(ctx, insertUserQuery, user.sqlVariables()...)
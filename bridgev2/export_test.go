@@ -0,0 +1,27 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+// This file exports internals for the external tests, which use the bridgetest harness.
+
+func (portal *Portal) ConvertCustomEmojiReaction(ctx context.Context, intent MatrixAPI, emoji string, customEmoji *CustomEmoji, extra map[string]any) (string, map[string]any) {
+	return portal.convertCustomEmojiReaction(ctx, intent, emoji, customEmoji, extra)
+}
+
+func (br *Bridge) ActuallyDoBackfillTask(ctx context.Context, task *database.BackfillTask) (bool, bool, error) {
+	return br.actuallyDoBackfillTask(ctx, task)
+}
+
+func (br *Bridge) IsBackfillQueueRunning() bool {
+	return br.backfillQueueRunning.Load()
+}
@@ -246,7 +246,7 @@ func (ghost *Ghost) UpdateInfoIfNecessary(ctx context.Context, source *UserLogin
 }
 
 func (ghost *Ghost) updateDMPortals(ctx context.Context) {
-	if !ghost.Bridge.Config.PrivateChatPortalMeta {
+	if !ghost.Bridge.GetConfig().PrivateChatPortalMeta {
 		return
 	}
 	dmPortals, err := ghost.Bridge.GetDMPortalsWith(ctx, ghost.ID)
@@ -22,7 +22,7 @@ var CommandLoginMatrix = &commands.FullHandler{
 }
 
 func fnLoginMatrix(ce *commands.Event) {
-	if !ce.User.Permissions.DoublePuppet {
+	if !ce.User.GetPermissions().DoublePuppet {
 		ce.Reply("You don't have permission to manage double puppeting.")
 		return
 	}
@@ -77,7 +77,7 @@ var CommandLogoutMatrix = &commands.FullHandler{
 }
 
 func fnLogoutMatrix(ce *commands.Event) {
-	if !ce.User.Permissions.DoublePuppet {
+	if !ce.User.GetPermissions().DoublePuppet {
 		ce.Reply("You don't have permission to manage double puppeting.")
 		return
 	}
@@ -13,6 +13,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
@@ -32,6 +34,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/sqlinbox"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
@@ -48,6 +51,7 @@ type Crypto interface {
 	HandleMemberEvent(context.Context, *event.Event)
 	Decrypt(context.Context, *event.Event) (*event.Event, error)
 	Encrypt(context.Context, id.RoomID, event.Type, *event.Content) error
+	EncryptAs(context.Context, id.UserID, id.RoomID, event.Type, *event.Content) error
 	WaitForSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, time.Duration) bool
 	RequestSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, id.UserID, id.DeviceID)
 	ResetSession(context.Context, id.RoomID)
@@ -63,6 +67,7 @@ type Connector struct {
 	AS           *appservice.AppService
 	Bot          *appservice.IntentAPI
 	StateStore   *sqlstatestore.SQLStateStore
+	Inbox        *sqlinbox.SQLInbox
 	Crypto       Crypto
 	Log          *zerolog.Logger
 	Config       *bridgeconfig.Config
@@ -86,6 +91,8 @@ type Connector struct {
 
 	EventProcessor *appservice.EventProcessor
 
+	metricsServer *http.Server
+
 	userIDRegex *regexp.Regexp
 
 	Websocket                      bool
@@ -97,6 +104,10 @@ type Connector struct {
 	stopping                       bool
 	hasSentAnyStates               bool
 	OnWebsocketReplaced            func()
+	wsMux                          *appservice.WebsocketMultiplexer
+
+	host       *BridgeHost
+	hostQueues *hostQueues
 }
 
 var (
@@ -127,6 +138,12 @@ func (br *Connector) Init(bridge *bridgev2.Bridge) {
 	br.AS = br.Config.MakeAppService()
 	br.AS.Log = bridge.Log
 	br.AS.StateStore = br.StateStore
+	br.AS.ThirdPartyHandler = &thirdPartyHandler{br: br}
+	// Hosted bridges don't receive transactions themselves, the bridge host has the inbox instead
+	if br.Config.AppService.DurableTransactions && br.host == nil {
+		br.Inbox = sqlinbox.NewSQLInbox(bridge.DB.Database, dbutil.ZeroLogger(br.Log.With().Str("db_section", "matrix_txn_inbox").Logger()))
+		br.AS.Inbox = br.Inbox
+	}
 	br.EventProcessor = appservice.NewEventProcessor(br.AS)
 	if !br.Config.AppService.AsyncTransactions {
 		br.EventProcessor.ExecMode = appservice.Sync
@@ -138,6 +155,17 @@ func (br *Connector) Init(bridge *bridgev2.Bridge) {
 	br.EventProcessor.On(event.EventSticker, br.handleRoomEvent)
 	br.EventProcessor.On(event.EventUnstablePollStart, br.handleRoomEvent)
 	br.EventProcessor.On(event.EventUnstablePollResponse, br.handleRoomEvent)
+	br.EventProcessor.On(event.EventUnstablePollEnd, br.handleRoomEvent)
+	br.EventProcessor.On(event.EventPollStart, br.handleRoomEvent)
+	br.EventProcessor.On(event.EventPollResponse, br.handleRoomEvent)
+	br.EventProcessor.On(event.EventPollEnd, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallInvite, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallCandidates, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallAnswer, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallReject, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallSelectAnswer, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallNegotiate, br.handleRoomEvent)
+	br.EventProcessor.On(event.CallHangup, br.handleRoomEvent)
 	br.EventProcessor.On(event.EventReaction, br.handleRoomEvent)
 	br.EventProcessor.On(event.EventRedaction, br.handleRoomEvent)
 	br.EventProcessor.On(event.EventEncrypted, br.handleEncryptedEvent)
@@ -145,7 +173,11 @@ func (br *Connector) Init(bridge *bridgev2.Bridge) {
 	br.EventProcessor.On(event.StatePowerLevels, br.handleRoomEvent)
 	br.EventProcessor.On(event.StateRoomName, br.handleRoomEvent)
 	br.EventProcessor.On(event.StateRoomAvatar, br.handleRoomEvent)
+	br.EventProcessor.On(event.StateJoinRules, br.handleRoomEvent)
+	br.EventProcessor.On(event.StateHistoryVisibility, br.handleRoomEvent)
+	br.EventProcessor.On(event.StateGuestAccess, br.handleRoomEvent)
 	br.EventProcessor.On(event.StateTopic, br.handleRoomEvent)
+	br.EventProcessor.On(event.StateTombstone, br.handleRoomEvent)
 	br.EventProcessor.On(event.EphemeralEventReceipt, br.handleEphemeralEvent)
 	br.EventProcessor.On(event.EphemeralEventTyping, br.handleEphemeralEvent)
 	br.Bot = br.AS.BotIntent()
@@ -169,11 +201,26 @@ func (br *Connector) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	err = br.initMetrics()
+	if err != nil {
+		return err
+	}
 	err = br.StateStore.Upgrade(ctx)
 	if err != nil {
 		return bridgev2.DBUpgradeError{Section: "matrix_state", Err: err}
 	}
-	if br.Config.Homeserver.Websocket || len(br.Config.Homeserver.WSProxy) > 0 {
+	if br.Inbox != nil {
+		err = br.Inbox.Upgrade(ctx)
+		if err != nil {
+			return bridgev2.DBUpgradeError{Section: "matrix_txn_inbox", Err: err}
+		}
+		// The listener has to be started before the connection check below so the homeserver can ping it,
+		// but new transactions must not be handled before the inbox has been replayed.
+		br.AS.HoldTransactionsForReplay()
+	}
+	if br.host != nil {
+		br.Log.Debug().Msg("Using shared appservice listener of bridge host")
+	} else if br.wsMux != nil || br.Config.Homeserver.Websocket || len(br.Config.Homeserver.WSProxy) > 0 {
 		br.Websocket = true
 		br.Log.Debug().Msg("Starting appservice websocket")
 		var wg sync.WaitGroup
@@ -199,6 +246,10 @@ func (br *Connector) Start(ctx context.Context) error {
 		}
 	}
 	br.EventProcessor.Start(ctx)
+	err = br.AS.ReplayInbox(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replay transaction inbox: %w", err)
+	}
 	go br.UpdateBotProfile(ctx)
 	if br.Crypto != nil {
 		go br.Crypto.Start()
@@ -208,13 +259,47 @@ func (br *Connector) Start(ctx context.Context) error {
 		br.deterministicEventIDServer = strings.TrimPrefix(parsed.Hostname(), "www.")
 	}
 	br.AS.Ready = true
-	if br.Websocket && br.Config.Homeserver.WSPingInterval > 0 {
+	if br.Websocket && br.wsMux == nil && br.Config.Homeserver.WSPingInterval > 0 {
 		br.wsStopPinger = make(chan struct{}, 1)
 		go br.websocketServerPinger()
 	}
 	return nil
 }
 
+func (br *Connector) initMetrics() error {
+	if !br.Config.Metrics.Enabled {
+		return nil
+	}
+	br.Bridge.Metrics = bridgev2.NewMetrics(br.Bridge)
+	if br.AS.RateLimiter != nil && br.host == nil {
+		br.Bridge.Metrics.TrackRateLimiter(br.AS.RateLimiter)
+	}
+	if br.Config.Metrics.ServeOnAppservice {
+		br.AS.Router.Path("/metrics").Methods(http.MethodGet).Handler(br.Bridge.Metrics.Handler())
+	}
+	if br.Config.Metrics.Listen == "" {
+		if !br.Config.Metrics.ServeOnAppservice {
+			br.Log.Warn().Msg("Metrics are enabled, but neither metrics.serve_on_appservice nor metrics.listen is set")
+		}
+		return nil
+	}
+	listener, err := net.Listen("tcp", br.Config.Metrics.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener: %w", err)
+	}
+	router := http.NewServeMux()
+	router.Handle("GET /metrics", br.Bridge.Metrics.Handler())
+	br.metricsServer = &http.Server{Handler: router}
+	br.Log.Info().Str("address", listener.Addr().String()).Msg("Starting metrics listener")
+	go func() {
+		err := br.metricsServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			br.Log.Err(err).Msg("Error in metrics listener")
+		}
+	}()
+	return nil
+}
+
 func (br *Connector) GetPublicAddress() string {
 	if br.Config.AppService.PublicAddress == "https://bridge.example.com" {
 		return ""
@@ -236,10 +321,19 @@ func (br *Connector) GetCapabilities() *bridgev2.MatrixCapabilities {
 func (br *Connector) Stop() {
 	br.stopping = true
 	br.AS.Stop()
+	if br.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = br.metricsServer.Shutdown(ctx)
+		cancel()
+	}
 	br.EventProcessor.Stop()
 	if br.Crypto != nil {
 		br.Crypto.Stop()
 	}
+	// The rate limiter of hosted bridges belongs to the bridge host
+	if br.AS.RateLimiter != nil && br.host == nil {
+		br.AS.RateLimiter.Stop()
+	}
 }
 
 var MinSpecVersion = mautrix.SpecV14
@@ -587,6 +681,7 @@ func (br *Connector) BatchSend(ctx context.Context, roomID id.RoomID, req *mautr
 			if evt.Type != event.EventEncrypted {
 				err = br.Crypto.Encrypt(ctx, roomID, evt.Type, &evt.Content)
 				if err != nil {
+					br.Bridge.Metrics.TrackEncryptionFailure()
 					return nil, err
 				}
 				evt.Type = event.EventEncrypted
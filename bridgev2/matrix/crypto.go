@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,6 +48,10 @@ type CryptoHelper struct {
 	store  *SQLCryptoStore
 	log    *zerolog.Logger
 
+	// router is only set if ghost devices are enabled
+	router    *crypto.MachineRouter
+	ghostLock sync.Mutex
+
 	lock       sync.RWMutex
 	syncDone   sync.WaitGroup
 	cancelSync func()
@@ -95,21 +100,15 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 	helper.log.Debug().
 		Str("device_id", helper.client.DeviceID.String()).
 		Msg("Logged in as bridge bot")
-	helper.mach = crypto.NewOlmMachine(helper.client, helper.log, helper.store, helper.bridge.StateStore)
-	helper.mach.DisableSharedGroupSessionTracking = true
-	helper.mach.AllowKeyShare = helper.allowKeyShare
-
+	helper.mach = helper.newMachine(helper.client, helper.log, helper.store)
 	encryptionConfig := helper.bridge.Config.Encryption
-	helper.mach.SendKeysMinTrust = encryptionConfig.VerificationLevels.Receive
-	helper.mach.PlaintextMentions = encryptionConfig.PlaintextMentions
-
-	helper.mach.DeleteOutboundKeysOnAck = encryptionConfig.DeleteKeys.DeleteOutboundOnAck
-	helper.mach.DontStoreOutboundKeys = encryptionConfig.DeleteKeys.DontStoreOutbound
-	helper.mach.RatchetKeysOnDecrypt = encryptionConfig.DeleteKeys.RatchetOnDecrypt
-	helper.mach.DeleteFullyUsedKeysOnDecrypt = encryptionConfig.DeleteKeys.DeleteFullyUsedOnDecrypt
-	helper.mach.DeletePreviousKeysOnReceive = encryptionConfig.DeleteKeys.DeletePrevOnNewSession
-	helper.mach.DeleteKeysOnDeviceDelete = encryptionConfig.DeleteKeys.DeleteOnDeviceDelete
-	helper.mach.DisableDeviceChangeKeyRotation = encryptionConfig.Rotation.DisableDeviceChangeKeyRotation
+	if encryptionConfig.GhostDevices {
+		if encryptionConfig.Appservice {
+			helper.router = crypto.NewMachineRouter(helper.mach)
+		} else {
+			helper.log.Warn().Msg("Ghost devices require appservice mode for encryption, sending all messages through the bot device")
+		}
+	}
 	if encryptionConfig.DeleteKeys.PeriodicallyDeleteExpired {
 		ctx, cancel := context.WithCancel(context.Background())
 		helper.cancelPeriodicDeleteLoop = cancel
@@ -136,12 +135,34 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 	if isExistingDevice {
 		helper.verifyKeysAreOnServer(ctx)
 	}
+	if helper.router != nil {
+		helper.loadGhostMachines(ctx)
+	}
 
 	go helper.resyncEncryptionInfo(context.TODO())
 
 	return nil
 }
 
+func (helper *CryptoHelper) newMachine(client *mautrix.Client, log *zerolog.Logger, store crypto.Store) *crypto.OlmMachine {
+	mach := crypto.NewOlmMachine(client, log, store, helper.bridge.StateStore)
+	mach.DisableSharedGroupSessionTracking = true
+	mach.AllowKeyShare = helper.allowKeyShare
+
+	encryptionConfig := helper.bridge.Config.Encryption
+	mach.SendKeysMinTrust = encryptionConfig.VerificationLevels.Receive
+	mach.PlaintextMentions = encryptionConfig.PlaintextMentions
+
+	mach.DeleteOutboundKeysOnAck = encryptionConfig.DeleteKeys.DeleteOutboundOnAck
+	mach.DontStoreOutboundKeys = encryptionConfig.DeleteKeys.DontStoreOutbound
+	mach.RatchetKeysOnDecrypt = encryptionConfig.DeleteKeys.RatchetOnDecrypt
+	mach.DeleteFullyUsedKeysOnDecrypt = encryptionConfig.DeleteKeys.DeleteFullyUsedOnDecrypt
+	mach.DeletePreviousKeysOnReceive = encryptionConfig.DeleteKeys.DeletePrevOnNewSession
+	mach.DeleteKeysOnDeviceDelete = encryptionConfig.DeleteKeys.DeleteOnDeviceDelete
+	mach.DisableDeviceChangeKeyRotation = encryptionConfig.Rotation.DisableDeviceChangeKeyRotation
+	return mach
+}
+
 func (helper *CryptoHelper) resyncEncryptionInfo(ctx context.Context) {
 	log := helper.log.With().Str("action", "resync encryption event").Logger()
 	rows, err := helper.store.DB.Query(ctx, `SELECT room_id FROM mx_room_state WHERE encryption='{"resync":true}'`)
@@ -219,7 +240,7 @@ func (helper *CryptoHelper) allowKeyShare(ctx context.Context, device *id.Device
 		} else if user == nil {
 			zerolog.Ctx(ctx).Debug().Msg("Couldn't find user to handle key request")
 			return &crypto.KeyShareRejectNoResponse
-		} else if !user.Permissions.Admin {
+		} else if !user.GetPermissions().Admin {
 			zerolog.Ctx(ctx).Debug().Msg("Rejecting key request: user is not admin")
 			// TODO is in room check?
 			return &crypto.KeyShareRejection{Code: event.RoomKeyWithheldUnauthorized, Reason: "Key sharing for non-admins is not yet implemented"}
@@ -277,6 +298,104 @@ func (helper *CryptoHelper) loginBot(ctx context.Context) (*mautrix.Client, bool
 	return client, deviceID != "", nil
 }
 
+func ghostAccountID(botAccountID string, userID id.UserID) string {
+	return fmt.Sprintf("%s/%s", botAccountID, userID)
+}
+
+// ghostAccountPattern returns a LIKE pattern (with \ as the escape character) that matches the account IDs of all ghosts.
+func (helper *CryptoHelper) ghostAccountPattern() string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(helper.store.AccountID) + "/%"
+}
+
+// loadGhostMachines adds the devices of all ghosts that have a stored crypto account to the router,
+// so that to-device events and one-time key counts sent to them are handled after a restart
+// even before the ghost sends its next message.
+func (helper *CryptoHelper) loadGhostMachines(ctx context.Context) {
+	rows, err := helper.store.DB.Query(ctx, `SELECT account_id FROM crypto_account WHERE account_id LIKE $1 ESCAPE '\'`, helper.ghostAccountPattern())
+	accountIDs, err := dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[string], err).AsList()
+	if err != nil {
+		helper.log.Err(err).Msg("Failed to get ghost crypto accounts")
+		return
+	}
+	prefix := helper.store.AccountID + "/"
+	for _, accountID := range accountIDs {
+		userID := id.UserID(strings.TrimPrefix(accountID, prefix))
+		mach, err := helper.newGhostMachine(ctx, helper.store, userID)
+		if err != nil {
+			helper.log.Err(err).Stringer("ghost_user_id", userID).Msg("Failed to load ghost encryption device")
+			continue
+		}
+		helper.router.Add(mach)
+	}
+	if len(accountIDs) > 0 {
+		helper.log.Debug().Int("ghost_count", len(accountIDs)).Msg("Loaded ghost encryption devices")
+	}
+}
+
+// newGhostMachine creates and loads the OlmMachine for the given ghost, creating a new device for it if necessary.
+// The machine is not added to the router.
+//
+// This doesn't use helper.lock, as creating the device and uploading its keys requires requests to the homeserver.
+// The bridge bot's store must be passed explicitly so that a concurrent reset doesn't change it halfway.
+func (helper *CryptoHelper) newGhostMachine(ctx context.Context, botStore *SQLCryptoStore, userID id.UserID) (*crypto.OlmMachine, error) {
+	log := helper.log.With().Stringer("ghost_user_id", userID).Logger()
+	store := NewSQLCryptoStore(
+		helper.bridge.Bridge.DB.Database,
+		dbutil.ZeroLogger(helper.bridge.Log.With().Str("db_section", "crypto").Logger()),
+		ghostAccountID(botStore.AccountID, userID),
+		botStore.UserID,
+		botStore.GhostIDFormat,
+		helper.bridge.Config.Encryption.PickleKey,
+	)
+	deviceID, err := store.FindDeviceID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find existing device ID: %w", err)
+	}
+	client := helper.bridge.AS.NewMautrixClient(userID)
+	initialDeviceDisplayName := fmt.Sprintf("%s bridge", helper.bridge.Bridge.Network.GetName().DisplayName)
+	if helper.bridge.Config.Encryption.MSC4190 {
+		err = client.CreateDeviceMSC4190(ctx, deviceID, initialDeviceDisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create device for ghost: %w", err)
+		}
+	} else if deviceID == "" {
+		resp, err := client.Login(ctx, &mautrix.ReqLogin{
+			Type: mautrix.AuthTypeAppservice,
+			Identifier: mautrix.UserIdentifier{
+				Type: mautrix.IdentifierTypeUser,
+				User: string(userID),
+			},
+			InitialDeviceDisplayName: initialDeviceDisplayName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to log in as ghost: %w", err)
+		}
+		// Keep using the as_token and only masquerade as the new device
+		client.DeviceID = resp.DeviceID
+		client.SetAppServiceDeviceID = true
+	} else {
+		client.DeviceID = deviceID
+		client.SetAppServiceDeviceID = true
+	}
+	store.DeviceID = client.DeviceID
+	log.Debug().
+		Stringer("device_id", client.DeviceID).
+		Bool("new_device", deviceID == "").
+		Msg("Initializing ghost encryption device")
+	mach := helper.newMachine(client, &log, store)
+	err = mach.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ghost olm account: %w", err)
+	}
+	if !mach.GetAccount().Shared {
+		err = mach.ShareKeys(ctx, -1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload ghost device keys: %w", err)
+		}
+	}
+	return mach, nil
+}
+
 func (helper *CryptoHelper) verifyKeysAreOnServer(ctx context.Context) {
 	helper.log.Debug().Msg("Making sure keys are still on server")
 	resp, err := helper.client.QueryKeys(ctx, &mautrix.ReqQueryKeys{
@@ -300,7 +419,11 @@ func (helper *CryptoHelper) Start() {
 	if helper.bridge.Config.Encryption.Appservice {
 		helper.log.Debug().Msg("End-to-bridge encryption is in appservice mode, registering event listeners and not starting syncer")
 		helper.bridge.AS.Registration.EphemeralEvents = true
-		helper.mach.AddAppserviceListener(helper.bridge.EventProcessor)
+		if helper.router != nil {
+			helper.router.AddAppserviceListener(helper.bridge.EventProcessor)
+		} else {
+			helper.mach.AddAppserviceListener(helper.bridge.EventProcessor)
+		}
 		return
 	}
 	helper.syncDone.Add(1)
@@ -330,18 +453,28 @@ func (helper *CryptoHelper) Stop() {
 }
 
 func (helper *CryptoHelper) clearDatabase(ctx context.Context) {
-	_, err := helper.store.DB.Exec(ctx, "DELETE FROM crypto_account")
+	_, err := helper.store.DB.Exec(ctx, "DELETE FROM crypto_account WHERE account_id=$1", helper.store.AccountID)
 	if err != nil {
 		helper.log.Warn().Err(err).Msg("Failed to clear crypto_account table")
 	}
-	_, err = helper.store.DB.Exec(ctx, "DELETE FROM crypto_olm_session")
+	_, err = helper.store.DB.Exec(ctx, "DELETE FROM crypto_olm_session WHERE account_id=$1", helper.store.AccountID)
 	if err != nil {
 		helper.log.Warn().Err(err).Msg("Failed to clear crypto_olm_session table")
 	}
-	_, err = helper.store.DB.Exec(ctx, "DELETE FROM crypto_megolm_outbound_session")
+	_, err = helper.store.DB.Exec(ctx, "DELETE FROM crypto_megolm_outbound_session WHERE account_id=$1", helper.store.AccountID)
 	if err != nil {
 		helper.log.Warn().Err(err).Msg("Failed to clear crypto_megolm_outbound_session table")
 	}
+	if helper.router != nil {
+		// Ghost devices are recreated lazily after the reset
+		ghostAccountPattern := helper.ghostAccountPattern()
+		for _, table := range []string{"crypto_account", "crypto_olm_session", "crypto_megolm_outbound_session"} {
+			_, err = helper.store.DB.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE account_id LIKE $1 ESCAPE '\'`, table), ghostAccountPattern)
+			if err != nil {
+				helper.log.Warn().Err(err).Str("table_name", table).Msg("Failed to clear ghost device data")
+			}
+		}
+	}
 	//_, _ = helper.store.DB.Exec("DELETE FROM crypto_device")
 	//_, _ = helper.store.DB.Exec("DELETE FROM crypto_tracked_user")
 	//_, _ = helper.store.DB.Exec("DELETE FROM crypto_cross_signing_keys")
@@ -363,6 +496,7 @@ func (helper *CryptoHelper) Reset(ctx context.Context, startAfterReset bool) {
 	helper.client = nil
 	helper.store = nil
 	helper.mach = nil
+	helper.router = nil
 	err = helper.Init(ctx)
 	if err != nil {
 		helper.log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Error reinitializing end-to-bridge encryption")
@@ -382,11 +516,67 @@ func (helper *CryptoHelper) Decrypt(ctx context.Context, evt *event.Event) (*eve
 	return helper.mach.DecryptMegolmEvent(ctx, evt)
 }
 
-func (helper *CryptoHelper) Encrypt(ctx context.Context, roomID id.RoomID, evtType event.Type, content *event.Content) (err error) {
+func (helper *CryptoHelper) Encrypt(ctx context.Context, roomID id.RoomID, evtType event.Type, content *event.Content) error {
 	helper.lock.RLock()
 	defer helper.lock.RUnlock()
+	return helper.encrypt(ctx, helper.mach, roomID, evtType, content)
+}
+
+// EncryptAs encrypts the event using the device of the given ghost user if ghost devices are enabled.
+// The bridge bot's device is used otherwise.
+func (helper *CryptoHelper) EncryptAs(ctx context.Context, userID id.UserID, roomID id.RoomID, evtType event.Type, content *event.Content) error {
+	helper.lock.RLock()
+	mach, router, store := helper.mach, helper.router, helper.store
+	if router != nil && userID != helper.client.UserID {
+		if ghostMach := router.Get(userID); ghostMach != nil {
+			defer helper.lock.RUnlock()
+			return helper.encrypt(ctx, ghostMach, roomID, evtType, content)
+		}
+		helper.lock.RUnlock()
+		return helper.createGhostMachineAndEncrypt(ctx, router, store, userID, roomID, evtType, content)
+	}
+	defer helper.lock.RUnlock()
+	return helper.encrypt(ctx, mach, roomID, evtType, content)
+}
+
+// createGhostMachineAndEncrypt creates the encryption device of a ghost without holding helper.lock,
+// then takes the lock to add the device to the router and encrypt the event with it.
+func (helper *CryptoHelper) createGhostMachineAndEncrypt(
+	ctx context.Context,
+	router *crypto.MachineRouter,
+	store *SQLCryptoStore,
+	userID id.UserID,
+	roomID id.RoomID,
+	evtType event.Type,
+	content *event.Content,
+) error {
+	// ghostLock only prevents concurrent senders from creating multiple devices for the same ghost.
+	// Reset never takes it, so it's fine to take helper.lock while holding it.
+	helper.ghostLock.Lock()
+	defer helper.ghostLock.Unlock()
+	mach := router.Get(userID)
+	if mach == nil {
+		var err error
+		mach, err = helper.newGhostMachine(ctx, store, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get encryption device for %s: %w", userID, err)
+		}
+	}
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	if helper.router != router {
+		return fmt.Errorf("end-to-bridge encryption was reset while creating encryption device for %s", userID)
+	} else if existing := router.Get(userID); existing != nil {
+		mach = existing
+	} else {
+		router.Add(mach)
+	}
+	return helper.encrypt(ctx, mach, roomID, evtType, content)
+}
+
+func (helper *CryptoHelper) encrypt(ctx context.Context, mach *crypto.OlmMachine, roomID id.RoomID, evtType event.Type, content *event.Content) (err error) {
 	var encrypted *event.EncryptedEventContent
-	encrypted, err = helper.mach.EncryptMegolmEvent(ctx, roomID, evtType, content)
+	encrypted, err = mach.EncryptMegolmEvent(ctx, roomID, evtType, content)
 	if err != nil {
 		if !errors.Is(err, crypto.SessionExpired) && !errors.Is(err, crypto.SessionNotShared) && !errors.Is(err, crypto.NoGroupSession) {
 			return
@@ -398,9 +588,9 @@ func (helper *CryptoHelper) Encrypt(ctx context.Context, roomID id.RoomID, evtTy
 		users, err = helper.store.GetRoomJoinedOrInvitedMembers(ctx, roomID)
 		if err != nil {
 			err = fmt.Errorf("failed to get room member list: %w", err)
-		} else if err = helper.mach.ShareGroupSession(ctx, roomID, users); err != nil {
+		} else if err = mach.ShareGroupSession(ctx, roomID, users); err != nil {
 			err = fmt.Errorf("failed to share group session: %w", err)
-		} else if encrypted, err = helper.mach.EncryptMegolmEvent(ctx, roomID, evtType, content); err != nil {
+		} else if encrypted, err = mach.EncryptMegolmEvent(ctx, roomID, evtType, content); err != nil {
 			err = fmt.Errorf("failed to encrypt event after re-sharing group session: %w", err)
 		}
 	}
@@ -444,18 +634,30 @@ func (helper *CryptoHelper) RequestSession(ctx context.Context, roomID id.RoomID
 func (helper *CryptoHelper) ResetSession(ctx context.Context, roomID id.RoomID) {
 	helper.lock.RLock()
 	defer helper.lock.RUnlock()
-	err := helper.mach.CryptoStore.RemoveOutboundGroupSession(ctx, roomID)
-	if err != nil {
-		helper.log.Debug().Err(err).
-			Str("room_id", roomID.String()).
-			Msg("Error manually removing outbound group session in room")
+	for _, mach := range helper.allMachines() {
+		err := mach.CryptoStore.RemoveOutboundGroupSession(ctx, roomID)
+		if err != nil {
+			helper.log.Debug().Err(err).
+				Str("room_id", roomID.String()).
+				Stringer("device_owner", mach.Client.UserID).
+				Msg("Error manually removing outbound group session in room")
+		}
 	}
 }
 
+func (helper *CryptoHelper) allMachines() []*crypto.OlmMachine {
+	if helper.router == nil {
+		return []*crypto.OlmMachine{helper.mach}
+	}
+	return append(helper.router.Machines(), helper.mach)
+}
+
 func (helper *CryptoHelper) HandleMemberEvent(ctx context.Context, evt *event.Event) {
 	helper.lock.RLock()
 	defer helper.lock.RUnlock()
-	helper.mach.HandleMemberEvent(ctx, evt)
+	for _, mach := range helper.allMachines() {
+		mach.HandleMemberEvent(ctx, evt)
+	}
 }
 
 // ShareKeys uploads the given number of one-time-keys to the server.
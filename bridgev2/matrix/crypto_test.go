@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo && !nocrypto
+
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+)
+
+func newGhostDeviceTestHelper(t *testing.T, br *Connector) *CryptoHelper {
+	t.Helper()
+	br.Config.Encryption.Allow = true
+	br.Config.Encryption.Appservice = true
+	br.Config.Encryption.GhostDevices = true
+	br.Config.Encryption.PickleKey = "test"
+	helper := NewCryptoHelper(br).(*CryptoHelper)
+	helper.store = NewSQLCryptoStore(
+		br.Bridge.DB.Database,
+		dbutil.NoopLogger,
+		string(br.Bridge.ID),
+		br.AS.BotMXID(),
+		fmt.Sprintf("@%s:%s", br.Config.AppService.FormatUsername("%"), br.AS.HomeserverDomain),
+		br.Config.Encryption.PickleKey,
+	)
+	require.NoError(t, helper.store.DB.Upgrade(context.Background()))
+	helper.client = br.AS.NewMautrixClient(br.AS.BotMXID())
+	helper.mach = helper.newMachine(helper.client, helper.log, helper.store)
+	helper.router = crypto.NewMachineRouter(helper.mach)
+	return helper
+}
+
+func TestCryptoHelperLoadsGhostDevicesOnRestart(t *testing.T) {
+	ctx := context.Background()
+	host := newTestBridgeHost(t)
+	br := addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	helper := newGhostDeviceTestHelper(t, br)
+	ghostID := br.FormatGhostMXID("alice")
+
+	// Simulate devices created before the restart: one for a ghost and one for the bot itself
+	for accountID, deviceID := range map[string]id.DeviceID{
+		ghostAccountID(helper.store.AccountID, ghostID): "GHOSTDEVICE",
+		helper.store.AccountID:                          "BOTDEVICE",
+	} {
+		store := NewSQLCryptoStore(br.Bridge.DB.Database, dbutil.NoopLogger, accountID, helper.store.UserID, helper.store.GhostIDFormat, br.Config.Encryption.PickleKey)
+		store.DeviceID = deviceID
+		account := crypto.NewOlmAccount()
+		account.Shared = true
+		require.NoError(t, store.PutAccount(ctx, account))
+	}
+
+	restarted := newGhostDeviceTestHelper(t, br)
+	assert.Nil(t, restarted.router.Get(ghostID))
+	restarted.loadGhostMachines(ctx)
+	mach := restarted.router.Get(ghostID)
+	require.NotNil(t, mach, "ghost device wasn't loaded into the router")
+	assert.Equal(t, id.DeviceID("GHOSTDEVICE"), mach.Client.DeviceID)
+	assert.True(t, mach.GetAccount().Shared)
+	assert.Len(t, restarted.router.Machines(), 1)
+}
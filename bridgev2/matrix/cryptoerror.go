@@ -45,6 +45,28 @@ func errorToHumanMessage(err error) string {
 	}
 }
 
+func errorToMetricReason(err error) string {
+	var withheld *event.RoomKeyWithheldEventContent
+	switch {
+	case errors.Is(err, errDeviceNotTrusted):
+		return "untrusted_device"
+	case errors.Is(err, errNoDecryptionKeys):
+		return "no_keys"
+	case errors.Is(err, errNoCrypto):
+		return "no_crypto"
+	case errors.Is(err, UnknownMessageIndex):
+		return "unknown_index"
+	case errors.Is(err, DuplicateMessageIndex):
+		return "duplicate_index"
+	case errors.As(err, &withheld):
+		return "withheld"
+	case errors.Is(err, errMessageNotEncrypted):
+		return "not_encrypted"
+	default:
+		return "other"
+	}
+}
+
 func deviceUnverifiedErrorWithExplanation(trust id.TrustState) error {
 	var explanation string
 	switch trust {
@@ -75,7 +97,9 @@ func (br *Connector) sendCryptoStatusError(ctx context.Context, evt *event.Event
 		SendNotice:    true,
 		RetryNum:      retryNum,
 	}
-	if !isFinal {
+	if isFinal {
+		br.Bridge.Metrics.TrackDecryptionFailure(errorToMetricReason(err))
+	} else {
 		ms.Status = event.MessageStatusPending
 		// Don't send notice for first error
 		if retryNum == 0 {
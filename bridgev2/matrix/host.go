@@ -0,0 +1,510 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/sqlinbox"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+)
+
+// BridgeHost runs multiple bridges in a single process using one appservice registration.
+//
+// Each hosted bridge has its own network connector, bot user, ghost namespace and [networkid.BridgeID],
+// but they all share the database, the appservice HTTP listener and the Matrix state store.
+// End-to-bridge encryption uses one crypto account per bridge, keyed by the bridge ID.
+//
+// Incoming events are routed to the bridge that owns the bot or ghost the event targets,
+// then to the bridge that owns the portal room, and finally to all bridges whose bot is in the room.
+// Each bridge has its own queue of routed events, so a bridge that's slow to handle events doesn't hold up the others.
+// If appservice.durable_transactions is enabled in the host config, the shared listener stores transactions
+// in a single inbox, and events are only removed from it after all bridges they were routed to have handled them.
+// The provisioning API, public media and debug endpoints of each bridge are served
+// under /_bridges/<bridge ID>/ on the shared listener. Metrics are only exposed there
+// if the bridge has metrics.serve_on_appservice enabled, otherwise they're served on its own metrics listener.
+//
+// The standard main function in the mxmain package only runs a single bridge. Programs that want to host
+// multiple bridges must create a BridgeHost in their own main function, add the bridges and call Start.
+type BridgeHost struct {
+	// Config contains the shared homeserver and appservice settings.
+	// The homeserver section and the appservice ID, address, listener and tokens are copied to all hosted bridges.
+	Config     *bridgeconfig.Config
+	DB         *dbutil.Database
+	Log        zerolog.Logger
+	AS         *appservice.AppService
+	StateStore *sqlstatestore.SQLStateStore
+	Inbox      *sqlinbox.SQLInbox
+	Bridges    []*Connector
+
+	roomOwners     map[id.RoomID]*Connector
+	roomOwnersLock sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	routerWg sync.WaitGroup
+}
+
+// hostQueues contains the queues of events routed to a single hosted bridge.
+type hostQueues struct {
+	events      *hostQueue[*event.Event]
+	toDevice    *hostQueue[*event.Event]
+	otkCounts   *hostQueue[*mautrix.OTKCount]
+	deviceLists *hostQueue[*mautrix.DeviceLists]
+}
+
+// hostQueue is an unbounded queue in front of one of the event channels of a hosted bridge,
+// which allows the router to move on to the next event without waiting for the bridge to read the previous one.
+type hostQueue[T any] struct {
+	lock   sync.Mutex
+	items  []T
+	signal chan struct{}
+	target chan T
+}
+
+func newHostQueue[T any](target chan T) *hostQueue[T] {
+	return &hostQueue[T]{
+		signal: make(chan struct{}, 1),
+		target: target,
+	}
+}
+
+func (hq *hostQueue[T]) push(item T) {
+	hq.lock.Lock()
+	hq.items = append(hq.items, item)
+	hq.lock.Unlock()
+	select {
+	case hq.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (hq *hostQueue[T]) run(wg *sync.WaitGroup, stop <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case <-hq.signal:
+		case <-stop:
+			return
+		}
+		hq.lock.Lock()
+		items := hq.items
+		hq.items = nil
+		hq.lock.Unlock()
+		for _, item := range items {
+			select {
+			case hq.target <- item:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+var (
+	ErrDuplicateBridgeID       = errors.New("bridge ID is already used by another hosted bridge")
+	ErrOverlappingNamespace    = errors.New("bridge namespace overlaps with another hosted bridge")
+	ErrHostWebsocketNotAllowed = errors.New("bridge host only supports the appservice HTTP listener")
+)
+
+// NewBridgeHost creates a new bridge host. Bridges must be added with [BridgeHost.AddBridge] before calling Start.
+func NewBridgeHost(cfg *bridgeconfig.Config, db *dbutil.Database, log zerolog.Logger) *BridgeHost {
+	host := &BridgeHost{
+		Config: cfg,
+		DB:     db,
+		Log:    log,
+
+		roomOwners: make(map[id.RoomID]*Connector),
+		stop:       make(chan struct{}),
+	}
+	host.StateStore = sqlstatestore.NewSQLStateStore(db, dbutil.ZeroLogger(log.With().Str("db_section", "matrix_state").Logger()), false)
+	host.AS = cfg.MakeAppService()
+	host.AS.Log = log
+	host.AS.StateStore = host.StateStore
+	if cfg.AppService.DurableTransactions {
+		host.Inbox = sqlinbox.NewSQLInbox(db, dbutil.ZeroLogger(log.With().Str("db_section", "matrix_txn_inbox").Logger()))
+		host.AS.Inbox = host.Inbox
+	}
+	host.AS.ThirdPartyHandler = &hostThirdPartyHandler{host: host}
+	return host
+}
+
+func (host *BridgeHost) applySharedConfig(cfg *bridgeconfig.Config) {
+	cfg.Homeserver = host.Config.Homeserver
+	cfg.AppService.ID = host.Config.AppService.ID
+	cfg.AppService.Address = host.Config.AppService.Address
+	cfg.AppService.Hostname = host.Config.AppService.Hostname
+	cfg.AppService.Port = host.Config.AppService.Port
+	cfg.AppService.ASToken = host.Config.AppService.ASToken
+	cfg.AppService.HSToken = host.Config.AppService.HSToken
+	cfg.AppService.EphemeralEvents = host.Config.AppService.EphemeralEvents
+	cfg.AppService.AsyncTransactions = host.Config.AppService.AsyncTransactions
+}
+
+// AddBridge creates a new bridge with the given ID and network connector and adds it to the host.
+//
+// The bot username and username template in the config must not overlap with any other hosted bridge.
+// The shared homeserver and appservice settings are copied from the host config.
+func (host *BridgeHost) AddBridge(bridgeID networkid.BridgeID, cfg *bridgeconfig.Config, network bridgev2.NetworkConnector) (*bridgev2.Bridge, error) {
+	host.applySharedConfig(cfg)
+	botMXID := id.NewUserID(cfg.AppService.Bot.Username, cfg.Homeserver.Domain)
+	sampleGhost := id.NewUserID(cfg.AppService.FormatUsername("a"), cfg.Homeserver.Domain)
+	ghostRegex := cfg.MakeUserIDRegex(".+")
+	for _, existing := range host.Bridges {
+		if existing.Bridge.ID == bridgeID {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateBridgeID, bridgeID)
+		}
+		existingBot := existing.Bot.UserID
+		if existingBot == botMXID || existing.isGhostMXID(botMXID) || existing.isGhostMXID(sampleGhost) ||
+			ghostRegex.MatchString(string(existingBot)) || ghostRegex.MatchString(string(existing.FormatGhostMXID("a"))) {
+			return nil, fmt.Errorf("%w: %q and %q", ErrOverlappingNamespace, bridgeID, existing.Bridge.ID)
+		}
+	}
+	connector := NewConnector(cfg)
+	connector.host = host
+	br := bridgev2.NewBridge(
+		bridgeID, host.DB, host.Log.With().Str("bridge_id", string(bridgeID)).Logger(),
+		&cfg.Bridge, connector, network, commands.NewProcessor,
+	)
+	br.SharedDB = true
+	// All hosted bridges talk to the same homeserver, so they share one rate limit
+	connector.AS.RateLimiter = host.AS.RateLimiter
+	connector.hostQueues = &hostQueues{
+		events:      newHostQueue(connector.AS.Events),
+		toDevice:    newHostQueue(connector.AS.ToDeviceEvents),
+		otkCounts:   newHostQueue(connector.AS.OTKCounts),
+		deviceLists: newHostQueue(connector.AS.DeviceLists),
+	}
+	connector.AS.DoublePuppetValue = network.GetName().NetworkID
+	if bridgeID != "" {
+		connector.AS.DoublePuppetValue += "/" + string(bridgeID)
+	}
+	host.Bridges = append(host.Bridges, connector)
+	return br, nil
+}
+
+// GenerateRegistration generates a single registration file containing the namespaces of all hosted bridges.
+// The generated tokens are stored in the host config and copied to the configs of all hosted bridges.
+func (host *BridgeHost) GenerateRegistration() *appservice.Registration {
+	registration := host.Config.GenerateRegistration()
+	registration.Namespaces = appservice.Namespaces{}
+	for _, br := range host.Bridges {
+		host.applySharedConfig(br.Config)
+		br.Config.RegisterNamespaces(registration)
+		protocol := br.Bridge.Network.GetName().NetworkID
+		if !slices.Contains(registration.Protocols, protocol) {
+			registration.Protocols = append(registration.Protocols, protocol)
+		}
+	}
+	return registration
+}
+
+// Start starts the shared appservice listener and all hosted bridges.
+//
+// If a bridge fails to start, the bridges that were already started are stopped and the host is shut down
+// like in [BridgeHost.Stop], so it can't be started again.
+func (host *BridgeHost) Start(ctx context.Context) error {
+	if host.Config.Homeserver.Websocket || len(host.Config.Homeserver.WSProxy) > 0 {
+		return ErrHostWebsocketNotAllowed
+	} else if !host.AS.Host.IsConfigured() {
+		return errors.New("appservice HTTP listener is not configured")
+	}
+	err := host.StateStore.Upgrade(ctx)
+	if err != nil {
+		return bridgev2.DBUpgradeError{Section: "matrix_state", Err: err}
+	}
+	if host.Inbox != nil {
+		err = host.Inbox.Upgrade(ctx)
+		if err != nil {
+			return bridgev2.DBUpgradeError{Section: "matrix_txn_inbox", Err: err}
+		}
+		host.AS.HoldTransactionsForReplay()
+	}
+	for _, br := range host.Bridges {
+		// Bridge-specific endpoints like provisioning are exposed under a per-bridge prefix.
+		prefix := "/_bridges/" + string(br.Bridge.ID)
+		host.AS.Router.PathPrefix(prefix + "/").Handler(http.StripPrefix(prefix, br.hostedHTTPHandler()))
+	}
+	host.routerWg.Add(3 + 4*len(host.Bridges))
+	for _, br := range host.Bridges {
+		go br.hostQueues.events.run(&host.routerWg, host.stop)
+		go br.hostQueues.toDevice.run(&host.routerWg, host.stop)
+		go br.hostQueues.otkCounts.run(&host.routerWg, host.stop)
+		go br.hostQueues.deviceLists.run(&host.routerWg, host.stop)
+	}
+	go host.routeEvents(ctx)
+	go host.routeToDeviceEvents(ctx)
+	go host.routeEncryptionData()
+	host.Log.Debug().Msg("Starting shared appservice HTTP server")
+	go host.AS.Start()
+	for i, br := range host.Bridges {
+		err = br.Bridge.Start()
+		if err != nil {
+			host.stopBridges(host.Bridges[:i])
+			return fmt.Errorf("failed to start bridge %q: %w", br.Bridge.ID, err)
+		}
+	}
+	err = host.AS.ReplayInbox(ctx)
+	if err != nil {
+		host.stopBridges(host.Bridges)
+		return fmt.Errorf("failed to replay transaction inbox: %w", err)
+	}
+	host.AS.Ready = true
+	return nil
+}
+
+// Stop stops the shared appservice listener and all hosted bridges, then closes the database.
+func (host *BridgeHost) Stop() {
+	host.stopBridges(host.Bridges)
+}
+
+func (host *BridgeHost) stopBridges(bridges []*Connector) {
+	host.stopOnce.Do(func() {
+		host.AS.Ready = false
+		host.AS.Stop()
+		close(host.stop)
+		host.routerWg.Wait()
+		var wg sync.WaitGroup
+		wg.Add(len(bridges))
+		for _, br := range bridges {
+			go func() {
+				defer wg.Done()
+				br.Bridge.Stop()
+			}()
+		}
+		wg.Wait()
+		if host.AS.RateLimiter != nil {
+			host.AS.RateLimiter.Stop()
+		}
+		err := host.DB.Close()
+		if err != nil {
+			host.Log.Warn().Err(err).Msg("Failed to close database")
+		}
+	})
+}
+
+func (host *BridgeHost) findUserOwner(userID id.UserID) *Connector {
+	for _, br := range host.Bridges {
+		if br.Bot.UserID == userID || br.isGhostMXID(userID) {
+			return br
+		}
+	}
+	return nil
+}
+
+// findPortalOwner returns the hosted bridge that has a portal in the given room.
+//
+// The owner of each portal room is cached, so that events in portals don't require looking up the room in every bridge.
+// Cached owners are checked again on every call, as the portal may have been deleted or moved to another room.
+func (host *BridgeHost) findPortalOwner(ctx context.Context, roomID id.RoomID) *Connector {
+	host.roomOwnersLock.Lock()
+	cachedOwner := host.roomOwners[roomID]
+	host.roomOwnersLock.Unlock()
+	if cachedOwner != nil {
+		portal, err := cachedOwner.Bridge.GetPortalByMXID(ctx, roomID)
+		if err == nil && portal != nil {
+			return cachedOwner
+		}
+		host.roomOwnersLock.Lock()
+		delete(host.roomOwners, roomID)
+		host.roomOwnersLock.Unlock()
+	}
+	for _, br := range host.Bridges {
+		if br == cachedOwner {
+			continue
+		}
+		portal, err := br.Bridge.GetPortalByMXID(ctx, roomID)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("bridge_id", string(br.Bridge.ID)).
+				Stringer("room_id", roomID).
+				Msg("Failed to get portal to route event")
+		} else if portal != nil {
+			host.roomOwnersLock.Lock()
+			host.roomOwners[roomID] = br
+			host.roomOwnersLock.Unlock()
+			return br
+		}
+	}
+	return nil
+}
+
+// RouteEvent returns the hosted bridges that should receive the given event.
+func (host *BridgeHost) RouteEvent(ctx context.Context, evt *event.Event) []*Connector {
+	if evt.Type == event.StateMember && evt.StateKey != nil {
+		if owner := host.findUserOwner(id.UserID(*evt.StateKey)); owner != nil {
+			return []*Connector{owner}
+		}
+	}
+	if owner := host.findUserOwner(evt.Sender); owner != nil {
+		return []*Connector{owner}
+	}
+	if evt.RoomID == "" {
+		return nil
+	}
+	if owner := host.findPortalOwner(ctx, evt.RoomID); owner != nil {
+		return []*Connector{owner}
+	}
+	var targets []*Connector
+	for _, br := range host.Bridges {
+		if host.StateStore.IsInRoom(ctx, evt.RoomID, br.Bot.UserID) {
+			targets = append(targets, br)
+		}
+	}
+	return targets
+}
+
+func (host *BridgeHost) routeEvents(ctx context.Context) {
+	defer host.routerWg.Done()
+	for {
+		select {
+		case evt := <-host.AS.Events:
+			host.routeEvent(ctx, evt)
+		case <-host.stop:
+			return
+		}
+	}
+}
+
+func (host *BridgeHost) routeEvent(ctx context.Context, evt *event.Event) {
+	targets := host.RouteEvent(ctx, evt)
+	if len(targets) == 0 {
+		host.Log.Debug().
+			Stringer("event_id", evt.ID).
+			Stringer("room_id", evt.RoomID).
+			Str("event_type", evt.Type.Type).
+			Msg("Dropping event that doesn't belong to any hosted bridge")
+	}
+	// Handlers may modify the parsed content, so each bridge gets its own copy of the event.
+	// The copies are made before queuing the original, as the first bridge may start handling it right away.
+	forwarded := make([]*event.Event, len(targets))
+	for i := range targets {
+		if i == 0 {
+			forwarded[i] = evt
+		} else {
+			forwarded[i] = copyEvent(evt)
+		}
+	}
+	for i, br := range targets {
+		host.AS.ForwardInboxEvent(evt, br.AS, forwarded[i])
+		br.hostQueues.events.push(forwarded[i])
+	}
+	host.AS.MarkEventHandled(ctx, evt)
+}
+
+func (host *BridgeHost) routeToDeviceEvents(ctx context.Context) {
+	defer host.routerWg.Done()
+	for {
+		select {
+		case evt := <-host.AS.ToDeviceEvents:
+			if owner := host.findUserOwner(evt.ToUserID); owner != nil {
+				owner.hostQueues.toDevice.push(evt)
+			} else {
+				zerolog.Ctx(ctx).Debug().
+					Stringer("to_user_id", evt.ToUserID).
+					Str("event_type", evt.Type.Type).
+					Msg("Dropping to-device event for unknown user")
+			}
+		case <-host.stop:
+			return
+		}
+	}
+}
+
+func (host *BridgeHost) routeEncryptionData() {
+	defer host.routerWg.Done()
+	for {
+		select {
+		case otk := <-host.AS.OTKCounts:
+			if owner := host.findUserOwner(otk.UserID); owner != nil {
+				owner.hostQueues.otkCounts.push(otk)
+			}
+		case dl := <-host.AS.DeviceLists:
+			// Device list changes are relevant to every bridge that shares rooms with the user.
+			for _, br := range host.Bridges {
+				br.hostQueues.deviceLists.push(copyDeviceLists(dl))
+			}
+		case <-host.stop:
+			return
+		}
+	}
+}
+
+func copyDeviceLists(dl *mautrix.DeviceLists) *mautrix.DeviceLists {
+	dlCopy := *dl
+	return &dlCopy
+}
+
+func copyEvent(evt *event.Event) *event.Event {
+	evtCopy := *evt
+	evtCopy.Content = copyContent(evt.Type, &evt.Content)
+	if evt.Unsigned.PrevContent != nil {
+		prevContent := copyContent(evt.Type, evt.Unsigned.PrevContent)
+		evtCopy.Unsigned.PrevContent = &prevContent
+	}
+	return &evtCopy
+}
+
+func copyContent(evtType event.Type, content *event.Content) event.Content {
+	var contentCopy event.Content
+	// The original content was unmarshaled from the same data, so this can't fail
+	_ = contentCopy.UnmarshalJSON(content.VeryRaw)
+	if content.Parsed != nil {
+		_ = contentCopy.ParseRaw(evtType)
+	}
+	return contentCopy
+}
+
+// isHostedHTTPPath checks if the given path is a bridge-specific endpoint that should be exposed
+// under the per-bridge prefix of a bridge host. The appservice API of hosted bridges is never exposed,
+// as transactions must only be received through the shared listener.
+func (br *Connector) isHostedHTTPPath(path string) bool {
+	switch {
+	case strings.HasPrefix(path, br.Config.Provisioning.Prefix+"/"):
+		return true
+	case strings.HasPrefix(path, "/_mautrix/publicmedia/"):
+		return br.Config.PublicMedia.Enabled
+	case strings.HasPrefix(path, "/debug/"):
+		return br.Config.Provisioning.DebugEndpoints
+	case path == "/metrics":
+		return br.Config.Metrics.Enabled && br.Config.Metrics.ServeOnAppservice
+	default:
+		return false
+	}
+}
+
+func (br *Connector) hostedHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !br.isHostedHTTPPath(r.URL.Path) {
+			mautrix.MUnrecognized.WithMessage("Unrecognized endpoint").Write(w)
+			return
+		}
+		br.AS.Router.ServeHTTP(w, r)
+	})
+}
+
+func (br *Connector) isGhostMXID(userID id.UserID) bool {
+	_, isGhost := br.ParseGhostMXID(userID)
+	return isGhost
+}
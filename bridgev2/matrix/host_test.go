@@ -0,0 +1,254 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type hostTestConnector struct {
+	bridgev2.NetworkConnector
+	name string
+}
+
+func (htc *hostTestConnector) Init(*bridgev2.Bridge)              {}
+func (htc *hostTestConnector) GetDBMetaTypes() database.MetaTypes { return database.MetaTypes{} }
+func (htc *hostTestConnector) GetName() bridgev2.BridgeName {
+	return bridgev2.BridgeName{DisplayName: htc.name, NetworkID: htc.name}
+}
+
+func newHostTestConfig(botUsername, usernameTemplate string) *bridgeconfig.Config {
+	cfg := &bridgeconfig.Config{}
+	cfg.AppService.Bot.Username = botUsername
+	cfg.AppService.UsernameTemplate = usernameTemplate
+	cfg.Provisioning.Prefix = "/_matrix/provision"
+	return cfg
+}
+
+func newTestBridgeHost(t *testing.T) *BridgeHost {
+	t.Helper()
+	cfg := &bridgeconfig.Config{}
+	cfg.Homeserver.Domain = "example.com"
+	cfg.Homeserver.Address = "http://localhost:8008"
+	cfg.AppService.ID = "host"
+	cfg.AppService.Bot.Username = "hostbot"
+	cfg.AppService.UsernameTemplate = "host_{{.}}"
+	host := NewBridgeHost(cfg, bridgetest.NewDatabase(t), zerolog.New(zerolog.NewTestWriter(t)))
+	require.NoError(t, host.StateStore.Upgrade(context.Background()))
+	return host
+}
+
+func addTestBridge(t *testing.T, host *BridgeHost, bridgeID networkid.BridgeID, botUsername, usernameTemplate string) *Connector {
+	t.Helper()
+	br, err := host.AddBridge(bridgeID, newHostTestConfig(botUsername, usernameTemplate), &hostTestConnector{name: string(bridgeID)})
+	require.NoError(t, err)
+	require.NoError(t, br.DB.Upgrade(context.Background()))
+	return br.Matrix.(*Connector)
+}
+
+func TestBridgeHostAddBridgeConflicts(t *testing.T) {
+	host := newTestBridgeHost(t)
+	addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+
+	_, err := host.AddBridge("signal", newHostTestConfig("otherbot", "other_{{.}}"), &hostTestConnector{name: "signal"})
+	assert.ErrorIs(t, err, ErrDuplicateBridgeID)
+	for _, test := range []struct{ name, bot, template string }{
+		{"same bot", "signalbot", "whatsapp_{{.}}"},
+		{"bot is ghost of existing bridge", "signal_whatsappbot", "whatsapp_{{.}}"},
+		{"ghost matches existing bot", "whatsappbot", "signal{{.}}"},
+		{"ghost namespaces overlap", "whatsappbot", "signal_wa_{{.}}"},
+	} {
+		_, err = host.AddBridge("whatsapp", newHostTestConfig(test.bot, test.template), &hostTestConnector{name: "whatsapp"})
+		assert.ErrorIs(t, err, ErrOverlappingNamespace, test.name)
+	}
+	assert.Len(t, host.Bridges, 1)
+
+	addTestBridge(t, host, "whatsapp", "whatsappbot", "whatsapp_{{.}}")
+	assert.Len(t, host.Bridges, 2)
+}
+
+func TestBridgeHostRouteEvent(t *testing.T) {
+	ctx := context.Background()
+	host := newTestBridgeHost(t)
+	signal := addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	whatsapp := addTestBridge(t, host, "whatsapp", "whatsappbot", "whatsapp_{{.}}")
+
+	memberKey := string(whatsapp.FormatGhostMXID("alice"))
+	assert.Equal(t, []*Connector{whatsapp}, host.RouteEvent(ctx, &event.Event{
+		Type:     event.StateMember,
+		Sender:   "@user:example.com",
+		StateKey: &memberKey,
+		RoomID:   "!room:example.com",
+	}), "invite to ghost should go to the ghost's bridge")
+	assert.Equal(t, []*Connector{signal}, host.RouteEvent(ctx, &event.Event{
+		Type:   event.EventMessage,
+		Sender: signal.FormatGhostMXID("bob"),
+		RoomID: "!room:example.com",
+	}), "event from ghost should go to the ghost's bridge")
+
+	require.NoError(t, whatsapp.Bridge.DB.Portal.Insert(ctx, &database.Portal{
+		PortalKey: networkid.PortalKey{ID: "chat"},
+		MXID:      "!portal:example.com",
+	}))
+	assert.Equal(t, []*Connector{whatsapp}, host.RouteEvent(ctx, &event.Event{
+		Type:   event.EventMessage,
+		Sender: "@user:example.com",
+		RoomID: "!portal:example.com",
+	}), "event in portal should go to the portal's bridge")
+
+	for _, br := range []*Connector{signal, whatsapp} {
+		require.NoError(t, host.StateStore.SetMembership(ctx, "!management:example.com", br.Bot.UserID, event.MembershipJoin))
+	}
+	assert.ElementsMatch(t, []*Connector{signal, whatsapp}, host.RouteEvent(ctx, &event.Event{
+		Type:   event.EventMessage,
+		Sender: "@user:example.com",
+		RoomID: "!management:example.com",
+	}), "event in non-portal room should go to all bridges whose bot is in the room")
+	assert.Empty(t, host.RouteEvent(ctx, &event.Event{
+		Type:   event.EventMessage,
+		Sender: "@user:example.com",
+		RoomID: "!unknown:example.com",
+	}))
+}
+
+func TestBridgeHostRouteEventCachesPortalOwner(t *testing.T) {
+	ctx := context.Background()
+	host := newTestBridgeHost(t)
+	addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	whatsapp := addTestBridge(t, host, "whatsapp", "whatsappbot", "whatsapp_{{.}}")
+	require.NoError(t, whatsapp.Bridge.DB.Portal.Insert(ctx, &database.Portal{
+		PortalKey: networkid.PortalKey{ID: "chat"},
+		MXID:      "!portal:example.com",
+	}))
+	evt := &event.Event{
+		Type:   event.EventMessage,
+		Sender: "@user:example.com",
+		RoomID: "!portal:example.com",
+	}
+	assert.Equal(t, []*Connector{whatsapp}, host.RouteEvent(ctx, evt))
+	assert.Equal(t, whatsapp, host.roomOwners["!portal:example.com"])
+	assert.Equal(t, []*Connector{whatsapp}, host.RouteEvent(ctx, evt))
+
+	portal, err := whatsapp.Bridge.GetPortalByMXID(ctx, "!portal:example.com")
+	require.NoError(t, err)
+	require.NoError(t, portal.Delete(ctx))
+	assert.Empty(t, host.RouteEvent(ctx, evt), "deleted portal must not stay cached")
+	assert.NotContains(t, host.roomOwners, id.RoomID("!portal:example.com"))
+}
+
+func startTestRouting(t *testing.T, host *BridgeHost) {
+	host.routerWg.Add(1 + len(host.Bridges))
+	for _, br := range host.Bridges {
+		go br.hostQueues.events.run(&host.routerWg, host.stop)
+	}
+	go host.routeEvents(context.Background())
+	t.Cleanup(func() {
+		close(host.stop)
+		host.routerWg.Wait()
+	})
+}
+
+func TestBridgeHostRouteEventsStalledBridge(t *testing.T) {
+	ctx := context.Background()
+	host := newTestBridgeHost(t)
+	signal := addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	whatsapp := addTestBridge(t, host, "whatsapp", "whatsappbot", "whatsapp_{{.}}")
+	for _, br := range []*Connector{signal, whatsapp} {
+		require.NoError(t, host.StateStore.SetMembership(ctx, "!management:example.com", br.Bot.UserID, event.MembershipJoin))
+	}
+	startTestRouting(t, host)
+
+	// Nothing reads the events of the signal bridge, which must not prevent the whatsapp bridge from receiving them
+	eventCount := 2*appservice.EventChannelSize + 1
+	go func() {
+		for i := 0; i < eventCount; i++ {
+			evt := &event.Event{
+				Type:    event.EventMessage,
+				ID:      id.EventID(fmt.Sprintf("$event%d", i)),
+				Sender:  "@user:example.com",
+				RoomID:  "!management:example.com",
+				Content: event.Content{VeryRaw: []byte(`{"msgtype":"m.text","body":"hi"}`)},
+			}
+			_ = evt.Content.ParseRaw(evt.Type)
+			host.AS.Events <- evt
+		}
+	}()
+	var received []*event.Event
+	for len(received) < eventCount {
+		select {
+		case evt := <-whatsapp.AS.Events:
+			received = append(received, evt)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %d/%d", len(received), eventCount)
+		}
+	}
+
+	select {
+	case evt := <-signal.AS.Events:
+		assert.Equal(t, received[0].ID, evt.ID)
+		assert.NotSame(t, received[0], evt, "bridges must get separate copies of the event")
+		assert.NotSame(t, received[0].Content.AsMessage(), evt.Content.AsMessage())
+		assert.Equal(t, "hi", evt.Content.AsMessage().Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event in stalled bridge")
+	}
+}
+
+func TestBridgeHostHTTPHandlerHidesAppserviceAPI(t *testing.T) {
+	host := newTestBridgeHost(t)
+	br := addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	br.AS.Router.HandleFunc("/_matrix/provision/v3/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := br.hostedHTTPHandler()
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/_matrix/provision/v3/ping", http.StatusNoContent},
+		{http.MethodPut, "/_matrix/app/v1/transactions/1", http.StatusNotFound},
+		{http.MethodGet, "/_matrix/app/v1/users/@signal_alice:example.com", http.StatusNotFound},
+		{http.MethodGet, "/_matrix/mau/live", http.StatusNotFound},
+		{http.MethodGet, "/metrics", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, strings.NewReader("{}")))
+		assert.Equal(t, test.status, rec.Code, test.path)
+		if test.status == http.StatusNotFound {
+			assert.Contains(t, rec.Body.String(), mautrix.MUnrecognized.ErrCode, test.path)
+		}
+	}
+
+	br.Config.Metrics.Enabled = true
+	br.Config.Metrics.ServeOnAppservice = true
+	require.NoError(t, br.initMetrics())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "bridge_portal_event_queue_depth")
+}
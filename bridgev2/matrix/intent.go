@@ -30,6 +30,7 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
+	"maunium.net/go/mautrix/tracing"
 )
 
 // ASIntent implements the bridge ghost API interface using a real Matrix homeserver as the backend.
@@ -44,7 +45,19 @@ type ASIntent struct {
 var _ bridgev2.MatrixAPI = (*ASIntent)(nil)
 var _ bridgev2.MarkAsDMMatrixAPI = (*ASIntent)(nil)
 
-func (as *ASIntent) SendMessage(ctx context.Context, roomID id.RoomID, eventType event.Type, content *event.Content, extra *bridgev2.MatrixSendExtra) (*mautrix.RespSendEvent, error) {
+func (as *ASIntent) SendMessage(ctx context.Context, roomID id.RoomID, eventType event.Type, content *event.Content, extra *bridgev2.MatrixSendExtra) (resp *mautrix.RespSendEvent, err error) {
+	ctx, span := tracing.Start(
+		ctx, "bridgev2.ASIntent.SendMessage",
+		tracing.String("matrix.room_id", roomID.String()),
+		tracing.String("matrix.event_type", eventType.Type),
+		tracing.String("matrix.sender", as.Matrix.UserID.String()),
+	)
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(tracing.String("matrix.event_id", resp.EventID.String()))
+		}
+		tracing.End(span, err)
+	}()
 	if extra == nil {
 		extra = &bridgev2.MatrixSendExtra{}
 	}
@@ -70,9 +83,12 @@ func (as *ASIntent) SendMessage(ctx context.Context, roomID id.RoomID, eventType
 				} else {
 					as.Matrix.AddDoublePuppetValueWithTS(content, extra.Timestamp.UnixMilli())
 				}
+				err = as.Connector.Crypto.Encrypt(ctx, roomID, eventType, content)
+			} else {
+				err = as.Connector.Crypto.EncryptAs(ctx, as.Matrix.UserID, roomID, eventType, content)
 			}
-			err = as.Connector.Crypto.Encrypt(ctx, roomID, eventType, content)
 			if err != nil {
+				as.Connector.Bridge.Metrics.TrackEncryptionFailure()
 				return nil, err
 			}
 			eventType = event.EventEncrypted
@@ -286,6 +302,7 @@ func (as *ASIntent) UploadMedia(ctx context.Context, roomID id.RoomID, data []by
 			fileName = ""
 		}
 	}
+	as.Connector.Bridge.Metrics.ObserveMediaUpload(int64(len(data)))
 	url, err = as.doUploadReq(ctx, file, mautrix.ReqUploadMedia{
 		ContentBytes: data,
 		ContentType:  mimeType,
@@ -301,6 +318,17 @@ func (as *ASIntent) UploadMediaStream(
 	requireFile bool,
 	cb bridgev2.FileStreamCallback,
 ) (url id.ContentURIString, file *event.EncryptedFileInfo, err error) {
+	ctx, span := tracing.Start(
+		ctx, "bridgev2.ASIntent.UploadMediaStream",
+		tracing.String("matrix.room_id", roomID.String()),
+		tracing.Int64("file.size", size),
+	)
+	defer func() {
+		if url != "" {
+			span.SetAttributes(tracing.String("matrix.content_uri", string(url)))
+		}
+		tracing.End(span, err)
+	}()
 	if size > as.Connector.MediaConfig.UploadSize {
 		return "", nil, fmt.Errorf("file too large (%.2f MB > %.2f MB)", float64(size)/1000/1000, float64(as.Connector.MediaConfig.UploadSize)/1000/1000)
 	}
@@ -393,6 +421,7 @@ func (as *ASIntent) UploadMediaStream(
 		err = fmt.Errorf("failed to get temp file info: %w", err)
 		return
 	}
+	as.Connector.Bridge.Metrics.ObserveMediaUpload(info.Size())
 	req := mautrix.ReqUploadMedia{
 		Content:       replFile,
 		ContentLength: info.Size(),
@@ -623,6 +652,18 @@ func (as *ASIntent) TagRoom(ctx context.Context, roomID id.RoomID, tag event.Roo
 	return nil
 }
 
+func (as *ASIntent) GetAccountData(ctx context.Context, eventType event.Type, output any) error {
+	err := as.Matrix.GetAccountData(ctx, eventType.Type, output)
+	if errors.Is(err, mautrix.MNotFound) {
+		err = nil
+	}
+	return err
+}
+
+func (as *ASIntent) SetAccountData(ctx context.Context, eventType event.Type, data any) error {
+	return as.Matrix.SetAccountData(ctx, eventType.Type, data)
+}
+
 func (as *ASIntent) MuteRoom(ctx context.Context, roomID id.RoomID, until time.Time) error {
 	var mutedUntil int64
 	if until.Before(time.Now()) {
@@ -35,7 +35,8 @@ func (br *Connector) handleRoomEvent(ctx context.Context, evt *event.Event) {
 	if evt.Type == event.StateMember && br.Crypto != nil {
 		br.Crypto.HandleMemberEvent(ctx, evt)
 	}
-	br.Bridge.QueueMatrixEvent(ctx, evt)
+	// Portals handle events in the background, so the event must stay in the transaction inbox until the portal is done
+	br.Bridge.QueueMatrixEventWithCallback(ctx, evt, appservice.DeferEventHandled(ctx))
 }
 
 func (br *Connector) handleEphemeralEvent(ctx context.Context, evt *event.Event) {
@@ -64,7 +65,7 @@ func (br *Connector) handleEphemeralEvent(ctx context.Context, evt *event.Event)
 		typingContent := evt.Content.AsTyping()
 		typingContent.UserIDs = slices.DeleteFunc(typingContent.UserIDs, br.shouldIgnoreEventFromUser)
 	}
-	br.Bridge.QueueMatrixEvent(ctx, evt)
+	br.Bridge.QueueMatrixEventWithCallback(ctx, evt, appservice.DeferEventHandled(ctx))
 }
 
 func (br *Connector) handleEncryptedEvent(ctx context.Context, evt *event.Event) {
@@ -97,7 +98,11 @@ func (br *Connector) handleEncryptedEvent(ctx context.Context, evt *event.Event)
 			log.Debug().Msg("Got keys after waiting, trying to decrypt event again")
 			decrypted, err = br.Crypto.Decrypt(ctx, evt)
 		} else {
-			go br.waitLongerForSession(ctx, evt, decryptionStart)
+			done := appservice.DeferEventHandled(ctx)
+			go func() {
+				defer done()
+				br.waitLongerForSession(ctx, evt, decryptionStart)
+			}()
 			return
 		}
 	}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mxmain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// CheckRegistration validates the registration file at [BridgeMain.RegistrationPath] against the bridge config,
+// and checks it for namespace conflicts with all other registration files in the given directory.
+//
+// The problems are printed to stdout and the return value is the exit code to use.
+func (br *BridgeMain) CheckRegistration(otherDir string) int {
+	reg, err := appservice.LoadRegistration(br.RegistrationPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to load registration:", err)
+		return 10
+	}
+	var problems []string
+	if err = br.Config.ValidateRegistration(reg); err != nil {
+		problems = append(problems, splitJoinedError(err)...)
+	}
+	if otherDir != "" {
+		otherProblems, err := checkOtherRegistrations(br.RegistrationPath, reg, otherDir)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to read other registrations:", err)
+			return 11
+		}
+		problems = append(problems, otherProblems...)
+	}
+	if len(problems) == 0 {
+		fmt.Println("Registration is valid")
+		return 0
+	}
+	fmt.Printf("Found %d problems in %s:\n", len(problems), br.RegistrationPath)
+	for _, problem := range problems {
+		fmt.Println("*", problem)
+	}
+	return 1
+}
+
+func checkOtherRegistrations(ownPath string, reg *appservice.Registration, dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ownAbsPath, _ := filepath.Abs(ownPath)
+	var problems []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if absPath, _ := filepath.Abs(path); absPath == ownAbsPath {
+			continue
+		}
+		other, err := appservice.LoadRegistration(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: failed to parse: %v", path, err))
+			continue
+		}
+		if other.ID == reg.ID && other.AppToken == reg.AppToken {
+			// Probably another copy of the same registration
+			continue
+		}
+		if other.ID == reg.ID {
+			problems = append(problems, fmt.Sprintf("%s: has the same id %q", path, reg.ID))
+		}
+		if other.AppToken == reg.AppToken || other.ServerToken == reg.ServerToken {
+			problems = append(problems, fmt.Sprintf("%s: has the same as_token or hs_token", path))
+		}
+		for _, conflict := range reg.FindConflicts(other) {
+			problems = append(problems, fmt.Sprintf("%s: %s", path, conflict))
+		}
+	}
+	return problems, nil
+}
+
+// splitJoinedError splits an error created with errors.Join into the individual error messages.
+func splitJoinedError(err error) []string {
+	return strings.Split(err.Error(), "\n")
+}
@@ -0,0 +1,542 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mxmain
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"golang.org/x/exp/maps"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+)
+
+// DataExportFormatVersion is the version of the archive format written by [BridgeMain.ExportData].
+const DataExportFormatVersion = 1
+
+// bridgeExportTables is the list of bridgev2 tables included in data exports, in foreign key dependency order.
+var bridgeExportTables = []string{
+	"user",
+	"user_login",
+	"ghost",
+	"portal",
+	"message",
+	"reaction",
+	"disappearing_message",
+	"scheduled_message",
+	"user_portal",
+	"backfill_task",
+	"kv_store",
+	"custom_emoji",
+	"image_pack",
+	"poll_option",
+	"poll_vote",
+}
+
+// cryptoExportTables is the list of crypto store tables included in data exports if requested.
+var cryptoExportTables = []string{
+	"crypto_account",
+	"crypto_message_index",
+	"crypto_tracked_user",
+	"crypto_device",
+	"crypto_olm_session",
+	"crypto_olm_message_hash",
+	"crypto_megolm_inbound_session",
+	"crypto_megolm_outbound_session",
+	"crypto_megolm_outbound_session_shared",
+	"crypto_cross_signing_keys",
+	"crypto_cross_signing_signatures",
+	"crypto_secrets",
+}
+
+// cryptoAccountFilter matches the crypto accounts of the bridge bot and its ghosts. The bridge bot uses the bridge ID
+// as its account ID and ghost devices use `<bridge ID>/<ghost MXID>` (see the crypto helper in the matrix package).
+const cryptoAccountFilter = `(account_id=$1 OR account_id LIKE $2 ESCAPE '\')`
+
+// cryptoExportFilters contains the WHERE clauses used to only export the crypto data of this bridge,
+// which matters when the database is shared with other bridges. The clauses take the same parameters
+// as [cryptoAccountFilter].
+//
+// Tables that aren't listed are caches of public keys of other users. They're shared by all bridges in the database,
+// so they're exported in full and rows that already exist are skipped when importing.
+var cryptoExportFilters = map[string]string{
+	"crypto_account":                        cryptoAccountFilter,
+	"crypto_message_index":                  "session_id IN (SELECT session_id FROM crypto_megolm_inbound_session WHERE " + cryptoAccountFilter + ")",
+	"crypto_olm_session":                    cryptoAccountFilter,
+	"crypto_olm_message_hash":               cryptoAccountFilter,
+	"crypto_megolm_inbound_session":         cryptoAccountFilter,
+	"crypto_megolm_outbound_session":        cryptoAccountFilter,
+	"crypto_megolm_outbound_session_shared": "session_id IN (SELECT session_id FROM crypto_megolm_outbound_session WHERE " + cryptoAccountFilter + ")",
+	"crypto_secrets":                        cryptoAccountFilter,
+}
+
+// exportSkipColumns contains columns that are not exported, because they're generated by the database.
+var exportSkipColumns = map[string][]string{
+	"message": {"rowid"},
+}
+
+type DataExportLineType string
+
+const (
+	DataExportLineHeader DataExportLineType = "header"
+	DataExportLineRow    DataExportLineType = "row"
+	DataExportLineFooter DataExportLineType = "footer"
+)
+
+// DataExportHeader is the first line of a data export archive.
+type DataExportHeader struct {
+	FormatVersion int                `json:"format_version"`
+	BridgeName    string             `json:"bridge_name"`
+	BridgeVersion string             `json:"bridge_version"`
+	NetworkID     string             `json:"network_id"`
+	BridgeID      networkid.BridgeID `json:"bridge_id"`
+	DBVersion     int                `json:"db_version"`
+	// CryptoDBVersion is the version of the crypto store schema, or zero if the crypto store isn't included.
+	CryptoDBVersion int                `json:"crypto_db_version,omitempty"`
+	ExportedAt      jsontime.UnixMilli `json:"exported_at"`
+}
+
+// DataExportLine is a single line in a data export archive.
+//
+// The first line is always a header, followed by any number of rows and finally a footer with the total row count.
+// Binary values in rows are encoded as `{"bytes": "<base64>"}` and timestamps as `{"time": "<RFC 3339>"}`.
+type DataExportLine struct {
+	Type DataExportLineType `json:"type"`
+
+	Header *DataExportHeader `json:"header,omitempty"`
+
+	Table string         `json:"table,omitempty"`
+	Row   map[string]any `json:"row,omitempty"`
+
+	RowCount int `json:"row_count,omitempty"`
+}
+
+var validIdentifierRegex = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+func getDBVersion(ctx context.Context, db *dbutil.Database, versionTable string) (version int, err error) {
+	err = db.QueryRow(ctx, fmt.Sprintf("SELECT version FROM %s LIMIT 1", versionTable)).Scan(&version)
+	return
+}
+
+func exportValue(val any, dbType string) any {
+	switch typedVal := val.(type) {
+	case int64:
+		// SQLite stores booleans as integers, but Postgres won't accept integers in boolean columns.
+		if strings.ToUpper(dbType) == "BOOLEAN" {
+			return typedVal != 0
+		}
+		return val
+	case []byte:
+		switch strings.ToUpper(dbType) {
+		case "BYTEA", "BLOB":
+			return map[string]string{"bytes": base64.StdEncoding.EncodeToString(typedVal)}
+		default:
+			return string(typedVal)
+		}
+	case time.Time:
+		return map[string]string{"time": typedVal.Format(time.RFC3339Nano)}
+	default:
+		return val
+	}
+}
+
+func importValue(val any) (any, error) {
+	switch typedVal := val.(type) {
+	case json.Number:
+		if intVal, err := typedVal.Int64(); err == nil {
+			return intVal, nil
+		}
+		return typedVal.Float64()
+	case map[string]any:
+		if b64, ok := typedVal["bytes"].(string); ok {
+			return base64.StdEncoding.DecodeString(b64)
+		} else if ts, ok := typedVal["time"].(string); ok {
+			return time.Parse(time.RFC3339Nano, ts)
+		}
+		return nil, fmt.Errorf("unsupported object value with keys %v", maps.Keys(typedVal))
+	case nil, string, bool:
+		return val, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", val)
+	}
+}
+
+func (br *BridgeMain) cryptoAccountFilterArgs() []any {
+	accountID := string(br.Bridge.ID)
+	return []any{accountID, strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(accountID) + "/%"}
+}
+
+func (br *BridgeMain) exportTable(ctx context.Context, enc *json.Encoder, table, where string, args []any) (int, error) {
+	query := fmt.Sprintf(`SELECT * FROM "%s"`, table)
+	if where != "" {
+		query += " WHERE " + where
+	} else {
+		args = nil
+	}
+	rows, err := br.DB.Query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	skip := exportSkipColumns[table]
+	values := make([]any, len(columns))
+	valuePtrs := make([]any, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(valuePtrs...)
+		if err != nil {
+			return count, err
+		}
+		row := make(map[string]any, len(columns))
+		for i, col := range columns {
+			if !slices.Contains(skip, col.Name()) {
+				row[col.Name()] = exportValue(values[i], col.DatabaseTypeName())
+			}
+		}
+		err = enc.Encode(&DataExportLine{Type: DataExportLineRow, Table: table, Row: row})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// readOnlyDatabaseConfig returns a copy of the given database config that can't be used to modify the database.
+// It's used to open the source database when exporting data.
+func readOnlyDatabaseConfig(cfg dbutil.Config) dbutil.Config {
+	addParam := func(uri, param string) string {
+		if strings.ContainsRune(uri, '?') {
+			return uri + "&" + param
+		}
+		return uri + "?" + param
+	}
+	switch cfg.Type {
+	case "postgres":
+		if strings.HasPrefix(cfg.URI, "postgres://") || strings.HasPrefix(cfg.URI, "postgresql://") {
+			cfg.URI = addParam(cfg.URI, "default_transaction_read_only=on")
+		} else {
+			cfg.URI += " default_transaction_read_only=on"
+		}
+	default:
+		if !strings.HasPrefix(cfg.URI, "file:") {
+			cfg.URI = "file:" + cfg.URI
+		}
+		// Immediate transactions take a write lock, which isn't allowed in query-only mode
+		cfg.URI = strings.ReplaceAll(cfg.URI, "_txlock=immediate", "_txlock=deferred")
+		cfg.URI = addParam(cfg.URI, "_query_only=true")
+	}
+	return cfg
+}
+
+// ExportData writes all bridge data into the given writer as a JSON lines archive.
+// If includeCrypto is true, the end-to-bridge encryption store is included as well.
+//
+// The database is never modified: it must already be on the latest schema version known by this bridge,
+// and the export runs in a single read-only transaction. When using the --export-data flag,
+// the database connection is also opened in read-only mode.
+func (br *BridgeMain) ExportData(ctx context.Context, w io.Writer, includeCrypto bool) error {
+	header := &DataExportHeader{
+		FormatVersion: DataExportFormatVersion,
+		BridgeName:    br.Name,
+		BridgeVersion: br.Version,
+		NetworkID:     br.Connector.GetName().NetworkID,
+		BridgeID:      br.Bridge.ID,
+		ExportedAt:    jsontime.UnixMilliNow(),
+	}
+	var err error
+	header.DBVersion, err = getDBVersion(ctx, br.DB, br.DB.VersionTable)
+	if err != nil {
+		return fmt.Errorf("failed to get database version: %w", err)
+	} else if latest := len(br.Bridge.DB.UpgradeTable); header.DBVersion != latest {
+		return fmt.Errorf("database is on version %d, but this bridge requires version %d (start the bridge normally to upgrade it)", header.DBVersion, latest)
+	}
+	if includeCrypto {
+		if exists, err := br.DB.TableExists(ctx, sql_store_upgrade.VersionTableName); err != nil {
+			return fmt.Errorf("failed to check if crypto store exists: %w", err)
+		} else if !exists {
+			return fmt.Errorf("crypto store hasn't been initialized")
+		}
+		header.CryptoDBVersion, err = getDBVersion(ctx, br.DB, sql_store_upgrade.VersionTableName)
+		if err != nil {
+			return fmt.Errorf("failed to get crypto store version: %w", err)
+		} else if latest := len(sql_store_upgrade.Table); header.CryptoDBVersion != latest {
+			return fmt.Errorf("crypto store is on version %d, but this bridge requires version %d (start the bridge normally to upgrade it)", header.CryptoDBVersion, latest)
+		}
+	}
+	return br.DB.DoTxn(ctx, &dbutil.TxnOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead}, func(ctx context.Context) error {
+		return br.exportData(ctx, w, header)
+	})
+}
+
+func (br *BridgeMain) exportData(ctx context.Context, w io.Writer, header *DataExportHeader) error {
+	bufWriter := bufio.NewWriter(w)
+	enc := json.NewEncoder(bufWriter)
+	err := enc.Encode(&DataExportLine{Type: DataExportLineHeader, Header: header})
+	if err != nil {
+		return err
+	}
+	totalCount := 0
+	exportTables := func(tables []string, filters map[string]string, args []any) error {
+		for _, table := range tables {
+			count, err := br.exportTable(ctx, enc, table, filters[table], args)
+			if err != nil {
+				return fmt.Errorf("failed to export %s: %w", table, err)
+			}
+			br.Log.Debug().Str("table", table).Int("row_count", count).Msg("Exported table")
+			totalCount += count
+		}
+		return nil
+	}
+	bridgeFilters := make(map[string]string, len(bridgeExportTables))
+	for _, table := range bridgeExportTables {
+		bridgeFilters[table] = "bridge_id=$1"
+	}
+	if err = exportTables(bridgeExportTables, bridgeFilters, []any{br.Bridge.ID}); err != nil {
+		return err
+	}
+	if header.CryptoDBVersion != 0 {
+		if err = exportTables(cryptoExportTables, cryptoExportFilters, br.cryptoAccountFilterArgs()); err != nil {
+			return err
+		}
+	}
+	err = enc.Encode(&DataExportLine{Type: DataExportLineFooter, RowCount: totalCount})
+	if err != nil {
+		return err
+	}
+	br.Log.Info().Int("row_count", totalCount).Msg("Data export complete")
+	return bufWriter.Flush()
+}
+
+type pendingPortalParent struct {
+	id, receiver, parentID any
+}
+
+func (br *BridgeMain) checkImportTargetEmpty(ctx context.Context, cryptoIncluded bool) error {
+	for _, table := range bridgeExportTables {
+		var exists bool
+		err := br.DB.QueryRow(ctx, fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM "%s" WHERE bridge_id=$1)`, table), br.Bridge.ID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check if %s is empty: %w", table, err)
+		} else if exists {
+			return fmt.Errorf("table %s already contains data for this bridge", table)
+		}
+	}
+	if cryptoIncluded {
+		var exists bool
+		err := br.DB.QueryRow(
+			ctx, "SELECT EXISTS(SELECT 1 FROM crypto_account WHERE "+cryptoAccountFilter+")", br.cryptoAccountFilterArgs()...,
+		).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check if crypto store is empty: %w", err)
+		} else if exists {
+			return fmt.Errorf("crypto store already contains an account for this bridge")
+		}
+	}
+	return nil
+}
+
+func (br *BridgeMain) importRow(ctx context.Context, header *DataExportHeader, line *DataExportLine, pendingParents *[]pendingPortalParent) error {
+	isBridgeTable := slices.Contains(bridgeExportTables, line.Table)
+	if !isBridgeTable && (header.CryptoDBVersion == 0 || !slices.Contains(cryptoExportTables, line.Table)) {
+		return fmt.Errorf("unexpected table %q", line.Table)
+	} else if len(line.Row) == 0 {
+		return fmt.Errorf("empty row in %s", line.Table)
+	}
+	if isBridgeTable && line.Row["bridge_id"] != string(header.BridgeID) {
+		return fmt.Errorf("row in %s has unexpected bridge ID %v", line.Table, line.Row["bridge_id"])
+	} else if accountID, ok := line.Row["account_id"].(string); ok && !isBridgeTable &&
+		accountID != string(header.BridgeID) && !strings.HasPrefix(accountID, string(header.BridgeID)+"/") {
+		return fmt.Errorf("row in %s has unexpected crypto account ID %q", line.Table, accountID)
+	}
+	if line.Table == "portal" && line.Row["parent_id"] != nil {
+		// Parent portals may come after their children, so set parents after all portals have been inserted.
+		*pendingParents = append(*pendingParents, pendingPortalParent{
+			id:       line.Row["id"],
+			receiver: line.Row["receiver"],
+			parentID: line.Row["parent_id"],
+		})
+		line.Row["parent_id"] = nil
+	}
+	columns := maps.Keys(line.Row)
+	slices.Sort(columns)
+	quotedColumns := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	args := make([]any, len(columns))
+	for i, col := range columns {
+		if !validIdentifierRegex.MatchString(col) {
+			return fmt.Errorf("invalid column name %q in %s", col, line.Table)
+		}
+		var err error
+		args[i], err = importValue(line.Row[col])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s.%s: %w", line.Table, col, err)
+		}
+		quotedColumns[i] = fmt.Sprintf(`"%s"`, col)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" (%s) VALUES (%s)`,
+		line.Table, strings.Join(quotedColumns, ", "), strings.Join(placeholders, ", "),
+	)
+	if _, isAccountData := cryptoExportFilters[line.Table]; !isBridgeTable && !isAccountData {
+		// Shared caches may already contain the same keys if another bridge uses the same database.
+		query += " ON CONFLICT DO NOTHING"
+	}
+	_, err := br.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to insert row into %s: %w", line.Table, err)
+	}
+	return nil
+}
+
+// ImportData reads an archive created by [BridgeMain.ExportData] and inserts all the data into the database.
+//
+// The archive must have been exported by a bridge with the same network and bridge ID and the same database schema
+// version, and the target database must not contain any data for the bridge. The database type doesn't matter,
+// so this can be used to move between SQLite and Postgres. All data is imported in a single transaction.
+//
+// Values are exported in a database-independent form (e.g. booleans stored as integers by SQLite are exported as
+// JSON booleans), but the automated tests only cover SQLite, so moving to Postgres should be verified manually
+// by starting the bridge on the new database before deleting the old one.
+func (br *BridgeMain) ImportData(ctx context.Context, r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	var headerLine DataExportLine
+	err := dec.Decode(&headerLine)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	header := headerLine.Header
+	if headerLine.Type != DataExportLineHeader || header == nil {
+		return fmt.Errorf("first line is not a header")
+	} else if header.FormatVersion != DataExportFormatVersion {
+		return fmt.Errorf("unsupported export format version %d (expected %d)", header.FormatVersion, DataExportFormatVersion)
+	} else if networkID := br.Connector.GetName().NetworkID; header.NetworkID != networkID {
+		return fmt.Errorf("export is for network %q, but this bridge is for %q", header.NetworkID, networkID)
+	} else if header.BridgeID != br.Bridge.ID {
+		return fmt.Errorf("export is for bridge ID %q, but this bridge has ID %q", header.BridgeID, br.Bridge.ID)
+	}
+	err = br.Bridge.DB.Upgrade(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	dbVersion, err := getDBVersion(ctx, br.DB, br.DB.VersionTable)
+	if err != nil {
+		return fmt.Errorf("failed to get database version: %w", err)
+	} else if dbVersion != header.DBVersion {
+		return fmt.Errorf("export has database version %d, but the target database is on version %d", header.DBVersion, dbVersion)
+	}
+	if header.CryptoDBVersion != 0 {
+		cryptoDB := br.DB.Child(sql_store_upgrade.VersionTableName, sql_store_upgrade.Table, nil)
+		err = cryptoDB.Upgrade(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade crypto store: %w", err)
+		}
+		cryptoDBVersion, err := getDBVersion(ctx, br.DB, sql_store_upgrade.VersionTableName)
+		if err != nil {
+			return fmt.Errorf("failed to get crypto store version: %w", err)
+		} else if cryptoDBVersion != header.CryptoDBVersion {
+			return fmt.Errorf("export has crypto store version %d, but the target database is on version %d", header.CryptoDBVersion, cryptoDBVersion)
+		}
+	}
+	err = br.checkImportTargetEmpty(ctx, header.CryptoDBVersion != 0)
+	if err != nil {
+		return err
+	}
+	br.Log.Info().
+		Str("exported_by", header.BridgeName).
+		Str("exported_version", header.BridgeVersion).
+		Time("exported_at", header.ExportedAt.Time).
+		Bool("includes_crypto", header.CryptoDBVersion != 0).
+		Msg("Importing bridge data")
+	return br.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		var pendingParents []pendingPortalParent
+		rowCount := 0
+		for {
+			var line DataExportLine
+			err := dec.Decode(&line)
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("archive ended without footer (read %d rows)", rowCount)
+			} else if err != nil {
+				return fmt.Errorf("failed to read line after %d rows: %w", rowCount, err)
+			}
+			switch line.Type {
+			case DataExportLineRow:
+				err = br.importRow(ctx, header, &line, &pendingParents)
+				if err != nil {
+					return err
+				}
+				rowCount++
+			case DataExportLineFooter:
+				if line.RowCount != rowCount {
+					return fmt.Errorf("footer says archive has %d rows, but read %d", line.RowCount, rowCount)
+				}
+				for _, parent := range pendingParents {
+					_, err = br.DB.Exec(
+						ctx, "UPDATE portal SET parent_id=$1 WHERE bridge_id=$2 AND id=$3 AND receiver=$4",
+						parent.parentID, br.Bridge.ID, parent.id, parent.receiver,
+					)
+					if err != nil {
+						return fmt.Errorf("failed to set portal parent: %w", err)
+					}
+				}
+				br.Log.Info().Int("row_count", rowCount).Msg("Data import complete")
+				return nil
+			default:
+				return fmt.Errorf("unexpected line type %q after %d rows", line.Type, rowCount)
+			}
+		}
+	})
+}
+
+func (br *BridgeMain) runDataTransfer() {
+	ctx := br.Log.WithContext(context.Background())
+	if *exportDataPath != "" {
+		file, err := os.OpenFile(*exportDataPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			br.Log.Fatal().Err(err).Msg("Failed to create export file")
+		}
+		err = br.ExportData(ctx, file, *exportCrypto)
+		_ = file.Close()
+		if err != nil {
+			_ = os.Remove(*exportDataPath)
+			br.Log.Fatal().Err(err).Msg("Failed to export data")
+		}
+	} else if *importDataPath != "" {
+		file, err := os.Open(*importDataPath)
+		if err != nil {
+			br.Log.Fatal().Err(err).Msg("Failed to open import file")
+		}
+		err = br.ImportData(ctx, file)
+		_ = file.Close()
+		if err != nil {
+			br.Log.Fatal().Err(err).Msg("Failed to import data")
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mxmain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+)
+
+type exportTestConnector struct {
+	bridgev2.NetworkConnector
+}
+
+func (etc *exportTestConnector) Init(*bridgev2.Bridge)              {}
+func (etc *exportTestConnector) GetDBMetaTypes() database.MetaTypes { return database.MetaTypes{} }
+func (etc *exportTestConnector) GetName() bridgev2.BridgeName {
+	return bridgev2.BridgeName{DisplayName: "Test", NetworkID: "test"}
+}
+
+func newExportTestBridge(t *testing.T, cfg dbutil.Config) *BridgeMain {
+	return newExportTestBridgeWithID(t, "", cfg)
+}
+
+func newExportTestBridgeWithID(t *testing.T, bridgeID networkid.BridgeID, cfg dbutil.Config) *BridgeMain {
+	t.Helper()
+	db, err := dbutil.NewFromConfig("", cfg, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	log := zerolog.New(zerolog.NewTestWriter(t))
+	br := &BridgeMain{
+		Name:      "mautrix-test",
+		Version:   "0.1.0",
+		Connector: &exportTestConnector{},
+		Log:       &log,
+		DB:        db,
+	}
+	br.Bridge = bridgev2.NewBridge(bridgeID, db, log, &bridgeconfig.BridgeConfig{}, bridgetest.NewMatrixConnector(), br.Connector, commands.NewProcessor)
+	return br
+}
+
+func sqliteFileConfig(path string) dbutil.Config {
+	return dbutil.Config{PoolConfig: dbutil.PoolConfig{
+		Type:         "sqlite3-fk-wal",
+		URI:          fmt.Sprintf("file:%s?_txlock=immediate", path),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	}}
+}
+
+func TestReadOnlyDatabaseConfig(t *testing.T) {
+	for _, test := range []struct{ typ, uri, expected string }{
+		{"sqlite3-fk-wal", "bridge.db", "file:bridge.db?_query_only=true"},
+		{"sqlite3-fk-wal", "file:bridge.db?_txlock=immediate", "file:bridge.db?_txlock=deferred&_query_only=true"},
+		{"postgres", "postgres://user@localhost/bridge", "postgres://user@localhost/bridge?default_transaction_read_only=on"},
+		{"postgres", "postgres://user@localhost/bridge?sslmode=disable", "postgres://user@localhost/bridge?sslmode=disable&default_transaction_read_only=on"},
+		{"postgres", "host=localhost dbname=bridge", "host=localhost dbname=bridge default_transaction_read_only=on"},
+	} {
+		cfg := readOnlyDatabaseConfig(dbutil.Config{PoolConfig: dbutil.PoolConfig{Type: test.typ, URI: test.uri}})
+		assert.Equal(t, test.expected, cfg.URI)
+	}
+}
+
+func TestDataExportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srcPath := filepath.Join(t.TempDir(), "source.db")
+	src := newExportTestBridge(t, sqliteFileConfig(srcPath))
+	require.NoError(t, src.Bridge.DB.Upgrade(ctx))
+	require.NoError(t, src.Bridge.DB.User.Insert(ctx, &database.User{MXID: "@user:example.com"}))
+	require.NoError(t, src.Bridge.DB.UserLogin.Insert(ctx, &database.UserLogin{UserMXID: "@user:example.com", ID: "login"}))
+	space := networkid.PortalKey{ID: "space"}
+	chat := networkid.PortalKey{ID: "chat", Receiver: "login"}
+	// Insert the child first to make sure parents are restored even if they come later in the archive.
+	require.NoError(t, src.Bridge.DB.Portal.Insert(ctx, &database.Portal{PortalKey: space, Name: "Space", RoomType: database.RoomTypeSpace}))
+	require.NoError(t, src.Bridge.DB.Portal.Insert(ctx, &database.Portal{PortalKey: chat, MXID: "!chat:example.com", ParentKey: space, Name: "Chat"}))
+	require.NoError(t, src.Bridge.DB.Ghost.Insert(ctx, &database.Ghost{ID: "alice", Name: "Alice"}))
+	ts := time.UnixMilli(1700000000000)
+	require.NoError(t, src.Bridge.DB.Message.Insert(ctx, &database.Message{
+		ID: "msg1", MXID: "$msg1", Room: chat, SenderID: "alice", Timestamp: ts,
+	}))
+	src.Bridge.DB.KV.Set(ctx, database.KeySplitPortalsEnabled, "true")
+	require.NoError(t, src.DB.Close())
+
+	// Export through a read-only connection like the --export-data flag does
+	exporter := newExportTestBridge(t, readOnlyDatabaseConfig(sqliteFileConfig(srcPath)))
+	_, err := exporter.DB.Exec(ctx, "DELETE FROM message")
+	require.Error(t, err, "read-only database allowed a write")
+	var archive bytes.Buffer
+	require.NoError(t, exporter.ExportData(ctx, &archive, false))
+
+	dst := newExportTestBridge(t, sqliteFileConfig(filepath.Join(t.TempDir(), "target.db")))
+	require.NoError(t, dst.ImportData(ctx, bytes.NewReader(archive.Bytes())))
+
+	portal, err := dst.Bridge.DB.Portal.GetByKey(ctx, chat)
+	require.NoError(t, err)
+	require.NotNil(t, portal)
+	assert.Equal(t, "Chat", portal.Name)
+	assert.Equal(t, space, portal.ParentKey)
+	msg, err := dst.Bridge.DB.Message.GetFirstPortalMessage(ctx, chat)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.EqualValues(t, "$msg1", msg.MXID)
+	assert.True(t, ts.Equal(msg.Timestamp))
+	login, err := dst.Bridge.DB.UserLogin.GetByID(ctx, "login")
+	require.NoError(t, err)
+	require.NotNil(t, login)
+	assert.EqualValues(t, "@user:example.com", login.UserMXID)
+	assert.Equal(t, "true", dst.Bridge.DB.KV.Get(ctx, database.KeySplitPortalsEnabled))
+
+	// Importing again must fail because the target isn't empty
+	assert.Error(t, dst.ImportData(ctx, bytes.NewReader(archive.Bytes())))
+}
+
+func TestDataExportRefusesOutdatedSchema(t *testing.T) {
+	ctx := context.Background()
+	srcPath := filepath.Join(t.TempDir(), "source.db")
+	src := newExportTestBridge(t, sqliteFileConfig(srcPath))
+	require.NoError(t, src.Bridge.DB.Upgrade(ctx))
+	_, err := src.DB.Exec(ctx, fmt.Sprintf("UPDATE %s SET version=version-1", src.DB.VersionTable))
+	require.NoError(t, err)
+	require.NoError(t, src.DB.Close())
+
+	exporter := newExportTestBridge(t, readOnlyDatabaseConfig(sqliteFileConfig(srcPath)))
+	err = exporter.ExportData(ctx, &bytes.Buffer{}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "start the bridge normally to upgrade it")
+}
+
+func initExportTestCryptoStore(t *testing.T, br *BridgeMain, accountIDs ...string) {
+	t.Helper()
+	ctx := context.Background()
+	require.NoError(t, br.Bridge.DB.Upgrade(ctx))
+	require.NoError(t, br.DB.Child(sql_store_upgrade.VersionTableName, sql_store_upgrade.Table, nil).Upgrade(ctx))
+	for _, accountID := range accountIDs {
+		_, err := br.DB.Exec(
+			ctx, "INSERT INTO crypto_account (account_id, device_id, shared, sync_token, account) VALUES ($1, 'DEVICE', true, '', $2)",
+			accountID, []byte("pickle"),
+		)
+		require.NoError(t, err)
+	}
+	_, err := br.DB.Exec(ctx, "INSERT INTO crypto_tracked_user (user_id) VALUES ('@user:example.com')")
+	require.NoError(t, err)
+}
+
+func TestDataExportCryptoOnlyIncludesOwnAccounts(t *testing.T) {
+	ctx := context.Background()
+	src := newExportTestBridgeWithID(t, "my_bridge", sqliteFileConfig(filepath.Join(t.TempDir(), "source.db")))
+	// The _ in the bridge ID must not act as a wildcard when matching ghost accounts.
+	initExportTestCryptoStore(t, src, "my_bridge", "my_bridge/@ghost:example.com", "other", "other/@ghost:example.com", "myxbridge/@ghost:example.com")
+	var archive bytes.Buffer
+	require.NoError(t, src.ExportData(ctx, &archive, true))
+
+	var accountIDs []string
+	dec := json.NewDecoder(bytes.NewReader(archive.Bytes()))
+	for dec.More() {
+		var line DataExportLine
+		require.NoError(t, dec.Decode(&line))
+		if line.Table == "crypto_account" {
+			accountIDs = append(accountIDs, line.Row["account_id"].(string))
+			assert.Equal(t, true, line.Row["shared"], "boolean wasn't exported as a JSON boolean")
+		}
+	}
+	assert.ElementsMatch(t, []string{"my_bridge", "my_bridge/@ghost:example.com"}, accountIDs)
+
+	// The target database is shared with another bridge that has also cached the same user.
+	dst := newExportTestBridgeWithID(t, "my_bridge", sqliteFileConfig(filepath.Join(t.TempDir(), "target.db")))
+	initExportTestCryptoStore(t, dst, "other")
+	require.NoError(t, dst.ImportData(ctx, bytes.NewReader(archive.Bytes())))
+	var accountCount int
+	require.NoError(t, dst.DB.QueryRow(ctx, "SELECT COUNT(*) FROM crypto_account").Scan(&accountCount))
+	assert.Equal(t, 3, accountCount)
+}
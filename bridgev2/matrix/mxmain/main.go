@@ -17,6 +17,7 @@ import (
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -46,6 +47,13 @@ var versionJSON = flag.Make().LongKey("version-json").Usage("Print a JSON object
 var ignoreUnsupportedDatabase = flag.Make().LongKey("ignore-unsupported-database").Usage("Run even if the database schema is too new").Default("false").Bool()
 var ignoreForeignTables = flag.Make().LongKey("ignore-foreign-tables").Usage("Run even if the database contains tables from other programs (like Synapse)").Default("false").Bool()
 var ignoreUnsupportedServer = flag.Make().LongKey("ignore-unsupported-server").Usage("Run even if the Matrix homeserver is outdated").Default("false").Bool()
+var runSetup = flag.Make().LongKey("setup").Usage("Interactively set up the config file and registration and quit.").Default("false").Bool()
+var runSetupFromEnv = flag.Make().LongKey("setup-from-env").Usage("Set up the config file and registration using MAUTRIX_SETUP_* environment variables and quit.").Default("false").Bool()
+var exportDataPath = flag.Make().LongKey("export-data").Usage("Export all bridge data from the database into the given file and quit.").String()
+var exportCrypto = flag.Make().LongKey("export-crypto").Usage("Include the encryption store in --export-data.").Default("false").Bool()
+var importDataPath = flag.Make().LongKey("import-data").Usage("Import bridge data from a file created with --export-data into an empty database and quit.").String()
+var checkRegistration = flag.Make().LongKey("check-registration").Usage("Check that the registration file is valid and matches the config, then quit.").Default("false").Bool()
+var otherRegistrationsDir = flag.Make().LongKey("other-registrations").Usage("A directory of other registration files to check for namespace conflicts with --check-registration.").String()
 var wantHelp, _ = flag.MakeHelpFlag()
 
 // BridgeMain contains the main function for a Matrix bridge.
@@ -92,6 +100,10 @@ type BridgeMain struct {
 	AdditionalLongFlags  string
 
 	manualStop chan int
+	reloadLock sync.Mutex
+	// reloadedConfig is the config with the latest reloaded sections applied.
+	// Config itself is never modified after startup.
+	reloadedConfig *bridgeconfig.Config
 }
 
 type VersionJSONOutput struct {
@@ -179,11 +191,15 @@ func (br *BridgeMain) PreInit() {
 			fmt.Println("Wrote example config to", *configPath)
 		}
 		os.Exit(0)
+	} else if *runSetup || *runSetupFromEnv {
+		br.RunSetup(*runSetup)
 	}
 	br.LoadConfig()
 	if *generateRegistration {
 		br.GenerateRegistration()
 		os.Exit(0)
+	} else if *checkRegistration {
+		os.Exit(br.CheckRegistration(*otherRegistrationsDir))
 	}
 }
 
@@ -197,6 +213,7 @@ func (br *BridgeMain) GenerateRegistration() {
 		os.Exit(20)
 	}
 	reg := br.Config.GenerateRegistration()
+	reg.Protocols = []string{br.Connector.GetName().NetworkID}
 	err := reg.Save(br.RegistrationPath)
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, "Failed to save registration:", err)
@@ -248,6 +265,7 @@ func (br *BridgeMain) Init() {
 	}
 	br.Matrix.IgnoreUnsupportedServer = *ignoreUnsupportedServer
 	br.Bridge = bridgev2.NewBridge("", br.DB, *br.Log, &br.Config.Bridge, br.Matrix, br.Connector, commands.NewProcessor)
+	br.Bridge.Version = br.LinkifiedVersion
 	br.Matrix.AS.DoublePuppetValue = br.Name
 	br.Bridge.Commands.(*commands.Processor).AddHandler(&commands.FullHandler{
 		Func: func(ce *commands.Event) {
@@ -259,9 +277,22 @@ func (br *BridgeMain) Init() {
 			Description: "Get the bridge version.",
 		},
 	})
+	br.Bridge.Commands.(*commands.Processor).AddHandler(&commands.FullHandler{
+		Func: br.fnReloadConfig,
+		Name: "reload-config",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Reload the parts of the config that can be changed without restarting.",
+		},
+		RequiresAdmin: true,
+	})
 	if br.PostInit != nil {
 		br.PostInit()
 	}
+	if *exportDataPath != "" || *importDataPath != "" {
+		br.runDataTransfer()
+		os.Exit(0)
+	}
 }
 
 func (br *BridgeMain) initDB() {
@@ -284,6 +315,9 @@ func (br *BridgeMain) initDB() {
 			Str("fixed_uri_example", fixedExampleURI).
 			Msg("Using SQLite without _txlock=immediate is not recommended")
 	}
+	if *exportDataPath != "" {
+		dbConfig = readOnlyDatabaseConfig(dbConfig)
+	}
 	var err error
 	br.DB, err = dbutil.NewFromConfig("megabridge/"+br.Name, dbConfig, dbutil.ZeroLogger(br.Log.With().Str("db_section", "main").Logger()))
 	if err != nil {
@@ -350,8 +384,7 @@ func (br *BridgeMain) LoadConfig() {
 		}
 	}
 
-	var cfg bridgeconfig.Config
-	err = yaml.Unmarshal(configData, &cfg)
+	cfg, err := parseConfig(configData)
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, "Failed to parse config:", err)
 		os.Exit(10)
@@ -363,8 +396,76 @@ func (br *BridgeMain) LoadConfig() {
 			os.Exit(10)
 		}
 	}
+	br.Config = cfg
+}
+
+func (br *BridgeMain) fnReloadConfig(ce *commands.Event) {
+	result, err := br.ReloadConfig(ce.Ctx)
+	if err != nil {
+		ce.Reply("Failed to reload config: %v", err)
+		return
+	} else if !result.HasChanges() {
+		ce.Reply("No config changes found")
+		return
+	}
+	var parts []string
+	if len(result.Reloaded) > 0 {
+		parts = append(parts, fmt.Sprintf("Reloaded `%s`", strings.Join(result.Reloaded, "`, `")))
+	}
+	if len(result.RequiresRestart) > 0 {
+		parts = append(parts, fmt.Sprintf("Changes to `%s` require restarting the bridge", strings.Join(result.RequiresRestart, "`, `")))
+	}
+	ce.Reply(strings.Join(parts, "\n\n"))
+}
+
+func parseConfig(data []byte) (*bridgeconfig.Config, error) {
+	var cfg bridgeconfig.Config
+	err := yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, err
+	}
 	cfg.Bridge.Backfill = cfg.Backfill
-	br.Config = &cfg
+	return &cfg, nil
+}
+
+// ReloadConfig re-reads the config file and applies the sections that can be changed at runtime
+// (see [bridgeconfig.ReloadableSections]). Changes to other sections are only reported in the result.
+//
+// The reloaded sections are published through [bridgev2.Bridge.ReloadConfig], so code running after startup
+// must read them from [bridgev2.Bridge.GetConfig] rather than the Config field of BridgeMain, which isn't changed.
+//
+// This is called automatically when the bridge receives SIGHUP or the reload-config command is used.
+func (br *BridgeMain) ReloadConfig(ctx context.Context) (*bridgeconfig.ReloadResult, error) {
+	br.reloadLock.Lock()
+	defer br.reloadLock.Unlock()
+	upgrader, _ := br.getConfigUpgrader()
+	configData, _, err := configupgrade.Do(br.ConfigPath, br.SaveConfig, upgrader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade config: %w", err)
+	}
+	newCfg, err := parseConfig(configData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	} else if !newCfg.Bridge.Permissions.IsConfigured() {
+		return nil, fmt.Errorf("bridge.permissions not configured")
+	}
+	current := br.reloadedConfig
+	if current == nil {
+		current = br.Config
+	}
+	merged, result := current.MergeReloadable(newCfg)
+	log := zerolog.Ctx(ctx)
+	if len(result.Reloaded) > 0 {
+		br.reloadedConfig = merged
+		br.Bridge.ReloadConfig(&merged.Bridge)
+		log.Info().Strs("sections", result.Reloaded).Msg("Reloaded config")
+	}
+	if len(result.RequiresRestart) > 0 {
+		log.Warn().Strs("sections", result.RequiresRestart).Msg("Config changes in some sections require restarting the bridge")
+	} else if !result.HasChanges() {
+		log.Info().Msg("No config changes found")
+	}
+	return result, nil
 }
 
 // Start starts the bridge after everything has been initialized.
@@ -392,17 +493,28 @@ func (br *BridgeMain) Start() {
 	}
 }
 
-// WaitForInterrupt waits for a SIGINT or SIGTERM signal.
+// WaitForInterrupt waits for a SIGINT or SIGTERM signal. SIGHUP signals received while waiting reload the config.
 func (br *BridgeMain) WaitForInterrupt() int {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-c:
-		br.Log.Info().Msg("Interrupt signal received from OS")
-		return 0
-	case exitCode := <-br.manualStop:
-		br.Log.Info().Msg("Internal stop signal received")
-		return exitCode
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-c:
+			br.Log.Info().Msg("Interrupt signal received from OS")
+			return 0
+		case exitCode := <-br.manualStop:
+			br.Log.Info().Msg("Internal stop signal received")
+			return exitCode
+		case <-hup:
+			br.Log.Info().Msg("SIGHUP received, reloading config")
+			_, err := br.ReloadConfig(br.Log.WithContext(context.Background()))
+			if err != nil {
+				br.Log.Err(err).Msg("Failed to reload config")
+			}
+		}
 	}
 }
 
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -126,6 +127,9 @@ func (prov *ProvisioningAPI) Init() {
 	prov.Router.Path("/v3/resolve_identifier/{identifier}").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(prov.GetResolveIdentifier)
 	prov.Router.Path("/v3/create_dm/{identifier}").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(prov.PostCreateDM)
 	prov.Router.Path("/v3/create_group").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(prov.PostCreateGroup)
+	prov.Router.Path("/v3/backfill").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(prov.GetBackfillTasks)
+	prov.Router.Path("/v3/backfill/{roomID}").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(prov.GetBackfillTask)
+	prov.Router.Path("/v3/backfill/{roomID}/{action:pause|resume|restart|prioritize|more}").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(prov.PostBackfillAction)
 
 	if prov.br.Config.Provisioning.DebugEndpoints {
 		prov.log.Debug().Msg("Enabling debug API at /debug")
@@ -263,7 +267,7 @@ func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 		}
 		// TODO handle user being nil?
 		// TODO per-endpoint permissions?
-		if !user.Permissions.Login {
+		if !user.GetPermissions().Login {
 			jsonResponse(w, http.StatusForbidden, &mautrix.RespError{
 				Err:     "User does not have login permissions",
 				ErrCode: mautrix.MForbidden.ErrCode,
@@ -790,3 +794,157 @@ func (prov *ProvisioningAPI) PostCreateGroup(w http.ResponseWriter, r *http.Requ
 		ErrCode: mautrix.MUnrecognized.ErrCode,
 	})
 }
+
+type RespBackfillTask struct {
+	PortalID       networkid.PortalID    `json:"portal_id"`
+	PortalReceiver networkid.UserLoginID `json:"portal_receiver,omitempty"`
+	RoomID         id.RoomID             `json:"room_id,omitempty"`
+	LoginID        networkid.UserLoginID `json:"login_id"`
+
+	BatchCount      int                `json:"batch_count"`
+	ExtraBatches    int                `json:"extra_batches"`
+	IsDone          bool               `json:"is_done"`
+	Paused          bool               `json:"paused"`
+	MessageCount    int                `json:"message_count"`
+	OldestMessageTS jsontime.UnixMilli `json:"oldest_message_ts"`
+	DispatchedAt    jsontime.UnixMilli `json:"dispatched_at"`
+	CompletedAt     jsontime.UnixMilli `json:"completed_at"`
+}
+
+type RespGetBackfillTasks struct {
+	Tasks []*RespBackfillTask `json:"tasks"`
+}
+
+func (prov *ProvisioningAPI) makeRespBackfillTask(ctx context.Context, info *bridgev2.BackfillTaskInfo) *RespBackfillTask {
+	resp := &RespBackfillTask{
+		PortalID:        info.PortalKey.ID,
+		PortalReceiver:  info.PortalKey.Receiver,
+		LoginID:         info.UserLoginID,
+		BatchCount:      max(info.BatchCount, 0),
+		ExtraBatches:    info.ExtraBatches,
+		IsDone:          info.IsDone,
+		Paused:          info.Paused,
+		MessageCount:    info.MessageCount,
+		OldestMessageTS: jsontime.UM(info.OldestMessageTS),
+		DispatchedAt:    jsontime.UM(info.DispatchedAt),
+		CompletedAt:     jsontime.UM(info.CompletedAt),
+	}
+	portal, err := prov.br.Bridge.GetExistingPortalByKey(ctx, info.PortalKey)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Object("portal_key", info.PortalKey).Msg("Failed to get portal for backfill task")
+	} else if portal != nil {
+		resp.RoomID = portal.MXID
+	}
+	return resp
+}
+
+func (prov *ProvisioningAPI) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !prov.GetUser(r).GetPermissions().Admin {
+		jsonResponse(w, http.StatusForbidden, &mautrix.RespError{
+			Err:     "This endpoint requires admin permissions",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return false
+	}
+	return true
+}
+
+func (prov *ProvisioningAPI) getPortalForBackfillRequest(w http.ResponseWriter, r *http.Request) *bridgev2.Portal {
+	portal, err := prov.br.Bridge.GetPortalByMXID(r.Context(), id.RoomID(mux.Vars(r)["roomID"]))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get portal")
+		jsonResponse(w, http.StatusInternalServerError, &mautrix.RespError{
+			Err:     "Failed to get portal",
+			ErrCode: "M_UNKNOWN",
+		})
+		return nil
+	} else if portal == nil {
+		jsonResponse(w, http.StatusNotFound, &mautrix.RespError{
+			Err:     "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return nil
+	}
+	return portal
+}
+
+func (prov *ProvisioningAPI) GetBackfillTasks(w http.ResponseWriter, r *http.Request) {
+	if !prov.requireAdmin(w, r) {
+		return
+	}
+	infos, err := prov.br.Bridge.GetAllBackfillTaskInfo(r.Context())
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get backfill tasks")
+		RespondWithError(w, err, "Internal error getting backfill tasks")
+		return
+	}
+	resp := &RespGetBackfillTasks{Tasks: make([]*RespBackfillTask, len(infos))}
+	for i, info := range infos {
+		resp.Tasks[i] = prov.makeRespBackfillTask(r.Context(), info)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func (prov *ProvisioningAPI) GetBackfillTask(w http.ResponseWriter, r *http.Request) {
+	if !prov.requireAdmin(w, r) {
+		return
+	}
+	portal := prov.getPortalForBackfillRequest(w, r)
+	if portal == nil {
+		return
+	}
+	task, err := prov.br.Bridge.DB.BackfillTask.GetByPortal(r.Context(), portal.PortalKey)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get backfill task")
+		RespondWithError(w, err, "Internal error getting backfill task")
+		return
+	} else if task == nil {
+		jsonResponse(w, http.StatusNotFound, &mautrix.RespError{
+			Err:     "Backfill task not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	}
+	info, err := prov.br.Bridge.GetBackfillTaskInfo(r.Context(), task)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get backfill task info")
+		RespondWithError(w, err, "Internal error getting backfill task")
+		return
+	}
+	jsonResponse(w, http.StatusOK, prov.makeRespBackfillTask(r.Context(), info))
+}
+
+func (prov *ProvisioningAPI) PostBackfillAction(w http.ResponseWriter, r *http.Request) {
+	if !prov.requireAdmin(w, r) {
+		return
+	}
+	portal := prov.getPortalForBackfillRequest(w, r)
+	if portal == nil {
+		return
+	}
+	action := bridgev2.BackfillControlAction(mux.Vars(r)["action"])
+	batches := 1
+	if batchesStr := r.URL.Query().Get("batches"); batchesStr != "" {
+		var err error
+		batches, err = strconv.Atoi(batchesStr)
+		if err != nil || batches <= 0 {
+			jsonResponse(w, http.StatusBadRequest, &mautrix.RespError{
+				Err:     "Batch count must be a positive integer",
+				ErrCode: mautrix.MInvalidParam.ErrCode,
+			})
+			return
+		}
+	}
+	err := prov.br.Bridge.ControlBackfill(r.Context(), portal.PortalKey, action, batches)
+	if errors.Is(err, bridgev2.ErrBackfillTaskNotFound) {
+		jsonResponse(w, http.StatusNotFound, &mautrix.RespError{
+			Err:     "Backfill task not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+	} else if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to control backfill task")
+		RespondWithError(w, err, "Internal error updating backfill task")
+	} else {
+		jsonResponse(w, http.StatusOK, json.RawMessage("{}"))
+	}
+}
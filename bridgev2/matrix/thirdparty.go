@@ -0,0 +1,226 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package matrix
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// ThirdPartyIdentifierField is the only user field in the third-party protocol of bridgev2 bridges.
+// Lookups pass it to the network connector's SearchUsers or ResolveIdentifier method.
+const ThirdPartyIdentifierField = "identifier"
+
+// thirdPartyHandler implements [appservice.ThirdPartyHandler] using the bridge's
+// [bridgev2.IdentifierResolvingNetworkAPI] and [bridgev2.UserSearchingNetworkAPI] implementations.
+//
+// The homeserver doesn't tell appservices who is making a third-party lookup,
+// so user lookups are done using a login of a bridge admin. Because that exposes
+// what the admin's remote account can see to every Matrix user, user lookups are
+// only enabled if the third_party_user_lookup option is set in the appservice config.
+type thirdPartyHandler struct {
+	br *Connector
+}
+
+var _ appservice.ThirdPartyHandler = (*thirdPartyHandler)(nil)
+
+func (tp *thirdPartyHandler) protocolID() string {
+	return tp.br.Bridge.Network.GetName().NetworkID
+}
+
+func (tp *thirdPartyHandler) GetProtocol(ctx context.Context, protocol string) (*mautrix.ThirdPartyProtocol, error) {
+	if protocol != tp.protocolID() {
+		return nil, nil
+	}
+	name := tp.br.Bridge.Network.GetName()
+	userFields := []string{}
+	if tp.br.Config.AppService.ThirdPartyUserLookup {
+		userFields = append(userFields, ThirdPartyIdentifierField)
+	}
+	return &mautrix.ThirdPartyProtocol{
+		UserFields:     userFields,
+		LocationFields: []string{},
+		Icon:           name.NetworkIcon,
+		FieldTypes: map[string]mautrix.ThirdPartyFieldType{
+			ThirdPartyIdentifierField: {
+				Regexp:      ".+",
+				Placeholder: name.DisplayName + " username or identifier",
+			},
+		},
+		Instances: []*mautrix.ThirdPartyProtocolInstance{{
+			Description: name.DisplayName,
+			Icon:        name.NetworkIcon,
+			Fields:      map[string]any{},
+			NetworkID:   name.NetworkID,
+		}},
+	}, nil
+}
+
+func (tp *thirdPartyHandler) GetLocation(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error) {
+	// Portal rooms don't have aliases, so there's nothing to return
+	return nil, nil
+}
+
+func (tp *thirdPartyHandler) GetLocationByAlias(ctx context.Context, alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error) {
+	return nil, nil
+}
+
+func (tp *thirdPartyHandler) getLookupLogin() *bridgev2.UserLogin {
+	logins := tp.br.Bridge.GetAllCachedUserLogins()
+	logins = slices.DeleteFunc(logins, func(login *bridgev2.UserLogin) bool {
+		return !login.User.GetPermissions().Admin || login.Client == nil || !login.Client.IsLoggedIn()
+	})
+	if len(logins) == 0 {
+		return nil
+	}
+	slices.SortFunc(logins, func(a, b *bridgev2.UserLogin) int {
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	return logins[0]
+}
+
+func (tp *thirdPartyHandler) GetUser(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error) {
+	identifier := fields[ThirdPartyIdentifierField]
+	if protocol != tp.protocolID() || identifier == "" || !tp.br.Config.AppService.ThirdPartyUserLookup {
+		return nil, nil
+	}
+	login := tp.getLookupLogin()
+	if login == nil {
+		zerolog.Ctx(ctx).Debug().Msg("No admin logins available for third-party user lookup")
+		return nil, nil
+	}
+	var results []*bridgev2.ResolveIdentifierResponse
+	switch api := login.Client.(type) {
+	case bridgev2.UserSearchingNetworkAPI:
+		var err error
+		results, err = api.SearchUsers(ctx, identifier)
+		if err != nil {
+			return nil, err
+		}
+	case bridgev2.IdentifierResolvingNetworkAPI:
+		resp, err := api.ResolveIdentifier(ctx, identifier, false)
+		if err != nil {
+			return nil, err
+		} else if resp != nil {
+			results = []*bridgev2.ResolveIdentifierResponse{resp}
+		}
+	default:
+		return nil, nil
+	}
+	users := make([]*mautrix.ThirdPartyUser, 0, len(results))
+	for _, resp := range results {
+		if resp == nil {
+			continue
+		}
+		user := &mautrix.ThirdPartyUser{
+			UserID:   tp.br.FormatGhostMXID(resp.UserID),
+			Protocol: protocol,
+			Fields:   map[string]any{ThirdPartyIdentifierField: string(resp.UserID)},
+		}
+		// Lookups are read-only: the ghost info is only updated when the user actually interacts with the ghost.
+		if resp.Ghost != nil {
+			user.UserID = resp.Ghost.Intent.GetMXID()
+		}
+		if resp.UserInfo != nil && resp.UserInfo.Name != nil {
+			user.Fields["displayname"] = *resp.UserInfo.Name
+		} else if resp.Ghost != nil && resp.Ghost.Name != "" {
+			user.Fields["displayname"] = resp.Ghost.Name
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (tp *thirdPartyHandler) GetUserByID(ctx context.Context, userID id.UserID) ([]*mautrix.ThirdPartyUser, error) {
+	ghostID, ok := tp.br.ParseGhostMXID(userID)
+	if !ok {
+		return nil, nil
+	}
+	return []*mautrix.ThirdPartyUser{{
+		UserID:   userID,
+		Protocol: tp.protocolID(),
+		Fields:   map[string]any{ThirdPartyIdentifierField: string(ghostID)},
+	}}, nil
+}
+
+// hostThirdPartyHandler dispatches third-party lookups to the hosted bridges with a matching protocol.
+type hostThirdPartyHandler struct {
+	host *BridgeHost
+}
+
+var _ appservice.ThirdPartyHandler = (*hostThirdPartyHandler)(nil)
+
+func (htp *hostThirdPartyHandler) bridgesFor(protocol string) []*Connector {
+	var bridges []*Connector
+	for _, br := range htp.host.Bridges {
+		if br.Bridge.Network.GetName().NetworkID == protocol {
+			bridges = append(bridges, br)
+		}
+	}
+	return bridges
+}
+
+func (htp *hostThirdPartyHandler) GetProtocol(ctx context.Context, protocol string) (*mautrix.ThirdPartyProtocol, error) {
+	bridges := htp.bridgesFor(protocol)
+	if len(bridges) == 0 {
+		return nil, nil
+	}
+	return bridges[0].AS.ThirdPartyHandler.GetProtocol(ctx, protocol)
+}
+
+func (htp *hostThirdPartyHandler) GetLocation(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error) {
+	var locations []*mautrix.ThirdPartyLocation
+	for _, br := range htp.bridgesFor(protocol) {
+		resp, err := br.AS.ThirdPartyHandler.GetLocation(ctx, protocol, fields)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, resp...)
+	}
+	return locations, nil
+}
+
+func (htp *hostThirdPartyHandler) GetUser(ctx context.Context, protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error) {
+	var users []*mautrix.ThirdPartyUser
+	for _, br := range htp.bridgesFor(protocol) {
+		resp, err := br.AS.ThirdPartyHandler.GetUser(ctx, protocol, fields)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, resp...)
+	}
+	return users, nil
+}
+
+func (htp *hostThirdPartyHandler) GetLocationByAlias(ctx context.Context, alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error) {
+	var locations []*mautrix.ThirdPartyLocation
+	for _, br := range htp.host.Bridges {
+		resp, err := br.AS.ThirdPartyHandler.GetLocationByAlias(ctx, alias)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, resp...)
+	}
+	return locations, nil
+}
+
+func (htp *hostThirdPartyHandler) GetUserByID(ctx context.Context, userID id.UserID) ([]*mautrix.ThirdPartyUser, error) {
+	for _, br := range htp.host.Bridges {
+		if br.isGhostMXID(userID) {
+			return br.AS.ThirdPartyHandler.GetUserByID(ctx, userID)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package matrix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+type lookupTestClient struct {
+	bridgev2.NetworkAPI
+	lookups []string
+}
+
+var _ bridgev2.IdentifierResolvingNetworkAPI = (*lookupTestClient)(nil)
+
+func (ltc *lookupTestClient) IsLoggedIn() bool { return true }
+
+func (ltc *lookupTestClient) ResolveIdentifier(ctx context.Context, identifier string, createChat bool) (*bridgev2.ResolveIdentifierResponse, error) {
+	ltc.lookups = append(ltc.lookups, identifier)
+	name := "Alice"
+	return &bridgev2.ResolveIdentifierResponse{
+		UserID:   networkid.UserID(identifier),
+		UserInfo: &bridgev2.UserInfo{Name: &name},
+	}, nil
+}
+
+func TestThirdPartyUserLookup(t *testing.T) {
+	ctx := context.Background()
+	host := newTestBridgeHost(t)
+	br := addTestBridge(t, host, "signal", "signalbot", "signal_{{.}}")
+	br.Config.Bridge.Permissions = bridgeconfig.PermissionConfig{
+		"@admin:example.com": &bridgeconfig.Permissions{Admin: true},
+	}
+	user, err := br.Bridge.GetUserByMXID(ctx, "@admin:example.com")
+	require.NoError(t, err)
+	client := &lookupTestClient{}
+	_, err = user.NewLogin(ctx, &database.UserLogin{ID: "admin"}, &bridgev2.NewLoginParams{
+		LoadUserLogin: func(ctx context.Context, login *bridgev2.UserLogin) error {
+			login.Client = client
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	fields := map[string]string{ThirdPartyIdentifierField: "alice"}
+
+	protocol, err := br.AS.ThirdPartyHandler.GetProtocol(ctx, "signal")
+	require.NoError(t, err)
+	assert.Empty(t, protocol.UserFields)
+	users, err := br.AS.ThirdPartyHandler.GetUser(ctx, "signal", fields)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+	assert.Empty(t, client.lookups, "lookups must not use the admin's account unless enabled")
+
+	br.Config.AppService.ThirdPartyUserLookup = true
+	protocol, err = br.AS.ThirdPartyHandler.GetProtocol(ctx, "signal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ThirdPartyIdentifierField}, protocol.UserFields)
+	users, err = br.AS.ThirdPartyHandler.GetUser(ctx, "signal", fields)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, br.FormatGhostMXID("alice"), users[0].UserID)
+	assert.Equal(t, "Alice", users[0].Fields["displayname"])
+	assert.Equal(t, []string{"alice"}, client.lookups)
+}
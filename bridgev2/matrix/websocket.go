@@ -45,6 +45,11 @@ func (br *Connector) startWebsocket(wg *sync.WaitGroup) {
 		default:
 		}
 	}
+	if br.wsMux != nil {
+		log.Debug().Msg("Waiting for events from websocket multiplexer")
+		br.wsMux.AddConnectHandler(onConnect)
+		return
+	}
 	reconnectBackoff := defaultReconnectBackoff
 	lastDisconnect := time.Now().UnixNano()
 	br.wsStopped = make(chan struct{})
@@ -98,8 +103,19 @@ func (br *Connector) startWebsocket(wg *sync.WaitGroup) {
 	}
 }
 
-type wsPingData struct {
-	Timestamp int64 `json:"timestamp"`
+// AttachWebsocketMultiplexer makes the bridge receive events through the given multiplexer
+// instead of opening its own websocket connection. It must be called after Init and before Start,
+// and the caller is responsible for running and stopping the multiplexer.
+func (br *Connector) AttachWebsocketMultiplexer(mux *appservice.WebsocketMultiplexer) error {
+	if br.host != nil {
+		return ErrHostWebsocketNotAllowed
+	}
+	err := mux.Add(br.AS)
+	if err != nil {
+		return err
+	}
+	br.wsMux = mux
+	return nil
 }
 
 func (br *Connector) PingServer() (start, serverTs, end time.Time) {
@@ -108,11 +124,18 @@ func (br *Connector) PingServer() (start, serverTs, end time.Time) {
 	}
 	if !br.AS.HasWebsocket() {
 		br.Log.Debug().Msg("Received server ping request, but no websocket connected. Trying to short-circuit backoff sleep")
-		select {
-		case br.wsShortCircuitReconnectBackoff <- struct{}{}:
-		default:
-			br.Log.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
-			return
+		if br.wsMux != nil {
+			if !br.wsMux.Reconnect() {
+				br.Log.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
+				return
+			}
+		} else {
+			select {
+			case br.wsShortCircuitReconnectBackoff <- struct{}{}:
+			default:
+				br.Log.Warn().Msg("Failed to ping websocket: not connected and no backoff?")
+				return
+			}
 		}
 		select {
 		case <-br.wsStarted:
@@ -124,20 +147,15 @@ func (br *Connector) PingServer() (start, serverTs, end time.Time) {
 		}
 	}
 	start = time.Now()
-	var resp wsPingData
 	br.Log.Debug().Msg("Pinging appservice websocket")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err := br.AS.RequestWebsocket(ctx, &appservice.WebsocketRequest{
-		Command: "ping",
-		Data:    &wsPingData{Timestamp: start.UnixMilli()},
-	}, &resp)
+	serverTs, err := br.AS.PingWebsocket(ctx)
 	end = time.Now()
 	if err != nil {
 		br.Log.Warn().Err(err).Dur("duration", end.Sub(start)).Msg("Websocket ping returned error")
 		br.AS.StopWebsocket(fmt.Errorf("websocket ping returned error in %s: %w", end.Sub(start), err))
 	} else {
-		serverTs = time.Unix(0, resp.Timestamp*int64(time.Millisecond))
 		br.Log.Debug().
 			Dur("duration", end.Sub(start)).
 			Dur("req_duration", serverTs.Sub(start)).
@@ -149,21 +167,8 @@ func (br *Connector) PingServer() (start, serverTs, end time.Time) {
 
 func (br *Connector) websocketServerPinger() {
 	interval := time.Duration(br.Config.Homeserver.WSPingInterval) * time.Second
-	clock := time.NewTicker(interval)
-	defer func() {
-		br.Log.Info().Msg("Stopping websocket pinger")
-		clock.Stop()
-	}()
-	br.Log.Info().Dur("interval_duration", interval).Msg("Starting websocket pinger")
-	for {
-		select {
-		case <-clock.C:
-			br.PingServer()
-		case <-br.wsStopPinger:
-			return
-		}
-		if br.stopping {
-			return
-		}
-	}
+	appservice.RunWebsocketPinger(br.Log, interval, br.wsStopPinger, func() bool {
+		br.PingServer()
+		return !br.stopping
+	})
 }
@@ -0,0 +1,98 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package matrix
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+func newWebsocketTestConnector(t *testing.T, registrationID string) *Connector {
+	t.Helper()
+	cfg := newHostTestConfig(registrationID+"bot", registrationID+"_{{.}}")
+	cfg.Homeserver.Domain = "example.com"
+	cfg.Homeserver.Address = "http://localhost:8008"
+	cfg.AppService.ID = registrationID
+	cfg.AppService.ASToken = registrationID + "_as_token"
+	connector := NewConnector(cfg)
+	bridgev2.NewBridge(
+		"", bridgetest.NewDatabase(t), zerolog.New(zerolog.NewTestWriter(t)),
+		&cfg.Bridge, connector, &hostTestConnector{name: registrationID}, commands.NewProcessor,
+	)
+	return connector
+}
+
+func TestConnectorAttachWebsocketMultiplexer(t *testing.T) {
+	var connCount int
+	var connLock sync.Mutex
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("X-Mautrix-Multiplex"), "only the multiplexer should connect")
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		connLock.Lock()
+		connCount++
+		connLock.Unlock()
+		for {
+			var cmd appservice.WebsocketCommand
+			if ws.ReadJSON(&cmd) != nil {
+				return
+			}
+			_ = ws.WriteJSON(map[string]any{"id": cmd.ReqID, "command": "response", "data": map[string]any{}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	signal := newWebsocketTestConnector(t, "signal")
+	whatsapp := newWebsocketTestConnector(t, "whatsapp")
+	mux := appservice.NewWebsocketMultiplexer(srv.URL, zerolog.Nop())
+	require.NoError(t, signal.AttachWebsocketMultiplexer(mux))
+	require.NoError(t, whatsapp.AttachWebsocketMultiplexer(mux))
+	hosted := addTestBridge(t, newTestBridgeHost(t), "telegram", "telegrambot", "telegram_{{.}}")
+	assert.ErrorIs(t, hosted.AttachWebsocketMultiplexer(mux), ErrHostWebsocketNotAllowed)
+
+	var wg sync.WaitGroup
+	for _, br := range []*Connector{signal, whatsapp} {
+		wg.Add(1)
+		br.startWebsocket(&wg)
+	}
+	go func() {
+		_ = mux.Run()
+	}()
+	t.Cleanup(mux.Stop)
+
+	connected := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(connected)
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for bridges to be connected through the multiplexer")
+	}
+	assert.True(t, signal.AS.HasWebsocket())
+	assert.True(t, whatsapp.AS.HasWebsocket())
+	connLock.Lock()
+	assert.Equal(t, 1, connCount)
+	connLock.Unlock()
+}
@@ -153,3 +153,8 @@ type MatrixAPI interface {
 type MarkAsDMMatrixAPI interface {
 	MarkAsDM(ctx context.Context, roomID id.RoomID, otherUser id.UserID) error
 }
+
+type AccountDataMatrixAPI interface {
+	GetAccountData(ctx context.Context, eventType event.Type, output any) error
+	SetAccountData(ctx context.Context, eventType event.Type, data any) error
+}
@@ -22,7 +22,7 @@ import (
 func (br *Bridge) handleBotInvite(ctx context.Context, evt *event.Event, sender *User) {
 	log := zerolog.Ctx(ctx)
 	// These invites should already be rejected in QueueMatrixEvent
-	if !sender.Permissions.Commands {
+	if !sender.GetPermissions().Commands {
 		log.Warn().Msg("Received bot invite from user without permission to send commands")
 		return
 	}
@@ -46,7 +46,7 @@ func (br *Bridge) handleBotInvite(ctx context.Context, evt *event.Event, sender
 				log.Err(err).Msg("Failed to update user's management room in database")
 			}
 		} else {
-			message = fmt.Sprintf("Hello, I'm a %s bridge bot.\n\nUse `%s help` for help.", br.Network.GetName().DisplayName, br.Config.CommandPrefix)
+			message = fmt.Sprintf("Hello, I'm a %s bridge bot.\n\nUse `%s help` for help.", br.Network.GetName().DisplayName, br.GetConfig().CommandPrefix)
 		}
 		_, err = br.Bot.SendMessage(ctx, evt.RoomID, event.EventMessage, &event.Content{
 			Parsed: format.RenderMarkdown(message, true, false),
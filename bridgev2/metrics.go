@@ -0,0 +1,294 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var mediaSizeBuckets = []float64{
+	1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30,
+}
+
+// Metrics contains the runtime metrics of a bridge.
+//
+// All methods are safe to call on a nil Metrics, which is what [Bridge.Metrics] is set to when metrics are disabled.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	constLabels prometheus.Labels
+
+	remoteEvents       *prometheus.CounterVec
+	remoteEventLatency *prometheus.HistogramVec
+	matrixEvents       *prometheus.CounterVec
+	matrixEventLatency *prometheus.HistogramVec
+	backfillMessages   *prometheus.CounterVec
+	decryptionFailures *prometheus.CounterVec
+	encryptionFailures prometheus.Counter
+	mediaUploadSize    prometheus.Histogram
+	loginState         *prometheus.GaugeVec
+
+	loginStates     map[string]status.BridgeStateEvent
+	loginStatesLock sync.Mutex
+}
+
+// NewMetrics creates the metric registry for the given bridge.
+// The returned value should be stored in [Bridge.Metrics] and [Metrics.Handler] served over HTTP.
+func NewMetrics(br *Bridge) *Metrics {
+	reg := prometheus.NewRegistry()
+	constLabels := prometheus.Labels{"network": br.Network.GetName().NetworkID}
+	factory := promauto.With(reg)
+	m := &Metrics{
+		Registry:    reg,
+		constLabels: constLabels,
+
+		remoteEvents: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "bridge_remote_events_total",
+			Help:        "Number of remote events queued for handling",
+			ConstLabels: constLabels,
+		}, []string{"login_id", "type"}),
+		remoteEventLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "bridge_remote_event_handling_seconds",
+			Help:        "Time from queuing a remote event to finishing handling it",
+			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
+		}, []string{"login_id", "type"}),
+		matrixEvents: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "bridge_matrix_events_total",
+			Help:        "Number of Matrix events queued for handling in portals",
+			ConstLabels: constLabels,
+		}, []string{"type"}),
+		matrixEventLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "bridge_matrix_event_handling_seconds",
+			Help:        "Time from queuing a Matrix event to finishing handling it",
+			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
+		}, []string{"login_id", "type"}),
+		backfillMessages: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "bridge_backfill_messages_total",
+			Help:        "Number of messages sent to Matrix via backfill",
+			ConstLabels: constLabels,
+		}, []string{"login_id", "direction"}),
+		decryptionFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "bridge_decryption_failures_total",
+			Help:        "Number of Matrix events that the bridge failed to decrypt",
+			ConstLabels: constLabels,
+		}, []string{"reason"}),
+		encryptionFailures: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "bridge_encryption_failures_total",
+			Help:        "Number of Matrix events that the bridge failed to encrypt",
+			ConstLabels: constLabels,
+		}),
+		mediaUploadSize: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:        "bridge_media_upload_bytes",
+			Help:        "Size of media uploaded to Matrix",
+			ConstLabels: constLabels,
+			Buckets:     mediaSizeBuckets,
+		}),
+		loginState: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "bridge_login_state",
+			Help:        "Current bridge state of each login (1 for the current state)",
+			ConstLabels: constLabels,
+		}, []string{"login_id", "state"}),
+
+		loginStates: make(map[string]status.BridgeStateEvent),
+	}
+	// Per-portal labels would create a new series for every chat, so the queues are only reported in aggregate.
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "bridge_portal_event_queue_depth",
+		Help:        "Total number of events waiting in the event queues of all portals",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		total, _ := br.portalQueueDepth()
+		return float64(total)
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "bridge_portal_event_queue_max_depth",
+		Help:        "Number of events waiting in the longest portal event queue",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		_, longest := br.portalQueueDepth()
+		return float64(longest)
+	})
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+func (br *Bridge) portalQueueDepth() (total, longest int) {
+	br.cacheLock.Lock()
+	defer br.cacheLock.Unlock()
+	for _, portal := range br.portalsByKey {
+		depth := len(portal.events)
+		total += depth
+		longest = max(longest, depth)
+	}
+	return
+}
+
+// Handler returns a HTTP handler that serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) TrackRemoteEvent(login *UserLogin, evtType RemoteEventType) {
+	if m == nil {
+		return
+	}
+	m.remoteEvents.WithLabelValues(string(login.ID), evtType.String()).Inc()
+}
+
+func (m *Metrics) ObserveRemoteEventHandled(login *UserLogin, evtType RemoteEventType, queuedAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.remoteEventLatency.WithLabelValues(string(login.ID), evtType.String()).Observe(time.Since(queuedAt).Seconds())
+}
+
+func (m *Metrics) TrackMatrixEvent(evtType event.Type) {
+	if m == nil {
+		return
+	}
+	m.matrixEvents.WithLabelValues(evtType.Type).Inc()
+}
+
+// ObserveMatrixEventHandled records how long handling a Matrix event took.
+// The login is the one the event was handled with, or nil for events that weren't handled with a login.
+func (m *Metrics) ObserveMatrixEventHandled(login *UserLogin, evtType event.Type, queuedAt time.Time) {
+	if m == nil {
+		return
+	}
+	var loginID networkid.UserLoginID
+	if login != nil {
+		loginID = login.ID
+	}
+	m.matrixEventLatency.WithLabelValues(string(loginID), evtType.Type).Observe(time.Since(queuedAt).Seconds())
+}
+
+// TrackBackfill counts messages sent by backfill. The direction should be forward, backward or thread.
+func (m *Metrics) TrackBackfill(login *UserLogin, direction string, messageCount int) {
+	if m == nil {
+		return
+	}
+	m.backfillMessages.WithLabelValues(string(login.ID), direction).Add(float64(messageCount))
+}
+
+func (m *Metrics) TrackDecryptionFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.decryptionFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) TrackEncryptionFailure() {
+	if m == nil {
+		return
+	}
+	m.encryptionFailures.Inc()
+}
+
+func (m *Metrics) ObserveMediaUpload(size int64) {
+	if m == nil {
+		return
+	}
+	m.mediaUploadSize.Observe(float64(size))
+}
+
+// TrackLoginState records the state of a login from a bridge state update.
+func (m *Metrics) TrackLoginState(state status.BridgeState) {
+	if m == nil || state.RemoteID == "" {
+		return
+	}
+	m.loginStatesLock.Lock()
+	defer m.loginStatesLock.Unlock()
+	prev, ok := m.loginStates[state.RemoteID]
+	if ok && prev == state.StateEvent {
+		return
+	} else if ok {
+		m.loginState.DeleteLabelValues(state.RemoteID, string(prev))
+	}
+	m.loginStates[state.RemoteID] = state.StateEvent
+	m.loginState.WithLabelValues(state.RemoteID, string(state.StateEvent)).Set(1)
+}
+
+// ForgetLogin removes all metrics labeled with the given login ID. It's called when the login is deleted.
+func (m *Metrics) ForgetLogin(loginID networkid.UserLoginID) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"login_id": string(loginID)}
+	m.loginStatesLock.Lock()
+	delete(m.loginStates, string(loginID))
+	m.loginState.DeletePartialMatch(labels)
+	m.loginStatesLock.Unlock()
+	m.remoteEvents.DeletePartialMatch(labels)
+	m.remoteEventLatency.DeletePartialMatch(labels)
+	m.matrixEventLatency.DeletePartialMatch(labels)
+	m.backfillMessages.DeletePartialMatch(labels)
+}
+
+// TrackRateLimiter registers metrics for the queue of the given homeserver request rate limiter.
+// This replaces the OnSend and OnRateLimited hooks of the rate limiter.
+func (m *Metrics) TrackRateLimiter(rl *mautrix.RateLimiter) {
+	if m == nil {
+		return
+	}
+	factory := promauto.With(m.Registry)
+	waitTime := factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "bridge_homeserver_request_queue_seconds",
+		Help:        "Time requests to the homeserver spent waiting in the rate limiter queue",
+		ConstLabels: m.constLabels,
+		Buckets:     latencyBuckets,
+	}, []string{"lane"})
+	rateLimited := factory.NewCounter(prometheus.CounterOpts{
+		Name:        "bridge_homeserver_rate_limited_total",
+		Help:        "Number of 429 responses received from the homeserver",
+		ConstLabels: m.constLabels,
+	})
+	m.Registry.MustRegister(&rateLimiterQueueCollector{
+		rl: rl,
+		desc: prometheus.NewDesc(
+			"bridge_homeserver_request_queue_depth",
+			"Number of requests to the homeserver waiting in the rate limiter queue",
+			[]string{"lane"}, m.constLabels,
+		),
+	})
+	rl.OnSend = func(lane mautrix.RequestLane, wait time.Duration) {
+		waitTime.WithLabelValues(lane.String()).Observe(wait.Seconds())
+	}
+	rl.OnRateLimited = func(pause time.Duration) {
+		rateLimited.Inc()
+	}
+}
+
+type rateLimiterQueueCollector struct {
+	rl   *mautrix.RateLimiter
+	desc *prometheus.Desc
+}
+
+func (rlc *rateLimiterQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rlc.desc
+}
+
+func (rlc *rateLimiterQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for lane, count := range rlc.rl.Stats().Queued {
+		ch <- prometheus.MustNewConstMetric(rlc.desc, prometheus.GaugeValue, float64(count), lane.String())
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func scrapeMetrics(t *testing.T, m *bridgev2.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+	return rec.Body.String()
+}
+
+func TestMetricsForgetLoginOnLogout(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	h.Bridge.Metrics = bridgev2.NewMetrics(h.Bridge)
+	login := h.Login(h.User("@user:bridge.test"), "username", map[string]string{"username": "me"})
+	other := h.Login(h.User("@other:bridge.test"), "username", map[string]string{"username": "other"})
+	h.QueueRemoteEvent(login, bridgetest.TextMessage("msg1", "alice", networkid.PortalKey{ID: "chat", Receiver: login.ID}, "hello"))
+	h.QueueRemoteEvent(other, bridgetest.TextMessage("msg2", "alice", networkid.PortalKey{ID: "chat", Receiver: other.ID}, "hi"))
+	login.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	other.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+
+	h.SendMatrixText(h.PortalRoom(networkid.PortalKey{ID: "chat", Receiver: login.ID}), login.UserMXID, "hi alice")
+
+	scraped := scrapeMetrics(t, h.Bridge.Metrics)
+	assert.Contains(t, scraped, `bridge_remote_events_total{login_id="me",network="test",type="RemoteEventMessage"} 1`)
+	assert.Contains(t, scraped, `bridge_remote_event_handling_seconds_count{login_id="me",network="test",type="RemoteEventMessage"} 1`)
+	assert.Contains(t, scraped, `bridge_matrix_event_handling_seconds_count{login_id="me",network="test",type="m.room.message"} 1`)
+	assert.Contains(t, scraped, `bridge_login_state{login_id="me",network="test",state="CONNECTED"} 1`)
+	assert.Contains(t, scraped, `login_id="other"`)
+
+	login.Delete(h.Ctx, status.BridgeState{StateEvent: status.StateLoggedOut}, bridgev2.DeleteOpts{BlockingCleanup: true})
+
+	scraped = scrapeMetrics(t, h.Bridge.Metrics)
+	assert.NotContains(t, scraped, `login_id="me"`)
+	assert.Contains(t, scraped, `bridge_remote_events_total{login_id="other",network="test",type="RemoteEventMessage"} 1`)
+	assert.Contains(t, scraped, `bridge_login_state{login_id="other",network="test",state="CONNECTED"} 1`)
+}
+
+func TestMetricsPortalQueueDepthIsAggregated(t *testing.T) {
+	h, _, _, _ := bridgetest.NewChat(t, nil)
+	h.Bridge.Metrics = bridgev2.NewMetrics(h.Bridge)
+
+	scraped := scrapeMetrics(t, h.Bridge.Metrics)
+	assert.Contains(t, scraped, `bridge_portal_event_queue_depth{network="test"} 0`)
+	assert.Contains(t, scraped, `bridge_portal_event_queue_max_depth{network="test"} 0`)
+	assert.NotContains(t, scraped, "portal_id")
+}
@@ -133,6 +133,20 @@ type AvatarID string
 // On networks that allow multiple emojis, this is the unicode emoji or a network-specific shortcode.
 type EmojiID string
 
+// CallID is the ID of a voice or video call on the remote network.
+type CallID string
+
+// PollOptionID is the ID of a single answer option in a poll on the remote network.
+//
+// Poll option IDs only need to be unique within a single poll.
+type PollOptionID string
+
+// ImagePackID is the ID of a custom emoji or sticker pack on the remote network.
+//
+// It is used as the state key of the im.ponies.room_emotes event in portal rooms,
+// so it should be unique within a single chat.
+type ImagePackID string
+
 // MediaID represents a media identifier that can be downloaded from the remote network at any point in the future.
 //
 // This is used to implement on-demand media downloads. The network connector can ask the Matrix connector
@@ -16,6 +16,7 @@ import (
 	"go.mau.fi/util/configupgrade"
 	"go.mau.fi/util/ptr"
 
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
@@ -30,6 +31,9 @@ type ConvertedMessagePart struct {
 	Extra      map[string]any
 	DBMetadata any
 	DontBridge bool
+	// For poll start parts, a map from the Matrix answer IDs (m.id) to the option IDs on the remote network.
+	// The bridge stores the mapping so that votes can be bridged in both directions.
+	PollOptions map[string]networkid.PollOptionID
 }
 
 func (cmp *ConvertedMessagePart) ToEditPart(part *database.Message) *ConvertedEditPart {
@@ -234,6 +238,16 @@ type StoppableNetwork interface {
 	Stop()
 }
 
+// ConfigReloadingNetwork is an optional interface that network connectors can implement to support config reloads.
+//
+// Implementing it also declares that the connector reads the config through [Bridge.GetConfig] and [User.GetPermissions]
+// rather than the deprecated [Bridge.Config] and [User.Permissions] fields, which aren't updated by reloads.
+type ConfigReloadingNetwork interface {
+	NetworkConnector
+	// OnConfigReloaded is called after the config returned by [Bridge.GetConfig] has been replaced.
+	OnConfigReloaded(cfg *bridgeconfig.BridgeConfig)
+}
+
 // DirectMediableNetwork is an optional interface that network connectors can implement to support direct media access.
 //
 // If the Matrix connector has direct media enabled, SetUseDirectMedia will be called
@@ -295,6 +309,8 @@ type MatrixMessageResponse struct {
 	// An optional function that is called after the message is saved to the database.
 	// Will not be called if the message is not saved for some reason.
 	PostSave func(context.Context, *database.Message)
+	// For poll start events, a map from the Matrix answer IDs (m.id) to the option IDs on the remote network.
+	PollOptions map[string]networkid.PollOptionID
 }
 
 type FileRestriction struct {
@@ -428,6 +444,10 @@ type BackfillReaction struct {
 	Emoji        string
 	ExtraContent map[string]any
 	DBMetadata   any
+
+	// Optional custom emoji. If set, the emoji will be bridged as an image pack emoji
+	// and the reaction key will be the Matrix content URI of the emoji.
+	CustomEmoji *CustomEmoji
 }
 
 // BackfillMessage is an individual message in a history pagination request.
@@ -526,6 +546,18 @@ type BackfillingNetworkAPIWithLimits interface {
 	GetBackfillMaxBatchCount(ctx context.Context, portal *Portal, task *database.BackfillTask) int
 }
 
+// ScheduledMessageHandlingNetworkAPI is an optional interface that network connectors can implement
+// if the remote network supports scheduling messages natively.
+//
+// If a connector doesn't implement this interface, the bridge will store scheduled messages
+// in its own database and pass them to HandleMatrixMessage at the scheduled time.
+type ScheduledMessageHandlingNetworkAPI interface {
+	NetworkAPI
+	// HandleMatrixScheduledMessage is called instead of HandleMatrixMessage when a Matrix message
+	// has a scheduled send time in the future.
+	HandleMatrixScheduledMessage(ctx context.Context, msg *MatrixScheduledMessage) (message *MatrixMessageResponse, err error)
+}
+
 // EditHandlingNetworkAPI is an optional interface that network connectors can implement to handle message edits.
 type EditHandlingNetworkAPI interface {
 	NetworkAPI
@@ -535,12 +567,30 @@ type EditHandlingNetworkAPI interface {
 	HandleMatrixEdit(ctx context.Context, msg *MatrixEdit) error
 }
 
+// PollHandlingNetworkAPI is an optional interface that network connectors can implement to handle polls.
+// Both stable (m.poll.*) and unstable (org.matrix.msc3381.poll.*) events are passed to these methods,
+// and the content is normalized so that both the stable and unstable fields are always filled.
 type PollHandlingNetworkAPI interface {
 	NetworkAPI
 	HandleMatrixPollStart(ctx context.Context, msg *MatrixPollStart) (*MatrixMessageResponse, error)
 	HandleMatrixPollVote(ctx context.Context, msg *MatrixPollVote) (*MatrixMessageResponse, error)
 }
 
+// CallHandlingNetworkAPI is an optional interface that network connectors can implement to forward
+// Matrix VoIP signalling (m.call.* events) to the remote network.
+type CallHandlingNetworkAPI interface {
+	NetworkAPI
+	// HandleMatrixCall is called for all m.call.* events in portal rooms. The content is one of the
+	// event.Call*EventContent structs, so network connectors should type switch on it.
+	HandleMatrixCall(ctx context.Context, msg *MatrixCall) error
+}
+
+// PollEndHandlingNetworkAPI is an optional extension to PollHandlingNetworkAPI for closing polls.
+type PollEndHandlingNetworkAPI interface {
+	PollHandlingNetworkAPI
+	HandleMatrixPollEnd(ctx context.Context, msg *MatrixPollEnd) error
+}
+
 // ReactionHandlingNetworkAPI is an optional interface that network connectors can implement to handle message reactions.
 type ReactionHandlingNetworkAPI interface {
 	NetworkAPI
@@ -630,6 +680,19 @@ type RoomTopicHandlingNetworkAPI interface {
 	HandleMatrixRoomTopic(ctx context.Context, msg *MatrixRoomTopic) (bool, error)
 }
 
+// RoomSettingsHandlingNetworkAPI is an optional interface that network connectors can implement to handle
+// changes to the join rules, history visibility and guest access of portal rooms.
+//
+// Like the other room metadata handlers, these methods should update the corresponding fields of the Portal
+// (JoinRule, HistoryVisibility and GuestAccess) and return true if the change was successful.
+// [GroupJoinSettingsFromJoinRule] can be used to map Matrix join rules and power levels to typical group settings.
+type RoomSettingsHandlingNetworkAPI interface {
+	NetworkAPI
+	HandleMatrixJoinRule(ctx context.Context, msg *MatrixJoinRule) (bool, error)
+	HandleMatrixHistoryVisibility(ctx context.Context, msg *MatrixHistoryVisibility) (bool, error)
+	HandleMatrixGuestAccess(ctx context.Context, msg *MatrixGuestAccess) (bool, error)
+}
+
 type ResolveIdentifierResponse struct {
 	// Ghost is the ghost of the user that the identifier resolves to.
 	// This field should be set whenever possible. However, it is not required,
@@ -870,6 +933,14 @@ func (ret RemoteEventType) String() string {
 		return "RemoteEventChatDelete"
 	case RemoteEventBackfill:
 		return "RemoteEventBackfill"
+	case RemoteEventPollVote:
+		return "RemoteEventPollVote"
+	case RemoteEventPollEnd:
+		return "RemoteEventPollEnd"
+	case RemoteEventPollResultsSync:
+		return "RemoteEventPollResultsSync"
+	case RemoteEventCall:
+		return "RemoteEventCall"
 	default:
 		return fmt.Sprintf("RemoteEventType(%d)", int(ret))
 	}
@@ -892,6 +963,10 @@ const (
 	RemoteEventChatResync
 	RemoteEventChatDelete
 	RemoteEventBackfill
+	RemoteEventPollVote
+	RemoteEventPollEnd
+	RemoteEventPollResultsSync
+	RemoteEventCall
 )
 
 // RemoteEvent represents a single event from the remote network, such as a message or a reaction.
@@ -1053,6 +1128,11 @@ type RemoteReactionWithExtraContent interface {
 	GetReactionExtraContent() map[string]any
 }
 
+type RemoteReactionWithCustomEmoji interface {
+	RemoteReaction
+	GetReactionCustomEmoji() *CustomEmoji
+}
+
 type RemoteReactionWithMeta interface {
 	RemoteReaction
 	GetReactionDBMetadata() any
@@ -1063,6 +1143,70 @@ type RemoteReactionRemove interface {
 	GetRemovedEmojiID() networkid.EmojiID
 }
 
+type RemotePollVote interface {
+	RemoteEventWithTargetMessage
+	// GetPollVote returns the option IDs the sender selected. An empty list means the vote was retracted.
+	GetPollVote() []networkid.PollOptionID
+}
+
+type RemotePollEnd interface {
+	RemoteEventWithTargetMessage
+	// GetFinalPollResults optionally returns the final number of votes for each option.
+	// If nil, the bridge will count the votes it knows about.
+	GetFinalPollResults() map[networkid.PollOptionID]int
+}
+
+type PollVoteSyncUser struct {
+	Sender    EventSender
+	Options   []networkid.PollOptionID
+	Timestamp time.Time
+}
+
+type PollResultsSyncData struct {
+	Votes []*PollVoteSyncUser
+	// Whether the list contains all votes in the poll. If true, votes from users who aren't in the list are retracted.
+	HasAllVotes bool
+}
+
+type RemotePollResultsSync interface {
+	RemoteEventWithTargetMessage
+	GetPollResults() *PollResultsSyncData
+}
+
+type CallType string
+
+const (
+	CallTypeVoice CallType = "voice"
+	CallTypeVideo CallType = "video"
+)
+
+type CallState string
+
+const (
+	// CallStateStarted means a call was started. For group calls, this creates a MSC3401 call state event.
+	CallStateStarted CallState = "started"
+	// CallStateMissed means a call ended without being answered.
+	CallStateMissed CallState = "missed"
+	// CallStateRejected means a call was declined by the recipient.
+	CallStateRejected CallState = "rejected"
+	// CallStateEnded means a call was answered and has now ended. Duration should be set if known.
+	CallStateEnded CallState = "ended"
+)
+
+type CallInfo struct {
+	ID       networkid.CallID
+	Type     CallType
+	State    CallState
+	IsGroup  bool
+	Name     string
+	Duration time.Duration
+}
+
+type RemoteCall interface {
+	RemoteEvent
+	GetCall() *CallInfo
+}
+
 type RemoteMessageRemove interface {
 	RemoteEventWithTargetMessage
 }
@@ -1134,6 +1278,11 @@ type MatrixMessage struct {
 	ReplyTo    *database.Message
 }
 
+type MatrixScheduledMessage struct {
+	MatrixMessage
+	SendAt time.Time
+}
+
 type MatrixEdit struct {
 	MatrixEventBase[*event.MessageEventContent]
 	EditTarget *database.Message
@@ -1148,6 +1297,18 @@ type MatrixPollVote struct {
 	MatrixMessage
 	VoteTo  *database.Message
 	Content *event.PollResponseEventContent
+	// The remote option IDs of the selected answers.
+	// Answers that don't have a known option ID in the database are not included.
+	SelectedOptions []networkid.PollOptionID
+}
+
+type MatrixCall struct {
+	MatrixEventBase[event.CallEventContent]
+}
+
+type MatrixPollEnd struct {
+	MatrixEventBase[*event.PollEndEventContent]
+	PollMessage *database.Message
 }
 
 type MatrixReaction struct {
@@ -1159,6 +1320,9 @@ type MatrixReaction struct {
 	ReactionToOverride *database.Reaction
 	// When MaxReactions is >0 in the pre-response, this is the list of previous reactions that should be preserved.
 	ExistingReactionsToKeep []*database.Reaction
+	// If the reaction key is a Matrix content URI of a custom emoji that was bridged from the remote network,
+	// this is the database entry of that emoji.
+	CustomEmoji *database.CustomEmoji
 }
 
 type MatrixReactionPreResponse struct {
@@ -1186,6 +1350,9 @@ type MatrixRoomMeta[ContentType any] struct {
 type MatrixRoomName = MatrixRoomMeta[*event.RoomNameEventContent]
 type MatrixRoomAvatar = MatrixRoomMeta[*event.RoomAvatarEventContent]
 type MatrixRoomTopic = MatrixRoomMeta[*event.TopicEventContent]
+type MatrixJoinRule = MatrixRoomMeta[*event.JoinRulesEventContent]
+type MatrixHistoryVisibility = MatrixRoomMeta[*event.HistoryVisibilityEventContent]
+type MatrixGuestAccess = MatrixRoomMeta[*event.GuestAccessEventContent]
 
 type MatrixReadReceipt struct {
 	Portal *Portal
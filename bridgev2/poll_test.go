@@ -0,0 +1,42 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestPollContentTypeMismatch(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	for _, tc := range []struct {
+		name    string
+		evtType event.Type
+		content any
+	}{
+		{"PollStartWithMessage", event.EventPollStart, &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}},
+		{"UnstablePollResponseWithMessage", event.EventUnstablePollResponse, &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}},
+		{"PollResponseWithPollStart", event.EventPollResponse, &event.PollStartEventContent{}},
+		{"MessageWithPollResponse", event.EventMessage, &event.PollResponseEventContent{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := h.SendMatrixEvent(roomID, login.UserMXID, tc.evtType, tc.content)
+			h.AssertMessageStatus(evt.ID, event.MessageStatusRetriable)
+			status := h.Matrix.MessageStatus(evt.ID)
+			require.NotNil(t, status)
+			assert.ErrorContains(t, status.InternalError, "unexpected parsed content type")
+		})
+	}
+	// The portal event loop must still be alive after the bad events
+	evt := h.SendMatrixText(roomID, login.UserMXID, "still alive")
+	h.AssertMessageStatus(evt.ID, event.MessageStatusSuccess)
+}
@@ -30,17 +30,24 @@ import (
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/tracing"
 )
 
 type portalMatrixEvent struct {
-	evt    *event.Event
-	sender *User
+	evt      *event.Event
+	sender   *User
+	queuedAt time.Time
+	traceCtx context.Context
+	// done is called after the event has been handled, see [Bridge.QueueMatrixEventWithCallback].
+	done func()
 }
 
 type portalRemoteEvent struct {
-	evt     RemoteEvent
-	source  *UserLogin
-	evtType RemoteEventType
+	evt      RemoteEvent
+	source   *UserLogin
+	evtType  RemoteEventType
+	queuedAt time.Time
+	traceCtx context.Context
 }
 
 type portalCreateEvent struct {
@@ -50,9 +57,22 @@ type portalCreateEvent struct {
 	cb     func(error)
 }
 
-func (pme *portalMatrixEvent) isPortalEvent() {}
-func (pre *portalRemoteEvent) isPortalEvent() {}
-func (pre *portalCreateEvent) isPortalEvent() {}
+type portalBarrierEvent struct {
+	done chan struct{}
+}
+
+// portalSpaceEvent adds the portal to the personal filtering space of a user login.
+// It's handled in the event loop so that it can't race with the room ID changing.
+type portalSpaceEvent struct {
+	login      *UserLogin
+	userPortal *database.UserPortal
+}
+
+func (pme *portalMatrixEvent) isPortalEvent()  {}
+func (pre *portalRemoteEvent) isPortalEvent()  {}
+func (pre *portalCreateEvent) isPortalEvent()  {}
+func (pbe *portalBarrierEvent) isPortalEvent() {}
+func (pse *portalSpaceEvent) isPortalEvent()   {}
 
 type portalEvent interface {
 	isPortalEvent()
@@ -159,7 +179,7 @@ func (br *Bridge) loadManyPortals(ctx context.Context, portals []*database.Porta
 }
 
 func (br *Bridge) UnlockedGetPortalByKey(ctx context.Context, key networkid.PortalKey, onlyIfExists bool) (*Portal, error) {
-	if br.Config.SplitPortals && key.Receiver == "" {
+	if br.GetConfig().SplitPortals && key.Receiver == "" {
 		return nil, fmt.Errorf("receiver must always be set when split portals is enabled")
 	}
 	cached, ok := br.portalsByKey[key]
@@ -187,7 +207,7 @@ func (br *Bridge) FindPortalReceiver(ctx context.Context, id networkid.PortalID,
 }
 
 func (br *Bridge) FindCachedPortalReceiver(id networkid.PortalID, maybeReceiver networkid.UserLoginID) networkid.PortalKey {
-	if br.Config.SplitPortals {
+	if br.GetConfig().SplitPortals {
 		return networkid.PortalKey{ID: id, Receiver: maybeReceiver}
 	}
 	br.cacheLock.Lock()
@@ -256,7 +276,7 @@ func (br *Bridge) GetPortalByKey(ctx context.Context, key networkid.PortalKey) (
 func (br *Bridge) GetExistingPortalByKey(ctx context.Context, key networkid.PortalKey) (*Portal, error) {
 	br.cacheLock.Lock()
 	defer br.cacheLock.Unlock()
-	if key.Receiver == "" || br.Config.SplitPortals {
+	if key.Receiver == "" || br.GetConfig().SplitPortals {
 		return br.UnlockedGetPortalByKey(ctx, key, true)
 	}
 	cached, ok := br.portalsByKey[key]
@@ -271,13 +291,48 @@ func (br *Bridge) GetExistingPortalByKey(ctx context.Context, key networkid.Port
 	return br.loadPortal(ctx, db, err, nil)
 }
 
-func (portal *Portal) queueEvent(ctx context.Context, evt portalEvent) {
+// queueEvent queues an event in the portal event loop. It returns false if the event was dropped because the queue is full.
+func (portal *Portal) queueEvent(ctx context.Context, evt portalEvent) bool {
 	select {
 	case portal.events <- evt:
+		return true
 	default:
 		zerolog.Ctx(ctx).Error().
 			Str("portal_id", string(portal.ID)).
 			Msg("Portal event channel is full")
+		return false
+	}
+}
+
+// queueInternalEvent queues an event created by the bridge itself. Unlike [Portal.queueEvent], it never
+// drops the event: if the buffer is full, the event is queued from a separate goroutine, as blocking
+// here would deadlock when called from the event loop.
+func (portal *Portal) queueInternalEvent(evt portalEvent) {
+	select {
+	case portal.events <- evt:
+	default:
+		go func() {
+			portal.events <- evt
+		}()
+	}
+}
+
+// WaitQueue blocks until all events queued in the portal before the call have been handled,
+// or until the context is canceled.
+//
+// If async event handling is enabled in the bridge config, events are only guaranteed to have been started.
+func (portal *Portal) WaitQueue(ctx context.Context) error {
+	barrier := &portalBarrierEvent{done: make(chan struct{})}
+	select {
+	case portal.events <- barrier:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-barrier.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -290,10 +345,14 @@ func (portal *Portal) eventLoop() {
 }
 
 func (portal *Portal) handleSingleEventAsync(idx int, rawEvt any) {
+	if barrier, isBarrier := rawEvt.(*portalBarrierEvent); isBarrier {
+		close(barrier.done)
+		return
+	}
 	ctx := portal.getEventCtxWithLog(rawEvt, idx)
 	if _, isCreate := rawEvt.(*portalCreateEvent); isCreate {
 		portal.handleSingleEvent(ctx, rawEvt, func() {})
-	} else if portal.Bridge.Config.AsyncEvents {
+	} else if portal.Bridge.GetConfig().AsyncEvents {
 		go portal.handleSingleEvent(ctx, rawEvt, func() {})
 	} else {
 		log := zerolog.Ctx(ctx)
@@ -330,6 +389,7 @@ func (portal *Portal) handleSingleEventAsync(idx int, rawEvt any) {
 
 func (portal *Portal) getEventCtxWithLog(rawEvt any, idx int) context.Context {
 	var logWith zerolog.Context
+	var traceCtx context.Context
 	switch evt := rawEvt.(type) {
 	case *portalMatrixEvent:
 		logWith = portal.Log.With().Int("event_loop_index", idx).
@@ -341,6 +401,7 @@ func (portal *Portal) getEventCtxWithLog(rawEvt any, idx int) context.Context {
 				Stringer("event_id", evt.evt.ID).
 				Stringer("sender", evt.sender.MXID)
 		}
+		traceCtx = evt.traceCtx
 	case *portalRemoteEvent:
 		evt.evtType = evt.evt.GetType()
 		logWith = portal.Log.With().Int("event_loop_index", idx).
@@ -348,16 +409,24 @@ func (portal *Portal) getEventCtxWithLog(rawEvt any, idx int) context.Context {
 			Str("source_id", string(evt.source.ID)).
 			Stringer("bridge_evt_type", evt.evtType)
 		logWith = evt.evt.AddLogContext(logWith)
+		traceCtx = evt.traceCtx
 	case *portalCreateEvent:
 		return evt.ctx
+	case *portalSpaceEvent:
+		logWith = portal.Log.With().Int("event_loop_index", idx).
+			Str("action", "add portal to space").
+			Str("login_id", string(evt.login.ID))
 	}
-	return logWith.Logger().WithContext(context.Background())
+	return tracing.Propagate(traceCtx, logWith.Logger().WithContext(context.Background()))
 }
 
 func (portal *Portal) handleSingleEvent(ctx context.Context, rawEvt any, doneCallback func()) {
 	log := zerolog.Ctx(ctx)
 	defer func() {
 		doneCallback()
+		if evt, ok := rawEvt.(*portalMatrixEvent); ok && evt.done != nil {
+			defer evt.done()
+		}
 		if err := recover(); err != nil {
 			logEvt := log.Error()
 			if realErr, ok := err.(error); ok {
@@ -380,11 +449,15 @@ func (portal *Portal) handleSingleEvent(ctx context.Context, rawEvt any, doneCal
 	}()
 	switch evt := rawEvt.(type) {
 	case *portalMatrixEvent:
-		portal.handleMatrixEvent(ctx, evt.sender, evt.evt)
+		login := portal.handleMatrixEvent(ctx, evt.sender, evt.evt)
+		portal.Bridge.Metrics.ObserveMatrixEventHandled(login, evt.evt.Type, evt.queuedAt)
 	case *portalRemoteEvent:
 		portal.handleRemoteEvent(ctx, evt.source, evt.evtType, evt.evt)
+		portal.Bridge.Metrics.ObserveRemoteEventHandled(evt.source, evt.evtType, evt.queuedAt)
 	case *portalCreateEvent:
 		evt.cb(portal.createMatrixRoomInLoop(evt.ctx, evt.source, evt.info, nil))
+	case *portalSpaceEvent:
+		evt.login.tryAddPortalToSpace(ctx, portal, evt.userPortal)
 	default:
 		panic(fmt.Errorf("illegal type %T in eventLoop", evt))
 	}
@@ -482,7 +555,8 @@ func (portal *Portal) checkConfusableName(ctx context.Context, userID id.UserID,
 	return false
 }
 
-func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *event.Event) {
+// handleMatrixEvent handles a Matrix event and returns the login that it was handled with, if any.
+func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *event.Event) *UserLogin {
 	log := zerolog.Ctx(ctx)
 	if evt.Mautrix.EventSource&event.SourceEphemeral != 0 {
 		switch evt.Type {
@@ -491,7 +565,10 @@ func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *
 		case event.EphemeralEventTyping:
 			portal.handleMatrixTyping(ctx, evt)
 		}
-		return
+		return nil
+	} else if evt.Type == event.StateTombstone {
+		portal.handleMatrixTombstone(ctx, sender, evt)
+		return nil
 	}
 	login, _, err := portal.FindPreferredLogin(ctx, sender, true)
 	if err != nil {
@@ -501,7 +578,7 @@ func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *
 		} else {
 			portal.sendErrorStatus(ctx, evt, WrapErrorInStatus(err).WithMessage("Failed to get login to handle event").WithIsCertain(true).WithSendNotice(true))
 		}
-		return
+		return nil
 	}
 	var origSender *OrigSender
 	if login == nil {
@@ -526,18 +603,24 @@ func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *
 		} else {
 			origSender.DisambiguatedName = sender.MXID.String()
 		}
-		origSender.FormattedName = portal.Bridge.Config.Relay.FormatName(origSender)
+		origSender.FormattedName = portal.Bridge.GetConfig().Relay.FormatName(origSender)
 	}
 	// Copy logger because many of the handlers will use UpdateContext
 	ctx = log.With().Str("login_id", string(login.ID)).Logger().WithContext(ctx)
 	switch evt.Type {
-	case event.EventMessage, event.EventSticker, event.EventUnstablePollStart, event.EventUnstablePollResponse:
+	case event.EventMessage, event.EventSticker, event.EventUnstablePollStart, event.EventUnstablePollResponse,
+		event.EventPollStart, event.EventPollResponse:
 		portal.handleMatrixMessage(ctx, login, origSender, evt)
+	case event.EventPollEnd, event.EventUnstablePollEnd:
+		portal.handleMatrixPollEnd(ctx, login, origSender, evt)
+	case event.CallInvite, event.CallCandidates, event.CallAnswer, event.CallReject, event.CallSelectAnswer,
+		event.CallNegotiate, event.CallHangup:
+		portal.handleMatrixCall(ctx, login, origSender, evt)
 	case event.EventReaction:
 		if origSender != nil {
 			log.Debug().Msg("Ignoring reaction event from relayed user")
 			portal.sendErrorStatus(ctx, evt, ErrIgnoringReactionFromRelayedUser)
-			return
+			return login
 		}
 		portal.handleMatrixReaction(ctx, login, evt)
 	case event.EventRedaction:
@@ -548,6 +631,12 @@ func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *
 		handleMatrixRoomMeta(portal, ctx, login, origSender, evt, RoomTopicHandlingNetworkAPI.HandleMatrixRoomTopic)
 	case event.StateRoomAvatar:
 		handleMatrixRoomMeta(portal, ctx, login, origSender, evt, RoomAvatarHandlingNetworkAPI.HandleMatrixRoomAvatar)
+	case event.StateJoinRules:
+		handleMatrixRoomMeta(portal, ctx, login, origSender, evt, RoomSettingsHandlingNetworkAPI.HandleMatrixJoinRule)
+	case event.StateHistoryVisibility:
+		handleMatrixRoomMeta(portal, ctx, login, origSender, evt, RoomSettingsHandlingNetworkAPI.HandleMatrixHistoryVisibility)
+	case event.StateGuestAccess:
+		handleMatrixRoomMeta(portal, ctx, login, origSender, evt, RoomSettingsHandlingNetworkAPI.HandleMatrixGuestAccess)
 	case event.StateEncryption:
 		// TODO?
 	case event.AccountDataMarkedUnread:
@@ -561,6 +650,7 @@ func (portal *Portal) handleMatrixEvent(ctx context.Context, sender *User, evt *
 	case event.StatePowerLevels:
 		portal.handleMatrixPowerLevels(ctx, login, origSender, evt)
 	}
+	return login
 }
 
 func (portal *Portal) handleMatrixReceipts(ctx context.Context, evt *event.Event) {
@@ -773,21 +863,36 @@ func (portal *Portal) checkMessageContentCaps(ctx context.Context, caps *Network
 }
 
 func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin, origSender *OrigSender, evt *event.Event) {
+	ctx, span := tracing.Start(
+		ctx, "bridgev2.Portal.handleMatrixMessage",
+		tracing.String("bridge.portal_key", portal.PortalKey.String()),
+		tracing.String("matrix.event_id", evt.ID.String()),
+		tracing.String("bridge.login_id", string(sender.ID)),
+	)
+	defer span.End()
 	log := zerolog.Ctx(ctx)
 	var relatesTo *event.RelatesTo
 	var msgContent *event.MessageEventContent
 	var pollContent *event.PollStartEventContent
 	var pollResponseContent *event.PollResponseEventContent
 	var ok bool
-	if evt.Type == event.EventUnstablePollStart {
+	if evt.Type == event.EventUnstablePollStart || evt.Type == event.EventPollStart {
 		pollContent, ok = evt.Content.Parsed.(*event.PollStartEventContent)
-		relatesTo = pollContent.RelatesTo
-	} else if evt.Type == event.EventUnstablePollResponse {
+		if ok {
+			pollContent.Normalize()
+			relatesTo = pollContent.RelatesTo
+		}
+	} else if evt.Type == event.EventUnstablePollResponse || evt.Type == event.EventPollResponse {
 		pollResponseContent, ok = evt.Content.Parsed.(*event.PollResponseEventContent)
-		relatesTo = &pollResponseContent.RelatesTo
+		if ok {
+			pollResponseContent.SetSelections(pollResponseContent.GetSelections())
+			relatesTo = &pollResponseContent.RelatesTo
+		}
 	} else {
 		msgContent, ok = evt.Content.Parsed.(*event.MessageEventContent)
-		relatesTo = msgContent.RelatesTo
+		if ok {
+			relatesTo = msgContent.RelatesTo
+		}
 	}
 	if !ok {
 		log.Error().Type("content_type", evt.Content.Parsed).Msg("Unexpected parsed content type")
@@ -806,13 +911,35 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 		return
 	}
 	var err error
+	var scheduledAt time.Time
+	if msgContent != nil && msgContent.MauScheduledTS > 0 {
+		scheduledAt = time.UnixMilli(msgContent.MauScheduledTS)
+		if !scheduledAt.After(time.Now()) {
+			scheduledAt = time.Time{}
+		}
+	}
+	schedulingAPI, nativeScheduling := sender.Client.(ScheduledMessageHandlingNetworkAPI)
+	if !scheduledAt.IsZero() && !nativeScheduling {
+		log.Debug().Time("send_at", scheduledAt).Msg("Storing scheduled message to be sent later")
+		err = portal.Bridge.ScheduledMessages.Add(ctx, evt, scheduledAt)
+		if err != nil {
+			log.Err(err).Msg("Failed to save scheduled message")
+			portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to save scheduled message: %w", ErrDatabaseError, err))
+			return
+		}
+		portal.Bridge.Matrix.SendMessageStatus(ctx, &MessageStatus{
+			Status:  event.MessageStatusPending,
+			Message: "Message scheduled",
+		}, StatusEventInfoFromEvent(evt))
+		return
+	}
 	if origSender != nil {
 		if msgContent == nil {
 			log.Debug().Msg("Ignoring poll event from relayed user")
 			portal.sendErrorStatus(ctx, evt, ErrIgnoringPollFromRelayedUser)
 			return
 		}
-		msgContent, err = portal.Bridge.Config.Relay.FormatMessage(msgContent, origSender)
+		msgContent, err = portal.Bridge.GetConfig().Relay.FormatMessage(msgContent, origSender)
 		if err != nil {
 			log.Err(err).Msg("Failed to format message for relaying")
 			portal.sendErrorStatus(ctx, evt, err)
@@ -832,15 +959,22 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 	}
 
 	var threadRoot, replyTo, voteTo *database.Message
-	if evt.Type == event.EventUnstablePollResponse {
+	var selectedOptions []networkid.PollOptionID
+	if pollResponseContent != nil {
 		voteTo, err = portal.Bridge.DB.Message.GetPartByMXID(ctx, relatesTo.GetReferenceID())
 		if err != nil {
 			log.Err(err).Msg("Failed to get poll target message from database")
-			// TODO send status
+			portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to get poll target: %w", ErrDatabaseError, err))
 			return
 		} else if voteTo == nil {
 			log.Warn().Stringer("vote_to_id", relatesTo.GetReferenceID()).Msg("Poll target message not found")
-			// TODO send status
+			portal.sendErrorStatus(ctx, evt, fmt.Errorf("poll %w", ErrTargetMessageNotFound))
+			return
+		}
+		selectedOptions, err = portal.getSelectedPollOptions(ctx, voteTo, pollResponseContent.GetSelections())
+		if err != nil {
+			log.Err(err).Msg("Failed to get poll options from database")
+			portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to get poll options: %w", ErrDatabaseError, err))
 			return
 		}
 	}
@@ -897,7 +1031,12 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 		ReplyTo:    replyTo,
 	}
 	var resp *MatrixMessageResponse
-	if msgContent != nil {
+	if msgContent != nil && !scheduledAt.IsZero() {
+		resp, err = schedulingAPI.HandleMatrixScheduledMessage(ctx, &MatrixScheduledMessage{
+			MatrixMessage: *wrappedMsgEvt,
+			SendAt:        scheduledAt,
+		})
+	} else if msgContent != nil {
 		resp, err = sender.Client.HandleMatrixMessage(ctx, wrappedMsgEvt)
 	} else if pollContent != nil {
 		resp, err = sender.Client.(PollHandlingNetworkAPI).HandleMatrixPollStart(ctx, &MatrixPollStart{
@@ -906,9 +1045,10 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 		})
 	} else if pollResponseContent != nil {
 		resp, err = sender.Client.(PollHandlingNetworkAPI).HandleMatrixPollVote(ctx, &MatrixPollVote{
-			MatrixMessage: *wrappedMsgEvt,
-			VoteTo:        voteTo,
-			Content:       pollResponseContent,
+			MatrixMessage:   *wrappedMsgEvt,
+			VoteTo:          voteTo,
+			Content:         pollResponseContent,
+			SelectedOptions: selectedOptions,
 		})
 	} else {
 		log.Error().Msg("Failed to handle Matrix message: all contents are nil?")
@@ -917,15 +1057,19 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 	}
 	if err != nil {
 		log.Err(err).Msg("Failed to handle Matrix message")
+		span.RecordError(err)
 		portal.sendErrorStatus(ctx, evt, err)
 		return
 	}
 	message := wrappedMsgEvt.fillDBMessage(resp.DB)
+	if resp.DB != nil {
+		span.SetAttributes(tracing.String("network.message_id", string(message.ID)))
+	}
 	if !resp.Pending {
 		if resp.DB == nil {
 			log.Error().Msg("Network connector didn't return a message to save")
 		} else {
-			if portal.Bridge.Config.OutgoingMessageReID {
+			if portal.Bridge.GetConfig().OutgoingMessageReID {
 				message.MXID = portal.Bridge.Matrix.GenerateDeterministicEventID(portal.MXID, portal.PortalKey, message.ID, message.PartID)
 			}
 			// Hack to ensure the ghost row exists
@@ -934,8 +1078,29 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *UserLogin
 			err = portal.Bridge.DB.Message.Insert(ctx, message)
 			if err != nil {
 				log.Err(err).Msg("Failed to save message to database")
-			} else if resp.PostSave != nil {
-				resp.PostSave(ctx, message)
+			} else {
+				if len(resp.PollOptions) > 0 {
+					err = portal.Bridge.DB.PollOption.Put(ctx, message, resp.PollOptions)
+					if err != nil {
+						log.Err(err).Msg("Failed to save poll options to database")
+					}
+				}
+				if resp.PostSave != nil {
+					resp.PostSave(ctx, message)
+				}
+			}
+			if voteTo != nil {
+				err = portal.Bridge.DB.PollVote.Upsert(ctx, &database.PollVote{
+					Room:          portal.PortalKey,
+					MessageID:     voteTo.ID,
+					MessagePartID: voteTo.PartID,
+					SenderID:      message.SenderID,
+					OptionIDs:     selectedOptions,
+					Timestamp:     message.Timestamp,
+				})
+				if err != nil {
+					log.Err(err).Msg("Failed to save poll vote to database")
+				}
 			}
 			if resp.RemovePending != "" {
 				portal.outgoingMessagesLock.Lock()
@@ -1038,7 +1203,7 @@ func (portal *Portal) handleMatrixEdit(ctx context.Context, sender *UserLogin, o
 	}
 	if origSender != nil {
 		var err error
-		content, err = portal.Bridge.Config.Relay.FormatMessage(content, origSender)
+		content, err = portal.Bridge.GetConfig().Relay.FormatMessage(content, origSender)
 		if err != nil {
 			log.Err(err).Msg("Failed to format message for relaying")
 			portal.sendErrorStatus(ctx, evt, err)
@@ -1099,6 +1264,110 @@ func (portal *Portal) handleMatrixEdit(ctx context.Context, sender *UserLogin, o
 	portal.sendSuccessStatus(ctx, evt, 0, "")
 }
 
+func (portal *Portal) getSelectedPollOptions(ctx context.Context, pollMessage *database.Message, answerIDs []string) ([]networkid.PollOptionID, error) {
+	options, err := portal.Bridge.DB.PollOption.GetAll(ctx, pollMessage)
+	if err != nil {
+		return nil, err
+	}
+	optionMap := make(map[string]networkid.PollOptionID, len(options))
+	for _, opt := range options {
+		optionMap[opt.AnswerID] = opt.OptionID
+	}
+	selected := make([]networkid.PollOptionID, 0, len(answerIDs))
+	for _, answerID := range answerIDs {
+		optionID, ok := optionMap[answerID]
+		if ok {
+			selected = append(selected, optionID)
+		}
+	}
+	return selected, nil
+}
+
+func (portal *Portal) handleMatrixPollEnd(ctx context.Context, sender *UserLogin, origSender *OrigSender, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	if origSender != nil {
+		log.Debug().Msg("Ignoring poll end event from relayed user")
+		portal.sendErrorStatus(ctx, evt, ErrIgnoringPollFromRelayedUser)
+		return
+	}
+	api, ok := sender.Client.(PollEndHandlingNetworkAPI)
+	if !ok {
+		log.Debug().Msg("Ignoring poll end event as network connector doesn't implement PollEndHandlingNetworkAPI")
+		portal.sendErrorStatus(ctx, evt, ErrPollsNotSupported)
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.PollEndEventContent)
+	if !ok {
+		log.Error().Type("content_type", evt.Content.Parsed).Msg("Unexpected parsed content type")
+		portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: %T", ErrUnexpectedParsedContentType, evt.Content.Parsed))
+		return
+	}
+	pollMessage, err := portal.Bridge.DB.Message.GetPartByMXID(ctx, content.RelatesTo.GetReferenceID())
+	if err != nil {
+		log.Err(err).Msg("Failed to get poll message from database")
+		portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to get poll message: %w", ErrDatabaseError, err))
+		return
+	} else if pollMessage == nil {
+		log.Warn().Stringer("poll_id", content.RelatesTo.GetReferenceID()).Msg("Poll message not found")
+		portal.sendErrorStatus(ctx, evt, fmt.Errorf("poll %w", ErrTargetMessageNotFound))
+		return
+	}
+	err = api.HandleMatrixPollEnd(ctx, &MatrixPollEnd{
+		MatrixEventBase: MatrixEventBase[*event.PollEndEventContent]{
+			Event:   evt,
+			Content: content,
+			Portal:  portal,
+		},
+		PollMessage: pollMessage,
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to handle Matrix poll end")
+		portal.sendErrorStatus(ctx, evt, err)
+		return
+	}
+	portal.sendSuccessStatus(ctx, evt, 0, "")
+}
+
+func (portal *Portal) handleMatrixCall(ctx context.Context, sender *UserLogin, origSender *OrigSender, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	if origSender != nil {
+		log.Debug().Msg("Ignoring call event from relayed user")
+		portal.sendErrorStatus(ctx, evt, ErrIgnoringCallFromRelayedUser)
+		return
+	}
+	api, ok := sender.Client.(CallHandlingNetworkAPI)
+	if !ok {
+		log.Debug().Msg("Ignoring call event as network connector doesn't implement CallHandlingNetworkAPI")
+		if evt.Type == event.CallInvite {
+			portal.sendErrorStatus(ctx, evt, ErrCallsNotSupported)
+		}
+		return
+	}
+	content, ok := evt.Content.Parsed.(event.CallEventContent)
+	if !ok {
+		log.Error().Type("content_type", evt.Content.Parsed).Msg("Unexpected parsed content type")
+		portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: %T", ErrUnexpectedParsedContentType, evt.Content.Parsed))
+		return
+	}
+	log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("call_id", content.GetCallBase().CallID)
+	})
+	err := api.HandleMatrixCall(ctx, &MatrixCall{
+		MatrixEventBase: MatrixEventBase[event.CallEventContent]{
+			Event:   evt,
+			Content: content,
+			Portal:  portal,
+		},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to handle Matrix call event")
+		portal.sendErrorStatus(ctx, evt, err)
+	} else if evt.Type == event.CallInvite {
+		// Only send success statuses for invites, the other call events are too spammy
+		portal.sendSuccessStatus(ctx, evt, 0, "")
+	}
+}
+
 func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *UserLogin, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
 	reactingAPI, ok := sender.Client.(ReactionHandlingNetworkAPI)
@@ -1137,6 +1406,14 @@ func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *UserLogi
 		},
 		TargetMessage: reactionTarget,
 	}
+	if strings.HasPrefix(content.RelatesTo.Key, "mxc://") {
+		react.CustomEmoji, err = portal.Bridge.DB.CustomEmoji.GetByMXC(ctx, id.ContentURIString(content.RelatesTo.Key))
+		if err != nil {
+			log.Err(err).Msg("Failed to get custom emoji from database")
+			portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to get custom emoji: %w", ErrDatabaseError, err))
+			return
+		}
+	}
 	preResp, err := reactingAPI.PreHandleMatrixReaction(ctx, react)
 	if err != nil {
 		log.Err(err).Msg("Failed to pre-handle Matrix reaction")
@@ -1144,7 +1421,7 @@ func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *UserLogi
 		return
 	}
 	var deterministicID id.EventID
-	if portal.Bridge.Config.OutgoingMessageReID {
+	if portal.Bridge.GetConfig().OutgoingMessageReID {
 		deterministicID = portal.Bridge.Matrix.GenerateReactionEventID(portal.MXID, reactionTarget, preResp.SenderID, preResp.EmojiID)
 	}
 	existing, err := portal.Bridge.DB.Reaction.GetByID(ctx, portal.Receiver, reactionTarget.ID, reactionTarget.PartID, preResp.SenderID, preResp.EmojiID)
@@ -1277,6 +1554,21 @@ func handleMatrixRoomMeta[APIType any, ContentType any](
 			portal.sendSuccessStatus(ctx, evt, 0, "")
 			return
 		}
+	case *event.JoinRulesEventContent:
+		if typedContent.JoinRule == portal.JoinRule && len(typedContent.Allow) == 0 {
+			portal.sendSuccessStatus(ctx, evt, 0, "")
+			return
+		}
+	case *event.HistoryVisibilityEventContent:
+		if typedContent.HistoryVisibility == portal.HistoryVisibility {
+			portal.sendSuccessStatus(ctx, evt, 0, "")
+			return
+		}
+	case *event.GuestAccessEventContent:
+		if typedContent.GuestAccess == portal.GuestAccess {
+			portal.sendSuccessStatus(ctx, evt, 0, "")
+			return
+		}
 	}
 	var prevContent ContentType
 	if evt.Unsigned.PrevContent != nil {
@@ -1341,6 +1633,164 @@ func handleMatrixAccountData[APIType any, ContentType any](
 	}
 }
 
+func (portal *Portal) handleMatrixTombstone(ctx context.Context, sender *User, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	content, ok := evt.Content.Parsed.(*event.TombstoneEventContent)
+	if !ok {
+		log.Error().Type("content_type", evt.Content.Parsed).Msg("Unexpected parsed content type")
+		return
+	} else if evt.StateKey == nil || *evt.StateKey != "" || content.ReplacementRoom == "" {
+		return
+	} else if content.ReplacementRoom == portal.MXID {
+		log.Warn().Msg("Ignoring tombstone pointing to the room itself")
+		return
+	}
+	pl, err := portal.Bridge.Matrix.GetPowerLevels(ctx, portal.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get power levels to check tombstone sender")
+		return
+	} else if pl.GetUserLevel(evt.Sender) < pl.GetEventLevel(event.StateTombstone) {
+		log.Warn().Msg("Ignoring tombstone from user without sufficient power level")
+		return
+	}
+	if !sender.GetPermissions().Admin {
+		login, _, err := portal.FindPreferredLogin(ctx, sender, false)
+		if err != nil || login == nil {
+			log.Warn().AnErr("login_err", err).Msg("Ignoring tombstone from user who isn't a bridge admin or logged into the portal")
+			return
+		}
+	}
+	existingPortal, err := portal.Bridge.GetPortalByMXID(ctx, content.ReplacementRoom)
+	if err != nil {
+		log.Err(err).Msg("Failed to check if replacement room is already a portal")
+		return
+	} else if existingPortal != nil {
+		log.Warn().
+			Stringer("replacement_room_id", content.ReplacementRoom).
+			Object("replacement_portal_key", existingPortal.PortalKey).
+			Msg("Ignoring tombstone pointing to another portal")
+		return
+	}
+	err = portal.FollowTombstone(ctx, content.ReplacementRoom)
+	if err != nil {
+		log.Err(err).Stringer("replacement_room_id", content.ReplacementRoom).Msg("Failed to follow room upgrade")
+	}
+}
+
+// FollowTombstone moves the portal to the given replacement room after the current room has been upgraded.
+//
+// The bridge bot and all ghosts in the old room are joined to the new room, after which the room ID is
+// updated in the database, bridge info is re-sent and space memberships are moved. Users with logins in
+// the portal are then marked as being in the portal again (see [UserLogin.MarkInPortal]), which joins
+// them to the new room with their double puppet or invites them using the bridge bot.
+//
+// Message mappings are keyed by portal rather than room ID, so they stay valid, although events bridged
+// before the upgrade will keep pointing at the old room.
+//
+// This must be called from the portal event loop, e.g. by handling a tombstone event.
+func (portal *Portal) FollowTombstone(ctx context.Context, newRoomID id.RoomID) error {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	oldRoomID := portal.MXID
+	if oldRoomID == "" {
+		return fmt.Errorf("portal doesn't have a room")
+	} else if oldRoomID == newRoomID {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().
+		Stringer("old_room_id", oldRoomID).
+		Stringer("new_room_id", newRoomID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Following room upgrade")
+	err := portal.Bridge.Bot.EnsureJoined(ctx, newRoomID)
+	if err != nil {
+		return fmt.Errorf("failed to join replacement room with bot: %w", err)
+	}
+	members, err := portal.Bridge.Matrix.GetMembers(ctx, oldRoomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get members of old room, ghosts won't be moved")
+	}
+	for userID, member := range members {
+		if member.Membership != event.MembershipJoin {
+			continue
+		}
+		ghostID, isGhost := portal.Bridge.Matrix.ParseGhostMXID(userID)
+		if !isGhost {
+			continue
+		}
+		err = portal.Bridge.Matrix.GhostIntent(ghostID).EnsureJoined(ctx, newRoomID)
+		if err != nil {
+			log.Err(err).Stringer("ghost_mxid", userID).Msg("Failed to join ghost to replacement room")
+		}
+	}
+
+	if portal.Parent != nil && portal.Parent.MXID != "" && portal.InSpace {
+		err = portal.toggleSpace(ctx, portal.Parent.MXID, false, true)
+		if err != nil {
+			log.Err(err).Msg("Failed to remove old room from parent space")
+		}
+	}
+	userPortals, err := portal.Bridge.DB.UserPortal.GetAllInPortal(ctx, portal.PortalKey)
+	if err != nil {
+		log.Err(err).Msg("Failed to get user portals, personal spaces won't be updated")
+	}
+	for _, up := range userPortals {
+		login := portal.Bridge.GetCachedUserLoginByID(up.LoginID)
+		if login == nil || up.InSpace == nil || !*up.InSpace {
+			continue
+		}
+		spaceRoom, err := login.GetSpaceRoom(ctx)
+		if err != nil {
+			log.Err(err).Str("login_id", string(login.ID)).Msg("Failed to get space room to remove old room")
+		} else if spaceRoom != "" {
+			err = portal.toggleSpace(ctx, spaceRoom, false, true)
+			if err != nil {
+				log.Err(err).Str("login_id", string(login.ID)).Msg("Failed to remove old room from space")
+			}
+		}
+		// Marking the new room as not being in the space makes MarkInPortal below add it
+		notInSpace := up.CopyWithoutValues()
+		notInSpace.InSpace = new(bool)
+		err = portal.Bridge.DB.UserPortal.Put(ctx, notInSpace)
+		if err != nil {
+			log.Err(err).Str("login_id", string(login.ID)).Msg("Failed to save user portal row after removing old room from space")
+		}
+	}
+
+	portal.Bridge.cacheLock.Lock()
+	delete(portal.Bridge.portalsByMXID, oldRoomID)
+	portal.MXID = newRoomID
+	portal.Bridge.portalsByMXID[newRoomID] = portal
+	portal.Bridge.cacheLock.Unlock()
+	portal.updateLogger()
+	err = portal.Save(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save new room ID: %w", err)
+	}
+	// Scheduled messages haven't been sent yet, so they're sent to the new room.
+	// Disappearing messages stay in the old room, as that's where the events to redact are.
+	err = portal.Bridge.DB.ScheduledMessage.MoveToRoom(ctx, oldRoomID, newRoomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to move scheduled messages to replacement room")
+	}
+	portal.UpdateBridgeInfo(ctx)
+
+	if portal.Parent != nil && portal.Parent.MXID != "" {
+		portal.addToParentSpaceAndSave(ctx, true)
+	}
+	for _, up := range userPortals {
+		login := portal.Bridge.GetCachedUserLoginByID(up.LoginID)
+		if login == nil {
+			continue
+		}
+		login.inPortalCache.Remove(portal.PortalKey)
+		login.MarkInPortal(ctx, portal)
+	}
+	log.Info().Msg("Finished following room upgrade")
+	return nil
+}
+
 func (portal *Portal) getTargetUser(ctx context.Context, userID id.UserID) (GhostOrUserLogin, error) {
 	if targetGhost, err := portal.Bridge.GetGhostByMXID(ctx, userID); err != nil {
 		return nil, fmt.Errorf("failed to get ghost: %w", err)
@@ -1397,7 +1847,7 @@ func (portal *Portal) handleMatrixMembership(
 	}
 
 	membershipChangeType := MembershipChangeType{From: prevContent.Membership, To: content.Membership, IsSelf: isSelf}
-	if !portal.Bridge.Config.BridgeMatrixLeave && membershipChangeType == Leave {
+	if !portal.Bridge.GetConfig().BridgeMatrixLeave && membershipChangeType == Leave {
 		log.Debug().Msg("Dropping leave event")
 		//portal.sendErrorStatus(ctx, evt, ErrIgnoringLeaveEvent)
 		return
@@ -1536,6 +1986,15 @@ func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *UserLog
 	log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 		return c.Stringer("redaction_target_mxid", content.Redacts)
 	})
+	if cancelled, err := portal.Bridge.ScheduledMessages.Cancel(ctx, content.Redacts); err != nil {
+		log.Err(err).Msg("Failed to cancel scheduled message")
+		portal.sendErrorStatus(ctx, evt, fmt.Errorf("%w: failed to cancel scheduled message: %w", ErrDatabaseError, err))
+		return
+	} else if cancelled {
+		log.Debug().Msg("Cancelled scheduled message")
+		portal.sendSuccessStatus(ctx, evt, 0, "")
+		return
+	}
 	deletingAPI, deleteOK := sender.Client.(RedactionHandlingNetworkAPI)
 	reactingAPI, reactOK := sender.Client.(ReactionHandlingNetworkAPI)
 	if !deleteOK && !reactOK {
@@ -1671,6 +2130,14 @@ func (portal *Portal) handleRemoteEvent(ctx context.Context, source *UserLogin,
 		portal.handleRemoteChatDelete(ctx, source, evt.(RemoteChatDelete))
 	case RemoteEventBackfill:
 		portal.handleRemoteBackfill(ctx, source, evt.(RemoteBackfill))
+	case RemoteEventPollVote:
+		portal.handleRemotePollVote(ctx, source, evt.(RemotePollVote))
+	case RemoteEventPollEnd:
+		portal.handleRemotePollEnd(ctx, source, evt.(RemotePollEnd))
+	case RemoteEventPollResultsSync:
+		portal.handleRemotePollResultsSync(ctx, source, evt.(RemotePollResultsSync))
+	case RemoteEventCall:
+		portal.handleRemoteCall(ctx, source, evt.(RemoteCall))
 	default:
 		log.Warn().Msg("Got remote event with unknown type")
 	}
@@ -1862,6 +2329,11 @@ func (portal *Portal) sendConvertedMessage(
 		err := portal.Bridge.DB.Message.Insert(ctx, dbMessage)
 		if err != nil {
 			logContext(log.Err(err)).Str("part_id", string(part.ID)).Msg("Failed to save message part to database")
+		} else if len(part.PollOptions) > 0 {
+			err = portal.Bridge.DB.PollOption.Put(ctx, dbMessage, part.PollOptions)
+			if err != nil {
+				logContext(log.Err(err)).Str("part_id", string(part.ID)).Msg("Failed to save poll options to database")
+			}
 		}
 		if converted.Disappear.Type != database.DisappearingTypeNone && !dbMessage.HasFakeMXID() {
 			if converted.Disappear.Type == database.DisappearingTypeAfterSend && converted.Disappear.DisappearAt.IsZero() {
@@ -1916,7 +2388,7 @@ func (portal *Portal) checkPendingMessage(ctx context.Context, evt RemoteMessage
 		saveMessage, statusErr = pending.handle(evt, pending.db)
 	}
 	if saveMessage {
-		if portal.Bridge.Config.OutgoingMessageReID {
+		if portal.Bridge.GetConfig().OutgoingMessageReID {
 			pending.db.MXID = portal.Bridge.Matrix.GenerateDeterministicEventID(portal.MXID, portal.PortalKey, pending.db.ID, pending.db.PartID)
 		}
 		// Hack to ensure the ghost row exists
@@ -1971,6 +2443,13 @@ func (portal *Portal) handleRemoteUpsert(ctx context.Context, source *UserLogin,
 }
 
 func (portal *Portal) handleRemoteMessage(ctx context.Context, source *UserLogin, evt RemoteMessage) {
+	ctx, span := tracing.Start(
+		ctx, "bridgev2.Portal.handleRemoteMessage",
+		tracing.String("bridge.portal_key", portal.PortalKey.String()),
+		tracing.String("network.message_id", string(evt.GetID())),
+		tracing.String("bridge.login_id", string(source.ID)),
+	)
+	defer span.End()
 	log := zerolog.Ctx(ctx)
 	upsertEvt, isUpsert := evt.(RemoteMessageUpsert)
 	isUpsert = isUpsert && evt.GetType() == RemoteEventMessageUpsert
@@ -2006,11 +2485,15 @@ func (portal *Portal) handleRemoteMessage(ctx context.Context, source *UserLogin
 			log.Debug().Err(err).Msg("Remote message handling was cancelled by convert function")
 		} else {
 			log.Err(err).Msg("Failed to convert remote message")
+			span.RecordError(err)
 			portal.sendRemoteErrorNotice(ctx, intent, err, ts, "message")
 		}
 		return
 	}
-	portal.sendConvertedMessage(ctx, evt.GetID(), intent, evt.GetSender().Sender, converted, ts, getStreamOrder(evt), nil)
+	dbMessages := portal.sendConvertedMessage(ctx, evt.GetID(), intent, evt.GetSender().Sender, converted, ts, getStreamOrder(evt), nil)
+	if len(dbMessages) > 0 {
+		span.SetAttributes(tracing.String("matrix.event_id", dbMessages[0].MXID.String()))
+	}
 }
 
 func (portal *Portal) sendRemoteErrorNotice(ctx context.Context, intent MatrixAPI, err error, ts time.Time, evtTypeName string) {
@@ -2216,9 +2699,10 @@ func (portal *Portal) handleRemoteReactionSync(ctx context.Context, source *User
 
 	doAddReaction := func(new *BackfillReaction) MatrixAPI {
 		intent := portal.GetIntentFor(ctx, new.Sender, source, RemoteEventReactionSync)
+		emoji, extra := portal.convertCustomEmojiReaction(ctx, intent, new.Emoji, new.CustomEmoji, new.ExtraContent)
 		portal.sendConvertedReaction(
-			ctx, new.Sender.Sender, intent, targetMessage, new.EmojiID, new.Emoji,
-			new.Timestamp, new.DBMetadata, new.ExtraContent,
+			ctx, new.Sender.Sender, intent, targetMessage, new.EmojiID, emoji,
+			new.Timestamp, new.DBMetadata, extra,
 			func(z *zerolog.Event) *zerolog.Event {
 				return z.
 					Any("reaction_sender_id", new.Sender).
@@ -2341,6 +2825,9 @@ func (portal *Portal) handleRemoteReaction(ctx context.Context, source *UserLogi
 	if metaProvider, ok := evt.(RemoteReactionWithMeta); ok {
 		dbMetadata = metaProvider.GetReactionDBMetadata()
 	}
+	if customEmojiProvider, ok := evt.(RemoteReactionWithCustomEmoji); ok {
+		emoji, extra = portal.convertCustomEmojiReaction(ctx, intent, emoji, customEmojiProvider.GetReactionCustomEmoji(), extra)
+	}
 	portal.sendConvertedReaction(ctx, evt.GetSender().Sender, intent, targetMessage, emojiID, emoji, ts, dbMetadata, extra, nil)
 	if existingReaction != nil {
 		_, err = intent.SendMessage(ctx, portal.MXID, event.EventRedaction, &event.Content{
@@ -2453,6 +2940,267 @@ func (portal *Portal) handleRemoteReactionRemove(ctx context.Context, source *Us
 	}
 }
 
+func (portal *Portal) getPollAnswerIDs(ctx context.Context, pollMessage *database.Message) (map[networkid.PollOptionID]string, error) {
+	options, err := portal.Bridge.DB.PollOption.GetAll(ctx, pollMessage)
+	if err != nil {
+		return nil, err
+	}
+	answerIDs := make(map[networkid.PollOptionID]string, len(options))
+	for _, opt := range options {
+		answerIDs[opt.OptionID] = opt.AnswerID
+	}
+	return answerIDs, nil
+}
+
+func (portal *Portal) sendPollVote(
+	ctx context.Context, intent MatrixAPI, pollMessage *database.Message, answerIDs map[networkid.PollOptionID]string,
+	senderID networkid.UserID, options []networkid.PollOptionID, ts time.Time,
+) {
+	log := zerolog.Ctx(ctx)
+	selections := make([]string, 0, len(options))
+	for _, optionID := range options {
+		answerID, ok := answerIDs[optionID]
+		if !ok {
+			log.Warn().Str("option_id", string(optionID)).Msg("Unknown poll option in vote")
+			continue
+		}
+		selections = append(selections, answerID)
+	}
+	content := &event.PollResponseEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelReference,
+			EventID: pollMessage.MXID,
+		},
+	}
+	content.SetSelections(selections)
+	resp, err := intent.SendMessage(ctx, portal.MXID, event.EventPollResponse, &event.Content{
+		Parsed: content,
+	}, &MatrixSendExtra{Timestamp: ts})
+	if err != nil {
+		log.Err(err).Str("sender_id", string(senderID)).Msg("Failed to send poll vote to Matrix")
+		return
+	}
+	log.Debug().
+		Stringer("event_id", resp.EventID).
+		Str("sender_id", string(senderID)).
+		Msg("Sent poll vote to Matrix")
+	err = portal.Bridge.DB.PollVote.Upsert(ctx, &database.PollVote{
+		Room:          portal.PortalKey,
+		MessageID:     pollMessage.ID,
+		MessagePartID: pollMessage.PartID,
+		SenderID:      senderID,
+		OptionIDs:     options,
+		Timestamp:     ts,
+	})
+	if err != nil {
+		log.Err(err).Str("sender_id", string(senderID)).Msg("Failed to save poll vote to database")
+	}
+}
+
+func (portal *Portal) getTargetPoll(ctx context.Context, evt RemoteEventWithTargetMessage) (*database.Message, map[networkid.PollOptionID]string) {
+	log := zerolog.Ctx(ctx)
+	pollMessage, err := portal.getTargetMessagePart(ctx, evt)
+	if err != nil {
+		log.Err(err).Msg("Failed to get target poll message")
+		return nil, nil
+	} else if pollMessage == nil {
+		log.Warn().Msg("Target poll message not found")
+		return nil, nil
+	}
+	answerIDs, err := portal.getPollAnswerIDs(ctx, pollMessage)
+	if err != nil {
+		log.Err(err).Msg("Failed to get poll options from database")
+		return nil, nil
+	}
+	return pollMessage, answerIDs
+}
+
+func (portal *Portal) handleRemotePollVote(ctx context.Context, source *UserLogin, evt RemotePollVote) {
+	pollMessage, answerIDs := portal.getTargetPoll(ctx, evt)
+	if pollMessage == nil {
+		return
+	}
+	intent := portal.GetIntentFor(ctx, evt.GetSender(), source, RemoteEventPollVote)
+	portal.sendPollVote(ctx, intent, pollMessage, answerIDs, evt.GetSender().Sender, evt.GetPollVote(), getEventTS(evt))
+}
+
+func (portal *Portal) handleRemotePollResultsSync(ctx context.Context, source *UserLogin, evt RemotePollResultsSync) {
+	log := zerolog.Ctx(ctx)
+	data := evt.GetPollResults()
+	if data == nil {
+		log.Warn().Msg("Poll results sync event didn't contain any results")
+		return
+	}
+	pollMessage, answerIDs := portal.getTargetPoll(ctx, evt)
+	if pollMessage == nil {
+		return
+	}
+	existingVotes, err := portal.Bridge.DB.PollVote.GetAll(ctx, pollMessage)
+	if err != nil {
+		log.Err(err).Msg("Failed to get existing poll votes")
+		return
+	}
+	existing := make(map[networkid.UserID]*database.PollVote, len(existingVotes))
+	for _, vote := range existingVotes {
+		existing[vote.SenderID] = vote
+	}
+	for _, vote := range data.Votes {
+		existingVote, ok := existing[vote.Sender.Sender]
+		delete(existing, vote.Sender.Sender)
+		if ok && slices.Equal(existingVote.OptionIDs, vote.Options) {
+			continue
+		}
+		ts := vote.Timestamp
+		if ts.IsZero() {
+			ts = getEventTS(evt)
+		}
+		intent := portal.GetIntentFor(ctx, vote.Sender, source, RemoteEventPollResultsSync)
+		portal.sendPollVote(ctx, intent, pollMessage, answerIDs, vote.Sender.Sender, vote.Options, ts)
+	}
+	if data.HasAllVotes {
+		for senderID, existingVote := range existing {
+			if len(existingVote.OptionIDs) == 0 {
+				continue
+			}
+			intent := portal.GetIntentFor(ctx, EventSender{Sender: senderID}, source, RemoteEventPollResultsSync)
+			portal.sendPollVote(ctx, intent, pollMessage, answerIDs, senderID, nil, getEventTS(evt))
+		}
+	}
+}
+
+func (portal *Portal) handleRemotePollEnd(ctx context.Context, source *UserLogin, evt RemotePollEnd) {
+	log := zerolog.Ctx(ctx)
+	pollMessage, answerIDs := portal.getTargetPoll(ctx, evt)
+	if pollMessage == nil {
+		return
+	}
+	results := evt.GetFinalPollResults()
+	if results == nil {
+		votes, err := portal.Bridge.DB.PollVote.GetAll(ctx, pollMessage)
+		if err != nil {
+			log.Err(err).Msg("Failed to get poll votes to count results")
+			return
+		}
+		results = make(map[networkid.PollOptionID]int)
+		for _, vote := range votes {
+			for _, optionID := range vote.OptionIDs {
+				results[optionID]++
+			}
+		}
+	}
+	content := &event.PollEndEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelReference,
+			EventID: pollMessage.MXID,
+		},
+		Results:         make(map[string]int, len(results)),
+		UnstablePollEnd: &struct{}{},
+		UnstableText:    "The poll has ended.",
+	}
+	content.Text = event.MakeExtensibleText(content.UnstableText, "")
+	for optionID, count := range results {
+		answerID, ok := answerIDs[optionID]
+		if ok {
+			content.Results[answerID] = count
+		}
+	}
+	intent := portal.GetIntentFor(ctx, evt.GetSender(), source, RemoteEventPollEnd)
+	resp, err := intent.SendMessage(ctx, portal.MXID, event.EventPollEnd, &event.Content{
+		Parsed: content,
+	}, &MatrixSendExtra{Timestamp: getEventTS(evt)})
+	if err != nil {
+		log.Err(err).Msg("Failed to send poll end to Matrix")
+		return
+	}
+	log.Debug().Stringer("event_id", resp.EventID).Msg("Sent poll end to Matrix")
+}
+
+func formatCallDuration(dur time.Duration) string {
+	dur = dur.Round(time.Second)
+	hours := int(dur / time.Hour)
+	minutes := int(dur % time.Hour / time.Minute)
+	seconds := int(dur % time.Minute / time.Second)
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
+
+func (ci *CallInfo) summary() string {
+	callType := "voice call"
+	if ci.Type == CallTypeVideo {
+		callType = "video call"
+	}
+	if ci.IsGroup {
+		callType = "group " + callType
+	}
+	switch ci.State {
+	case CallStateStarted:
+		if ci.IsGroup {
+			return fmt.Sprintf("Started a %s", callType)
+		}
+		return fmt.Sprintf("Incoming %s", callType)
+	case CallStateMissed:
+		return fmt.Sprintf("Missed %s", callType)
+	case CallStateRejected:
+		return fmt.Sprintf("Declined %s", callType)
+	case CallStateEnded:
+		if ci.Duration > 0 {
+			return fmt.Sprintf("%s ended (duration: %s)", strings.ToUpper(callType[:1])+callType[1:], formatCallDuration(ci.Duration))
+		}
+		return fmt.Sprintf("%s ended", strings.ToUpper(callType[:1])+callType[1:])
+	default:
+		return ""
+	}
+}
+
+func (portal *Portal) handleRemoteCall(ctx context.Context, source *UserLogin, evt RemoteCall) {
+	log := zerolog.Ctx(ctx)
+	info := evt.GetCall()
+	if info == nil {
+		log.Warn().Msg("Remote call event didn't contain call info")
+		return
+	}
+	log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("call_id", string(info.ID)).Str("call_state", string(info.State))
+	})
+	intent := portal.GetIntentFor(ctx, evt.GetSender(), source, RemoteEventCall)
+	ts := getEventTS(evt)
+	if info.IsGroup && info.ID != "" {
+		content := &event.GroupCallEventContent{
+			Intent: event.GroupCallIntentRoom,
+			Type:   event.GroupCallTypeVoice,
+			Name:   info.Name,
+		}
+		if info.Type == CallTypeVideo {
+			content.Type = event.GroupCallTypeVideo
+		}
+		if info.State != CallStateStarted {
+			content.Terminated = "call_ended"
+		}
+		portal.sendRoomMeta(ctx, intent, ts, event.StateUnstableGroupCall, string(info.ID), content)
+		if info.State == CallStateStarted {
+			return
+		}
+	}
+	summary := info.summary()
+	if summary == "" {
+		log.Warn().Msg("Unknown remote call state")
+		return
+	}
+	resp, err := intent.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    summary,
+		},
+	}, &MatrixSendExtra{Timestamp: ts})
+	if err != nil {
+		log.Err(err).Msg("Failed to send call notice to Matrix")
+		return
+	}
+	log.Debug().Stringer("event_id", resp.EventID).Msg("Sent call notice to Matrix")
+}
+
 func (portal *Portal) handleRemoteMessageRemove(ctx context.Context, source *UserLogin, evt RemoteMessageRemove) {
 	log := zerolog.Ctx(ctx)
 	targetParts, err := portal.Bridge.DB.Message.GetAllPartsByID(ctx, portal.Receiver, evt.GetTargetMessage())
@@ -2639,7 +3387,7 @@ func (portal *Portal) handleRemoteChatResync(ctx context.Context, source *UserLo
 		}
 	}
 	backfillChecker, ok := evt.(RemoteChatResyncBackfill)
-	if portal.Bridge.Config.Backfill.Enabled && ok && portal.RoomType != database.RoomTypeSpace {
+	if portal.Bridge.GetConfig().Backfill.Enabled && ok && portal.RoomType != database.RoomTypeSpace {
 		latestMessage, err := portal.Bridge.DB.Message.GetLastPartAtOrBeforeTime(ctx, portal.PortalKey, time.Now().Add(10*time.Second))
 		if err != nil {
 			log.Err(err).Msg("Failed to get last message in portal to check if backfill is necessary")
@@ -2826,8 +3574,10 @@ type ChatInfo struct {
 	Topic  *string
 	Avatar *Avatar
 
-	Members  *ChatMemberList
-	JoinRule *event.JoinRulesEventContent
+	Members           *ChatMemberList
+	JoinRule          *event.JoinRulesEventContent
+	HistoryVisibility *event.HistoryVisibilityEventContent
+	GuestAccess       *event.GuestAccessEventContent
 
 	Type      *database.RoomType
 	Disappear *database.DisappearingSetting
@@ -2835,6 +3585,10 @@ type ChatInfo struct {
 
 	UserLocal *UserLocalPortalInfo
 
+	// Custom emoji and sticker packs of the chat. Packs that are not included in the list are left as-is,
+	// use [ImagePack.Remove] to remove a pack from the room.
+	ImagePacks []*ImagePack
+
 	CanBackfill bool
 
 	ExtraUpdates ExtraUpdater[*Portal]
@@ -2887,6 +3641,42 @@ func (portal *Portal) updateTopic(ctx context.Context, topic string, sender Matr
 	return true
 }
 
+func (portal *Portal) updateJoinRule(ctx context.Context, content *event.JoinRulesEventContent, sender MatrixAPI, ts time.Time) bool {
+	// Restricted join rules have an allow list which isn't stored in the database, so always resend those
+	if portal.JoinRule == content.JoinRule && len(content.Allow) == 0 {
+		return false
+	}
+	if portal.MXID != "" && !portal.sendRoomMeta(ctx, sender, ts, event.StateJoinRules, "", content) {
+		return false
+	}
+	portal.JoinRule = content.JoinRule
+	return true
+}
+
+func (portal *Portal) updateHistoryVisibility(ctx context.Context, visibility event.HistoryVisibility, sender MatrixAPI, ts time.Time) bool {
+	if portal.HistoryVisibility == visibility {
+		return false
+	}
+	content := &event.HistoryVisibilityEventContent{HistoryVisibility: visibility}
+	if portal.MXID != "" && !portal.sendRoomMeta(ctx, sender, ts, event.StateHistoryVisibility, "", content) {
+		return false
+	}
+	portal.HistoryVisibility = visibility
+	return true
+}
+
+func (portal *Portal) updateGuestAccess(ctx context.Context, guestAccess event.GuestAccess, sender MatrixAPI, ts time.Time) bool {
+	if portal.GuestAccess == guestAccess {
+		return false
+	}
+	content := &event.GuestAccessEventContent{GuestAccess: guestAccess}
+	if portal.MXID != "" && !portal.sendRoomMeta(ctx, sender, ts, event.StateGuestAccess, "", content) {
+		return false
+	}
+	portal.GuestAccess = guestAccess
+	return true
+}
+
 func (portal *Portal) updateAvatar(ctx context.Context, avatar *Avatar, sender MatrixAPI, ts time.Time) bool {
 	if portal.AvatarID == avatar.ID && (portal.AvatarSet || portal.MXID == "") {
 		return false
@@ -3013,7 +3803,7 @@ func (portal *Portal) getInitialMemberList(ctx context.Context, members *ChatMem
 		return
 	}
 	var loginsInPortal []*UserLogin
-	if members.CheckAllLogins && !portal.Bridge.Config.SplitPortals {
+	if members.CheckAllLogins && !portal.Bridge.GetConfig().SplitPortals {
 		loginsInPortal, err = portal.Bridge.GetUserLoginsInPortal(ctx, portal.PortalKey)
 		if err != nil {
 			err = fmt.Errorf("failed to get user logins in portal: %w", err)
@@ -3087,7 +3877,7 @@ func (portal *Portal) syncParticipants(ctx context.Context, members *ChatMemberL
 	members.memberListToMap(ctx)
 	var loginsInPortal []*UserLogin
 	var err error
-	if members.CheckAllLogins && !portal.Bridge.Config.SplitPortals {
+	if members.CheckAllLogins && !portal.Bridge.GetConfig().SplitPortals {
 		loginsInPortal, err = portal.Bridge.GetUserLoginsInPortal(ctx, portal.PortalKey)
 		if err != nil {
 			return fmt.Errorf("failed to get user logins in portal: %w", err)
@@ -3269,16 +4059,16 @@ func (portal *Portal) updateUserLocalInfo(ctx context.Context, info *UserLocalPo
 	if info == nil {
 		return
 	}
-	if info.MutedUntil != nil && (didJustCreate || !portal.Bridge.Config.MuteOnlyOnCreate) && (!didJustCreate || info.MutedUntil.After(time.Now())) {
+	if info.MutedUntil != nil && (didJustCreate || !portal.Bridge.GetConfig().MuteOnlyOnCreate) && (!didJustCreate || info.MutedUntil.After(time.Now())) {
 		err := dp.MuteRoom(ctx, portal.MXID, *info.MutedUntil)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to mute room")
 		}
 	}
 	if info.Tag != nil &&
-		len(portal.Bridge.Config.OnlyBridgeTags) > 0 &&
-		(*info.Tag == "" || slices.Contains(portal.Bridge.Config.OnlyBridgeTags, *info.Tag)) &&
-		(didJustCreate || !portal.Bridge.Config.TagOnlyOnCreate) &&
+		len(portal.Bridge.GetConfig().OnlyBridgeTags) > 0 &&
+		(*info.Tag == "" || slices.Contains(portal.Bridge.GetConfig().OnlyBridgeTags, *info.Tag)) &&
+		(didJustCreate || !portal.Bridge.GetConfig().TagOnlyOnCreate) &&
 		(!didJustCreate || *info.Tag != "") {
 		err := dp.TagRoom(ctx, portal.MXID, *info.Tag, *info.Tag != "")
 		if err != nil {
@@ -3339,7 +4129,7 @@ func (portal *Portal) UpdateDisappearingSetting(ctx context.Context, setting dat
 
 func (portal *Portal) updateParent(ctx context.Context, newParentID networkid.PortalID, source *UserLogin) bool {
 	newParent := networkid.PortalKey{ID: newParentID}
-	if portal.Bridge.Config.SplitPortals {
+	if portal.Bridge.GetConfig().SplitPortals {
 		newParent.Receiver = portal.Receiver
 	}
 	if portal.ParentKey == newParent {
@@ -3382,7 +4172,7 @@ func (portal *Portal) lockedUpdateInfoFromGhost(ctx context.Context, ghost *Ghos
 }
 
 func (portal *Portal) UpdateInfoFromGhost(ctx context.Context, ghost *Ghost) (changed bool) {
-	if portal.NameIsCustom || !portal.Bridge.Config.PrivateChatPortalMeta || (portal.OtherUserID == "" && ghost == nil) || portal.RoomType != database.RoomTypeDM {
+	if portal.NameIsCustom || !portal.Bridge.GetConfig().PrivateChatPortalMeta || (portal.OtherUserID == "" && ghost == nil) || portal.RoomType != database.RoomTypeDM {
 		return
 	}
 	var err error
@@ -3428,8 +4218,13 @@ func (portal *Portal) UpdateInfo(ctx context.Context, info *ChatInfo, source *Us
 		changed = portal.updateParent(ctx, *info.ParentID, source) || changed
 	}
 	if info.JoinRule != nil {
-		// TODO change detection instead of spamming this every time?
-		portal.sendRoomMeta(ctx, sender, ts, event.StateJoinRules, "", info.JoinRule)
+		changed = portal.updateJoinRule(ctx, info.JoinRule, sender, ts) || changed
+	}
+	if info.HistoryVisibility != nil {
+		changed = portal.updateHistoryVisibility(ctx, info.HistoryVisibility.HistoryVisibility, sender, ts) || changed
+	}
+	if info.GuestAccess != nil {
+		changed = portal.updateGuestAccess(ctx, info.GuestAccess.GuestAccess, sender, ts) || changed
 	}
 	if info.Type != nil && portal.RoomType != *info.Type {
 		if portal.MXID != "" && (*info.Type == database.RoomTypeSpace || portal.RoomType == database.RoomTypeSpace) {
@@ -3463,6 +4258,9 @@ func (portal *Portal) UpdateInfo(ctx context.Context, info *ChatInfo, source *Us
 		}
 		// TODO wake up backfill queue if task was just created
 	}
+	if info.ImagePacks != nil {
+		portal.updateImagePacks(ctx, info.ImagePacks, sender, ts)
+	}
 	if info.ExtraUpdates != nil {
 		changed = info.ExtraUpdates(ctx, portal) || changed
 	}
@@ -3617,6 +4415,18 @@ func (portal *Portal) createMatrixRoomInLoop(ctx context.Context, source *UserLo
 			Content: event.Content{Parsed: info.JoinRule},
 		})
 	}
+	if portal.HistoryVisibility != "" {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateHistoryVisibility,
+			Content: event.Content{Parsed: &event.HistoryVisibilityEventContent{HistoryVisibility: portal.HistoryVisibility}},
+		})
+	}
+	if portal.GuestAccess != "" {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateGuestAccess,
+			Content: event.Content{Parsed: &event.GuestAccessEventContent{GuestAccess: portal.GuestAccess}},
+		})
+	}
 	roomID, err := portal.Bridge.Bot.CreateRoom(ctx, &req)
 	if err != nil {
 		log.Err(err).Msg("Failed to create Matrix room")
@@ -3657,6 +4467,7 @@ func (portal *Portal) createMatrixRoomInLoop(ctx context.Context, source *UserLo
 		}
 	}
 	portal.updateUserLocalInfo(ctx, info.UserLocal, source, true)
+	portal.updateImagePacks(ctx, info.ImagePacks, nil, time.Time{})
 	if !autoJoinInvites {
 		if info.Members == nil {
 			dp := source.User.DoublePuppet(ctx)
@@ -3682,7 +4493,7 @@ func (portal *Portal) createMatrixRoomInLoop(ctx context.Context, source *UserLo
 					log.Err(err).Msg("Failed to get user portal to add portal to spaces")
 				} else {
 					login.inPortalCache.Remove(portal.PortalKey)
-					go login.tryAddPortalToSpace(withoutCancelCtx, portal, up.CopyWithoutValues())
+					portal.queueInternalEvent(&portalSpaceEvent{login: login, userPortal: up.CopyWithoutValues()})
 				}
 			}
 		} else {
@@ -3694,13 +4505,13 @@ func (portal *Portal) createMatrixRoomInLoop(ctx context.Context, source *UserLo
 					login := portal.Bridge.GetCachedUserLoginByID(up.LoginID)
 					if login != nil {
 						login.inPortalCache.Remove(portal.PortalKey)
-						go login.tryAddPortalToSpace(withoutCancelCtx, portal, up.CopyWithoutValues())
+						portal.queueInternalEvent(&portalSpaceEvent{login: login, userPortal: up.CopyWithoutValues()})
 					}
 				}
 			}
 		}
 	}
-	if portal.Bridge.Config.Backfill.Enabled && portal.RoomType != database.RoomTypeSpace {
+	if portal.Bridge.GetConfig().Backfill.Enabled && portal.RoomType != database.RoomTypeSpace {
 		portal.doForwardBackfill(ctx, source, nil, backfillBundle)
 	}
 	return nil
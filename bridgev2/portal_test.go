@@ -0,0 +1,57 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatCallDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		expected string
+	}{
+		{"Zero", 0, "0:00"},
+		{"Seconds", 5 * time.Second, "0:05"},
+		{"Rounded", 59*time.Second + 600*time.Millisecond, "1:00"},
+		{"Minutes", 12*time.Minute + 34*time.Second, "12:34"},
+		{"Hours", 2*time.Hour + 3*time.Minute + 4*time.Second, "2:03:04"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, formatCallDuration(test.duration))
+		})
+	}
+}
+
+func TestCallInfo_Summary(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     CallInfo
+		expected string
+	}{
+		{"Incoming", CallInfo{State: CallStateStarted}, "Incoming voice call"},
+		{"IncomingVideo", CallInfo{State: CallStateStarted, Type: CallTypeVideo}, "Incoming video call"},
+		{"GroupStarted", CallInfo{State: CallStateStarted, IsGroup: true}, "Started a group voice call"},
+		{"Missed", CallInfo{State: CallStateMissed}, "Missed voice call"},
+		{"MissedGroupVideo", CallInfo{State: CallStateMissed, Type: CallTypeVideo, IsGroup: true}, "Missed group video call"},
+		{"Rejected", CallInfo{State: CallStateRejected, Type: CallTypeVideo}, "Declined video call"},
+		{"Ended", CallInfo{State: CallStateEnded}, "Voice call ended"},
+		{"EndedWithDuration", CallInfo{State: CallStateEnded, Duration: 75 * time.Second}, "Voice call ended (duration: 1:15)"},
+		{"GroupEnded", CallInfo{State: CallStateEnded, IsGroup: true, Type: CallTypeVideo}, "Group video call ended"},
+		{"Unknown", CallInfo{State: "foo"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.info.summary())
+		})
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"go.mau.fi/util/variationselector"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
@@ -35,10 +36,10 @@ func (portal *Portal) doForwardBackfill(ctx context.Context, source *UserLogin,
 	var limit int
 	if lastMessage != nil {
 		logEvt = logEvt.Str("latest_message_id", string(lastMessage.ID))
-		limit = portal.Bridge.Config.Backfill.MaxCatchupMessages
+		limit = portal.Bridge.GetConfig().Backfill.MaxCatchupMessages
 	} else {
 		logEvt = logEvt.Str("latest_message_id", "")
-		limit = portal.Bridge.Config.Backfill.MaxInitialMessages
+		limit = portal.Bridge.GetConfig().Backfill.MaxInitialMessages
 	}
 	if limit <= 0 {
 		logEvt.Discard().Send()
@@ -106,7 +107,7 @@ func (portal *Portal) DoBackwardsBackfill(ctx context.Context, source *UserLogin
 		Forward:       false,
 		Cursor:        task.Cursor,
 		AnchorMessage: firstMessage,
-		Count:         portal.Bridge.Config.Backfill.Queue.BatchSize,
+		Count:         portal.Bridge.GetConfig().Backfill.Queue.BatchSize,
 		Task:          task,
 	})
 	if err != nil {
@@ -121,6 +122,7 @@ func (portal *Portal) DoBackwardsBackfill(ctx context.Context, source *UserLogin
 		Bool("has_more", resp.HasMore).
 		Int("message_count", len(resp.Messages)).
 		Msg("Fetched messages for backward backfill")
+	prevCursor := task.Cursor
 	task.Cursor = resp.Cursor
 	if !resp.HasMore {
 		task.IsDone = true
@@ -136,14 +138,42 @@ func (portal *Portal) DoBackwardsBackfill(ctx context.Context, source *UserLogin
 		}
 		return nil
 	}
-	resp.Messages = portal.cutoffMessages(ctx, resp.Messages, resp.AggressiveDeduplication, false, firstMessage)
+	batchSending := portal.Bridge.Matrix.GetCapabilities().BatchSending
+	resumed := !batchSending && firstMessage != nil && slices.ContainsFunc(resp.Messages, func(msg *BackfillMessage) bool {
+		return msg.ID == firstMessage.ID
+	})
+	if resumed {
+		// A previous attempt failed in the middle of sending this batch without batch sending,
+		// so the oldest bridged message is in the batch and can't be used as the cutoff point.
+		resp.Messages, err = portal.dropBridgedMessages(ctx, resp.Messages)
+		if err != nil {
+			task.Cursor = prevCursor
+			task.IsDone = false
+			return err
+		}
+	} else {
+		resp.Messages = portal.cutoffMessages(ctx, resp.Messages, resp.AggressiveDeduplication, false, firstMessage)
+	}
 	if len(resp.Messages) == 0 {
 		if resp.CompleteCallback != nil {
 			resp.CompleteCallback()
 		}
 		return fmt.Errorf("no messages left to backfill after cutting off too new messages")
 	}
-	portal.sendBackfill(ctx, source, resp.Messages, false, resp.MarkRead, false, resp.CompleteCallback)
+	if batchSending {
+		portal.sendBackfill(ctx, source, resp.Messages, false, resp.MarkRead, false, resp.CompleteCallback)
+	} else {
+		err = portal.sendLegacyBackwardsBackfill(ctx, source, resp.Messages, task, resumed)
+		if err != nil {
+			// Don't move the cursor, so that the batch is fetched again when the task is retried
+			task.Cursor = prevCursor
+			task.IsDone = false
+			return fmt.Errorf("failed to send backward backfill without batch sending: %w", err)
+		}
+		if resp.CompleteCallback != nil {
+			resp.CompleteCallback()
+		}
+	}
 	if len(resp.Messages) > 0 {
 		task.OldestMessageID = resp.Messages[0].ID
 	}
@@ -157,7 +187,7 @@ func (portal *Portal) fetchThreadBackfill(ctx context.Context, source *UserLogin
 		ThreadRoot:    anchor.ID,
 		Forward:       true,
 		AnchorMessage: anchor,
-		Count:         portal.Bridge.Config.Backfill.Threads.MaxInitialMessages,
+		Count:         portal.Bridge.GetConfig().Backfill.Threads.MaxInitialMessages,
 	})
 	if err != nil {
 		log.Err(err).Msg("Failed to fetch messages for thread backfill")
@@ -279,7 +309,7 @@ func (portal *Portal) sendBackfill(
 	done func(),
 ) {
 	canBatchSend := portal.Bridge.Matrix.GetCapabilities().BatchSending
-	unreadThreshold := time.Duration(portal.Bridge.Config.Backfill.UnreadHoursThreshold) * time.Hour
+	unreadThreshold := time.Duration(portal.Bridge.GetConfig().Backfill.UnreadHoursThreshold) * time.Hour
 	forceMarkRead := unreadThreshold > 0 && time.Since(messages[len(messages)-1].Timestamp) > unreadThreshold
 	zerolog.Ctx(ctx).Info().
 		Int("message_count", len(messages)).
@@ -287,6 +317,13 @@ func (portal *Portal) sendBackfill(
 		Bool("mark_read", markRead).
 		Bool("mark_read_past_threshold", forceMarkRead).
 		Msg("Sending backfill messages")
+	direction := "backward"
+	if inThread {
+		direction = "thread"
+	} else if forceForward {
+		direction = "forward"
+	}
+	portal.Bridge.Metrics.TrackBackfill(source, direction, len(messages))
 	if canBatchSend {
 		portal.sendBatch(ctx, source, messages, forceForward, markRead || forceMarkRead, inThread)
 	} else {
@@ -296,7 +333,7 @@ func (portal *Portal) sendBackfill(
 		done()
 	}
 	zerolog.Ctx(ctx).Debug().Msg("Backfill finished")
-	if !canBatchSend && !inThread && portal.Bridge.Config.Backfill.Threads.MaxInitialMessages > 0 {
+	if !canBatchSend && !inThread && portal.Bridge.GetConfig().Backfill.Threads.MaxInitialMessages > 0 {
 		for _, msg := range messages {
 			if msg.ShouldBackfillThread {
 				portal.doThreadBackfill(ctx, source, msg.ID)
@@ -311,9 +348,10 @@ type compileBatchOutput struct {
 	Events []*event.Event
 	Extras []*MatrixSendExtra
 
-	DBMessages  []*database.Message
-	DBReactions []*database.Reaction
-	Disappear   []*database.DisappearingMessage
+	DBMessages    []*database.Message
+	DBReactions   []*database.Reaction
+	DBPollOptions map[*database.Message]map[string]networkid.PollOptionID
+	Disappear     []*database.DisappearingMessage
 }
 
 func (portal *Portal) compileBatchMessage(ctx context.Context, source *UserLogin, msg *BackfillMessage, out *compileBatchOutput, inThread bool) {
@@ -364,6 +402,9 @@ func (portal *Portal) compileBatchMessage(ctx context.Context, source *UserLogin
 			firstPart = dbMessage
 		}
 		partMap[part.ID] = dbMessage
+		if len(part.PollOptions) > 0 {
+			out.DBPollOptions[dbMessage] = part.PollOptions
+		}
 		out.Extras = append(out.Extras, &MatrixSendExtra{MessageMeta: dbMessage, StreamOrder: msg.StreamOrder, PartIndex: i})
 		out.DBMessages = append(out.DBMessages, dbMessage)
 		if prevThreadEvent != nil {
@@ -395,6 +436,7 @@ func (portal *Portal) compileBatchMessage(ctx context.Context, source *UserLogin
 			// TODO warning log and/or skip reaction?
 		}
 		reactionMXID := portal.Bridge.Matrix.GenerateReactionEventID(portal.MXID, targetPart, reaction.Sender.Sender, reaction.EmojiID)
+		emoji, extra := portal.convertCustomEmojiReaction(ctx, reactionIntent, reaction.Emoji, reaction.CustomEmoji, reaction.ExtraContent)
 		dbReaction := &database.Reaction{
 			Room:          portal.PortalKey,
 			MessageID:     msg.ID,
@@ -403,7 +445,7 @@ func (portal *Portal) compileBatchMessage(ctx context.Context, source *UserLogin
 			EmojiID:       reaction.EmojiID,
 			MXID:          reactionMXID,
 			Timestamp:     reaction.Timestamp,
-			Emoji:         reaction.Emoji,
+			Emoji:         emoji,
 			Metadata:      reaction.DBMetadata,
 		}
 		out.Events = append(out.Events, &event.Event{
@@ -417,16 +459,16 @@ func (portal *Portal) compileBatchMessage(ctx context.Context, source *UserLogin
 					RelatesTo: event.RelatesTo{
 						Type:    event.RelAnnotation,
 						EventID: portal.Bridge.Matrix.GenerateDeterministicEventID(portal.MXID, portal.PortalKey, msg.ID, *reaction.TargetPart),
-						Key:     variationselector.Add(reaction.Emoji),
+						Key:     variationselector.Add(emoji),
 					},
 				},
-				Raw: reaction.ExtraContent,
+				Raw: extra,
 			},
 		})
 		out.DBReactions = append(out.DBReactions, dbReaction)
 		out.Extras = append(out.Extras, &MatrixSendExtra{ReactionMeta: dbReaction})
 	}
-	if firstPart != nil && !inThread && portal.Bridge.Config.Backfill.Threads.MaxInitialMessages > 0 && msg.ShouldBackfillThread {
+	if firstPart != nil && !inThread && portal.Bridge.GetConfig().Backfill.Threads.MaxInitialMessages > 0 && msg.ShouldBackfillThread {
 		portal.fetchThreadInsideBatch(ctx, source, firstPart, out)
 	}
 }
@@ -452,6 +494,7 @@ func (portal *Portal) sendBatch(ctx context.Context, source *UserLogin, messages
 		Extras:           make([]*MatrixSendExtra, 0, len(messages)),
 		DBMessages:       make([]*database.Message, 0, len(messages)),
 		DBReactions:      make([]*database.Reaction, 0),
+		DBPollOptions:    make(map[*database.Message]map[string]networkid.PollOptionID),
 		Disappear:        make([]*database.DisappearingMessage, 0),
 	}
 	for _, msg := range messages {
@@ -489,6 +532,14 @@ func (portal *Portal) sendBatch(ctx context.Context, source *UserLogin, messages
 				Str("portal_id", string(msg.Room.ID)).
 				Str("portal_receiver", string(msg.Room.Receiver)).
 				Msg("Failed to insert backfilled message to database")
+		} else if pollOptions, ok := out.DBPollOptions[msg]; ok {
+			err = portal.Bridge.DB.PollOption.Put(ctx, msg, pollOptions)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).
+					Str("message_id", string(msg.ID)).
+					Str("part_id", string(msg.PartID)).
+					Msg("Failed to insert backfilled poll options to database")
+			}
 		}
 	}
 	// TODO mass insert db reactions
@@ -506,6 +557,152 @@ func (portal *Portal) sendBatch(ctx context.Context, source *UserLogin, messages
 	}
 }
 
+// dropBridgedMessages removes messages that already exist in the database from the given list.
+// moveToHistoryThread puts all parts of the message in the history thread. Threads can't be nested,
+// so the history thread replaces the thread the message was in. Like in live threads, the previous event
+// is only used as the reply fallback: messages that reply to another message keep the reply, and messages
+// from another thread reply to the root of that thread instead.
+func (portal *Portal) moveToHistoryThread(ctx context.Context, msg *BackfillMessage, threadRoot, prevEvent id.EventID) {
+	var origThreadRoot id.EventID
+	if msg.ThreadRoot != nil && *msg.ThreadRoot != msg.ID && msg.ReplyTo == nil {
+		origRoot, err := portal.Bridge.DB.Message.GetFirstThreadMessage(ctx, portal.PortalKey, *msg.ThreadRoot)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to get thread root message from database")
+		} else if origRoot != nil {
+			origThreadRoot = origRoot.MXID
+		}
+	}
+	msg.ThreadRoot = nil
+	for _, part := range msg.Parts {
+		relatesTo := part.Content.GetRelatesTo()
+		if origThreadRoot != "" && relatesTo.GetReplyTo() == "" {
+			relatesTo.SetReplyTo(origThreadRoot)
+		}
+		relatesTo.SetThread(threadRoot, prevEvent)
+	}
+}
+
+func (portal *Portal) dropBridgedMessages(ctx context.Context, messages []*BackfillMessage) ([]*BackfillMessage, error) {
+	filtered := messages[:0]
+	for _, msg := range messages {
+		existing, err := portal.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if message %s is already bridged: %w", msg.ID, err)
+		} else if existing == nil {
+			filtered = append(filtered, msg)
+		}
+	}
+	zerolog.Ctx(ctx).Debug().
+		Int("dropped_count", len(messages)-len(filtered)).
+		Int("total_count", len(messages)).
+		Msg("Dropped already bridged messages from retried backward backfill batch")
+	return filtered, nil
+}
+
+// sendLegacyBackwardsBackfill sends a backwards backfill batch with normal sends when batch sending isn't available.
+// If resumed is true, the batch was partially sent by a previous attempt, so the batch marker isn't sent again.
+func (portal *Portal) sendLegacyBackwardsBackfill(ctx context.Context, source *UserLogin, messages []*BackfillMessage, task *database.BackfillTask, resumed bool) error {
+	log := zerolog.Ctx(ctx)
+	mode := portal.Bridge.GetConfig().Backfill.Queue.LegacyMode
+	log.Info().
+		Int("message_count", len(messages)).
+		Str("legacy_mode", string(mode)).
+		Msg("Sending backwards backfill messages without batch sending")
+	portal.Bridge.Metrics.TrackBackfill(source, "backward", len(messages))
+	var threadRoot id.EventID
+	if mode == bridgeconfig.BackfillLegacyModeThread {
+		threadRoot = task.HistoryThreadRoot
+		if threadRoot == "" {
+			resp, err := portal.Bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+				Parsed: &event.MessageEventContent{
+					MsgType:  event.MsgNotice,
+					Body:     "Message history",
+					Mentions: &event.Mentions{},
+				},
+			}, nil)
+			if err != nil {
+				return fmt.Errorf("failed to send history thread root: %w", err)
+			}
+			threadRoot = resp.EventID
+			task.HistoryThreadRoot = threadRoot
+			// Save the root immediately, as the task progress isn't saved if sending the batch fails
+			err = portal.Bridge.DB.BackfillTask.SetHistoryThreadRoot(ctx, task)
+			if err != nil {
+				return fmt.Errorf("failed to save history thread root: %w", err)
+			}
+		}
+	}
+	lastEvent := threadRoot
+	if !resumed {
+		markerText := fmt.Sprintf(
+			"Older messages from %s to %s",
+			messages[0].Timestamp.UTC().Format(time.DateTime),
+			messages[len(messages)-1].Timestamp.UTC().Format(time.DateTime),
+		)
+		markerContent := &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     markerText,
+			Mentions: &event.Mentions{},
+		}
+		if threadRoot != "" {
+			markerContent.GetRelatesTo().SetThread(threadRoot, "")
+		}
+		resp, err := portal.Bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{Parsed: markerContent}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to send backfill batch marker: %w", err)
+		}
+		lastEvent = resp.EventID
+	}
+	for _, msg := range messages {
+		if threadRoot != "" {
+			portal.moveToHistoryThread(ctx, msg, threadRoot, lastEvent)
+		}
+		intent := portal.GetIntentFor(ctx, msg.Sender, source, RemoteEventMessage)
+		dbMessages := portal.sendConvertedMessage(ctx, msg.ID, intent, msg.Sender.Sender, msg.ConvertedMessage, msg.Timestamp, msg.StreamOrder, func(z *zerolog.Event) *zerolog.Event {
+			return z.
+				Str("message_id", string(msg.ID)).
+				Any("sender_id", msg.Sender).
+				Time("message_ts", msg.Timestamp)
+		})
+		for _, dbMsg := range dbMessages {
+			if !dbMsg.HasFakeMXID() {
+				lastEvent = dbMsg.MXID
+			}
+		}
+		if len(dbMessages) < len(msg.Parts) {
+			// Stop here so that the rest of the batch is sent in order when the task is retried
+			return fmt.Errorf("failed to send message %s", msg.ID)
+		} else if len(dbMessages) == 0 {
+			continue
+		}
+		for _, reaction := range msg.Reactions {
+			reactionIntent := portal.GetIntentFor(ctx, reaction.Sender, source, RemoteEventReaction)
+			targetPart := dbMessages[0]
+			if reaction.TargetPart != nil {
+				targetPartIdx := slices.IndexFunc(dbMessages, func(dbMsg *database.Message) bool {
+					return dbMsg.PartID == *reaction.TargetPart
+				})
+				if targetPartIdx != -1 {
+					targetPart = dbMessages[targetPartIdx]
+				}
+			}
+			emoji, extra := portal.convertCustomEmojiReaction(ctx, reactionIntent, reaction.Emoji, reaction.CustomEmoji, reaction.ExtraContent)
+			portal.sendConvertedReaction(
+				ctx, reaction.Sender.Sender, reactionIntent, targetPart, reaction.EmojiID, emoji,
+				reaction.Timestamp, reaction.DBMetadata, extra,
+				func(z *zerolog.Event) *zerolog.Event {
+					return z.
+						Str("target_message_id", string(msg.ID)).
+						Str("target_part_id", string(targetPart.PartID)).
+						Any("reaction_sender_id", reaction.Sender).
+						Time("reaction_ts", reaction.Timestamp)
+				},
+			)
+		}
+	}
+	return nil
+}
+
 func (portal *Portal) sendLegacyBackfill(ctx context.Context, source *UserLogin, messages []*BackfillMessage, markRead bool) {
 	var lastPart id.EventID
 	for _, msg := range messages {
@@ -531,9 +728,10 @@ func (portal *Portal) sendLegacyBackfill(ctx context.Context, source *UserLogin,
 						// TODO warning log and/or skip reaction?
 					}
 				}
+				emoji, extra := portal.convertCustomEmojiReaction(ctx, reactionIntent, reaction.Emoji, reaction.CustomEmoji, reaction.ExtraContent)
 				portal.sendConvertedReaction(
-					ctx, reaction.Sender.Sender, reactionIntent, targetPart, reaction.EmojiID, reaction.Emoji,
-					reaction.Timestamp, reaction.DBMetadata, reaction.ExtraContent,
+					ctx, reaction.Sender.Sender, reactionIntent, targetPart, reaction.EmojiID, emoji,
+					reaction.Timestamp, reaction.DBMetadata, extra,
 					func(z *zerolog.Event) *zerolog.Event {
 						return z.
 							Str("target_message_id", string(msg.ID)).
@@ -0,0 +1,286 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/ptr"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func backfillTestMessage(msgID networkid.MessageID, sender networkid.UserID, ts time.Time) *bridgev2.BackfillMessage {
+	return &bridgev2.BackfillMessage{
+		ConvertedMessage: &bridgev2.ConvertedMessage{
+			Parts: []*bridgev2.ConvertedMessagePart{{
+				Type:    event.EventMessage,
+				Content: &event.MessageEventContent{MsgType: event.MsgText, Body: string(msgID)},
+			}},
+		},
+		Sender:    bridgev2.EventSender{Sender: sender},
+		ID:        msgID,
+		Timestamp: ts,
+	}
+}
+
+// fetchTwoBatches returns two batches of old messages: old2 and old3 (with a reaction) first, then old1.
+func fetchTwoBatches(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+	base := time.Now().Add(-24 * time.Hour)
+	if params.Cursor == "" {
+		newer := backfillTestMessage("old3", "bob", base.Add(3*time.Minute))
+		newer.Reactions = []*bridgev2.BackfillReaction{{
+			Sender:    bridgev2.EventSender{Sender: "alice"},
+			EmojiID:   "👍",
+			Emoji:     "👍",
+			Timestamp: base.Add(4 * time.Minute),
+		}}
+		return &bridgev2.FetchMessagesResponse{
+			Messages: []*bridgev2.BackfillMessage{backfillTestMessage("old2", "alice", base.Add(2*time.Minute)), newer},
+			Cursor:   "page2",
+			HasMore:  true,
+		}, nil
+	}
+	return &bridgev2.FetchMessagesResponse{
+		Messages: []*bridgev2.BackfillMessage{backfillTestMessage("old1", "alice", base.Add(time.Minute))},
+	}, nil
+}
+
+type legacyBackfillChat struct {
+	*bridgetest.Harness
+	Login  *bridgev2.UserLogin
+	Portal *bridgev2.Portal
+	RoomID id.RoomID
+
+	initialEvents int
+}
+
+func newLegacyBackfillChat(t *testing.T, mode bridgeconfig.BackfillLegacyMode, fetch func(context.Context, bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error)) *legacyBackfillChat {
+	t.Helper()
+	cfg := bridgetest.DefaultConfig()
+	cfg.Backfill.Queue.LegacyMode = mode
+	cfg.Backfill.Queue.BatchSize = 2
+	h, login, portalKey, roomID := bridgetest.NewChat(t, cfg)
+	login.Client.(*bridgetest.NetworkAPI).FetchMessagesFunc = fetch
+	portal, err := h.Bridge.GetExistingPortalByKey(h.Ctx, portalKey)
+	require.NoError(t, err)
+	return &legacyBackfillChat{
+		Harness:       h,
+		Login:         login,
+		Portal:        portal,
+		RoomID:        roomID,
+		initialEvents: len(h.Matrix.Messages(roomID)),
+	}
+}
+
+// backfilled returns the events sent to the room after the chat was created.
+func (c *legacyBackfillChat) backfilled() []*event.Event {
+	return c.Matrix.Messages(c.RoomID)[c.initialEvents:]
+}
+
+// run runs the backfill task until it's done. Like the backfill queue, it loads the task from the database
+// before each batch and only saves the progress if the batch succeeds.
+func (c *legacyBackfillChat) run(t *testing.T) *database.BackfillTask {
+	t.Helper()
+	require.NoError(t, c.Bridge.DB.BackfillTask.EnsureExists(c.Ctx, c.Portal.PortalKey, c.Login.ID))
+	for i := 0; ; i++ {
+		require.Less(t, i, 5, "backfill didn't finish")
+		task, err := c.Bridge.DB.BackfillTask.GetByPortal(c.Ctx, c.Portal.PortalKey)
+		require.NoError(t, err)
+		if task.IsDone {
+			return task
+		} else if err = c.Portal.DoBackwardsBackfill(c.Ctx, c.Login, task); err != nil {
+			continue
+		}
+		require.NoError(t, c.Bridge.DB.BackfillTask.Update(c.Ctx, task))
+	}
+}
+
+// failOnce makes sending the message with the given body fail the first time.
+func (c *legacyBackfillChat) failOnce(body string) {
+	var once sync.Once
+	c.Matrix.FailSend = func(evt *event.Event) error {
+		var err error
+		if msg, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && msg.Body == body {
+			once.Do(func() {
+				err = errors.New("fake send failure")
+			})
+		}
+		return err
+	}
+}
+
+func countMessages(events []*event.Event, match func(content *event.MessageEventContent) bool) int {
+	var count int
+	for _, evt := range events {
+		if evt.Type == event.EventMessage && match(evt.Content.AsMessage()) {
+			count++
+		}
+	}
+	return count
+}
+
+func isMarker(content *event.MessageEventContent) bool {
+	return content.MsgType == event.MsgNotice && content.Body != "Message history"
+}
+
+func TestDoBackwardsBackfill_LegacyThread(t *testing.T) {
+	c := newLegacyBackfillChat(t, bridgeconfig.BackfillLegacyModeThread, fetchTwoBatches)
+	task := c.run(t)
+	require.NotEmpty(t, task.HistoryThreadRoot)
+	assert.Equal(t, networkid.MessageID("old1"), task.OldestMessageID)
+
+	bot := c.Bridge.Bot.GetMXID()
+	alice := c.Matrix.FormatGhostMXID("alice")
+	events := c.backfilled()
+	require.Len(t, events, 7)
+	root := events[0]
+	assert.Equal(t, task.HistoryThreadRoot, root.ID)
+	assert.Equal(t, bot, root.Sender)
+	assert.Equal(t, "Message history", root.Content.AsMessage().Body)
+
+	// The second batch contains older messages, but is sent after the first batch in the same thread
+	expected := []struct {
+		sender id.UserID
+		body   string
+	}{
+		{bot, ""},
+		{alice, "old2"},
+		{c.Matrix.FormatGhostMXID("bob"), "old3"},
+		{bot, ""},
+		{alice, "old1"},
+	}
+	threadMessages := []*event.Event{events[1], events[2], events[3], events[5], events[6]}
+	for i, evt := range threadMessages {
+		content := evt.Content.AsMessage()
+		assert.Equal(t, expected[i].sender, evt.Sender)
+		if expected[i].body != "" {
+			assert.Equal(t, expected[i].body, content.Body)
+		} else {
+			assert.Equal(t, event.MsgNotice, content.MsgType)
+			assert.Contains(t, content.Body, "Older messages from")
+		}
+		assert.Equal(t, task.HistoryThreadRoot, content.RelatesTo.GetThreadParent(), "message #%d isn't in the history thread", i)
+	}
+
+	reaction := events[4]
+	require.Equal(t, event.EventReaction, reaction.Type)
+	assert.Equal(t, alice, reaction.Sender)
+	assert.Equal(t, events[3].ID, reaction.Content.AsReaction().RelatesTo.EventID)
+
+	for _, msgID := range []networkid.MessageID{"old1", "old2", "old3"} {
+		msg, err := c.Bridge.DB.Message.GetFirstPartByID(c.Ctx, c.Login.ID, msgID)
+		require.NoError(t, err)
+		assert.NotNil(t, msg, "message %s wasn't saved to the database", msgID)
+	}
+}
+
+func TestDoBackwardsBackfill_LegacyThreadRetry(t *testing.T) {
+	c := newLegacyBackfillChat(t, bridgeconfig.BackfillLegacyModeThread, fetchTwoBatches)
+	c.failOnce("old3")
+	task := c.run(t)
+
+	events := c.backfilled()
+	assert.Equal(t, 1, countMessages(events, func(content *event.MessageEventContent) bool {
+		return content.Body == "Message history"
+	}), "history thread root must only be created once")
+	assert.Equal(t, 2, countMessages(events, isMarker), "retried batch must not send another marker")
+	for _, evt := range events {
+		if evt.ID != task.HistoryThreadRoot && evt.Type == event.EventMessage {
+			assert.Equal(t, task.HistoryThreadRoot, evt.Content.AsMessage().RelatesTo.GetThreadParent())
+		}
+	}
+}
+
+func TestDoBackwardsBackfill_LegacyThreadKeepsReplies(t *testing.T) {
+	c := newLegacyBackfillChat(t, bridgeconfig.BackfillLegacyModeThread, func(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+		base := time.Now().Add(-24 * time.Hour)
+		reply := backfillTestMessage("reply", "bob", base.Add(2*time.Minute))
+		reply.ReplyTo = &networkid.MessageOptionalPartID{MessageID: "root"}
+		inThread := backfillTestMessage("thread", "alice", base.Add(3*time.Minute))
+		inThread.ThreadRoot = ptr.Ptr(networkid.MessageID("root"))
+		return &bridgev2.FetchMessagesResponse{
+			Messages: []*bridgev2.BackfillMessage{backfillTestMessage("root", "alice", base.Add(time.Minute)), reply, inThread},
+		}, nil
+	})
+	c.run(t)
+
+	byBody := make(map[string]*event.Event)
+	for _, evt := range c.backfilled() {
+		byBody[evt.Content.AsMessage().Body] = evt
+	}
+	root := byBody["root"]
+	require.NotNil(t, root)
+	for _, body := range []string{"reply", "thread"} {
+		evt := byBody[body]
+		require.NotNil(t, evt)
+		relatesTo := evt.Content.AsMessage().RelatesTo
+		assert.Equal(t, root.ID, relatesTo.GetNonFallbackReplyTo(), "%s should reply to the original message", body)
+		assert.False(t, relatesTo.IsFallingBack)
+	}
+	rootRel := root.Content.AsMessage().RelatesTo
+	assert.True(t, rootRel.IsFallingBack, "messages without replies should only have the reply fallback")
+}
+
+func TestDoBackwardsBackfill_LegacyInline(t *testing.T) {
+	c := newLegacyBackfillChat(t, bridgeconfig.BackfillLegacyModeInline, fetchTwoBatches)
+	task := c.run(t)
+	assert.Empty(t, task.HistoryThreadRoot)
+	assert.Equal(t, networkid.MessageID("old1"), task.OldestMessageID)
+
+	var bodies []string
+	for _, evt := range c.backfilled() {
+		if evt.Type != event.EventMessage {
+			continue
+		}
+		content := evt.Content.AsMessage()
+		assert.Nil(t, content.RelatesTo, "inline backfill message %q shouldn't have relations", content.Body)
+		if content.MsgType == event.MsgNotice {
+			assert.Contains(t, content.Body, "Older messages from")
+			bodies = append(bodies, "marker")
+		} else {
+			bodies = append(bodies, content.Body)
+		}
+	}
+	assert.Equal(t, []string{"marker", "old2", "old3", "marker", "old1"}, bodies)
+}
+
+func TestDoBackwardsBackfill_LegacySendFailure(t *testing.T) {
+	c := newLegacyBackfillChat(t, bridgeconfig.BackfillLegacyModeInline, fetchTwoBatches)
+	c.failOnce("old3")
+
+	task := &database.BackfillTask{PortalKey: c.Portal.PortalKey, UserLoginID: c.Login.ID}
+	err := c.Portal.DoBackwardsBackfill(c.Ctx, c.Login, task)
+	require.Error(t, err)
+	assert.Empty(t, task.Cursor, "cursor shouldn't move after a failed batch")
+	assert.Empty(t, task.OldestMessageID)
+	assert.False(t, task.IsDone)
+
+	// The retry sends the rest of the batch without duplicating the messages that were already sent
+	task = c.run(t)
+	var bodies []string
+	for _, evt := range c.backfilled() {
+		if evt.Type == event.EventMessage && evt.Content.AsMessage().MsgType != event.MsgNotice {
+			bodies = append(bodies, evt.Content.AsMessage().Body)
+		}
+	}
+	assert.Equal(t, []string{"old2", "old3", "old1"}, bodies)
+	assert.Equal(t, 2, countMessages(c.backfilled(), isMarker))
+	assert.Equal(t, networkid.MessageID("old1"), task.OldestMessageID)
+}
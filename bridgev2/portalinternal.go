@@ -29,8 +29,12 @@ func (portal *PortalInternals) UpdateLogger() {
 	(*Portal)(portal).updateLogger()
 }
 
-func (portal *PortalInternals) QueueEvent(ctx context.Context, evt portalEvent) {
-	(*Portal)(portal).queueEvent(ctx, evt)
+func (portal *PortalInternals) QueueEvent(ctx context.Context, evt portalEvent) bool {
+	return (*Portal)(portal).queueEvent(ctx, evt)
+}
+
+func (portal *PortalInternals) QueueInternalEvent(evt portalEvent) {
+	(*Portal)(portal).queueInternalEvent(evt)
 }
 
 func (portal *PortalInternals) EventLoop() {
@@ -61,8 +65,8 @@ func (portal *PortalInternals) CheckConfusableName(ctx context.Context, userID i
 	return (*Portal)(portal).checkConfusableName(ctx, userID, name)
 }
 
-func (portal *PortalInternals) HandleMatrixEvent(ctx context.Context, sender *User, evt *event.Event) {
-	(*Portal)(portal).handleMatrixEvent(ctx, sender, evt)
+func (portal *PortalInternals) HandleMatrixEvent(ctx context.Context, sender *User, evt *event.Event) *UserLogin {
+	return (*Portal)(portal).handleMatrixEvent(ctx, sender, evt)
 }
 
 func (portal *PortalInternals) HandleMatrixReceipts(ctx context.Context, evt *event.Event) {
@@ -97,10 +101,26 @@ func (portal *PortalInternals) HandleMatrixEdit(ctx context.Context, sender *Use
 	(*Portal)(portal).handleMatrixEdit(ctx, sender, origSender, evt, content, caps)
 }
 
+func (portal *PortalInternals) GetSelectedPollOptions(ctx context.Context, pollMessage *database.Message, answerIDs []string) ([]networkid.PollOptionID, error) {
+	return (*Portal)(portal).getSelectedPollOptions(ctx, pollMessage, answerIDs)
+}
+
+func (portal *PortalInternals) HandleMatrixPollEnd(ctx context.Context, sender *UserLogin, origSender *OrigSender, evt *event.Event) {
+	(*Portal)(portal).handleMatrixPollEnd(ctx, sender, origSender, evt)
+}
+
+func (portal *PortalInternals) HandleMatrixCall(ctx context.Context, sender *UserLogin, origSender *OrigSender, evt *event.Event) {
+	(*Portal)(portal).handleMatrixCall(ctx, sender, origSender, evt)
+}
+
 func (portal *PortalInternals) HandleMatrixReaction(ctx context.Context, sender *UserLogin, evt *event.Event) {
 	(*Portal)(portal).handleMatrixReaction(ctx, sender, evt)
 }
 
+func (portal *PortalInternals) HandleMatrixTombstone(ctx context.Context, sender *User, evt *event.Event) {
+	(*Portal)(portal).handleMatrixTombstone(ctx, sender, evt)
+}
+
 func (portal *PortalInternals) GetTargetUser(ctx context.Context, userID id.UserID) (GhostOrUserLogin, error) {
 	return (*Portal)(portal).getTargetUser(ctx, userID)
 }
@@ -189,6 +209,34 @@ func (portal *PortalInternals) HandleRemoteReactionRemove(ctx context.Context, s
 	(*Portal)(portal).handleRemoteReactionRemove(ctx, source, evt)
 }
 
+func (portal *PortalInternals) GetPollAnswerIDs(ctx context.Context, pollMessage *database.Message) (map[networkid.PollOptionID]string, error) {
+	return (*Portal)(portal).getPollAnswerIDs(ctx, pollMessage)
+}
+
+func (portal *PortalInternals) SendPollVote(ctx context.Context, intent MatrixAPI, pollMessage *database.Message, answerIDs map[networkid.PollOptionID]string, senderID networkid.UserID, options []networkid.PollOptionID, ts time.Time) {
+	(*Portal)(portal).sendPollVote(ctx, intent, pollMessage, answerIDs, senderID, options, ts)
+}
+
+func (portal *PortalInternals) GetTargetPoll(ctx context.Context, evt RemoteEventWithTargetMessage) (*database.Message, map[networkid.PollOptionID]string) {
+	return (*Portal)(portal).getTargetPoll(ctx, evt)
+}
+
+func (portal *PortalInternals) HandleRemotePollVote(ctx context.Context, source *UserLogin, evt RemotePollVote) {
+	(*Portal)(portal).handleRemotePollVote(ctx, source, evt)
+}
+
+func (portal *PortalInternals) HandleRemotePollResultsSync(ctx context.Context, source *UserLogin, evt RemotePollResultsSync) {
+	(*Portal)(portal).handleRemotePollResultsSync(ctx, source, evt)
+}
+
+func (portal *PortalInternals) HandleRemotePollEnd(ctx context.Context, source *UserLogin, evt RemotePollEnd) {
+	(*Portal)(portal).handleRemotePollEnd(ctx, source, evt)
+}
+
+func (portal *PortalInternals) HandleRemoteCall(ctx context.Context, source *UserLogin, evt RemoteCall) {
+	(*Portal)(portal).handleRemoteCall(ctx, source, evt)
+}
+
 func (portal *PortalInternals) HandleRemoteMessageRemove(ctx context.Context, source *UserLogin, evt RemoteMessageRemove) {
 	(*Portal)(portal).handleRemoteMessageRemove(ctx, source, evt)
 }
@@ -237,6 +285,18 @@ func (portal *PortalInternals) UpdateTopic(ctx context.Context, topic string, se
 	return (*Portal)(portal).updateTopic(ctx, topic, sender, ts)
 }
 
+func (portal *PortalInternals) UpdateJoinRule(ctx context.Context, content *event.JoinRulesEventContent, sender MatrixAPI, ts time.Time) bool {
+	return (*Portal)(portal).updateJoinRule(ctx, content, sender, ts)
+}
+
+func (portal *PortalInternals) UpdateHistoryVisibility(ctx context.Context, visibility event.HistoryVisibility, sender MatrixAPI, ts time.Time) bool {
+	return (*Portal)(portal).updateHistoryVisibility(ctx, visibility, sender, ts)
+}
+
+func (portal *PortalInternals) UpdateGuestAccess(ctx context.Context, guestAccess event.GuestAccess, sender MatrixAPI, ts time.Time) bool {
+	return (*Portal)(portal).updateGuestAccess(ctx, guestAccess, sender, ts)
+}
+
 func (portal *PortalInternals) UpdateAvatar(ctx context.Context, avatar *Avatar, sender MatrixAPI, ts time.Time) bool {
 	return (*Portal)(portal).updateAvatar(ctx, avatar, sender, ts)
 }
@@ -325,6 +385,18 @@ func (portal *PortalInternals) SendBatch(ctx context.Context, source *UserLogin,
 	(*Portal)(portal).sendBatch(ctx, source, messages, forceForward, markRead, inThread)
 }
 
+func (portal *PortalInternals) MoveToHistoryThread(ctx context.Context, msg *BackfillMessage, threadRoot, prevEvent id.EventID) {
+	(*Portal)(portal).moveToHistoryThread(ctx, msg, threadRoot, prevEvent)
+}
+
+func (portal *PortalInternals) DropBridgedMessages(ctx context.Context, messages []*BackfillMessage) ([]*BackfillMessage, error) {
+	return (*Portal)(portal).dropBridgedMessages(ctx, messages)
+}
+
+func (portal *PortalInternals) SendLegacyBackwardsBackfill(ctx context.Context, source *UserLogin, messages []*BackfillMessage, task *database.BackfillTask, resumed bool) error {
+	return (*Portal)(portal).sendLegacyBackwardsBackfill(ctx, source, messages, task, resumed)
+}
+
 func (portal *PortalInternals) SendLegacyBackfill(ctx context.Context, source *UserLogin, messages []*BackfillMessage, markRead bool) {
 	(*Portal)(portal).sendLegacyBackfill(ctx, source, messages, markRead)
 }
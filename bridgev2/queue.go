@@ -64,8 +64,24 @@ func (br *Bridge) rejectInviteOnNoPermission(ctx context.Context, evt *event.Eve
 }
 
 func (br *Bridge) QueueMatrixEvent(ctx context.Context, evt *event.Event) {
+	br.QueueMatrixEventWithCallback(ctx, evt, nil)
+}
+
+// QueueMatrixEventWithCallback is like QueueMatrixEvent, but calls doneCallback once the event has been fully handled.
+//
+// Events that are queued to a portal are handled in the portal's event loop, so the callback may be called
+// after this function returns. If the portal's queue is full, the event is dropped and the callback is called immediately.
+func (br *Bridge) QueueMatrixEventWithCallback(ctx context.Context, evt *event.Event, doneCallback func()) {
 	// TODO maybe HandleMatrixEvent would be more appropriate as this also handles bot invites and commands
 
+	queuedToPortal := false
+	if doneCallback != nil {
+		defer func() {
+			if !queuedToPortal {
+				doneCallback()
+			}
+		}()
+	}
 	log := zerolog.Ctx(ctx)
 	var sender *User
 	if evt.Sender != "" {
@@ -81,13 +97,13 @@ func (br *Bridge) QueueMatrixEvent(ctx context.Context, evt *event.Event) {
 			status := WrapErrorInStatus(errors.New("sender not found for event")).WithIsCertain(true).WithErrorAsMessage()
 			br.Matrix.SendMessageStatus(ctx, &status, StatusEventInfoFromEvent(evt))
 			return
-		} else if !sender.Permissions.SendEvents {
+		} else if !sender.GetPermissions().SendEvents {
 			if !br.rejectInviteOnNoPermission(ctx, evt, "interact with") {
 				status := WrapErrorInStatus(errors.New("you don't have permission to send messages")).WithIsCertain(true).WithSendNotice(false).WithErrorAsMessage()
 				br.Matrix.SendMessageStatus(ctx, &status, StatusEventInfoFromEvent(evt))
 			}
 			return
-		} else if !sender.Permissions.Commands && br.rejectInviteOnNoPermission(ctx, evt, "send commands to") {
+		} else if !sender.GetPermissions().Commands && br.rejectInviteOnNoPermission(ctx, evt, "send commands to") {
 			return
 		}
 	} else if evt.Type.Class != event.EphemeralEventType {
@@ -99,8 +115,8 @@ func (br *Bridge) QueueMatrixEvent(ctx context.Context, evt *event.Event) {
 	if evt.Type == event.EventMessage && sender != nil {
 		msg := evt.Content.AsMessage()
 		msg.RemoveReplyFallback()
-		if strings.HasPrefix(msg.Body, br.Config.CommandPrefix) || evt.RoomID == sender.ManagementRoom {
-			if !sender.Permissions.Commands {
+		if strings.HasPrefix(msg.Body, br.GetConfig().CommandPrefix) || evt.RoomID == sender.ManagementRoom {
+			if !sender.GetPermissions().Commands {
 				status := WrapErrorInStatus(errors.New("you don't have permission to use commands")).WithIsCertain(true).WithSendNotice(false).WithErrorAsMessage()
 				br.Matrix.SendMessageStatus(ctx, &status, StatusEventInfoFromEvent(evt))
 				return
@@ -110,7 +126,7 @@ func (br *Bridge) QueueMatrixEvent(ctx context.Context, evt *event.Event) {
 				evt.RoomID,
 				evt.ID,
 				sender,
-				strings.TrimPrefix(msg.Body, br.Config.CommandPrefix+" "),
+				strings.TrimPrefix(msg.Body, br.GetConfig().CommandPrefix+" "),
 				msg.RelatesTo.GetReplyTo(),
 			)
 			return
@@ -127,9 +143,13 @@ func (br *Bridge) QueueMatrixEvent(ctx context.Context, evt *event.Event) {
 		br.Matrix.SendMessageStatus(ctx, &status, StatusEventInfoFromEvent(evt))
 		return
 	} else if portal != nil {
-		portal.queueEvent(ctx, &portalMatrixEvent{
-			evt:    evt,
-			sender: sender,
+		br.Metrics.TrackMatrixEvent(evt.Type)
+		queuedToPortal = portal.queueEvent(ctx, &portalMatrixEvent{
+			evt:      evt,
+			sender:   sender,
+			queuedAt: time.Now(),
+			traceCtx: ctx,
+			done:     doneCallback,
 		})
 	} else if evt.Type == event.StateMember && br.IsGhostMXID(id.UserID(evt.GetStateKey())) && evt.Content.AsMember().Membership == event.MembershipInvite && evt.Content.AsMember().IsDirect {
 		br.handleGhostDMInvite(ctx, evt, sender)
@@ -143,15 +163,29 @@ func (ul *UserLogin) QueueRemoteEvent(evt RemoteEvent) {
 	ul.Bridge.QueueRemoteEvent(ul, evt)
 }
 
+// QueueRemoteEventWithContext queues a remote event like [UserLogin.QueueRemoteEvent],
+// but continues the trace from the given context (see the tracing package).
+func (ul *UserLogin) QueueRemoteEventWithContext(ctx context.Context, evt RemoteEvent) {
+	ul.Bridge.QueueRemoteEventWithContext(ctx, ul, evt)
+}
+
 func (br *Bridge) QueueRemoteEvent(login *UserLogin, evt RemoteEvent) {
+	br.QueueRemoteEventWithContext(context.TODO(), login, evt)
+}
+
+// QueueRemoteEventWithContext queues a remote event for handling in the portal event loop.
+//
+// The context is only used for tracing: the span in it (if any) will be the parent of the spans created
+// while handling the event. Cancelling the context doesn't affect the handling of the event.
+func (br *Bridge) QueueRemoteEventWithContext(ctx context.Context, login *UserLogin, evt RemoteEvent) {
 	log := login.Log
-	ctx := log.WithContext(context.TODO())
+	ctx = log.WithContext(context.WithoutCancel(ctx))
 	maybeUncertain, ok := evt.(RemoteEventWithUncertainPortalReceiver)
 	isUncertain := ok && maybeUncertain.PortalReceiverIsUncertain()
 	key := evt.GetPortalKey()
 	var portal *Portal
 	var err error
-	if isUncertain && !br.Config.SplitPortals {
+	if isUncertain && !br.GetConfig().SplitPortals {
 		portal, err = br.GetExistingPortalByKey(ctx, key)
 	} else {
 		portal, err = br.GetPortalByKey(ctx, key)
@@ -170,8 +204,11 @@ func (br *Bridge) QueueRemoteEvent(login *UserLogin, evt RemoteEvent) {
 	}
 	// TODO put this in a better place, and maybe cache to avoid constant db queries
 	login.MarkInPortal(ctx, portal)
+	br.Metrics.TrackRemoteEvent(login, evt.GetType())
 	portal.queueEvent(ctx, &portalRemoteEvent{
-		evt:    evt,
-		source: login,
+		evt:      evt,
+		source:   login,
+		queuedAt: time.Now(),
+		traceCtx: ctx,
 	})
 }
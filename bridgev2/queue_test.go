@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestQueueMatrixEventCallbackAfterPortalHandling(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	evt := bridgetest.MatrixTextEvent("$queued:bridge.test", login.UserMXID, roomID, "hi")
+	handled := make(chan *database.Message, 1)
+	h.Bridge.QueueMatrixEventWithCallback(h.Ctx, evt, func() {
+		msg, err := h.Bridge.DB.Message.GetPartByMXID(h.Ctx, evt.ID)
+		assert.NoError(t, err)
+		handled <- msg
+	})
+	select {
+	case msg := <-handled:
+		assert.NotNil(t, msg, "callback was called before the portal finished handling the event")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for callback")
+	}
+	assert.Equal(t, []id.EventID{evt.ID}, login.Client.(*bridgetest.NetworkAPI).SentMessages())
+
+	// Events that don't go to a portal are done when the function returns
+	called := false
+	h.Bridge.QueueMatrixEventWithCallback(h.Ctx, bridgetest.MatrixTextEvent("$unknown:bridge.test", login.UserMXID, "!unknown:bridge.test", "hi"), func() {
+		called = true
+	})
+	require.True(t, called)
+}
+
+func TestQueueMatrixEventCallbackOnDrop(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	client := login.Client.(*bridgetest.NetworkAPI)
+	unblock := make(chan struct{})
+	client.BlockSend = unblock
+	h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent("$blocking:bridge.test", login.UserMXID, roomID, "hi"))
+	h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent("$queued0:bridge.test", login.UserMXID, roomID, "hi"))
+	// The first event is being handled, so the rest of the queue can be filled
+	require.Eventually(t, func() bool {
+		return h.Bridge.GetEventQueueStats().QueuedEvents == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 1; i < bridgev2.PortalEventBuffer; i++ {
+		h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent(id.EventID(fmt.Sprintf("$queued%d:bridge.test", i)), login.UserMXID, roomID, "hi"))
+	}
+
+	called := false
+	h.Bridge.QueueMatrixEventWithCallback(h.Ctx, bridgetest.MatrixTextEvent("$dropped:bridge.test", login.UserMXID, roomID, "hi"), func() {
+		called = true
+	})
+	assert.True(t, called, "callback wasn't called for dropped event")
+
+	// Let the queued events finish before the harness stops the bridge and disconnects the login
+	close(unblock)
+	h.WaitRoom(roomID)
+}
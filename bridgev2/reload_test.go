@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestReloadConfig(t *testing.T) {
+	h, _, _, roomID := bridgetest.NewChat(t, nil)
+	user := h.User("@user:bridge.test")
+	assert.True(t, user.GetPermissions().Admin)
+	oldConfig := h.Bridge.GetConfig()
+
+	// Reload the config while the portal is handling Matrix events, which read it concurrently
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			newConfig := *h.Bridge.GetConfig()
+			newConfig.Relay.DisplaynameFormat = fmt.Sprintf("reload %d", i)
+			h.Bridge.ReloadConfig(&newConfig)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		evt := h.SendMatrixText(roomID, user.MXID, fmt.Sprintf("message %d", i))
+		h.AssertMessageStatus(evt.ID, event.MessageStatusSuccess)
+	}
+	<-done
+
+	newConfig := *h.Bridge.GetConfig()
+	newConfig.Permissions = bridgeconfig.PermissionConfig{"*": &bridgeconfig.PermissionLevelRelay}
+	h.Bridge.ReloadConfig(&newConfig)
+	assert.False(t, user.GetPermissions().Admin)
+	assert.True(t, user.GetPermissions().SendEvents)
+	// The deprecated fields aren't written after startup, as they're read without locking
+	assert.True(t, user.Permissions.Admin)
+	assert.Same(t, oldConfig, h.Bridge.Config)
+	assert.True(t, oldConfig.Permissions.Get(user.MXID).Admin, "reloading modified the old config")
+	assert.Equal(t, 21, h.Bridge.Network.(*bridgetest.NetworkConnector).ConfigReloads())
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+// GroupJoinSettings is a network-agnostic representation of the join settings that most chat networks have for groups.
+// It can be converted to and from Matrix join rules using [GroupJoinSettings.ToJoinRule] and [GroupJoinSettingsFromJoinRule].
+type GroupJoinSettings struct {
+	// Whether anyone can join the group using an invite link (or by finding it in a public directory).
+	InviteLinkEnabled bool
+	// Whether new members joining via the invite link must be approved by an admin.
+	RequireApproval bool
+	// Whether only admins are allowed to add new members.
+	OnlyAdminsCanAdd bool
+}
+
+// ToJoinRule converts the settings into a Matrix join rule.
+//
+// Open invite links map to the public join rule, invite links requiring approval map to knock,
+// and everything else maps to the invite join rule.
+func (gjs GroupJoinSettings) ToJoinRule() *event.JoinRulesEventContent {
+	joinRule := event.JoinRuleInvite
+	if gjs.InviteLinkEnabled && gjs.RequireApproval {
+		joinRule = event.JoinRuleKnock
+	} else if gjs.InviteLinkEnabled {
+		joinRule = event.JoinRulePublic
+	}
+	return &event.JoinRulesEventContent{JoinRule: joinRule}
+}
+
+// ApplyPowerLevels sets the invite power level in the given overrides based on OnlyAdminsCanAdd.
+// If overrides is nil, a new struct is allocated.
+func (gjs GroupJoinSettings) ApplyPowerLevels(overrides *PowerLevelOverrides) *PowerLevelOverrides {
+	if overrides == nil {
+		overrides = &PowerLevelOverrides{}
+	}
+	inviteLevel := 0
+	if gjs.OnlyAdminsCanAdd {
+		inviteLevel = 50
+	}
+	overrides.Invite = &inviteLevel
+	return overrides
+}
+
+// GroupJoinSettingsFromJoinRule converts a Matrix join rule and power levels into group join settings.
+//
+// OnlyAdminsCanAdd is set if the invite power level is higher than the default user level.
+// If power levels are nil, OnlyAdminsCanAdd is always false.
+func GroupJoinSettingsFromJoinRule(content *event.JoinRulesEventContent, pl *event.PowerLevelsEventContent) GroupJoinSettings {
+	var settings GroupJoinSettings
+	switch content.JoinRule {
+	case event.JoinRulePublic:
+		settings.InviteLinkEnabled = true
+	case event.JoinRuleKnock, event.JoinRuleKnockRestricted:
+		settings.InviteLinkEnabled = true
+		settings.RequireApproval = true
+	}
+	if pl != nil {
+		settings.OnlyAdminsCanAdd = pl.Invite() > pl.UsersDefault
+	}
+	return settings
+}
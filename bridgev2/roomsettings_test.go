@@ -0,0 +1,58 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mau.fi/util/ptr"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestGroupJoinSettingsFromJoinRule(t *testing.T) {
+	adminInvites := &event.PowerLevelsEventContent{InvitePtr: ptr.Ptr(50)}
+	tests := []struct {
+		name     string
+		joinRule event.JoinRule
+		pl       *event.PowerLevelsEventContent
+		expected bridgev2.GroupJoinSettings
+	}{
+		{"Public", event.JoinRulePublic, nil, bridgev2.GroupJoinSettings{InviteLinkEnabled: true}},
+		{"Knock", event.JoinRuleKnock, nil, bridgev2.GroupJoinSettings{InviteLinkEnabled: true, RequireApproval: true}},
+		{"KnockRestricted", event.JoinRuleKnockRestricted, nil, bridgev2.GroupJoinSettings{InviteLinkEnabled: true, RequireApproval: true}},
+		{"Invite", event.JoinRuleInvite, nil, bridgev2.GroupJoinSettings{}},
+		{"Restricted", event.JoinRuleRestricted, nil, bridgev2.GroupJoinSettings{}},
+		{"Private", event.JoinRulePrivate, nil, bridgev2.GroupJoinSettings{}},
+		{"PublicAdminInvites", event.JoinRulePublic, adminInvites, bridgev2.GroupJoinSettings{InviteLinkEnabled: true, OnlyAdminsCanAdd: true}},
+		{"InviteAdminInvites", event.JoinRuleInvite, adminInvites, bridgev2.GroupJoinSettings{OnlyAdminsCanAdd: true}},
+		{"InviteDefaultLevels", event.JoinRuleInvite, &event.PowerLevelsEventContent{}, bridgev2.GroupJoinSettings{}},
+		{"InviteAtUsersDefault", event.JoinRuleInvite, &event.PowerLevelsEventContent{UsersDefault: 50, InvitePtr: ptr.Ptr(50)}, bridgev2.GroupJoinSettings{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := bridgev2.GroupJoinSettingsFromJoinRule(&event.JoinRulesEventContent{JoinRule: test.joinRule}, test.pl)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+func TestGroupJoinSettings_Roundtrip(t *testing.T) {
+	for _, settings := range []bridgev2.GroupJoinSettings{
+		{},
+		{InviteLinkEnabled: true},
+		{InviteLinkEnabled: true, RequireApproval: true},
+		{OnlyAdminsCanAdd: true},
+		{InviteLinkEnabled: true, RequireApproval: true, OnlyAdminsCanAdd: true},
+	} {
+		overrides := settings.ApplyPowerLevels(nil)
+		pl := &event.PowerLevelsEventContent{InvitePtr: overrides.Invite}
+		assert.Equal(t, settings, bridgev2.GroupJoinSettingsFromJoinRule(settings.ToJoinRule(), pl))
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ScheduledMessageLoop sends scheduled Matrix messages to the remote network when their time comes.
+// It's only used for networks that don't implement [ScheduledMessageHandlingNetworkAPI].
+type ScheduledMessageLoop struct {
+	br *Bridge
+
+	lock      sync.Mutex
+	nextCheck time.Time
+	ctx       context.Context
+	stop      context.CancelFunc
+	// sending contains the messages that have been queued in a portal, but haven't been handled yet.
+	sending map[id.EventID]struct{}
+}
+
+const ScheduledMessageCheckInterval = 1 * time.Hour
+
+// ScheduledMessageRetryDelay is how long to wait before trying again if a scheduled message couldn't be queued.
+const ScheduledMessageRetryDelay = 1 * time.Minute
+
+// Start loads upcoming scheduled messages from the database and starts a background loop to send them.
+func (sl *ScheduledMessageLoop) Start() {
+	log := sl.br.Log.With().Str("component", "scheduled message loop").Logger()
+	sl.lock.Lock()
+	sl.ctx, sl.stop = context.WithCancel(log.WithContext(context.Background()))
+	ctx := sl.ctx
+	sl.lock.Unlock()
+	go sl.loop(ctx)
+}
+
+// NextCheck returns the time when the loop will next fetch upcoming messages from the database.
+// Messages scheduled before this time are sent by goroutines that were started when the message was added.
+func (sl *ScheduledMessageLoop) NextCheck() time.Time {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.nextCheck
+}
+
+func (sl *ScheduledMessageLoop) loop(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	for {
+		// Bump the next check time before fetching, so that messages added concurrently are either
+		// returned by the query or started by Add. Messages that are picked up by both are only sent
+		// once, because messages that are already being sent are skipped.
+		sl.lock.Lock()
+		nextCheck := time.Now().Add(ScheduledMessageCheckInterval)
+		sl.nextCheck = nextCheck
+		sl.lock.Unlock()
+		messages, err := sl.br.DB.ScheduledMessage.GetUpcoming(ctx, ScheduledMessageCheckInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Err(err).Msg("Failed to get upcoming scheduled messages")
+		} else if len(messages) > 0 {
+			go sl.sleepAndSend(ctx, messages...)
+		}
+		select {
+		case <-time.After(time.Until(nextCheck)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sl *ScheduledMessageLoop) Stop() {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if sl.stop != nil {
+		sl.stop()
+	}
+}
+
+// Add saves a Matrix message to be sent at the given time.
+func (sl *ScheduledMessageLoop) Add(ctx context.Context, evt *event.Event, sendAt time.Time) error {
+	sm := &database.ScheduledMessage{
+		RoomID:  evt.RoomID,
+		EventID: evt.ID,
+		Sender:  evt.Sender,
+		SendAt:  sendAt,
+		Event:   evt,
+	}
+	return sl.schedule(ctx, sm)
+}
+
+func (sl *ScheduledMessageLoop) schedule(ctx context.Context, sm *database.ScheduledMessage) error {
+	err := sl.br.DB.ScheduledMessage.Put(ctx, sm)
+	if err != nil {
+		return err
+	}
+	sl.lock.Lock()
+	loopCtx, nextCheck := sl.ctx, sl.nextCheck
+	sl.lock.Unlock()
+	// If the loop isn't running, the message will be picked up when it's started
+	if loopCtx != nil && sm.SendAt.Before(nextCheck) {
+		go sl.sleepAndSend(loopCtx, sm)
+	}
+	return nil
+}
+
+// Cancel removes a scheduled message. It returns true if the event was scheduled and hasn't been sent yet.
+// Messages that have already been queued in the portal can't be cancelled anymore.
+func (sl *ScheduledMessageLoop) Cancel(ctx context.Context, eventID id.EventID) (bool, error) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if _, isSending := sl.sending[eventID]; isSending {
+		return false, nil
+	}
+	sm, err := sl.br.DB.ScheduledMessage.Claim(ctx, eventID)
+	return sm != nil, err
+}
+
+// startSending marks the given message as being sent. It returns false if it was already being sent.
+func (sl *ScheduledMessageLoop) startSending(eventID id.EventID) bool {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if _, isSending := sl.sending[eventID]; isSending {
+		return false
+	}
+	if sl.sending == nil {
+		sl.sending = make(map[id.EventID]struct{})
+	}
+	sl.sending[eventID] = struct{}{}
+	return true
+}
+
+func (sl *ScheduledMessageLoop) stopSending(eventID id.EventID) {
+	sl.lock.Lock()
+	delete(sl.sending, eventID)
+	sl.lock.Unlock()
+}
+
+// retry reschedules a message that couldn't be queued, so that it's tried again after ScheduledMessageRetryDelay.
+func (sl *ScheduledMessageLoop) retry(ctx context.Context, sm *database.ScheduledMessage) {
+	sm.SendAt = time.Now().Add(ScheduledMessageRetryDelay)
+	err := sl.schedule(ctx, sm)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("event_id", sm.EventID).Msg("Failed to reschedule scheduled message")
+	}
+}
+
+func (sl *ScheduledMessageLoop) sleepAndSend(ctx context.Context, sms ...*database.ScheduledMessage) {
+	for _, sm := range sms {
+		select {
+		case <-time.After(time.Until(sm.SendAt)):
+		case <-ctx.Done():
+			return
+		}
+		sl.send(ctx, sm)
+	}
+}
+
+func (sl *ScheduledMessageLoop) send(ctx context.Context, sm *database.ScheduledMessage) {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("room_id", sm.RoomID).
+		Stringer("event_id", sm.EventID).
+		Logger()
+	if !sl.startSending(sm.EventID) {
+		log.Debug().Msg("Scheduled message is already being sent")
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			sl.stopSending(sm.EventID)
+		}
+	}()
+	// The row is only deleted after the portal has handled the message, so reload it to make sure
+	// it wasn't cancelled while sleeping, and to get the current room in case the room was upgraded.
+	current, err := sl.br.DB.ScheduledMessage.Get(ctx, sm.EventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get scheduled message")
+		sl.retry(ctx, sm)
+		return
+	} else if current == nil {
+		log.Debug().Msg("Scheduled message was already sent or cancelled")
+		return
+	} else if current.SendAt.After(time.Now()) {
+		log.Debug().Msg("Scheduled message was rescheduled")
+		return
+	}
+	portal, err := sl.br.GetPortalByMXID(ctx, current.RoomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get portal for scheduled message")
+		sl.retry(ctx, current)
+		return
+	} else if portal == nil {
+		log.Warn().Msg("Portal for scheduled message no longer exists")
+		sl.delete(ctx, current.EventID)
+		return
+	}
+	sender, err := sl.br.GetUserByMXID(ctx, current.Sender)
+	if err != nil {
+		log.Err(err).Msg("Failed to get sender of scheduled message")
+		sl.retry(ctx, current)
+		return
+	}
+	evt := current.Event
+	evt.RoomID = current.RoomID
+	evt.Type.Class = event.MessageEventType
+	if evt.Content.Parsed == nil {
+		err = evt.Content.ParseRaw(evt.Type)
+		if err != nil {
+			log.Err(err).Msg("Failed to parse scheduled message content")
+			sl.delete(ctx, current.EventID)
+			return
+		}
+	}
+	if msg, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+		msg.MauScheduledTS = 0
+	}
+	delete(evt.Content.Raw, "fi.mau.scheduled_ts")
+	log.Debug().Msg("Sending scheduled message")
+	queued = portal.queueEvent(ctx, &portalMatrixEvent{
+		evt:      evt,
+		sender:   sender,
+		queuedAt: time.Now(),
+		traceCtx: ctx,
+		done: func() {
+			sl.delete(ctx, current.EventID)
+			sl.stopSending(current.EventID)
+		},
+	})
+	if !queued {
+		log.Warn().Msg("Portal event queue is full, retrying scheduled message later")
+		sl.retry(ctx, current)
+	}
+}
+
+func (sl *ScheduledMessageLoop) delete(ctx context.Context, eventID id.EventID) {
+	_, err := sl.br.DB.ScheduledMessage.Claim(ctx, eventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("event_id", eventID).Msg("Failed to delete sent scheduled message")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestScheduledMessage(t *testing.T) {
+	h := bridgetest.New(t, &bridgetest.NetworkConnector{}, nil)
+	userID := id.UserID("@user:bridge.test")
+	login := h.Login(h.User(userID), "username", map[string]string{"username": "me"})
+	portalKey := networkid.PortalKey{ID: "chat", Receiver: login.ID}
+	h.QueueRemoteEvent(login, &simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventChatResync,
+			PortalKey:    portalKey,
+			CreatePortal: true,
+		},
+	})
+	roomID := h.PortalRoom(portalKey)
+
+	sendAt := time.Now().Add(200 * time.Millisecond)
+	scheduled := h.SendMatrixEvent(roomID, userID, event.EventMessage, &event.MessageEventContent{
+		MsgType:        event.MsgText,
+		Body:           "later",
+		MauScheduledTS: sendAt.UnixMilli(),
+	})
+	cancelled := h.SendMatrixEvent(roomID, userID, event.EventMessage, &event.MessageEventContent{
+		MsgType:        event.MsgText,
+		Body:           "never",
+		MauScheduledTS: sendAt.UnixMilli(),
+	})
+	h.AssertMessageStatus(scheduled.ID, event.MessageStatusPending)
+	h.AssertMessageStatus(cancelled.ID, event.MessageStatusPending)
+	redaction := h.SendMatrixEvent(roomID, userID, event.EventRedaction, &event.RedactionEventContent{Redacts: cancelled.ID})
+	h.AssertMessageStatus(redaction.ID, event.MessageStatusSuccess)
+
+	msg, err := h.Bridge.DB.Message.GetPartByMXID(h.Ctx, scheduled.ID)
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+	require.Eventually(t, func() bool {
+		msg, err = h.Bridge.DB.Message.GetPartByMXID(h.Ctx, scheduled.ID)
+		return err == nil && msg != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, time.Now().Before(sendAt))
+	h.AssertMessageStatus(scheduled.ID, event.MessageStatusSuccess)
+	msg, err = h.Bridge.DB.Message.GetPartByMXID(h.Ctx, cancelled.ID)
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestScheduledMessageSentOnce(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	sendAt := time.Now().Add(200 * time.Millisecond)
+	scheduled := h.SendMatrixEvent(roomID, login.UserMXID, event.EventMessage, &event.MessageEventContent{
+		MsgType:        event.MsgText,
+		Body:           "later",
+		MauScheduledTS: sendAt.UnixMilli(),
+	})
+	h.AssertMessageStatus(scheduled.ID, event.MessageStatusPending)
+	// Adding the same event again starts another sender goroutine, like the periodic check would
+	require.NoError(t, h.Bridge.ScheduledMessages.Add(h.Ctx, scheduled, sendAt))
+	require.NoError(t, h.Bridge.ScheduledMessages.Add(h.Ctx, scheduled, sendAt))
+
+	client := login.Client.(*bridgetest.NetworkAPI)
+	require.Eventually(t, func() bool {
+		return len(client.SentMessages()) > 0
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []id.EventID{scheduled.ID}, client.SentMessages())
+	h.AssertMessageStatus(scheduled.ID, event.MessageStatusSuccess)
+	// The row is deleted after the portal has finished handling the message
+	require.Eventually(t, func() bool {
+		sm, err := h.Bridge.DB.ScheduledMessage.Get(h.Ctx, scheduled.ID)
+		return err == nil && sm == nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestScheduledMessageRetriedWhenQueueFull(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	client := login.Client.(*bridgetest.NetworkAPI)
+	unblock := make(chan struct{})
+	client.BlockSend = unblock
+	h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent("$blocking:bridge.test", login.UserMXID, roomID, "hi"))
+	require.Eventually(t, func() bool {
+		return len(client.SentMessages()) == 0 && h.Bridge.GetEventQueueStats().QueuedEvents == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < bridgev2.PortalEventBuffer; i++ {
+		h.Bridge.QueueMatrixEvent(h.Ctx, bridgetest.MatrixTextEvent(id.EventID(fmt.Sprintf("$queued%d:bridge.test", i)), login.UserMXID, roomID, "hi"))
+	}
+
+	scheduled := bridgetest.MatrixTextEvent("$scheduled:bridge.test", login.UserMXID, roomID, "later")
+	sendAt := time.Now().Add(50 * time.Millisecond)
+	require.NoError(t, h.Bridge.ScheduledMessages.Add(h.Ctx, scheduled, sendAt))
+	require.Eventually(t, func() bool {
+		sm, err := h.Bridge.DB.ScheduledMessage.Get(h.Ctx, scheduled.ID)
+		return err == nil && sm != nil && sm.SendAt.After(sendAt)
+	}, 5*time.Second, 10*time.Millisecond, "message dropped by the full queue should be rescheduled")
+
+	close(unblock)
+	h.WaitRoom(roomID)
+	assert.NotContains(t, client.SentMessages(), scheduled.ID)
+}
+
+func TestScheduledMessageLoopStop(t *testing.T) {
+	h, login, _, roomID := bridgetest.NewChat(t, nil)
+	sendAt := time.Now().Add(100 * time.Millisecond)
+	scheduled := h.SendMatrixEvent(roomID, login.UserMXID, event.EventMessage, &event.MessageEventContent{
+		MsgType:        event.MsgText,
+		Body:           "later",
+		MauScheduledTS: sendAt.UnixMilli(),
+	})
+	h.AssertMessageStatus(scheduled.ID, event.MessageStatusPending)
+	h.Bridge.ScheduledMessages.Stop()
+
+	time.Sleep(time.Until(sendAt) + 200*time.Millisecond)
+	assert.Empty(t, login.Client.(*bridgetest.NetworkAPI).SentMessages())
+	sm, err := h.Bridge.DB.ScheduledMessage.Get(h.Ctx, scheduled.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, sm, "stopped loop shouldn't claim the message")
+}
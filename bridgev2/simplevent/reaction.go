@@ -19,12 +19,14 @@ type Reaction struct {
 	Emoji          string
 	ExtraContent   map[string]any
 	ReactionDBMeta any
+	CustomEmoji    *bridgev2.CustomEmoji
 }
 
 var (
 	_ bridgev2.RemoteReaction                 = (*Reaction)(nil)
 	_ bridgev2.RemoteReactionWithMeta         = (*Reaction)(nil)
 	_ bridgev2.RemoteReactionWithExtraContent = (*Reaction)(nil)
+	_ bridgev2.RemoteReactionWithCustomEmoji  = (*Reaction)(nil)
 	_ bridgev2.RemoteReactionRemove           = (*Reaction)(nil)
 )
 
@@ -48,6 +50,10 @@ func (evt *Reaction) GetReactionExtraContent() map[string]any {
 	return evt.ExtraContent
 }
 
+func (evt *Reaction) GetReactionCustomEmoji() *bridgev2.CustomEmoji {
+	return evt.CustomEmoji
+}
+
 type ReactionSync struct {
 	EventMeta
 	TargetMessage networkid.MessageID
@@ -42,8 +42,8 @@ func (ul *UserLogin) MarkInPortal(ctx context.Context, portal *Portal) {
 				zerolog.Ctx(ctx).Err(err).Msg("Failed to ensure user is invited to portal")
 			}
 		}
-		if ul.Bridge.Config.PersonalFilteringSpaces && (userPortal.InSpace == nil || !*userPortal.InSpace) {
-			go ul.tryAddPortalToSpace(context.WithoutCancel(ctx), portal, userPortal.CopyWithoutValues())
+		if ul.Bridge.GetConfig().PersonalFilteringSpaces && (userPortal.InSpace == nil || !*userPortal.InSpace) {
+			portal.queueInternalEvent(&portalSpaceEvent{login: ul, userPortal: userPortal.CopyWithoutValues()})
 		}
 	}
 }
@@ -131,7 +131,7 @@ func (portal *Portal) toggleSpace(ctx context.Context, spaceID id.RoomID, canoni
 }
 
 func (ul *UserLogin) GetSpaceRoom(ctx context.Context) (id.RoomID, error) {
-	if !ul.Bridge.Config.PersonalFilteringSpaces {
+	if !ul.Bridge.GetConfig().PersonalFilteringSpaces {
 		return ul.SpaceRoom, nil
 	}
 	ul.spaceCreateLock.Lock()
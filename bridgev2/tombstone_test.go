@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func upgradeRoom(t *testing.T, h *bridgetest.Harness, oldRoomID id.RoomID, sender id.UserID, senderLevel int) id.RoomID {
+	t.Helper()
+	pl := &event.PowerLevelsEventContent{Users: map[id.UserID]int{sender: senderLevel}}
+	_, err := h.Bridge.Bot.SendState(h.Ctx, oldRoomID, event.StatePowerLevels, "", &event.Content{Parsed: pl}, time.Now())
+	require.NoError(t, err)
+	newRoomID, err := h.Matrix.Intent(sender).CreateRoom(h.Ctx, &mautrix.ReqCreateRoom{})
+	require.NoError(t, err)
+	h.SendMatrixEvent(oldRoomID, sender, event.StateTombstone, &event.TombstoneEventContent{
+		ReplacementRoom: newRoomID,
+	})
+	return newRoomID
+}
+
+func TestFollowTombstone(t *testing.T) {
+	h, login, portalKey, oldRoomID := bridgetest.NewChat(t, nil)
+	newRoomID := upgradeRoom(t, h, oldRoomID, "@admin:bridge.test", 100)
+	assert.Equal(t, newRoomID, h.PortalRoom(portalKey))
+
+	for userID, expected := range map[string]event.Membership{
+		h.Bridge.Bot.GetMXID().String():            event.MembershipJoin,
+		h.Matrix.FormatGhostMXID("alice").String(): event.MembershipJoin,
+		login.UserMXID.String():                    event.MembershipJoin,
+	} {
+		member := h.Matrix.GetState(newRoomID, event.StateMember, userID)
+		if assert.NotNil(t, member, "no member event for %s", userID) {
+			assert.Equal(t, expected, member.Content.AsMember().Membership, "unexpected membership for %s", userID)
+		}
+	}
+}
+
+func TestFollowTombstoneMovesSpaceChild(t *testing.T) {
+	cfg := bridgetest.DefaultConfig()
+	cfg.PersonalFilteringSpaces = true
+	h, login, portalKey, oldRoomID := bridgetest.NewChat(t, cfg)
+	// Adding the portal to the space is queued in the portal event loop after the room is created
+	h.WaitPortal(portalKey)
+	require.NotEmpty(t, login.SpaceRoom)
+	oldChild := h.Matrix.GetState(login.SpaceRoom, event.StateSpaceChild, oldRoomID.String())
+	require.NotNil(t, oldChild)
+
+	newRoomID := upgradeRoom(t, h, oldRoomID, "@admin:bridge.test", 100)
+	h.WaitPortal(portalKey)
+	assert.Equal(t, newRoomID, h.PortalRoom(portalKey))
+
+	oldChild = h.Matrix.GetState(login.SpaceRoom, event.StateSpaceChild, oldRoomID.String())
+	require.NotNil(t, oldChild)
+	require.NoError(t, parseIfNeeded(oldChild))
+	assert.Empty(t, oldChild.Content.AsSpaceChild().Via)
+	newChild := h.Matrix.GetState(login.SpaceRoom, event.StateSpaceChild, newRoomID.String())
+	require.NotNil(t, newChild)
+	require.NoError(t, parseIfNeeded(newChild))
+	assert.NotEmpty(t, newChild.Content.AsSpaceChild().Via)
+}
+
+func TestFollowTombstoneMovesScheduledMessages(t *testing.T) {
+	h, login, _, oldRoomID := bridgetest.NewChat(t, nil)
+	evt := bridgetest.MatrixTextEvent("$scheduled:bridge.test", login.UserMXID, oldRoomID, "later")
+	require.NoError(t, h.Bridge.DB.ScheduledMessage.Put(h.Ctx, &database.ScheduledMessage{
+		RoomID:  oldRoomID,
+		EventID: evt.ID,
+		Sender:  evt.Sender,
+		SendAt:  time.Now().Add(24 * time.Hour),
+		Event:   evt,
+	}))
+
+	newRoomID := upgradeRoom(t, h, oldRoomID, "@admin:bridge.test", 100)
+	sm, err := h.Bridge.DB.ScheduledMessage.Get(h.Ctx, evt.ID)
+	require.NoError(t, err)
+	require.NotNil(t, sm)
+	assert.Equal(t, newRoomID, sm.RoomID)
+}
+
+func TestFollowTombstoneChecksSender(t *testing.T) {
+	cfg := bridgetest.DefaultConfig()
+	cfg.Permissions["@nobody:bridge.test"] = &bridgeconfig.PermissionLevelUser
+	h, login, portalKey, oldRoomID := bridgetest.NewChat(t, cfg)
+
+	upgradeRoom(t, h, oldRoomID, "@admin:bridge.test", 0)
+	assert.Equal(t, oldRoomID, h.PortalRoom(portalKey), "tombstone without sufficient power level must be ignored")
+	upgradeRoom(t, h, oldRoomID, "@nobody:bridge.test", 100)
+	assert.Equal(t, oldRoomID, h.PortalRoom(portalKey), "tombstone from user who isn't an admin or logged in must be ignored")
+
+	newRoomID := upgradeRoom(t, h, oldRoomID, login.UserMXID, 100)
+	assert.Equal(t, newRoomID, h.PortalRoom(portalKey))
+}
+
+func parseIfNeeded(evt *event.Event) error {
+	if evt.Content.Parsed != nil {
+		return nil
+	}
+	return evt.Content.ParseRaw(evt.Type)
+}
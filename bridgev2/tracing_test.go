@@ -0,0 +1,48 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgev2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"maunium.net/go/mautrix/bridgev2/bridgetest"
+	"maunium.net/go/mautrix/tracing"
+	"maunium.net/go/mautrix/tracing/oteltracing"
+)
+
+func TestQueueRemoteEventWithContextLinksTrace(t *testing.T) {
+	h, login, portalKey, _ := bridgetest.NewChat(t, nil)
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetTracer(oteltracing.New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")))
+	t.Cleanup(func() {
+		tracing.SetTracer(nil)
+	})
+
+	ctx, span := tracing.Start(h.Ctx, "connector.receive")
+	login.QueueRemoteEventWithContext(ctx, bridgetest.TextMessage("traced", "alice", portalKey, "hello"))
+	h.WaitPortal(portalKey)
+	span.End()
+
+	var root, handle sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		switch s.Name() {
+		case "connector.receive":
+			root = s
+		case "bridgev2.Portal.handleRemoteMessage":
+			handle = s
+		}
+	}
+	require.NotNil(t, root)
+	require.NotNil(t, handle, "remote message handling didn't create a span")
+	assert.Equal(t, root.SpanContext().TraceID(), handle.SpanContext().TraceID())
+	assert.Equal(t, root.SpanContext().SpanID(), handle.Parent().SpanID())
+}
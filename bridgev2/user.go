@@ -30,8 +30,12 @@ type User struct {
 	Bridge *Bridge
 	Log    zerolog.Logger
 
+	// Permissions are the permissions of the user when the user was loaded. They aren't updated when the config is reloaded.
+	//
+	// Deprecated: use [User.GetPermissions] instead, which reflects the current config.
+	Permissions bridgeconfig.Permissions
+
 	CommandState unsafe.Pointer
-	Permissions  bridgeconfig.Permissions
 
 	doublePuppetIntent      MatrixAPI
 	doublePuppetInitialized bool
@@ -42,6 +46,11 @@ type User struct {
 	logins map[networkid.UserLoginID]*UserLogin
 }
 
+// GetPermissions returns the permissions of the user according to the current bridge config.
+func (user *User) GetPermissions() bridgeconfig.Permissions {
+	return user.Bridge.GetConfig().Permissions.Get(user.MXID)
+}
+
 func (br *Bridge) loadUser(ctx context.Context, dbUser *database.User, queryErr error, userID *id.UserID) (*User, error) {
 	if queryErr != nil {
 		return nil, fmt.Errorf("failed to query db: %w", queryErr)
@@ -60,11 +69,12 @@ func (br *Bridge) loadUser(ctx context.Context, dbUser *database.User, queryErr
 		}
 	}
 	user := &User{
-		User:        dbUser,
-		Bridge:      br,
-		Log:         br.Log.With().Stringer("user_mxid", dbUser.MXID).Logger(),
-		logins:      make(map[networkid.UserLoginID]*UserLogin),
-		Permissions: br.Config.Permissions.Get(dbUser.MXID),
+		User:   dbUser,
+		Bridge: br,
+		Log:    br.Log.With().Stringer("user_mxid", dbUser.MXID).Logger(),
+		logins: make(map[networkid.UserLoginID]*UserLogin),
+
+		Permissions: br.GetConfig().Permissions.Get(dbUser.MXID),
 	}
 	br.usersByMXID[user.MXID] = user
 	err := br.unlockedLoadUserLoginsByMXID(ctx, user)
@@ -16,6 +16,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/exsync"
+	"golang.org/x/exp/maps"
 
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
@@ -37,6 +38,7 @@ type UserLogin struct {
 
 	spaceCreateLock sync.Mutex
 	deleteLock      sync.Mutex
+	clientLock      sync.RWMutex
 }
 
 func (br *Bridge) loadUserLogin(ctx context.Context, user *User, dbUserLogin *database.UserLogin) (*UserLogin, error) {
@@ -136,6 +138,14 @@ func (br *Bridge) GetCachedUserLoginByID(id networkid.UserLoginID) *UserLogin {
 	return br.userLoginsByID[id]
 }
 
+// GetAllCachedUserLogins returns all user logins that are currently loaded in memory.
+// Logins are loaded on startup, so this generally includes all logins of the bridge.
+func (br *Bridge) GetAllCachedUserLogins() []*UserLogin {
+	br.cacheLock.Lock()
+	defer br.cacheLock.Unlock()
+	return maps.Values(br.userLoginsByID)
+}
+
 func (br *Bridge) GetCurrentBridgeStates() (states []status.BridgeState) {
 	br.cacheLock.Lock()
 	defer br.cacheLock.Unlock()
@@ -260,7 +270,7 @@ type DeleteOpts struct {
 }
 
 func (ul *UserLogin) Delete(ctx context.Context, state status.BridgeState, opts DeleteOpts) {
-	cleanupRooms := !opts.DontCleanupRooms && ul.Bridge.Config.CleanupOnLogout.Enabled
+	cleanupRooms := !opts.DontCleanupRooms && ul.Bridge.GetConfig().CleanupOnLogout.Enabled
 	zerolog.Ctx(ctx).Info().Str("user_login_id", string(ul.ID)).
 		Bool("logout_remote", opts.LogoutRemote).
 		Bool("cleanup_rooms", cleanupRooms).
@@ -313,6 +323,7 @@ func (ul *UserLogin) Delete(ctx context.Context, state status.BridgeState, opts
 	}
 	ul.BridgeState.Destroy()
 	ul.BridgeState = nil
+	ul.Bridge.Metrics.ForgetLogin(ul.ID)
 }
 
 func (ul *UserLogin) deleteSpace(ctx context.Context) {
@@ -451,9 +462,9 @@ func (ul *UserLogin) getLogoutAction(ctx context.Context, up *database.UserPorta
 	} else if portal == nil || portal.MXID == "" {
 		return nil, bridgeconfig.CleanupActionNull, "portal not found", nil
 	}
-	actionsSet := ul.Bridge.Config.CleanupOnLogout.Manual
+	actionsSet := ul.Bridge.GetConfig().CleanupOnLogout.Manual
 	if badCredentials {
-		actionsSet = ul.Bridge.Config.CleanupOnLogout.BadCredentials
+		actionsSet = ul.Bridge.GetConfig().CleanupOnLogout.BadCredentials
 	}
 	if portal.Receiver != "" {
 		return portal, actionsSet.Private, "portal has receiver", nil
@@ -502,22 +513,55 @@ func (ul *UserLogin) FillBridgeState(state status.BridgeState) status.BridgeStat
 	return state
 }
 
+// Reconnect disconnects the network client and connects it again.
+//
+// The existing client is reused rather than replaced, as portals read the Client field
+// without synchronization while handling events.
+func (ul *UserLogin) Reconnect(ctx context.Context) error {
+	ul.deleteLock.Lock()
+	defer ul.deleteLock.Unlock()
+	client := ul.GetClient()
+	if ul.BridgeState == nil {
+		return fmt.Errorf("login has been deleted")
+	} else if client == nil {
+		return fmt.Errorf("login doesn't have a network client")
+	}
+	ul.disconnectClient(client)
+	client.Connect(ul.Log.WithContext(context.WithoutCancel(ctx)))
+	return nil
+}
+
 func (ul *UserLogin) Disconnect(done func()) {
 	if done != nil {
 		defer done()
 	}
+	ul.clientLock.Lock()
 	client := ul.Client
+	ul.Client = nil
+	ul.clientLock.Unlock()
 	if client != nil {
-		ul.Client = nil
-		disconnected := make(chan struct{})
-		go func() {
-			client.Disconnect()
-			close(disconnected)
-		}()
-		select {
-		case <-disconnected:
-		case <-time.After(5 * time.Second):
-			ul.Log.Warn().Msg("Client disconnection timed out")
-		}
+		ul.disconnectClient(client)
+	}
+}
+
+// GetClient returns the network client of the login, or nil if the login has been disconnected.
+//
+// Unlike reading the Client field directly, this is safe to call concurrently with Disconnect.
+func (ul *UserLogin) GetClient() NetworkAPI {
+	ul.clientLock.RLock()
+	defer ul.clientLock.RUnlock()
+	return ul.Client
+}
+
+func (ul *UserLogin) disconnectClient(client NetworkAPI) {
+	disconnected := make(chan struct{})
+	go func() {
+		client.Disconnect()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		ul.Log.Warn().Msg("Client disconnection timed out")
 	}
 }
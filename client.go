@@ -29,6 +29,7 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
+	"maunium.net/go/mautrix/tracing"
 )
 
 type CryptoHelper interface {
@@ -108,6 +109,9 @@ type Client struct {
 	DefaultHTTPBackoff time.Duration
 	// Set to true to disable automatically sleeping on 429 errors.
 	IgnoreRateLimit bool
+	// RateLimiter is used to throttle outgoing requests. It can be shared between multiple clients.
+	// If set, requests retried after 429 errors wait in the rate limiter queue instead of sleeping separately.
+	RateLimiter RequestRateLimiter
 
 	txnID int32
 
@@ -464,7 +468,14 @@ func (cli *Client) MakeFullRequest(ctx context.Context, params FullRequest) ([]b
 	return data, err
 }
 
-func (cli *Client) MakeFullRequestWithResp(ctx context.Context, params FullRequest) ([]byte, *http.Response, error) {
+func (cli *Client) MakeFullRequestWithResp(ctx context.Context, params FullRequest) (data []byte, resp *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "mautrix.Client.MakeFullRequest", tracing.String("http.request.method", params.Method))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(span, err)
+	}()
 	if params.MaxAttempts == 0 {
 		params.MaxAttempts = 1 + cli.DefaultHTTPRetries
 	}
@@ -482,6 +493,7 @@ func (cli *Client) MakeFullRequestWithResp(ctx context.Context, params FullReque
 	if err != nil {
 		return nil, nil, err
 	}
+	span.SetAttributes(tracing.String("server.address", req.URL.Host), tracing.String("url.path", req.URL.Path))
 	if params.Handler == nil {
 		if params.DontReadResponse {
 			params.Handler = noopHandleResponse
@@ -507,7 +519,7 @@ func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
 	return log
 }
 
-func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON any, handler ClientResponseHandler, dontReadResponse bool, client *http.Client) ([]byte, *http.Response, error) {
+func (cli *Client) doRetry(req *http.Request, cause error, retries int, sleep, backoff time.Duration, responseJSON any, handler ClientResponseHandler, dontReadResponse bool, client *http.Client) ([]byte, *http.Response, error) {
 	log := zerolog.Ctx(req.Context())
 	if req.Body != nil {
 		var err error
@@ -529,9 +541,9 @@ func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff
 		}
 	}
 	log.Warn().Err(cause).
-		Int("retry_in_seconds", int(backoff.Seconds())).
+		Int("retry_in_seconds", int(sleep.Seconds())).
 		Msg("Request failed, retrying")
-	time.Sleep(backoff)
+	time.Sleep(sleep)
 	if cli.UpdateRequestOnRetry != nil {
 		req = cli.UpdateRequestOnRetry(req, cause)
 	}
@@ -624,16 +636,35 @@ func ParseErrorResponse(req *http.Request, res *http.Response) ([]byte, error) {
 }
 
 func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON any, handler ClientResponseHandler, dontReadResponse bool, client *http.Client) ([]byte, *http.Response, error) {
+	var rateLimitDone func(*http.Response) bool
+	if cli.RateLimiter != nil {
+		var err error
+		rateLimitDone, err = cli.RateLimiter.Wait(req)
+		if err != nil {
+			err = HTTPError{
+				Request: req,
+
+				Message:      "failed to wait for rate limiter",
+				WrappedError: err,
+			}
+			cli.LogRequestDone(req, nil, err, nil, 0, 0)
+			return nil, nil, err
+		}
+	}
 	cli.RequestStart(req)
 	startTime := time.Now()
 	res, err := client.Do(req)
 	duration := time.Now().Sub(startTime)
+	var rateLimitPaused bool
+	if rateLimitDone != nil {
+		rateLimitPaused = rateLimitDone(res)
+	}
 	if res != nil && !dontReadResponse {
 		defer res.Body.Close()
 	}
 	if err != nil {
 		if retries > 0 && !errors.Is(err, context.Canceled) {
-			return cli.doRetry(req, err, retries, backoff, responseJSON, handler, dontReadResponse, client)
+			return cli.doRetry(req, err, retries, backoff, backoff, responseJSON, handler, dontReadResponse, client)
 		}
 		err = HTTPError{
 			Request:  req,
@@ -648,7 +679,12 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 
 	if retries > 0 && retryafter.Should(res.StatusCode, !cli.IgnoreRateLimit) {
 		backoff = retryafter.Parse(res.Header.Get("Retry-After"), backoff)
-		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler, dontReadResponse, client)
+		sleep := backoff
+		if rateLimitPaused {
+			// The rate limiter will hold back the retry until the pause is over, so don't sleep separately
+			sleep = 0
+		}
+		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, sleep, backoff, responseJSON, handler, dontReadResponse, client)
 	}
 
 	var body []byte
@@ -1139,6 +1175,9 @@ func (cli *Client) SetRoomAccountData(ctx context.Context, roomID id.RoomID, nam
 type ReqSendEvent struct {
 	Timestamp     int64
 	TransactionID string
+	// UnstableDelay makes the server send the event after the given delay (MSC4140).
+	// The response will contain a delay ID instead of an event ID.
+	UnstableDelay time.Duration
 
 	DontEncrypt bool
 
@@ -1167,6 +1206,9 @@ func (cli *Client) SendMessageEvent(ctx context.Context, roomID id.RoomID, event
 	if req.MeowEventID != "" {
 		queryParams["fi.mau.event_id"] = req.MeowEventID.String()
 	}
+	if req.UnstableDelay > 0 {
+		queryParams["org.matrix.msc4140.delay"] = strconv.FormatInt(req.UnstableDelay.Milliseconds(), 10)
+	}
 
 	if !req.DontEncrypt && cli.Crypto != nil && eventType != event.EventReaction && eventType != event.EventEncrypted {
 		var isEncrypted bool
@@ -1202,11 +1244,14 @@ func (cli *Client) SendStateEvent(ctx context.Context, roomID id.RoomID, eventTy
 	if req.MeowEventID != "" {
 		queryParams["fi.mau.event_id"] = req.MeowEventID.String()
 	}
+	if req.UnstableDelay > 0 {
+		queryParams["org.matrix.msc4140.delay"] = strconv.FormatInt(req.UnstableDelay.Milliseconds(), 10)
+	}
 
 	urlData := ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}
 	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
 	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, contentJSON, &resp)
-	if err == nil && cli.StateStore != nil {
+	if err == nil && cli.StateStore != nil && req.UnstableDelay == 0 {
 		cli.updateStoreWithOutgoingEvent(ctx, roomID, eventType, stateKey, contentJSON)
 	}
 	return
@@ -1225,6 +1270,40 @@ func (cli *Client) SendMassagedStateEvent(ctx context.Context, roomID id.RoomID,
 	return
 }
 
+// DelayedEvents lists the delayed events scheduled by the current user (MSC4140).
+// The from parameter is the next_batch token from a previous response, or an empty string to start from the beginning.
+func (cli *Client) DelayedEvents(ctx context.Context, from string) (resp *RespDelayedEvents, err error) {
+	query := map[string]string{}
+	if from != "" {
+		query["from"] = from
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"unstable", "org.matrix.msc4140", "delayed_events"}, query)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// UpdateDelayedEvent cancels, restarts or immediately sends a delayed event (MSC4140).
+func (cli *Client) UpdateDelayedEvent(ctx context.Context, delayID string, action DelayedEventAction) error {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc4140", "delayed_events", delayID)
+	_, err := cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqUpdateDelayedEvent{Action: action}, nil)
+	return err
+}
+
+// CancelDelayedEvent cancels a delayed event so that it's never sent.
+func (cli *Client) CancelDelayedEvent(ctx context.Context, delayID string) error {
+	return cli.UpdateDelayedEvent(ctx, delayID, DelayedEventActionCancel)
+}
+
+// RestartDelayedEvent resets the timer of a delayed event to its original delay.
+func (cli *Client) RestartDelayedEvent(ctx context.Context, delayID string) error {
+	return cli.UpdateDelayedEvent(ctx, delayID, DelayedEventActionRestart)
+}
+
+// SendDelayedEventNow sends a delayed event immediately instead of waiting for the delay to expire.
+func (cli *Client) SendDelayedEventNow(ctx context.Context, delayID string) error {
+	return cli.UpdateDelayedEvent(ctx, delayID, DelayedEventActionSend)
+}
+
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
 // See https://spec.matrix.org/v1.2/client-server-api/#mtext
 func (cli *Client) SendText(ctx context.Context, roomID id.RoomID, text string) (*RespSendEvent, error) {
@@ -2079,6 +2158,54 @@ func (cli *Client) GetAliases(ctx context.Context, roomID id.RoomID) (resp *Resp
 	return
 }
 
+// GetThirdPartyProtocols returns the third-party protocols that the homeserver can bridge to.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyprotocols
+func (cli *Client) GetThirdPartyProtocols(ctx context.Context) (resp RespThirdPartyProtocols, err error) {
+	urlPath := cli.BuildClientURL("v3", "thirdparty", "protocols")
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyProtocol returns the metadata of a single third-party protocol.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+func (cli *Client) GetThirdPartyProtocol(ctx context.Context, protocol string) (resp *ThirdPartyProtocol, err error) {
+	urlPath := cli.BuildClientURL("v3", "thirdparty", "protocol", protocol)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyLocations finds bridged rooms matching the given protocol-specific fields.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartylocationprotocol
+func (cli *Client) GetThirdPartyLocations(ctx context.Context, protocol string, fields map[string]string) (resp []*ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "location", protocol}, fields)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyUsers finds bridged users matching the given protocol-specific fields.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyuserprotocol
+func (cli *Client) GetThirdPartyUsers(ctx context.Context, protocol string, fields map[string]string) (resp []*ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "user", protocol}, fields)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyLocationsByAlias finds the third-party locations that the given room alias is bridged to.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartylocation
+func (cli *Client) GetThirdPartyLocationsByAlias(ctx context.Context, alias id.RoomAlias) (resp []*ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "location"}, map[string]string{"alias": alias.String()})
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyUsersByID finds the third-party users that the given Matrix user ID is bridged to.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyuser
+func (cli *Client) GetThirdPartyUsersByID(ctx context.Context, userID id.UserID) (resp []*ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "user"}, map[string]string{"userid": userID.String()})
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
 func (cli *Client) UploadKeys(ctx context.Context, req *ReqUploadKeys) (resp *RespUploadKeys, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "upload")
 	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
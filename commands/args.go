@@ -0,0 +1,214 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrUnterminatedQuote = errors.New("unterminated quote")
+
+// SplitArgs splits the given string into arguments like a shell would.
+//
+// Arguments are separated by whitespace. Single and double quotes can be used to include whitespace in arguments,
+// and backslashes escape the next character, except inside single quotes.
+func SplitArgs(input string) ([]string, error) {
+	args, _, err := splitArgs(input)
+	return args, err
+}
+
+// splitArgs is SplitArgs, but it also returns the byte offset in the input where each argument ends.
+func splitArgs(input string) (args []string, ends []int, err error) {
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	escaped := false
+	for i, char := range input {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '"' || char == '\'':
+			quote = char
+			inArg = true
+		case unicode.IsSpace(char):
+			if inArg {
+				args = append(args, current.String())
+				ends = append(ends, i)
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, nil, ErrUnterminatedQuote
+	} else if escaped {
+		current.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, current.String())
+		ends = append(ends, len(input))
+	}
+	return args, ends, nil
+}
+
+type FlagType int
+
+const (
+	FlagTypeBool FlagType = iota
+	FlagTypeString
+	FlagTypeInt
+	FlagTypeDuration
+)
+
+func (ft FlagType) String() string {
+	switch ft {
+	case FlagTypeBool:
+		return "bool"
+	case FlagTypeString:
+		return "string"
+	case FlagTypeInt:
+		return "int"
+	case FlagTypeDuration:
+		return "duration"
+	default:
+		return fmt.Sprintf("FlagType(%d)", int(ft))
+	}
+}
+
+// Flag describes a typed flag that a command accepts.
+//
+// Flags can be specified anywhere in the arguments as `--name value`, `--name=value` or `-s value`
+// (where s is the short name). Boolean flags don't take a value, but `--name=false` is allowed.
+// A lone `--` stops flag parsing.
+type Flag struct {
+	Name        string
+	Short       string
+	Type        FlagType
+	Default     any
+	Description string
+}
+
+func (f *Flag) parse(value string) (any, error) {
+	switch f.Type {
+	case FlagTypeBool:
+		return strconv.ParseBool(value)
+	case FlagTypeString:
+		return value, nil
+	case FlagTypeInt:
+		return strconv.Atoi(value)
+	case FlagTypeDuration:
+		return time.ParseDuration(value)
+	default:
+		return nil, fmt.Errorf("unsupported flag type %s", f.Type)
+	}
+}
+
+// FlagValues contains the parsed values of flags, including defaults for flags that weren't specified.
+type FlagValues map[string]any
+
+// Has returns true if the flag was specified or has a default value.
+func (fv FlagValues) Has(name string) bool {
+	_, ok := fv[name]
+	return ok
+}
+
+func (fv FlagValues) Bool(name string) bool {
+	val, _ := fv[name].(bool)
+	return val
+}
+
+func (fv FlagValues) String(name string) string {
+	val, _ := fv[name].(string)
+	return val
+}
+
+func (fv FlagValues) Int(name string) int {
+	val, _ := fv[name].(int)
+	return val
+}
+
+func (fv FlagValues) Duration(name string) time.Duration {
+	val, _ := fv[name].(time.Duration)
+	return val
+}
+
+func isFlagArg(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	// Allow negative numbers as positional arguments
+	_, err := strconv.ParseFloat(arg, 64)
+	return err != nil
+}
+
+// ParseFlags extracts the given flags from the argument list.
+// It returns the remaining positional arguments and the flag values.
+func ParseFlags(flags []Flag, args []string) ([]string, FlagValues, error) {
+	values := make(FlagValues, len(flags))
+	for _, flag := range flags {
+		if flag.Default != nil {
+			values[flag.Name] = flag.Default
+		}
+	}
+	positional := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		} else if !isFlagArg(arg) {
+			positional = append(positional, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		var flag *Flag
+		for j := range flags {
+			if (strings.HasPrefix(arg, "--") && flags[j].Name == name) ||
+				(!strings.HasPrefix(arg, "--") && flags[j].Short != "" && flags[j].Short == name) {
+				flag = &flags[j]
+				break
+			}
+		}
+		if flag == nil {
+			return nil, nil, fmt.Errorf("unknown flag %s", arg)
+		}
+		if !hasValue {
+			if flag.Type == FlagTypeBool {
+				values[flag.Name] = true
+				continue
+			} else if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("flag --%s requires a value", flag.Name)
+			}
+			i++
+			value = args[i]
+		}
+		parsed, err := flag.parse(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for flag --%s: %w", flag.Name, err)
+		}
+		values[flag.Name] = parsed
+	}
+	return positional, values, nil
+}
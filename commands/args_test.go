@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/commands"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"Empty", "", nil},
+		{"Simple", "foo bar  baz", []string{"foo", "bar", "baz"}},
+		{"DoubleQuotes", `foo "bar baz" qux`, []string{"foo", "bar baz", "qux"}},
+		{"SingleQuotes", `'it\s' "a \"test\""`, []string{`it\s`, `a "test"`}},
+		{"EmptyQuoted", `foo "" bar`, []string{"foo", "", "bar"}},
+		{"AdjacentQuotes", `foo"bar baz"`, []string{"foobar baz"}},
+		{"EscapedSpace", `foo\ bar`, []string{"foo bar"}},
+		{"TrailingBackslash", `foo\`, []string{`foo\`}},
+		{"Newlines", "foo\nbar", []string{"foo", "bar"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := commands.SplitArgs(test.input)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, args)
+		})
+	}
+	_, err := commands.SplitArgs(`foo "bar`)
+	assert.ErrorIs(t, err, commands.ErrUnterminatedQuote)
+}
+
+var testFlags = []commands.Flag{
+	{Name: "verbose", Short: "v", Type: commands.FlagTypeBool},
+	{Name: "name", Short: "n", Type: commands.FlagTypeString, Default: "default"},
+	{Name: "count", Type: commands.FlagTypeInt},
+	{Name: "timeout", Type: commands.FlagTypeDuration},
+}
+
+func TestParseFlags(t *testing.T) {
+	args, flags, err := commands.ParseFlags(testFlags, []string{"first", "-v", "--name", "foo", "second", "--count=-5", "--timeout=1m", "-3"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second", "-3"}, args)
+	assert.True(t, flags.Bool("verbose"))
+	assert.Equal(t, "foo", flags.String("name"))
+	assert.Equal(t, -5, flags.Int("count"))
+	assert.Equal(t, time.Minute, flags.Duration("timeout"))
+}
+
+func TestParseFlags_Defaults(t *testing.T) {
+	args, flags, err := commands.ParseFlags(testFlags, []string{"--verbose=false", "--", "--name", "-v"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--name", "-v"}, args)
+	assert.False(t, flags.Bool("verbose"))
+	assert.True(t, flags.Has("verbose"))
+	assert.Equal(t, "default", flags.String("name"))
+	assert.False(t, flags.Has("count"))
+}
+
+func TestParseFlags_Errors(t *testing.T) {
+	_, _, err := commands.ParseFlags(testFlags, []string{"--unknown"})
+	assert.ErrorContains(t, err, "unknown flag --unknown")
+	_, _, err = commands.ParseFlags(testFlags, []string{"--name"})
+	assert.ErrorContains(t, err, "requires a value")
+	_, _, err = commands.ParseFlags(testFlags, []string{"--count", "abc"})
+	assert.ErrorContains(t, err, "invalid value for flag --count")
+	_, _, err = commands.ParseFlags(testFlags, []string{"--verbose", "-n"})
+	assert.ErrorContains(t, err, "flag --name requires a value")
+}
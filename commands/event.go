@@ -0,0 +1,122 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// Event stores all data which might be used to handle commands
+type Event struct {
+	Client    *mautrix.Client
+	Processor *Processor
+	Handler   MinimalCommandHandler
+	RoomID    id.RoomID
+	EventID   id.EventID
+	Sender    id.UserID
+	Command   string
+	Args      []string
+	RawArgs   string
+	Flags     FlagValues
+	ReplyTo   id.EventID
+	Evt       *event.Event
+	Ctx       context.Context
+	Log       *zerolog.Logger
+}
+
+// Prefix returns the command prefix of the room the command was sent in.
+func (ce *Event) Prefix() string {
+	return ce.Processor.RoomPrefix(ce.RoomID)
+}
+
+func (ce *Event) formatReply(msg string, args []any) string {
+	prefix := ce.Prefix()
+	if prefix != "" {
+		prefix += " "
+	}
+	msg = strings.ReplaceAll(msg, "$cmdprefix ", prefix)
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Reply sends a reply to command as notice, with optional string formatting and automatic $cmdprefix replacement.
+func (ce *Event) Reply(msg string, args ...any) {
+	ce.ReplyAdvanced(ce.formatReply(msg, args), true, false)
+}
+
+// ReplyAdvanced sends a reply to command as notice. It allows using HTML and disabling markdown,
+// but doesn't have built-in string formatting.
+func (ce *Event) ReplyAdvanced(msg string, allowMarkdown, allowHTML bool) {
+	_, err := ce.sendNotice(msg, allowMarkdown, allowHTML)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to reply to command")
+	}
+}
+
+func (ce *Event) sendNotice(msg string, allowMarkdown, allowHTML bool) (id.EventID, error) {
+	content := format.RenderMarkdown(msg, allowMarkdown, allowHTML)
+	content.MsgType = event.MsgNotice
+	resp, err := ce.Client.SendMessageEvent(ce.Ctx, ce.RoomID, event.EventMessage, &content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// Edit edits a message previously sent by the bot, with optional string formatting and automatic $cmdprefix replacement.
+func (ce *Event) Edit(eventID id.EventID, msg string, args ...any) {
+	err := ce.Processor.editNotice(ce.Ctx, ce.RoomID, eventID, ce.formatReply(msg, args))
+	if err != nil {
+		ce.Log.Err(err).Stringer("target_event_id", eventID).Msg("Failed to edit message")
+	}
+}
+
+// React sends a reaction to the command.
+func (ce *Event) React(key string) {
+	_, err := ce.Client.SendReaction(ce.Ctx, ce.RoomID, ce.EventID, key)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to react to command")
+	}
+}
+
+// Redact redacts the command.
+func (ce *Event) Redact(req ...mautrix.ReqRedact) {
+	_, err := ce.Client.RedactEvent(ce.Ctx, ce.RoomID, ce.EventID, req...)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to redact command")
+	}
+}
+
+// MarkRead marks the command event as read.
+func (ce *Event) MarkRead() {
+	err := ce.Client.MarkRead(ce.Ctx, ce.RoomID, ce.EventID)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to mark command as read")
+	}
+}
+
+// SetState stores a command state for the sender in the current room,
+// which means their next message will be passed to the state's Next handler.
+func (ce *Event) SetState(state *CommandState) {
+	ce.Processor.StoreCommandState(ce.RoomID, ce.Sender, state)
+}
+
+// State returns the current command state of the sender in the current room.
+func (ce *Event) State() *CommandState {
+	return ce.Processor.LoadCommandState(ce.RoomID, ce.Sender)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+type MinimalCommandHandler interface {
+	Run(*Event)
+}
+
+type MinimalCommandHandlerFunc func(*Event)
+
+func (mhf MinimalCommandHandlerFunc) Run(ce *Event) {
+	mhf(ce)
+}
+
+// CommandState is a multi-step command that is waiting for more input from a user in a specific room.
+type CommandState struct {
+	Next   MinimalCommandHandler
+	Action string
+	Meta   any
+	Cancel func()
+}
+
+type CommandHandler interface {
+	MinimalCommandHandler
+	GetName() string
+}
+
+type AliasedCommandHandler interface {
+	CommandHandler
+	GetAliases() []string
+}
+
+type FullHandler struct {
+	Func func(*Event)
+
+	Name    string
+	Aliases []string
+	Help    HelpMeta
+	Flags   []Flag
+
+	// RequiresAdmin limits the command to users for which [Processor.IsAdmin] returns true.
+	RequiresAdmin bool
+	// RequiresEventLevel limits the command to users who are allowed to send the given event type in the room.
+	RequiresEventLevel event.Type
+	// RequiresPowerLevel limits the command to users whose power level in the room is at least this value.
+	RequiresPowerLevel int
+}
+
+func (fh *FullHandler) GetHelp() HelpMeta {
+	fh.Help.Command = fh.Name
+	fh.Help.Flags = fh.Flags
+	if fh.Help.Section.Name == "" {
+		fh.Help.Section = HelpSectionGeneral
+	}
+	return fh.Help
+}
+
+func (fh *FullHandler) GetName() string {
+	return fh.Name
+}
+
+func (fh *FullHandler) GetAliases() []string {
+	return fh.Aliases
+}
+
+func (fh *FullHandler) ShowInHelp(ce *Event) bool {
+	return !fh.RequiresAdmin || ce.Processor.IsAdmin(ce.Sender)
+}
+
+func (fh *FullHandler) userHasRoomPermission(ce *Event) bool {
+	levels, err := ce.Processor.GetPowerLevels(ce.Ctx, ce.RoomID)
+	if err != nil {
+		ce.Log.Warn().Err(err).Msg("Failed to check room power levels")
+		ce.Reply("Failed to get room power levels to see if you're allowed to use that command")
+		return false
+	}
+	userLevel := levels.GetUserLevel(ce.Sender)
+	if fh.RequiresEventLevel.Type != "" && userLevel < levels.GetEventLevel(fh.RequiresEventLevel) {
+		return false
+	}
+	return userLevel >= fh.RequiresPowerLevel
+}
+
+func (fh *FullHandler) Run(ce *Event) {
+	needsRoomPermission := fh.RequiresEventLevel.Type != "" || fh.RequiresPowerLevel > 0
+	isAdmin := ce.Processor.IsAdmin(ce.Sender)
+	if fh.RequiresAdmin && !isAdmin {
+		ce.Reply("That command is limited to bot administrators.")
+	} else if needsRoomPermission && !isAdmin && !fh.userHasRoomPermission(ce) {
+		ce.Reply("You don't have sufficient permissions in this room to use that command.")
+	} else if len(fh.Flags) > 0 && !fh.parseFlags(ce) {
+		return
+	} else {
+		fh.Func(ce)
+	}
+}
+
+func (fh *FullHandler) parseFlags(ce *Event) bool {
+	args, flags, err := ParseFlags(fh.Flags, ce.Args)
+	if err != nil {
+		ce.Reply("%s. Use `$cmdprefix help %s` for usage.", capitalizeFirst(err.Error()), fh.Name)
+		return false
+	}
+	ce.Args = args
+	ce.Flags = flags
+	return true
+}
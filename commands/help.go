@@ -0,0 +1,214 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type HelpfulHandler interface {
+	CommandHandler
+	GetHelp() HelpMeta
+	ShowInHelp(*Event) bool
+}
+
+type HelpSection struct {
+	Name  string
+	Order int
+}
+
+var (
+	HelpSectionGeneral = HelpSection{"General", 0}
+	HelpSectionAdmin   = HelpSection{"Administration", 50}
+)
+
+type HelpMeta struct {
+	Command     string
+	Section     HelpSection
+	Description string
+	Args        string
+	Flags       []Flag
+}
+
+func (hm *HelpMeta) String() string {
+	if len(hm.Args) == 0 {
+		return fmt.Sprintf("**%s** - %s", hm.Command, hm.Description)
+	}
+	return fmt.Sprintf("**%s** %s - %s", hm.Command, hm.Args, hm.Description)
+}
+
+// Detailed returns the help text of a single command, including descriptions of all flags.
+func (hm *HelpMeta) Detailed(aliases []string) string {
+	var output strings.Builder
+	output.WriteString(hm.String())
+	output.WriteByte('\n')
+	if len(aliases) > 0 {
+		_, _ = fmt.Fprintf(&output, "\nAliases: `%s`\n", strings.Join(aliases, "`, `"))
+	}
+	if len(hm.Flags) > 0 {
+		output.WriteString("\nFlags:\n")
+		for _, flag := range hm.Flags {
+			output.WriteString("* `--")
+			output.WriteString(flag.Name)
+			if flag.Type != FlagTypeBool {
+				output.WriteString(" <")
+				output.WriteString(flag.Type.String())
+				output.WriteByte('>')
+			}
+			output.WriteByte('`')
+			if flag.Short != "" {
+				_, _ = fmt.Fprintf(&output, " (`-%s`)", flag.Short)
+			}
+			if flag.Description != "" {
+				output.WriteString(" - ")
+				output.WriteString(flag.Description)
+			}
+			if flag.Default != nil {
+				_, _ = fmt.Fprintf(&output, " (default: `%v`)", flag.Default)
+			}
+			output.WriteByte('\n')
+		}
+	}
+	return output.String()
+}
+
+func capitalizeFirst(str string) string {
+	first, size := utf8.DecodeRuneInString(str)
+	if size == 0 {
+		return str
+	}
+	return string(unicode.ToUpper(first)) + str[size:]
+}
+
+type helpSectionList []HelpSection
+
+func (h helpSectionList) Len() int {
+	return len(h)
+}
+
+func (h helpSectionList) Less(i, j int) bool {
+	return h[i].Order < h[j].Order
+}
+
+func (h helpSectionList) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+type helpMetaList []HelpMeta
+
+func (h helpMetaList) Len() int {
+	return len(h)
+}
+
+func (h helpMetaList) Less(i, j int) bool {
+	return h[i].Command < h[j].Command
+}
+
+func (h helpMetaList) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+var _ sort.Interface = (helpSectionList)(nil)
+var _ sort.Interface = (helpMetaList)(nil)
+
+// WriteHelpSections writes the given help entries grouped by section. Sections are sorted by their order,
+// and the commands in each section are sorted by name.
+func WriteHelpSections(output *strings.Builder, helps []HelpMeta) {
+	sections := make(map[HelpSection]helpMetaList)
+	for _, help := range helps {
+		sections[help.Section] = append(sections[help.Section], help)
+	}
+
+	sortedSections := make(helpSectionList, 0, len(sections))
+	for section := range sections {
+		sortedSections = append(sortedSections, section)
+	}
+	sort.Sort(sortedSections)
+
+	for _, section := range sortedSections {
+		output.WriteString("#### ")
+		output.WriteString(section.Name)
+		output.WriteByte('\n')
+		sort.Sort(sections[section])
+		for _, command := range sections[section] {
+			output.WriteString(command.String())
+			output.WriteByte('\n')
+		}
+		output.WriteByte('\n')
+	}
+}
+
+func FormatHelp(ce *Event) string {
+	var helps []HelpMeta
+	for _, handler := range ce.Processor.getHandlers() {
+		helpfulHandler, ok := handler.(HelpfulHandler)
+		if !ok || !helpfulHandler.ShowInHelp(ce) {
+			continue
+		}
+		help := helpfulHandler.GetHelp()
+		if help.Description == "" {
+			continue
+		}
+		helps = append(helps, help)
+	}
+
+	var output strings.Builder
+	output.Grow(10240)
+
+	if prefix := ce.Prefix(); prefix == "" {
+		output.WriteString("Prefixing commands is not required in this room.")
+	} else {
+		_, _ = fmt.Fprintf(&output, "Commands in this room must be prefixed with `%s`.", prefix)
+	}
+	output.WriteByte('\n')
+	output.WriteString("Parameters in [square brackets] are optional, while parameters in <angle brackets> are required.")
+	output.WriteString(" Use `help <command>` to see the flags of a specific command.")
+	output.WriteByte('\n')
+	output.WriteByte('\n')
+	WriteHelpSections(&output, helps)
+	return output.String()
+}
+
+// FormatCommandHelp returns the detailed help text of the given command, or an empty string if the command isn't found.
+func FormatCommandHelp(ce *Event, command string) string {
+	handler := ce.Processor.GetHandler(command)
+	helpfulHandler, ok := handler.(HelpfulHandler)
+	if !ok || !helpfulHandler.ShowInHelp(ce) {
+		return ""
+	}
+	help := helpfulHandler.GetHelp()
+	var aliases []string
+	if aliased, ok := handler.(AliasedCommandHandler); ok {
+		aliases = aliased.GetAliases()
+	}
+	return help.Detailed(aliases)
+}
+
+var CommandHelp = &FullHandler{
+	Func: func(ce *Event) {
+		if len(ce.Args) > 0 {
+			help := FormatCommandHelp(ce, ce.Args[0])
+			if help == "" {
+				ce.Reply("Unknown command `%s`", ce.Args[0])
+			} else {
+				ce.Reply(help)
+			}
+			return
+		}
+		ce.Reply(FormatHelp(ce))
+	},
+	Name: "help",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Show this help message, or the detailed help of a single command.",
+		Args:        "[_command_]",
+	},
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package commands implements a command processor for Matrix bots, which works with any [mautrix.Client],
+// including appservice intents.
+package commands
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+type stateKey struct {
+	RoomID id.RoomID
+	UserID id.UserID
+}
+
+// Processor parses commands from Matrix messages and dispatches them to handlers.
+//
+// Events should be passed to [Processor.HandleEvent], e.g. by registering it as a syncer
+// or appservice event processor handler for m.room.message and m.reaction events.
+type Processor struct {
+	Client *mautrix.Client
+	// StateStore is used to get power levels for permission checks. Defaults to the state store of the client.
+	StateStore mautrix.StateStore
+	Log        zerolog.Logger
+	// Prefix is the default command prefix used in rooms that don't have a custom prefix.
+	Prefix string
+	// IsAdmin returns true if the given user is a bot administrator, which bypasses all permission checks.
+	IsAdmin func(userID id.UserID) bool
+	// PromptTimeout is how long prompts can be answered after they're sent. Zero means prompts never expire.
+	PromptTimeout time.Duration
+
+	handlers     map[string]CommandHandler
+	aliases      map[string]string
+	handlersLock sync.RWMutex
+
+	roomPrefixes map[id.RoomID]string
+	prefixLock   sync.RWMutex
+
+	states     map[stateKey]*CommandState
+	prompts    map[id.EventID]*Prompt
+	statesLock sync.Mutex
+}
+
+// NewProcessor creates a Processor with the help and cancel commands.
+func NewProcessor(client *mautrix.Client, prefix string) *Processor {
+	proc := &Processor{
+		Client:     client,
+		StateStore: client.StateStore,
+		Log:        client.Log.With().Str("component", "commands").Logger(),
+		Prefix:     prefix,
+		IsAdmin: func(userID id.UserID) bool {
+			return false
+		},
+		PromptTimeout: 24 * time.Hour,
+
+		handlers:     make(map[string]CommandHandler),
+		aliases:      make(map[string]string),
+		roomPrefixes: make(map[id.RoomID]string),
+		states:       make(map[stateKey]*CommandState),
+		prompts:      make(map[id.EventID]*Prompt),
+	}
+	proc.AddHandlers(CommandHelp, CommandCancel)
+	return proc
+}
+
+func (proc *Processor) AddHandlers(handlers ...CommandHandler) {
+	for _, handler := range handlers {
+		proc.AddHandler(handler)
+	}
+}
+
+func (proc *Processor) AddHandler(handler CommandHandler) {
+	proc.handlersLock.Lock()
+	defer proc.handlersLock.Unlock()
+	proc.handlers[handler.GetName()] = handler
+	aliased, ok := handler.(AliasedCommandHandler)
+	if ok {
+		for _, alias := range aliased.GetAliases() {
+			proc.aliases[alias] = handler.GetName()
+		}
+	}
+}
+
+// GetHandler returns the handler for the given command name or alias.
+func (proc *Processor) GetHandler(command string) CommandHandler {
+	proc.handlersLock.RLock()
+	defer proc.handlersLock.RUnlock()
+	command = strings.ToLower(command)
+	realCommand, ok := proc.aliases[command]
+	if !ok {
+		realCommand = command
+	}
+	return proc.handlers[realCommand]
+}
+
+func (proc *Processor) getHandlers() []CommandHandler {
+	proc.handlersLock.RLock()
+	defer proc.handlersLock.RUnlock()
+	handlers := make([]CommandHandler, 0, len(proc.handlers))
+	for _, handler := range proc.handlers {
+		handlers = append(handlers, handler)
+	}
+	return handlers
+}
+
+// SetRoomPrefix overrides the command prefix in the given room.
+// An empty prefix means that all messages in the room are treated as commands.
+func (proc *Processor) SetRoomPrefix(roomID id.RoomID, prefix string) {
+	proc.prefixLock.Lock()
+	proc.roomPrefixes[roomID] = prefix
+	proc.prefixLock.Unlock()
+}
+
+// ClearRoomPrefix removes the prefix override of the given room, so the default prefix is used again.
+func (proc *Processor) ClearRoomPrefix(roomID id.RoomID) {
+	proc.prefixLock.Lock()
+	delete(proc.roomPrefixes, roomID)
+	proc.prefixLock.Unlock()
+}
+
+// RoomPrefix returns the command prefix used in the given room.
+func (proc *Processor) RoomPrefix(roomID id.RoomID) string {
+	proc.prefixLock.RLock()
+	defer proc.prefixLock.RUnlock()
+	prefix, ok := proc.roomPrefixes[roomID]
+	if !ok {
+		return proc.Prefix
+	}
+	return prefix
+}
+
+// GetPowerLevels returns the power levels of the given room from the state store,
+// or fetches them from the server if they're not cached.
+func (proc *Processor) GetPowerLevels(ctx context.Context, roomID id.RoomID) (*event.PowerLevelsEventContent, error) {
+	if proc.StateStore != nil {
+		levels, err := proc.StateStore.GetPowerLevels(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get power levels from state store: %w", err)
+		} else if levels != nil {
+			return levels, nil
+		}
+	}
+	var levels event.PowerLevelsEventContent
+	err := proc.Client.StateEvent(ctx, roomID, event.StatePowerLevels, "", &levels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch power levels: %w", err)
+	}
+	if proc.StateStore != nil {
+		err = proc.StateStore.SetPowerLevels(ctx, roomID, &levels)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to store fetched power levels")
+		}
+	}
+	return &levels, nil
+}
+
+func (proc *Processor) LoadCommandState(roomID id.RoomID, userID id.UserID) *CommandState {
+	proc.statesLock.Lock()
+	defer proc.statesLock.Unlock()
+	return proc.states[stateKey{roomID, userID}]
+}
+
+// StoreCommandState sets the command state of the given user in the given room. A nil state clears it.
+func (proc *Processor) StoreCommandState(roomID id.RoomID, userID id.UserID, cs *CommandState) {
+	proc.SwapCommandState(roomID, userID, cs)
+}
+
+func (proc *Processor) SwapCommandState(roomID id.RoomID, userID id.UserID, cs *CommandState) *CommandState {
+	proc.statesLock.Lock()
+	defer proc.statesLock.Unlock()
+	key := stateKey{roomID, userID}
+	prev := proc.states[key]
+	if cs == nil {
+		delete(proc.states, key)
+	} else {
+		proc.states[key] = cs
+	}
+	return prev
+}
+
+func (proc *Processor) editNotice(ctx context.Context, roomID id.RoomID, eventID id.EventID, msg string) error {
+	content := format.RenderMarkdown(msg, true, false)
+	content.MsgType = event.MsgNotice
+	content.SetEdit(eventID)
+	_, err := proc.Client.SendMessageEvent(ctx, roomID, event.EventMessage, &content)
+	return err
+}
+
+// trimPrefix returns the message without the command prefix, or false if the message doesn't have the prefix.
+// If the prefix ends with a letter or number, it must be followed by whitespace.
+func trimPrefix(message, prefix string) (string, bool) {
+	if prefix == "" {
+		return message, true
+	} else if !strings.HasPrefix(message, prefix) {
+		return "", false
+	}
+	rest := message[len(prefix):]
+	lastChar, _ := utf8.DecodeLastRuneInString(prefix)
+	nextChar, _ := utf8.DecodeRuneInString(rest)
+	if rest != "" && (unicode.IsLetter(lastChar) || unicode.IsNumber(lastChar)) && !unicode.IsSpace(nextChar) {
+		return "", false
+	}
+	return strings.TrimLeftFunc(rest, unicode.IsSpace), true
+}
+
+// HandleEvent handles an m.room.message or m.reaction event. Other event types and events sent by the bot itself are ignored.
+func (proc *Processor) HandleEvent(ctx context.Context, evt *event.Event) {
+	if evt.Sender == proc.Client.UserID {
+		return
+	}
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	log := proc.Log.With().
+		Stringer("room_id", evt.RoomID).
+		Stringer("event_id", evt.ID).
+		Stringer("sender", evt.Sender).
+		Logger()
+	ctx = log.WithContext(ctx)
+	defer func() {
+		err := recover()
+		if err != nil {
+			logEvt := log.Error().
+				Bytes(zerolog.ErrorStackFieldName, debug.Stack())
+			if realErr, ok := err.(error); ok {
+				logEvt = logEvt.Err(realErr)
+			} else {
+				logEvt = logEvt.Any(zerolog.ErrorFieldName, err)
+			}
+			logEvt.Msg("Panic in Matrix command handler")
+		}
+	}()
+	switch evt.Type {
+	case event.EventMessage:
+		proc.handleMessage(ctx, evt)
+	case event.EventReaction:
+		proc.handleReaction(ctx, evt)
+	}
+}
+
+func (proc *Processor) newEvent(ctx context.Context, evt *event.Event) *Event {
+	return &Event{
+		Client:    proc.Client,
+		Processor: proc,
+		RoomID:    evt.RoomID,
+		EventID:   evt.ID,
+		Sender:    evt.Sender,
+		Evt:       evt,
+		Ctx:       ctx,
+		Log:       zerolog.Ctx(ctx),
+	}
+}
+
+func (proc *Processor) handleMessage(ctx context.Context, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgText || content.RelatesTo.GetReplaceID() != "" {
+		return
+	}
+	contentCopy := *content
+	contentCopy.RemoveReplyFallback()
+	message := strings.TrimSpace(contentCopy.Body)
+	replyTo := content.RelatesTo.GetNonFallbackReplyTo()
+	if replyTo != "" && proc.answerPrompt(ctx, evt, replyTo, message) {
+		return
+	}
+	ce := proc.newEvent(ctx, evt)
+	ce.ReplyTo = replyTo
+	commandText, isCommand := trimPrefix(message, proc.RoomPrefix(evt.RoomID))
+	if isCommand {
+		args, ends, err := splitArgs(commandText)
+		if err != nil {
+			ce.Reply("Failed to parse command: %v", err)
+			return
+		} else if len(args) == 0 {
+			args = []string{"help"}
+			ends = []int{0}
+		}
+		ce.Command = strings.ToLower(args[0])
+		ce.Args = args[1:]
+		ce.RawArgs = strings.TrimLeftFunc(commandText[ends[0]:], unicode.IsSpace)
+		handler := proc.GetHandler(ce.Command)
+		if handler != nil {
+			log := zerolog.Ctx(ctx)
+			log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("mx_command", ce.Command)
+			})
+			log.Debug().Msg("Received command")
+			ce.Handler = handler
+			handler.Run(ce)
+			return
+		}
+	}
+	state := proc.LoadCommandState(evt.RoomID, evt.Sender)
+	if state != nil && state.Next != nil {
+		args, err := SplitArgs(message)
+		if err != nil {
+			args = strings.Fields(message)
+		}
+		ce.Command = ""
+		ce.RawArgs = message
+		ce.Args = args
+		ce.Handler = state.Next
+		log := zerolog.Ctx(ctx)
+		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str("action", state.Action)
+		})
+		log.Debug().Msg("Received reply to command state")
+		state.Next.Run(ce)
+	} else if isCommand {
+		zerolog.Ctx(ctx).Debug().Str("mx_command", ce.Command).Msg("Received unknown command")
+		ce.Reply("Unknown command, use the `$cmdprefix help` command for help.")
+	}
+}
+
+var CommandCancel = &FullHandler{
+	Func: func(ce *Event) {
+		state := ce.Processor.SwapCommandState(ce.RoomID, ce.Sender, nil)
+		if state != nil {
+			action := state.Action
+			if action == "" {
+				action = "Unknown action"
+			}
+			if state.Cancel != nil {
+				state.Cancel()
+			}
+			ce.Reply("%s cancelled.", action)
+		} else {
+			ce.Reply("No ongoing command.")
+		}
+	},
+	Name: "cancel",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Cancel an ongoing action.",
+	},
+}
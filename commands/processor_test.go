@@ -0,0 +1,340 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mockserver"
+)
+
+type testEnv struct {
+	t      *testing.T
+	ctx    context.Context
+	bot    *mautrix.Client
+	user   *mautrix.Client
+	roomID id.RoomID
+	proc   *commands.Processor
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+	bot := ms.Login(t, ms.CreateUser("bot"), "BOT")
+	user := ms.Login(t, ms.CreateUser("alice"), "ALICE")
+	resp, err := bot.CreateRoom(ctx, &mautrix.ReqCreateRoom{Invite: []id.UserID{user.UserID}})
+	require.NoError(t, err)
+	_, err = user.JoinRoomByID(ctx, resp.RoomID)
+	require.NoError(t, err)
+	return &testEnv{
+		t:      t,
+		ctx:    ctx,
+		bot:    bot,
+		user:   user,
+		roomID: resp.RoomID,
+		proc:   commands.NewProcessor(bot, "!bot"),
+	}
+}
+
+func (env *testEnv) handle(eventID id.EventID) {
+	evt, err := env.bot.GetEvent(env.ctx, env.roomID, eventID)
+	require.NoError(env.t, err)
+	env.proc.HandleEvent(env.ctx, evt)
+}
+
+func (env *testEnv) send(content *event.MessageEventContent) id.EventID {
+	resp, err := env.user.SendMessageEvent(env.ctx, env.roomID, event.EventMessage, content)
+	require.NoError(env.t, err)
+	env.handle(resp.EventID)
+	return resp.EventID
+}
+
+func (env *testEnv) sendText(text string) id.EventID {
+	return env.send(&event.MessageEventContent{MsgType: event.MsgText, Body: text})
+}
+
+func (env *testEnv) lastBotMessage() (*event.Event, *event.MessageEventContent) {
+	resp, err := env.user.Messages(env.ctx, env.roomID, "", "", mautrix.DirectionBackward, nil, 20)
+	require.NoError(env.t, err)
+	for _, evt := range resp.Chunk {
+		if evt.Sender == env.bot.UserID && evt.Type == event.EventMessage {
+			require.NoError(env.t, evt.Content.ParseRaw(evt.Type))
+			return evt, evt.Content.AsMessage()
+		}
+	}
+	return nil, nil
+}
+
+func (env *testEnv) lastReply() string {
+	_, content := env.lastBotMessage()
+	if content == nil {
+		return ""
+	}
+	return content.Body
+}
+
+func TestProcessor_CommandWithFlags(t *testing.T) {
+	env := newTestEnv(t)
+	var gotArgs []string
+	var gotFlags commands.FlagValues
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			gotArgs = ce.Args
+			gotFlags = ce.Flags
+			ce.Reply(strings.Repeat(ce.Args[0], ce.Flags.Int("times")))
+		},
+		Name:    "echo",
+		Aliases: []string{"say"},
+		Flags: []commands.Flag{
+			{Name: "times", Short: "t", Type: commands.FlagTypeInt, Default: 1, Description: "How many times to repeat"},
+			{Name: "loud", Type: commands.FlagTypeBool},
+		},
+		Help: commands.HelpMeta{Description: "Echo the input", Args: "<_text_>"},
+	})
+
+	env.sendText(`!bot SAY --loud "hello world" -t 2`)
+	assert.Equal(t, []string{"hello world"}, gotArgs)
+	assert.True(t, gotFlags.Bool("loud"))
+	assert.Equal(t, "hello worldhello world", env.lastReply())
+
+	env.sendText(`!bot echo --times nope x`)
+	assert.Contains(t, env.lastReply(), "Invalid value for flag --times")
+	assert.Contains(t, env.lastReply(), "!bot help echo")
+
+	env.sendText(`!bot echo "unterminated`)
+	assert.Contains(t, env.lastReply(), "unterminated quote")
+
+	env.sendText("!bot help")
+	assert.Contains(t, env.lastReply(), "**echo** <_text_> - Echo the input")
+	assert.Contains(t, env.lastReply(), "prefixed with `!bot`")
+
+	env.sendText("!bot help say")
+	assert.Contains(t, env.lastReply(), "`--times <int>` (`-t`)")
+	assert.Contains(t, env.lastReply(), "Aliases: `say`")
+
+	env.sendText("!bot nonexistent")
+	assert.Equal(t, "Unknown command, use the `!bot help` command for help.", env.lastReply())
+}
+
+func TestProcessor_Prefixes(t *testing.T) {
+	env := newTestEnv(t)
+	calls := 0
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			calls++
+		},
+		Name: "ping",
+	})
+
+	env.sendText("ping")
+	env.sendText("!botping")
+	assert.Equal(t, 0, calls)
+	env.sendText("!bot ping")
+	assert.Equal(t, 1, calls)
+
+	env.proc.SetRoomPrefix(env.roomID, "")
+	env.sendText("ping")
+	assert.Equal(t, 2, calls)
+	env.sendText("hello")
+	assert.Equal(t, "Unknown command, use the `help` command for help.", env.lastReply())
+
+	env.proc.SetRoomPrefix(env.roomID, "/")
+	env.sendText("/ping")
+	assert.Equal(t, 3, calls)
+
+	env.proc.ClearRoomPrefix(env.roomID)
+	env.sendText("/ping")
+	assert.Equal(t, 3, calls)
+}
+
+func TestProcessor_Permissions(t *testing.T) {
+	env := newTestEnv(t)
+	calls := 0
+	env.proc.AddHandlers(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			calls++
+		},
+		Name:               "kick",
+		RequiresEventLevel: event.StatePowerLevels,
+		Help:               commands.HelpMeta{Description: "Kick someone"},
+	}, &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			calls++
+		},
+		Name:          "shutdown",
+		RequiresAdmin: true,
+		Help:          commands.HelpMeta{Description: "Shut down the bot"},
+	})
+
+	env.sendText("!bot kick")
+	assert.Equal(t, 0, calls)
+	assert.Contains(t, env.lastReply(), "sufficient permissions")
+	env.sendText("!bot shutdown")
+	assert.Equal(t, 0, calls)
+	assert.Contains(t, env.lastReply(), "limited to bot administrators")
+	env.sendText("!bot help")
+	assert.NotContains(t, env.lastReply(), "shutdown")
+
+	levels, err := env.proc.GetPowerLevels(env.ctx, env.roomID)
+	require.NoError(t, err)
+	levels.SetUserLevel(env.user.UserID, 100)
+	_, err = env.bot.SendStateEvent(env.ctx, env.roomID, event.StatePowerLevels, "", levels)
+	require.NoError(t, err)
+	require.NoError(t, env.bot.StateStore.SetPowerLevels(env.ctx, env.roomID, levels))
+	env.sendText("!bot kick")
+	assert.Equal(t, 1, calls)
+
+	env.proc.IsAdmin = func(userID id.UserID) bool {
+		return userID == env.user.UserID
+	}
+	env.sendText("!bot shutdown")
+	assert.Equal(t, 2, calls)
+	env.sendText("!bot help")
+	assert.Contains(t, env.lastReply(), "shutdown")
+}
+
+func TestProcessor_Prompts(t *testing.T) {
+	env := newTestEnv(t)
+	var answers []string
+	var prompt *commands.Prompt
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			var options []string
+			if len(ce.Args) > 0 {
+				options = ce.Args
+			}
+			var err error
+			prompt, err = ce.Prompt("Continue?", options, func(ce *commands.Event, prompt *commands.Prompt, answer string) {
+				answers = append(answers, answer)
+				assert.NoError(t, prompt.Edit(ce.Ctx, "Answered: "+answer))
+			})
+			require.NoError(t, err)
+		},
+		Name: "ask",
+	})
+
+	env.sendText("!bot ask yes no")
+	require.NotNil(t, prompt)
+	reactResp, err := env.user.SendReaction(env.ctx, env.roomID, prompt.EventID, "maybe")
+	require.NoError(t, err)
+	env.handle(reactResp.EventID)
+	assert.Empty(t, answers)
+
+	reply := &event.MessageEventContent{MsgType: event.MsgText, Body: "maybe"}
+	reply.RelatesTo = (&event.RelatesTo{}).SetReplyTo(prompt.EventID)
+	env.send(reply)
+	assert.Empty(t, answers)
+	assert.Contains(t, env.lastReply(), "Please answer with one of `yes`, `no`")
+
+	reactResp, err = env.user.SendReaction(env.ctx, env.roomID, prompt.EventID, "yes")
+	require.NoError(t, err)
+	env.handle(reactResp.EventID)
+	assert.Equal(t, []string{"yes"}, answers)
+	evt, content := env.lastBotMessage()
+	require.NotNil(t, evt)
+	assert.Equal(t, prompt.EventID, content.RelatesTo.GetReplaceID())
+	assert.Equal(t, "Answered: yes", content.NewContent.Body)
+
+	// Prompts are only answered once
+	env.handle(reactResp.EventID)
+	assert.Len(t, answers, 1)
+
+	env.sendText("!bot ask")
+	reply = &event.MessageEventContent{MsgType: event.MsgText, Body: "free text answer"}
+	reply.RelatesTo = (&event.RelatesTo{}).SetReplyTo(prompt.EventID)
+	env.send(reply)
+	assert.Equal(t, []string{"yes", "free text answer"}, answers)
+}
+
+func TestProcessor_PromptTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	env.proc.PromptTimeout = time.Millisecond
+	var answers []string
+	var prompt *commands.Prompt
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			var err error
+			prompt, err = ce.Prompt("Continue?", nil, func(ce *commands.Event, prompt *commands.Prompt, answer string) {
+				answers = append(answers, answer)
+			})
+			require.NoError(t, err)
+		},
+		Name: "ask",
+	})
+
+	env.sendText("!bot ask")
+	require.NotNil(t, prompt)
+	time.Sleep(5 * time.Millisecond)
+	reply := &event.MessageEventContent{MsgType: event.MsgText, Body: "too late"}
+	reply.RelatesTo = (&event.RelatesTo{}).SetReplyTo(prompt.EventID)
+	env.send(reply)
+	assert.Empty(t, answers, "expired prompts must not be answered")
+}
+
+func TestProcessor_RawArgs(t *testing.T) {
+	env := newTestEnv(t)
+	var rawArgs []string
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			rawArgs = append(rawArgs, ce.RawArgs)
+		},
+		Name: "echo",
+	})
+
+	env.sendText(`!bot echo  "a  b" c`)
+	env.sendText(`!bot "echo" a b`)
+	env.sendText(`!bot e\cho a b`)
+	env.sendText(`!bot 'ECHO'`)
+	assert.Equal(t, []string{`"a  b" c`, "a b", "a b", ""}, rawArgs)
+}
+
+func TestProcessor_CommandState(t *testing.T) {
+	env := newTestEnv(t)
+	var steps []string
+	cancelled := false
+	env.proc.AddHandler(&commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			ce.SetState(&commands.CommandState{
+				Action: "Setup",
+				Next: commands.MinimalCommandHandlerFunc(func(ce *commands.Event) {
+					steps = append(steps, ce.RawArgs)
+					if len(steps) == 2 {
+						ce.SetState(nil)
+					}
+				}),
+				Cancel: func() {
+					cancelled = true
+				},
+			})
+			ce.Reply("Send the name")
+		},
+		Name: "setup",
+	})
+
+	env.sendText("!bot setup")
+	env.sendText("first step")
+	env.sendText("second step")
+	env.sendText("third step")
+	assert.Equal(t, []string{"first step", "second step"}, steps)
+
+	env.sendText("!bot setup")
+	assert.NotNil(t, env.proc.LoadCommandState(env.roomID, env.user.UserID))
+	env.sendText("!bot cancel")
+	assert.True(t, cancelled)
+	assert.Equal(t, "Setup cancelled.", env.lastReply())
+	assert.Nil(t, env.proc.LoadCommandState(env.roomID, env.user.UserID))
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PromptHandler is called when a prompt is answered. The answer is either
+// the text of the reply or the key of the reaction that the user sent.
+type PromptHandler func(ce *Event, prompt *Prompt, answer string)
+
+// Prompt is a question sent by the bot that the user can answer by replying to it or, if the prompt
+// has options, by reacting to it with one of the options. Prompts are only answered once: the handler
+// can send a new prompt if it needs more input. The prompt message itself can be edited to show the result.
+type Prompt struct {
+	RoomID  id.RoomID
+	EventID id.EventID
+	// UserID is the user who is allowed to answer the prompt.
+	UserID  id.UserID
+	Options []string
+	Handler PromptHandler
+	// ExpiresAt is the time after which the prompt can no longer be answered. Zero means it never expires.
+	ExpiresAt time.Time
+
+	proc *Processor
+}
+
+func (p *Prompt) expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt)
+}
+
+// Prompt sends a notice that the sender of the command can answer by replying to it. If options are given,
+// they're also added as reactions to the notice, and the answer must be one of the options.
+func (ce *Event) Prompt(msg string, options []string, handler PromptHandler) (*Prompt, error) {
+	eventID, err := ce.sendNotice(ce.formatReply(msg, nil), true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send prompt: %w", err)
+	}
+	prompt := &Prompt{
+		RoomID:  ce.RoomID,
+		EventID: eventID,
+		UserID:  ce.Sender,
+		Options: options,
+		Handler: handler,
+		proc:    ce.Processor,
+	}
+	now := time.Now()
+	if ce.Processor.PromptTimeout > 0 {
+		prompt.ExpiresAt = now.Add(ce.Processor.PromptTimeout)
+	}
+	ce.Processor.statesLock.Lock()
+	for promptEventID, existing := range ce.Processor.prompts {
+		if existing.expired(now) {
+			delete(ce.Processor.prompts, promptEventID)
+		}
+	}
+	ce.Processor.prompts[eventID] = prompt
+	ce.Processor.statesLock.Unlock()
+	for _, option := range options {
+		_, err = ce.Client.SendReaction(ce.Ctx, ce.RoomID, eventID, option)
+		if err != nil {
+			ce.Log.Warn().Err(err).Str("option", option).Msg("Failed to add option reaction to prompt")
+		}
+	}
+	return prompt, nil
+}
+
+// Edit replaces the text of the prompt message.
+func (p *Prompt) Edit(ctx context.Context, msg string) error {
+	return p.proc.editNotice(ctx, p.RoomID, p.EventID, msg)
+}
+
+// Cancel stops waiting for an answer to the prompt.
+func (p *Prompt) Cancel() {
+	p.proc.statesLock.Lock()
+	if p.proc.prompts[p.EventID] == p {
+		delete(p.proc.prompts, p.EventID)
+	}
+	p.proc.statesLock.Unlock()
+}
+
+func (p *Prompt) matchOption(answer string) (string, bool) {
+	if len(p.Options) == 0 {
+		return answer, true
+	}
+	for _, option := range p.Options {
+		if strings.EqualFold(option, answer) {
+			return option, true
+		}
+	}
+	return "", false
+}
+
+func (proc *Processor) takePrompt(targetEventID id.EventID, sender id.UserID, answer string, isReaction bool) (*Prompt, string, bool) {
+	proc.statesLock.Lock()
+	defer proc.statesLock.Unlock()
+	prompt, ok := proc.prompts[targetEventID]
+	if ok && prompt.expired(time.Now()) {
+		delete(proc.prompts, targetEventID)
+		return nil, "", false
+	} else if !ok || prompt.UserID != sender || (isReaction && len(prompt.Options) == 0) {
+		return nil, "", false
+	}
+	answer, ok = prompt.matchOption(answer)
+	if ok {
+		delete(proc.prompts, targetEventID)
+	}
+	return prompt, answer, ok
+}
+
+func (proc *Processor) runPrompt(ctx context.Context, evt *event.Event, prompt *Prompt, answer string) {
+	ce := proc.newEvent(ctx, evt)
+	ce.RawArgs = answer
+	ce.Args = strings.Fields(answer)
+	ce.ReplyTo = prompt.EventID
+	log := zerolog.Ctx(ctx)
+	log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Stringer("prompt_event_id", prompt.EventID)
+	})
+	log.Debug().Msg("Received answer to prompt")
+	prompt.Handler(ce, prompt, answer)
+}
+
+func (proc *Processor) answerPrompt(ctx context.Context, evt *event.Event, replyTo id.EventID, message string) bool {
+	prompt, answer, ok := proc.takePrompt(replyTo, evt.Sender, message, false)
+	if prompt == nil {
+		return false
+	} else if !ok {
+		ce := proc.newEvent(ctx, evt)
+		ce.Reply("Please answer with one of `%s`", strings.Join(prompt.Options, "`, `"))
+		return true
+	}
+	proc.runPrompt(ctx, evt, prompt, answer)
+	return true
+}
+
+func (proc *Processor) handleReaction(ctx context.Context, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if !ok {
+		return
+	}
+	targetEventID := content.RelatesTo.GetAnnotationID()
+	key := content.RelatesTo.GetAnnotationKey()
+	if targetEventID == "" {
+		return
+	}
+	prompt, answer, ok := proc.takePrompt(targetEventID, evt.Sender, key, true)
+	if !ok {
+		return
+	}
+	proc.runPrompt(ctx, evt, prompt, answer)
+}
@@ -224,19 +224,28 @@ type ASEventProcessor interface {
 	Dispatch(ctx context.Context, evt *event.Event)
 }
 
+// appserviceToDeviceTypes are the to-device event types that are handled when receiving encryption data
+// through appservice transactions.
+//
+// ToDeviceForwardedRoomKey and ToDeviceRoomKey aren't included, as they should only be present inside encrypted to-device events.
+var appserviceToDeviceTypes = []event.Type{
+	event.ToDeviceEncrypted,
+	event.ToDeviceRoomKeyRequest,
+	event.ToDeviceRoomKeyWithheld,
+	event.ToDeviceBeeperRoomKeyAck,
+	event.ToDeviceOrgMatrixRoomKeyWithheld,
+	event.ToDeviceVerificationRequest,
+	event.ToDeviceVerificationStart,
+	event.ToDeviceVerificationAccept,
+	event.ToDeviceVerificationKey,
+	event.ToDeviceVerificationMAC,
+	event.ToDeviceVerificationCancel,
+}
+
 func (mach *OlmMachine) AddAppserviceListener(ep ASEventProcessor) {
-	// ToDeviceForwardedRoomKey and ToDeviceRoomKey should only be present inside encrypted to-device events
-	ep.On(event.ToDeviceEncrypted, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceRoomKeyRequest, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceRoomKeyWithheld, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceBeeperRoomKeyAck, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceOrgMatrixRoomKeyWithheld, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationRequest, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationStart, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationAccept, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationKey, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationMAC, mach.HandleToDeviceEvent)
-	ep.On(event.ToDeviceVerificationCancel, mach.HandleToDeviceEvent)
+	for _, evtType := range appserviceToDeviceTypes {
+		ep.On(evtType, mach.HandleToDeviceEvent)
+	}
 	ep.OnOTK(mach.HandleOTKCounts)
 	ep.OnDeviceList(mach.HandleDeviceLists)
 	mach.Log.Debug().Msg("Added listeners for encryption data coming from appservice transactions")
@@ -436,7 +445,7 @@ func (mach *OlmMachine) MarkOlmHashSavePoint(ctx context.Context) {
 // don't need to add any custom handlers if you use that method.
 func (mach *OlmMachine) HandleToDeviceEvent(ctx context.Context, evt *event.Event) {
 	if len(evt.ToUserID) > 0 && (evt.ToUserID != mach.Client.UserID || evt.ToDeviceID != mach.Client.DeviceID) {
-		// TODO This log probably needs to be silence-able if someone wants to use encrypted appservices with multiple e2ee sessions
+		// MachineRouter should be used instead of AddAppserviceListener if there are multiple e2ee sessions
 		mach.Log.Debug().
 			Str("target_user_id", evt.ToUserID.String()).
 			Str("target_device_id", evt.ToDeviceID.String()).
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MachineRouter distributes encryption data from appservice transactions to multiple OlmMachines.
+//
+// It's meant for appservices where many users have their own devices (MSC3202). Each machine has its own
+// account in the crypto store, while the device list is shared, so device list changes are only handled by
+// the default machine. To-device events and one-time key counts are routed based on the target user and device.
+type MachineRouter struct {
+	// Default is the machine that handles device list changes as well as any data
+	// that isn't targeted to one of the other machines.
+	Default *OlmMachine
+
+	lock     sync.RWMutex
+	machines map[id.UserID]*OlmMachine
+}
+
+// NewMachineRouter creates a new MachineRouter with the given default machine.
+func NewMachineRouter(defaultMachine *OlmMachine) *MachineRouter {
+	return &MachineRouter{
+		Default:  defaultMachine,
+		machines: make(map[id.UserID]*OlmMachine),
+	}
+}
+
+// Add registers a machine to receive data targeted to its user and device.
+// Any previous machine for the same user is replaced.
+func (mr *MachineRouter) Add(mach *OlmMachine) {
+	mr.lock.Lock()
+	mr.machines[mach.Client.UserID] = mach
+	mr.lock.Unlock()
+}
+
+// Remove unregisters the machine of the given user.
+func (mr *MachineRouter) Remove(userID id.UserID) {
+	mr.lock.Lock()
+	delete(mr.machines, userID)
+	mr.lock.Unlock()
+}
+
+// Get returns the machine registered for the given user, or nil if there isn't one.
+func (mr *MachineRouter) Get(userID id.UserID) *OlmMachine {
+	mr.lock.RLock()
+	defer mr.lock.RUnlock()
+	return mr.machines[userID]
+}
+
+// Machines returns all registered machines, not including the default machine.
+func (mr *MachineRouter) Machines() []*OlmMachine {
+	mr.lock.RLock()
+	defer mr.lock.RUnlock()
+	machines := make([]*OlmMachine, 0, len(mr.machines))
+	for _, mach := range mr.machines {
+		machines = append(machines, mach)
+	}
+	return machines
+}
+
+func (mr *MachineRouter) find(userID id.UserID, deviceID id.DeviceID) *OlmMachine {
+	if userID == "" {
+		return mr.Default
+	}
+	mach := mr.Get(userID)
+	if mach != nil && (deviceID == "" || mach.Client.DeviceID == deviceID) {
+		return mach
+	}
+	return mr.Default
+}
+
+// HandleToDeviceEvent passes the event to the machine of the user and device it's targeted to.
+func (mr *MachineRouter) HandleToDeviceEvent(ctx context.Context, evt *event.Event) {
+	mr.find(evt.ToUserID, evt.ToDeviceID).HandleToDeviceEvent(ctx, evt)
+}
+
+// HandleOTKCounts passes the one-time key counts to the machine of the user and device they're for.
+func (mr *MachineRouter) HandleOTKCounts(ctx context.Context, otkCount *mautrix.OTKCount) {
+	mr.find(otkCount.UserID, otkCount.DeviceID).HandleOTKCounts(ctx, otkCount)
+}
+
+// AddAppserviceListener registers the router to the given event processor.
+// This should be used instead of calling [OlmMachine.AddAppserviceListener] on the individual machines.
+func (mr *MachineRouter) AddAppserviceListener(ep ASEventProcessor) {
+	for _, evtType := range appserviceToDeviceTypes {
+		ep.On(evtType, mr.HandleToDeviceEvent)
+	}
+	ep.OnOTK(mr.HandleOTKCounts)
+	ep.OnDeviceList(mr.Default.HandleDeviceLists)
+	mr.Default.Log.Debug().Msg("Added routed listeners for encryption data coming from appservice transactions")
+}
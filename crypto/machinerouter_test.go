@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMachineRouter_HandleToDeviceEvent(t *testing.T) {
+	ctx := context.Background()
+	bot := newMachine(t, "@bot:example.com")
+	ghost := newMachine(t, "@ghost:example.com")
+	router := NewMachineRouter(bot)
+	router.Add(ghost)
+
+	withheld := func(sessionID id.SessionID, userID id.UserID, deviceID id.DeviceID) {
+		evt := &event.Event{
+			Type: event.ToDeviceRoomKeyWithheld,
+			Content: event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+				RoomID:    "!room:example.com",
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: sessionID,
+				Code:      event.RoomKeyWithheldUnverified,
+			}},
+			ToUserID:   userID,
+			ToDeviceID: deviceID,
+		}
+		router.HandleToDeviceEvent(ctx, evt)
+	}
+	isWithheld := func(mach *OlmMachine, sessionID id.SessionID) bool {
+		content, err := mach.CryptoStore.GetWithheldGroupSession(ctx, "!room:example.com", sessionID)
+		require.NoError(t, err)
+		return content != nil
+	}
+
+	withheld("ghost", ghost.Client.UserID, ghost.Client.DeviceID)
+	withheld("bot", bot.Client.UserID, bot.Client.DeviceID)
+	withheld("otherdevice", ghost.Client.UserID, "otherdevice")
+	assert.True(t, isWithheld(ghost, "ghost"))
+	assert.False(t, isWithheld(bot, "ghost"))
+	assert.True(t, isWithheld(bot, "bot"))
+	assert.False(t, isWithheld(ghost, "bot"))
+	// Events for unknown devices go to the default machine, which drops them as they're not for it
+	assert.False(t, isWithheld(bot, "otherdevice"))
+	assert.False(t, isWithheld(ghost, "otherdevice"))
+
+	router.Remove(ghost.Client.UserID)
+	assert.Nil(t, router.Get(ghost.Client.UserID))
+}
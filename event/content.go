@@ -48,6 +48,8 @@ var TypeMap = map[Type]reflect.Type{
 	StateUnstablePolicyUser:   reflect.TypeOf(ModPolicyContent{}),
 
 	StateElementFunctionalMembers: reflect.TypeOf(ElementFunctionalMembersContent{}),
+	StateUnstableImagePack:        reflect.TypeOf(ImagePackEventContent{}),
+	StateUnstableGroupCall:        reflect.TypeOf(GroupCallEventContent{}),
 
 	EventMessage:   reflect.TypeOf(MessageEventContent{}),
 	EventSticker:   reflect.TypeOf(MessageEventContent{}),
@@ -57,6 +59,10 @@ var TypeMap = map[Type]reflect.Type{
 
 	EventUnstablePollStart:    reflect.TypeOf(PollStartEventContent{}),
 	EventUnstablePollResponse: reflect.TypeOf(PollResponseEventContent{}),
+	EventUnstablePollEnd:      reflect.TypeOf(PollEndEventContent{}),
+	EventPollStart:            reflect.TypeOf(PollStartEventContent{}),
+	EventPollResponse:         reflect.TypeOf(PollResponseEventContent{}),
+	EventPollEnd:              reflect.TypeOf(PollEndEventContent{}),
 
 	BeeperMessageStatus: reflect.TypeOf(BeeperMessageStatusEventContent{}),
 
@@ -67,6 +73,9 @@ var TypeMap = map[Type]reflect.Type{
 	AccountDataMarkedUnread:    reflect.TypeOf(MarkedUnreadEventContent{}),
 	AccountDataBeeperMute:      reflect.TypeOf(BeeperMuteEventContent{}),
 
+	AccountDataUnstableImagePack:      reflect.TypeOf(ImagePackEventContent{}),
+	AccountDataUnstableImagePackRooms: reflect.TypeOf(ImagePackRoomsEventContent{}),
+
 	EphemeralEventTyping:   reflect.TypeOf(TypingEventContent{}),
 	EphemeralEventReceipt:  reflect.TypeOf(ReceiptEventContent{}),
 	EphemeralEventPresence: reflect.TypeOf(PresenceEventContent{}),
@@ -390,6 +399,41 @@ func (content *Content) AsElementFunctionalMembers() *ElementFunctionalMembersCo
 	}
 	return casted
 }
+func (content *Content) AsImagePack() *ImagePackEventContent {
+	casted, ok := content.Parsed.(*ImagePackEventContent)
+	if !ok {
+		return &ImagePackEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsImagePackRooms() *ImagePackRoomsEventContent {
+	casted, ok := content.Parsed.(*ImagePackRoomsEventContent)
+	if !ok {
+		return &ImagePackRoomsEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollStart() *PollStartEventContent {
+	casted, ok := content.Parsed.(*PollStartEventContent)
+	if !ok {
+		return &PollStartEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollResponse() *PollResponseEventContent {
+	casted, ok := content.Parsed.(*PollResponseEventContent)
+	if !ok {
+		return &PollResponseEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollEnd() *PollEndEventContent {
+	casted, ok := content.Parsed.(*PollEndEventContent)
+	if !ok {
+		return &PollEndEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsMessage() *MessageEventContent {
 	casted, ok := content.Parsed.(*MessageEventContent)
 	if !ok {
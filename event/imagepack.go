@@ -0,0 +1,69 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"slices"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ImagePackUsage specifies what an image pack or an individual image in a pack can be used for.
+type ImagePackUsage string
+
+const (
+	ImagePackUsageEmoticon ImagePackUsage = "emoticon"
+	ImagePackUsageSticker  ImagePackUsage = "sticker"
+)
+
+// ImagePackImage is a single image inside an image pack.
+type ImagePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *FileInfo           `json:"info,omitempty"`
+	Usage []ImagePackUsage    `json:"usage,omitempty"`
+}
+
+// ImagePackMeta contains the metadata of an image pack.
+type ImagePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []ImagePackUsage    `json:"usage,omitempty"`
+	Attribution string              `json:"attribution,omitempty"`
+}
+
+// ImagePackEventContent represents the content of an im.ponies.room_emotes state event
+// or an im.ponies.user_emotes account data event.
+//
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2545
+type ImagePackEventContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackMeta              `json:"pack"`
+}
+
+// GetUsage returns the effective usage of the given image, falling back to the usage of the whole pack.
+// If neither the image nor the pack specify a usage, the image can be used for everything.
+func (content *ImagePackEventContent) GetUsage(shortcode string) []ImagePackUsage {
+	img, ok := content.Images[shortcode]
+	if ok && len(img.Usage) > 0 {
+		return img.Usage
+	} else if len(content.Pack.Usage) > 0 {
+		return content.Pack.Usage
+	}
+	return []ImagePackUsage{ImagePackUsageEmoticon, ImagePackUsageSticker}
+}
+
+// CanBeUsedAs returns whether the given image can be used for the given purpose.
+func (content *ImagePackEventContent) CanBeUsedAs(shortcode string, usage ImagePackUsage) bool {
+	return slices.Contains(content.GetUsage(shortcode), usage)
+}
+
+// ImagePackRoomsEventContent represents the content of an im.ponies.emote_rooms account data event,
+// which lists room image packs that the user has enabled globally.
+type ImagePackRoomsEventContent struct {
+	Rooms map[id.RoomID]map[string]struct{} `json:"rooms"`
+}
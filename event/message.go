@@ -138,6 +138,9 @@ type MessageEventContent struct {
 
 	BeeperLinkPreviews []*BeeperLinkPreview `json:"com.beeper.linkpreviews,omitempty"`
 
+	// MauScheduledTS asks the bridge to send the message to the remote network at the given unix millisecond timestamp.
+	MauScheduledTS int64 `json:"fi.mau.scheduled_ts,omitempty"`
+
 	MSC1767Audio *MSC1767Audio `json:"org.matrix.msc1767.audio,omitempty"`
 	MSC3245Voice *MSC3245Voice `json:"org.matrix.msc3245.voice,omitempty"`
 }
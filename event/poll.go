@@ -6,11 +6,94 @@
 
 package event
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ExtensibleText is a single representation of text in an extensible event (MSC1767).
+type ExtensibleText struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+// ExtensibleTextContainer is a list of representations of the same text, in order of preference.
+type ExtensibleTextContainer []ExtensibleText
+
+// MakeExtensibleText creates an extensible text container with a plaintext
+// and optionally a HTML representation of the given text.
+func MakeExtensibleText(text, html string) ExtensibleTextContainer {
+	container := ExtensibleTextContainer{{Body: text}}
+	if html != "" {
+		container = append(ExtensibleTextContainer{{Body: html, MimeType: "text/html"}}, container...)
+	}
+	return container
+}
+
+func (etc ExtensibleTextContainer) get(mimeType string) string {
+	for _, text := range etc {
+		if text.MimeType == mimeType || (mimeType == "text/plain" && text.MimeType == "") {
+			return text.Body
+		}
+	}
+	return ""
+}
+
+// Text returns the plaintext representation in the container.
+func (etc ExtensibleTextContainer) Text() string {
+	return etc.get("text/plain")
+}
+
+// HTML returns the HTML representation in the container, or an empty string if there isn't one.
+func (etc ExtensibleTextContainer) HTML() string {
+	return etc.get("text/html")
+}
+
 type PollResponseEventContent struct {
 	RelatesTo RelatesTo `json:"m.relates_to"`
 	Response  struct {
 		Answers []string `json:"answers"`
 	} `json:"org.matrix.msc3381.poll.response"`
+	Selections []string `json:"m.selections"`
+}
+
+// GetSelections returns the answer IDs selected in this response, preferring the stable field.
+func (content *PollResponseEventContent) GetSelections() []string {
+	if content.Selections != nil {
+		return content.Selections
+	}
+	return content.Response.Answers
+}
+
+type marshalablePollResponseEventContent PollResponseEventContent
+
+// MarshalJSON fills in missing stable or unstable answer fields from the other one,
+// so that neither of them is serialized as null.
+func (content *PollResponseEventContent) MarshalJSON() ([]byte, error) {
+	filled := *content
+	if filled.Selections == nil || filled.Response.Answers == nil {
+		selections := filled.GetSelections()
+		if selections == nil {
+			selections = []string{}
+		}
+		if filled.Selections == nil {
+			filled.Selections = selections
+		}
+		if filled.Response.Answers == nil {
+			filled.Response.Answers = selections
+		}
+	}
+	return json.Marshal((*marshalablePollResponseEventContent)(&filled))
+}
+
+// SetSelections sets both the stable and unstable answer fields.
+func (content *PollResponseEventContent) SetSelections(answers []string) {
+	if answers == nil {
+		answers = []string{}
+	}
+	content.Selections = answers
+	content.Response.Answers = answers
 }
 
 func (content *PollResponseEventContent) GetRelatesTo() *RelatesTo {
@@ -37,18 +120,122 @@ type MSC1767Message struct {
 	} `json:"org.matrix.msc1767.message,omitempty"`
 }
 
+type MSC3381PollAnswer struct {
+	ID string `json:"id"`
+	MSC1767Message
+}
+
+type PollKind string
+
+const (
+	PollKindDisclosed   PollKind = "m.disclosed"
+	PollKindUndisclosed PollKind = "m.undisclosed"
+
+	PollKindUnstableDisclosed   PollKind = "org.matrix.msc3381.poll.disclosed"
+	PollKindUnstableUndisclosed PollKind = "org.matrix.msc3381.poll.undisclosed"
+)
+
+// IsDisclosed returns true if votes should be visible to everyone before the poll ends.
+func (kind PollKind) IsDisclosed() bool {
+	return kind == PollKindDisclosed || kind == PollKindUnstableDisclosed
+}
+
+type PollQuestion struct {
+	Text ExtensibleTextContainer `json:"m.text"`
+}
+
+type PollAnswer struct {
+	ID   string                  `json:"m.id"`
+	Text ExtensibleTextContainer `json:"m.text"`
+}
+
+// PollInfo is the content of the m.poll key in a stable m.poll.start event.
+type PollInfo struct {
+	Kind          PollKind     `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Question      PollQuestion `json:"question"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
 type PollStartEventContent struct {
 	RelatesTo *RelatesTo `json:"m.relates_to"`
 	Mentions  *Mentions  `json:"m.mentions,omitempty"`
 	PollStart struct {
-		Kind          string         `json:"kind"`
-		MaxSelections int            `json:"max_selections"`
-		Question      MSC1767Message `json:"question"`
-		Answers       []struct {
-			ID string `json:"id"`
-			MSC1767Message
-		} `json:"answers"`
+		Kind          string              `json:"kind"`
+		MaxSelections int                 `json:"max_selections"`
+		Question      MSC1767Message      `json:"question"`
+		Answers       []MSC3381PollAnswer `json:"answers"`
 	} `json:"org.matrix.msc3381.poll.start"`
+
+	Poll *PollInfo `json:"m.poll,omitempty"`
+	// Text is the fallback representation of the poll for clients that don't support polls.
+	Text ExtensibleTextContainer `json:"m.text,omitempty"`
+}
+
+// Normalize fills the stable m.poll field from the unstable fields or vice versa,
+// so that the content can be read and sent using either format.
+func (content *PollStartEventContent) Normalize() {
+	if content.Poll != nil && len(content.PollStart.Answers) == 0 {
+		content.PollStart.Kind = string(content.Poll.Kind)
+		switch content.Poll.Kind {
+		case PollKindDisclosed:
+			content.PollStart.Kind = string(PollKindUnstableDisclosed)
+		case PollKindUndisclosed:
+			content.PollStart.Kind = string(PollKindUnstableUndisclosed)
+		}
+		content.PollStart.MaxSelections = content.Poll.MaxSelections
+		content.PollStart.Question = MSC1767Message{
+			Text: content.Poll.Question.Text.Text(),
+			HTML: content.Poll.Question.Text.HTML(),
+		}
+		content.PollStart.Answers = make([]MSC3381PollAnswer, len(content.Poll.Answers))
+		for i, answer := range content.Poll.Answers {
+			content.PollStart.Answers[i] = MSC3381PollAnswer{
+				ID: answer.ID,
+				MSC1767Message: MSC1767Message{
+					Text: answer.Text.Text(),
+					HTML: answer.Text.HTML(),
+				},
+			}
+		}
+	} else if content.Poll == nil && len(content.PollStart.Answers) > 0 {
+		content.Poll = &PollInfo{
+			Kind:          PollKind(content.PollStart.Kind),
+			MaxSelections: content.PollStart.MaxSelections,
+			Question: PollQuestion{
+				Text: MakeExtensibleText(content.PollStart.Question.Text, content.PollStart.Question.HTML),
+			},
+			Answers: make([]PollAnswer, len(content.PollStart.Answers)),
+		}
+		switch PollKind(content.PollStart.Kind) {
+		case PollKindUnstableDisclosed:
+			content.Poll.Kind = PollKindDisclosed
+		case PollKindUnstableUndisclosed:
+			content.Poll.Kind = PollKindUndisclosed
+		}
+		for i, answer := range content.PollStart.Answers {
+			content.Poll.Answers[i] = PollAnswer{
+				ID:   answer.ID,
+				Text: MakeExtensibleText(answer.Text, answer.HTML),
+			}
+		}
+	}
+	if len(content.Text) == 0 && content.Poll != nil {
+		content.Text = MakeExtensibleText(content.FallbackText(), "")
+	}
+}
+
+// FallbackText returns a plaintext representation of the poll question and answers.
+func (content *PollStartEventContent) FallbackText() string {
+	if content.Poll == nil {
+		return content.PollStart.Question.Text
+	}
+	var buf strings.Builder
+	buf.WriteString(content.Poll.Question.Text.Text())
+	for i, answer := range content.Poll.Answers {
+		_, _ = fmt.Fprintf(&buf, "\n%d. %s", i+1, answer.Text.Text())
+	}
+	return buf.String()
 }
 
 func (content *PollStartEventContent) GetRelatesTo() *RelatesTo {
@@ -65,3 +252,29 @@ func (content *PollStartEventContent) OptionalGetRelatesTo() *RelatesTo {
 func (content *PollStartEventContent) SetRelatesTo(rel *RelatesTo) {
 	content.RelatesTo = rel
 }
+
+// PollEndEventContent represents the content of a m.poll.end event, which closes a poll.
+type PollEndEventContent struct {
+	RelatesTo RelatesTo               `json:"m.relates_to"`
+	Text      ExtensibleTextContainer `json:"m.text,omitempty"`
+	// Results is an optional map from answer ID to the number of votes the answer received.
+	Results map[string]int `json:"m.poll.results,omitempty"`
+
+	UnstablePollEnd *struct{} `json:"org.matrix.msc3381.poll.end,omitempty"`
+	UnstableText    string    `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+func (content *PollEndEventContent) GetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *PollEndEventContent) OptionalGetRelatesTo() *RelatesTo {
+	if content.RelatesTo.Type == "" {
+		return nil
+	}
+	return &content.RelatesTo
+}
+
+func (content *PollEndEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = *rel
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const stablePollStart = `{
+	"type": "m.poll.start",
+	"event_id": "$poll",
+	"origin_server_ts": 1432735824653,
+	"room_id": "!jEsUZKDJdhlrceRyVU:example.org",
+	"sender": "@example:example.org",
+	"content": {
+		"m.poll": {
+			"kind": "m.disclosed",
+			"max_selections": 1,
+			"question": {"m.text": [{"body": "Best color?"}]},
+			"answers": [
+				{"m.id": "red", "m.text": [{"body": "Red"}]},
+				{"m.id": "blue", "m.text": [{"body": "<b>Blue</b>", "mimetype": "text/html"}, {"body": "Blue"}]}
+			]
+		},
+		"m.text": [{"body": "Best color?\n1. Red\n2. Blue"}]
+	}
+}`
+
+const unstablePollResponse = `{
+	"type": "org.matrix.msc3381.poll.response",
+	"event_id": "$vote",
+	"origin_server_ts": 1432735824653,
+	"room_id": "!jEsUZKDJdhlrceRyVU:example.org",
+	"sender": "@example:example.org",
+	"content": {
+		"m.relates_to": {"rel_type": "m.reference", "event_id": "$poll"},
+		"org.matrix.msc3381.poll.response": {"answers": ["blue"]}
+	}
+}`
+
+func TestPollStartEventContent_Normalize(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(stablePollStart), &evt)
+	require.NoError(t, err)
+	require.Equal(t, event.EventPollStart, evt.Type)
+	err = evt.Content.ParseRaw(evt.Type)
+	require.NoError(t, err)
+	content := evt.Content.AsPollStart()
+	content.Normalize()
+	assert.Equal(t, string(event.PollKindUnstableDisclosed), content.PollStart.Kind)
+	assert.Equal(t, "Best color?", content.PollStart.Question.Text)
+	require.Len(t, content.PollStart.Answers, 2)
+	assert.Equal(t, "blue", content.PollStart.Answers[1].ID)
+	assert.Equal(t, "Blue", content.PollStart.Answers[1].Text)
+	assert.Equal(t, "<b>Blue</b>", content.PollStart.Answers[1].HTML)
+}
+
+func TestPollResponseEventContent_GetSelections(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(unstablePollResponse), &evt)
+	require.NoError(t, err)
+	err = evt.Content.ParseRaw(evt.Type)
+	require.NoError(t, err)
+	content := evt.Content.AsPollResponse()
+	assert.Equal(t, []string{"blue"}, content.GetSelections())
+	assert.Equal(t, event.RelReference, content.RelatesTo.Type)
+}
+
+const stablePollRetraction = `{
+	"type": "m.poll.response",
+	"event_id": "$retract",
+	"origin_server_ts": 1432735824653,
+	"room_id": "!jEsUZKDJdhlrceRyVU:example.org",
+	"sender": "@example:example.org",
+	"content": {
+		"m.relates_to": {"rel_type": "m.reference", "event_id": "$poll"},
+		"m.selections": []
+	}
+}`
+
+func TestPollResponseEventContent_Retraction(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(stablePollRetraction), &evt)
+	require.NoError(t, err)
+	require.Equal(t, event.EventPollResponse, evt.Type)
+	err = evt.Content.ParseRaw(evt.Type)
+	require.NoError(t, err)
+	content := evt.Content.AsPollResponse()
+	selections := content.GetSelections()
+	assert.NotNil(t, selections)
+	assert.Empty(t, selections)
+
+	content.SetSelections(nil)
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	var raw map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.JSONEq(t, `[]`, string(raw["m.selections"]))
+	assert.JSONEq(t, `{"answers": []}`, string(raw["org.matrix.msc3381.poll.response"]))
+
+	var roundtrip event.PollResponseEventContent
+	require.NoError(t, json.Unmarshal(data, &roundtrip))
+	assert.NotNil(t, roundtrip.GetSelections())
+	assert.Empty(t, roundtrip.GetSelections())
+}
+
+func TestPollResponseEventContent_UnstableRoundtrip(t *testing.T) {
+	var content event.PollResponseEventContent
+	content.Response.Answers = []string{"red"}
+	data, err := json.Marshal(&content)
+	require.NoError(t, err)
+	var roundtrip event.PollResponseEventContent
+	require.NoError(t, json.Unmarshal(data, &roundtrip))
+	assert.Equal(t, []string{"red"}, roundtrip.GetSelections())
+}
+
+func TestPollResponseEventContent_MarshalJSON(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(unstablePollResponse), &evt)
+	require.NoError(t, err)
+	err = evt.Content.ParseRaw(evt.Type)
+	require.NoError(t, err)
+	data, err := json.Marshal(evt.Content.AsPollResponse())
+	require.NoError(t, err)
+	var raw map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.JSONEq(t, `["blue"]`, string(raw["m.selections"]))
+	assert.JSONEq(t, `{"answers": ["blue"]}`, string(raw["org.matrix.msc3381.poll.response"]))
+
+	data, err = json.Marshal(&event.PollResponseEventContent{})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.JSONEq(t, `[]`, string(raw["m.selections"]))
+	assert.JSONEq(t, `{"answers": []}`, string(raw["org.matrix.msc3381.poll.response"]))
+}
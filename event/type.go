@@ -112,7 +112,8 @@ func (et *Type) GuessClass() TypeClass {
 		StatePowerLevels.Type, StateRoomName.Type, StateRoomAvatar.Type, StateServerACL.Type, StateTopic.Type,
 		StatePinnedEvents.Type, StateTombstone.Type, StateEncryption.Type, StateBridge.Type, StateHalfShotBridge.Type,
 		StateSpaceParent.Type, StateSpaceChild.Type, StatePolicyRoom.Type, StatePolicyServer.Type, StatePolicyUser.Type,
-		StateInsertionMarker.Type, StateElementFunctionalMembers.Type:
+		StateInsertionMarker.Type, StateElementFunctionalMembers.Type, StateUnstableImagePack.Type,
+		StateUnstableGroupCall.Type:
 		return StateEventType
 	case EphemeralEventReceipt.Type, EphemeralEventTyping.Type, EphemeralEventPresence.Type:
 		return EphemeralEventType
@@ -120,13 +121,15 @@ func (et *Type) GuessClass() TypeClass {
 		AccountDataFullyRead.Type, AccountDataIgnoredUserList.Type, AccountDataMarkedUnread.Type,
 		AccountDataSecretStorageKey.Type, AccountDataSecretStorageDefaultKey.Type,
 		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type,
-		AccountDataFullyRead.Type, AccountDataMegolmBackupKey.Type:
+		AccountDataFullyRead.Type, AccountDataMegolmBackupKey.Type, AccountDataUnstableImagePack.Type,
+		AccountDataUnstableImagePackRooms.Type:
 		return AccountDataEventType
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
 		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
 		CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
-		CallNegotiate.Type, CallHangup.Type, BeeperMessageStatus.Type, EventUnstablePollStart.Type, EventUnstablePollResponse.Type:
+		CallNegotiate.Type, CallHangup.Type, BeeperMessageStatus.Type, EventUnstablePollStart.Type, EventUnstablePollResponse.Type,
+		EventUnstablePollEnd.Type, EventPollStart.Type, EventPollResponse.Type, EventPollEnd.Type:
 		return MessageEventType
 	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type,
 		ToDeviceBeeperRoomKeyAck.Type:
@@ -203,6 +206,9 @@ var (
 	StateInsertionMarker = Type{"org.matrix.msc2716.marker", StateEventType}
 
 	StateElementFunctionalMembers = Type{"io.element.functional_members", StateEventType}
+
+	StateUnstableImagePack = Type{"im.ponies.room_emotes", StateEventType}
+	StateUnstableGroupCall = Type{"org.matrix.msc3401.call", StateEventType}
 )
 
 // Message events
@@ -235,6 +241,11 @@ var (
 
 	EventUnstablePollStart    = Type{Type: "org.matrix.msc3381.poll.start", Class: MessageEventType}
 	EventUnstablePollResponse = Type{Type: "org.matrix.msc3381.poll.response", Class: MessageEventType}
+	EventUnstablePollEnd      = Type{Type: "org.matrix.msc3381.poll.end", Class: MessageEventType}
+
+	EventPollStart    = Type{Type: "m.poll.start", Class: MessageEventType}
+	EventPollResponse = Type{Type: "m.poll.response", Class: MessageEventType}
+	EventPollEnd      = Type{Type: "m.poll.end", Class: MessageEventType}
 )
 
 // Ephemeral events
@@ -254,6 +265,9 @@ var (
 	AccountDataMarkedUnread    = Type{"m.marked_unread", AccountDataEventType}
 	AccountDataBeeperMute      = Type{"com.beeper.mute", AccountDataEventType}
 
+	AccountDataUnstableImagePack      = Type{"im.ponies.user_emotes", AccountDataEventType}
+	AccountDataUnstableImagePackRooms = Type{"im.ponies.emote_rooms", AccountDataEventType}
+
 	AccountDataSecretStorageDefaultKey = Type{"m.secret_storage.default_key", AccountDataEventType}
 	AccountDataSecretStorageKey        = Type{"m.secret_storage.key", AccountDataEventType}
 	AccountDataCrossSigningMaster      = Type{string(id.SecretXSMaster), AccountDataEventType}
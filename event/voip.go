@@ -114,3 +114,38 @@ type CallHangupEventContent struct {
 	BaseCallEventContent
 	Reason CallHangupReason `json:"reason"`
 }
+
+// CallEventContent is implemented by the contents of all m.call.* events.
+type CallEventContent interface {
+	GetCallBase() *BaseCallEventContent
+}
+
+func (content *BaseCallEventContent) GetCallBase() *BaseCallEventContent {
+	return content
+}
+
+type GroupCallIntent string
+
+const (
+	GroupCallIntentRing   GroupCallIntent = "m.ring"
+	GroupCallIntentPrompt GroupCallIntent = "m.prompt"
+	GroupCallIntentRoom   GroupCallIntent = "m.room"
+)
+
+type GroupCallType string
+
+const (
+	GroupCallTypeVoice GroupCallType = "m.voice"
+	GroupCallTypeVideo GroupCallType = "m.video"
+)
+
+// GroupCallEventContent represents the content of an org.matrix.msc3401.call state event.
+// The state key is the ID of the call.
+//
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3401
+type GroupCallEventContent struct {
+	Intent     GroupCallIntent `json:"m.intent"`
+	Type       GroupCallType   `json:"m.type"`
+	Name       string          `json:"m.name,omitempty"`
+	Terminated string          `json:"m.terminated,omitempty"`
+}
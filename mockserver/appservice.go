@@ -0,0 +1,255 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TransactionRetryInterval is how long the background sender waits before retrying a failed transaction.
+var TransactionRetryInterval = 100 * time.Millisecond
+
+type appserviceState struct {
+	ms           *MockServer
+	Registration *appservice.Registration
+
+	userRegexes []*regexp.Regexp
+	roomRegexes []*regexp.Regexp
+
+	// cursor is the index of the next event in ms.eventLog that hasn't been sent to the appservice.
+	cursor   int
+	toDevice []*event.Event
+	txnID    int
+
+	sendLock sync.Mutex
+	wakeCh   chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// RegisterAppService adds an appservice to the server. Events that the appservice is interested in are pushed to
+// the registration URL in the background. [MockServer.FlushTransactions] can be used to wait for them to be sent.
+func (ms *MockServer) RegisterAppService(t testing.TB, reg *appservice.Registration) {
+	t.Helper()
+	as := &appserviceState{
+		ms:           ms,
+		Registration: reg,
+		wakeCh:       make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	var err error
+	as.userRegexes, err = reg.Namespaces.UserIDs.Compile()
+	require.NoError(t, err)
+	as.roomRegexes, err = reg.Namespaces.RoomIDs.Compile()
+	require.NoError(t, err)
+	ms.lock.Lock()
+	as.cursor = len(ms.eventLog)
+	ms.appservices = append(ms.appservices, as)
+	ms.ensureUser(as.botUserID(ms.ServerName)).AppService = as
+	ms.lock.Unlock()
+	go as.loop()
+}
+
+// FlushTransactions sends all pending events to all registered appservices and waits for them to be accepted.
+func (ms *MockServer) FlushTransactions(ctx context.Context) error {
+	ms.lock.Lock()
+	appservices := ms.appservices
+	ms.lock.Unlock()
+	var errs []error
+	for _, as := range appservices {
+		if err := as.flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send transaction to %s: %w", as.Registration.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (as *appserviceState) botUserID(serverName string) id.UserID {
+	return id.NewUserID(as.Registration.SenderLocalpart, serverName)
+}
+
+func (as *appserviceState) isInterestedInUser(userID id.UserID) bool {
+	for _, re := range as.userRegexes {
+		if re.MatchString(string(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInterestedInEvent checks if the event should be sent to the appservice. The caller must hold the lock.
+func (as *appserviceState) isInterestedInEvent(evt *event.Event) bool {
+	botUserID := as.botUserID(as.ms.ServerName)
+	if evt.Sender == botUserID || as.isInterestedInUser(evt.Sender) {
+		return true
+	} else if evt.StateKey != nil && (id.UserID(*evt.StateKey) == botUserID || as.isInterestedInUser(id.UserID(*evt.StateKey))) {
+		return true
+	}
+	for _, re := range as.roomRegexes {
+		if re.MatchString(string(evt.RoomID)) {
+			return true
+		}
+	}
+	if rm, ok := as.ms.rooms[evt.RoomID]; ok {
+		for userID, membership := range rm.members() {
+			if membership == event.MembershipJoin && (userID == botUserID || as.isInterestedInUser(userID)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (as *appserviceState) wake() {
+	select {
+	case as.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (as *appserviceState) stop() {
+	as.stopOnce.Do(func() {
+		close(as.stopCh)
+	})
+	<-as.done
+}
+
+func (as *appserviceState) loop() {
+	defer close(as.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-as.stopCh
+		cancel()
+	}()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-as.wakeCh:
+		case <-retry:
+		case <-as.stopCh:
+			return
+		}
+		retry = nil
+		if as.flush(ctx) != nil {
+			retry = time.After(TransactionRetryInterval)
+		}
+	}
+}
+
+// flush sends everything that hasn't been sent yet to the appservice in a single transaction.
+func (as *appserviceState) flush(ctx context.Context) error {
+	as.sendLock.Lock()
+	defer as.sendLock.Unlock()
+
+	as.ms.lock.Lock()
+	txn := &appservice.Transaction{Events: []*event.Event{}}
+	for _, evt := range as.ms.eventLog[as.cursor:] {
+		if as.isInterestedInEvent(evt.Event) {
+			txn.Events = append(txn.Events, evt.copy())
+		}
+	}
+	newCursor := len(as.ms.eventLog)
+	toDeviceCount := len(as.toDevice)
+	if toDeviceCount > 0 {
+		txn.ToDeviceEvents = append([]*event.Event{}, as.toDevice...)
+	}
+	as.ms.lock.Unlock()
+
+	if len(txn.Events) == 0 && len(txn.ToDeviceEvents) == 0 {
+		as.ms.lock.Lock()
+		as.cursor = newCursor
+		as.ms.lock.Unlock()
+		return nil
+	}
+	as.txnID++
+	err := as.sendTransaction(ctx, fmt.Sprintf("mock_txn_%d", as.txnID), txn)
+	if err != nil {
+		return err
+	}
+	as.ms.lock.Lock()
+	as.cursor = newCursor
+	as.toDevice = as.toDevice[toDeviceCount:]
+	as.ms.lock.Unlock()
+	return nil
+}
+
+func (as *appserviceState) request(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(as.Registration.URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+as.Registration.ServerToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		respData, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, respData)
+	}
+	return resp, nil
+}
+
+func (as *appserviceState) sendTransaction(ctx context.Context, txnID string, txn *appservice.Transaction) error {
+	resp, err := as.request(ctx, http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, txn)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (ms *MockServer) postAppservicePing(w http.ResponseWriter, r *http.Request, sess *session) {
+	if sess.AppService == nil || sess.AppService.Registration.ID != mux.Vars(r)["appserviceID"] {
+		mautrix.MForbidden.WithMessage("Appservice token doesn't match appservice ID").Write(w)
+		return
+	}
+	var req mautrix.ReqAppservicePing
+	if !readJSON(w, r, &req) {
+		return
+	}
+	start := time.Now()
+	resp, err := sess.AppService.request(r.Context(), http.MethodPost, "/_matrix/app/v1/ping", &req)
+	if err != nil {
+		mautrix.RespError{
+			ErrCode:    "M_CONNECTION_FAILED",
+			Err:        err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}.Write(w)
+		return
+	}
+	_ = resp.Body.Close()
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespAppservicePing{DurationMS: time.Since(start).Milliseconds()})
+}
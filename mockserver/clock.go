@@ -0,0 +1,63 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultStartTime is the initial time of the [Clock] of new mock servers.
+var DefaultStartTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is a manually controlled clock. It's used for event timestamps and sync timeouts,
+// so time only moves forward when the test calls [Clock.Advance] or [Clock.Set].
+type Clock struct {
+	lock    sync.Mutex
+	now     time.Time
+	changed chan struct{}
+}
+
+// NewClock creates a new clock that starts at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.notify()
+	c.lock.Unlock()
+}
+
+// Set changes the current time of the clock.
+func (c *Clock) Set(t time.Time) {
+	c.lock.Lock()
+	c.now = t
+	c.notify()
+	c.lock.Unlock()
+}
+
+func (c *Clock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// nowAndChanged returns the current time and a channel that is closed the next time the clock changes.
+func (c *Clock) nowAndChanged() (time.Time, <-chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now, c.changed
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (dev *device) otkCount() mautrix.OTKCount {
+	var count mautrix.OTKCount
+	for keyID := range dev.OneTimeKeys {
+		switch algorithm, _ := keyID.Parse(); algorithm {
+		case id.KeyAlgorithmSignedCurve25519:
+			count.SignedCurve25519++
+		case id.KeyAlgorithmCurve25519:
+			count.Curve25519++
+		}
+	}
+	return count
+}
+
+func (ms *MockServer) putSendToDevice(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqSendToDevice
+	if !readJSON(w, r, &req) {
+		return
+	}
+	evtType := event.Type{Type: mux.Vars(r)["type"], Class: event.ToDeviceEventType}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for userID, devices := range req.Messages {
+		target, ok := ms.users[userID]
+		if !ok {
+			continue
+		}
+		for deviceID, content := range devices {
+			var targetDevices []*device
+			if deviceID == "*" {
+				for _, dev := range target.devices {
+					targetDevices = append(targetDevices, dev)
+				}
+			} else if dev, ok := target.devices[deviceID]; ok {
+				targetDevices = append(targetDevices, dev)
+			}
+			raw, err := json.Marshal(content)
+			if err != nil {
+				continue
+			}
+			for _, dev := range targetDevices {
+				evt := &storedEvent{Event: &event.Event{
+					Sender:  sess.UserID,
+					Type:    evtType,
+					Content: event.Content{VeryRaw: raw},
+				}}
+				if target.AppService != nil && target.AppService.Registration.EphemeralEvents {
+					evt.ToUserID = userID
+					evt.ToDeviceID = dev.ID
+					target.AppService.toDevice = append(target.AppService.toDevice, evt.Event)
+					target.AppService.wake()
+				} else {
+					evt.Pos = ms.bumpStream()
+					dev.Inbox = append(dev.Inbox, evt)
+				}
+			}
+		}
+	}
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) getAccountData(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	if id.UserID(vars["userID"]) != sess.UserID {
+		mautrix.MForbidden.WithMessage("Can't access other users' account data").Write(w)
+		return
+	}
+	ms.lock.Lock()
+	item, ok := ms.ensureUser(sess.UserID).accountData[vars["type"]]
+	ms.lock.Unlock()
+	if !ok {
+		mautrix.MNotFound.WithMessage("Account data not found").Write(w)
+		return
+	}
+	exhttp.WriteJSONData(w, http.StatusOK, item.Content)
+}
+
+func (ms *MockServer) putAccountData(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	if id.UserID(vars["userID"]) != sess.UserID {
+		mautrix.MForbidden.WithMessage("Can't change other users' account data").Write(w)
+		return
+	}
+	var content json.RawMessage
+	if !readJSON(w, r, &content) {
+		return
+	}
+	ms.lock.Lock()
+	ms.ensureUser(sess.UserID).accountData[vars["type"]] = &accountDataItem{Content: content, Pos: ms.bumpStream()}
+	ms.lock.Unlock()
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) postKeysUpload(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqUploadKeys
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	usr := ms.ensureUser(sess.UserID)
+	dev, ok := usr.devices[sess.DeviceID]
+	if !ok {
+		mautrix.MUnknown.WithMessage("Session doesn't have a device").WithStatus(http.StatusBadRequest).Write(w)
+		return
+	}
+	if req.DeviceKeys != nil {
+		dev.Keys = req.DeviceKeys
+		usr.keysChangedAt = ms.bumpStream()
+	}
+	if dev.OneTimeKeys == nil {
+		dev.OneTimeKeys = make(map[id.KeyID]mautrix.OneTimeKey)
+	}
+	for keyID, key := range req.OneTimeKeys {
+		dev.OneTimeKeys[keyID] = key
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespUploadKeys{OneTimeKeyCounts: dev.otkCount()})
+}
+
+func (ms *MockServer) postKeysQuery(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqQueryKeys
+	if !readJSON(w, r, &req) {
+		return
+	}
+	resp := &mautrix.RespQueryKeys{
+		DeviceKeys:      make(map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys),
+		MasterKeys:      make(map[id.UserID]mautrix.CrossSigningKeys),
+		SelfSigningKeys: make(map[id.UserID]mautrix.CrossSigningKeys),
+		UserSigningKeys: make(map[id.UserID]mautrix.CrossSigningKeys),
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for userID, deviceIDs := range req.DeviceKeys {
+		usr, ok := ms.users[userID]
+		if !ok {
+			continue
+		}
+		devices := make(map[id.DeviceID]mautrix.DeviceKeys)
+		for _, dev := range usr.devices {
+			if dev.Keys != nil && (len(deviceIDs) == 0 || containsDevice(deviceIDs, dev.ID)) {
+				devices[dev.ID] = *dev.Keys
+			}
+		}
+		resp.DeviceKeys[userID] = devices
+		if usr.masterKey != nil {
+			resp.MasterKeys[userID] = *usr.masterKey
+		}
+		if usr.selfSigningKey != nil {
+			resp.SelfSigningKeys[userID] = *usr.selfSigningKey
+		}
+		// User-signing keys are only visible to the user themselves
+		if usr.userSigningKey != nil && userID == sess.UserID {
+			resp.UserSigningKeys[userID] = *usr.userSigningKey
+		}
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func containsDevice(list mautrix.DeviceIDList, deviceID id.DeviceID) bool {
+	for _, item := range list {
+		if item == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *MockServer) postKeysClaim(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqClaimKeys
+	if !readJSON(w, r, &req) {
+		return
+	}
+	resp := &mautrix.RespClaimKeys{
+		OneTimeKeys: make(map[id.UserID]map[id.DeviceID]map[id.KeyID]mautrix.OneTimeKey),
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for userID, devices := range req.OneTimeKeys {
+		usr, ok := ms.users[userID]
+		if !ok {
+			continue
+		}
+		resp.OneTimeKeys[userID] = make(map[id.DeviceID]map[id.KeyID]mautrix.OneTimeKey)
+		for deviceID, algorithm := range devices {
+			dev, ok := usr.devices[deviceID]
+			if !ok {
+				continue
+			}
+			// Claim the keys in a deterministic order
+			keyIDs := make([]id.KeyID, 0, len(dev.OneTimeKeys))
+			for keyID := range dev.OneTimeKeys {
+				if keyAlgorithm, _ := keyID.Parse(); keyAlgorithm == algorithm {
+					keyIDs = append(keyIDs, keyID)
+				}
+			}
+			if len(keyIDs) == 0 {
+				continue
+			}
+			sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+			key := dev.OneTimeKeys[keyIDs[0]]
+			delete(dev.OneTimeKeys, keyIDs[0])
+			resp.OneTimeKeys[userID][deviceID] = map[id.KeyID]mautrix.OneTimeKey{keyIDs[0]: key}
+		}
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) postDeviceSigningUpload(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.UploadCrossSigningKeysReq
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	usr := ms.ensureUser(sess.UserID)
+	usr.masterKey = &req.Master
+	usr.selfSigningKey = &req.SelfSigning
+	usr.userSigningKey = &req.UserSigning
+	usr.keysChangedAt = ms.bumpStream()
+	ms.lock.Unlock()
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) postSignaturesUpload(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqUploadSignatures
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for userID, keys := range req {
+		usr, ok := ms.users[userID]
+		if !ok {
+			continue
+		}
+		for keyID, signed := range keys {
+			if dev, ok := usr.devices[id.DeviceID(keyID)]; ok && dev.Keys != nil {
+				dev.Keys.Signatures = mergeSignatures(dev.Keys.Signatures, signed.Signatures)
+			} else if usr.masterKey != nil && string(usr.masterKey.FirstKey()) == keyID {
+				usr.masterKey.Signatures = mergeSignatures(usr.masterKey.Signatures, signed.Signatures)
+			}
+		}
+		usr.keysChangedAt = ms.bumpStream()
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespUploadSignatures{})
+}
+
+func mergeSignatures(into, from signatures.Signatures) signatures.Signatures {
+	if into == nil {
+		into = make(signatures.Signatures)
+	}
+	for userID, sigs := range from {
+		if into[userID] == nil {
+			into[userID] = make(map[id.KeyID]string)
+		}
+		for keyID, sig := range sigs {
+			into[userID][keyID] = sig
+		}
+	}
+	return into
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/util/exhttp"
+	"go.mau.fi/util/jsontime"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxUploadSize is the maximum size of media uploads accepted by the mock server.
+const MaxUploadSize = 50 * 1024 * 1024
+
+type mediaItem struct {
+	Data        []byte
+	ContentType string
+	FileName    string
+	Uploaded    bool
+}
+
+func (ms *MockServer) registerMediaRoutes() {
+	media := ms.Router.PathPrefix("/_matrix/media").Subrouter()
+	media.HandleFunc("/v3/upload", ms.authed(ms.postUpload)).Methods(http.MethodPost)
+	media.HandleFunc("/v1/create", ms.authed(ms.postCreateMXC)).Methods(http.MethodPost)
+	media.HandleFunc("/v3/upload/{serverName}/{mediaID}", ms.authed(ms.putUpload)).Methods(http.MethodPut)
+	media.HandleFunc("/v3/config", ms.getMediaConfig).Methods(http.MethodGet)
+	media.HandleFunc("/v3/download/{serverName}/{mediaID}", ms.getDownload).Methods(http.MethodGet)
+	media.HandleFunc("/v3/download/{serverName}/{mediaID}/{fileName}", ms.getDownload).Methods(http.MethodGet)
+
+	cli := ms.Router.PathPrefix("/_matrix/client/v1/media").Subrouter()
+	cli.HandleFunc("/config", ms.authed(ms.getMediaConfigAuthed)).Methods(http.MethodGet)
+	cli.HandleFunc("/download/{serverName}/{mediaID}", ms.authed(ms.getDownloadAuthed)).Methods(http.MethodGet)
+	cli.HandleFunc("/download/{serverName}/{mediaID}/{fileName}", ms.authed(ms.getDownloadAuthed)).Methods(http.MethodGet)
+}
+
+// AddMedia stores the given data in the media repo and returns the content URI.
+func (ms *MockServer) AddMedia(data []byte, contentType, fileName string) id.ContentURI {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mediaID := ms.nextID("mock")
+	ms.media[mediaID] = &mediaItem{Data: data, ContentType: contentType, FileName: fileName, Uploaded: true}
+	return id.ContentURI{Homeserver: ms.ServerName, FileID: mediaID}
+}
+
+func readUpload(w http.ResponseWriter, r *http.Request) *mediaItem {
+	data, err := io.ReadAll(io.LimitReader(r.Body, MaxUploadSize+1))
+	if err != nil {
+		mautrix.MUnknown.WithMessage("Failed to read request body: %v", err).WithStatus(http.StatusBadRequest).Write(w)
+		return nil
+	} else if len(data) > MaxUploadSize {
+		mautrix.MTooLarge.WithMessage("File is too large").Write(w)
+		return nil
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &mediaItem{Data: data, ContentType: contentType, FileName: r.URL.Query().Get("filename"), Uploaded: true}
+}
+
+func (ms *MockServer) postUpload(w http.ResponseWriter, r *http.Request, sess *session) {
+	item := readUpload(w, r)
+	if item == nil {
+		return
+	}
+	ms.lock.Lock()
+	mediaID := ms.nextID("mock")
+	ms.media[mediaID] = item
+	ms.lock.Unlock()
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespMediaUpload{
+		ContentURI: id.ContentURI{Homeserver: ms.ServerName, FileID: mediaID},
+	})
+}
+
+func (ms *MockServer) postCreateMXC(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	mediaID := ms.nextID("mock")
+	ms.media[mediaID] = &mediaItem{}
+	ms.lock.Unlock()
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespCreateMXC{
+		ContentURI:      id.ContentURI{Homeserver: ms.ServerName, FileID: mediaID},
+		UnusedExpiresAt: jsontime.UM(ms.Clock.Now().Add(24 * time.Hour)),
+	})
+}
+
+func (ms *MockServer) putUpload(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	if vars["serverName"] != ms.ServerName {
+		mautrix.MNotFound.WithMessage("Unknown server name").Write(w)
+		return
+	}
+	ms.lock.Lock()
+	existing, ok := ms.media[vars["mediaID"]]
+	ms.lock.Unlock()
+	if !ok {
+		mautrix.MNotFound.WithMessage("Media ID not found").Write(w)
+		return
+	} else if existing.Uploaded {
+		mautrix.RespError{
+			ErrCode:    "M_CANNOT_OVERWRITE_MEDIA",
+			Err:        "Media already uploaded",
+			StatusCode: http.StatusConflict,
+		}.Write(w)
+		return
+	}
+	item := readUpload(w, r)
+	if item == nil {
+		return
+	}
+	ms.lock.Lock()
+	ms.media[vars["mediaID"]] = item
+	ms.lock.Unlock()
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) getMediaConfig(w http.ResponseWriter, r *http.Request) {
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespMediaConfig{UploadSize: MaxUploadSize})
+}
+
+func (ms *MockServer) getMediaConfigAuthed(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.getMediaConfig(w, r)
+}
+
+func (ms *MockServer) getDownloadAuthed(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.getDownload(w, r)
+}
+
+func (ms *MockServer) getDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if vars["serverName"] != ms.ServerName {
+		mautrix.MNotFound.WithMessage("Unknown server name").Write(w)
+		return
+	}
+	ms.lock.Lock()
+	item, ok := ms.media[vars["mediaID"]]
+	ms.lock.Unlock()
+	if !ok || !item.Uploaded {
+		mautrix.MNotFound.WithMessage("Media not found").Write(w)
+		return
+	}
+	fileName := vars["fileName"]
+	if fileName == "" {
+		fileName = item.FileName
+	}
+	w.Header().Set("Content-Type", item.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
+	if fileName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(item.Data)
+}
@@ -0,0 +1,527 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package mockserver contains an in-process fake Matrix homeserver for integration tests.
+//
+// The [MockServer] implements a subset of the client-server API that is enough for most bots, bridges and
+// crypto code: registration and login, rooms and state, sync, to-device messages, end-to-bridge encryption keys,
+// media and pushing transactions to appservices. Everything is stored in memory and authorization rules are
+// only checked loosely (power levels aren't enforced at all). Event timestamps and sync timeouts use a manually
+// controlled [Clock] to make tests deterministic.
+package mockserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultPassword is the password of users created with [MockServer.CreateUser].
+const DefaultPassword = "password"
+
+// MockServer is a fake Matrix homeserver running in an [httptest.Server].
+type MockServer struct {
+	*httptest.Server
+
+	ServerName string
+	Clock      *Clock
+	Router     *mux.Router
+
+	lock    sync.Mutex
+	counter int64
+	// streamPos is incremented whenever something that can be returned from /sync changes.
+	streamPos int64
+	// streamChanged is closed and replaced whenever streamPos is incremented.
+	streamChanged chan struct{}
+
+	eventLog    []*storedEvent
+	users       map[id.UserID]*user
+	sessions    map[string]*session
+	rooms       map[id.RoomID]*room
+	aliases     map[id.RoomAlias]id.RoomID
+	txnIDs      map[string]id.EventID
+	media       map[string]*mediaItem
+	appservices []*appserviceState
+}
+
+type user struct {
+	ID          id.UserID
+	Password    string
+	DisplayName string
+	AvatarURL   id.ContentURI
+	AppService  *appserviceState
+
+	devices     map[id.DeviceID]*device
+	accountData map[string]*accountDataItem
+
+	masterKey      *mautrix.CrossSigningKeys
+	selfSigningKey *mautrix.CrossSigningKeys
+	userSigningKey *mautrix.CrossSigningKeys
+	keysChangedAt  int64
+}
+
+type device struct {
+	ID          id.DeviceID
+	DisplayName string
+	Keys        *mautrix.DeviceKeys
+	OneTimeKeys map[id.KeyID]mautrix.OneTimeKey
+	Inbox       []*storedEvent
+}
+
+type accountDataItem struct {
+	Content json.RawMessage
+	Pos     int64
+}
+
+type session struct {
+	UserID     id.UserID
+	DeviceID   id.DeviceID
+	AppService *appserviceState
+}
+
+// New creates and starts a new mock homeserver with the given server name. The server is closed when the test finishes.
+func New(t testing.TB, serverName string) *MockServer {
+	ms := &MockServer{
+		ServerName:    serverName,
+		Clock:         NewClock(DefaultStartTime),
+		streamChanged: make(chan struct{}),
+		users:         make(map[id.UserID]*user),
+		sessions:      make(map[string]*session),
+		rooms:         make(map[id.RoomID]*room),
+		aliases:       make(map[id.RoomAlias]id.RoomID),
+		txnIDs:        make(map[string]id.EventID),
+		media:         make(map[string]*mediaItem),
+	}
+	ms.Router = mux.NewRouter().SkipClean(true).StrictSlash(false).UseEncodedPath()
+	ms.Router.Use(decodeVarsMiddleware)
+	ms.Router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mautrix.MUnrecognized.WithMessage("Unrecognized request").Write(w)
+	})
+	ms.Router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mautrix.MUnrecognized.WithMessage("Method not allowed").WithStatus(http.StatusMethodNotAllowed).Write(w)
+	})
+	ms.registerClientRoutes()
+	ms.registerMediaRoutes()
+	ms.Server = httptest.NewServer(ms.Router)
+	t.Cleanup(ms.Close)
+	return ms
+}
+
+// Close stops all appservice transaction senders and shuts down the server.
+func (ms *MockServer) Close() {
+	ms.lock.Lock()
+	appservices := ms.appservices
+	ms.appservices = nil
+	ms.lock.Unlock()
+	for _, as := range appservices {
+		as.stop()
+	}
+	ms.Server.Close()
+}
+
+func decodeVarsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for k, v := range vars {
+			decoded, err := url.PathUnescape(v)
+			if err != nil {
+				mautrix.MInvalidParam.WithMessage("Invalid path parameter %s", k).Write(w)
+				return
+			}
+			vars[k] = decoded
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ms *MockServer) registerClientRoutes() {
+	cli := ms.Router.PathPrefix("/_matrix/client").Subrouter()
+	cli.HandleFunc("/versions", ms.getVersions).Methods(http.MethodGet)
+	v3 := cli.PathPrefix("/{version:(?:r0|v3)}").Subrouter()
+	v3.HandleFunc("/register", ms.postRegister).Methods(http.MethodPost)
+	v3.HandleFunc("/login", ms.postLogin).Methods(http.MethodPost)
+	v3.HandleFunc("/logout", ms.authed(ms.postLogout)).Methods(http.MethodPost)
+	v3.HandleFunc("/account/whoami", ms.authed(ms.getWhoami)).Methods(http.MethodGet)
+	v3.HandleFunc("/sync", ms.authed(ms.getSync)).Methods(http.MethodGet)
+	v3.HandleFunc("/user/{userID}/filter", ms.authed(ms.postFilter)).Methods(http.MethodPost)
+	v3.HandleFunc("/profile/{userID}", ms.getProfile).Methods(http.MethodGet)
+	v3.HandleFunc("/profile/{userID}/{field:displayname|avatar_url}", ms.getProfile).Methods(http.MethodGet)
+	v3.HandleFunc("/profile/{userID}/{field:displayname|avatar_url}", ms.authed(ms.putProfile)).Methods(http.MethodPut)
+	v3.HandleFunc("/presence/{userID}/status", ms.authed(ms.emptyResponse)).Methods(http.MethodPut)
+
+	v3.HandleFunc("/createRoom", ms.authed(ms.postCreateRoom)).Methods(http.MethodPost)
+	v3.HandleFunc("/joined_rooms", ms.authed(ms.getJoinedRooms)).Methods(http.MethodGet)
+	v3.HandleFunc("/join/{roomIDOrAlias}", ms.authed(ms.postJoin)).Methods(http.MethodPost)
+	v3.HandleFunc("/directory/room/{alias}", ms.getAlias).Methods(http.MethodGet)
+	v3.HandleFunc("/directory/room/{alias}", ms.authed(ms.putAlias)).Methods(http.MethodPut)
+	v3.HandleFunc("/directory/room/{alias}", ms.authed(ms.deleteAlias)).Methods(http.MethodDelete)
+	room := v3.PathPrefix("/rooms/{roomID}").Subrouter()
+	room.HandleFunc("/join", ms.authed(ms.postJoin)).Methods(http.MethodPost)
+	room.HandleFunc("/{action:leave|invite|kick|ban|unban}", ms.authed(ms.postMembership)).Methods(http.MethodPost)
+	room.HandleFunc("/send/{type}/{txnID}", ms.authed(ms.putSend)).Methods(http.MethodPut)
+	room.HandleFunc("/state/{type}", ms.authed(ms.putState)).Methods(http.MethodPut)
+	room.HandleFunc("/state/{type}/{stateKey:.*}", ms.authed(ms.putState)).Methods(http.MethodPut)
+	room.HandleFunc("/state", ms.authed(ms.getFullState)).Methods(http.MethodGet)
+	room.HandleFunc("/state/{type}", ms.authed(ms.getState)).Methods(http.MethodGet)
+	room.HandleFunc("/state/{type}/{stateKey:.*}", ms.authed(ms.getState)).Methods(http.MethodGet)
+	room.HandleFunc("/redact/{eventID}/{txnID}", ms.authed(ms.putRedact)).Methods(http.MethodPut)
+	room.HandleFunc("/event/{eventID}", ms.authed(ms.getEvent)).Methods(http.MethodGet)
+	room.HandleFunc("/messages", ms.authed(ms.getMessages)).Methods(http.MethodGet)
+	room.HandleFunc("/members", ms.authed(ms.getMembers)).Methods(http.MethodGet)
+	room.HandleFunc("/joined_members", ms.authed(ms.getJoinedMembers)).Methods(http.MethodGet)
+	room.HandleFunc("/receipt/{type}/{eventID}", ms.authed(ms.emptyResponse)).Methods(http.MethodPost)
+	room.HandleFunc("/read_markers", ms.authed(ms.emptyResponse)).Methods(http.MethodPost)
+	room.HandleFunc("/typing/{userID}", ms.authed(ms.emptyResponse)).Methods(http.MethodPut)
+
+	v3.HandleFunc("/sendToDevice/{type}/{txnID}", ms.authed(ms.putSendToDevice)).Methods(http.MethodPut)
+	v3.HandleFunc("/user/{userID}/account_data/{type}", ms.authed(ms.getAccountData)).Methods(http.MethodGet)
+	v3.HandleFunc("/user/{userID}/account_data/{type}", ms.authed(ms.putAccountData)).Methods(http.MethodPut)
+	v3.HandleFunc("/keys/upload", ms.authed(ms.postKeysUpload)).Methods(http.MethodPost)
+	v3.HandleFunc("/keys/query", ms.authed(ms.postKeysQuery)).Methods(http.MethodPost)
+	v3.HandleFunc("/keys/claim", ms.authed(ms.postKeysClaim)).Methods(http.MethodPost)
+	v3.HandleFunc("/keys/device_signing/upload", ms.authed(ms.postDeviceSigningUpload)).Methods(http.MethodPost)
+	v3.HandleFunc("/keys/signatures/upload", ms.authed(ms.postSignaturesUpload)).Methods(http.MethodPost)
+
+	cli.HandleFunc("/v1/appservice/{appserviceID}/ping", ms.authed(ms.postAppservicePing)).Methods(http.MethodPost)
+}
+
+func (ms *MockServer) getVersions(w http.ResponseWriter, r *http.Request) {
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespVersions{
+		Versions: []mautrix.SpecVersion{mautrix.SpecV11, mautrix.SpecV17, mautrix.SpecV111},
+		UnstableFeatures: map[string]bool{
+			mautrix.FeatureAppservicePing.UnstableFlag:     true,
+			mautrix.FeatureAuthenticatedMedia.UnstableFlag: true,
+		},
+	})
+}
+
+func (ms *MockServer) emptyResponse(w http.ResponseWriter, r *http.Request, sess *session) {
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, into any) bool {
+	err := json.NewDecoder(r.Body).Decode(into)
+	if err != nil {
+		mautrix.MNotJSON.WithMessage("Request body is not valid JSON: %v", err).Write(w)
+		return false
+	}
+	return true
+}
+
+// nextID returns a new unique identifier with the given prefix.
+// The caller must hold the lock.
+func (ms *MockServer) nextID(prefix string) string {
+	ms.counter++
+	return fmt.Sprintf("%s%d", prefix, ms.counter)
+}
+
+// bumpStream marks that something visible in /sync has changed and returns the new stream position.
+// The caller must hold the lock.
+func (ms *MockServer) bumpStream() int64 {
+	ms.streamPos++
+	close(ms.streamChanged)
+	ms.streamChanged = make(chan struct{})
+	for _, as := range ms.appservices {
+		as.wake()
+	}
+	return ms.streamPos
+}
+
+// authed wraps a handler to require an access token.
+func (ms *MockServer) authed(fn func(w http.ResponseWriter, r *http.Request, sess *session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+		if token == "" {
+			mautrix.MMissingToken.WithMessage("Missing access token").Write(w)
+			return
+		}
+		ms.lock.Lock()
+		sess, err := ms.getSession(token, r.URL.Query())
+		ms.lock.Unlock()
+		if err != nil {
+			err.(mautrix.RespError).Write(w)
+			return
+		}
+		fn(w, r, sess)
+	}
+}
+
+// getSession finds the session for the given access token. The caller must hold the lock.
+func (ms *MockServer) getSession(token string, query url.Values) (*session, error) {
+	if sess, ok := ms.sessions[token]; ok {
+		return sess, nil
+	}
+	for _, as := range ms.appservices {
+		if as.Registration.AppToken != token {
+			continue
+		}
+		userID := id.UserID(query.Get("user_id"))
+		if userID == "" {
+			userID = as.botUserID(ms.ServerName)
+		} else if !as.isInterestedInUser(userID) && userID != as.botUserID(ms.ServerName) {
+			return nil, mautrix.MForbidden.WithMessage("Appservice can't masquerade as %s", userID)
+		}
+		usr := ms.ensureUser(userID)
+		usr.AppService = as
+		deviceID := id.DeviceID(query.Get("org.matrix.msc3202.device_id"))
+		if deviceID != "" && usr.devices[deviceID] == nil {
+			usr.devices[deviceID] = &device{ID: deviceID}
+		}
+		return &session{UserID: userID, DeviceID: deviceID, AppService: as}, nil
+	}
+	return nil, mautrix.MUnknownToken.WithMessage("Unknown access token")
+}
+
+// ensureUser returns the user with the given ID, creating it if it doesn't exist. The caller must hold the lock.
+func (ms *MockServer) ensureUser(userID id.UserID) *user {
+	usr, ok := ms.users[userID]
+	if !ok {
+		usr = &user{
+			ID:          userID,
+			devices:     make(map[id.DeviceID]*device),
+			accountData: make(map[string]*accountDataItem),
+		}
+		ms.users[userID] = usr
+	}
+	return usr
+}
+
+// newSession creates a new device and access token for the given user. The caller must hold the lock.
+func (ms *MockServer) newSession(usr *user, deviceID id.DeviceID, displayName string) string {
+	if deviceID == "" {
+		deviceID = id.DeviceID(ms.nextID("MOCKDEVICE"))
+	}
+	if usr.devices[deviceID] == nil {
+		usr.devices[deviceID] = &device{ID: deviceID, DisplayName: displayName}
+	}
+	token := ms.nextID("mock_token_")
+	ms.sessions[token] = &session{UserID: usr.ID, DeviceID: deviceID}
+	return token
+}
+
+// CreateUser creates a user with the given localpart and [DefaultPassword] as the password.
+func (ms *MockServer) CreateUser(localpart string) id.UserID {
+	userID := id.NewUserID(localpart, ms.ServerName)
+	ms.lock.Lock()
+	ms.ensureUser(userID).Password = DefaultPassword
+	ms.lock.Unlock()
+	return userID
+}
+
+// Login creates a new device for the given user and returns a client using it.
+// The user is created if it doesn't exist. If deviceID is empty, a new device ID is generated.
+func (ms *MockServer) Login(t testing.TB, userID id.UserID, deviceID id.DeviceID) *mautrix.Client {
+	t.Helper()
+	ms.lock.Lock()
+	token := ms.newSession(ms.ensureUser(userID), deviceID, "")
+	sess := ms.sessions[token]
+	ms.lock.Unlock()
+	client, err := mautrix.NewClient(ms.URL, userID, token)
+	require.NoError(t, err)
+	client.DeviceID = sess.DeviceID
+	client.StateStore = mautrix.NewMemoryStateStore()
+	return client
+}
+
+func (ms *MockServer) postRegister(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqRegister
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if req.Type == mautrix.AuthTypeAppservice {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var as *appserviceState
+		for _, existing := range ms.appservices {
+			if existing.Registration.AppToken == token {
+				as = existing
+			}
+		}
+		userID := id.NewUserID(strings.ToLower(req.Username), ms.ServerName)
+		if as == nil {
+			mautrix.MUnknownToken.WithMessage("Unknown appservice token").Write(w)
+			return
+		} else if !as.isInterestedInUser(userID) {
+			mautrix.MExclusive.WithMessage("User ID is not in the appservice's namespace").Write(w)
+			return
+		} else if _, exists := ms.users[userID]; exists {
+			mautrix.MUserInUse.WithMessage("User ID already taken").Write(w)
+			return
+		}
+		ms.ensureUser(userID).AppService = as
+		exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespRegister{UserID: userID})
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		mautrix.MInvalidParam.WithMessage("Username and password are required").Write(w)
+		return
+	} else if req.Auth == nil {
+		// Only the dummy auth stage is supported, and any auth data is accepted for it
+		exhttp.WriteJSONResponse(w, http.StatusUnauthorized, &mautrix.RespUserInteractive{
+			Flows:   []mautrix.UIAFlow{{Stages: []mautrix.AuthType{mautrix.AuthTypeDummy}}},
+			Session: ms.nextID("mock_uia_"),
+		})
+		return
+	}
+	userID := id.NewUserID(strings.ToLower(req.Username), ms.ServerName)
+	if _, exists := ms.users[userID]; exists {
+		mautrix.MUserInUse.WithMessage("User ID already taken").Write(w)
+		return
+	}
+	usr := ms.ensureUser(userID)
+	usr.Password = req.Password
+	resp := &mautrix.RespRegister{UserID: userID}
+	if !req.InhibitLogin {
+		resp.AccessToken = ms.newSession(usr, req.DeviceID, req.InitialDeviceDisplayName)
+		resp.DeviceID = ms.sessions[resp.AccessToken].DeviceID
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) postLogin(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqLogin
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	userID := id.UserID(req.Identifier.User)
+	if !strings.HasPrefix(string(userID), "@") {
+		userID = id.NewUserID(string(userID), ms.ServerName)
+	}
+	usr, ok := ms.users[userID]
+	switch req.Type {
+	case mautrix.AuthTypePassword:
+		if !ok || usr.Password == "" || usr.Password != req.Password {
+			mautrix.MForbidden.WithMessage("Invalid username or password").Write(w)
+			return
+		}
+	case mautrix.AuthTypeAppservice:
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sess, err := ms.getSession(token, url.Values{"user_id": {string(userID)}})
+		if err != nil || sess.AppService == nil {
+			mautrix.MForbidden.WithMessage("Invalid appservice token").Write(w)
+			return
+		}
+		usr = ms.users[userID]
+	default:
+		mautrix.MUnknown.WithMessage("Unsupported login type").WithStatus(http.StatusBadRequest).Write(w)
+		return
+	}
+	token := ms.newSession(usr, req.DeviceID, req.InitialDeviceDisplayName)
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespLogin{
+		AccessToken: token,
+		DeviceID:    ms.sessions[token].DeviceID,
+		UserID:      userID,
+	})
+}
+
+func (ms *MockServer) postLogout(w http.ResponseWriter, r *http.Request, sess *session) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	ms.lock.Lock()
+	delete(ms.sessions, token)
+	ms.lock.Unlock()
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) getWhoami(w http.ResponseWriter, r *http.Request, sess *session) {
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespWhoami{
+		UserID:   sess.UserID,
+		DeviceID: sess.DeviceID,
+	})
+}
+
+func (ms *MockServer) postFilter(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	filterID := ms.nextID("")
+	ms.lock.Unlock()
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespCreateFilter{FilterID: filterID})
+}
+
+func (ms *MockServer) getProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ms.lock.Lock()
+	usr, ok := ms.users[id.UserID(vars["userID"])]
+	var resp map[string]any
+	if ok {
+		resp = make(map[string]any)
+		if usr.DisplayName != "" && vars["field"] != "avatar_url" {
+			resp["displayname"] = usr.DisplayName
+		}
+		if !usr.AvatarURL.IsEmpty() && vars["field"] != "displayname" {
+			resp["avatar_url"] = usr.AvatarURL.String()
+		}
+	}
+	ms.lock.Unlock()
+	if !ok {
+		mautrix.MNotFound.WithMessage("User not found").Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) putProfile(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	if id.UserID(vars["userID"]) != sess.UserID {
+		mautrix.MForbidden.WithMessage("Can't change other users' profiles").Write(w)
+		return
+	}
+	var req struct {
+		DisplayName string        `json:"displayname"`
+		AvatarURL   id.ContentURI `json:"avatar_url"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	usr := ms.ensureUser(sess.UserID)
+	if vars["field"] == "displayname" {
+		usr.DisplayName = req.DisplayName
+	} else {
+		usr.AvatarURL = req.AvatarURL
+	}
+	// Update the member events in all joined rooms like real homeservers do
+	for _, rm := range ms.rooms {
+		if rm.membership(sess.UserID) != event.MembershipJoin {
+			continue
+		}
+		content := rm.memberContent(sess.UserID)
+		content.Displayname = usr.DisplayName
+		content.AvatarURL = usr.AvatarURL.CUString()
+		ms.addEvent(rm, sess.UserID, event.StateMember, ptr(string(sess.UserID)), mustMarshal(content))
+	}
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func mustMarshal(data any) json.RawMessage {
+	out, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func ptr[T any](val T) *T {
+	return &val
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mockserver"
+)
+
+func TestMockServer_RegisterLoginSync(t *testing.T) {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+
+	cli, err := mautrix.NewClient(ms.URL, "", "")
+	require.NoError(t, err)
+	_, err = cli.RegisterDummy(ctx, &mautrix.ReqRegister{Username: "alice", Password: "hunter2"})
+	require.NoError(t, err)
+	_, err = cli.Login(ctx, &mautrix.ReqLogin{
+		Type:             mautrix.AuthTypePassword,
+		Identifier:       mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: "alice"},
+		Password:         "hunter2",
+		StoreCredentials: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), cli.UserID)
+	whoami, err := cli.Whoami(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cli.DeviceID, whoami.DeviceID)
+
+	room, err := cli.CreateRoom(ctx, &mautrix.ReqCreateRoom{Name: "Test room"})
+	require.NoError(t, err)
+	sent, err := cli.SendText(ctx, room.RoomID, "Hello, world!")
+	require.NoError(t, err)
+
+	resp, err := cli.SyncRequest(ctx, 0, "", "", false, "")
+	require.NoError(t, err)
+	require.Contains(t, resp.Rooms.Join, room.RoomID)
+	timeline := resp.Rooms.Join[room.RoomID].Timeline.Events
+	last := timeline[len(timeline)-1]
+	assert.Equal(t, sent.EventID, last.ID)
+	assert.Equal(t, mockserver.DefaultStartTime.UnixMilli(), last.Timestamp)
+	require.NoError(t, last.Content.ParseRaw(event.EventMessage))
+	assert.Equal(t, "Hello, world!", last.Content.AsMessage().Body)
+}
+
+func TestMockServer_SyncLongPoll(t *testing.T) {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+	alice := ms.Login(t, ms.CreateUser("alice"), "")
+	bob := ms.Login(t, ms.CreateUser("bob"), "")
+
+	room, err := alice.CreateRoom(ctx, &mautrix.ReqCreateRoom{Invite: []id.UserID{bob.UserID}})
+	require.NoError(t, err)
+	_, err = bob.JoinRoomByID(ctx, room.RoomID)
+	require.NoError(t, err)
+	initial, err := bob.SyncRequest(ctx, 0, "", "", false, "")
+	require.NoError(t, err)
+
+	results := make(chan *mautrix.RespSync, 1)
+	go func() {
+		resp, err := bob.SyncRequest(ctx, 30000, initial.NextBatch, "", false, "")
+		assert.NoError(t, err)
+		results <- resp
+	}()
+	select {
+	case <-results:
+		t.Fatal("Sync returned before anything happened")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ms.Clock.Advance(time.Second)
+	_, err = alice.SendText(ctx, room.RoomID, "Hi")
+	require.NoError(t, err)
+	select {
+	case resp := <-results:
+		require.Contains(t, resp.Rooms.Join, room.RoomID)
+		evts := resp.Rooms.Join[room.RoomID].Timeline.Events
+		require.Len(t, evts, 1)
+		assert.Equal(t, mockserver.DefaultStartTime.Add(time.Second).UnixMilli(), evts[0].Timestamp)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync didn't return after message was sent")
+	}
+
+	next, err := bob.SyncRequest(ctx, 0, "", "", false, "")
+	require.NoError(t, err)
+	go func() {
+		resp, err := bob.SyncRequest(ctx, 30000, next.NextBatch, "", false, "")
+		assert.NoError(t, err)
+		results <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ms.Clock.Advance(31 * time.Second)
+	select {
+	case resp := <-results:
+		assert.Empty(t, resp.Rooms.Join)
+		assert.Equal(t, next.NextBatch, resp.NextBatch)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync didn't time out after clock was advanced")
+	}
+}
+
+func TestMockServer_Keys(t *testing.T) {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+	alice := ms.Login(t, ms.CreateUser("alice"), "ALICEDEVICE")
+	bob := ms.Login(t, ms.CreateUser("bob"), "BOBDEVICE")
+
+	uploadResp, err := alice.UploadKeys(ctx, &mautrix.ReqUploadKeys{
+		DeviceKeys: &mautrix.DeviceKeys{
+			UserID:     alice.UserID,
+			DeviceID:   alice.DeviceID,
+			Algorithms: []id.Algorithm{id.AlgorithmOlmV1, id.AlgorithmMegolmV1},
+			Keys:       mautrix.KeyMap{id.NewDeviceKeyID(id.KeyAlgorithmCurve25519, "ALICEDEVICE"): "curve"},
+		},
+		OneTimeKeys: map[id.KeyID]mautrix.OneTimeKey{
+			id.NewKeyID(id.KeyAlgorithmSignedCurve25519, "AAAA"): {Key: "otk1", IsSigned: true},
+			id.NewKeyID(id.KeyAlgorithmSignedCurve25519, "AAAB"): {Key: "otk2", IsSigned: true},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, uploadResp.OneTimeKeyCounts.SignedCurve25519)
+
+	queryResp, err := bob.QueryKeys(ctx, &mautrix.ReqQueryKeys{
+		DeviceKeys: mautrix.DeviceKeysRequest{alice.UserID: {}},
+	})
+	require.NoError(t, err)
+	require.Contains(t, queryResp.DeviceKeys[alice.UserID], alice.DeviceID)
+	assert.Equal(t, "curve", queryResp.DeviceKeys[alice.UserID][alice.DeviceID].Keys.GetCurve25519(alice.DeviceID).String())
+
+	claimResp, err := bob.ClaimKeys(ctx, &mautrix.ReqClaimKeys{
+		OneTimeKeys: mautrix.OneTimeKeysRequest{alice.UserID: {alice.DeviceID: id.KeyAlgorithmSignedCurve25519}},
+	})
+	require.NoError(t, err)
+	claimed := claimResp.OneTimeKeys[alice.UserID][alice.DeviceID]
+	require.Len(t, claimed, 1)
+	assert.Equal(t, id.Curve25519("otk1"), claimed[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, "AAAA")].Key)
+
+	_, err = bob.SendToDevice(ctx, event.ToDeviceDummy, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			alice.UserID: {"*": {Raw: map[string]any{}}},
+		},
+	})
+	require.NoError(t, err)
+	resp, err := alice.SyncRequest(ctx, 0, "", "", false, "")
+	require.NoError(t, err)
+	require.Len(t, resp.ToDevice.Events, 1)
+	assert.Equal(t, bob.UserID, resp.ToDevice.Events[0].Sender)
+	assert.Equal(t, 1, resp.DeviceOTKCount.SignedCurve25519)
+	resp, err = alice.SyncRequest(ctx, 0, resp.NextBatch, "", false, "")
+	require.NoError(t, err)
+	assert.Empty(t, resp.ToDevice.Events)
+}
+
+func TestMockServer_Media(t *testing.T) {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+	cli := ms.Login(t, ms.CreateUser("alice"), "")
+
+	upload, err := cli.UploadBytesWithName(ctx, []byte("meow"), "text/plain", "cat.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", upload.ContentURI.Homeserver)
+	data, err := cli.DownloadBytes(ctx, upload.ContentURI)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), data)
+
+	_, err = cli.DownloadBytes(ctx, id.ContentURI{Homeserver: "example.com", FileID: "nonexistent"})
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
+
+func TestMockServer_AppService(t *testing.T) {
+	ctx := context.Background()
+	ms := mockserver.New(t, "example.com")
+
+	as := appservice.Create()
+	as.Registration = appservice.CreateRegistration()
+	as.Registration.ID = "test"
+	as.Registration.SenderLocalpart = "bot"
+	as.Registration.Namespaces.UserIDs.Register(regexp.MustCompile(`^@ghost_.+:example\.com$`), true)
+	asServer := httptest.NewServer(as.Router)
+	t.Cleanup(asServer.Close)
+	as.Registration.URL = asServer.URL
+	as.HomeserverDomain = ms.ServerName
+	require.NoError(t, as.SetHomeserverURL(ms.URL))
+	ms.RegisterAppService(t, as.Registration)
+
+	ghost := as.Intent("@ghost_1:example.com")
+	require.NoError(t, ghost.EnsureRegistered(ctx))
+	alice := ms.Login(t, ms.CreateUser("alice"), "")
+	room, err := alice.CreateRoom(ctx, &mautrix.ReqCreateRoom{Invite: []id.UserID{ghost.UserID}})
+	require.NoError(t, err)
+	_, err = alice.SendText(ctx, room.RoomID, "Not visible to the appservice")
+	require.NoError(t, err)
+	require.NoError(t, ms.FlushTransactions(ctx))
+	drainEvents(as)
+
+	_, err = ghost.JoinRoomByID(ctx, room.RoomID)
+	require.NoError(t, err)
+	sent, err := alice.SendText(ctx, room.RoomID, "Hello ghost")
+	require.NoError(t, err)
+	require.NoError(t, ms.FlushTransactions(ctx))
+	var received []*event.Event
+	for _, evt := range drainEvents(as) {
+		if evt.Type == event.EventMessage {
+			received = append(received, evt)
+		}
+	}
+	require.Len(t, received, 1)
+	assert.Equal(t, sent.EventID, received[0].ID)
+
+	ping, err := as.BotClient().AppservicePing(ctx, "test", "")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, ping.DurationMS, int64(0))
+}
+
+func drainEvents(as *appservice.AppService) (evts []*event.Event) {
+	for {
+		select {
+		case evt := <-as.Events:
+			evts = append(evts, evt)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,593 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultRoomVersion is the room version used for rooms created without an explicit version.
+const DefaultRoomVersion = "10"
+
+type stateKey struct {
+	Type     string
+	StateKey string
+}
+
+type storedEvent struct {
+	*event.Event
+	Pos int64
+}
+
+type room struct {
+	ID       id.RoomID
+	Timeline []*storedEvent
+	ByID     map[id.EventID]*storedEvent
+	State    map[stateKey]*storedEvent
+}
+
+// copy returns a shallow copy of the event that is safe to return after the lock is released.
+func (evt *storedEvent) copy() *event.Event {
+	cp := *evt.Event
+	return &cp
+}
+
+func (rm *room) getState(evtType event.Type, key string) *storedEvent {
+	return rm.State[stateKey{Type: evtType.Type, StateKey: key}]
+}
+
+func (rm *room) memberContent(userID id.UserID) *event.MemberEventContent {
+	var content event.MemberEventContent
+	if evt := rm.getState(event.StateMember, string(userID)); evt != nil {
+		_ = json.Unmarshal(evt.Content.VeryRaw, &content)
+	}
+	return &content
+}
+
+func (rm *room) membership(userID id.UserID) event.Membership {
+	evt := rm.getState(event.StateMember, string(userID))
+	if evt == nil {
+		return ""
+	}
+	return rm.memberContent(userID).Membership
+}
+
+func (rm *room) joinRule() event.JoinRule {
+	var content event.JoinRulesEventContent
+	if evt := rm.getState(event.StateJoinRules, ""); evt != nil {
+		_ = json.Unmarshal(evt.Content.VeryRaw, &content)
+	}
+	return content.JoinRule
+}
+
+func (rm *room) members() map[id.UserID]event.Membership {
+	members := make(map[id.UserID]event.Membership)
+	for key := range rm.State {
+		if key.Type == event.StateMember.Type {
+			members[id.UserID(key.StateKey)] = rm.membership(id.UserID(key.StateKey))
+		}
+	}
+	return members
+}
+
+func (rm *room) stateEvents() []*event.Event {
+	events := make([]*event.Event, 0, len(rm.State))
+	for _, evt := range rm.Timeline {
+		if evt.StateKey != nil && rm.State[stateKey{Type: evt.Type.Type, StateKey: *evt.StateKey}] == evt {
+			events = append(events, evt.copy())
+		}
+	}
+	return events
+}
+
+// addEvent appends a new event to the room. The caller must hold the lock.
+func (ms *MockServer) addEvent(rm *room, sender id.UserID, evtType event.Type, key *string, content json.RawMessage) *storedEvent {
+	if key != nil {
+		evtType.Class = event.StateEventType
+	} else if evtType.Class == event.UnknownEventType {
+		evtType.Class = event.MessageEventType
+	}
+	evt := &storedEvent{
+		Event: &event.Event{
+			ID:        id.EventID(ms.nextID("$mock")),
+			RoomID:    rm.ID,
+			Sender:    sender,
+			Type:      evtType,
+			StateKey:  key,
+			Timestamp: ms.Clock.Now().UnixMilli(),
+			Content:   event.Content{VeryRaw: content},
+		},
+	}
+	if key != nil {
+		if prev := rm.getState(evtType, *key); prev != nil {
+			evt.Unsigned.PrevContent = &event.Content{VeryRaw: prev.Content.VeryRaw}
+			evt.Unsigned.ReplacesState = prev.ID
+		}
+		rm.State[stateKey{Type: evtType.Type, StateKey: *key}] = evt
+	}
+	evt.Pos = ms.bumpStream()
+	rm.Timeline = append(rm.Timeline, evt)
+	rm.ByID[evt.ID] = evt
+	ms.eventLog = append(ms.eventLog, evt)
+	return evt
+}
+
+// getJoinedRoom finds a room and checks that the user is joined to it. If it returns nil, an error has been written.
+// The caller must hold the lock.
+func (ms *MockServer) getJoinedRoom(w http.ResponseWriter, r *http.Request, sess *session) *room {
+	rm, ok := ms.rooms[id.RoomID(mux.Vars(r)["roomID"])]
+	if !ok {
+		mautrix.MNotFound.WithMessage("Room not found").Write(w)
+		return nil
+	} else if rm.membership(sess.UserID) != event.MembershipJoin {
+		mautrix.MForbidden.WithMessage("You are not joined to this room").Write(w)
+		return nil
+	}
+	return rm
+}
+
+func (ms *MockServer) postCreateRoom(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqCreateRoom
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var alias id.RoomAlias
+	if req.RoomAliasName != "" {
+		alias = id.NewRoomAlias(req.RoomAliasName, ms.ServerName)
+		if _, exists := ms.aliases[alias]; exists {
+			mautrix.MRoomInUse.WithMessage("Room alias already taken").Write(w)
+			return
+		}
+	}
+	roomVersion := req.RoomVersion
+	if roomVersion == "" {
+		roomVersion = DefaultRoomVersion
+	}
+	rm := &room{
+		ID:    id.RoomID(ms.nextID("!mock") + ":" + ms.ServerName),
+		ByID:  make(map[id.EventID]*storedEvent),
+		State: make(map[stateKey]*storedEvent),
+	}
+	ms.rooms[rm.ID] = rm
+
+	createContent := map[string]any{}
+	for key, value := range req.CreationContent {
+		createContent[key] = value
+	}
+	createContent["creator"] = sess.UserID
+	createContent["room_version"] = roomVersion
+	ms.addEvent(rm, sess.UserID, event.StateCreate, ptr(""), mustMarshal(createContent))
+	ms.addMember(rm, sess.UserID, sess.UserID, event.MembershipJoin, "", false)
+
+	powerLevels := map[string]any{
+		"users":          map[id.UserID]int{sess.UserID: 100},
+		"users_default":  0,
+		"events_default": 0,
+		"state_default":  50,
+		"ban":            50,
+		"kick":           50,
+		"redact":         50,
+		"invite":         0,
+	}
+	if req.PowerLevelOverride != nil {
+		var override map[string]any
+		_ = json.Unmarshal(mustMarshal(req.PowerLevelOverride), &override)
+		for key, value := range override {
+			powerLevels[key] = value
+		}
+	}
+	ms.addEvent(rm, sess.UserID, event.StatePowerLevels, ptr(""), mustMarshal(powerLevels))
+	joinRule := event.JoinRuleInvite
+	if req.Preset == "public_chat" || (req.Preset == "" && req.Visibility == "public") {
+		joinRule = event.JoinRulePublic
+	}
+	ms.addEvent(rm, sess.UserID, event.StateJoinRules, ptr(""), mustMarshal(&event.JoinRulesEventContent{JoinRule: joinRule}))
+	ms.addEvent(rm, sess.UserID, event.StateHistoryVisibility, ptr(""), mustMarshal(&event.HistoryVisibilityEventContent{
+		HistoryVisibility: event.HistoryVisibilityShared,
+	}))
+	if alias != "" {
+		ms.aliases[alias] = rm.ID
+		ms.addEvent(rm, sess.UserID, event.StateCanonicalAlias, ptr(""), mustMarshal(&event.CanonicalAliasEventContent{Alias: alias}))
+	}
+	for _, evt := range req.InitialState {
+		content, err := json.Marshal(&evt.Content)
+		if err != nil {
+			continue
+		}
+		ms.addEvent(rm, sess.UserID, evt.Type, ptr(evt.GetStateKey()), content)
+	}
+	if req.Name != "" {
+		ms.addEvent(rm, sess.UserID, event.StateRoomName, ptr(""), mustMarshal(&event.RoomNameEventContent{Name: req.Name}))
+	}
+	if req.Topic != "" {
+		ms.addEvent(rm, sess.UserID, event.StateTopic, ptr(""), mustMarshal(&event.TopicEventContent{Topic: req.Topic}))
+	}
+	for _, invitee := range req.Invite {
+		ms.addMember(rm, sess.UserID, invitee, event.MembershipInvite, "", req.IsDirect)
+	}
+	for _, member := range req.BeeperInitialMembers {
+		ms.addMember(rm, member, member, event.MembershipJoin, "", false)
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespCreateRoom{RoomID: rm.ID})
+}
+
+// addMember sends a member event, filling the profile from the target user. The caller must hold the lock.
+func (ms *MockServer) addMember(rm *room, sender, target id.UserID, membership event.Membership, reason string, isDirect bool) *storedEvent {
+	content := &event.MemberEventContent{
+		Membership: membership,
+		Reason:     reason,
+		IsDirect:   isDirect,
+	}
+	if usr, ok := ms.users[target]; ok && (membership == event.MembershipJoin || membership == event.MembershipInvite) {
+		content.Displayname = usr.DisplayName
+		content.AvatarURL = usr.AvatarURL.CUString()
+	}
+	return ms.addEvent(rm, sender, event.StateMember, ptr(string(target)), mustMarshal(content))
+}
+
+func (ms *MockServer) getJoinedRooms(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	resp := &mautrix.RespJoinedRooms{JoinedRooms: []id.RoomID{}}
+	for _, rm := range ms.rooms {
+		if rm.membership(sess.UserID) == event.MembershipJoin {
+			resp.JoinedRooms = append(resp.JoinedRooms, rm.ID)
+		}
+	}
+	ms.lock.Unlock()
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) postJoin(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	roomID := id.RoomID(vars["roomID"])
+	if roomIDOrAlias := vars["roomIDOrAlias"]; strings.HasPrefix(roomIDOrAlias, "#") {
+		roomID = ms.aliases[id.RoomAlias(roomIDOrAlias)]
+	} else if roomIDOrAlias != "" {
+		roomID = id.RoomID(roomIDOrAlias)
+	}
+	rm, ok := ms.rooms[roomID]
+	if !ok {
+		mautrix.MNotFound.WithMessage("Room not found").Write(w)
+		return
+	}
+	switch rm.membership(sess.UserID) {
+	case event.MembershipJoin:
+	case event.MembershipInvite:
+		ms.addMember(rm, sess.UserID, sess.UserID, event.MembershipJoin, "", rm.memberContent(sess.UserID).IsDirect)
+	case event.MembershipBan:
+		mautrix.MForbidden.WithMessage("You are banned from this room").Write(w)
+		return
+	default:
+		if rm.joinRule() != event.JoinRulePublic {
+			mautrix.MForbidden.WithMessage("You are not invited to this room").Write(w)
+			return
+		}
+		ms.addMember(rm, sess.UserID, sess.UserID, event.MembershipJoin, "", false)
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespJoinRoom{RoomID: rm.ID})
+}
+
+func (ms *MockServer) postMembership(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req struct {
+		UserID id.UserID `json:"user_id"`
+		Reason string    `json:"reason"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	action := mux.Vars(r)["action"]
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm, ok := ms.rooms[id.RoomID(mux.Vars(r)["roomID"])]
+	if !ok {
+		mautrix.MNotFound.WithMessage("Room not found").Write(w)
+		return
+	}
+	ownMembership := rm.membership(sess.UserID)
+	if action == "leave" {
+		if ownMembership != event.MembershipJoin && ownMembership != event.MembershipInvite {
+			mautrix.MForbidden.WithMessage("You are not in this room").Write(w)
+			return
+		}
+		ms.addMember(rm, sess.UserID, sess.UserID, event.MembershipLeave, req.Reason, false)
+		exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+		return
+	} else if ownMembership != event.MembershipJoin {
+		mautrix.MForbidden.WithMessage("You are not joined to this room").Write(w)
+		return
+	}
+	targetMembership := rm.membership(req.UserID)
+	var newMembership event.Membership
+	switch action {
+	case "invite":
+		if targetMembership == event.MembershipJoin || targetMembership == event.MembershipBan {
+			mautrix.MForbidden.WithMessage("User is already %s", targetMembership).Write(w)
+			return
+		}
+		newMembership = event.MembershipInvite
+	case "kick":
+		if targetMembership != event.MembershipJoin && targetMembership != event.MembershipInvite {
+			mautrix.MForbidden.WithMessage("User is not in the room").Write(w)
+			return
+		}
+		newMembership = event.MembershipLeave
+	case "ban":
+		newMembership = event.MembershipBan
+	case "unban":
+		if targetMembership != event.MembershipBan {
+			mautrix.MForbidden.WithMessage("User is not banned").Write(w)
+			return
+		}
+		newMembership = event.MembershipLeave
+	}
+	ms.addMember(rm, sess.UserID, req.UserID, newMembership, req.Reason, false)
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+// checkTxnID returns the event ID previously sent with the same transaction ID, if any. The caller must hold the lock.
+func (ms *MockServer) checkTxnID(sess *session, txnID string) (string, id.EventID) {
+	key := strings.Join([]string{string(sess.UserID), string(sess.DeviceID), txnID}, "|")
+	return key, ms.txnIDs[key]
+}
+
+func (ms *MockServer) putSend(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	var content json.RawMessage
+	if !readJSON(w, r, &content) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	txnKey, existing := ms.checkTxnID(sess, vars["txnID"])
+	if existing == "" {
+		evtType := event.Type{Type: vars["type"], Class: event.MessageEventType}
+		existing = ms.addEvent(rm, sess.UserID, evtType, nil, content).ID
+		ms.txnIDs[txnKey] = existing
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespSendEvent{EventID: existing})
+}
+
+func (ms *MockServer) putState(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	var content json.RawMessage
+	if !readJSON(w, r, &content) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	evtType := event.Type{Type: vars["type"], Class: event.StateEventType}
+	if evtType == event.StateCanonicalAlias {
+		var aliasContent event.CanonicalAliasEventContent
+		_ = json.Unmarshal(content, &aliasContent)
+		if aliasContent.Alias != "" && ms.aliases[aliasContent.Alias] != rm.ID {
+			mautrix.RespError{ErrCode: "M_BAD_ALIAS", StatusCode: http.StatusBadRequest}.WithMessage("Alias doesn't point at this room").Write(w)
+			return
+		}
+	}
+	evt := ms.addEvent(rm, sess.UserID, evtType, ptr(vars["stateKey"]), content)
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespSendEvent{EventID: evt.ID})
+}
+
+func (ms *MockServer) getFullState(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, rm.stateEvents())
+}
+
+func (ms *MockServer) getState(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	evt := rm.getState(event.Type{Type: vars["type"]}, vars["stateKey"])
+	if evt == nil {
+		mautrix.MNotFound.WithMessage("State event not found").Write(w)
+		return
+	}
+	exhttp.WriteJSONData(w, http.StatusOK, evt.Content.VeryRaw)
+}
+
+func (ms *MockServer) putRedact(w http.ResponseWriter, r *http.Request, sess *session) {
+	vars := mux.Vars(r)
+	var req map[string]any
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	target, ok := rm.ByID[id.EventID(vars["eventID"])]
+	if !ok {
+		mautrix.MNotFound.WithMessage("Event not found").Write(w)
+		return
+	}
+	txnKey, existing := ms.checkTxnID(sess, vars["txnID"])
+	if existing == "" {
+		req["redacts"] = target.ID
+		redaction := ms.addEvent(rm, sess.UserID, event.EventRedaction, nil, mustMarshal(req))
+		redaction.Redacts = target.ID
+		if target.StateKey != nil {
+			// Keep the membership of member events, but otherwise don't try to implement the redaction algorithm
+			if target.Type == event.StateMember {
+				target.Content = event.Content{VeryRaw: mustMarshal(map[string]any{"membership": rm.memberContent(id.UserID(*target.StateKey)).Membership})}
+			} else {
+				target.Content = event.Content{VeryRaw: json.RawMessage("{}")}
+			}
+		} else {
+			target.Content = event.Content{VeryRaw: json.RawMessage("{}")}
+		}
+		target.Unsigned.RedactedBecause = redaction.copy()
+		existing = redaction.ID
+		ms.txnIDs[txnKey] = existing
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespSendEvent{EventID: existing})
+}
+
+func (ms *MockServer) getEvent(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	evt, ok := rm.ByID[id.EventID(mux.Vars(r)["eventID"])]
+	if !ok {
+		mautrix.MNotFound.WithMessage("Event not found").Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, evt.copy())
+}
+
+// getMessages implements a simplified /messages where pagination tokens are timeline indexes.
+func (ms *MockServer) getMessages(w http.ResponseWriter, r *http.Request, sess *session) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	backwards := query.Get("dir") != "f"
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		if backwards {
+			from = len(rm.Timeline)
+		} else {
+			from = 0
+		}
+	}
+	from = min(max(from, 0), len(rm.Timeline))
+	resp := &mautrix.RespMessages{Start: strconv.Itoa(from), Chunk: []*event.Event{}}
+	end := from
+	if backwards {
+		for end > 0 && len(resp.Chunk) < limit {
+			end--
+			resp.Chunk = append(resp.Chunk, rm.Timeline[end].copy())
+		}
+		if end > 0 {
+			resp.End = strconv.Itoa(end)
+		}
+	} else {
+		for end < len(rm.Timeline) && len(resp.Chunk) < limit {
+			resp.Chunk = append(resp.Chunk, rm.Timeline[end].copy())
+			end++
+		}
+		resp.End = strconv.Itoa(end)
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) getMembers(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	resp := &mautrix.RespMembers{Chunk: []*event.Event{}}
+	for _, evt := range rm.stateEvents() {
+		if evt.Type == event.StateMember {
+			resp.Chunk = append(resp.Chunk, evt)
+		}
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) getJoinedMembers(w http.ResponseWriter, r *http.Request, sess *session) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	rm := ms.getJoinedRoom(w, r, sess)
+	if rm == nil {
+		return
+	}
+	resp := &mautrix.RespJoinedMembers{Joined: make(map[id.UserID]mautrix.JoinedMember)}
+	for userID, membership := range rm.members() {
+		if membership == event.MembershipJoin {
+			content := rm.memberContent(userID)
+			resp.Joined[userID] = mautrix.JoinedMember{DisplayName: content.Displayname, AvatarURL: string(content.AvatarURL)}
+		}
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (ms *MockServer) getAlias(w http.ResponseWriter, r *http.Request) {
+	ms.lock.Lock()
+	roomID, ok := ms.aliases[id.RoomAlias(mux.Vars(r)["alias"])]
+	ms.lock.Unlock()
+	if !ok {
+		mautrix.MNotFound.WithMessage("Room alias not found").Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &mautrix.RespAliasResolve{RoomID: roomID, Servers: []string{ms.ServerName}})
+}
+
+func (ms *MockServer) putAlias(w http.ResponseWriter, r *http.Request, sess *session) {
+	var req mautrix.ReqAliasCreate
+	if !readJSON(w, r, &req) {
+		return
+	}
+	alias := id.RoomAlias(mux.Vars(r)["alias"])
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.aliases[alias]; exists {
+		mautrix.MUnknown.WithMessage("Room alias already exists").WithStatus(http.StatusConflict).Write(w)
+		return
+	} else if _, exists = ms.rooms[req.RoomID]; !exists {
+		mautrix.MNotFound.WithMessage("Room not found").Write(w)
+		return
+	}
+	ms.aliases[alias] = req.RoomID
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (ms *MockServer) deleteAlias(w http.ResponseWriter, r *http.Request, sess *session) {
+	alias := id.RoomAlias(mux.Vars(r)["alias"])
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.aliases[alias]; !exists {
+		mautrix.MNotFound.WithMessage("Room alias not found").Write(w)
+		return
+	}
+	delete(ms.aliases, alias)
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mockserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// strippedStateTypes are the state events included in invites.
+var strippedStateTypes = []event.Type{
+	event.StateCreate, event.StateJoinRules, event.StateRoomName, event.StateRoomAvatar,
+	event.StateCanonicalAlias, event.StateEncryption,
+}
+
+func parseSyncToken(token string) int64 {
+	pos, _ := strconv.ParseInt(strings.TrimPrefix(token, "s"), 10, 64)
+	return pos
+}
+
+// getSync implements /sync. Long-polling uses the mock [Clock]: if there's nothing new, the request waits
+// until something changes or the clock is advanced past the timeout.
+func (ms *MockServer) getSync(w http.ResponseWriter, r *http.Request, sess *session) {
+	query := r.URL.Query()
+	since := parseSyncToken(query.Get("since"))
+	timeoutMS, _ := strconv.Atoi(query.Get("timeout"))
+	deadline := ms.Clock.Now().Add(time.Duration(timeoutMS) * time.Millisecond)
+
+	ms.lock.Lock()
+	for {
+		resp, hasData := ms.buildSync(sess, since)
+		streamChanged := ms.streamChanged
+		ms.lock.Unlock()
+		now, clockChanged := ms.Clock.nowAndChanged()
+		if hasData || since == 0 || !now.Before(deadline) {
+			exhttp.WriteJSONResponse(w, http.StatusOK, resp)
+			return
+		}
+		select {
+		case <-streamChanged:
+		case <-clockChanged:
+		case <-r.Context().Done():
+			return
+		}
+		ms.lock.Lock()
+	}
+}
+
+// buildSync creates a sync response with everything that happened after the given stream position.
+// The caller must hold the lock.
+func (ms *MockServer) buildSync(sess *session, since int64) (*mautrix.RespSync, bool) {
+	resp := &mautrix.RespSync{
+		NextBatch: fmt.Sprintf("s%d", ms.streamPos),
+		Rooms: mautrix.RespSyncRooms{
+			Join:   make(map[id.RoomID]*mautrix.SyncJoinedRoom),
+			Invite: make(map[id.RoomID]*mautrix.SyncInvitedRoom),
+			Leave:  make(map[id.RoomID]*mautrix.SyncLeftRoom),
+		},
+	}
+	for _, rm := range ms.rooms {
+		memberEvt := rm.getState(event.StateMember, string(sess.UserID))
+		if memberEvt == nil {
+			continue
+		}
+		switch rm.membership(sess.UserID) {
+		case event.MembershipJoin:
+			// Send the full timeline for rooms that were joined after the since token
+			after := since
+			if memberEvt.Pos > since {
+				after = 0
+			}
+			events := rm.eventsBetween(after, ms.streamPos)
+			if len(events) > 0 {
+				resp.Rooms.Join[rm.ID] = &mautrix.SyncJoinedRoom{
+					Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{Events: events}},
+				}
+			}
+		case event.MembershipInvite:
+			if memberEvt.Pos > since {
+				invite := &mautrix.SyncInvitedRoom{}
+				for _, evtType := range strippedStateTypes {
+					if evt := rm.getState(evtType, ""); evt != nil {
+						invite.State.Events = append(invite.State.Events, evt.copy())
+					}
+				}
+				invite.State.Events = append(invite.State.Events, memberEvt.copy())
+				resp.Rooms.Invite[rm.ID] = invite
+			}
+		case event.MembershipLeave, event.MembershipBan:
+			if since > 0 && memberEvt.Pos > since {
+				resp.Rooms.Leave[rm.ID] = &mautrix.SyncLeftRoom{
+					Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{Events: rm.eventsBetween(since, memberEvt.Pos)}},
+				}
+			}
+		}
+	}
+	hasData := len(resp.Rooms.Join) > 0 || len(resp.Rooms.Invite) > 0 || len(resp.Rooms.Leave) > 0
+
+	usr := ms.users[sess.UserID]
+	if usr == nil {
+		return resp, hasData
+	}
+	for evtType, item := range usr.accountData {
+		if item.Pos > since {
+			resp.AccountData.Events = append(resp.AccountData.Events, &event.Event{
+				Type:    event.Type{Type: evtType, Class: event.AccountDataEventType},
+				Content: event.Content{VeryRaw: item.Content},
+			})
+		}
+	}
+	if dev := usr.devices[sess.DeviceID]; dev != nil {
+		// Messages up to the since token have been received by the client, so they can be deleted
+		pending := dev.Inbox[:0]
+		for _, msg := range dev.Inbox {
+			if msg.Pos > since {
+				pending = append(pending, msg)
+				resp.ToDevice.Events = append(resp.ToDevice.Events, msg.copy())
+			}
+		}
+		dev.Inbox = pending
+		resp.DeviceOTKCount = dev.otkCount()
+	}
+	if since > 0 {
+		for _, other := range ms.users {
+			if other.keysChangedAt > since && (other.ID == usr.ID || ms.sharesRoom(usr.ID, other.ID)) {
+				resp.DeviceLists.Changed = append(resp.DeviceLists.Changed, other.ID)
+			}
+		}
+	}
+	hasData = hasData || len(resp.AccountData.Events) > 0 || len(resp.ToDevice.Events) > 0 || len(resp.DeviceLists.Changed) > 0
+	return resp, hasData
+}
+
+// eventsBetween returns copies of the events in the timeline with a stream position in (after, until].
+func (rm *room) eventsBetween(after, until int64) []*event.Event {
+	var events []*event.Event
+	for _, evt := range rm.Timeline {
+		if evt.Pos > after && evt.Pos <= until {
+			events = append(events, evt.copy())
+		}
+	}
+	return events
+}
+
+// sharesRoom returns true if both users are joined to at least one room. The caller must hold the lock.
+func (ms *MockServer) sharesRoom(a, b id.UserID) bool {
+	for _, rm := range ms.rooms {
+		if rm.membership(a) == event.MembershipJoin && rm.membership(b) == event.MembershipJoin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/util/retryafter"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RequestRateLimiter can be set in [Client.RateLimiter] to throttle outgoing requests.
+type RequestRateLimiter interface {
+	// Wait blocks until the given request is allowed to be sent. If it returns a nil error,
+	// the returned function must be called with the response (or nil if the request failed) after the request is done.
+	// The function returns true if the rate limiter will hold back a retry of the request because of the response,
+	// in which case the client doesn't need to sleep before retrying.
+	Wait(req *http.Request) (done func(resp *http.Response) (paused bool), err error)
+}
+
+// RequestLane is the priority class of a rate-limited request. Lower values have higher priority.
+type RequestLane int
+
+const (
+	// LaneState is used for state events, membership changes and room creation.
+	LaneState RequestLane = iota
+	// LaneMessage is used for message events and redactions.
+	LaneMessage
+	// LaneReceipt is used for read receipts, read markers and typing notifications.
+	LaneReceipt
+
+	laneCount
+
+	// LaneUnlimited is used for requests that aren't queued, like reads and media.
+	LaneUnlimited RequestLane = -1
+)
+
+func (lane RequestLane) String() string {
+	switch lane {
+	case LaneState:
+		return "state"
+	case LaneMessage:
+		return "message"
+	case LaneReceipt:
+		return "receipt"
+	case LaneUnlimited:
+		return "unlimited"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassifyRequest returns the lane and room ID of a request based on its method and path.
+// It is the default value of [RateLimiter.Classify].
+func ClassifyRequest(req *http.Request) (RequestLane, id.RoomID) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return LaneUnlimited, ""
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	// Expected format: _matrix/client/<version>/...
+	if len(parts) < 4 || parts[0] != "_matrix" || parts[1] != "client" {
+		return LaneUnlimited, ""
+	}
+	parts = parts[3:]
+	switch parts[0] {
+	case "createRoom", "join":
+		return LaneState, ""
+	case "rooms":
+		if len(parts) < 3 {
+			return LaneUnlimited, ""
+		}
+		roomID := id.RoomID(parts[1])
+		switch parts[2] {
+		case "state", "join", "leave", "invite", "kick", "ban", "unban", "forget":
+			return LaneState, roomID
+		case "send", "redact":
+			return LaneMessage, roomID
+		case "receipt", "read_markers", "typing":
+			return LaneReceipt, roomID
+		}
+	}
+	return LaneUnlimited, ""
+}
+
+// DefaultRateLimitPause is how long a [RateLimiter] pauses all requests after a 429 response without a Retry-After header.
+const DefaultRateLimitPause = 5 * time.Second
+
+// DefaultReceiptShare is the default value of [RateLimiter.ReceiptShare].
+const DefaultReceiptShare = 0.1
+
+// RateLimiter is a token bucket request scheduler that can be shared between many [Client]s.
+//
+// Requests are sorted into priority lanes (see [RequestLane]). When a token is available, the oldest request
+// of the highest priority lane is sent, with rooms in each lane taking turns so a single busy room can't
+// starve the others. The receipt lane is guaranteed a minimum share of the requests (see [RateLimiter.ReceiptShare]).
+// When the homeserver returns a 429 error, all requests are paused for the duration of the Retry-After header.
+//
+// The scheduler runs in a background goroutine, which is stopped with [RateLimiter.Stop].
+type RateLimiter struct {
+	// Classify returns the lane and room ID of a request.
+	Classify func(req *http.Request) (RequestLane, id.RoomID)
+	// ReceiptShare is the minimum fraction of requests that go to the receipt lane while it has queued requests,
+	// so that a steady stream of state and message requests can't starve receipts and typing notifications.
+	// It must not be changed after the first request. Zero disables the minimum.
+	ReceiptShare float64
+	// OnSend is called when a queued request is allowed through. It's called with the lock held, so it must not block.
+	OnSend func(lane RequestLane, wait time.Duration)
+	// OnRateLimited is called when the homeserver returns a 429 error.
+	OnRateLimited func(pause time.Duration)
+
+	rate  float64
+	burst float64
+
+	lock        sync.Mutex
+	tokens      float64
+	lastRefill  time.Time
+	pausedUntil time.Time
+	lanes       [laneCount]rateLimitLane
+	pending     int
+	wakeup      chan struct{}
+	startOnce   sync.Once
+	stopped     bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+
+	// receiptsSkipped is the number of requests sent from other lanes while the receipt lane had queued requests.
+	receiptsSkipped int
+
+	stats RateLimiterStats
+}
+
+// RateLimiterStats contains counters about the requests that have gone through a [RateLimiter].
+type RateLimiterStats struct {
+	Queued      map[RequestLane]int
+	Sent        map[RequestLane]uint64
+	TotalWait   map[RequestLane]time.Duration
+	RateLimited uint64
+}
+
+type rateLimitLane struct {
+	rooms map[id.RoomID][]*rateLimitWaiter
+	order []id.RoomID
+}
+
+type rateLimitWaiter struct {
+	lane     RequestLane
+	queuedAt time.Time
+	state    atomic.Int32
+	ch       chan struct{}
+}
+
+const (
+	waiterPending int32 = iota
+	waiterGranted
+	waiterCancelled
+)
+
+var _ RequestRateLimiter = (*RateLimiter)(nil)
+
+// NewRateLimiter creates a new rate limiter that allows the given number of requests per second on average
+// with bursts of up to burst requests.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &RateLimiter{
+		Classify:     ClassifyRequest,
+		ReceiptShare: DefaultReceiptShare,
+		rate:         requestsPerSecond,
+		burst:        float64(burst),
+		tokens:       float64(burst),
+		lastRefill:   time.Now(),
+		wakeup:       make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		stats: RateLimiterStats{
+			Sent:      make(map[RequestLane]uint64),
+			TotalWait: make(map[RequestLane]time.Duration),
+		},
+	}
+	for i := range rl.lanes {
+		rl.lanes[i].rooms = make(map[id.RoomID][]*rateLimitWaiter)
+	}
+	return rl
+}
+
+func (rl *RateLimiter) Wait(req *http.Request) (func(*http.Response) bool, error) {
+	lane, roomID := rl.Classify(req)
+	if lane < 0 || lane >= laneCount {
+		return rl.observeUnlimitedResponse, nil
+	}
+	rl.startOnce.Do(func() {
+		go rl.run()
+	})
+	waiter := &rateLimitWaiter{lane: lane, queuedAt: time.Now(), ch: make(chan struct{})}
+	rl.lock.Lock()
+	if rl.stopped {
+		rl.lock.Unlock()
+		return rl.observeUnlimitedResponse, nil
+	}
+	queue := &rl.lanes[lane]
+	if _, ok := queue.rooms[roomID]; !ok {
+		queue.order = append(queue.order, roomID)
+	}
+	queue.rooms[roomID] = append(queue.rooms[roomID], waiter)
+	rl.pending++
+	rl.lock.Unlock()
+	select {
+	case rl.wakeup <- struct{}{}:
+	default:
+	}
+	select {
+	case <-waiter.ch:
+		return rl.observeResponse, nil
+	case <-req.Context().Done():
+		waiter.state.CompareAndSwap(waiterPending, waiterCancelled)
+		return nil, req.Context().Err()
+	}
+}
+
+// observeResponse pauses the queue if the homeserver returned a 429 error. It returns true if the queue was paused.
+func (rl *RateLimiter) observeResponse(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	pause := retryafter.Parse(resp.Header.Get("Retry-After"), DefaultRateLimitPause)
+	rl.lock.Lock()
+	if rl.stopped {
+		rl.lock.Unlock()
+		return false
+	}
+	if until := time.Now().Add(pause); until.After(rl.pausedUntil) {
+		rl.pausedUntil = until
+	}
+	rl.stats.RateLimited++
+	rl.lock.Unlock()
+	if rl.OnRateLimited != nil {
+		rl.OnRateLimited(pause)
+	}
+	return true
+}
+
+// observeUnlimitedResponse is like observeResponse, but for requests that don't go through the queue.
+// Retries of those requests aren't held back by the pause, so it always returns false.
+func (rl *RateLimiter) observeUnlimitedResponse(resp *http.Response) bool {
+	rl.observeResponse(resp)
+	return false
+}
+
+// Stop stops the background scheduler of the rate limiter. Requests that are still queued are let through,
+// and requests made after stopping aren't throttled anymore. It's safe to call Stop multiple times.
+func (rl *RateLimiter) Stop() {
+	rl.stopOnce.Do(func() {
+		rl.lock.Lock()
+		rl.stopped = true
+		for i := range rl.lanes {
+			for _, waiters := range rl.lanes[i].rooms {
+				for _, waiter := range waiters {
+					if waiter.state.CompareAndSwap(waiterPending, waiterGranted) {
+						close(waiter.ch)
+					}
+				}
+			}
+			rl.lanes[i].rooms = make(map[id.RoomID][]*rateLimitWaiter)
+			rl.lanes[i].order = nil
+		}
+		rl.pending = 0
+		rl.lock.Unlock()
+		close(rl.stop)
+	})
+}
+
+// Stats returns a snapshot of the rate limiter's counters.
+func (rl *RateLimiter) Stats() RateLimiterStats {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	stats := RateLimiterStats{
+		Queued:      make(map[RequestLane]int, laneCount),
+		Sent:        make(map[RequestLane]uint64, len(rl.stats.Sent)),
+		TotalWait:   make(map[RequestLane]time.Duration, len(rl.stats.TotalWait)),
+		RateLimited: rl.stats.RateLimited,
+	}
+	for lane := range rl.lanes {
+		count := 0
+		for _, waiters := range rl.lanes[lane].rooms {
+			count += len(waiters)
+		}
+		stats.Queued[RequestLane(lane)] = count
+	}
+	for lane, count := range rl.stats.Sent {
+		stats.Sent[lane] = count
+	}
+	for lane, wait := range rl.stats.TotalWait {
+		stats.TotalWait[lane] = wait
+	}
+	return stats
+}
+
+func (rl *RateLimiter) refill(now time.Time) {
+	rl.tokens += now.Sub(rl.lastRefill).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.lastRefill = now
+}
+
+// timeUntilToken returns how long to wait until the next request can be sent.
+func (rl *RateLimiter) timeUntilToken(now time.Time) time.Duration {
+	if now.Before(rl.pausedUntil) {
+		return rl.pausedUntil.Sub(now)
+	} else if rl.tokens >= 1 {
+		return 0
+	} else if rl.rate <= 0 {
+		return time.Second
+	}
+	return time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
+
+// popNext removes the next waiter from the highest priority non-empty lane,
+// unless the receipt lane has been skipped too many times and is due for its share.
+func (rl *RateLimiter) popNext() *rateLimitWaiter {
+	receiptsWaiting := len(rl.lanes[LaneReceipt].order) > 0
+	if receiptsWaiting && rl.ReceiptShare > 0 && float64(rl.receiptsSkipped+1)*rl.ReceiptShare >= 1 {
+		if waiter := rl.popLane(LaneReceipt); waiter != nil {
+			rl.receiptsSkipped = 0
+			return waiter
+		}
+	}
+	for i := range rl.lanes {
+		if waiter := rl.popLane(RequestLane(i)); waiter != nil {
+			if waiter.lane == LaneReceipt || !receiptsWaiting {
+				rl.receiptsSkipped = 0
+			} else {
+				rl.receiptsSkipped++
+			}
+			return waiter
+		}
+	}
+	return nil
+}
+
+// popLane removes the next waiter from the given lane, rotating between rooms.
+func (rl *RateLimiter) popLane(lane RequestLane) *rateLimitWaiter {
+	queue := &rl.lanes[lane]
+	for len(queue.order) > 0 {
+		roomID := queue.order[0]
+		queue.order = queue.order[1:]
+		waiters := queue.rooms[roomID]
+		waiter := waiters[0]
+		if len(waiters) > 1 {
+			queue.rooms[roomID] = waiters[1:]
+			queue.order = append(queue.order, roomID)
+		} else {
+			delete(queue.rooms, roomID)
+		}
+		rl.pending--
+		if waiter.state.CompareAndSwap(waiterPending, waiterGranted) {
+			return waiter
+		}
+	}
+	return nil
+}
+
+func (rl *RateLimiter) run() {
+	for {
+		rl.lock.Lock()
+		if rl.pending == 0 {
+			rl.lock.Unlock()
+			select {
+			case <-rl.wakeup:
+			case <-rl.stop:
+				return
+			}
+			continue
+		}
+		now := time.Now()
+		rl.refill(now)
+		if delay := rl.timeUntilToken(now); delay > 0 {
+			rl.lock.Unlock()
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-rl.stop:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		waiter := rl.popNext()
+		if waiter != nil {
+			rl.tokens--
+			wait := now.Sub(waiter.queuedAt)
+			rl.stats.Sent[waiter.lane]++
+			rl.stats.TotalWait[waiter.lane] += wait
+			if rl.OnSend != nil {
+				rl.OnSend(waiter.lane, wait)
+			}
+			close(waiter.ch)
+		}
+		rl.lock.Unlock()
+	}
+}
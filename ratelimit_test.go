@@ -0,0 +1,219 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		lane   mautrix.RequestLane
+		roomID id.RoomID
+	}{
+		{http.MethodPut, "/_matrix/client/v3/rooms/!a:example.com/send/m.room.message/txn", mautrix.LaneMessage, "!a:example.com"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/!a:example.com/state/m.room.name/", mautrix.LaneState, "!a:example.com"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/!a:example.com/invite", mautrix.LaneState, "!a:example.com"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/!a:example.com/receipt/m.read/$evt", mautrix.LaneReceipt, "!a:example.com"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/!a:example.com/typing/@user:example.com", mautrix.LaneReceipt, "!a:example.com"},
+		{http.MethodPost, "/_matrix/client/v3/createRoom", mautrix.LaneState, ""},
+		{http.MethodGet, "/_matrix/client/v3/rooms/!a:example.com/state/m.room.name/", mautrix.LaneUnlimited, ""},
+		{http.MethodPost, "/_matrix/media/v3/upload", mautrix.LaneUnlimited, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		lane, roomID := mautrix.ClassifyRequest(req)
+		assert.Equal(t, test.lane, lane, test.path)
+		assert.Equal(t, test.roomID, roomID, test.path)
+	}
+}
+
+func TestRateLimiter_Order(t *testing.T) {
+	rl := mautrix.NewRateLimiter(20, 1)
+	// Pause the limiter so that all the requests below end up in the queue
+	done, err := rl.Wait(httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/sync", nil))
+	require.NoError(t, err)
+	done(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}})
+
+	requests := []struct {
+		name string
+		path string
+	}{
+		{"msgA1", "/_matrix/client/v3/rooms/!a/send/m.room.message/1"},
+		{"msgA2", "/_matrix/client/v3/rooms/!a/send/m.room.message/2"},
+		{"msgA3", "/_matrix/client/v3/rooms/!a/send/m.room.message/3"},
+		{"receiptA", "/_matrix/client/v3/rooms/!a/receipt/m.read/$evt"},
+		{"msgB1", "/_matrix/client/v3/rooms/!b/send/m.room.message/1"},
+		{"stateB", "/_matrix/client/v3/rooms/!b/state/m.room.name/"},
+	}
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rl.Wait(httptest.NewRequest(http.MethodPut, req.path, nil))
+			assert.NoError(t, err)
+			lock.Lock()
+			order = append(order, req.name)
+			lock.Unlock()
+		}()
+		// Wait for the request to be queued to make the queue order deterministic
+		require.Eventually(t, func() bool {
+			total := 0
+			for _, count := range rl.Stats().Queued {
+				total += count
+			}
+			return total == i+1
+		}, time.Second, time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"stateB", "msgA1", "msgB1", "msgA2", "msgA3", "receiptA"}, order)
+	stats := rl.Stats()
+	assert.EqualValues(t, 1, stats.RateLimited)
+	assert.EqualValues(t, 3+1, stats.Sent[mautrix.LaneMessage])
+}
+
+func TestRateLimiter_ReceiptShare(t *testing.T) {
+	rl := mautrix.NewRateLimiter(1000, 1)
+	done, err := rl.Wait(httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/sync", nil))
+	require.NoError(t, err)
+	done(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}})
+
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	queue := func(name, path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rl.Wait(httptest.NewRequest(http.MethodPut, path, nil))
+			assert.NoError(t, err)
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		}()
+	}
+	queue("receipt", "/_matrix/client/v3/rooms/!a/receipt/m.read/$evt")
+	for i := 0; i < 20; i++ {
+		queue("message", "/_matrix/client/v3/rooms/!a/send/m.room.message/"+strconv.Itoa(i))
+	}
+	require.Eventually(t, func() bool {
+		return rl.Stats().Queued[mautrix.LaneMessage] == 20 && rl.Stats().Queued[mautrix.LaneReceipt] == 1
+	}, time.Second, time.Millisecond)
+	wg.Wait()
+	assert.Equal(t, 9, slices.Index(order, "receipt"), "receipts should get every 10th request")
+}
+
+func TestRateLimiter_Stop(t *testing.T) {
+	rl := mautrix.NewRateLimiter(0.001, 1)
+	path := "/_matrix/client/v3/rooms/!a/send/m.room.message/1"
+	_, err := rl.Wait(httptest.NewRequest(http.MethodPut, path, nil))
+	require.NoError(t, err)
+	waitErr := make(chan error, 1)
+	go func() {
+		_, err := rl.Wait(httptest.NewRequest(http.MethodPut, path, nil))
+		waitErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		return rl.Stats().Queued[mautrix.LaneMessage] == 1
+	}, time.Second, time.Millisecond)
+	rl.Stop()
+	select {
+	case err = <-waitErr:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Queued request wasn't released after stopping")
+	}
+	_, err = rl.Wait(httptest.NewRequest(http.MethodPut, path, nil))
+	assert.NoError(t, err)
+	rl.Stop()
+}
+
+func TestRateLimiter_Cancel(t *testing.T) {
+	rl := mautrix.NewRateLimiter(0.001, 1)
+	path := "/_matrix/client/v3/rooms/!a/send/m.room.message/1"
+	_, err := rl.Wait(httptest.NewRequest(http.MethodPut, path, nil))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rl.Wait(httptest.NewRequest(http.MethodPut, path, nil).WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClient_RateLimiter429(t *testing.T) {
+	var lock sync.Mutex
+	var requestTimes []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestTimes = append(requestTimes, time.Now())
+		first := len(requestTimes) == 1
+		lock.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"event_id":"$evt"}`))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 1
+	cli.RateLimiter = mautrix.NewRateLimiter(100, 10)
+	resp, err := cli.SendText(context.Background(), "!a", "hello")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$evt"), resp.EventID)
+	require.Len(t, requestTimes, 2)
+	assert.GreaterOrEqual(t, requestTimes[1].Sub(requestTimes[0]), 900*time.Millisecond)
+	assert.Less(t, requestTimes[1].Sub(requestTimes[0]), 1900*time.Millisecond)
+}
+
+func TestClient_RateLimiter429Unlimited(t *testing.T) {
+	var lock sync.Mutex
+	var requestTimes []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestTimes = append(requestTimes, time.Now())
+		first := len(requestTimes) == 1
+		lock.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 1
+	cli.RateLimiter = mautrix.NewRateLimiter(100, 10)
+	// GET requests don't go through the rate limiter queue, so the client must still respect Retry-After itself
+	_, err = cli.Whoami(context.Background())
+	require.NoError(t, err)
+	require.Len(t, requestTimes, 2)
+	assert.GreaterOrEqual(t, requestTimes[1].Sub(requestTimes[0]), 900*time.Millisecond)
+}
@@ -138,6 +138,20 @@ type ReqRedact struct {
 	Extra  map[string]interface{}
 }
 
+// DelayedEventAction is an action that can be applied to a delayed event (MSC4140).
+type DelayedEventAction string
+
+const (
+	DelayedEventActionCancel  DelayedEventAction = "cancel"
+	DelayedEventActionRestart DelayedEventAction = "restart"
+	DelayedEventActionSend    DelayedEventAction = "send"
+)
+
+// ReqUpdateDelayedEvent is the JSON request for MSC4140's POST /delayed_events/{delay_id}.
+type ReqUpdateDelayedEvent struct {
+	Action DelayedEventAction `json:"action"`
+}
+
 type ReqMembers struct {
 	At            string           `json:"at"`
 	Membership    event.Membership `json:"membership,omitempty"`
@@ -98,6 +98,25 @@ type RespContext struct {
 // RespSendEvent is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidsendeventtypetxnid
 type RespSendEvent struct {
 	EventID id.EventID `json:"event_id"`
+
+	UnstableDelayID string `json:"delay_id,omitempty"`
+}
+
+// RespDelayedEvents is the JSON response for MSC4140's GET /delayed_events.
+type RespDelayedEvents struct {
+	DelayedEvents []*DelayedEvent `json:"delayed_events"`
+	NextBatch     string          `json:"next_batch,omitempty"`
+}
+
+// DelayedEvent is a single scheduled event in a [RespDelayedEvents] response.
+type DelayedEvent struct {
+	DelayID      string             `json:"delay_id"`
+	RoomID       id.RoomID          `json:"room_id"`
+	Type         event.Type         `json:"type"`
+	StateKey     *string            `json:"state_key,omitempty"`
+	Delay        int64              `json:"delay"`
+	RunningSince jsontime.UnixMilli `json:"running_since"`
+	Content      json.RawMessage    `json:"content"`
 }
 
 // RespMediaConfig is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixmediav3config
@@ -634,6 +653,47 @@ type StrippedStateWithTime struct {
 	Timestamp jsontime.UnixMilli `json:"origin_server_ts"`
 }
 
+// ThirdPartyProtocol describes a third-party network that can be bridged.
+// See https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           id.ContentURIString            `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []*ThirdPartyProtocolInstance  `json:"instances"`
+}
+
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+type ThirdPartyProtocolInstance struct {
+	Description string              `json:"desc"`
+	Icon        id.ContentURIString `json:"icon,omitempty"`
+	Fields      map[string]any      `json:"fields"`
+	NetworkID   string              `json:"network_id"`
+	// InstanceID is added by the homeserver and is only present in client-server API responses.
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// RespThirdPartyProtocols is the JSON response for https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv3thirdpartyprotocols
+type RespThirdPartyProtocols map[string]*ThirdPartyProtocol
+
+// ThirdPartyLocation is a Matrix room alias that is bridged to a third-party location.
+type ThirdPartyLocation struct {
+	Alias    id.RoomAlias   `json:"alias"`
+	Protocol string         `json:"protocol"`
+	Fields   map[string]any `json:"fields"`
+}
+
+// ThirdPartyUser is a Matrix user ID that is bridged to a third-party user.
+type ThirdPartyUser struct {
+	UserID   id.UserID      `json:"userid"`
+	Protocol string         `json:"protocol"`
+	Fields   map[string]any `json:"fields"`
+}
+
 type RespAppservicePing struct {
 	DurationMS int64 `json:"duration_ms"`
 }
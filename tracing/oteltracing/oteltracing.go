@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package oteltracing implements the [tracing.Tracer] interface using OpenTelemetry.
+//
+// To send spans to an OpenTelemetry collector, set up a tracer provider and pass a tracer from it to [New]:
+//
+//	tracing.SetTracer(oteltracing.New(otel.Tracer("maunium.net/go/mautrix")))
+package oteltracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"maunium.net/go/mautrix/tracing"
+)
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+var _ tracing.Tracer = (*otelTracer)(nil)
+
+// New wraps the given OpenTelemetry tracer into a [tracing.Tracer].
+func New(tracer trace.Tracer) tracing.Tracer {
+	return &otelTracer{tracer: tracer}
+}
+
+func (ot *otelTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	ctx, span := ot.tracer.Start(ctx, name, trace.WithAttributes(convertAttributes(attrs)...))
+	return ctx, otelSpan{span}
+}
+
+func (ot *otelTracer) Propagate(from, to context.Context) context.Context {
+	span := trace.SpanFromContext(from)
+	if !span.SpanContext().IsValid() {
+		return to
+	}
+	return trace.ContextWithSpan(to, span)
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttributes(attrs ...tracing.Attribute) {
+	s.span.SetAttributes(convertAttributes(attrs)...)
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+func convertAttributes(attrs []tracing.Attribute) []attribute.KeyValue {
+	converted := make([]attribute.KeyValue, len(attrs))
+	for i, attr := range attrs {
+		converted[i] = convertAttribute(attr)
+	}
+	return converted
+}
+
+func convertAttribute(attr tracing.Attribute) attribute.KeyValue {
+	switch value := attr.Value.(type) {
+	case string:
+		return attribute.String(attr.Key, value)
+	case int:
+		return attribute.Int(attr.Key, value)
+	case int64:
+		return attribute.Int64(attr.Key, value)
+	case bool:
+		return attribute.Bool(attr.Key, value)
+	default:
+		return attribute.String(attr.Key, fmt.Sprint(value))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oteltracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"maunium.net/go/mautrix/tracing"
+	"maunium.net/go/mautrix/tracing/oteltracing"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := oteltracing.New(provider.Tracer("test"))
+
+	ctx, rootSpan := tracer.Start(context.Background(), "root", tracing.String("key", "value"), tracing.Int("count", 5))
+	queued := tracer.Propagate(ctx, context.Background())
+	_, childSpan := tracer.Start(queued, "child", tracing.Bool("flag", true))
+	childSpan.SetAttributes(tracing.Int64("size", 1234))
+	tracing.End(childSpan, errors.New("meow"))
+	tracing.End(rootSpan, nil)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	child, root := spans[0], spans[1]
+	assert.Equal(t, "root", root.Name())
+	assert.Equal(t, "child", child.Name())
+	assert.Equal(t, root.SpanContext().TraceID(), child.SpanContext().TraceID())
+	assert.Equal(t, root.SpanContext().SpanID(), child.Parent().SpanID())
+	assert.Contains(t, root.Attributes(), attribute.String("key", "value"))
+	assert.Contains(t, root.Attributes(), attribute.Int("count", 5))
+	assert.Contains(t, child.Attributes(), attribute.Bool("flag", true))
+	assert.Contains(t, child.Attributes(), attribute.Int64("size", 1234))
+	assert.Equal(t, codes.Error, child.Status().Code)
+	assert.Equal(t, "meow", child.Status().Description)
+	assert.Equal(t, codes.Unset, root.Status().Code)
+}
+
+func TestPropagateWithoutSpan(t *testing.T) {
+	tracer := oteltracing.New(sdktrace.NewTracerProvider().Tracer("test"))
+	to := context.WithValue(context.Background(), struct{}{}, "meow")
+	assert.Equal(t, to, tracer.Propagate(context.Background(), to))
+}
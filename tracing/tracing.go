@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tracing contains a minimal tracing abstraction used to create spans around HTTP requests
+// and bridge event handling.
+//
+// By default, all spans are no-ops. To enable tracing, pass a [Tracer] to [SetTracer] before starting
+// the client or bridge. The oteltracing subpackage contains a Tracer backed by OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Attribute is a single key-value pair attached to a span.
+type Attribute struct {
+	Key string
+	// Value is a string, int, int64 or bool.
+	Value any
+}
+
+// String creates a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int creates an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 creates an integer attribute.
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool creates a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a single traced operation. Spans must be ended by calling End.
+type Span interface {
+	// SetAttributes adds attributes to the span, overriding any previous values with the same key.
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span as failed with the given error.
+	RecordError(err error)
+	// End finishes the span.
+	End()
+}
+
+// Tracer creates spans.
+type Tracer interface {
+	// Start creates a new span as a child of the span in the given context (if any).
+	// The returned context must contain the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	// Propagate returns a copy of the target context that contains the span from the source context.
+	// This is used to continue traces when events are passed between goroutines, such as through queues.
+	Propagate(from, to context.Context) context.Context
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Propagate(_, to context.Context) context.Context {
+	return to
+}
+
+// NoopTracer is a tracer that doesn't record anything. It's the default tracer.
+var NoopTracer Tracer = noopTracer{}
+
+type tracerHolder struct {
+	Tracer
+}
+
+var globalTracer atomic.Pointer[tracerHolder]
+
+func init() {
+	globalTracer.Store(&tracerHolder{NoopTracer})
+}
+
+// SetTracer sets the global tracer. Passing nil resets the tracer to [NoopTracer].
+func SetTracer(tracer Tracer) {
+	if tracer == nil {
+		tracer = NoopTracer
+	}
+	globalTracer.Store(&tracerHolder{tracer})
+}
+
+// GetTracer returns the current global tracer.
+func GetTracer() Tracer {
+	return globalTracer.Load().Tracer
+}
+
+// Start creates a new span using the global tracer.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return GetTracer().Start(ctx, name, attrs...)
+}
+
+// Propagate copies the span from one context to another using the global tracer.
+func Propagate(from, to context.Context) context.Context {
+	if from == nil {
+		return to
+	}
+	return GetTracer().Propagate(from, to)
+}
+
+// End ends the span after recording the given error, if it's non-nil.
+// It's meant to be used with a named error return value in a defer statement.
+func End(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
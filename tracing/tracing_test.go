@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/tracing"
+)
+
+type spanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...tracing.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+type testTracer struct{}
+
+func (testTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: make(map[string]any)}
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (testTracer) Propagate(from, to context.Context) context.Context {
+	if span, ok := from.Value(spanKey{}).(*testSpan); ok {
+		return context.WithValue(to, spanKey{}, span)
+	}
+	return to
+}
+
+func TestNoopTracer(t *testing.T) {
+	ctx := context.Background()
+	newCtx, span := tracing.Start(ctx, "test")
+	assert.Equal(t, ctx, newCtx)
+	tracing.End(span, errors.New("meow"))
+	assert.Equal(t, ctx, tracing.Propagate(newCtx, ctx))
+}
+
+func TestSetTracer(t *testing.T) {
+	tracing.SetTracer(testTracer{})
+
+	ctx, rootSpan := tracing.Start(context.Background(), "root", tracing.String("key", "value"))
+	queued := tracing.Propagate(ctx, context.Background())
+	_, childSpan := tracing.Start(queued, "child", tracing.Int("count", 5))
+	testErr := errors.New("meow")
+	tracing.End(childSpan, testErr)
+	tracing.End(rootSpan, nil)
+
+	root := rootSpan.(*testSpan)
+	child := childSpan.(*testSpan)
+	assert.Equal(t, root, child.parent)
+	assert.Equal(t, "value", root.attrs["key"])
+	assert.Equal(t, 5, child.attrs["count"])
+	assert.Equal(t, testErr, child.err)
+	assert.NoError(t, root.err)
+	assert.True(t, root.ended)
+	assert.True(t, child.ended)
+
+	tracing.SetTracer(nil)
+	assert.Equal(t, tracing.NoopTracer, tracing.GetTracer())
+}